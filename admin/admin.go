@@ -0,0 +1,64 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package admin is the runtime control channel of a rend server. Endpoints are registered under
+// /admin/ on the default HTTP mux, which memproxy serves on localhost only, next to the metrics
+// and pprof endpoints.
+package admin
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const prefix = "/admin/"
+
+var (
+	endpoints     = make(map[string]struct{})
+	endpointsLock = new(sync.Mutex)
+)
+
+func init() {
+	http.HandleFunc(prefix, list)
+}
+
+// Handle registers an admin endpoint at /admin/<name>
+func Handle(name string, h http.Handler) {
+	endpointsLock.Lock()
+	endpoints[name] = struct{}{}
+	endpointsLock.Unlock()
+
+	http.Handle(prefix+name, h)
+}
+
+// list shows the registered endpoints at /admin/ itself
+func list(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != prefix {
+		http.NotFound(w, r)
+		return
+	}
+
+	endpointsLock.Lock()
+	names := make([]string, 0, len(endpoints))
+	for name := range endpoints {
+		names = append(names, prefix+name)
+	}
+	endpointsLock.Unlock()
+
+	sort.Strings(names)
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(strings.Join(names, "\n") + "\n"))
+}
@@ -0,0 +1,237 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Health reports whether the server is alive, whether it's ready for traffic, and how each of the
+// things it depends on is doing, with the reason for anything that isn't healthy. Dependencies are
+// checked in the background by Run, so probes from load balancers and Kubernetes never wait on a
+// backend and can come as often as they like.
+//
+// The server is live as long as the checks keep finishing; a check loop that's stuck for three
+// intervals means the process is wedged and should be restarted. It's ready when its Readiness is
+// and every critical dependency is healthy. Dependencies that aren't critical, like a backend that
+// failed over to its standby, are reported without taking the server out of service.
+type Health struct {
+	ready *Readiness
+
+	lock     sync.RWMutex
+	deps     []*dependency
+	interval time.Duration
+	// last is when the last round of checks finished
+	last time.Time
+}
+
+type dependency struct {
+	name     string
+	critical bool
+	check    func() error
+
+	healthy bool
+	reason  string
+	since   time.Time
+}
+
+// DependencyStatus is how one dependency did in its last check
+type DependencyStatus struct {
+	Name     string `json:"name"`
+	Critical bool   `json:"critical"`
+	Healthy  bool   `json:"healthy"`
+	Reason   string `json:"reason,omitempty"`
+	// Since is when the dependency became healthy or unhealthy
+	Since time.Time `json:"since"`
+}
+
+// HealthStatus is the state of the server and its dependencies
+type HealthStatus struct {
+	Live  bool `json:"live"`
+	Ready bool `json:"ready"`
+	// Reasons are why the server isn't live or ready
+	Reasons      []string           `json:"reasons,omitempty"`
+	LastChecked  time.Time          `json:"last_checked"`
+	Dependencies []DependencyStatus `json:"dependencies"`
+}
+
+// NewHealth creates a Health that's ready when ready is, once its dependencies check out
+func NewHealth(ready *Readiness) *Health {
+	return &Health{ready: ready}
+}
+
+// AddDependency adds a dependency that's healthy when check returns nil, and unhealthy for the
+// reason in its error otherwise. Dependencies count as unhealthy until their first check. It must
+// be called before Run.
+func (h *Health) AddDependency(name string, critical bool, check func() error) {
+	h.lock.Lock()
+	h.deps = append(h.deps, &dependency{
+		name:     name,
+		critical: critical,
+		check:    check,
+		reason:   "not checked yet",
+		since:    time.Now(),
+	})
+	h.lock.Unlock()
+}
+
+// Run checks every dependency once per interval, forever. A check that takes longer than the
+// interval fails, and the next round waits for it to return.
+func (h *Health) Run(interval time.Duration) {
+	h.lock.Lock()
+	h.interval = interval
+	h.lock.Unlock()
+
+	for {
+		h.checkAll(interval)
+		time.Sleep(interval)
+	}
+}
+
+func (h *Health) checkAll(timeout time.Duration) {
+	h.lock.RLock()
+	deps := append([]*dependency(nil), h.deps...)
+	h.lock.RUnlock()
+
+	errs := make([]error, len(deps))
+	wg := new(sync.WaitGroup)
+	for i, d := range deps {
+		wg.Add(1)
+		go func(i int, d *dependency) {
+			defer wg.Done()
+			errs[i] = runCheck(d.check, timeout)
+		}(i, d)
+	}
+	wg.Wait()
+
+	now := time.Now()
+	h.lock.Lock()
+	for i, d := range deps {
+		healthy := errs[i] == nil
+		if healthy != d.healthy {
+			d.since = now
+		}
+		d.healthy = healthy
+		d.reason = ""
+		if !healthy {
+			d.reason = errs[i].Error()
+		}
+	}
+	h.last = now
+	h.lock.Unlock()
+}
+
+// runCheck fails the check if it doesn't return within the timeout, but it still has to return
+// before the next round starts
+func runCheck(check func() error, timeout time.Duration) error {
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() { done <- check() }()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case err := <-done:
+		return err
+	case <-t.C:
+		err := <-done
+		if err == nil {
+			err = fmt.Errorf("check took %v", time.Since(start).Round(time.Millisecond))
+		}
+		return err
+	}
+}
+
+// Status returns the state of the server and its dependencies as of the last checks
+func (h *Health) Status() HealthStatus {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	s := HealthStatus{
+		Live:         true,
+		Ready:        true,
+		LastChecked:  h.last,
+		Dependencies: make([]DependencyStatus, 0, len(h.deps)),
+	}
+
+	if h.interval > 0 && !h.last.IsZero() && time.Since(h.last) > 3*h.interval {
+		s.Live = false
+		s.Ready = false
+		s.Reasons = append(s.Reasons, fmt.Sprintf("health checks haven't finished since %v", h.last.Format(time.RFC3339)))
+	}
+
+	if ready, reason := h.ready.IsReady(); !ready {
+		s.Ready = false
+		s.Reasons = append(s.Reasons, reason)
+	}
+
+	for _, d := range h.deps {
+		s.Dependencies = append(s.Dependencies, DependencyStatus{
+			Name:     d.name,
+			Critical: d.critical,
+			Healthy:  d.healthy,
+			Reason:   d.reason,
+			Since:    d.since,
+		})
+		if d.critical && !d.healthy {
+			s.Ready = false
+			s.Reasons = append(s.Reasons, d.name+": "+d.reason)
+		}
+	}
+
+	return s
+}
+
+// ServeHTTP answers with the whole status as JSON, with a 503 if the server isn't ready
+func (h *Health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s := h.Status()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !s.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(s)
+}
+
+// Live answers 200 while the server is live and 503 with the reasons when it isn't, for liveness
+// probes
+func (h *Health) Live(w http.ResponseWriter, r *http.Request) {
+	s := h.Status()
+	probe(w, s.Live, "live", s.Reasons)
+}
+
+// Ready answers 200 while the server is ready and 503 with the reasons when it isn't, for
+// readiness probes and load balancer health checks
+func (h *Health) Ready(w http.ResponseWriter, r *http.Request) {
+	s := h.Status()
+	probe(w, s.Ready, "ready", s.Reasons)
+}
+
+func probe(w http.ResponseWriter, ok bool, state string, reasons []string) {
+	w.Header().Set("Content-Type", "text/plain")
+
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(strings.Join(reasons, "\n") + "\n"))
+		return
+	}
+	w.Write([]byte(state + "\n"))
+}
@@ -0,0 +1,79 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/admin"
+)
+
+func TestHealth(t *testing.T) {
+	ready := admin.NewReadiness("warming up")
+	h := admin.NewHealth(ready)
+
+	var down int32 = 1
+	h.AddDependency("backend", true, func() error {
+		if atomic.LoadInt32(&down) == 1 {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	h.AddDependency("standby", false, func() error { return errors.New("failed over") })
+	go h.Run(5 * time.Millisecond)
+
+	// waits for a round of checks that started after the call
+	settle := func() admin.HealthStatus {
+		start := time.Now()
+		for {
+			if s := h.Status(); s.LastChecked.After(start) {
+				return s
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	code := func(f http.HandlerFunc) int {
+		w := httptest.NewRecorder()
+		f(w, httptest.NewRequest("GET", "/", nil))
+		return w.Code
+	}
+
+	s := settle()
+	if !s.Live || s.Ready || len(s.Reasons) != 2 || s.Reasons[0] != "warming up" || s.Reasons[1] != "backend: connection refused" {
+		t.Fatalf("Unexpected status before warm-up %+v", s)
+	}
+	if code(h.Live) != 200 || code(h.Ready) != 503 || code(h.ServeHTTP) != 503 {
+		t.Fatal("Expected a live server that isn't ready")
+	}
+
+	ready.Ready()
+	atomic.StoreInt32(&down, 0)
+
+	s = settle()
+	if !s.Ready || len(s.Reasons) != 0 {
+		t.Fatalf("Expected a ready server with a failed over standby, got %+v", s)
+	}
+	if d := s.Dependencies[1]; d.Healthy || d.Critical || d.Reason != "failed over" {
+		t.Fatalf("Unexpected standby status %+v", d)
+	}
+	if code(h.Ready) != 200 || code(h.ServeHTTP) != 200 {
+		t.Fatal("Expected a ready server")
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/netflix/rend/handlers"
+)
+
+// Purger deletes every key under a prefix from each of the storage tiers added to it, e.g. to drop
+// a whole namespace after a launch without flushing everything else. It only works for tiers whose
+// handlers can list their keys, see handlers.KeyLister.
+//
+// POST /admin/purge?prefix=catalog:v3: deletes the keys, and adding expire=true touches them to
+// expire in a second instead. tier=<name> limits the purge to one tier.
+type Purger struct {
+	lock  sync.Mutex
+	names []string
+	tiers map[string]handlers.HandlerConst
+}
+
+// NewPurger creates a Purger without any tiers
+func NewPurger() *Purger {
+	return &Purger{tiers: make(map[string]handlers.HandlerConst)}
+}
+
+// Add makes a tier available to purge under the given name
+func (p *Purger) Add(name string, h handlers.HandlerConst) {
+	p.lock.Lock()
+	p.names = append(p.names, name)
+	p.tiers[name] = h
+	p.lock.Unlock()
+}
+
+func (p *Purger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "purges must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	prefix := r.FormValue("prefix")
+	if prefix == "" {
+		http.Error(w, "a prefix is required, an empty one would purge everything", http.StatusBadRequest)
+		return
+	}
+
+	expire := false
+	if e := r.FormValue("expire"); e != "" {
+		var err error
+		if expire, err = strconv.ParseBool(e); err != nil {
+			http.Error(w, "expire must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+
+	p.lock.Lock()
+	names := p.names
+	if tier := r.FormValue("tier"); tier != "" {
+		if _, ok := p.tiers[tier]; !ok {
+			p.lock.Unlock()
+			http.Error(w, fmt.Sprintf("unknown tier %q", tier), http.StatusBadRequest)
+			return
+		}
+		names = []string{tier}
+	}
+	tiers := make([]handlers.HandlerConst, len(names))
+	for i, name := range names {
+		tiers[i] = p.tiers[name]
+	}
+	p.lock.Unlock()
+
+	verb := "deleted"
+	if expire {
+		verb = "expired"
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+
+	// every tier is tried even if one fails, and the response says how each one went
+	status := http.StatusOK
+	var out []byte
+	for i, hc := range tiers {
+		n, err := purge(hc, []byte(prefix), expire)
+		if err != nil {
+			status = http.StatusInternalServerError
+			out = append(out, fmt.Sprintf("%s: %s %d keys before failing: %s\n", names[i], verb, n, err.Error())...)
+			continue
+		}
+		out = append(out, fmt.Sprintf("%s: %s %d keys\n", names[i], verb, n)...)
+	}
+
+	w.WriteHeader(status)
+	w.Write(out)
+}
+
+func purge(hc handlers.HandlerConst, prefix []byte, expire bool) (int, error) {
+	h, err := hc()
+	if err != nil {
+		return 0, err
+	}
+	defer h.Close()
+
+	return handlers.Purge(h, prefix, expire)
+}
@@ -0,0 +1,62 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"net/http"
+	"sync"
+)
+
+// Readiness reports whether the server is ready for traffic, for load balancers and deployment
+// tooling to wait on. It answers 200 once ready and 503 with the reason before that.
+type Readiness struct {
+	lock   sync.RWMutex
+	reason string
+}
+
+// NewReadiness creates a Readiness that isn't ready for the given reason
+func NewReadiness(reason string) *Readiness {
+	return &Readiness{reason: reason}
+}
+
+// NotReady marks the server as not ready for the given reason
+func (r *Readiness) NotReady(reason string) {
+	r.lock.Lock()
+	r.reason = reason
+	r.lock.Unlock()
+}
+
+// Ready marks the server as ready
+func (r *Readiness) Ready() {
+	r.NotReady("")
+}
+
+// IsReady returns whether the server is ready, and the reason if not
+func (r *Readiness) IsReady() (bool, string) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.reason == "", r.reason
+}
+
+func (r *Readiness) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+
+	if ready, reason := r.IsReady(); !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(reason + "\n"))
+		return
+	}
+	w.Write([]byte("ready\n"))
+}
@@ -0,0 +1,262 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bench_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strconv"
+	"testing"
+
+	"github.com/netflix/rend/bench"
+	"github.com/netflix/rend/client/rendclient"
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers/inmem"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol"
+	"github.com/netflix/rend/protocol/binprot"
+	"github.com/netflix/rend/protocol/textprot"
+)
+
+// repeatReader returns the same bytes over and over, so a parser can read the same request forever
+type repeatReader struct {
+	data []byte
+	off  int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		c := copy(p[n:], r.data[r.off:])
+		n += c
+		r.off = (r.off + c) % len(r.data)
+	}
+	return n, nil
+}
+
+func benchParse(b *testing.B, req []byte, newParser func(r *bufio.Reader) protocol.RequestParser) {
+	p := newParser(bufio.NewReader(&repeatReader{data: req}))
+	b.SetBytes(int64(len(req)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, _, _, err := p.Parse(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func binaryParser(r *bufio.Reader) protocol.RequestParser { return binprot.NewBinaryParser(r) }
+func textParser(r *bufio.Reader) protocol.RequestParser   { return textprot.NewTextParser(r) }
+
+func BenchmarkParseBinaryGet(b *testing.B) {
+	buf := new(bytes.Buffer)
+	binprot.WriteGetCmd(buf, []byte("bench:key"), 0)
+	benchParse(b, buf.Bytes(), binaryParser)
+}
+
+func BenchmarkParseBinarySet(b *testing.B) {
+	buf := new(bytes.Buffer)
+	binprot.WriteSetCmd(buf, []byte("bench:key"), 0, 0, 100, 0)
+	buf.Write(make([]byte, 100))
+	benchParse(b, buf.Bytes(), binaryParser)
+}
+
+func BenchmarkParseTextGet(b *testing.B) {
+	benchParse(b, []byte("get bench:key\r\n"), textParser)
+}
+
+func BenchmarkParseTextSet(b *testing.B) {
+	req := append([]byte("set bench:key 0 0 100\r\n"), make([]byte, 100)...)
+	benchParse(b, append(req, "\r\n"...), textParser)
+}
+
+func BenchmarkHandlerInmemGet(b *testing.B) {
+	h, _ := inmem.New()
+	h.Set(common.SetRequest{Key: []byte("bench:handler"), Data: make([]byte, 100)})
+	req := common.GetRequest{Keys: [][]byte{[]byte("bench:handler")}, Opaques: []uint32{0}, Quiet: []bool{false}}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		resc, errc := h.Get(req)
+		for resc != nil || errc != nil {
+			select {
+			case _, ok := <-resc:
+				if !ok {
+					resc = nil
+				}
+			case err, ok := <-errc:
+				if !ok {
+					errc = nil
+				} else {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkHandlerInmemSet(b *testing.B) {
+	h, _ := inmem.New()
+	req := common.SetRequest{Key: []byte("bench:handler"), Data: make([]byte, 100)}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := h.Set(req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func l1OnlyOrca() orcas.Orca {
+	h, _ := inmem.New()
+	res := binprot.NewBinaryResponder(bufio.NewWriter(ioutil.Discard))
+	return orcas.L1Only(h, nil, res)
+}
+
+func BenchmarkOrcaL1OnlyGet(b *testing.B) {
+	o := l1OnlyOrca()
+	o.Set(common.SetRequest{Key: []byte("bench:orca"), Data: make([]byte, 100)})
+	req := common.GetRequest{Keys: [][]byte{[]byte("bench:orca")}, Opaques: []uint32{0}, Quiet: []bool{false}}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := o.Get(req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkOrcaL1OnlySet(b *testing.B) {
+	o := l1OnlyOrca()
+	req := common.SetRequest{Key: []byte("bench:orca"), Data: make([]byte, 100)}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := o.Set(req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func fullStack(b *testing.B) *rendclient.Client {
+	s, err := bench.StartServer()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { s.Close() })
+
+	c := rendclient.New(rendclient.Config{Addr: s.Addr(), MaxIdle: 64})
+	b.Cleanup(func() { c.Close() })
+	return c
+}
+
+func BenchmarkFullStackGet(b *testing.B) {
+	c := fullStack(b)
+	ctx := context.Background()
+	if err := c.Set(ctx, &rendclient.Item{Key: "bench:full", Value: make([]byte, 100)}); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := c.Get(ctx, "bench:full"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkFullStackSet(b *testing.B) {
+	c := fullStack(b)
+	ctx := context.Background()
+	it := &rendclient.Item{Key: "bench:full", Value: make([]byte, 100)}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := c.Set(ctx, it); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkFullStackGetMulti(b *testing.B) {
+	c := fullStack(b)
+	ctx := context.Background()
+
+	keys := make([]string, 20)
+	for i := range keys {
+		keys[i] = "bench:full:" + strconv.Itoa(i)
+		if err := c.Set(ctx, &rendclient.Item{Key: keys[i], Value: make([]byte, 100)}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := c.GetMulti(ctx, keys); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// TestScenarios runs a scaled down copy of every scenario to make sure they all work
+func TestScenarios(t *testing.T) {
+	s, err := bench.StartServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	newClient := func() *rendclient.Client {
+		return rendclient.New(rendclient.Config{Addr: s.Addr()})
+	}
+
+	for _, name := range bench.ScenarioNames() {
+		sc := bench.Scenarios[name]
+		sc.Keys = 100
+		sc.Ops = 400
+		sc.Concurrency = 4
+
+		res, err := bench.Run(context.Background(), sc, newClient)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if res.Ops != 400 || res.Errors != 0 {
+			t.Fatalf("%s: expected 400 operations without errors, got %v", name, res)
+		}
+		if sc.Prefill && res.Misses != 0 {
+			t.Fatalf("%s: expected every read to hit after the prefill, got %v", name, res)
+		}
+		if res.Percentile(0.5) <= 0 || res.Percentile(0.5) > res.Percentile(0.999) {
+			t.Fatalf("%s: unexpected latencies %v", name, res)
+		}
+	}
+}
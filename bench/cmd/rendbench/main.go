@@ -0,0 +1,93 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// rendbench runs one of the reproducible load scenarios in the bench package against a rend
+// server, either one already running at -addr or one started in this process with -inproc.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/netflix/rend/bench"
+	"github.com/netflix/rend/client/rendclient"
+)
+
+func main() {
+	var (
+		name          = flag.String("scenario", "get-heavy", "Scenario to run. See -list for the choices.")
+		list          = flag.Bool("list", false, "List the scenarios and exit.")
+		addr          = flag.String("addr", "localhost:11211", "Address of the rend server to load.")
+		inproc        = flag.Bool("inproc", false, "Start an L1 only in-memory server in this process instead of using -addr.")
+		deadlineHints = flag.Bool("deadline-hints", false, "Send deadline hints with each request.")
+		ops           = flag.Int("ops", 0, "Overrides the scenario's number of operations if set.")
+		concurrency   = flag.Int("concurrency", 0, "Overrides the scenario's number of workers if set.")
+		seed          = flag.Int64("seed", 0, "Overrides the scenario's random seed if set.")
+	)
+	flag.Parse()
+
+	if *list {
+		for _, n := range bench.ScenarioNames() {
+			fmt.Printf("%-14s %s\n", n, bench.Scenarios[n].Description)
+		}
+		return
+	}
+
+	s, ok := bench.Scenarios[*name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown scenario %q. Scenarios: %s\n", *name, strings.Join(bench.ScenarioNames(), ", "))
+		os.Exit(1)
+	}
+	if *ops > 0 {
+		s.Ops = *ops
+	}
+	if *concurrency > 0 {
+		s.Concurrency = *concurrency
+	}
+	if *seed != 0 {
+		s.Seed = *seed
+	}
+
+	if *inproc {
+		srv, err := bench.StartServer()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error starting server: %v\n", err)
+			os.Exit(1)
+		}
+		defer srv.Close()
+		*addr = srv.Addr()
+	}
+
+	// Everything that affects the numbers goes in the output so runs can be compared
+	fmt.Printf("%s %s/%s GOMAXPROCS=%d NumCPU=%d\n", runtime.Version(), runtime.GOOS, runtime.GOARCH,
+		runtime.GOMAXPROCS(0), runtime.NumCPU())
+	fmt.Printf("scenario=%s seed=%d keys=%d zipf=%v value=%dB get-ratio=%v batch=%d concurrency=%d ops=%d inproc=%v\n",
+		s.Name, s.Seed, s.Keys, s.Zipf, s.ValueSize, s.GetRatio, s.BatchSize, s.Concurrency, s.Ops, *inproc)
+
+	newClient := func() *rendclient.Client {
+		return rendclient.New(rendclient.Config{Addr: *addr, DeadlineHints: *deadlineHints})
+	}
+
+	res, err := bench.Run(context.Background(), s, newClient)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error running scenario: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println(res)
+}
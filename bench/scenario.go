@@ -0,0 +1,339 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bench holds the benchmarks of rend's main code paths and a harness that runs fixed load
+// scenarios against a live server, so performance changes can be measured the same way by anyone.
+//
+// The Go benchmarks cover parsing, orchestrators, handlers, and the full stack over a loopback
+// connection:
+//
+//	go test -run NONE -bench . -benchmem -count 10 ./bench/ > new.txt
+//
+// Scenarios are run with the rendbench command, either against a server given by address or an
+// in-process L1 only server with an in-memory L1:
+//
+//	go run ./bench/cmd/rendbench -scenario get-heavy -inproc
+//
+// Every scenario has a fixed seed, so the exact same keys, values, and operations are generated on
+// every run. What can't be fixed in code is the machine, so results are only comparable when these
+// are the same, and they are printed with every result:
+//
+//   - GOMAXPROCS and the number of CPUs. Pin the server and the load generator to separate cores
+//     (e.g. with taskset) so they don't compete.
+//   - CPU frequency scaling and turbo. Set the governor to performance for stable numbers.
+//   - The Go version.
+//   - For a remote server, the network between the two hosts.
+package bench
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/client/rendclient"
+)
+
+// Scenario is a reproducible load pattern
+type Scenario struct {
+	Name        string
+	Description string
+
+	// Seed of every random choice made, each worker using Seed plus its index
+	Seed int64
+
+	// Keys is the size of the key space. With Zipf set, keys are chosen with a zipfian distribution
+	// of that exponent (which must be > 1), so a few keys are hot. Otherwise keys are uniform.
+	Keys int
+	Zipf float64
+
+	// ValueSize is the size of every value set
+	ValueSize int
+
+	// GetRatio is the fraction of operations that are reads, the rest are sets
+	GetRatio float64
+
+	// BatchSize is the number of keys in each read, which are done with a multi-get if it's more
+	// than 1
+	BatchSize int
+
+	// Concurrency is how many workers run at once, each with its own connection
+	Concurrency int
+
+	// Ops is the total number of operations done, split evenly between the workers
+	Ops int
+
+	// Prefill sets every key once before the measured run, so reads hit
+	Prefill bool
+}
+
+// Scenarios are the built-in scenarios, by name
+var Scenarios = map[string]Scenario{
+	"get-heavy": {
+		Name:        "get-heavy",
+		Description: "90% gets of small values over a hot key space",
+		Seed:        1,
+		Keys:        100000,
+		Zipf:        1.1,
+		ValueSize:   100,
+		GetRatio:    0.9,
+		BatchSize:   1,
+		Concurrency: 16,
+		Ops:         1000000,
+		Prefill:     true,
+	},
+	"set-heavy": {
+		Name:        "set-heavy",
+		Description: "90% sets of small values over a uniform key space",
+		Seed:        2,
+		Keys:        100000,
+		ValueSize:   100,
+		GetRatio:    0.1,
+		BatchSize:   1,
+		Concurrency: 16,
+		Ops:         1000000,
+	},
+	"multiget": {
+		Name:        "multiget",
+		Description: "multi-gets of 20 keys at a time over a hot key space",
+		Seed:        3,
+		Keys:        100000,
+		Zipf:        1.1,
+		ValueSize:   100,
+		GetRatio:    1,
+		BatchSize:   20,
+		Concurrency: 16,
+		Ops:         200000,
+		Prefill:     true,
+	},
+	"large-values": {
+		Name:        "large-values",
+		Description: "half gets and half sets of 100k values, large enough to span many chunks",
+		Seed:        4,
+		Keys:        1000,
+		ValueSize:   100 * 1024,
+		GetRatio:    0.5,
+		BatchSize:   1,
+		Concurrency: 8,
+		Ops:         50000,
+		Prefill:     true,
+	},
+}
+
+// ScenarioNames returns the sorted names of the built-in scenarios
+func ScenarioNames() []string {
+	var names []string
+	for name := range Scenarios {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Result is the outcome of running a scenario
+type Result struct {
+	Scenario Scenario
+	Ops      int
+	Misses   int
+	Errors   int
+	Duration time.Duration
+
+	// latencies of every operation, sorted
+	latencies []time.Duration
+}
+
+// Throughput is the number of operations per second
+func (r Result) Throughput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Ops) / r.Duration.Seconds()
+}
+
+// Percentile returns the latency at or under which the fraction p of operations finished
+func (r Result) Percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	idx := int(p * float64(len(r.latencies)))
+	if idx >= len(r.latencies) {
+		idx = len(r.latencies) - 1
+	}
+	return r.latencies[idx]
+}
+
+func (r Result) String() string {
+	return fmt.Sprintf("%s: %d ops in %v (%.0f ops/s), %d misses, %d errors, p50 %v p99 %v p99.9 %v",
+		r.Scenario.Name, r.Ops, r.Duration.Round(time.Millisecond), r.Throughput(), r.Misses, r.Errors,
+		r.Percentile(0.5), r.Percentile(0.99), r.Percentile(0.999))
+}
+
+// keyChooser picks keys for one worker
+type keyChooser struct {
+	r    *rand.Rand
+	zipf *rand.Zipf
+	n    int
+}
+
+func newKeyChooser(s Scenario, r *rand.Rand) keyChooser {
+	kc := keyChooser{r: r, n: s.Keys}
+	if s.Zipf > 1 {
+		kc.zipf = rand.NewZipf(r, s.Zipf, 1, uint64(s.Keys-1))
+	}
+	return kc
+}
+
+func (kc keyChooser) next() string {
+	if kc.zipf != nil {
+		return key(int(kc.zipf.Uint64()))
+	}
+	return key(kc.r.Intn(kc.n))
+}
+
+func key(i int) string {
+	return "bench:" + strconv.Itoa(i)
+}
+
+// value returns a value of the given size made from the random source, so values are the same on
+// every run without all being identical
+func value(r *rand.Rand, size int) []byte {
+	v := make([]byte, size)
+	r.Read(v)
+	return v
+}
+
+// Run runs the scenario with clients made by newClient, one per worker. Errors from individual
+// operations are counted in the result, while an error prefilling the keys stops the run.
+func Run(ctx context.Context, s Scenario, newClient func() *rendclient.Client) (Result, error) {
+	res := Result{Scenario: s}
+
+	if s.Prefill {
+		if err := prefill(ctx, s, newClient); err != nil {
+			return res, err
+		}
+	}
+
+	type workerResult struct {
+		misses, errors int
+		latencies      []time.Duration
+	}
+
+	perWorker := s.Ops / s.Concurrency
+	results := make([]workerResult, s.Concurrency)
+
+	var wg sync.WaitGroup
+	start := time.Now()
+
+	for w := 0; w < s.Concurrency; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			c := newClient()
+			defer c.Close()
+
+			r := rand.New(rand.NewSource(s.Seed + int64(w)))
+			keys := newKeyChooser(s, r)
+			val := value(r, s.ValueSize)
+			wr := workerResult{latencies: make([]time.Duration, 0, perWorker)}
+			batch := make([]string, s.BatchSize)
+
+			for i := 0; i < perWorker; i++ {
+				var err error
+				var missed bool
+				opStart := time.Now()
+
+				if r.Float64() < s.GetRatio {
+					if s.BatchSize > 1 {
+						for j := range batch {
+							batch[j] = keys.next()
+						}
+						var items map[string]*rendclient.Item
+						items, err = c.GetMulti(ctx, batch)
+						// a zipf batch often repeats keys, so look each one up rather than counting
+						for _, k := range batch {
+							if _, ok := items[k]; !ok && err == nil {
+								missed = true
+							}
+						}
+					} else {
+						_, err = c.Get(ctx, keys.next())
+						if err == rendclient.ErrCacheMiss {
+							missed, err = true, nil
+						}
+					}
+				} else {
+					err = c.Set(ctx, &rendclient.Item{Key: keys.next(), Value: val})
+				}
+
+				wr.latencies = append(wr.latencies, time.Since(opStart))
+				if err != nil {
+					wr.errors++
+				}
+				if missed {
+					wr.misses++
+				}
+			}
+
+			results[w] = wr
+		}(w)
+	}
+
+	wg.Wait()
+	res.Duration = time.Since(start)
+
+	for _, wr := range results {
+		res.Ops += len(wr.latencies)
+		res.Misses += wr.misses
+		res.Errors += wr.errors
+		res.latencies = append(res.latencies, wr.latencies...)
+	}
+	sort.Slice(res.latencies, func(i, j int) bool { return res.latencies[i] < res.latencies[j] })
+
+	return res, nil
+}
+
+// prefill sets every key in the key space once, split between the workers
+func prefill(ctx context.Context, s Scenario, newClient func() *rendclient.Client) error {
+	errs := make(chan error, s.Concurrency)
+
+	for w := 0; w < s.Concurrency; w++ {
+		go func(w int) {
+			c := newClient()
+			defer c.Close()
+
+			r := rand.New(rand.NewSource(s.Seed - int64(w) - 1))
+			val := value(r, s.ValueSize)
+
+			for i := w; i < s.Keys; i += s.Concurrency {
+				if err := c.Set(ctx, &rendclient.Item{Key: key(i), Value: val}); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(w)
+	}
+
+	var err error
+	for w := 0; w < s.Concurrency; w++ {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,72 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bench
+
+import (
+	"bufio"
+	"io"
+	"net"
+
+	"github.com/netflix/rend/handlers/inmem"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol/binprot"
+	"github.com/netflix/rend/server"
+)
+
+// Server is an in-process rend serving the binary protocol on a loopback port, with the L1 only
+// orchestrator and an in-memory L1. It measures rend itself without any backend I/O.
+type Server struct {
+	l net.Listener
+}
+
+// StartServer starts a Server on a free loopback port
+func StartServer() (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{l: l}
+	go s.accept()
+	return s, nil
+}
+
+// Addr is the address the server listens on
+func (s *Server) Addr() string {
+	return s.l.Addr().String()
+}
+
+// Close stops accepting new connections. Open connections stay open until their clients close them.
+func (s *Server) Close() error {
+	return s.l.Close()
+}
+
+func (s *Server) accept() {
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+
+		go serve(c)
+	}
+}
+
+func serve(c net.Conn) {
+	l1, _ := inmem.New()
+	res := binprot.NewBinaryResponder(bufio.NewWriter(c))
+	o := orcas.L1Only(l1, nil, res)
+	server.Default([]io.Closer{c}, binprot.NewBinaryParser(bufio.NewReader(c)), o).Loop()
+}
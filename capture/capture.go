@@ -0,0 +1,304 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package capture records a sampled stream of parsed requests to a file so real traffic can be
+// replayed later against a test target. Keys are anonymized with a keyed hash: the same key
+// always maps to the same anonymized key within a capture, which preserves the access pattern,
+// but the original keys can't be recovered without the secret. Values are never recorded, only
+// their sizes.
+//
+// The file format is one JSON Record per line.
+package capture
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/protocol"
+)
+
+var (
+	MetricCaptureRecords = metrics.AddCounter("capture_records", nil)
+	MetricCaptureDropped = metrics.AddCounter("capture_dropped", nil)
+	MetricCaptureErrors  = metrics.AddCounter("capture_errors", nil)
+)
+
+// Record is a single captured request
+type Record struct {
+	// Time the request was parsed, in nanoseconds since the unix epoch
+	Time    int64    `json:"t"`
+	Op      string   `json:"op"`
+	Keys    []string `json:"keys"`
+	Size    int      `json:"size,omitempty"`
+	Flags   uint32   `json:"flags,omitempty"`
+	Exptime uint32   `json:"exptime,omitempty"`
+}
+
+const (
+	// anonymized keys are this many hex characters of the HMAC
+	anonKeyLength = 32
+	// records waiting to be written before new ones get dropped
+	recordQueueSize = 4096
+	flushInterval   = time.Second
+)
+
+// Recorder writes sampled requests to a capture file in the background. Requests are dropped
+// rather than slowing down the server if the file can't keep up.
+type Recorder struct {
+	secret []byte
+	// keys are sampled if the first 8 bytes of their hash are below this
+	threshold uint64
+
+	records chan Record
+	done    chan struct{}
+	once    sync.Once
+}
+
+// NewRecorder creates a capture file at the given path. The sample rate is the fraction (0 to 1]
+// of keys that are recorded. Sampling is by key so that every request for a sampled key is in the
+// capture. If secret is empty a random one is generated, which means keys from different captures
+// can't be correlated.
+func NewRecorder(path string, sampleRate float64, secret []byte) (*Recorder, error) {
+	if sampleRate <= 0 || sampleRate > 1 {
+		return nil, errors.New("Capture sample rate must be in (0, 1]")
+	}
+
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	threshold := ^uint64(0)
+	if sampleRate < 1 {
+		threshold = uint64(sampleRate * float64(^uint64(0)))
+	}
+
+	r := &Recorder{
+		secret:    secret,
+		threshold: threshold,
+		records:   make(chan Record, recordQueueSize),
+		done:      make(chan struct{}),
+	}
+
+	go r.write(f)
+
+	return r, nil
+}
+
+// Anonymize returns the anonymized form of a key and whether the key is sampled
+func (r *Recorder) Anonymize(key []byte) (string, bool) {
+	mac := hmac.New(sha256.New, r.secret)
+	mac.Write(key)
+	sum := mac.Sum(nil)
+
+	sampled := binary.BigEndian.Uint64(sum) <= r.threshold
+	return hex.EncodeToString(sum)[:anonKeyLength], sampled
+}
+
+// Record captures a parsed request if any of its keys are sampled. It never blocks.
+func (r *Recorder) Record(req common.Request, reqType common.RequestType, at time.Time) {
+	// Each item of a batch is recorded as its own request
+	switch reqType {
+	case common.RequestMultiSet:
+		for _, set := range req.(common.MultiSetRequest).Sets {
+			r.Record(set, common.RequestSet, at)
+		}
+		return
+	case common.RequestMultiDelete:
+		for _, del := range req.(common.MultiDeleteRequest).Deletes {
+			r.Record(del, common.RequestDelete, at)
+		}
+		return
+	case common.RequestSetIfMatch:
+		req = req.(common.SetIfMatchRequest).SetRequest
+	case common.RequestCAS:
+		req = req.(common.CASRequest).SetRequest
+	}
+
+	rec := Record{
+		Time: at.UnixNano(),
+	}
+
+	var keys [][]byte
+
+	switch reqType {
+	case common.RequestGet, common.RequestGetE, common.RequestGets:
+		keys = req.(common.GetRequest).Keys
+		switch reqType {
+		case common.RequestGet:
+			rec.Op = "get"
+		case common.RequestGetE:
+			rec.Op = "gete"
+		default:
+			rec.Op = "gets"
+		}
+
+	case common.RequestGat:
+		gr := req.(common.GATRequest)
+		keys = [][]byte{gr.Key}
+		rec.Op = "gat"
+		rec.Exptime = gr.Exptime
+
+	case common.RequestSet, common.RequestAdd, common.RequestReplace, common.RequestAppend, common.RequestPrepend,
+		common.RequestSetIfMatch, common.RequestCAS:
+		sr := req.(common.SetRequest)
+		keys = [][]byte{sr.Key}
+		rec.Op = setOps[reqType]
+		rec.Size = len(sr.Data)
+		rec.Flags = sr.Flags
+		rec.Exptime = sr.Exptime
+
+	case common.RequestDelete:
+		keys = [][]byte{req.(common.DeleteRequest).Key}
+		rec.Op = "delete"
+
+	case common.RequestTouch:
+		tr := req.(common.TouchRequest)
+		keys = [][]byte{tr.Key}
+		rec.Op = "touch"
+		rec.Exptime = tr.Exptime
+
+	default:
+		return
+	}
+
+	for _, k := range keys {
+		if anon, sampled := r.Anonymize(k); sampled {
+			rec.Keys = append(rec.Keys, anon)
+		}
+	}
+
+	if len(rec.Keys) == 0 {
+		return
+	}
+
+	select {
+	case r.records <- rec:
+	default:
+		metrics.IncCounter(MetricCaptureDropped)
+	}
+}
+
+var setOps = map[common.RequestType]string{
+	common.RequestSet:        "set",
+	common.RequestAdd:        "add",
+	common.RequestReplace:    "replace",
+	common.RequestAppend:     "append",
+	common.RequestPrepend:    "prepend",
+	common.RequestSetIfMatch: "setif",
+	common.RequestCAS:        "cas",
+}
+
+// Close stops recording and flushes everything recorded so far to the file. Record must not be
+// called after Close.
+func (r *Recorder) Close() error {
+	r.once.Do(func() {
+		close(r.records)
+	})
+	<-r.done
+	return nil
+}
+
+func (r *Recorder) write(f *os.File) {
+	defer close(r.done)
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	defer w.Flush()
+
+	enc := json.NewEncoder(w)
+	flush := time.NewTicker(flushInterval)
+	defer flush.Stop()
+
+	for {
+		select {
+		case rec, ok := <-r.records:
+			if !ok {
+				return
+			}
+			if err := enc.Encode(rec); err != nil {
+				log.Println("Error writing capture record:", err.Error())
+				metrics.IncCounter(MetricCaptureErrors)
+				continue
+			}
+			metrics.IncCounter(MetricCaptureRecords)
+
+		case <-flush.C:
+			if err := w.Flush(); err != nil {
+				log.Println("Error flushing capture file:", err.Error())
+				metrics.IncCounter(MetricCaptureErrors)
+			}
+		}
+	}
+}
+
+// Wrap returns a protocol.RequestParser that records every successfully parsed request before
+// returning it.
+func (r *Recorder) Wrap(rp protocol.RequestParser) protocol.RequestParser {
+	return parser{
+		RequestParser: rp,
+		r:             r,
+	}
+}
+
+type parser struct {
+	protocol.RequestParser
+	r *Recorder
+}
+
+func (p parser) Parse() (common.Request, common.RequestType, uint64, error) {
+	req, reqType, start, err := p.RequestParser.Parse()
+	if err == nil {
+		p.r.Record(req, reqType, time.Now())
+	}
+	return req, reqType, start, err
+}
+
+// Reader reads records back from a capture file
+type Reader struct {
+	dec *json.Decoder
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		dec: json.NewDecoder(bufio.NewReader(r)),
+	}
+}
+
+// Next returns the next record in the capture, or io.EOF at the end.
+func (r *Reader) Next() (Record, error) {
+	var rec Record
+	err := r.dec.Decode(&rec)
+	return rec, err
+}
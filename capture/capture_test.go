@@ -0,0 +1,76 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package capture_test
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/capture"
+	"github.com/netflix/rend/common"
+)
+
+func TestRecordAndRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+
+	rec, err := capture.NewRecorder(path, 1, []byte("secret"))
+	if err != nil {
+		t.Fatalf("Error creating recorder: %v", err)
+	}
+
+	now := time.Now()
+	rec.Record(common.SetRequest{Key: []byte("foo"), Data: []byte("hello"), Exptime: 10}, common.RequestSet, now)
+	rec.Record(common.GetRequest{Keys: [][]byte{[]byte("foo"), []byte("bar")}}, common.RequestGet, now.Add(time.Millisecond))
+	rec.Record(common.NoopRequest{}, common.RequestNoop, now)
+	rec.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Error opening capture: %v", err)
+	}
+	defer f.Close()
+
+	r := capture.NewReader(f)
+
+	set, err := r.Next()
+	if err != nil {
+		t.Fatalf("Error reading set record: %v", err)
+	}
+	if set.Op != "set" || set.Size != 5 || set.Exptime != 10 || len(set.Keys) != 1 {
+		t.Fatalf("Unexpected set record %+v", set)
+	}
+	if set.Keys[0] == "foo" {
+		t.Fatalf("Key was not anonymized")
+	}
+
+	get, err := r.Next()
+	if err != nil {
+		t.Fatalf("Error reading get record: %v", err)
+	}
+	if get.Op != "get" || len(get.Keys) != 2 || get.Keys[0] != set.Keys[0] {
+		t.Fatalf("Unexpected get record %+v", get)
+	}
+	if get.Time-set.Time != int64(time.Millisecond) {
+		t.Fatalf("Expected timestamps to be preserved, got a difference of %d", get.Time-set.Time)
+	}
+
+	// the noop is not recorded
+	if _, err := r.Next(); err != io.EOF {
+		t.Fatalf("Expected io.EOF, got %v", err)
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cdc publishes a change data capture stream of the writes rend completes for clients, so
+// downstream systems can invalidate caches derived from the same data. Every successful set,
+// delete, or touch becomes an Event handed to a Sink.
+//
+// Delivery is at least once: a batch of events is retried until the sink accepts it, so a sink may
+// see the same event more than once if it fails partway through a batch. Buffering is bounded
+// though, and events are dropped rather than slowing down requests when the sink can't keep up.
+// The cdc_events_dropped metric counts those. Consumers that can't tolerate gaps should still
+// apply TTLs to whatever they derive.
+package cdc
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/timer"
+)
+
+var (
+	MetricEvents        = metrics.AddCounter("cdc_events", nil)
+	MetricEventsDropped = metrics.AddCounter("cdc_events_dropped", nil)
+	MetricPublished     = metrics.AddCounter("cdc_events_published", nil)
+	MetricBatches       = metrics.AddCounter("cdc_batches", nil)
+	MetricRetries       = metrics.AddCounter("cdc_batch_retries", nil)
+	MetricGivenUp       = metrics.AddCounter("cdc_events_given_up", nil)
+
+	HistPublish = metrics.AddHistogram("cdc_publish", false, nil)
+)
+
+// Op is the kind of write an event records
+type Op string
+
+const (
+	OpSet        Op = "set"
+	OpAdd        Op = "add"
+	OpReplace    Op = "replace"
+	OpAppend     Op = "append"
+	OpPrepend    Op = "prepend"
+	OpSetIfMatch Op = "setif"
+	OpCAS        Op = "cas"
+	OpDelete     Op = "delete"
+	OpTouch      Op = "touch"
+	OpIncr       Op = "incr"
+	OpDecr       Op = "decr"
+	OpFlush      Op = "flush"
+)
+
+// Event is a single completed write
+type Event struct {
+	// Time the write completed, in nanoseconds since the unix epoch
+	Time int64 `json:"t"`
+	Op   Op    `json:"op"`
+	// Key is base64 in JSON since binary protocol keys can be arbitrary bytes. Flushes remove every
+	// key, so they have none.
+	Key []byte `json:"key"`
+	// Size is the number of value bytes in the request, so for appends and prepends it is the size
+	// of the added data rather than of the whole value.
+	Size int `json:"size,omitempty"`
+	// Exptime is the TTL exactly as the client sent it, either seconds from now or a unix timestamp
+	Exptime uint32 `json:"exptime,omitempty"`
+	// Tier is the name of the orchestrator that completed the write, e.g. l1only, l1l2, or
+	// l1l2batch, which tells consumers which tiers were written.
+	Tier string `json:"tier"`
+}
+
+// Sink receives batches of events. Publish should only return nil once every event in the batch is
+// durable downstream, since the batch is retried as a whole otherwise. It's only ever called from
+// one goroutine at a time.
+type Sink interface {
+	Publish(events []Event) error
+	Close() error
+}
+
+// Opts configures a Publisher. Zero values use the defaults.
+type Opts struct {
+	// Events waiting to be published before new ones get dropped
+	BufferSize int
+	// Most events handed to the sink at once
+	BatchSize int
+	// Longest a published event waits for its batch to fill up
+	FlushInterval time.Duration
+	// Longest wait between retries of a failed batch. Retries start at a tenth of this and double.
+	MaxBackoff time.Duration
+}
+
+const (
+	defaultBufferSize    = 10000
+	defaultBatchSize     = 100
+	defaultFlushInterval = 100 * time.Millisecond
+	defaultMaxBackoff    = 10 * time.Second
+
+	// attempts at each remaining batch once the publisher is closed
+	closeAttempts = 3
+)
+
+var errClosed = errors.New("CDC publisher is closed")
+
+// Publisher buffers events and hands them to a sink in batches in the background
+type Publisher struct {
+	sink Sink
+	opts Opts
+
+	events chan Event
+	stop   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+	err    error
+}
+
+// NewPublisher starts publishing events to sink
+func NewPublisher(sink Sink, opts Opts) *Publisher {
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = defaultBufferSize
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaultFlushInterval
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = defaultMaxBackoff
+	}
+
+	p := &Publisher{
+		sink:   sink,
+		opts:   opts,
+		events: make(chan Event, opts.BufferSize),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	go p.run()
+
+	return p
+}
+
+// Publish queues an event. It never blocks; if the buffer is full the event is dropped. The event
+// must not share memory with the request it came from, since it's published after the request has
+// been answered. Publish must not be called after Close.
+func (p *Publisher) Publish(ev Event) {
+	metrics.IncCounter(MetricEvents)
+
+	select {
+	case p.events <- ev:
+	default:
+		metrics.IncCounter(MetricEventsDropped)
+	}
+}
+
+// Close publishes the events still buffered, giving up on any batch that fails a few more times,
+// and then closes the sink.
+func (p *Publisher) Close() error {
+	p.once.Do(func() {
+		close(p.stop)
+	})
+	<-p.done
+	return p.err
+}
+
+func (p *Publisher) run() {
+	defer close(p.done)
+
+	batch := make([]Event, 0, p.opts.BatchSize)
+	flush := time.NewTicker(p.opts.FlushInterval)
+	defer flush.Stop()
+
+	for {
+		select {
+		case ev := <-p.events:
+			batch = append(batch, ev)
+			if len(batch) < p.opts.BatchSize {
+				continue
+			}
+
+		case <-flush.C:
+			if len(batch) == 0 {
+				continue
+			}
+
+		case <-p.stop:
+			p.drain(batch)
+			return
+		}
+
+		if !p.publish(batch) {
+			p.drain(batch)
+			return
+		}
+		batch = batch[:0]
+	}
+}
+
+// publish hands the batch to the sink, retrying with backoff until it succeeds. It returns false if
+// the publisher was closed before that happened.
+func (p *Publisher) publish(batch []Event) bool {
+	backoff := p.opts.MaxBackoff / 10
+
+	for {
+		if p.tryPublish(batch) == nil {
+			return true
+		}
+
+		metrics.IncCounter(MetricRetries)
+
+		select {
+		case <-time.After(backoff):
+		case <-p.stop:
+			return false
+		}
+
+		if backoff *= 2; backoff > p.opts.MaxBackoff {
+			backoff = p.opts.MaxBackoff
+		}
+	}
+}
+
+func (p *Publisher) tryPublish(batch []Event) error {
+	start := timer.Now()
+	err := p.sink.Publish(batch)
+	metrics.ObserveHist(HistPublish, timer.Since(start))
+
+	if err != nil {
+		log.Println("Error publishing CDC events:", err.Error())
+		return err
+	}
+
+	metrics.IncCounter(MetricBatches)
+	metrics.IncCounterBy(MetricPublished, uint64(len(batch)))
+	return nil
+}
+
+// drain publishes the partial batch and everything left in the buffer after the publisher is closed
+func (p *Publisher) drain(batch []Event) {
+	for {
+		for len(batch) < p.opts.BatchSize && len(p.events) > 0 {
+			batch = append(batch, <-p.events)
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		var err error
+		for i := 0; i < closeAttempts; i++ {
+			if err = p.tryPublish(batch); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			metrics.IncCounterBy(MetricGivenUp, uint64(len(batch)))
+			p.err = err
+		}
+
+		batch = batch[:0]
+	}
+
+	if err := p.sink.Close(); err != nil && p.err == nil {
+		p.err = err
+	}
+}
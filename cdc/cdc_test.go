@@ -0,0 +1,156 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cdc_test
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/cdc"
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers/inmem"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol/binprot"
+)
+
+// testSink fails the first few batches it's given and records the rest
+type testSink struct {
+	sync.Mutex
+	failures int
+	events   []cdc.Event
+	closed   bool
+}
+
+func (s *testSink) Publish(events []cdc.Event) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("sink unavailable")
+	}
+	s.events = append(s.events, events...)
+	return nil
+}
+
+func (s *testSink) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *testSink) published() []cdc.Event {
+	s.Lock()
+	defer s.Unlock()
+	return append([]cdc.Event(nil), s.events...)
+}
+
+func TestPublisherRetries(t *testing.T) {
+	sink := &testSink{failures: 2}
+	p := cdc.NewPublisher(sink, cdc.Opts{
+		BatchSize:     2,
+		FlushInterval: time.Millisecond,
+		MaxBackoff:    10 * time.Millisecond,
+	})
+
+	for _, k := range []string{"a", "b", "c"} {
+		p.Publish(cdc.Event{Op: cdc.OpSet, Key: []byte(k)})
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sink.published()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	events := sink.published()
+	if len(events) != 3 {
+		t.Fatalf("Expected every event to be published once the sink recovered, got %v", events)
+	}
+	for i, k := range []string{"a", "b", "c"} {
+		if string(events[i].Key) != k {
+			t.Fatalf("Expected events in order, got %v", events)
+		}
+	}
+	if !sink.closed {
+		t.Fatal("Expected the sink to be closed")
+	}
+}
+
+func TestPublisherDrops(t *testing.T) {
+	// The sink never recovers, so everything past the buffer and the batch in flight is dropped
+	sink := &testSink{failures: 1 << 30}
+	p := cdc.NewPublisher(sink, cdc.Opts{BufferSize: 4, BatchSize: 1, MaxBackoff: time.Hour})
+
+	for i := 0; i < 100; i++ {
+		p.Publish(cdc.Event{Op: cdc.OpDelete, Key: []byte("foo")})
+	}
+
+	if err := p.Close(); err == nil {
+		t.Fatal("Expected closing with events that couldn't be published to fail")
+	}
+}
+
+func TestOrca(t *testing.T) {
+	l1, _ := inmem.New()
+	sink := &testSink{}
+	p := cdc.NewPublisher(sink, cdc.Opts{})
+	o := p.Orca(orcas.L1Only, "l1only")(l1, nil, binprot.NewBinaryResponder(bufio.NewWriter(ioutil.Discard)))
+
+	key := []byte("TestCDCOrca")
+	missing := []byte("TestCDCOrcaMissing")
+
+	if err := o.Set(common.SetRequest{Key: key, Data: []byte("foo"), Exptime: 60}); err != nil {
+		t.Fatal(err)
+	}
+	// Only the set and the gat hit will have events
+	if err := o.Replace(common.SetRequest{Key: missing, Data: []byte("bar")}); err == nil {
+		t.Fatal("Expected the replace of a missing key to fail")
+	}
+	if err := o.Gat(common.GATRequest{Key: missing, Exptime: 30}); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Gat(common.GATRequest{Key: key, Exptime: 30}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The key buffer may be reused by the parser once the request is done
+	key[0] = 'X'
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	events := sink.published()
+	if len(events) != 2 {
+		t.Fatalf("Expected two events, got %v", events)
+	}
+
+	set, touch := events[0], events[1]
+	if set.Op != cdc.OpSet || string(set.Key) != "TestCDCOrca" || set.Size != 3 || set.Exptime != 60 || set.Tier != "l1only" {
+		t.Fatalf("Unexpected set event %+v", set)
+	}
+	if touch.Op != cdc.OpTouch || string(touch.Key) != "TestCDCOrca" || touch.Exptime != 30 {
+		t.Fatalf("Unexpected touch event %+v", touch)
+	}
+}
@@ -0,0 +1,515 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package kafka is a CDC sink that produces events to a Kafka topic, e.g. for a search indexer to
+// react to cache writes. It speaks just enough of the Kafka protocol to produce: metadata requests
+// to find the partition leaders, and produce requests carrying v2 record batches, optionally gzip
+// compressed.
+//
+// Each event is a record with the cache key as its key and the JSON encoded event as its value.
+// Records are partitioned by the murmur2 hash of the key like the Java client does, so the events
+// for a key are in order in a single partition. A batch of events from the publisher becomes one
+// produce request per broker, and it's only accepted once every partition in it is acknowledged.
+//
+// The sink is selected with a configuration string of URL query parameters:
+//
+//	kafka:brokers=kafka1:9092,kafka2:9092&topic=rend-cdc&compression=gzip&acks=all
+package kafka
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/netflix/rend/cdc"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricProduceRequests = metrics.AddCounter("cdc_kafka_produce_requests", nil)
+	MetricProduceErrors   = metrics.AddCounter("cdc_kafka_produce_errors", nil)
+	MetricRecords         = metrics.AddCounter("cdc_kafka_records", nil)
+	MetricBytes           = metrics.AddCounter("cdc_kafka_bytes", nil)
+	MetricMetadata        = metrics.AddCounter("cdc_kafka_metadata_requests", nil)
+	MetricMetadataErrors  = metrics.AddCounter("cdc_kafka_metadata_errors", nil)
+)
+
+func init() {
+	cdc.RegisterSink("kafka", func(conf string) (cdc.Sink, error) {
+		c, err := ParseConfig(conf)
+		if err != nil {
+			return nil, err
+		}
+		return New(c), nil
+	})
+}
+
+// Compression is the codec of the produced record batches, numbered as in the batch attributes
+type Compression int16
+
+const (
+	CompressionNone Compression = 0
+	CompressionGzip Compression = 1
+)
+
+// Acks values for Config.Acks
+const (
+	AcksNone   = 0
+	AcksLeader = 1
+	AcksAll    = -1
+)
+
+// Config configures a Kafka sink
+type Config struct {
+	// Bootstrap brokers, as host:port, used to find the rest of the cluster
+	Brokers []string
+	Topic   string
+	// Client ID sent with every request, which shows up in broker logs and quotas
+	ClientID string
+	// Acknowledgements required before a produce request succeeds: AcksNone, AcksLeader, or AcksAll
+	Acks        int16
+	Compression Compression
+	// Timeout for connecting and for each request, which is also the time the broker is given to
+	// replicate the records when acks is all
+	Timeout time.Duration
+	// How often partition leaders are looked up again even when nothing failed
+	MetadataRefresh time.Duration
+}
+
+const (
+	defaultClientID        = "rend"
+	defaultTimeout         = 10 * time.Second
+	defaultMetadataRefresh = 5 * time.Minute
+)
+
+// ParseConfig parses a configuration string of URL query parameters. brokers is a comma separated
+// list and topic is required. The rest are optional: client_id, acks (all, leader, or none; all is
+// the default), compression (none or gzip), timeout, and metadata_refresh (both durations).
+func ParseConfig(conf string) (Config, error) {
+	c := Config{
+		ClientID:        defaultClientID,
+		Acks:            AcksAll,
+		Timeout:         defaultTimeout,
+		MetadataRefresh: defaultMetadataRefresh,
+	}
+
+	q, err := url.ParseQuery(conf)
+	if err != nil {
+		return c, err
+	}
+
+	for name := range q {
+		val := q.Get(name)
+
+		switch name {
+		case "brokers":
+			for _, b := range strings.Split(val, ",") {
+				if b = strings.TrimSpace(b); b != "" {
+					c.Brokers = append(c.Brokers, b)
+				}
+			}
+
+		case "topic":
+			c.Topic = val
+
+		case "client_id":
+			c.ClientID = val
+
+		case "acks":
+			switch val {
+			case "all", "-1":
+				c.Acks = AcksAll
+			case "leader", "1":
+				c.Acks = AcksLeader
+			case "none", "0":
+				c.Acks = AcksNone
+			default:
+				return c, fmt.Errorf("Invalid Kafka acks %q", val)
+			}
+
+		case "compression":
+			switch val {
+			case "none":
+				c.Compression = CompressionNone
+			case "gzip":
+				c.Compression = CompressionGzip
+			default:
+				return c, fmt.Errorf("Unsupported Kafka compression %q, only none and gzip are available", val)
+			}
+
+		case "timeout", "metadata_refresh":
+			d, err := time.ParseDuration(val)
+			if err != nil || d <= 0 {
+				return c, fmt.Errorf("Invalid Kafka %s %q", name, val)
+			}
+			if name == "timeout" {
+				c.Timeout = d
+			} else {
+				c.MetadataRefresh = d
+			}
+
+		default:
+			return c, fmt.Errorf("Unknown Kafka sink option %q", name)
+		}
+	}
+
+	if len(c.Brokers) == 0 {
+		return c, errors.New("The Kafka sink needs at least one broker")
+	}
+	if c.Topic == "" {
+		return c, errors.New("The Kafka sink needs a topic")
+	}
+
+	return c, nil
+}
+
+// Sink produces CDC events to Kafka. Like every sink it's only used from one goroutine, so it
+// needs no locking.
+type Sink struct {
+	conf        Config
+	correlation int32
+
+	// connections by broker node ID, made as needed
+	conns map[int32]*conn
+	// broker addresses by node ID and the leader of each partition, from the last metadata
+	brokers   map[int32]string
+	leaders   []int32
+	refreshed time.Time
+}
+
+// New creates a Kafka sink. It doesn't connect until the first events are published.
+func New(c Config) *Sink {
+	return &Sink{
+		conf:  c,
+		conns: make(map[int32]*conn),
+	}
+}
+
+func (s *Sink) Publish(events []cdc.Event) error {
+	if s.leaders == nil || time.Since(s.refreshed) > s.conf.MetadataRefresh {
+		if err := s.refreshMetadata(); err != nil {
+			metrics.IncCounter(MetricMetadataErrors)
+			return err
+		}
+	}
+
+	// Records by partition, and partitions by leader
+	byPartition := make(map[int32][]record)
+	for _, ev := range events {
+		value, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+
+		p := int32(partition(ev.Key, len(s.leaders)))
+		byPartition[p] = append(byPartition[p], record{
+			key:       ev.Key,
+			value:     value,
+			timestamp: ev.Time / int64(time.Millisecond),
+		})
+	}
+
+	byLeader := make(map[int32][]int32)
+	for p := range byPartition {
+		leader := s.leaders[p]
+		if leader < 0 {
+			s.leaders = nil
+			return fmt.Errorf("Kafka partition %d of %s has no leader", p, s.conf.Topic)
+		}
+		byLeader[leader] = append(byLeader[leader], p)
+	}
+
+	for leader, partitions := range byLeader {
+		if err := s.produce(leader, partitions, byPartition); err != nil {
+			metrics.IncCounter(MetricProduceErrors)
+			return err
+		}
+	}
+
+	metrics.IncCounterBy(MetricRecords, uint64(len(events)))
+	return nil
+}
+
+func (s *Sink) produce(leader int32, partitions []int32, records map[int32][]record) error {
+	var req encoder
+	req.nullString() // transactional id
+	req.int16(s.conf.Acks)
+	req.int32(int32(s.conf.Timeout / time.Millisecond))
+	req.int32(1) // topics
+	req.string(s.conf.Topic)
+	req.int32(int32(len(partitions)))
+	for _, p := range partitions {
+		batch, err := recordBatch(records[p], s.conf.Compression)
+		if err != nil {
+			return err
+		}
+		req.int32(p)
+		req.bytes(batch)
+	}
+
+	c, err := s.conn(leader)
+	if err != nil {
+		return err
+	}
+
+	metrics.IncCounter(MetricProduceRequests)
+	metrics.IncCounterBy(MetricBytes, uint64(req.Len()))
+
+	// The broker doesn't respond at all when no acknowledgement is needed
+	res, err := s.request(c, apiProduce, produceVersion, req.Bytes(), s.conf.Acks != AcksNone)
+	if err != nil {
+		// The broker may be gone, so look the leaders up again before retrying
+		s.closeConn(leader)
+		s.leaders = nil
+		return err
+	}
+	if s.conf.Acks == AcksNone {
+		return nil
+	}
+
+	d := &decoder{buf: res}
+	for i, topics := 0, d.arrayLen(); i < topics; i++ {
+		d.string()
+		for j, parts := 0, d.arrayLen(); j < parts; j++ {
+			p := d.int32()
+			code := d.int16()
+			d.int64() // base offset
+			d.int64() // log append time
+
+			if d.err == nil && code != 0 {
+				s.checkError(code)
+				return fmt.Errorf("Kafka produce to partition %d of %s failed with error code %d", p, s.conf.Topic, code)
+			}
+		}
+	}
+
+	return d.err
+}
+
+// checkError forces a metadata refresh for the errors that mean the leaders moved
+func (s *Sink) checkError(code int16) {
+	switch code {
+	case errUnknownTopicOrPartition, errLeaderNotAvailable, errNotLeaderForPartition, errNotEnoughReplicas:
+		s.leaders = nil
+	}
+}
+
+// refreshMetadata looks up the brokers and the partition leaders of the topic from the first
+// bootstrap broker that answers.
+func (s *Sink) refreshMetadata() error {
+	var req encoder
+	req.int32(1)
+	req.string(s.conf.Topic)
+
+	var lastErr error
+	for _, addr := range s.conf.Brokers {
+		metrics.IncCounter(MetricMetadata)
+
+		c, err := dial(addr, s.conf.Timeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		res, err := s.request(c, apiMetadata, metadataVersion, req.Bytes(), true)
+		c.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if lastErr = s.parseMetadata(res); lastErr == nil {
+			return nil
+		}
+	}
+
+	return lastErr
+}
+
+func (s *Sink) parseMetadata(res []byte) error {
+	d := &decoder{buf: res}
+
+	brokers := make(map[int32]string)
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		if rack := d.int16(); rack > 0 {
+			d.take(int(rack))
+		}
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.int32() // controller id
+
+	var leaders []int32
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		code := d.int16()
+		name := d.string()
+		d.int8() // is internal
+
+		parts := d.arrayLen()
+		if d.err == nil && name == s.conf.Topic {
+			if code != 0 {
+				return fmt.Errorf("Kafka metadata for %s failed with error code %d", s.conf.Topic, code)
+			}
+			leaders = make([]int32, parts)
+		}
+
+		for j := 0; j < parts; j++ {
+			d.int16() // partition error code
+			p := d.int32()
+			leader := d.int32()
+			for k, n := 0, d.arrayLen(); k < n; k++ {
+				d.int32() // replicas
+			}
+			for k, n := 0, d.arrayLen(); k < n; k++ {
+				d.int32() // in sync replicas
+			}
+
+			if name == s.conf.Topic && d.err == nil {
+				if p < 0 || int(p) >= len(leaders) {
+					return fmt.Errorf("Kafka metadata for %s has an invalid partition %d", s.conf.Topic, p)
+				}
+				leaders[p] = leader
+			}
+		}
+	}
+
+	if d.err != nil {
+		return d.err
+	}
+	if len(leaders) == 0 {
+		return fmt.Errorf("Kafka metadata has no partitions for %s", s.conf.Topic)
+	}
+
+	// Connections to brokers that are gone or moved are closed, the others are kept
+	for id, addr := range s.brokers {
+		if brokers[id] != addr {
+			s.closeConn(id)
+		}
+	}
+
+	s.brokers = brokers
+	s.leaders = leaders
+	s.refreshed = time.Now()
+
+	return nil
+}
+
+func (s *Sink) conn(id int32) (*conn, error) {
+	if c, ok := s.conns[id]; ok {
+		return c, nil
+	}
+
+	addr, ok := s.brokers[id]
+	if !ok {
+		s.leaders = nil
+		return nil, fmt.Errorf("Kafka broker %d isn't in the metadata", id)
+	}
+
+	c, err := dial(addr, s.conf.Timeout)
+	if err != nil {
+		s.leaders = nil
+		return nil, err
+	}
+
+	s.conns[id] = c
+	return c, nil
+}
+
+func (s *Sink) closeConn(id int32) {
+	if c, ok := s.conns[id]; ok {
+		c.Close()
+		delete(s.conns, id)
+	}
+}
+
+// request sends a request with a v1 header and returns the body of its response, if one is expected
+func (s *Sink) request(c *conn, api, version int16, body []byte, response bool) ([]byte, error) {
+	s.correlation++
+
+	var hdr encoder
+	hdr.int16(api)
+	hdr.int16(version)
+	hdr.int32(s.correlation)
+	hdr.string(s.conf.ClientID)
+
+	c.SetDeadline(time.Now().Add(s.conf.Timeout))
+
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(hdr.Len()+len(body)))
+	c.w.Write(size[:])
+	c.w.Write(hdr.Bytes())
+	c.w.Write(body)
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	if !response {
+		return nil, nil
+	}
+
+	if _, err := io.ReadFull(c.r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4 {
+		return nil, errShortResponse
+	}
+
+	res := make([]byte, n)
+	if _, err := io.ReadFull(c.r, res); err != nil {
+		return nil, err
+	}
+
+	if int32(binary.BigEndian.Uint32(res)) != s.correlation {
+		return nil, errCorrelation
+	}
+
+	return res[4:], nil
+}
+
+// Close closes every broker connection
+func (s *Sink) Close() error {
+	for id := range s.conns {
+		s.closeConn(id)
+	}
+	return nil
+}
+
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func dial(addr string, timeout time.Duration) (*conn, error) {
+	c, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{
+		Conn: c,
+		r:    bufio.NewReader(c),
+		w:    bufio.NewWriter(c),
+	}, nil
+}
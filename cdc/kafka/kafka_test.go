@@ -0,0 +1,298 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kafka
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/netflix/rend/cdc"
+)
+
+// Test vectors from the Java client, which partitions by the same hash
+func TestMurmur2(t *testing.T) {
+	cases := map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	}
+
+	for in, want := range cases {
+		if got := murmur2([]byte(in)); got != want {
+			t.Errorf("murmur2(%q) = %d, want %d", in, got, want)
+		}
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	c, err := ParseConfig("brokers=a:9092,b:9092&topic=rend&compression=gzip&acks=leader&timeout=2s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Brokers) != 2 || c.Topic != "rend" || c.Compression != CompressionGzip || c.Acks != AcksLeader || c.Timeout.Seconds() != 2 {
+		t.Fatalf("Unexpected config %+v", c)
+	}
+
+	for _, bad := range []string{"topic=rend", "brokers=a:9092", "brokers=a:9092&topic=rend&compression=zstd", "brokers=a:9092&topic=rend&foo=bar"} {
+		if _, err := ParseConfig(bad); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+// broker is a fake single node Kafka cluster that accepts produce requests for one topic
+type broker struct {
+	t          *testing.T
+	l          net.Listener
+	topic      string
+	partitions int32
+
+	sync.Mutex
+	// keys produced to each partition, in order
+	produced map[int32][]string
+	// error code to fail the next produce request with
+	failNext int16
+}
+
+func newBroker(t *testing.T, topic string, partitions int32) *broker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &broker{
+		t:          t,
+		l:          l,
+		topic:      topic,
+		partitions: partitions,
+		produced:   make(map[int32][]string),
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(c)
+		}
+	}()
+
+	return b
+}
+
+func (b *broker) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(r, req); err != nil {
+			return
+		}
+
+		d := &decoder{buf: req}
+		api := d.int16()
+		d.int16() // version
+		correlation := d.int32()
+		d.string() // client id
+
+		var res encoder
+		res.int32(correlation)
+
+		switch api {
+		case apiMetadata:
+			host, port, _ := net.SplitHostPort(b.l.Addr().String())
+			p, _ := strconv.Atoi(port)
+
+			res.int32(1)
+			res.int32(1) // node id
+			res.string(host)
+			res.int32(int32(p))
+			res.nullString() // rack
+			res.int32(1)     // controller
+
+			res.int32(1)
+			res.int16(0)
+			res.string(b.topic)
+			res.int8(0)
+			res.int32(b.partitions)
+			for i := int32(0); i < b.partitions; i++ {
+				res.int16(0)
+				res.int32(i)
+				res.int32(1) // leader
+				res.int32(1)
+				res.int32(1)
+				res.int32(1)
+				res.int32(1)
+			}
+
+		case apiProduce:
+			d.string() // transactional id
+			d.int16()  // acks
+			d.int32()  // timeout
+
+			b.Lock()
+			code := b.failNext
+			b.failNext = 0
+			b.Unlock()
+
+			res.int32(int32(d.arrayLen()))
+			res.string(d.string())
+			parts := d.arrayLen()
+			res.int32(int32(parts))
+			for i := 0; i < parts; i++ {
+				p := d.int32()
+				batch := d.take(int(d.int32()))
+				if code == 0 {
+					b.record(p, batch)
+				}
+
+				res.int32(p)
+				res.int16(code)
+				res.int64(0)
+				res.int64(-1)
+			}
+			res.int32(0) // throttle time
+
+		default:
+			b.t.Errorf("Unexpected API key %d", api)
+			return
+		}
+
+		binary.BigEndian.PutUint32(size[:], uint32(res.Len()))
+		c.Write(size[:])
+		c.Write(res.Bytes())
+	}
+}
+
+// record decodes a v2 record batch and keeps the keys in it
+func (b *broker) record(p int32, batch []byte) {
+	d := &decoder{buf: batch}
+	d.int64() // base offset
+	if n := int(d.int32()); n != len(d.buf) {
+		b.t.Errorf("Batch length %d doesn't match the %d bytes left", n, len(d.buf))
+	}
+	d.int32() // leader epoch
+	if magic := d.int8(); magic != 2 {
+		b.t.Errorf("Expected a v2 record batch, got magic %d", magic)
+	}
+	if crc := uint32(d.int32()); crc != crc32.Checksum(d.buf, castagnoli) {
+		b.t.Error("Record batch CRC doesn't match")
+	}
+
+	compression := Compression(d.int16())
+	d.take(4 + 8 + 8 + 8 + 2 + 4)
+	count := int(d.int32())
+	body := d.buf
+
+	if compression == CompressionGzip {
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			b.t.Fatal(err)
+		}
+		if body, err = ioutil.ReadAll(zr); err != nil {
+			b.t.Fatal(err)
+		}
+	}
+
+	br := bytes.NewReader(body)
+	varbytes := func() []byte {
+		n, _ := binary.ReadVarint(br)
+		buf := make([]byte, n)
+		io.ReadFull(br, buf)
+		return buf
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	for i := 0; i < count; i++ {
+		binary.ReadVarint(br) // length
+		br.ReadByte()         // attributes
+		binary.ReadVarint(br) // timestamp delta
+		binary.ReadVarint(br) // offset delta
+		key := varbytes()
+
+		var ev cdc.Event
+		if err := json.Unmarshal(varbytes(), &ev); err != nil || !bytes.Equal(ev.Key, key) {
+			b.t.Errorf("Record value %+v doesn't match the key %q: %v", ev, key, err)
+		}
+		binary.ReadVarint(br) // headers
+
+		b.produced[p] = append(b.produced[p], string(key))
+	}
+}
+
+func TestSink(t *testing.T) {
+	b := newBroker(t, "rend-cdc", 4)
+	defer b.l.Close()
+
+	c, err := ParseConfig("brokers=" + b.l.Addr().String() + "&topic=rend-cdc&compression=gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(c)
+	defer s.Close()
+
+	var events []cdc.Event
+	for i := 0; i < 20; i++ {
+		events = append(events, cdc.Event{Op: cdc.OpSet, Key: []byte("key" + strconv.Itoa(i%5)), Tier: "l1only"})
+	}
+
+	// A leader change fails the whole batch, which is retried by the publisher
+	b.Lock()
+	b.failNext = errNotLeaderForPartition
+	b.Unlock()
+	if err := s.Publish(events); err == nil {
+		t.Fatal("Expected the produce to fail")
+	}
+	if err := s.Publish(events); err != nil {
+		t.Fatal(err)
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	total := 0
+	for p, keys := range b.produced {
+		total += len(keys)
+		for _, k := range keys {
+			if want := int32(partition([]byte(k), 4)); p != want {
+				t.Errorf("Key %s was produced to partition %d instead of %d", k, p, want)
+			}
+		}
+	}
+	if total != len(events) {
+		t.Fatalf("Expected %d records, got %v", len(events), b.produced)
+	}
+}
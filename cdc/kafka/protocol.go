@@ -0,0 +1,291 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+// The few Kafka APIs the producer needs. Produce v3 is the oldest version that carries v2 record
+// batches, which is also the oldest version current brokers still accept.
+const (
+	apiProduce  = 0
+	apiMetadata = 3
+
+	produceVersion  = 3
+	metadataVersion = 1
+)
+
+// Error codes that mean the cluster changed and the metadata needs to be fetched again
+const (
+	errUnknownTopicOrPartition = 3
+	errLeaderNotAvailable      = 5
+	errNotLeaderForPartition   = 6
+	errNotEnoughReplicas       = 19
+)
+
+var (
+	errShortResponse = errors.New("Kafka response is too short")
+	errCorrelation   = errors.New("Kafka response doesn't match the request")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// encoder builds Kafka protocol messages, which are all big endian with int16 length strings and
+// int32 length arrays and byte strings.
+type encoder struct {
+	bytes.Buffer
+}
+
+func (e *encoder) int8(v int8) {
+	e.WriteByte(byte(v))
+}
+
+func (e *encoder) int16(v int16) {
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], uint16(v))
+	e.Write(buf[:])
+}
+
+func (e *encoder) int32(v int32) {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(v))
+	e.Write(buf[:])
+}
+
+func (e *encoder) int64(v int64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(v))
+	e.Write(buf[:])
+}
+
+func (e *encoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.WriteString(s)
+}
+
+func (e *encoder) nullString() {
+	e.int16(-1)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.Write(b)
+}
+
+// varint and varbytes are the zigzag encoded forms used inside record batches
+func (e *encoder) varint(v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	e.Write(buf[:binary.PutVarint(buf[:], v)])
+}
+
+func (e *encoder) varbytes(b []byte) {
+	if b == nil {
+		e.varint(-1)
+		return
+	}
+	e.varint(int64(len(b)))
+	e.Write(b)
+}
+
+// decoder reads Kafka protocol messages. The first error sticks, so a whole response can be
+// decoded before checking it.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.buf) {
+		d.err = errShortResponse
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) int8() int8 {
+	if b := d.take(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *decoder) int16() int16 {
+	if b := d.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *decoder) int32() int32 {
+	if b := d.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if b := d.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *decoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
+
+// arrayLen reads an array length, treating a null array as empty
+func (d *decoder) arrayLen() int {
+	n := int(d.int32())
+	if n < 0 {
+		return 0
+	}
+	// every element is at least a byte, which stops a corrupt length from allocating too much
+	if n > len(d.buf) {
+		d.err = errShortResponse
+		return 0
+	}
+	return n
+}
+
+type record struct {
+	key, value []byte
+	// milliseconds since the unix epoch
+	timestamp int64
+}
+
+// recordBatch encodes records as a v2 record batch, the message format since Kafka 0.11.
+func recordBatch(records []record, compression Compression) ([]byte, error) {
+	if len(records) == 0 {
+		return nil, errors.New("Kafka record batch is empty")
+	}
+
+	first, max := records[0].timestamp, records[0].timestamp
+	for _, r := range records {
+		if r.timestamp > max {
+			max = r.timestamp
+		}
+	}
+
+	var recs encoder
+	for i, r := range records {
+		var rec encoder
+		rec.int8(0) // attributes
+		rec.varint(r.timestamp - first)
+		rec.varint(int64(i)) // offset delta
+		rec.varbytes(r.key)
+		rec.varbytes(r.value)
+		rec.varint(0) // headers
+
+		recs.varint(int64(rec.Len()))
+		recs.Write(rec.Bytes())
+	}
+
+	body := recs.Bytes()
+	if compression == CompressionGzip {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(body); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		body = buf.Bytes()
+	}
+
+	// Everything the CRC covers, from the attributes to the end
+	var crcd encoder
+	crcd.int16(int16(compression))
+	crcd.int32(int32(len(records) - 1)) // last offset delta
+	crcd.int64(first)
+	crcd.int64(max)
+	crcd.int64(-1) // producer id
+	crcd.int16(-1) // producer epoch
+	crcd.int32(-1) // base sequence
+	crcd.int32(int32(len(records)))
+	crcd.Write(body)
+
+	var batch encoder
+	batch.int64(0) // base offset, assigned by the broker
+	// batch length counts everything after itself: leader epoch, magic, crc, and the rest
+	batch.int32(int32(4 + 1 + 4 + crcd.Len()))
+	batch.int32(-1) // partition leader epoch
+	batch.int8(2)   // magic
+	batch.int32(int32(crc32.Checksum(crcd.Bytes(), castagnoli)))
+	batch.Write(crcd.Bytes())
+
+	return batch.Bytes(), nil
+}
+
+// murmur2 is the hash the Java client's default partitioner uses, so events for a key land in the
+// same partition as writes for that key from any other producer using the default.
+func murmur2(data []byte) int32 {
+	const (
+		seed uint32 = 0x9747b28c
+		m    uint32 = 0x5bd1e995
+		r           = 24
+	)
+
+	length := len(data)
+	h := seed ^ uint32(length)
+
+	for i := 0; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	tail := data[length&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+
+	return int32(h)
+}
+
+// partition picks the partition for a key the same way as the Java client's default partitioner
+func partition(key []byte, partitions int) int {
+	return int(murmur2(key)&0x7fffffff) % partitions
+}
@@ -0,0 +1,152 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cdc
+
+import (
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol"
+)
+
+// Orca wraps an orchestrator so every write, delete, or touch it completes successfully is
+// published as an event from the named tier. Like peer invalidations, this wraps the orchestrator
+// rather than the handlers so internal writes, like filling L1 from L2 on a miss, aren't published.
+// Batched sets and deletes go through the serial fallback so each item is published on its own.
+func (p *Publisher) Orca(oc orcas.OrcaConst, tier string) orcas.OrcaConst {
+	return func(l1, l2 handlers.Handler, res protocol.Responder) orcas.Orca {
+		gr := &gatResponder{Responder: res}
+		return &publishingOrca{
+			Orca: oc(l1, l2, gr),
+			p:    p,
+			tier: tier,
+			res:  gr,
+		}
+	}
+}
+
+type publishingOrca struct {
+	orcas.Orca
+	p    *Publisher
+	tier string
+	res  *gatResponder
+}
+
+// gatResponder remembers whether the last gat was a miss, since orchestrators answer misses
+// without returning an error.
+type gatResponder struct {
+	protocol.Responder
+	miss bool
+}
+
+func (r *gatResponder) GAT(res common.GetResponse) error {
+	r.miss = res.Miss
+	return r.Responder.GAT(res)
+}
+
+func (o *publishingOrca) written(op Op, key []byte, size int, exptime uint32, err error) error {
+	if err == nil {
+		o.p.Publish(Event{
+			Time:    time.Now().UnixNano(),
+			Op:      op,
+			Key:     append([]byte(nil), key...),
+			Size:    size,
+			Exptime: exptime,
+			Tier:    o.tier,
+		})
+	}
+	return err
+}
+
+func (o *publishingOrca) set(op Op, req common.SetRequest, err error) error {
+	return o.written(op, req.Key, len(req.Data), req.Exptime, err)
+}
+
+func (o *publishingOrca) Set(req common.SetRequest) error {
+	return o.set(OpSet, req, o.Orca.Set(req))
+}
+
+func (o *publishingOrca) Add(req common.SetRequest) error {
+	return o.set(OpAdd, req, o.Orca.Add(req))
+}
+
+func (o *publishingOrca) Replace(req common.SetRequest) error {
+	return o.set(OpReplace, req, o.Orca.Replace(req))
+}
+
+func (o *publishingOrca) Append(req common.SetRequest) error {
+	return o.set(OpAppend, req, o.Orca.Append(req))
+}
+
+func (o *publishingOrca) Prepend(req common.SetRequest) error {
+	return o.set(OpPrepend, req, o.Orca.Prepend(req))
+}
+
+func (o *publishingOrca) SetIfMatch(req common.SetIfMatchRequest) error {
+	return o.set(OpSetIfMatch, req.SetRequest, orcas.SetIfMatch(o.Orca, req))
+}
+
+func (o *publishingOrca) CompareAndSwap(req common.CASRequest) error {
+	return o.set(OpCAS, req.SetRequest, orcas.CompareAndSwap(o.Orca, req))
+}
+
+func (o *publishingOrca) Gets(req common.GetRequest) error {
+	return orcas.Gets(o.Orca, req)
+}
+
+func (o *publishingOrca) Incr(req common.ArithRequest) error {
+	return o.written(OpIncr, req.Key, 0, 0, orcas.Incr(o.Orca, req))
+}
+
+func (o *publishingOrca) Decr(req common.ArithRequest) error {
+	return o.written(OpDecr, req.Key, 0, 0, orcas.Decr(o.Orca, req))
+}
+
+func (o *publishingOrca) Flush(req common.FlushRequest) error {
+	return o.written(OpFlush, nil, 0, 0, orcas.Flush(o.Orca, req))
+}
+
+func (o *publishingOrca) Stats(req common.StatsRequest) error {
+	return orcas.Stats(o.Orca, req)
+}
+
+// Locks don't change values, so they aren't published
+func (o *publishingOrca) GetLock(req common.GetLockRequest) error {
+	return orcas.GetLock(o.Orca, req)
+}
+
+func (o *publishingOrca) Unlock(req common.UnlockRequest) error {
+	return orcas.Unlock(o.Orca, req)
+}
+
+func (o *publishingOrca) Delete(req common.DeleteRequest) error {
+	return o.written(OpDelete, req.Key, 0, 0, o.Orca.Delete(req))
+}
+
+func (o *publishingOrca) Touch(req common.TouchRequest) error {
+	return o.written(OpTouch, req.Key, 0, req.Exptime, o.Orca.Touch(req))
+}
+
+// A gat changes the TTL the same way a touch does
+func (o *publishingOrca) Gat(req common.GATRequest) error {
+	o.res.miss = true
+	err := o.Orca.Gat(req)
+	if o.res.miss {
+		return err
+	}
+	return o.written(OpTouch, req.Key, 0, req.Exptime, err)
+}
@@ -0,0 +1,146 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cdc
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/netflix/rend/handlers"
+)
+
+// SinkFactory creates a Sink from a configuration string, in the same way as handler factories
+type SinkFactory func(conf string) (Sink, error)
+
+var (
+	sinks     = make(map[string]SinkFactory)
+	sinksLock = new(sync.RWMutex)
+)
+
+func init() {
+	RegisterSink("file", func(conf string) (Sink, error) {
+		if conf == "" {
+			return nil, errors.New("The file CDC sink needs a path, e.g. file:/var/log/rend/cdc.json")
+		}
+		if conf == "-" {
+			return NewWriterSink(nopCloser{os.Stdout}), nil
+		}
+
+		f, err := os.OpenFile(conf, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return NewWriterSink(f), nil
+	})
+}
+
+// RegisterSink makes a sink implementation available by name. Registering the same name twice
+// panics.
+func RegisterSink(name string, f SinkFactory) {
+	sinksLock.Lock()
+	defer sinksLock.Unlock()
+
+	if f == nil {
+		panic("cdc: RegisterSink factory is nil for " + name)
+	}
+	if _, dup := sinks[name]; dup {
+		panic("cdc: RegisterSink called twice for " + name)
+	}
+
+	sinks[name] = f
+}
+
+// RegisteredSinks returns the sorted names of all registered sink implementations.
+func RegisteredSinks() []string {
+	sinksLock.RLock()
+	defer sinksLock.RUnlock()
+
+	names := make([]string, 0, len(sinks))
+	for name := range sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// SinkFromConfig resolves a configuration string of the form "name" or "name:conf" to a Sink using
+// the registered factory for that name.
+func SinkFromConfig(spec string) (Sink, error) {
+	name, conf := handlers.SplitSpec(spec)
+
+	sinksLock.RLock()
+	f, ok := sinks[name]
+	sinksLock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("Unknown CDC sink %q. Registered sinks: %s", name, strings.Join(RegisteredSinks(), ", "))
+	}
+
+	return f(conf)
+}
+
+// WriterSink writes events as one JSON object per line. A batch is only accepted once it's been
+// written through to the underlying writer.
+type WriterSink struct {
+	wc  io.WriteCloser
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func NewWriterSink(wc io.WriteCloser) *WriterSink {
+	w := bufio.NewWriter(wc)
+	return &WriterSink{
+		wc:  wc,
+		w:   w,
+		enc: json.NewEncoder(w),
+	}
+}
+
+func (s *WriterSink) Publish(events []Event) error {
+	for _, ev := range events {
+		if err := s.enc.Encode(ev); err != nil {
+			return err
+		}
+	}
+
+	// A bufio.Writer keeps failing after the first error, so start over for the retry
+	if err := s.w.Flush(); err != nil {
+		s.w.Reset(s.wc)
+		return err
+	}
+	return nil
+}
+
+func (s *WriterSink) Close() error {
+	if err := s.w.Flush(); err != nil {
+		s.wc.Close()
+		return err
+	}
+	return s.wc.Close()
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
@@ -30,6 +30,8 @@ var NumWorkers int
 var Port int
 var Pprof string
 var Host string
+var Capture string
+var Speed float64
 
 // Flags
 func init() {
@@ -56,9 +58,12 @@ func init() {
 	flag.StringVar(&Host, "h", "localhost", "Hostname / IP to connect to.")
 	flag.StringVar(&Host, "host", "localhost", "Hostname / IP to connect to. (shorthand)")
 
+	flag.StringVar(&Capture, "capture", "", "Capture file to replay. Only used by replay.go.")
+	flag.Float64Var(&Speed, "speed", 1, "Replay speed relative to the original capture, e.g. 2 is twice as fast. 0 replays as fast as possible. Only used by replay.go.")
+
 	flag.Parse()
 
-	if (Binary && Text) || KeyLength <= 0 || NumOps <= 0 {
+	if (Binary && Text) || KeyLength <= 0 || NumOps <= 0 || Speed < 0 {
 		flag.Usage()
 		os.Exit(1)
 	}
@@ -0,0 +1,499 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rendclient is a Go client for rend using the memcached binary protocol. Besides the
+// standard commands, it supports the rend extensions: GetE to read when a key expires,
+// SetIfMatch, and deadline hints so rend can stop working on requests the client has given up on.
+//
+// A Client is safe for concurrent use. It keeps a pool of connections and uses one connection for
+// the whole of each call, so batches like GetMulti are pipelined on a single connection.
+package rendclient
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+const maxKeyLen = 250
+
+// Item is a single entry in the cache
+type Item struct {
+	Key   string
+	Value []byte
+	Flags uint32
+	// Exptime is the TTL to set the item with. Items read with GetE have it set to the time the
+	// item expires instead, as a unix timestamp, with 0 meaning the item never expires.
+	Exptime uint32
+}
+
+// Config is the configuration of a Client
+type Config struct {
+	// Network and Addr are given to net.Dial, e.g. "tcp" and "localhost:11211", or "unix" and the
+	// path of a socket. Network defaults to "tcp".
+	Network string
+	Addr    string
+
+	// MaxIdle is the most connections kept open while unused. Defaults to 2.
+	MaxIdle int
+
+	// DialTimeout bounds connecting to the server. Defaults to 1 second.
+	DialTimeout time.Duration
+
+	// Timeout bounds each call that is made with a context without a deadline. Defaults to 1
+	// second.
+	Timeout time.Duration
+
+	// DeadlineHints sends the time left until the deadline of each call along with the request,
+	// so rend abandons requests that would be answered too late. Only rend understands these, so
+	// this must be off when talking to anything else.
+	DeadlineHints bool
+}
+
+// Client is a client for a single rend endpoint
+type Client struct {
+	cfg Config
+
+	mu     sync.Mutex
+	idle   []*conn
+	closed bool
+}
+
+type conn struct {
+	nc     net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+	opaque uint32
+}
+
+// New returns a new Client for the server in cfg. Connections are only opened as they are needed.
+func New(cfg Config) *Client {
+	if cfg.Network == "" {
+		cfg.Network = "tcp"
+	}
+	if cfg.MaxIdle <= 0 {
+		cfg.MaxIdle = 2
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Second
+	}
+
+	return &Client{cfg: cfg}
+}
+
+// Close closes every idle connection. Calls in progress finish normally, but their connections are
+// closed afterwards and no new calls can be made.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	idle := c.idle
+	c.idle = nil
+	c.closed = true
+	c.mu.Unlock()
+
+	for _, cn := range idle {
+		cn.nc.Close()
+	}
+	return nil
+}
+
+func (c *Client) getConn(ctx context.Context) (*conn, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if n := len(c.idle); n > 0 {
+		cn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return cn, nil
+	}
+	c.mu.Unlock()
+
+	d := net.Dialer{Timeout: c.cfg.DialTimeout}
+	nc, err := d.DialContext(ctx, c.cfg.Network, c.cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &conn{
+		nc: nc,
+		r:  bufio.NewReader(nc),
+		w:  bufio.NewWriter(nc),
+	}, nil
+}
+
+// putConn returns a connection to the pool after a call. A connection that had any error other than
+// an error status from the server can't be trusted to be in sync anymore and is closed.
+func (c *Client) putConn(cn *conn, err error) {
+	if err != nil {
+		if _, ok := err.(*StatusError); !ok && !isStatus(err) {
+			cn.nc.Close()
+			return
+		}
+	}
+
+	c.mu.Lock()
+	if c.closed || len(c.idle) >= c.cfg.MaxIdle {
+		c.mu.Unlock()
+		cn.nc.Close()
+		return
+	}
+	c.idle = append(c.idle, cn)
+	c.mu.Unlock()
+}
+
+func isStatus(err error) bool {
+	switch err {
+	case ErrCacheMiss, ErrKeyExists, ErrNotStored, ErrTooBig, ErrNotSupported:
+		return true
+	}
+	return false
+}
+
+// do runs f with a connection whose I/O is bounded by the deadline of ctx, or the configured
+// timeout if it has none. f is given the deadline hint to send, if any.
+func (c *Client) do(ctx context.Context, f func(cn *conn, hint uint32) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(c.cfg.Timeout)
+	}
+
+	cn, err := c.getConn(ctx)
+	if err != nil {
+		return err
+	}
+
+	var hint uint32
+	if c.cfg.DeadlineHints {
+		// rounded up so a short deadline is still sent as one
+		hint = uint32((time.Until(deadline) + time.Millisecond - 1) / time.Millisecond)
+		if hint == 0 {
+			hint = 1
+		}
+	}
+
+	cn.nc.SetDeadline(deadline)
+	err = f(cn, hint)
+	c.putConn(cn, err)
+	return err
+}
+
+func (cn *conn) nextOpaque() uint32 {
+	cn.opaque++
+	return cn.opaque
+}
+
+// simple sends a single command and reads its response, checking that they match
+func (cn *conn) simple(opcode uint8, extras []uint32, key string, value []byte, hint uint32) (header, []byte, []byte, error) {
+	opaque := cn.nextOpaque()
+	if err := writeRequest(cn.w, opcode, extras, key, value, opaque, hint); err != nil {
+		return header{}, nil, nil, err
+	}
+	if err := cn.w.Flush(); err != nil {
+		return header{}, nil, nil, err
+	}
+
+	h, ex, val, err := readResponse(cn.r)
+	if err != nil {
+		return h, nil, nil, err
+	}
+	if h.opaque != opaque {
+		return h, nil, nil, errDesync
+	}
+	return h, ex, val, statusError(h)
+}
+
+func checkKey(key string) error {
+	if len(key) == 0 || len(key) > maxKeyLen {
+		return ErrMalformedKey
+	}
+	return nil
+}
+
+func (c *Client) get(ctx context.Context, opcode uint8, extras []uint32, key string) (*Item, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+
+	var it *Item
+	err := c.do(ctx, func(cn *conn, hint uint32) error {
+		_, ex, val, err := cn.simple(opcode, extras, key, nil, hint)
+		if err == nil {
+			it = item(key, ex, val)
+		}
+		return err
+	})
+	return it, err
+}
+
+// Get returns the item for key, or ErrCacheMiss if there is none
+func (c *Client) Get(ctx context.Context, key string) (*Item, error) {
+	return c.get(ctx, opGet, nil, key)
+}
+
+// GetE is Get with the expiration time of the item in Exptime. This is a rend extension.
+func (c *Client) GetE(ctx context.Context, key string) (*Item, error) {
+	return c.get(ctx, opGetE, nil, key)
+}
+
+// Gat returns the item for key and sets its TTL to exptime at the same time
+func (c *Client) Gat(ctx context.Context, key string, exptime uint32) (*Item, error) {
+	return c.get(ctx, opGat, []uint32{exptime}, key)
+}
+
+// GetMulti returns the items for all of keys that exist, keyed by key. The keys are sent in a single
+// pipelined batch.
+func (c *Client) GetMulti(ctx context.Context, keys []string) (map[string]*Item, error) {
+	return c.getMulti(ctx, opGetQ, keys)
+}
+
+// GetEMulti is GetMulti with the expiration time of each item in Exptime. This is a rend extension.
+func (c *Client) GetEMulti(ctx context.Context, keys []string) (map[string]*Item, error) {
+	return c.getMulti(ctx, opGetEQ, keys)
+}
+
+func (c *Client) getMulti(ctx context.Context, opcode uint8, keys []string) (map[string]*Item, error) {
+	for _, key := range keys {
+		if err := checkKey(key); err != nil {
+			return nil, err
+		}
+	}
+
+	items := make(map[string]*Item, len(keys))
+	if len(keys) == 0 {
+		return items, nil
+	}
+
+	err := c.do(ctx, func(cn *conn, hint uint32) error {
+		// The opaque of each quiet get is the index of its key after the first one, and a noop
+		// ends the batch so the end of the responses can be found
+		base := cn.opaque + 1
+		cn.opaque += uint32(len(keys)) + 1
+		for i, key := range keys {
+			if err := writeRequest(cn.w, opcode, nil, key, nil, base+uint32(i), hint); err != nil {
+				return err
+			}
+		}
+		if err := writeRequest(cn.w, opNoop, nil, "", nil, cn.opaque, 0); err != nil {
+			return err
+		}
+		if err := cn.w.Flush(); err != nil {
+			return err
+		}
+
+		// Error statuses are kept until the end so the connection stays in sync
+		var statusErr error
+		for {
+			h, ex, val, err := readResponse(cn.r)
+			if err != nil {
+				return err
+			}
+
+			if h.opcode == opNoop {
+				if h.opaque != cn.opaque {
+					return errDesync
+				}
+				return statusErr
+			}
+
+			idx := h.opaque - base
+			if h.opaque < base || idx >= uint32(len(keys)) {
+				return errDesync
+			}
+
+			switch err := statusError(h); err {
+			case nil:
+				items[keys[idx]] = item(keys[idx], ex, val)
+			case ErrCacheMiss:
+			default:
+				if statusErr == nil {
+					statusErr = err
+				}
+			}
+		}
+	})
+	return items, err
+}
+
+func (c *Client) store(ctx context.Context, opcode uint8, it *Item) error {
+	if err := checkKey(it.Key); err != nil {
+		return err
+	}
+
+	return c.do(ctx, func(cn *conn, hint uint32) error {
+		_, _, _, err := cn.simple(opcode, []uint32{it.Flags, it.Exptime}, it.Key, it.Value, hint)
+		return err
+	})
+}
+
+// Set stores the item unconditionally
+func (c *Client) Set(ctx context.Context, it *Item) error {
+	return c.store(ctx, opSet, it)
+}
+
+// Add stores the item only if the key doesn't exist yet, returning ErrKeyExists otherwise
+func (c *Client) Add(ctx context.Context, it *Item) error {
+	return c.store(ctx, opAdd, it)
+}
+
+// Replace stores the item only if the key exists, returning ErrCacheMiss otherwise
+func (c *Client) Replace(ctx context.Context, it *Item) error {
+	return c.store(ctx, opReplace, it)
+}
+
+func (c *Client) concat(ctx context.Context, opcode uint8, key string, value []byte) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	return c.do(ctx, func(cn *conn, hint uint32) error {
+		_, _, _, err := cn.simple(opcode, nil, key, value, hint)
+		return err
+	})
+}
+
+// Append adds value to the end of the existing value of key. If there is none, the error is
+// ErrCacheMiss or, from backends that answer like memcached does, ErrNotStored.
+func (c *Client) Append(ctx context.Context, key string, value []byte) error {
+	return c.concat(ctx, opAppend, key, value)
+}
+
+// Prepend adds value to the start of the existing value of key, with the same errors as Append
+func (c *Client) Prepend(ctx context.Context, key string, value []byte) error {
+	return c.concat(ctx, opPrepend, key, value)
+}
+
+// SetIfMatch stores the item only if the current value of the key is current, returning
+// ErrKeyExists if it's different and ErrCacheMiss if there is none. This is a rend extension.
+func (c *Client) SetIfMatch(ctx context.Context, it *Item, current []byte) error {
+	return c.setIfMatch(ctx, it, matchValue, current)
+}
+
+// SetIfHashMatch is SetIfMatch with the 64 bit FNV-1a hash of the current value instead of the
+// value itself, which keeps the request small for large values. This is a rend extension.
+func (c *Client) SetIfHashMatch(ctx context.Context, it *Item, hash uint64) error {
+	var match [8]byte
+	binary.BigEndian.PutUint64(match[:], hash)
+	return c.setIfMatch(ctx, it, matchHash, match[:])
+}
+
+func (c *Client) setIfMatch(ctx context.Context, it *Item, matchType uint32, match []byte) error {
+	if err := checkKey(it.Key); err != nil {
+		return err
+	}
+
+	// The match token goes between the key and the value
+	body := make([]byte, 0, len(match)+len(it.Value))
+	body = append(append(body, match...), it.Value...)
+	extras := []uint32{it.Flags, it.Exptime, matchType, uint32(len(match))}
+
+	return c.do(ctx, func(cn *conn, hint uint32) error {
+		_, _, _, err := cn.simple(opSetIfMatch, extras, it.Key, body, 0)
+		return err
+	})
+}
+
+// Delete removes key, returning ErrCacheMiss if it didn't exist
+func (c *Client) Delete(ctx context.Context, key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	return c.do(ctx, func(cn *conn, hint uint32) error {
+		_, _, _, err := cn.simple(opDelete, nil, key, nil, hint)
+		return err
+	})
+}
+
+// Touch sets the TTL of key to exptime, returning ErrCacheMiss if it doesn't exist
+func (c *Client) Touch(ctx context.Context, key string, exptime uint32) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	return c.do(ctx, func(cn *conn, hint uint32) error {
+		_, _, _, err := cn.simple(opTouch, []uint32{exptime}, key, nil, hint)
+		return err
+	})
+}
+
+// Version returns the version string of the server
+func (c *Client) Version(ctx context.Context) (string, error) {
+	var version string
+	err := c.do(ctx, func(cn *conn, hint uint32) error {
+		_, _, val, err := cn.simple(opVersion, nil, "", nil, 0)
+		version = string(val)
+		return err
+	})
+	return version, err
+}
+
+// Extensions returns the rend extensions the server supports, by name, with the version of each
+// and its parameters, e.g. "1 protocols=binary" for "deadline". A server that doesn't list its
+// extensions, like memcached or a port that only serves the spec, has none. The version of the list
+// itself is under "extensions".
+func (c *Client) Extensions(ctx context.Context) (map[string]string, error) {
+	exts := make(map[string]string)
+	err := c.do(ctx, func(cn *conn, hint uint32) error {
+		opaque := cn.nextOpaque()
+		if err := writeRequest(cn.w, opStat, nil, "extensions", nil, opaque, 0); err != nil {
+			return err
+		}
+		if err := cn.w.Flush(); err != nil {
+			return err
+		}
+
+		// one response per extension, ended by one without a key
+		for {
+			h, key, _, val, err := readKeyedResponse(cn.r)
+			if err != nil {
+				return err
+			}
+			if h.opaque != opaque {
+				return errDesync
+			}
+			if err := statusError(h); err != nil {
+				return err
+			}
+			if len(key) == 0 {
+				return nil
+			}
+			exts[string(key)] = string(val)
+		}
+	})
+
+	if _, ok := err.(*StatusError); ok || isStatus(err) {
+		return map[string]string{}, nil
+	}
+	return exts, err
+}
+
+// Ping checks that the server is responding
+func (c *Client) Ping(ctx context.Context) error {
+	return c.do(ctx, func(cn *conn, hint uint32) error {
+		_, _, _, err := cn.simple(opNoop, nil, "", nil, 0)
+		return err
+	})
+}
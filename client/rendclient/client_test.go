@@ -0,0 +1,199 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rendclient_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/client/rendclient"
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/inmem"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol/binprot"
+	"github.com/netflix/rend/server"
+)
+
+// serve runs an L1 only rend with an in memory L1 on a local port until the test ends
+func serve(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				h, _ := inmem.New()
+				oc := orcas.ConstV2(orcas.L1Only)(handlers.V2(h), nil, binprot.NewBinaryResponder(bufio.NewWriter(c)))
+				o := orcas.V1(context.Background(), oc)
+				server.Default([]io.Closer{c}, binprot.NewBinaryParser(bufio.NewReader(c)), o).Loop()
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestClient(t *testing.T) {
+	for _, hints := range []bool{false, true} {
+		c := rendclient.New(rendclient.Config{Addr: serve(t), DeadlineHints: hints})
+		defer c.Close()
+
+		ctx := context.Background()
+		prefix := "client-"
+		if hints {
+			prefix = "client-hints-"
+		}
+		key := func(k string) string { return prefix + k }
+
+		if _, err := c.Get(ctx, key("foo")); err != rendclient.ErrCacheMiss {
+			t.Fatalf("Expected a miss, got %v", err)
+		}
+
+		if err := c.Set(ctx, &rendclient.Item{Key: key("foo"), Value: []byte("bar"), Flags: 7, Exptime: 100}); err != nil {
+			t.Fatal(err)
+		}
+		it, err := c.Get(ctx, key("foo"))
+		if err != nil || string(it.Value) != "bar" || it.Flags != 7 {
+			t.Fatalf("Unexpected item %+v %v", it, err)
+		}
+
+		now := uint32(time.Now().Unix())
+		if it, err = c.GetE(ctx, key("foo")); err != nil || it.Exptime < now || it.Exptime > now+100 {
+			t.Fatalf("Expected the expiration time from GetE, got %+v %v", it, err)
+		}
+
+		if err := c.Add(ctx, &rendclient.Item{Key: key("new"), Value: []byte("a")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Replace(ctx, &rendclient.Item{Key: key("missing"), Value: []byte("a")}); err != rendclient.ErrCacheMiss {
+			t.Fatalf("Expected a replace of a missing key to miss, got %v", err)
+		}
+		if err := c.Append(ctx, key("missing"), []byte("b")); err != rendclient.ErrCacheMiss {
+			t.Fatalf("Expected an append to a missing key to miss, got %v", err)
+		}
+		if err := c.Append(ctx, key("new"), []byte("b")); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Prepend(ctx, key("new"), []byte("c")); err != nil {
+			t.Fatal(err)
+		}
+
+		items, err := c.GetMulti(ctx, []string{key("foo"), key("missing"), key("new")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != 2 || string(items[key("foo")].Value) != "bar" || string(items[key("new")].Value) != "cab" {
+			t.Fatalf("Unexpected items %v", items)
+		}
+
+		items, err = c.GetEMulti(ctx, []string{key("foo"), key("new")})
+		if err != nil || len(items) != 2 || items[key("foo")].Exptime == 0 {
+			t.Fatalf("Unexpected items %v %v", items, err)
+		}
+
+		if err := c.SetIfMatch(ctx, &rendclient.Item{Key: key("foo"), Value: []byte("baz")}, []byte("nope")); err != rendclient.ErrKeyExists {
+			t.Fatalf("Expected a mismatch, got %v", err)
+		}
+		if err := c.SetIfHashMatch(ctx, &rendclient.Item{Key: key("foo"), Value: []byte("baz")}, common.ValueHash([]byte("bar"))); err != nil {
+			t.Fatal(err)
+		}
+
+		if it, err = c.Gat(ctx, key("foo"), 0); err != nil || string(it.Value) != "baz" {
+			t.Fatalf("Unexpected item %+v %v", it, err)
+		}
+		if err := c.Touch(ctx, key("foo"), 10); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Delete(ctx, key("foo")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Get(ctx, key("foo")); err != rendclient.ErrCacheMiss {
+			t.Fatalf("Expected a miss after the delete, got %v", err)
+		}
+
+		if v, err := c.Version(ctx); err != nil || v != common.VersionString {
+			t.Fatalf("Unexpected version %q %v", v, err)
+		}
+		if err := c.Ping(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		exts, err := c.Extensions(ctx)
+		if err != nil || exts["extensions"] != "1" || exts["gete"] != "1" || exts["deadline"] != "1 protocols=binary" {
+			t.Fatalf("Unexpected extensions %v %v", exts, err)
+		}
+		if _, ok := exts["stale"]; ok {
+			t.Fatal("Expected stale to only be listed once its flag bit is reserved")
+		}
+
+		if _, err := c.Get(ctx, ""); err != rendclient.ErrMalformedKey {
+			t.Fatalf("Expected an empty key to be rejected, got %v", err)
+		}
+	}
+}
+
+func TestClientConcurrent(t *testing.T) {
+	c := rendclient.New(rendclient.Config{Addr: serve(t), MaxIdle: 4})
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	errs := make(chan error)
+	for i := 0; i < 8; i++ {
+		go func(i int) {
+			key := "concurrent-" + string(rune('a'+i))
+			for j := 0; j < 50; j++ {
+				if err := c.Set(ctx, &rendclient.Item{Key: key, Value: []byte(key)}); err != nil {
+					errs <- err
+					return
+				}
+				it, err := c.Get(ctx, key)
+				if err == nil && string(it.Value) != key {
+					t.Errorf("Expected %q, got %q", key, it.Value)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(i)
+	}
+
+	for i := 0; i < 8; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c.Close()
+	if err := c.Ping(ctx); err != rendclient.ErrClosed {
+		t.Fatalf("Expected a closed client to refuse calls, got %v", err)
+	}
+}
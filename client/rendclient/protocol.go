@@ -0,0 +1,217 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rendclient
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	magicRequest  = 0x80
+	magicResponse = 0x81
+
+	opGet        = 0x00
+	opSet        = 0x01
+	opAdd        = 0x02
+	opReplace    = 0x03
+	opDelete     = 0x04
+	opGetQ       = 0x09
+	opNoop       = 0x0a
+	opVersion    = 0x0b
+	opAppend     = 0x0e
+	opPrepend    = 0x0f
+	opStat       = 0x10
+	opTouch      = 0x1c
+	opGat        = 0x1d
+	opGetE       = 0x40
+	opGetEQ      = 0x41
+	opSetIfMatch = 0x42
+
+	matchValue = 0
+	matchHash  = 1
+
+	statusSuccess      = 0x00
+	statusKeyEnoent    = 0x01
+	statusKeyExists    = 0x02
+	statusE2big        = 0x03
+	statusNotStored    = 0x05
+	statusNotSupported = 0x83
+
+	headerLen = 24
+)
+
+var (
+	// ErrCacheMiss means the key doesn't exist
+	ErrCacheMiss = errors.New("rendclient: cache miss")
+	// ErrKeyExists means an add found the key already there, or a SetIfMatch found a different value
+	ErrKeyExists = errors.New("rendclient: key exists")
+	// ErrNotStored means the item wasn't stored, e.g. memcached's answer to an append to a missing
+	// key
+	ErrNotStored = errors.New("rendclient: item not stored")
+	// ErrTooBig means the value is larger than the server accepts
+	ErrTooBig = errors.New("rendclient: value too big")
+	// ErrNotSupported means the server doesn't support the command, e.g. a SetIfMatch against a
+	// plain memcached
+	ErrNotSupported = errors.New("rendclient: not supported")
+	// ErrMalformedKey means the key is empty or longer than 250 bytes
+	ErrMalformedKey = errors.New("rendclient: malformed key")
+	// ErrClosed means the client has been closed
+	ErrClosed = errors.New("rendclient: client closed")
+
+	errDesync = errors.New("rendclient: response doesn't match the request")
+)
+
+// StatusError is any other error status the server responded with. Servers started with
+// --echo-request-ids also send the ID of the failed request, which can be used to find it in the
+// server's logs.
+type StatusError struct {
+	Status    uint16
+	RequestID uint64
+}
+
+func (e *StatusError) Error() string {
+	if e.RequestID != 0 {
+		return fmt.Sprintf("rendclient: server error status 0x%x (request %016x)", e.Status, e.RequestID)
+	}
+	return fmt.Sprintf("rendclient: server error status 0x%x", e.Status)
+}
+
+func statusError(h header) error {
+	switch h.status {
+	case statusSuccess:
+		return nil
+	case statusKeyEnoent:
+		return ErrCacheMiss
+	case statusKeyExists:
+		return ErrKeyExists
+	case statusE2big:
+		return ErrTooBig
+	case statusNotStored:
+		return ErrNotStored
+	case statusNotSupported:
+		return ErrNotSupported
+	}
+	return &StatusError{Status: h.status, RequestID: h.cas}
+}
+
+// takesDeadline reports whether rend accepts a deadline hint after the standard extras of a command
+func takesDeadline(opcode uint8) bool {
+	switch opcode {
+	case opGet, opGetQ, opGetE, opGetEQ, opGat, opTouch, opDelete,
+		opSet, opAdd, opReplace, opAppend, opPrepend:
+		return true
+	}
+	return false
+}
+
+type header struct {
+	opcode    uint8
+	keyLen    uint16
+	extrasLen uint8
+	status    uint16
+	bodyLen   uint32
+	opaque    uint32
+	cas       uint64
+}
+
+// writeRequest writes a whole request. A deadline in milliseconds is added after the extras of the
+// commands that take one if it isn't 0.
+func writeRequest(w io.Writer, opcode uint8, extras []uint32, key string, value []byte, opaque, deadline uint32) error {
+	if deadline > 0 && takesDeadline(opcode) {
+		extras = append(extras, deadline)
+	}
+
+	extrasLen := 4 * len(extras)
+	buf := make([]byte, headerLen+extrasLen+len(key))
+	buf[0] = magicRequest
+	buf[1] = opcode
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(key)))
+	buf[4] = uint8(extrasLen)
+	binary.BigEndian.PutUint32(buf[8:12], uint32(extrasLen+len(key)+len(value)))
+	binary.BigEndian.PutUint32(buf[12:16], opaque)
+
+	for i, e := range extras {
+		binary.BigEndian.PutUint32(buf[headerLen+4*i:], e)
+	}
+	copy(buf[headerLen+extrasLen:], key)
+
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+	_, err := w.Write(value)
+	return err
+}
+
+func readHeader(r io.Reader) (header, error) {
+	var buf [headerLen]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return header{}, err
+	}
+	if buf[0] != magicResponse {
+		return header{}, errDesync
+	}
+
+	return header{
+		opcode:    buf[1],
+		keyLen:    binary.BigEndian.Uint16(buf[2:4]),
+		extrasLen: buf[4],
+		status:    binary.BigEndian.Uint16(buf[6:8]),
+		bodyLen:   binary.BigEndian.Uint32(buf[8:12]),
+		opaque:    binary.BigEndian.Uint32(buf[12:16]),
+		cas:       binary.BigEndian.Uint64(buf[16:24]),
+	}, nil
+}
+
+// readResponse reads a response and returns its body split into extras and value. Keys are only
+// sent back by rend in stats responses, so any key is skipped.
+func readResponse(r io.Reader) (header, []byte, []byte, error) {
+	h, _, extras, value, err := readKeyedResponse(r)
+	return h, extras, value, err
+}
+
+// readKeyedResponse is readResponse with the key of the response too
+func readKeyedResponse(r io.Reader) (header, []byte, []byte, []byte, error) {
+	h, err := readHeader(r)
+	if err != nil {
+		return h, nil, nil, nil, err
+	}
+
+	fixed := uint32(h.extrasLen) + uint32(h.keyLen)
+	if fixed > h.bodyLen {
+		return h, nil, nil, nil, errDesync
+	}
+
+	body := make([]byte, h.bodyLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return h, nil, nil, nil, err
+	}
+
+	return h, body[h.extrasLen:fixed], body[:h.extrasLen], body[fixed:], nil
+}
+
+// item builds an Item from the extras and value of a get, gete, or gat response
+func item(key string, extras, value []byte) *Item {
+	it := &Item{Key: key, Value: value}
+	if len(extras) >= 4 {
+		it.Flags = binary.BigEndian.Uint32(extras[0:4])
+	}
+	if len(extras) >= 8 {
+		it.Exptime = binary.BigEndian.Uint32(extras[4:8])
+	}
+	return it
+}
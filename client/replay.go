@@ -0,0 +1,249 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/capture"
+	"github.com/netflix/rend/client/binprot"
+	"github.com/netflix/rend/client/common"
+	"github.com/netflix/rend/client/f"
+	_ "github.com/netflix/rend/client/sigs"
+	"github.com/netflix/rend/client/stats"
+	"github.com/netflix/rend/client/textprot"
+	"github.com/netflix/rend/timer"
+)
+
+// replay.go feeds a capture recorded by a rend server with --capture-file back through a target,
+// either at the original pace, sped up or slowed down by --speed, or as fast as possible with
+// --speed 0. Requests for the same key always go over the same connection so their relative
+// order is preserved. Values are random data of the captured size.
+
+type result struct {
+	d    uint64
+	op   string
+	miss bool
+	err  bool
+}
+
+func main() {
+	if f.Capture == "" {
+		fmt.Println("ERROR: --capture is required")
+		os.Exit(1)
+	}
+
+	file, err := os.Open(f.Capture)
+	if err != nil {
+		fmt.Println("ERROR: opening capture:", err.Error())
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	var prot common.Prot
+	if f.Binary {
+		prot = binprot.BinProt{}
+	} else {
+		prot = textprot.TextProt{}
+	}
+
+	workers := make([]chan capture.Record, f.NumWorkers)
+	results := make(chan result, 100000)
+	comms := new(sync.WaitGroup)
+
+	for i := range workers {
+		conn, err := common.Connect(f.Host, f.Port)
+		if err != nil {
+			fmt.Println("ERROR: connecting:", err.Error())
+			os.Exit(1)
+		}
+
+		workers[i] = make(chan capture.Record, 1000)
+		comms.Add(1)
+		go replayer(prot, conn, workers[i], results, comms)
+	}
+
+	summary := new(sync.WaitGroup)
+	summary.Add(1)
+	go summarize(results, summary)
+
+	reader := capture.NewReader(file)
+
+	var first int64
+	var maxLag time.Duration
+	start := time.Now()
+	count := 0
+
+	for {
+		rec, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Println("ERROR: reading capture:", err.Error())
+			break
+		}
+
+		if count == 0 {
+			first = rec.Time
+		}
+		count++
+
+		if f.Speed > 0 {
+			due := start.Add(time.Duration(float64(rec.Time-first) / f.Speed))
+			if wait := time.Until(due); wait > 0 {
+				time.Sleep(wait)
+			} else if -wait > maxLag {
+				maxLag = -wait
+			}
+		}
+
+		h := fnv.New32a()
+		h.Write([]byte(rec.Keys[0]))
+		workers[h.Sum32()%uint32(len(workers))] <- rec
+	}
+
+	for _, w := range workers {
+		close(w)
+	}
+	comms.Wait()
+	close(results)
+	summary.Wait()
+
+	fmt.Printf("\nReplayed %d requests in %v\n", count, time.Since(start))
+	if f.Speed > 0 {
+		fmt.Printf("Max lag behind the capture schedule: %v\n", maxLag)
+	}
+}
+
+func replayer(prot common.Prot, conn net.Conn, recs <-chan capture.Record, results chan<- result, comms *sync.WaitGroup) {
+	defer comms.Done()
+	defer conn.Close()
+
+	r := rand.New(rand.NewSource(common.RandSeed()))
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	for rec := range recs {
+		var err error
+		key := []byte(rec.Keys[0])
+		start := timer.Now()
+
+		switch rec.Op {
+		case "get", "gete", "gets":
+			if len(rec.Keys) == 1 {
+				_, err = prot.Get(rw, key)
+			} else {
+				keys := make([][]byte, len(rec.Keys))
+				for i, k := range rec.Keys {
+					keys[i] = []byte(k)
+				}
+				_, err = prot.BatchGet(rw, keys)
+			}
+		case "gat":
+			if f.Binary {
+				_, err = prot.GAT(rw, key)
+			} else {
+				// no gat in the text protocol
+				_, err = prot.Get(rw, key)
+			}
+		case "set", "setif", "cas":
+			// the value or CAS value a conditional set matched isn't recorded, so it is replayed as a
+			// set
+			err = prot.Set(rw, key, common.RandData(r, rec.Size, true))
+		case "add":
+			err = prot.Add(rw, key, common.RandData(r, rec.Size, true))
+		case "replace":
+			err = prot.Replace(rw, key, common.RandData(r, rec.Size, true))
+		case "append":
+			err = prot.Append(rw, key, common.RandData(r, rec.Size, true))
+		case "prepend":
+			err = prot.Prepend(rw, key, common.RandData(r, rec.Size, true))
+		case "delete":
+			err = prot.Delete(rw, key)
+		case "touch":
+			err = prot.Touch(rw, key)
+		default:
+			continue
+		}
+
+		res := result{
+			d:    timer.Since(start),
+			op:   rec.Op,
+			miss: isMiss(err),
+			err:  err != nil && !isMiss(err),
+		}
+		results <- res
+
+		if err == io.EOF {
+			fmt.Println("Connection closed by the target")
+			// drain so the dispatcher doesn't block
+			for range recs {
+			}
+			return
+		}
+	}
+}
+
+func isMiss(err error) bool {
+	return err == common.ErrKeyNotFound || err == common.ErrKeyExists || err == common.ErrItemNotStored
+}
+
+func summarize(results <-chan result, summary *sync.WaitGroup) {
+	defer summary.Done()
+
+	times := make(map[string][]int)
+	misses := make(map[string]int)
+	errs := make(map[string]int)
+
+	for res := range results {
+		times[res.op] = append(times[res.op], int(res.d))
+		if res.miss {
+			misses[res.op]++
+		}
+		if res.err {
+			errs[res.op]++
+		}
+	}
+
+	ops := make([]string, 0, len(times))
+	for op := range times {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	for _, op := range ops {
+		t := times[op]
+		sort.Ints(t)
+		s := stats.Get(t)
+
+		fmt.Println()
+		fmt.Printf("%s (n = %d, misses = %d, errors = %d)\n", op, len(t), misses[op], errs[op])
+		fmt.Printf("Min: %fms\n", s.Min)
+		fmt.Printf("Max: %fms\n", s.Max)
+		fmt.Printf("Avg: %fms\n", s.Avg)
+		fmt.Printf("p50: %fms\n", s.P50)
+		fmt.Printf("p90: %fms\n", s.P90)
+		fmt.Printf("p99: %fms\n", s.P99)
+	}
+}
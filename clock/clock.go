@@ -0,0 +1,99 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package clock is the source of wall clock time for TTL math. Expiration times in the memcached
+// protocol are in wall clock seconds, so a host clock that's stepped (by an operator, or by NTP
+// catching up after a long drift) would otherwise expire every entry early or keep them around
+// far too long. The default clock reads the wall clock once and then advances with the monotonic
+// clock, so steps after startup don't move it. SkewGuard watches for the local clock or the
+// backends' clocks drifting away from it.
+package clock
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// RealTimeMaxDelta is the largest relative expiration time in the memcached protocol. Anything
+// larger is an absolute unix time.
+const RealTimeMaxDelta = 60 * 60 * 24 * 30
+
+// Clock tells the wall clock time
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// System is the host's wall clock, which follows any adjustment to it
+var System Clock = systemClock{}
+
+type monotonicClock struct {
+	base time.Time
+}
+
+func (m monotonicClock) Now() time.Time {
+	return m.base.Add(time.Since(m.base))
+}
+
+// Monotonic returns a Clock that starts at the current wall clock time and then moves with the
+// monotonic clock. It never goes backwards and ignores steps of the wall clock, but keeps any error
+// the wall clock had when it was made.
+func Monotonic() Clock {
+	return monotonicClock{base: time.Now()}
+}
+
+type holder struct {
+	c Clock
+}
+
+var current atomic.Value
+
+func init() {
+	current.Store(holder{Monotonic()})
+}
+
+// Set replaces the clock used by Now, e.g. with a fake one in tests
+func Set(c Clock) {
+	current.Store(holder{c})
+}
+
+// Now returns the current time of the clock in use, Monotonic by default
+func Now() time.Time {
+	return current.Load().(holder).c.Now()
+}
+
+// Unix returns the current time of the clock in use in unix seconds, the unit of TTL math
+func Unix() uint32 {
+	return uint32(Now().Unix())
+}
+
+// Deadline returns the unix time an entry set with the given memcached expiration time expires
+// at. 0 never expires and stays 0, times up to RealTimeMaxDelta are relative to now, and anything
+// larger is already a unix time.
+func Deadline(exptime uint32) uint32 {
+	if exptime == 0 || exptime > RealTimeMaxDelta {
+		return exptime
+	}
+	return Unix() + exptime
+}
+
+// Expired reports whether an entry that expires at the given unix time (0 for never) has expired
+func Expired(deadline uint32) bool {
+	return deadline != 0 && deadline < Unix()
+}
@@ -0,0 +1,78 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clock_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/clock"
+	"github.com/netflix/rend/common"
+)
+
+type fixed time.Time
+
+func (f fixed) Now() time.Time {
+	return time.Time(f)
+}
+
+func TestDeadline(t *testing.T) {
+	defer clock.Set(clock.Monotonic())
+	clock.Set(fixed(time.Unix(1500000000, 0)))
+
+	for exptime, expected := range map[uint32]uint32{
+		0:                          0,
+		60:                         1500000060,
+		clock.RealTimeMaxDelta:     1500000000 + clock.RealTimeMaxDelta,
+		clock.RealTimeMaxDelta + 1: clock.RealTimeMaxDelta + 1,
+		1600000000:                 1600000000,
+	} {
+		if d := clock.Deadline(exptime); d != expected {
+			t.Fatalf("Expected the deadline of %d to be %d, got %d", exptime, expected, d)
+		}
+	}
+
+	if clock.Expired(0) || clock.Expired(1500000000) || !clock.Expired(1499999999) {
+		t.Fatal("Expected only deadlines in the past to be expired")
+	}
+}
+
+func TestMonotonic(t *testing.T) {
+	c := clock.Monotonic()
+	a := c.Now()
+	time.Sleep(time.Millisecond)
+	if b := c.Now(); !b.After(a) || b.Sub(time.Now()) > time.Second {
+		t.Fatalf("Expected the monotonic clock to move forward with the wall clock, got %v then %v", a, b)
+	}
+}
+
+func TestSkewGuard(t *testing.T) {
+	g := clock.NewSkewGuard(5 * time.Second)
+	g.Add("ahead", func() (time.Time, error) { return clock.Now().Add(time.Minute), nil })
+	g.Add("inmem", func() (time.Time, error) { return time.Time{}, common.ErrNotSupported })
+	g.Add("down", func() (time.Time, error) { return time.Time{}, errors.New("connection refused") })
+
+	skews := g.Check()
+	if len(skews) != 2 {
+		t.Fatalf("Expected only the clocks that could be read, got %v", skews)
+	}
+	if s := skews["local"]; s > time.Second || s < -time.Second {
+		t.Fatalf("Expected the local clock to agree, got %v", s)
+	}
+	if s := skews["ahead"]; s < 59*time.Second || s > 61*time.Second {
+		t.Fatalf("Expected the clock a minute ahead to be a minute off, got %v", s)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clock
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricSkewChecks      = metrics.AddCounter("clock_skew_checks", nil)
+	MetricSkewCheckErrors = metrics.AddCounter("clock_skew_check_errors", nil)
+	MetricSkewAlarms      = metrics.AddCounter("clock_skew_alarms", nil)
+)
+
+// Source tells the time of some other clock, like a backend's
+type Source func() (time.Time, error)
+
+type source struct {
+	name    string
+	get     Source
+	gauge   uint32
+	alarmed bool
+}
+
+// SkewGuard compares other clocks with Now. The local wall clock is always one of them, which shows
+// how far it has been stepped since startup; backends like memcached keep their own time, and
+// absolute expiration times sent to them are only right if it agrees with ours. The skew of each
+// clock, in seconds and positive when it's ahead, is the clock_skew_seconds gauge tagged with the
+// clock's name. A skew over the limit counts an alarm and is logged until it recovers.
+type SkewGuard struct {
+	max time.Duration
+
+	lock    sync.Mutex
+	sources []*source
+}
+
+// NewSkewGuard makes a guard that alarms on skews larger than max. Backend clocks are usually only
+// known to the second, so max should be a few seconds at least.
+func NewSkewGuard(max time.Duration) *SkewGuard {
+	g := &SkewGuard{max: max}
+	g.Add("local", func() (time.Time, error) { return System.Now(), nil })
+	return g
+}
+
+// Add compares the clock of s, under the given name, on every check. A source that returns
+// common.ErrNotSupported, e.g. a backend that can't tell its time, is skipped.
+func (g *SkewGuard) Add(name string, s Source) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.sources = append(g.sources, &source{
+		name:  name,
+		get:   s,
+		gauge: metrics.AddFloatGauge("clock_skew_seconds", metrics.Tags{"clock": name}),
+	})
+}
+
+// Check compares every clock with Now once and returns their skews by name
+func (g *SkewGuard) Check() map[string]time.Duration {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	skews := make(map[string]time.Duration, len(g.sources))
+
+	for _, s := range g.sources {
+		t, err := s.get()
+		if errors.Is(err, common.ErrNotSupported) {
+			continue
+		}
+		metrics.IncCounter(MetricSkewChecks)
+		if err != nil {
+			metrics.IncCounter(MetricSkewCheckErrors)
+			continue
+		}
+
+		skew := t.Sub(Now())
+		skews[s.name] = skew
+		metrics.SetFloatGauge(s.gauge, skew.Seconds())
+
+		over := skew > g.max || skew < -g.max
+		switch {
+		case over:
+			metrics.IncCounter(MetricSkewAlarms)
+			if !s.alarmed {
+				log.Printf("Clock skew alarm: the %s clock is %v off, more than %v. Expiration times are likely wrong.\n", s.name, skew, g.max)
+			}
+		case s.alarmed:
+			log.Printf("Clock skew recovered: the %s clock is %v off\n", s.name, skew)
+		}
+		s.alarmed = over
+	}
+
+	return skews
+}
+
+// Watch checks the clocks every interval, forever
+func (g *SkewGuard) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		g.Check()
+	}
+}
@@ -21,7 +21,9 @@
 package common
 
 import (
-	"errors"
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
 
 	"github.com/netflix/rend/metrics"
 )
@@ -38,49 +40,8 @@ var (
 	MetricBytesWrittenLocal   = metrics.AddCounter("bytes_written_local", nil)
 	MetricBytesWrittenLocalL1 = metrics.AddCounter("bytes_written_local_l1", nil)
 	MetricBytesWrittenLocalL2 = metrics.AddCounter("bytes_written_local_l2", nil)
-
-	// Errors used across the application
-	ErrBadRequest = errors.New("CLIENT_ERROR bad request")
-	ErrBadLength  = errors.New("CLIENT_ERROR length is not a valid integer")
-	ErrBadFlags   = errors.New("CLIENT_ERROR flags is not a valid integer")
-	ErrBadExptime = errors.New("CLIENT_ERROR exptime is not a valid integer")
-
-	ErrNoError        = errors.New("Success")
-	ErrKeyNotFound    = errors.New("ERROR Key not found")
-	ErrKeyExists      = errors.New("ERROR Key already exists")
-	ErrValueTooBig    = errors.New("ERROR Value too big")
-	ErrInvalidArgs    = errors.New("ERROR Invalid arguments")
-	ErrItemNotStored  = errors.New("ERROR Item not stored")
-	ErrBadIncDecValue = errors.New("ERROR Bad increment/decrement value")
-	ErrAuth           = errors.New("ERROR Authentication error")
-	ErrUnknownCmd     = errors.New("ERROR Unknown command")
-	ErrNoMem          = errors.New("ERROR Out of memory")
-	ErrNotSupported   = errors.New("ERROR Not supported")
-	ErrInternal       = errors.New("ERROR Internal error")
-	ErrBusy           = errors.New("ERROR Busy")
-	ErrTempFailure    = errors.New("ERROR Temporary error")
 )
 
-// IsAppError differentiates between protocol-defined errors that are relatively benign and other
-// fatal errors like an IO error because of some socket problem or network issue.
-// Make sure to keep this list in sync with the one above. It should contain all Err* that could
-// come back from memcached itself
-func IsAppError(err error) bool {
-	return err == ErrKeyNotFound ||
-		err == ErrKeyExists ||
-		err == ErrValueTooBig ||
-		err == ErrInvalidArgs ||
-		err == ErrItemNotStored ||
-		err == ErrBadIncDecValue ||
-		err == ErrAuth ||
-		err == ErrUnknownCmd ||
-		err == ErrNoMem ||
-		err == ErrNotSupported ||
-		err == ErrInternal ||
-		err == ErrBusy ||
-		err == ErrTempFailure
-}
-
 // RequestType is the protocol-agnostic identifier for the command
 type RequestType int
 
@@ -131,6 +92,53 @@ const (
 
 	// RequestVersion replies with a string designating the current software version
 	RequestVersion
+
+	// RequestMultiSet is a batch of sets that arrived pipelined together, e.g. a run of SETQ
+	// commands in the binary protocol. Each item is answered as if it were its own set.
+	RequestMultiSet
+
+	// RequestMultiDelete is a batch of deletes that arrived together, e.g. a run of DELETEQ
+	// commands in the binary protocol or a delete of many keys in the text protocol. Each item is
+	// answered as if it were its own delete.
+	RequestMultiDelete
+
+	// RequestSetIfMatch is a custom set that only stores the new value if the current value of the
+	// key, or a hash of it, matches a token given with the request
+	RequestSetIfMatch
+
+	// RequestGetLock is a get that also locks the key for a while. Other attempts to lock it fail
+	// until it's unlocked or the lock expires.
+	RequestGetLock
+
+	// RequestUnlock releases a lock taken with RequestGetLock
+	RequestUnlock
+
+	// RequestGets is a get that also returns the CAS value of each hit
+	RequestGets
+
+	// RequestCAS is a set that only stores the new value if the CAS value of the key is still the
+	// one given with the request, i.e. nobody else has written it since it was last read
+	RequestCAS
+
+	// RequestStats reports the server's stats, in the same form as memcached's stats command
+	RequestStats
+
+	// RequestIncr adds to a key holding a decimal number, see ArithRequest
+	RequestIncr
+
+	// RequestDecr subtracts from a key holding a decimal number, see ArithRequest
+	RequestDecr
+
+	// RequestFlush removes every key
+	RequestFlush
+)
+
+const (
+	// DefaultLockTime is how many seconds a lock is held for when the request doesn't say
+	DefaultLockTime = 15
+	// MaxLockTime is the longest a lock can be held for, in seconds. Longer requests are cut down
+	// to it, so a client that goes away can't hold a key for long.
+	MaxLockTime = 30
 )
 
 type Request interface {
@@ -157,6 +165,143 @@ func (r SetRequest) IsQuiet() bool {
 	return r.Quiet
 }
 
+// MultiSetRequest corresponds to common.RequestMultiSet. It holds the individual sets in the order
+// they were received. Each one keeps its own opaque and quiet values so responses can be matched up
+// by the client exactly as if the sets had been processed one at a time.
+type MultiSetRequest struct {
+	Sets []SetRequest
+}
+
+// GetOpaque returns the opaque value of the last set in the batch, which is the one that ends it.
+func (r MultiSetRequest) GetOpaque() uint32 {
+	if len(r.Sets) == 0 {
+		return 0
+	}
+	return r.Sets[len(r.Sets)-1].Opaque
+}
+
+// IsQuiet is only true if every set in the batch is quiet.
+func (r MultiSetRequest) IsQuiet() bool {
+	for _, s := range r.Sets {
+		if !s.Quiet {
+			return false
+		}
+	}
+	return true
+}
+
+// SetIfMatchRequest corresponds to common.RequestSetIfMatch. The embedded SetRequest is the set to
+// do if the key currently holds the value given by Match. If MatchHash is true, Match is instead the
+// 8 byte big endian ValueHash of the current value, which keeps requests small for large values.
+type SetIfMatchRequest struct {
+	SetRequest
+	Match     []byte
+	MatchHash bool
+}
+
+// Matches returns whether the current value of the key satisfies the request
+func (r SetIfMatchRequest) Matches(current []byte) bool {
+	if r.MatchHash {
+		return len(r.Match) == 8 && binary.BigEndian.Uint64(r.Match) == ValueHash(current)
+	}
+	return bytes.Equal(r.Match, current)
+}
+
+// ValueHash is the hash of a value used to match it in a SetIfMatchRequest. It is the 64 bit FNV-1a
+// hash of the data.
+func ValueHash(data []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(data)
+	return h.Sum64()
+}
+
+// CASRequest is a memcached "cas" command: the embedded SetRequest is the set to do if the CAS value
+// of the key is still Cas, i.e. it hasn't been written since it was read along with that value.
+type CASRequest struct {
+	SetRequest
+	Cas uint64
+}
+
+// ArithRequest is an increment or decrement of a key holding a decimal number, by Delta. If the key
+// isn't there and Create is set, it's stored as Initial with Exptime instead, which the binary
+// protocol asks for with any expiration but 0xffffffff.
+type ArithRequest struct {
+	Key     []byte
+	Delta   uint64
+	Initial uint64
+	Exptime uint32
+	Create  bool
+	Opaque  uint32
+	Quiet   bool
+}
+
+func (r ArithRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r ArithRequest) IsQuiet() bool {
+	return r.Quiet
+}
+
+// FlushRequest corresponds to common.RequestFlush. Delay is the number of seconds to wait before
+// flushing, given by the optional expiration extras of the binary protocol.
+type FlushRequest struct {
+	Delay  uint32
+	Opaque uint32
+	Quiet  bool
+}
+
+func (r FlushRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r FlushRequest) IsQuiet() bool {
+	return r.Quiet
+}
+
+// GetLockRequest corresponds to common.RequestGetLock. LockTime is how many seconds the lock is held
+// for if it isn't unlocked first, see LockTimeOf.
+type GetLockRequest struct {
+	Key      []byte
+	LockTime uint32
+	Opaque   uint32
+}
+
+func (r GetLockRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r GetLockRequest) IsQuiet() bool {
+	return false
+}
+
+// LockTimeOf returns the lock time a request gets: DefaultLockTime for 0, and at most
+// MaxLockTime
+func LockTimeOf(r GetLockRequest) uint32 {
+	switch {
+	case r.LockTime == 0:
+		return DefaultLockTime
+	case r.LockTime > MaxLockTime:
+		return MaxLockTime
+	}
+	return r.LockTime
+}
+
+// UnlockRequest corresponds to common.RequestUnlock. Token is the one the lock was taken with.
+type UnlockRequest struct {
+	Key    []byte
+	Token  uint64
+	Opaque uint32
+}
+
+func (r UnlockRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r UnlockRequest) IsQuiet() bool {
+	return false
+}
+
 // GetRequest corresponds to common.RequestGet. It contains all the information required to fulfill
 // a get requestGets are batch by default, so single gets and batch gets are both represented by the
 // same type.
@@ -195,6 +340,30 @@ func (r DeleteRequest) IsQuiet() bool {
 	return r.Quiet
 }
 
+// MultiDeleteRequest corresponds to common.RequestMultiDelete. It holds the individual deletes in
+// the order they were received, each with its own opaque and quiet values.
+type MultiDeleteRequest struct {
+	Deletes []DeleteRequest
+}
+
+// GetOpaque returns the opaque value of the last delete in the batch, which is the one that ends it.
+func (r MultiDeleteRequest) GetOpaque() uint32 {
+	if len(r.Deletes) == 0 {
+		return 0
+	}
+	return r.Deletes[len(r.Deletes)-1].Opaque
+}
+
+// IsQuiet is only true if every delete in the batch is quiet.
+func (r MultiDeleteRequest) IsQuiet() bool {
+	for _, d := range r.Deletes {
+		if !d.Quiet {
+			return false
+		}
+	}
+	return true
+}
+
 // TouchRequest corresponds to common.RequestTouch. It contains all the information required to
 // fulfill a touch request.
 type TouchRequest struct {
@@ -272,6 +441,21 @@ func (r VersionRequest) IsQuiet() bool {
 	return false
 }
 
+// StatsRequest corresponds to common.RequestStats. Group is the optional argument of the stats
+// command selecting a subset of stats; only the general group ("") is supported.
+type StatsRequest struct {
+	Group  string
+	Opaque uint32
+}
+
+func (r StatsRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r StatsRequest) IsQuiet() bool {
+	return false
+}
+
 // GetResponse is used in both RequestGet and RequestGat handling. Both respond in the same manner
 // but with different opcodes. It is binary-protocol specific, but is still a part of the interface
 // of responder to make the handling code more protocol-agnostic.
@@ -282,6 +466,8 @@ type GetResponse struct {
 	Flags  uint32
 	Miss   bool
 	Quiet  bool
+	// Cas is the CAS value of the data, for handlers that keep one. 0 means unknown.
+	Cas uint64
 }
 
 // GetEResponse is used in the GetE protocol extension
@@ -294,3 +480,12 @@ type GetEResponse struct {
 	Miss    bool
 	Quiet   bool
 }
+
+// GetLockResponse is the value of a key that was just locked, along with the token that unlocks it
+type GetLockResponse struct {
+	Key    []byte
+	Data   []byte
+	Opaque uint32
+	Flags  uint32
+	Token  uint64
+}
@@ -0,0 +1,210 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import "errors"
+
+// ErrorClass is the broad category of an error, which decides how the rest of the application
+// reacts to it without having to compare against every specific error.
+type ErrorClass int
+
+const (
+	// ClassNone is the class of a nil error
+	ClassNone ErrorClass = iota
+	// ClassFatal is anything that isn't one of the errors below, like an I/O error on a socket. The
+	// connection it happened on can't be trusted afterwards.
+	ClassFatal
+	// ClassClient means the request couldn't be parsed
+	ClassClient
+	// ClassNotFound means the key doesn't exist
+	ClassNotFound
+	// ClassConflict means the condition of a conditional write didn't hold, e.g. an add of a key
+	// that exists or a replace of one that doesn't
+	ClassConflict
+	// ClassInvalid means the request was understood but can't be served as given
+	ClassInvalid
+	// ClassServer means the server or a backend couldn't serve the request right now
+	ClassServer
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ClassNone:
+		return "none"
+	case ClassFatal:
+		return "fatal"
+	case ClassClient:
+		return "client"
+	case ClassNotFound:
+		return "not_found"
+	case ClassConflict:
+		return "conflict"
+	case ClassInvalid:
+		return "invalid"
+	case ClassServer:
+		return "server"
+	}
+	return "unknown"
+}
+
+// Error is the structured form of every error the application knows how to respond with. Status
+// is the memcached binary protocol status code for the error, which other protocols translate from
+// as well.
+//
+// The Err* values below are all of type *Error and are still meant to be compared against, either
+// directly or with errors.Is. Errors made with Wrap compare equal to the sentinel they were made
+// from with errors.Is while also carrying their cause.
+type Error struct {
+	Class     ErrorClass
+	Status    uint16
+	Retryable bool
+	Message   string
+	Cause     error
+
+	sentinel error
+}
+
+func (e *Error) Error() string {
+	if e.Cause != nil {
+		return e.Message + ": " + e.Cause.Error()
+	}
+	return e.Message
+}
+
+// Unwrap returns the cause of the error, if any
+func (e *Error) Unwrap() error {
+	return e.Cause
+}
+
+// Is reports whether e was made from target with Wrap, or from an error that was
+func (e *Error) Is(target error) bool {
+	return e.sentinel != nil && errors.Is(e.sentinel, target)
+}
+
+// Wrap returns a copy of the sentinel error carrying a cause. The result still satisfies
+// errors.Is(result, sentinel). A sentinel that isn't an *Error is returned as is.
+func Wrap(sentinel, cause error) error {
+	s, ok := sentinel.(*Error)
+	if !ok {
+		return sentinel
+	}
+	w := *s
+	w.Cause = cause
+	w.sentinel = sentinel
+	return &w
+}
+
+// ServerError is an error that rend itself reports to clients with a free form message, e.g. when
+// the server is in a mode where the request can't be served. It goes out as a SERVER_ERROR in the
+// text protocol. The binary protocol has no room for a message, so it goes out as a temporary
+// failure.
+func ServerError(msg string) error {
+	return &Error{
+		Class:     ClassServer,
+		Status:    0x86,
+		Retryable: true,
+		Message:   "SERVER_ERROR " + msg,
+	}
+}
+
+func newError(class ErrorClass, status uint16, retryable bool, msg string) error {
+	return &Error{
+		Class:     class,
+		Status:    status,
+		Retryable: retryable,
+		Message:   msg,
+	}
+}
+
+// Errors used across the application
+var (
+	ErrBadRequest = newError(ClassClient, 0xFFFF, false, "CLIENT_ERROR bad request")
+	ErrBadLength  = newError(ClassClient, 0xFFFF, false, "CLIENT_ERROR length is not a valid integer")
+	ErrBadFlags   = newError(ClassClient, 0xFFFF, false, "CLIENT_ERROR flags is not a valid integer")
+	ErrBadExptime = newError(ClassClient, 0xFFFF, false, "CLIENT_ERROR exptime is not a valid integer")
+
+	ErrNoError        = newError(ClassNone, 0x00, false, "Success")
+	ErrKeyNotFound    = newError(ClassNotFound, 0x01, false, "ERROR Key not found")
+	ErrKeyExists      = newError(ClassConflict, 0x02, false, "ERROR Key already exists")
+	ErrValueTooBig    = newError(ClassInvalid, 0x03, false, "ERROR Value too big")
+	ErrInvalidArgs    = newError(ClassInvalid, 0x04, false, "ERROR Invalid arguments")
+	ErrItemNotStored  = newError(ClassConflict, 0x05, false, "ERROR Item not stored")
+	ErrBadIncDecValue = newError(ClassInvalid, 0x06, false, "ERROR Bad increment/decrement value")
+	ErrNotMyVBucket   = newError(ClassClient, 0x07, false, "CLIENT_ERROR vbucket is not served here")
+	ErrLocked         = newError(ClassConflict, 0x09, true, "ERROR Key is locked")
+	ErrNotLocked      = newError(ClassConflict, 0x0e, false, "ERROR Key is not locked")
+	ErrAuth           = newError(ClassInvalid, 0x20, false, "ERROR Authentication error")
+	ErrUnknownCmd     = newError(ClassInvalid, 0x81, false, "ERROR Unknown command")
+	ErrNoMem          = newError(ClassServer, 0x82, true, "ERROR Out of memory")
+	ErrNotSupported   = newError(ClassInvalid, 0x83, false, "ERROR Not supported")
+	ErrInternal       = newError(ClassServer, 0x84, false, "ERROR Internal error")
+	ErrBusy           = newError(ClassServer, 0x85, true, "ERROR Busy")
+	ErrTempFailure    = newError(ClassServer, 0x86, true, "ERROR Temporary error")
+
+	// ErrNotAdded is what an add fails with when the key is already there. It is an ErrKeyExists
+	// with errors.Is, and has the same status, but lets the text protocol tell it apart from a
+	// failed cas: memcached answers NOT_STORED to one and EXISTS to the other.
+	ErrNotAdded = &Error{Class: ClassConflict, Status: 0x02, Message: "ERROR Key already exists", sentinel: ErrKeyExists}
+)
+
+// Errors from parsers in strict mode, which say exactly what was wrong with a request. They're all
+// client errors, so the connection stays open. The binary protocol gets the closest status.
+var (
+	ErrBadCommandLine = newError(ClassClient, 0x04, false, "CLIENT_ERROR bad command line format")
+	ErrBadDataChunk   = newError(ClassClient, 0x04, false, "CLIENT_ERROR bad data chunk")
+	ErrBadLineEnding  = newError(ClassClient, 0x04, false, "CLIENT_ERROR line does not end with \\r\\n")
+	ErrLineTooLong    = newError(ClassClient, 0x04, false, "CLIENT_ERROR line is longer than 2048 bytes")
+	ErrBadKey         = newError(ClassClient, 0x04, false, "CLIENT_ERROR key is empty or has spaces or control characters")
+	ErrKeyTooLong     = newError(ClassClient, 0x04, false, "CLIENT_ERROR key is longer than 250 bytes")
+	ErrBadExtras      = newError(ClassClient, 0x04, false, "CLIENT_ERROR wrong extras length for command")
+	ErrBadBody        = newError(ClassClient, 0x04, false, "CLIENT_ERROR unexpected key or value for command")
+	ErrBadDataType    = newError(ClassClient, 0x04, false, "CLIENT_ERROR data type must be raw bytes")
+	ErrExtension      = newError(ClassClient, 0x81, false, "CLIENT_ERROR command is not part of the memcached protocol")
+)
+
+// AsError returns the structured form of err, if it has one anywhere in its chain
+func AsError(err error) (*Error, bool) {
+	var e *Error
+	ok := errors.As(err, &e)
+	return e, ok
+}
+
+// ClassOf returns the class of any error. Errors that aren't structured are fatal.
+func ClassOf(err error) ErrorClass {
+	if err == nil {
+		return ClassNone
+	}
+	if e, ok := AsError(err); ok {
+		return e.Class
+	}
+	return ClassFatal
+}
+
+// IsRetryable reports whether the same request may succeed if it is simply tried again
+func IsRetryable(err error) bool {
+	e, ok := AsError(err)
+	return ok && e.Retryable
+}
+
+// IsAppError differentiates between protocol-defined errors that are relatively benign and other
+// fatal errors like an IO error because of some socket problem or network issue. Errors that the
+// request parsers return are not app errors, since the connection is no longer usable after them.
+func IsAppError(err error) bool {
+	switch ClassOf(err) {
+	case ClassNotFound, ClassConflict, ClassInvalid, ClassServer:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common_test
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/netflix/rend/common"
+)
+
+func TestWrap(t *testing.T) {
+	err := common.Wrap(common.ErrKeyExists, io.ErrUnexpectedEOF)
+
+	if err == common.ErrKeyExists || !errors.Is(err, common.ErrKeyExists) {
+		t.Fatal("Expected a wrapped error to match its sentinel with errors.Is only")
+	}
+	if errors.Is(err, common.ErrItemNotStored) {
+		t.Fatal("Expected a wrapped error not to match a different sentinel of the same class")
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatal("Expected a wrapped error to match its cause")
+	}
+	if err.Error() != "ERROR Key already exists: unexpected EOF" {
+		t.Fatalf("Unexpected message %q", err.Error())
+	}
+
+	e, ok := common.AsError(err)
+	if !ok || e.Status != 0x02 || e.Class != common.ClassConflict {
+		t.Fatalf("Expected the sentinel's status and class, got %+v", e)
+	}
+
+	// a failed add is still a key that exists, wrapped or not
+	err = common.Wrap(common.ErrNotAdded, io.ErrUnexpectedEOF)
+	if !errors.Is(err, common.ErrNotAdded) || !errors.Is(err, common.ErrKeyExists) {
+		t.Fatal("Expected a wrapped failed add to match both ErrNotAdded and ErrKeyExists")
+	}
+	if errors.Is(common.ErrKeyExists, common.ErrNotAdded) {
+		t.Fatal("Expected ErrKeyExists not to be a failed add")
+	}
+}
+
+func TestClasses(t *testing.T) {
+	tests := []struct {
+		err       error
+		class     common.ErrorClass
+		app       bool
+		retryable bool
+	}{
+		{nil, common.ClassNone, false, false},
+		{io.EOF, common.ClassFatal, false, false},
+		{common.ErrBadLength, common.ClassClient, false, false},
+		{common.ErrKeyNotFound, common.ClassNotFound, true, false},
+		{common.ErrItemNotStored, common.ClassConflict, true, false},
+		{common.ErrValueTooBig, common.ClassInvalid, true, false},
+		{common.ErrBusy, common.ClassServer, true, true},
+		{common.ServerError("read-only"), common.ClassServer, true, true},
+		{common.Wrap(common.ErrTempFailure, io.EOF), common.ClassServer, true, true},
+	}
+
+	for _, test := range tests {
+		if c := common.ClassOf(test.err); c != test.class {
+			t.Errorf("%v: expected class %v, got %v", test.err, test.class, c)
+		}
+		if common.IsAppError(test.err) != test.app {
+			t.Errorf("%v: expected IsAppError to be %v", test.err, test.app)
+		}
+		if common.IsRetryable(test.err) != test.retryable {
+			t.Errorf("%v: expected IsRetryable to be %v", test.err, test.retryable)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ExtensionsStatsGroup is the stats group rend lists its extensions in, so clients can find out
+// which of them an endpoint supports with "stats extensions" in the text protocol or a stat request
+// with the group as the key in the binary protocol. Each extension is a stat named after it whose
+// value is its version, followed by any parameters as name=value, e.g. "deadline 1
+// protocols=binary". A memcached server, or a rend from before the list, answers with an error,
+// which means no extensions.
+const ExtensionsStatsGroup = "extensions"
+
+// ExtensionsVersion is the version of the list itself. It's always the first stat of the group,
+// named "extensions", so changes to the form of the list can be told apart from its contents.
+const ExtensionsVersion = 1
+
+// Extension is a rend feature that clients have to opt into and so need to know about first. The
+// version goes up whenever the extension changes in a way clients can tell.
+type Extension struct {
+	Name    string
+	Version int
+	// Protocols are the names of the protocols the extension is available in, see
+	// protocol.Components.Name. It's available in every protocol if it's empty.
+	Protocols []string
+	// Flag is set if the extension marks values with a bit of the client-visible flags. The bit is
+	// reserved under this name in DefaultFlagBits, and the extension is only advertised, with the
+	// bit as a parameter, once something has reserved it.
+	Flag string
+}
+
+var (
+	extensions     = make(map[string]Extension)
+	extensionsLock = new(sync.RWMutex)
+)
+
+// The extensions every rend serves. Features that are only there when configured register their
+// own, or use Flag.
+func init() {
+	RegisterExtension(Extension{Name: "gete", Version: 1})
+	RegisterExtension(Extension{Name: "setif", Version: 1})
+	RegisterExtension(Extension{Name: "getl", Version: 1})
+	RegisterExtension(Extension{Name: "noop", Version: 1, Protocols: []string{"text"}})
+	RegisterExtension(Extension{Name: "mdelete", Version: 1, Protocols: []string{"text"}})
+	RegisterExtension(Extension{Name: "deadline", Version: 1, Protocols: []string{"binary"}})
+	RegisterExtension(Extension{Name: "stale", Version: 1, Flag: FlagStale})
+	RegisterExtension(Extension{Name: "l1-only", Version: 1, Flag: FlagL1Only})
+	RegisterExtension(Extension{Name: "l2-only", Version: 1, Flag: FlagL2Only})
+	RegisterExtension(Extension{Name: "replicate", Version: 1, Flag: FlagReplicate})
+	RegisterExtension(Extension{Name: "no-chunk", Version: 1, Flag: FlagNoChunk})
+}
+
+// RegisterExtension adds e to the extensions rend advertises. Registering the same name twice
+// panics.
+func RegisterExtension(e Extension) {
+	extensionsLock.Lock()
+	defer extensionsLock.Unlock()
+
+	if _, dup := extensions[e.Name]; dup {
+		panic("common: RegisterExtension called twice for " + e.Name)
+	}
+	extensions[e.Name] = e
+}
+
+// AdvertisedExtension is an extension as it's advertised, with the flag bit it was given if it
+// has a Flag
+type AdvertisedExtension struct {
+	Extension
+	Bit int
+}
+
+// Value returns the value of the extension's stat: the version and then its parameters
+func (a AdvertisedExtension) Value() string {
+	v := strconv.Itoa(a.Version)
+	if len(a.Protocols) > 0 {
+		v += " protocols=" + strings.Join(a.Protocols, ",")
+	}
+	if a.Flag != "" {
+		v += " bit=" + strconv.Itoa(a.Bit)
+	}
+	return v
+}
+
+// Extensions returns the extensions to advertise, sorted by name. Those with a Flag whose bit isn't
+// reserved in DefaultFlagBits are left out.
+func Extensions() []AdvertisedExtension {
+	reserved := DefaultFlagBits.Reservations()
+
+	extensionsLock.RLock()
+	defer extensionsLock.RUnlock()
+
+	res := make([]AdvertisedExtension, 0, len(extensions))
+	for _, e := range extensions {
+		a := AdvertisedExtension{Extension: e}
+		if e.Flag != "" {
+			bit, ok := reserved[e.Flag]
+			if !ok {
+				continue
+			}
+			a.Bit = bit
+		}
+		res = append(res, a)
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
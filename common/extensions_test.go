@@ -0,0 +1,60 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common_test
+
+import (
+	"testing"
+
+	"github.com/netflix/rend/common"
+)
+
+func TestExtensions(t *testing.T) {
+	find := func(name string) (common.AdvertisedExtension, bool) {
+		for _, e := range common.Extensions() {
+			if e.Name == name {
+				return e, true
+			}
+		}
+		return common.AdvertisedExtension{}, false
+	}
+
+	exts := common.Extensions()
+	for i := 1; i < len(exts); i++ {
+		if exts[i-1].Name >= exts[i].Name {
+			t.Fatalf("Expected the extensions sorted by name, got %v", exts)
+		}
+	}
+
+	if e, ok := find("deadline"); !ok || e.Value() != "1 protocols=binary" {
+		t.Fatalf("Unexpected deadline extension %+v", e)
+	}
+	if _, ok := find("stale"); ok {
+		t.Fatal("Expected stale to be left out until its flag bit is reserved")
+	}
+
+	if _, err := common.ReserveFlagBit(common.FlagStale, 30); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := find("stale"); !ok || e.Value() != "1 bit=30" {
+		t.Fatalf("Unexpected stale extension %+v", e)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Expected registering an extension twice to panic")
+		}
+	}()
+	common.RegisterExtension(common.Extension{Name: "gete", Version: 2})
+}
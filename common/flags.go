@@ -0,0 +1,183 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Names of the flag bits rend features reserve. Features that mark values by setting a bit in the
+// client-visible flags reserve it under one of these, or their own name, so two features can't
+// end up using the same bit.
+const (
+	FlagCompressed    = "compressed"
+	FlagEncrypted     = "encrypted"
+	FlagChunked       = "chunked"
+	FlagStale         = "stale"
+	FlagNegativeCache = "negative-cache"
+
+	// Storage class hints, set by clients to say where a value should be kept
+	FlagL1Only    = "l1-only"
+	FlagL2Only    = "l2-only"
+	FlagReplicate = "replicate"
+	FlagNoChunk   = "no-chunk"
+)
+
+// ErrFlagBitTaken is returned when reserving a flag bit that's already reserved for another name
+var ErrFlagBitTaken = errors.New("Flag bit is already reserved")
+
+// FlagBits keeps track of which of the 32 bits of item flags are reserved and what for. Reserving
+// a bit for a name that already has it returns the same mask, so a feature wired into several
+// listeners can reserve its bit each time.
+type FlagBits struct {
+	lock  sync.Mutex
+	names [32]string
+}
+
+// DefaultFlagBits is the registry used by the package level functions
+var DefaultFlagBits = new(FlagBits)
+
+// Reserve reserves bit (0-31) for name and returns its mask
+func (f *FlagBits) Reserve(name string, bit int) (uint32, error) {
+	if name == "" {
+		return 0, errors.New("Flag bit reservations need a name")
+	}
+	if bit < 0 || bit >= len(f.names) {
+		return 0, fmt.Errorf("Flag bit %d for %s is not between 0 and 31", bit, name)
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.names[bit] == name {
+		return 1 << uint(bit), nil
+	}
+	if f.names[bit] != "" {
+		return 0, fmt.Errorf("%w: bit %d can't be used for %s, it's reserved for %s", ErrFlagBitTaken, bit, name, f.names[bit])
+	}
+	if have := f.bit(name); have >= 0 {
+		return 0, fmt.Errorf("%s already has flag bit %d reserved, it can't also have bit %d", name, have, bit)
+	}
+
+	f.names[bit] = name
+	return 1 << uint(bit), nil
+}
+
+// Alloc reserves a free bit for name, or returns the one it already has. Bits are handed out from
+// the highest down, since client libraries tend to use the low bits for their own serialization
+// flags.
+func (f *FlagBits) Alloc(name string) (uint32, error) {
+	if name == "" {
+		return 0, errors.New("Flag bit reservations need a name")
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if have := f.bit(name); have >= 0 {
+		return 1 << uint(have), nil
+	}
+	for bit := len(f.names) - 1; bit >= 0; bit-- {
+		if f.names[bit] == "" {
+			f.names[bit] = name
+			return 1 << uint(bit), nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: no flag bits are left for %s", ErrFlagBitTaken, name)
+}
+
+// bit returns the bit reserved for name, or -1. The lock must be held.
+func (f *FlagBits) bit(name string) int {
+	for bit, n := range f.names {
+		if n == name {
+			return bit
+		}
+	}
+	return -1
+}
+
+// Mask returns the mask of the bit reserved for name, or 0 if it has none
+func (f *FlagBits) Mask(name string) uint32 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if bit := f.bit(name); bit >= 0 {
+		return 1 << uint(bit)
+	}
+	return 0
+}
+
+// Reserved returns the mask of every reserved bit. Flags from clients that overlap it collide
+// with a rend feature.
+func (f *FlagBits) Reserved() uint32 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var mask uint32
+	for bit, n := range f.names {
+		if n != "" {
+			mask |= 1 << uint(bit)
+		}
+	}
+	return mask
+}
+
+// Reservations returns the reserved bits by name
+func (f *FlagBits) Reservations() map[string]int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	res := make(map[string]int)
+	for bit, n := range f.names {
+		if n != "" {
+			res[n] = bit
+		}
+	}
+	return res
+}
+
+// ReserveFlagBit reserves a bit in DefaultFlagBits
+func ReserveFlagBit(name string, bit int) (uint32, error) {
+	return DefaultFlagBits.Reserve(name, bit)
+}
+
+// AllocFlagBit reserves a free bit in DefaultFlagBits
+func AllocFlagBit(name string) (uint32, error) {
+	return DefaultFlagBits.Alloc(name)
+}
+
+// FlagMask returns the mask reserved for name in DefaultFlagBits, or 0
+func FlagMask(name string) uint32 {
+	return DefaultFlagBits.Mask(name)
+}
+
+// HasFlag reports whether every bit of mask is set in flags. A zero mask, i.e. a feature without
+// a reserved bit, is never set.
+func HasFlag(flags, mask uint32) bool {
+	return mask != 0 && flags&mask == mask
+}
+
+// SetFlag returns flags with the bits of mask set
+func SetFlag(flags, mask uint32) uint32 {
+	return flags | mask
+}
+
+// ClearFlag returns flags with the bits of mask cleared
+func ClearFlag(flags, mask uint32) uint32 {
+	return flags &^ mask
+}
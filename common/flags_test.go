@@ -0,0 +1,87 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/netflix/rend/common"
+)
+
+func TestFlagBits(t *testing.T) {
+	f := new(common.FlagBits)
+
+	mask, err := f.Reserve(common.FlagStale, 3)
+	if err != nil || mask != 1<<3 {
+		t.Fatalf("Expected bit 3, got %x %v", mask, err)
+	}
+	if again, err := f.Reserve(common.FlagStale, 3); err != nil || again != mask {
+		t.Fatal("Expected reserving the same bit for the same name again to succeed, got", err)
+	}
+	if _, err := f.Reserve(common.FlagCompressed, 3); !errors.Is(err, common.ErrFlagBitTaken) {
+		t.Fatal("Expected a collision, got", err)
+	}
+	if _, err := f.Reserve(common.FlagStale, 4); err == nil {
+		t.Fatal("Expected a name to only have one bit")
+	}
+	for _, bit := range []int{-1, 32} {
+		if _, err := f.Reserve(common.FlagEncrypted, bit); err == nil {
+			t.Errorf("Expected bit %d to be out of range", bit)
+		}
+	}
+
+	// allocation goes from the top and is stable per name
+	if mask, err := f.Alloc(common.FlagCompressed); err != nil || mask != 1<<31 {
+		t.Fatalf("Expected the highest bit, got %x %v", mask, err)
+	}
+	if mask, _ := f.Alloc(common.FlagCompressed); mask != 1<<31 {
+		t.Fatalf("Expected the same bit again, got %x", mask)
+	}
+	if mask, _ := f.Alloc(common.FlagStale); mask != 1<<3 {
+		t.Fatalf("Expected the reserved bit, got %x", mask)
+	}
+
+	if f.Mask(common.FlagCompressed) != 1<<31 || f.Mask(common.FlagChunked) != 0 {
+		t.Fatal("Unexpected masks")
+	}
+	if f.Reserved() != 1<<31|1<<3 {
+		t.Fatalf("Unexpected reserved mask %x", f.Reserved())
+	}
+	if r := f.Reservations(); len(r) != 2 || r[common.FlagStale] != 3 {
+		t.Fatalf("Unexpected reservations %v", r)
+	}
+
+	for i := 0; i < 30; i++ {
+		if _, err := f.Alloc(string(rune('a' + i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := f.Alloc("full"); !errors.Is(err, common.ErrFlagBitTaken) {
+		t.Fatal("Expected allocation to fail when every bit is taken, got", err)
+	}
+}
+
+func TestFlagHelpers(t *testing.T) {
+	const mask = 1 << 5
+
+	flags := common.SetFlag(1, mask)
+	if !common.HasFlag(flags, mask) || common.HasFlag(1, mask) || common.HasFlag(flags, 0) {
+		t.Fatal("Unexpected HasFlag results")
+	}
+	if common.ClearFlag(flags, mask) != 1 {
+		t.Fatal("Expected the bit to be cleared")
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"sync/atomic"
+)
+
+// RequestID identifies a single request from a client for as long as the process runs. IDs start
+// from a random point in each process so the IDs from different instances rarely collide, which
+// lets a request be found across the logs of a whole fleet.
+type RequestID uint64
+
+var lastRequestID uint64
+
+func init() {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err == nil {
+		// keep the low bits clear so there's plenty of room before the prefix changes
+		lastRequestID = binary.BigEndian.Uint64(b[:]) &^ (1<<40 - 1)
+	}
+}
+
+// NewRequestID returns a new ID, distinct from every other one returned in this process
+func NewRequestID() RequestID {
+	return RequestID(atomic.AddUint64(&lastRequestID, 1))
+}
+
+// String formats the ID as 16 hex digits, which is how it appears in logs and responses
+func (id RequestID) String() string {
+	const zeros = "0000000000000000"
+	s := strconv.FormatUint(uint64(id), 16)
+	return zeros[len(s):] + s
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying the ID that id points to. The ID is read through
+// the pointer every time, so a connection can use one context for its whole lifetime and only
+// update the ID as each request comes in.
+func WithRequestID(ctx context.Context, id *RequestID) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFrom returns the ID of the request ctx is for, or 0 if it isn't for one
+func RequestIDFrom(ctx context.Context) RequestID {
+	if id, ok := ctx.Value(requestIDKey{}).(*RequestID); ok {
+		return *id
+	}
+	return 0
+}
+
+// TagRequestID attaches a request ID to an error being sent to a client, so a responder can echo
+// it back. The result still matches everything err does with errors.Is and errors.As, but its
+// message ends with the ID.
+func TagRequestID(err error, id RequestID) error {
+	return requestIDError{err: err, id: id}
+}
+
+// RequestIDOf returns the ID attached to err with TagRequestID, if any
+func RequestIDOf(err error) (RequestID, bool) {
+	var e requestIDError
+	if errors.As(err, &e) {
+		return e.id, true
+	}
+	return 0, false
+}
+
+type requestIDError struct {
+	err error
+	id  RequestID
+}
+
+func (e requestIDError) Error() string {
+	return e.err.Error() + " (request " + e.id.String() + ")"
+}
+
+func (e requestIDError) Unwrap() error {
+	return e.err
+}
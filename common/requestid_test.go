@@ -0,0 +1,66 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/netflix/rend/common"
+)
+
+func TestRequestID(t *testing.T) {
+	a, b := common.NewRequestID(), common.NewRequestID()
+	if a == b {
+		t.Fatal("Expected distinct request IDs")
+	}
+
+	if s := common.RequestID(0xab).String(); s != "00000000000000ab" {
+		t.Fatalf("Expected IDs to be formatted as 16 hex digits, got %q", s)
+	}
+
+	if id := common.RequestIDFrom(context.Background()); id != 0 {
+		t.Fatalf("Expected no ID from a plain context, got %v", id)
+	}
+
+	id := new(common.RequestID)
+	ctx := common.WithRequestID(context.Background(), id)
+	*id = a
+	if got := common.RequestIDFrom(ctx); got != a {
+		t.Fatalf("Expected %v, got %v", a, got)
+	}
+	*id = b
+	if got := common.RequestIDFrom(ctx); got != b {
+		t.Fatalf("Expected the context to follow the current ID %v, got %v", b, got)
+	}
+}
+
+func TestTagRequestID(t *testing.T) {
+	err := common.TagRequestID(common.ErrTempFailure, 0x1f)
+
+	if !errors.Is(err, common.ErrTempFailure) || common.ClassOf(err) != common.ClassServer {
+		t.Fatal("Expected a tagged error to match the error it was made from")
+	}
+	if err.Error() != "ERROR Temporary error (request 000000000000001f)" {
+		t.Fatalf("Unexpected message %q", err.Error())
+	}
+	if id, ok := common.RequestIDOf(err); !ok || id != 0x1f {
+		t.Fatalf("Expected the ID back, got %v %v", id, ok)
+	}
+	if _, ok := common.RequestIDOf(common.ErrTempFailure); ok {
+		t.Fatal("Expected no ID from an untagged error")
+	}
+}
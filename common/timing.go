@@ -0,0 +1,171 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/timer"
+)
+
+// Phase is a part of serving a request that a Timing accounts time to
+type Phase int
+
+const (
+	// PhaseOther is the orchestrator's own work in between the other phases
+	PhaseOther Phase = iota
+	// PhaseParse is reading the request after its first line or header arrived
+	PhaseParse
+	// PhaseL1 is waiting on L1
+	PhaseL1
+	// PhaseL2 is waiting on L2
+	PhaseL2
+	// PhaseBackfill is waiting on L1 for a call made while L2 was being read, like when a value
+	// read from L2 is set in L1
+	PhaseBackfill
+	// PhaseRespond is writing responses to the client
+	PhaseRespond
+
+	numPhases
+)
+
+// Timing breaks down the time spent serving a single sampled request by phase. Time is accounted
+// to one phase at a time: entering a phase credits the time since the last change to the phase
+// being left. A connection uses one Timing for its whole lifetime, and only requests between Start
+// and Finish are timed; outside of them every method does nothing, as do the methods of a nil
+// *Timing.
+type Timing struct {
+	lock   sync.Mutex
+	active bool
+	phase  Phase
+	mark   uint64
+	spent  [numPhases]time.Duration
+}
+
+// Timings is how long a request spent in each phase
+type Timings struct {
+	Parse, L1, L2, Backfill, Respond, Other time.Duration
+}
+
+// Total is the time spent in every phase together
+func (t Timings) Total() time.Duration {
+	return t.Parse + t.L1 + t.L2 + t.Backfill + t.Respond + t.Other
+}
+
+// String formats the timings as key=value pairs for a log line
+func (t Timings) String() string {
+	return fmt.Sprintf("total=%v parse=%v l1=%v l2=%v backfill=%v respond=%v other=%v",
+		t.Total(), t.Parse, t.L1, t.L2, t.Backfill, t.Respond, t.Other)
+}
+
+// Start begins timing a request in the parse phase, from start as returned by the parser
+func (t *Timing) Start(start uint64) {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.active = true
+	t.phase = PhaseParse
+	t.mark = start
+	t.spent = [numPhases]time.Duration{}
+}
+
+// Active reports whether a request is being timed
+func (t *Timing) Active() bool {
+	if t == nil {
+		return false
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.active
+}
+
+// Phase returns the phase time is currently accounted to
+func (t *Timing) Phase() Phase {
+	if t == nil {
+		return PhaseOther
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.phase
+}
+
+// Enter accounts time to p from now on and returns the phase that was left, so a caller can go
+// back to it when it's done
+func (t *Timing) Enter(p Phase) Phase {
+	if t == nil {
+		return PhaseOther
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if !t.active {
+		return PhaseOther
+	}
+
+	now := timer.Now()
+	t.spent[t.phase] += time.Duration(now - t.mark)
+	t.mark = now
+
+	prev := t.phase
+	t.phase = p
+	return prev
+}
+
+// Finish stops timing the current request and returns how long it spent in each phase
+func (t *Timing) Finish() Timings {
+	if t == nil {
+		return Timings{}
+	}
+	t.Enter(PhaseOther)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.active = false
+	return Timings{
+		Parse:    t.spent[PhaseParse],
+		L1:       t.spent[PhaseL1],
+		L2:       t.spent[PhaseL2],
+		Backfill: t.spent[PhaseBackfill],
+		Respond:  t.spent[PhaseRespond],
+		Other:    t.spent[PhaseOther],
+	}
+}
+
+type timingKey struct{}
+
+// WithTiming returns a copy of ctx carrying t, so everything serving requests with it can account
+// its time
+func WithTiming(ctx context.Context, t *Timing) context.Context {
+	return context.WithValue(ctx, timingKey{}, t)
+}
+
+// TimingFrom returns the Timing carried by ctx, or nil if it has none
+func TimingFrom(ctx context.Context) *Timing {
+	t, _ := ctx.Value(timingKey{}).(*Timing)
+	return t
+}
@@ -0,0 +1,66 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/timer"
+)
+
+func TestTiming(t *testing.T) {
+	var nilTiming *common.Timing
+	nilTiming.Start(timer.Now())
+	nilTiming.Enter(common.PhaseL1)
+	if nilTiming.Active() || nilTiming.Finish() != (common.Timings{}) {
+		t.Fatal("Expected a nil Timing to do nothing")
+	}
+
+	timing := new(common.Timing)
+	if common.TimingFrom(context.Background()) != nil {
+		t.Fatal("Expected no Timing from a plain context")
+	}
+	if common.TimingFrom(common.WithTiming(context.Background(), timing)) != timing {
+		t.Fatal("Expected the Timing the context was given")
+	}
+
+	timing.Enter(common.PhaseL1)
+	if timing.Active() || timing.Phase() != common.PhaseOther {
+		t.Fatal("Expected nothing to be timed before Start")
+	}
+
+	const d = 2 * time.Millisecond
+	timing.Start(timer.Now())
+	time.Sleep(d)
+	if prev := timing.Enter(common.PhaseL2); prev != common.PhaseParse {
+		t.Fatalf("Expected to leave the parse phase, left %v", prev)
+	}
+	time.Sleep(d)
+	timing.Enter(common.PhaseOther)
+
+	times := timing.Finish()
+	if times.Parse < d || times.L2 < d || times.L1 != 0 {
+		t.Fatalf("Expected time in parse and L2 only, got %v", times)
+	}
+	if times.Total() < 2*d {
+		t.Fatalf("Expected a total of at least %v, got %v", 2*d, times.Total())
+	}
+	if timing.Active() {
+		t.Fatal("Expected nothing to be timed after Finish")
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compat
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/netflix/rend/protocol/binprot"
+)
+
+// Cases are the command sequences rend is expected to answer exactly like memcached. They stick to
+// commands both support; rend's own extensions have nothing to be compared with.
+var Cases = append(TextCases, BinaryCases...)
+
+// TextCases cover the text protocol
+var TextCases = []Case{
+	textCase("set-get", func(k func(string) string) []string {
+		return []string{
+			"set " + k("a") + " 5 0 3\r\nfoo\r\n",
+			"get " + k("a") + "\r\n",
+			"get " + k("missing") + "\r\n",
+		}
+	}),
+	textCase("multiget", func(k func(string) string) []string {
+		return []string{
+			"set " + k("a") + " 0 0 1\r\na\r\n",
+			"set " + k("b") + " 0 0 2\r\nbb\r\n",
+			"get " + k("a") + " " + k("missing") + " " + k("b") + "\r\n",
+			"gets " + k("a") + " " + k("b") + "\r\n",
+		}
+	}),
+	textCase("flags", func(k func(string) string) []string {
+		return []string{
+			"set " + k("max") + " 4294967295 0 1\r\nx\r\n",
+			"set " + k("zero") + " 0 0 0\r\n\r\n",
+			"get " + k("max") + " " + k("zero") + "\r\n",
+		}
+	}),
+	textCase("add-replace", func(k func(string) string) []string {
+		return []string{
+			"replace " + k("a") + " 0 0 1\r\nx\r\n",
+			"add " + k("a") + " 0 0 1\r\nx\r\n",
+			"add " + k("a") + " 0 0 1\r\ny\r\n",
+			"replace " + k("a") + " 0 0 1\r\nz\r\n",
+			"get " + k("a") + "\r\n",
+		}
+	}),
+	textCase("append-prepend", func(k func(string) string) []string {
+		return []string{
+			"append " + k("missing") + " 0 0 1\r\nx\r\n",
+			"prepend " + k("missing") + " 0 0 1\r\nx\r\n",
+			"set " + k("a") + " 7 0 1\r\nb\r\n",
+			"append " + k("a") + " 0 0 1\r\nc\r\n",
+			"prepend " + k("a") + " 0 0 1\r\na\r\n",
+			"get " + k("a") + "\r\n",
+		}
+	}),
+	textCase("cas", func(k func(string) string) []string {
+		return []string{
+			"cas " + k("missing") + " 0 0 1 1\r\nx\r\n",
+			"set " + k("a") + " 0 0 1\r\nx\r\n",
+			"cas " + k("a") + " 0 0 1 0\r\ny\r\n",
+		}
+	}),
+	textCase("delete", func(k func(string) string) []string {
+		return []string{
+			"delete " + k("missing") + "\r\n",
+			"set " + k("a") + " 0 0 1\r\nx\r\n",
+			"delete " + k("a") + "\r\n",
+			"get " + k("a") + "\r\n",
+		}
+	}),
+	textCase("touch", func(k func(string) string) []string {
+		return []string{
+			"touch " + k("missing") + " 100\r\n",
+			"set " + k("a") + " 0 0 1\r\nx\r\n",
+			"touch " + k("a") + " 100\r\n",
+		}
+	}),
+	textCase("noreply", func(k func(string) string) []string {
+		return []string{
+			"set " + k("a") + " 0 0 1 noreply\r\nx\r\n",
+			"add " + k("a") + " 0 0 1 noreply\r\ny\r\n",
+			"get " + k("a") + "\r\n",
+			"delete " + k("a") + " noreply\r\n",
+			"get " + k("a") + "\r\n",
+		}
+	}),
+	textCase("errors", func(k func(string) string) []string {
+		return []string{
+			"bogus\r\n",
+			"set " + k("a") + " 0 0 1\r\ntoolong\r\n",
+			"get " + k(strings.Repeat("k", 251)) + "\r\n",
+			"set " + k("a") + " notanumber 0 1\r\nx\r\n",
+		}
+	}),
+	textCase("version", func(k func(string) string) []string {
+		return []string{"version\r\n"}
+	}),
+}
+
+// BinaryCases cover the binary protocol
+var BinaryCases = []Case{
+	binaryCase("set-get", func(k func(string) []byte, w *bytes.Buffer) {
+		binprot.WriteSetCmd(w, k("a"), 0xdeadbeef, 0, 3, 1)
+		w.WriteString("foo")
+	}, func(k func(string) []byte, w *bytes.Buffer) {
+		binprot.WriteGetCmd(w, k("a"), 2)
+	}, func(k func(string) []byte, w *bytes.Buffer) {
+		binprot.WriteGetCmd(w, k("missing"), 3)
+	}),
+	binaryCase("quiet-get", func(k func(string) []byte, w *bytes.Buffer) {
+		binprot.WriteSetCmd(w, k("a"), 0, 0, 1, 1)
+		w.WriteString("a")
+	}, func(k func(string) []byte, w *bytes.Buffer) {
+		binprot.WriteGetQCmd(w, k("missing"), 2)
+		binprot.WriteGetQCmd(w, k("a"), 3)
+		binprot.WriteNoopCmd(w, 4)
+	}),
+	binaryCase("add-replace", func(k func(string) []byte, w *bytes.Buffer) {
+		binprot.WriteReplaceCmd(w, k("a"), 0, 0, 1, 1)
+		w.WriteString("x")
+	}, func(k func(string) []byte, w *bytes.Buffer) {
+		binprot.WriteAddCmd(w, k("a"), 0, 0, 1, 2)
+		w.WriteString("x")
+	}, func(k func(string) []byte, w *bytes.Buffer) {
+		binprot.WriteAddCmd(w, k("a"), 0, 0, 1, 3)
+		w.WriteString("y")
+	}),
+	binaryCase("append-prepend", func(k func(string) []byte, w *bytes.Buffer) {
+		binprot.WriteAppendCmd(w, k("missing"), 0, 0, 1, 1)
+		w.WriteString("x")
+	}, func(k func(string) []byte, w *bytes.Buffer) {
+		binprot.WriteSetCmd(w, k("a"), 0, 0, 1, 2)
+		w.WriteString("b")
+	}, func(k func(string) []byte, w *bytes.Buffer) {
+		binprot.WriteAppendCmd(w, k("a"), 0, 0, 1, 3)
+		w.WriteString("c")
+	}, func(k func(string) []byte, w *bytes.Buffer) {
+		binprot.WritePrependCmd(w, k("a"), 0, 0, 1, 4)
+		w.WriteString("a")
+	}, func(k func(string) []byte, w *bytes.Buffer) {
+		binprot.WriteGetCmd(w, k("a"), 5)
+	}),
+	binaryCase("delete", func(k func(string) []byte, w *bytes.Buffer) {
+		binprot.WriteDeleteCmd(w, k("missing"), 1)
+	}, func(k func(string) []byte, w *bytes.Buffer) {
+		binprot.WriteSetCmd(w, k("a"), 0, 0, 1, 2)
+		w.WriteString("x")
+	}, func(k func(string) []byte, w *bytes.Buffer) {
+		binprot.WriteDeleteQCmd(w, k("a"), 3)
+		binprot.WriteNoopCmd(w, 4)
+	}),
+	binaryCase("touch-gat", func(k func(string) []byte, w *bytes.Buffer) {
+		binprot.WriteTouchCmd(w, k("missing"), 100, 1)
+	}, func(k func(string) []byte, w *bytes.Buffer) {
+		binprot.WriteSetCmd(w, k("a"), 3, 0, 1, 2)
+		w.WriteString("x")
+	}, func(k func(string) []byte, w *bytes.Buffer) {
+		binprot.WriteTouchCmd(w, k("a"), 100, 3)
+	}, func(k func(string) []byte, w *bytes.Buffer) {
+		binprot.WriteGATCmd(w, k("a"), 100, 4)
+	}),
+	binaryCase("incr-decr", func(k func(string) []byte, w *bytes.Buffer) {
+		binprot.WriteIncrCmd(w, k("n"), 1, 10, 0xffffffff, 1)
+	}, func(k func(string) []byte, w *bytes.Buffer) {
+		binprot.WriteIncrCmd(w, k("n"), 1, 10, 0, 2)
+	}, func(k func(string) []byte, w *bytes.Buffer) {
+		binprot.WriteIncrCmd(w, k("n"), 5, 0, 0, 3)
+	}, func(k func(string) []byte, w *bytes.Buffer) {
+		binprot.WriteDecrCmd(w, k("n"), 100, 0, 0, 4)
+	}, func(k func(string) []byte, w *bytes.Buffer) {
+		binprot.WriteIncrQCmd(w, k("n"), 1, 0, 0, 5)
+		binprot.WriteDecrQCmd(w, k("missing"), 1, 0, 0xffffffff, 6)
+		binprot.WriteNoopCmd(w, 7)
+	}),
+	binaryCase("noop", func(k func(string) []byte, w *bytes.Buffer) {
+		binprot.WriteNoopCmd(w, 0xcafe)
+	}),
+}
+
+// textCase makes a Case out of text requests, with k turning a name into a key under the prefix
+func textCase(name string, steps func(k func(string) string) []string) Case {
+	return Case{
+		Name: "text-" + name,
+		Steps: func(prefix string) [][]byte {
+			var res [][]byte
+			for _, s := range steps(func(name string) string { return prefix + name }) {
+				res = append(res, []byte(s))
+			}
+			return res
+		},
+	}
+}
+
+// binaryCase makes a Case out of funcs that each write the requests of one step
+func binaryCase(name string, steps ...func(k func(string) []byte, w *bytes.Buffer)) Case {
+	return Case{
+		Name:   "binary-" + name,
+		Binary: true,
+		Steps: func(prefix string) [][]byte {
+			k := func(name string) []byte { return []byte(prefix + name) }
+
+			var res [][]byte
+			for _, step := range steps {
+				buf := new(bytes.Buffer)
+				step(k, buf)
+				res = append(res, buf.Bytes())
+			}
+			return res
+		},
+	}
+}
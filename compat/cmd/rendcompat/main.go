@@ -0,0 +1,47 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// rendcompat runs the command sequences of the compat package against a running rend and one or
+// more memcached servers, and prints every response rend gives that differs from memcached's. It
+// exits with status 1 if there were any.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/netflix/rend/compat"
+)
+
+func main() {
+	var (
+		rend      = flag.String("rend", "localhost:11211", "Address of the rend server to check.")
+		memcached = flag.String("memcached", "localhost:11311", "Comma separated addresses of the memcached servers to compare with, e.g. one per version.")
+		idle      = flag.Duration("idle", compat.DefaultIdle, "How long a server may stay silent before its response is considered complete.")
+	)
+	flag.Parse()
+
+	passed := true
+	for _, mc := range strings.Split(*memcached, ",") {
+		r := compat.Compare(*rend, strings.TrimSpace(mc), compat.Cases, *idle)
+		fmt.Print(r)
+		passed = passed && r.Passed()
+	}
+
+	if !passed {
+		os.Exit(1)
+	}
+}
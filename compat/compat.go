@@ -0,0 +1,302 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package compat compares rend's responses with a real memcached's, byte for byte. Every Case is a
+// sequence of requests sent on one connection to each server, and after each request whatever the
+// server sent back is compared, including status codes, error strings, and flags. Values that are
+// expected to differ between any two servers, like CAS values and version strings, are blanked
+// out first.
+//
+// Client libraries tend to depend on the exact form of responses, so running the Cases against
+// each memcached version in use (1.4, 1.5, and 1.6 behave differently in places) shows where rend
+// would surprise them. The test in this package runs them against the memcached servers given
+// with -memcached, and rendcompat runs them against a rend that is already running.
+package compat
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultIdle is how long a server may stay silent before its response to a request is considered
+// complete
+const DefaultIdle = 50 * time.Millisecond
+
+// Case is a sequence of requests sent to both servers on a fresh connection each
+type Case struct {
+	Name string
+	// Binary is set if the requests are in the binary protocol
+	Binary bool
+	// Steps returns the requests to send, each on its own after the response to the one before.
+	// Every key starts with prefix, which is unique to the run and server, so cases never see
+	// each other's data or data left over from earlier runs.
+	Steps func(prefix string) [][]byte
+}
+
+// Mismatch is a request that the two servers answered differently
+type Mismatch struct {
+	Case string
+	// Step is the index of the request in the case's steps
+	Step      int
+	Request   []byte
+	Rend      []byte
+	Memcached []byte
+}
+
+func (m Mismatch) String() string {
+	return fmt.Sprintf("%s step %d: request %q\n    rend:      %q\n    memcached: %q", m.Case, m.Step, m.Request, m.Rend, m.Memcached)
+}
+
+// Report is the outcome of comparing every case against one memcached
+type Report struct {
+	Memcached string
+	// Version is what the memcached server says it is
+	Version    string
+	Cases      int
+	Mismatches []Mismatch
+	// Err is set if the comparison couldn't be finished, e.g. because a server went away
+	Err error
+}
+
+// Passed returns whether every case was answered the same by both servers
+func (r Report) Passed() bool {
+	return r.Err == nil && len(r.Mismatches) == 0
+}
+
+func (r Report) String() string {
+	buf := new(bytes.Buffer)
+
+	switch {
+	case r.Err != nil:
+		fmt.Fprintf(buf, "ERROR memcached %s at %s: %v\n", r.Version, r.Memcached, r.Err)
+	case len(r.Mismatches) > 0:
+		fmt.Fprintf(buf, "FAIL memcached %s at %s: %d mismatches in %d cases\n", r.Version, r.Memcached, len(r.Mismatches), r.Cases)
+	default:
+		fmt.Fprintf(buf, "PASS memcached %s at %s: %d cases\n", r.Version, r.Memcached, r.Cases)
+	}
+
+	for _, m := range r.Mismatches {
+		fmt.Fprintf(buf, "  %v\n", m)
+	}
+
+	return buf.String()
+}
+
+// Compare runs every case against the rend and memcached servers listening on the given TCP
+// addresses. A response is complete once the server has been silent for idle, or DefaultIdle if
+// it's 0.
+func Compare(rend, memcached string, cases []Case, idle time.Duration) Report {
+	if idle <= 0 {
+		idle = DefaultIdle
+	}
+
+	r := Report{Memcached: memcached}
+
+	v, err := Version(memcached)
+	if err != nil {
+		r.Err = err
+		return r
+	}
+	r.Version = v
+
+	// Each server gets keys of its own, since rend could be using the very same memcached as a
+	// backend. The prefixes are the same length, so they can be blanked out of responses without
+	// changing the lengths in them.
+	rendPrefix, mcPrefix := newPrefix(), newPrefix()
+
+	for _, c := range cases {
+		r.Cases++
+		rendSteps := c.Steps(rendPrefix + c.Name + ":")
+		mcSteps := c.Steps(mcPrefix + c.Name + ":")
+
+		rendRes, err := run(rend, rendSteps, idle)
+		if err != nil {
+			r.Err = fmt.Errorf("rend, %s: %v", c.Name, err)
+			return r
+		}
+		mcRes, err := run(memcached, mcSteps, idle)
+		if err != nil {
+			r.Err = fmt.Errorf("memcached, %s: %v", c.Name, err)
+			return r
+		}
+
+		for i := range rendSteps {
+			a := normalize(rendRes[i], rendPrefix, c.Binary)
+			b := normalize(mcRes[i], mcPrefix, c.Binary)
+			if !bytes.Equal(a, b) {
+				r.Mismatches = append(r.Mismatches, Mismatch{
+					Case:      c.Name,
+					Step:      i,
+					Request:   rendSteps[i],
+					Rend:      a,
+					Memcached: b,
+				})
+			}
+		}
+	}
+
+	return r
+}
+
+// Version asks the server at addr which version it is, with the text protocol
+func Version(addr string) (string, error) {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("version\r\n")); err != nil {
+		return "", err
+	}
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(line, "VERSION ") {
+		return "", fmt.Errorf("Unexpected version response %q", line)
+	}
+	return strings.TrimSpace(strings.TrimPrefix(line, "VERSION ")), nil
+}
+
+// run sends the steps one at a time on a new connection to addr and returns everything received
+// after each one
+func run(addr string, steps [][]byte, idle time.Duration) ([][]byte, error) {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	res := make([][]byte, len(steps))
+	buf := make([]byte, 64*1024)
+
+	for i, step := range steps {
+		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write(step); err != nil {
+			return nil, err
+		}
+
+		for {
+			conn.SetReadDeadline(time.Now().Add(idle))
+			n, err := conn.Read(buf)
+			res[i] = append(res[i], buf[:n]...)
+
+			if os.IsTimeout(err) {
+				break
+			}
+			if err != nil {
+				// The server closing the connection is an answer too, but nothing after it can be
+				// sent
+				for j := i + 1; j < len(steps); j++ {
+					res[j] = []byte("<closed>")
+				}
+				return res, nil
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// normalize blanks out the parts of a response that differ between any two servers, along with the
+// key prefix the server was given
+func normalize(res []byte, prefix string, bin bool) []byte {
+	res = bytes.Replace(res, []byte(prefix), []byte(blankPrefix), -1)
+	if bin {
+		return normalizeBinary(res)
+	}
+	return normalizeText(res)
+}
+
+const binHeaderLen = 24
+
+// normalizeBinary zeroes the CAS of every response packet
+func normalizeBinary(res []byte) []byte {
+	var out []byte
+
+	for len(res) >= binHeaderLen {
+		hdr := append([]byte(nil), res[:binHeaderLen]...)
+		bodyLen := int(binary.BigEndian.Uint32(hdr[8:12]))
+		if len(res) < binHeaderLen+bodyLen {
+			break
+		}
+		body := res[binHeaderLen : binHeaderLen+bodyLen]
+		res = res[binHeaderLen+bodyLen:]
+
+		binary.BigEndian.PutUint64(hdr[16:24], 0)
+
+		out = append(out, hdr...)
+		out = append(out, body...)
+	}
+
+	// anything that isn't a whole packet is compared as is
+	return append(out, res...)
+}
+
+// normalizeText blanks out the CAS values of gets responses and the version of version responses.
+// Data blocks are skipped by their length so values are never mistaken for response lines.
+func normalizeText(res []byte) []byte {
+	var out []byte
+
+	for len(res) > 0 {
+		end := bytes.IndexByte(res, '\n')
+		if end < 0 {
+			break
+		}
+		line := res[:end+1]
+		res = res[end+1:]
+
+		var data []byte
+		fields := strings.Fields(string(line))
+		switch {
+		case len(fields) > 0 && fields[0] == "VERSION":
+			line = []byte("VERSION\r\n")
+
+		case len(fields) >= 4 && fields[0] == "VALUE":
+			if n, err := strconv.Atoi(fields[3]); err == nil && n >= 0 && n <= len(res) {
+				if len(fields) == 5 {
+					line = []byte(strings.Join(fields[:4], " ") + " <cas>\r\n")
+				}
+				data, res = res[:n], res[n:]
+			}
+		}
+
+		out = append(out, line...)
+		out = append(out, data...)
+	}
+
+	return append(out, res...)
+}
+
+// blankPrefix is what key prefixes look like after normalizing
+const blankPrefix = "compat:xxxxxxxxxxxxxxxx:"
+
+// newPrefix returns a random key prefix the same length as blankPrefix
+func newPrefix() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "compat:" + hex.EncodeToString(b) + ":"
+}
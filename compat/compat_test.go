@@ -0,0 +1,89 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compat_test
+
+import (
+	"flag"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/compat"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/inmem"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol"
+	"github.com/netflix/rend/protocol/binprot"
+	"github.com/netflix/rend/protocol/textprot"
+	"github.com/netflix/rend/server"
+)
+
+var memcached = flag.String("memcached", "", "Comma separated addresses of memcached servers to compare rend with, e.g. one per version")
+
+func startRend(t *testing.T) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	go server.ListenAndServe(
+		server.ListenArgs{Type: server.ListenTCP, Port: port},
+		[]protocol.Components{binprot.Components, textprot.Components},
+		server.Default,
+		orcas.L1Only,
+		inmem.New,
+		handlers.NilHandler,
+	)
+
+	addr := net.JoinHostPort("localhost", strconv.Itoa(port))
+	for i := 0; i < 100; i++ {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			c.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return addr
+}
+
+// TestCompareSelf checks the harness by comparing rend with itself, which can't mismatch
+func TestCompareSelf(t *testing.T) {
+	addr := startRend(t)
+
+	r := compat.Compare(addr, addr, compat.Cases, 20*time.Millisecond)
+	if !r.Passed() || r.Cases != len(compat.Cases) {
+		t.Fatalf("Expected rend to match itself:\n%v", r)
+	}
+	if !strings.HasPrefix(r.String(), "PASS memcached ") {
+		t.Fatalf("Unexpected report:\n%v", r)
+	}
+}
+
+func TestMemcached(t *testing.T) {
+	if *memcached == "" {
+		t.Skip("No memcached servers given with -memcached")
+	}
+
+	addr := startRend(t)
+	for _, mc := range strings.Split(*memcached, ",") {
+		if r := compat.Compare(addr, mc, compat.Cases, 0); !r.Passed() {
+			t.Error(r)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compat
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/netflix/rend/protocol/binprot"
+)
+
+func TestNormalizeText(t *testing.T) {
+	prefix := newPrefix()
+	res := []byte("VALUE " + prefix + "a 0 7 12345\r\nVERSION\r\nVALUE " + prefix + "b 1 1\r\nx\r\nEND\r\nVERSION 1.6.9\r\n")
+
+	expected := "VALUE " + blankPrefix + "a 0 7 <cas>\r\nVERSION\r\nVALUE " + blankPrefix + "b 1 1\r\nx\r\nEND\r\nVERSION\r\n"
+	if out := normalize(res, prefix, false); string(out) != expected {
+		t.Fatalf("Expected %q, got %q", expected, out)
+	}
+}
+
+func TestNormalizeBinary(t *testing.T) {
+	buf := new(bytes.Buffer)
+	binprot.WriteSetCASCmd(buf, []byte("foo"), 0, 0, 0, 1, 0xabcdef)
+	binprot.WriteSetCASCmd(buf, []byte("bar"), 0, 0, 0, 2, 0)
+
+	out := normalize(append(buf.Bytes(), 0x81, 0x0a), "unused", true)
+
+	buf.Reset()
+	binprot.WriteSetCmd(buf, []byte("foo"), 0, 0, 0, 1)
+	binprot.WriteSetCmd(buf, []byte("bar"), 0, 0, 0, 2)
+	if expected := append(buf.Bytes(), 0x81, 0x0a); !bytes.Equal(out, expected) {
+		t.Fatalf("Expected CAS values to be zeroed and partial packets kept:\n%q\n%q", expected, out)
+	}
+}
@@ -0,0 +1,341 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consistency
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/logging"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricChecked       = metrics.AddCounter("consistency_checked", nil)
+	MetricConsistent    = metrics.AddCounter("consistency_consistent", nil)
+	MetricOnlyL1        = metrics.AddCounter("consistency_only_l1", nil)
+	MetricFlagsMismatch = metrics.AddCounter("consistency_flags_mismatch", nil)
+	MetricValueMismatch = metrics.AddCounter("consistency_value_mismatch", nil)
+	MetricRepaired      = metrics.AddCounter("consistency_repaired", nil)
+	MetricErrors        = metrics.AddCounter("consistency_errors", nil)
+
+	// The ratio of divergent keys to keys present in L1 in the last check
+	GaugeDivergenceRatio = metrics.AddFloatGauge("consistency_divergence_ratio", nil)
+)
+
+const (
+	// A mismatch is checked again after this delay before it counts, since a write that lands
+	// between the two reads makes the tiers look different for a moment.
+	recheckDelay = 10 * time.Millisecond
+
+	// the number of divergent keys listed in a report
+	maxReportedDivergences = 100
+)
+
+// Kinds of divergence
+const (
+	KindOnlyL1        = "only_l1"
+	KindFlagsMismatch = "flags_mismatch"
+	KindValueMismatch = "value_mismatch"
+)
+
+// Divergence describes a single key that differs between L1 and L2. The values themselves are not
+// included, only their hashes, and the key is as logging.Key returns it.
+type Divergence struct {
+	Key     string `json:"key"`
+	Kind    string `json:"kind"`
+	L1Flags uint32 `json:"l1_flags"`
+	L2Flags uint32 `json:"l2_flags"`
+	L1Hash  string `json:"l1_hash"`
+	L2Hash  string `json:"l2_hash,omitempty"`
+}
+
+// Report is the result of one check
+type Report struct {
+	Start    time.Time `json:"start"`
+	Duration string    `json:"duration"`
+
+	// Keys checked
+	Checked int `json:"checked"`
+	// Present in both and identical
+	Consistent int `json:"consistent"`
+	// Present in L2 only, which is normal
+	MissingL1 int `json:"missing_l1"`
+	// Present in neither
+	MissingBoth int `json:"missing_both"`
+
+	OnlyL1        int `json:"only_l1"`
+	FlagsMismatch int `json:"flags_mismatch"`
+	ValueMismatch int `json:"value_mismatch"`
+	Repaired      int `json:"repaired"`
+	Errors        int `json:"errors"`
+
+	Divergences []Divergence `json:"divergences,omitempty"`
+}
+
+// Checker compares sampled keys between L1 and L2. It uses its own handlers, separate from any
+// client connection.
+type Checker struct {
+	h1, h2  handlers.HandlerConst
+	l1, l2  handlers.Handler
+	sampler *Sampler
+	repair  bool
+
+	// only one check runs at a time
+	lock sync.Mutex
+	last Report
+}
+
+// NewChecker creates a checker for keys from the given sampler. If repair is true, divergent keys
+// are deleted from L1.
+func NewChecker(h1, h2 handlers.HandlerConst, sampler *Sampler, repair bool) *Checker {
+	return &Checker{
+		h1:      h1,
+		h2:      h2,
+		sampler: sampler,
+		repair:  repair,
+	}
+}
+
+// Start runs a check at the given interval in the background
+func (c *Checker) Start(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			c.Check()
+		}
+	}()
+}
+
+// Last returns the report from the most recent check
+func (c *Checker) Last() Report {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.last
+}
+
+// Check compares every key in the current sample and returns the report
+func (c *Checker) Check() Report {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	r := Report{Start: time.Now()}
+
+	for _, key := range c.sampler.Keys() {
+		if err := c.checkKey(key, &r); err != nil {
+			log.Println("Error checking consistency:", err.Error())
+			metrics.IncCounter(MetricErrors)
+			r.Errors++
+
+			// the connections may be broken, so start fresh on the next key
+			c.closeHandlers()
+		}
+	}
+
+	r.Duration = time.Since(r.Start).String()
+
+	divergent := r.OnlyL1 + r.FlagsMismatch + r.ValueMismatch
+	if inL1 := divergent + r.Consistent; inL1 > 0 {
+		metrics.SetFloatGauge(GaugeDivergenceRatio, float64(divergent)/float64(inL1))
+	} else {
+		metrics.SetFloatGauge(GaugeDivergenceRatio, 0)
+	}
+
+	c.last = r
+	return r
+}
+
+func (c *Checker) checkKey(key []byte, r *Report) error {
+	if err := c.openHandlers(); err != nil {
+		return err
+	}
+
+	kind, res1, res2, err := c.compare(key)
+	if err != nil {
+		return err
+	}
+
+	// Give any in-flight write a chance to land in both tiers before calling it divergent
+	if kind != "" {
+		time.Sleep(recheckDelay)
+		if kind, res1, res2, err = c.compare(key); err != nil {
+			return err
+		}
+	}
+
+	r.Checked++
+	metrics.IncCounter(MetricChecked)
+
+	switch kind {
+	case "":
+		switch {
+		case res1.Miss && res2.Miss:
+			r.MissingBoth++
+		case res1.Miss:
+			r.MissingL1++
+		default:
+			r.Consistent++
+			metrics.IncCounter(MetricConsistent)
+		}
+		return nil
+
+	case KindOnlyL1:
+		r.OnlyL1++
+		metrics.IncCounter(MetricOnlyL1)
+	case KindFlagsMismatch:
+		r.FlagsMismatch++
+		metrics.IncCounter(MetricFlagsMismatch)
+	case KindValueMismatch:
+		r.ValueMismatch++
+		metrics.IncCounter(MetricValueMismatch)
+	}
+
+	if len(r.Divergences) < maxReportedDivergences {
+		d := Divergence{
+			Key:     logging.Key(key),
+			Kind:    kind,
+			L1Flags: res1.Flags,
+			L1Hash:  hash(res1.Data),
+		}
+		if !res2.Miss {
+			d.L2Flags = res2.Flags
+			d.L2Hash = hash(res2.Data)
+		}
+		r.Divergences = append(r.Divergences, d)
+	}
+
+	if c.repair {
+		err := c.l1.Delete(common.DeleteRequest{Key: key})
+		if err != nil && !errors.Is(err, common.ErrKeyNotFound) {
+			return err
+		}
+		r.Repaired++
+		metrics.IncCounter(MetricRepaired)
+	}
+
+	return nil
+}
+
+// compare reads the key from both tiers and returns the kind of divergence, if any
+func (c *Checker) compare(key []byte) (string, common.GetResponse, common.GetResponse, error) {
+	res1, err := getOne(c.l1, key)
+	if err != nil {
+		return "", res1, common.GetResponse{}, err
+	}
+
+	res2, err := getOne(c.l2, key)
+	if err != nil {
+		return "", res1, res2, err
+	}
+
+	// Nothing in L1 is always consistent
+	if res1.Miss {
+		return "", res1, res2, nil
+	}
+
+	switch {
+	case res2.Miss:
+		return KindOnlyL1, res1, res2, nil
+	case res1.Flags != res2.Flags:
+		return KindFlagsMismatch, res1, res2, nil
+	case !bytes.Equal(res1.Data, res2.Data):
+		return KindValueMismatch, res1, res2, nil
+	}
+
+	return "", res1, res2, nil
+}
+
+func getOne(h handlers.Handler, key []byte) (common.GetResponse, error) {
+	resChan, errChan := h.Get(common.GetRequest{
+		Keys:    [][]byte{key},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+
+	var res common.GetResponse
+	var err error
+
+	for resChan != nil || errChan != nil {
+		select {
+		case r, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			} else {
+				res = r
+			}
+		case e, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			} else {
+				err = e
+			}
+		}
+	}
+
+	return res, err
+}
+
+func hash(data []byte) string {
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *Checker) openHandlers() error {
+	var err error
+	if c.l1 == nil {
+		if c.l1, err = c.h1(); err != nil {
+			return err
+		}
+	}
+	if c.l2 == nil {
+		if c.l2, err = c.h2(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Checker) closeHandlers() {
+	if c.l1 != nil {
+		c.l1.Close()
+		c.l1 = nil
+	}
+	if c.l2 != nil {
+		c.l2.Close()
+		c.l2 = nil
+	}
+}
+
+// ServeHTTP responds with the last report as JSON. A POST runs a new check first and responds
+// with its report.
+func (c *Checker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var rep Report
+	if r.Method == http.MethodPost {
+		rep = c.Check()
+	} else {
+		rep = c.Last()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rep)
+}
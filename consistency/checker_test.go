@@ -0,0 +1,120 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consistency_test
+
+import (
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/consistency"
+	"github.com/netflix/rend/handlers"
+)
+
+type entry struct {
+	flags uint32
+	data  string
+}
+
+// mapHandler is just enough of a handler for the checker, which only uses Get and Delete
+type mapHandler map[string]entry
+
+func (m mapHandler) Set(cmd common.SetRequest) error     { return nil }
+func (m mapHandler) Add(cmd common.SetRequest) error     { return nil }
+func (m mapHandler) Replace(cmd common.SetRequest) error { return nil }
+func (m mapHandler) Append(cmd common.SetRequest) error  { return nil }
+func (m mapHandler) Prepend(cmd common.SetRequest) error { return nil }
+func (m mapHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	return nil, nil
+}
+func (m mapHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	return common.GetResponse{}, nil
+}
+func (m mapHandler) Touch(cmd common.TouchRequest) error { return nil }
+func (m mapHandler) Close() error                        { return nil }
+
+func (m mapHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	resChan := make(chan common.GetResponse, len(cmd.Keys))
+	errChan := make(chan error)
+
+	for _, k := range cmd.Keys {
+		e, ok := m[string(k)]
+		resChan <- common.GetResponse{
+			Key:   k,
+			Data:  []byte(e.data),
+			Flags: e.flags,
+			Miss:  !ok,
+		}
+	}
+
+	close(resChan)
+	close(errChan)
+	return resChan, errChan
+}
+
+func (m mapHandler) Delete(cmd common.DeleteRequest) error {
+	delete(m, string(cmd.Key))
+	return nil
+}
+
+func constOf(h handlers.Handler) handlers.HandlerConst {
+	return func() (handlers.Handler, error) { return h, nil }
+}
+
+func TestChecker(t *testing.T) {
+	l1 := mapHandler{
+		"same":     {1, "a"},
+		"onlyl1":   {1, "a"},
+		"flags":    {1, "a"},
+		"value":    {1, "a"},
+		"notsampl": {1, "a"},
+	}
+	l2 := mapHandler{
+		"same":    {1, "a"},
+		"flags":   {2, "a"},
+		"value":   {1, "b"},
+		"missing": {1, "a"},
+	}
+
+	sampler := consistency.NewSampler(1, 100)
+	for _, k := range []string{"same", "onlyl1", "flags", "value", "missing", "neither"} {
+		sampler.Observe(common.DeleteRequest{}, common.RequestDelete) // ignored
+		sampler.Observe(common.TouchRequest{Key: []byte(k)}, common.RequestTouch)
+	}
+
+	c := consistency.NewChecker(constOf(l1), constOf(l2), sampler, true)
+	r := c.Check()
+
+	if r.Checked != 6 || r.Consistent != 1 || r.MissingL1 != 1 || r.MissingBoth != 1 {
+		t.Fatalf("Unexpected counts in report: %+v", r)
+	}
+	if r.OnlyL1 != 1 || r.FlagsMismatch != 1 || r.ValueMismatch != 1 {
+		t.Fatalf("Unexpected divergence counts in report: %+v", r)
+	}
+	if r.Repaired != 3 || len(r.Divergences) != 3 {
+		t.Fatalf("Expected 3 repairs and divergences, got %+v", r)
+	}
+
+	for _, k := range []string{"onlyl1", "flags", "value"} {
+		if _, ok := l1[k]; ok {
+			t.Fatalf("Expected %s to be repaired out of L1", k)
+		}
+	}
+
+	// everything left is consistent
+	r = c.Check()
+	if r.OnlyL1+r.FlagsMismatch+r.ValueMismatch != 0 {
+		t.Fatalf("Expected no divergence after repair, got %+v", r)
+	}
+}
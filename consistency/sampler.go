@@ -0,0 +1,115 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package consistency checks how well L1 agrees with L2. Keys are sampled from live traffic and
+// periodically (or on demand) read from both tiers directly. Any key present in L1 should have the
+// same flags and value in L2, since L2 is the source of truth and L1 is meant to be a subset of it.
+// Divergence is reported in metrics and, optionally, repaired by removing the bad entry from L1 so
+// that it is refilled from L2 on the next read.
+package consistency
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/common"
+)
+
+// Sampler keeps a bounded, uniformly random sample of the keys seen in traffic using reservoir
+// sampling. It implements server.RequestObserver.
+type Sampler struct {
+	threshold uint32
+
+	lock sync.Mutex
+	keys [][]byte
+	max  int
+	seen uint64
+	rand *rand.Rand
+}
+
+// NewSampler creates a sampler that considers the given fraction of keys (0 to 1] and keeps at
+// most max of them. The fraction is applied by hashing the key, which keeps the cost for keys that
+// aren't sampled down to a single hash and no locking.
+func NewSampler(rate float64, max int) *Sampler {
+	threshold := ^uint32(0)
+	if rate < 1 {
+		threshold = uint32(rate * float64(^uint32(0)))
+	}
+
+	return &Sampler{
+		threshold: threshold,
+		max:       max,
+		keys:      make([][]byte, 0, max),
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (s *Sampler) Observe(req common.Request, reqType common.RequestType) {
+	switch reqType {
+	case common.RequestGet, common.RequestGetE, common.RequestGets:
+		for _, k := range req.(common.GetRequest).Keys {
+			s.offer(k)
+		}
+	case common.RequestGat:
+		s.offer(req.(common.GATRequest).Key)
+	case common.RequestSet, common.RequestAdd, common.RequestReplace, common.RequestAppend, common.RequestPrepend:
+		s.offer(req.(common.SetRequest).Key)
+	case common.RequestSetIfMatch:
+		s.offer(req.(common.SetIfMatchRequest).Key)
+	case common.RequestCAS:
+		s.offer(req.(common.CASRequest).Key)
+	case common.RequestMultiSet:
+		for _, set := range req.(common.MultiSetRequest).Sets {
+			s.offer(set.Key)
+		}
+	case common.RequestTouch:
+		s.offer(req.(common.TouchRequest).Key)
+	case common.RequestIncr, common.RequestDecr:
+		s.offer(req.(common.ArithRequest).Key)
+	}
+}
+
+func (s *Sampler) offer(key []byte) {
+	h := fnv.New32a()
+	h.Write(key)
+	if h.Sum32() > s.threshold {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.seen++
+
+	if len(s.keys) < s.max {
+		s.keys = append(s.keys, append([]byte(nil), key...))
+		return
+	}
+
+	if i := s.rand.Int63n(int64(s.seen)); i < int64(s.max) {
+		s.keys[i] = append([]byte(nil), key...)
+	}
+}
+
+// Keys returns a copy of the current sample
+func (s *Sampler) Keys() [][]byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ret := make([][]byte, len(s.keys))
+	copy(ret, s.keys)
+	return ret
+}
@@ -0,0 +1,326 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package consul is a discovery provider that watches a service in the HashiCorp Consul catalog
+// through the health endpoint of Consul's HTTP API, using blocking queries so changes are seen as
+// soon as they happen. An instance is unhealthy if any of its checks are critical, which includes
+// nodes and services in maintenance mode; checks that are only warning still count as healthy,
+// the same as in Consul's DNS interface.
+//
+// The provider is selected with a configuration string of URL query parameters:
+//
+//	consul:service=memcached&addr=http://127.0.0.1:8500&tag=l1&dc=us-east-1
+//
+// The zone of an instance is taken from the service's metadata, or failing that the node's, under
+// the key given by zone_key ("zone" by default). The ACL token is read from token_file on every
+// request, or the CONSUL_HTTP_TOKEN environment variable without one.
+package consul
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/netflix/rend/discovery"
+	"github.com/netflix/rend/metrics"
+)
+
+var MetricErrors = metrics.AddCounter("discovery_consul_errors", nil)
+
+func init() {
+	discovery.Register("consul", func(conf string) (discovery.Provider, error) {
+		c, err := ParseConfig(conf)
+		if err != nil {
+			return nil, err
+		}
+		return New(c)
+	})
+}
+
+// Config configures a Consul provider
+type Config struct {
+	// Address of the Consul agent
+	Addr    string
+	Service string
+	// Only instances with this tag are used. Empty uses all of them.
+	Tag string
+	// Datacenter to look in. Empty uses the agent's.
+	Datacenter string
+	// Metadata key holding the zone of an instance
+	ZoneKey string
+	// File holding the ACL token. Empty uses the CONSUL_HTTP_TOKEN environment variable.
+	TokenFile string
+	// PEM CA certificates to verify the agent with instead of the system roots
+	CAFile string
+	// Longest a blocking query waits for a change
+	Wait time.Duration
+	// How long to wait before trying again after an error
+	Retry time.Duration
+}
+
+const (
+	defaultAddr    = "http://127.0.0.1:8500"
+	defaultZoneKey = "zone"
+	defaultWait    = 5 * time.Minute
+	defaultRetry   = 5 * time.Second
+)
+
+// ParseConfig parses a configuration string of URL query parameters. service is required. The
+// rest are optional: addr, tag, dc, zone_key, token_file, ca_file, wait, and retry.
+func ParseConfig(conf string) (Config, error) {
+	c := Config{
+		Addr:    defaultAddr,
+		ZoneKey: defaultZoneKey,
+		Wait:    defaultWait,
+		Retry:   defaultRetry,
+	}
+
+	q, err := url.ParseQuery(conf)
+	if err != nil {
+		return c, err
+	}
+
+	for name := range q {
+		val := q.Get(name)
+
+		switch name {
+		case "addr":
+			c.Addr = strings.TrimRight(val, "/")
+		case "service":
+			c.Service = val
+		case "tag":
+			c.Tag = val
+		case "dc":
+			c.Datacenter = val
+		case "zone_key":
+			c.ZoneKey = val
+		case "token_file":
+			c.TokenFile = val
+		case "ca_file":
+			c.CAFile = val
+		case "wait", "retry":
+			d, err := time.ParseDuration(val)
+			if err != nil || d <= 0 {
+				return c, fmt.Errorf("Invalid Consul %s %q", name, val)
+			}
+			if name == "wait" {
+				c.Wait = d
+			} else {
+				c.Retry = d
+			}
+		default:
+			return c, fmt.Errorf("Unknown Consul discovery provider option %q", name)
+		}
+	}
+
+	if c.Service == "" {
+		return c, errors.New("The Consul discovery provider needs a service, e.g. consul:service=memcached")
+	}
+	if c.Addr == "" {
+		return c, errors.New("Consul addr can't be empty")
+	}
+
+	return c, nil
+}
+
+// Provider watches a service in Consul
+type Provider struct {
+	c      Config
+	client *http.Client
+}
+
+func New(c Config) (*Provider, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if c.CAFile != "" {
+		ca, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("No certificates found in Consul CA file %s", c.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	// Consul adds up to 1/16th of the wait time as jitter
+	timeout := c.Wait + c.Wait/16 + 10*time.Second
+
+	return &Provider{
+		c:      c,
+		client: &http.Client{Transport: transport, Timeout: timeout},
+	}, nil
+}
+
+func (p *Provider) token() (string, error) {
+	if p.c.TokenFile == "" {
+		return os.Getenv("CONSUL_HTTP_TOKEN"), nil
+	}
+
+	buf, err := ioutil.ReadFile(p.c.TokenFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(buf)), nil
+}
+
+type serviceEntry struct {
+	Node struct {
+		Address string
+		Meta    map[string]string
+	}
+	Service struct {
+		Address string
+		Port    int
+		Meta    map[string]string
+	}
+	Checks []struct {
+		Status string
+	}
+}
+
+func (e serviceEntry) instance(zoneKey string) discovery.Instance {
+	addr := e.Service.Address
+	if addr == "" {
+		addr = e.Node.Address
+	}
+
+	zone := e.Service.Meta[zoneKey]
+	if zone == "" {
+		zone = e.Node.Meta[zoneKey]
+	}
+
+	healthy := true
+	for _, c := range e.Checks {
+		if c.Status == "critical" {
+			healthy = false
+		}
+	}
+
+	return discovery.Instance{
+		Address: net.JoinHostPort(addr, strconv.Itoa(e.Service.Port)),
+		Zone:    zone,
+		Healthy: healthy,
+	}
+}
+
+// query runs a blocking query for the instances, returning once they've changed since index or
+// the wait runs out. It returns the index to wait on next.
+func (p *Provider) query(ctx context.Context, index uint64) ([]discovery.Instance, uint64, error) {
+	q := url.Values{}
+	q.Set("index", strconv.FormatUint(index, 10))
+	q.Set("wait", strconv.Itoa(int(p.c.Wait/time.Second))+"s")
+	if p.c.Tag != "" {
+		q.Set("tag", p.c.Tag)
+	}
+	if p.c.Datacenter != "" {
+		q.Set("dc", p.c.Datacenter)
+	}
+
+	req, err := http.NewRequest("GET", p.c.Addr+"/v1/health/service/"+url.PathEscape(p.c.Service)+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, index, err
+	}
+	req = req.WithContext(ctx)
+
+	token, err := p.token()
+	if err != nil {
+		return nil, index, err
+	}
+	if token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, index, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return nil, index, fmt.Errorf("Consul returned %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+
+	var entries []serviceEntry
+	if err := json.NewDecoder(res.Body).Decode(&entries); err != nil {
+		return nil, index, err
+	}
+
+	next, err := strconv.ParseUint(res.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, index, fmt.Errorf("Invalid X-Consul-Index %q", res.Header.Get("X-Consul-Index"))
+	}
+
+	instances := make([]discovery.Instance, len(entries))
+	for i, e := range entries {
+		instances[i] = e.instance(p.c.ZoneKey)
+	}
+
+	return instances, next, nil
+}
+
+func (p *Provider) Watch(ctx context.Context, f func([]discovery.Instance)) error {
+	var index uint64
+
+	for {
+		instances, next, err := p.query(ctx, index)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err != nil {
+			log.Printf("Error watching Consul service %s, retrying in %v: %v\n", p.c.Service, p.c.Retry, err)
+			metrics.IncCounter(MetricErrors)
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(p.c.Retry):
+			}
+			continue
+		}
+
+		// An unchanged index means the wait ran out with nothing new
+		if next == index {
+			continue
+		}
+
+		f(instances)
+
+		// Consul's rules for indexes: going backwards, e.g. after the catalog is restored, means
+		// starting over, and 0 must never be waited on since it returns right away
+		switch {
+		case next < index:
+			index = 0
+		case next == 0:
+			index = 1
+		default:
+			index = next
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/discovery"
+	"github.com/netflix/rend/discovery/consul"
+)
+
+const entriesV1 = `[
+  {"Node": {"Address": "10.0.0.1", "Meta": {"zone": "us-east-1a"}},
+   "Service": {"Address": "", "Port": 11211},
+   "Checks": [{"Status": "passing"}, {"Status": "warning"}]},
+  {"Node": {"Address": "10.0.0.2"},
+   "Service": {"Address": "10.1.0.2", "Port": 11212, "Meta": {"zone": "us-east-1b"}},
+   "Checks": [{"Status": "passing"}, {"Status": "critical"}]}
+]`
+
+const entriesV2 = `[
+  {"Node": {"Address": "10.0.0.3"}, "Service": {"Port": 11211}, "Checks": []}
+]`
+
+func TestConsul(t *testing.T) {
+	change := make(chan struct{})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/memcached" || r.URL.Query().Get("tag") != "l1" || r.Header.Get("X-Consul-Token") != "tok" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		switch r.URL.Query().Get("index") {
+		case "0":
+			w.Header().Set("X-Consul-Index", "5")
+			w.Write([]byte(entriesV1))
+		case "5":
+			// A wait that runs out first, then the change
+			select {
+			case <-change:
+				w.Header().Set("X-Consul-Index", "6")
+				w.Write([]byte(entriesV2))
+			case <-time.After(20 * time.Millisecond):
+				w.Header().Set("X-Consul-Index", "5")
+				w.Write([]byte(entriesV1))
+			}
+		default:
+			select {
+			case <-r.Context().Done():
+			case <-time.After(100 * time.Millisecond):
+			}
+			w.Header().Set("X-Consul-Index", r.URL.Query().Get("index"))
+			w.Write([]byte(entriesV2))
+		}
+	}))
+	defer srv.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("tok\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := discovery.FromConfig("consul:service=memcached&tag=l1&wait=1s&addr=" + srv.URL + "&token_file=" + tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reports := make(chan []discovery.Instance, 10)
+	done := make(chan error)
+	go func() {
+		done <- p.Watch(ctx, func(i []discovery.Instance) { reports <- i })
+	}()
+
+	expected := []discovery.Instance{
+		{Address: "10.0.0.1:11211", Zone: "us-east-1a", Healthy: true},
+		{Address: "10.1.0.2:11212", Zone: "us-east-1b", Healthy: false},
+	}
+	if got := <-reports; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+
+	// Let a wait run out without a report
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case got := <-reports:
+		t.Fatalf("Expected no report without a change, got %v", got)
+	default:
+	}
+
+	close(change)
+	expected = []discovery.Instance{{Address: "10.0.0.3:11211", Healthy: true}}
+	if got := <-reports; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatal("Expected the watch to stop when canceled, got", err)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	c, err := consul.ParseConfig("service=memcached&addr=http://consul:8500/&wait=30s&zone_key=az")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Addr != "http://consul:8500" || c.Service != "memcached" || c.Wait != 30*time.Second || c.ZoneKey != "az" {
+		t.Fatalf("Unexpected config %+v", c)
+	}
+
+	for _, bad := range []string{"", "addr=http://consul:8500", "service=a&wait=forever", "service=a&retry=0s", "service=a&nope=1"} {
+		if _, err := consul.ParseConfig(bad); err == nil {
+			t.Errorf("Expected %q to fail", bad)
+		}
+	}
+}
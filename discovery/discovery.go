@@ -0,0 +1,238 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package discovery keeps backend pools up to date from a service catalog, so cache nodes can be
+// replaced without regenerating configuration and restarting rend. Providers are selected by name
+// with a configuration string, like handlers and secrets providers; the consul, etcd, kubernetes,
+// and eureka subpackages register providers for those catalogs.
+//
+// A provider watches one service and reports its instances every time they change. Apply turns
+// each report into the members of a replicas.Group, leaving out instances the catalog says are
+// unhealthy.
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/replicas"
+	"github.com/netflix/rend/metrics"
+)
+
+// Instance is one backend of a service as the catalog knows it
+type Instance struct {
+	// Address to connect to, as host:port
+	Address string
+	// Zone the instance runs in, if the catalog says
+	Zone string
+	// Healthy is false when the catalog's health checks for the instance are failing
+	Healthy bool
+}
+
+func (i Instance) String() string {
+	state := "healthy"
+	if !i.Healthy {
+		state = "unhealthy"
+	}
+	return fmt.Sprintf("%s (zone %q, %s)", i.Address, i.Zone, state)
+}
+
+// Provider watches the instances of a service in a catalog
+type Provider interface {
+	// Watch calls f with all the instances of the service, first as soon as they're known and then
+	// every time they change, until ctx is done. Errors talking to the catalog are logged and
+	// retried, keeping the last known instances in the meantime.
+	Watch(ctx context.Context, f func([]Instance)) error
+}
+
+// ProviderFactory creates a Provider from a configuration string, in the same way as handler
+// factories
+type ProviderFactory func(conf string) (Provider, error)
+
+var (
+	providers     = make(map[string]ProviderFactory)
+	providersLock = new(sync.RWMutex)
+)
+
+// Register makes a provider implementation available by name. Registering the same name twice
+// panics.
+func Register(name string, f ProviderFactory) {
+	providersLock.Lock()
+	defer providersLock.Unlock()
+
+	if f == nil {
+		panic("discovery: Register factory is nil for " + name)
+	}
+	if _, dup := providers[name]; dup {
+		panic("discovery: Register called twice for " + name)
+	}
+
+	providers[name] = f
+}
+
+// Registered returns the sorted names of all registered provider implementations.
+func Registered() []string {
+	providersLock.RLock()
+	defer providersLock.RUnlock()
+
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// FromConfig resolves a configuration string of the form "name" or "name:conf" to a Provider
+// using the registered factory for that name.
+func FromConfig(spec string) (Provider, error) {
+	name, conf := handlers.SplitSpec(spec)
+
+	providersLock.RLock()
+	f, ok := providers[name]
+	providersLock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("Unknown discovery provider %q. Registered providers: %s", name, strings.Join(Registered(), ", "))
+	}
+
+	return f(conf)
+}
+
+// Backend makes the handler for an instance at the given address
+type Backend func(addr string) (handlers.HandlerConst, error)
+
+// HandlerBackend is a Backend that uses the registered handler with the given name, passing the
+// address as its configuration, e.g. "memcached" for memcached:10.0.0.1:11211.
+func HandlerBackend(name string) Backend {
+	return func(addr string) (handlers.HandlerConst, error) {
+		return handlers.FromConfig(name + ":" + addr)
+	}
+}
+
+// Apply watches the provider in the background and makes the healthy instances the members of
+// the group, each one named after its address. If none of them are healthy all of them are used, since trying a backend that may be
+// down is better than failing every request.
+//
+// It waits up to timeout for the first list of instances, so the group has members before it
+// starts taking traffic, and fails if none came by then. The name tags the metrics.
+func Apply(name string, p Provider, g *replicas.Group, backend Backend, timeout time.Duration) error {
+	tags := metrics.Tags{"pool": name}
+	metricUpdates := metrics.AddCounter("discovery_updates", tags)
+	metricErrors := metrics.AddCounter("discovery_backend_errors", tags)
+	gaugeInstances := metrics.AddIntGauge("discovery_instances", tags)
+	gaugeHealthy := metrics.AddIntGauge("discovery_healthy_instances", tags)
+
+	first := make(chan struct{})
+	var once sync.Once
+
+	// Handlers are kept by address so the pool metrics and connections of an instance that stays
+	// in the catalog aren't recreated on every update
+	backends := make(map[string]handlers.HandlerConst)
+	var last []Instance
+	reported := false
+
+	update := func(instances []Instance) {
+		instances = append([]Instance(nil), instances...)
+		sort.Slice(instances, func(i, j int) bool { return instances[i].Address < instances[j].Address })
+
+		// Catalogs can report again without anything changing
+		if reported && equal(instances, last) {
+			return
+		}
+		last, reported = instances, true
+
+		metrics.IncCounter(metricUpdates)
+
+		var healthy []Instance
+		for _, i := range instances {
+			if i.Healthy {
+				healthy = append(healthy, i)
+			}
+		}
+		metrics.SetIntGauge(gaugeInstances, uint64(len(instances)))
+		metrics.SetIntGauge(gaugeHealthy, uint64(len(healthy)))
+
+		use := healthy
+		if len(healthy) == 0 && len(instances) > 0 {
+			log.Printf("No healthy instances found by discovery for %s, using all %d\n", name, len(instances))
+			use = instances
+		}
+
+		rs := make([]replicas.Replica, 0, len(use))
+		seen := make(map[string]struct{}, len(use))
+		for _, i := range use {
+			if _, dup := seen[i.Address]; dup {
+				continue
+			}
+			seen[i.Address] = struct{}{}
+
+			hc, ok := backends[i.Address]
+			if !ok {
+				var err error
+				if hc, err = backend(i.Address); err != nil {
+					log.Printf("Error making a handler for %s discovered for %s: %v\n", i.Address, name, err)
+					metrics.IncCounter(metricErrors)
+					continue
+				}
+				backends[i.Address] = hc
+			}
+
+			rs = append(rs, replicas.Replica{Name: i.Address, Zone: i.Zone, Handler: hc})
+		}
+
+		for addr := range backends {
+			if _, ok := seen[addr]; !ok {
+				delete(backends, addr)
+			}
+		}
+
+		g.Update(rs)
+		log.Printf("Discovery updated %s: %d instances, %d healthy\n", name, len(instances), len(healthy))
+
+		once.Do(func() { close(first) })
+	}
+
+	go func() {
+		if err := p.Watch(context.Background(), update); err != nil {
+			log.Printf("Discovery for %s stopped: %v\n", name, err)
+		}
+	}()
+
+	select {
+	case <-first:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("No instances discovered for %s within %v", name, timeout)
+	}
+}
+
+func equal(a, b []Instance) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,111 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery_test
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/discovery"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/replicas"
+)
+
+// chanProvider reports whatever is sent on its channel
+type chanProvider chan []discovery.Instance
+
+func (c chanProvider) Watch(ctx context.Context, f func([]discovery.Instance)) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case instances := <-c:
+			f(instances)
+		}
+	}
+}
+
+func waitFor(t *testing.T, g *replicas.Group, expected ...string) {
+	t.Helper()
+
+	sort.Strings(expected)
+	deadline := time.Now().Add(time.Second)
+	for {
+		names := g.Replicas()
+		sort.Strings(names)
+		if reflect.DeepEqual(names, expected) || (len(names) == 0 && len(expected) == 0) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected replicas %v, got %v", expected, names)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestApply(t *testing.T) {
+	made := make(map[string]int)
+	backend := func(addr string) (handlers.HandlerConst, error) {
+		made[addr]++
+		return handlers.NilHandler, nil
+	}
+
+	p := make(chanProvider, 1)
+	g := replicas.New(replicas.Config{}, nil)
+
+	if err := discovery.Apply("test-timeout", p, g, backend, 10*time.Millisecond); err == nil {
+		t.Fatal("Expected Apply to fail with nothing discovered")
+	}
+
+	p = make(chanProvider, 1)
+	p <- []discovery.Instance{
+		{Address: "10.0.0.1:11211", Zone: "a", Healthy: true},
+		{Address: "10.0.0.2:11211", Zone: "b", Healthy: false},
+	}
+	if err := discovery.Apply("test", p, g, backend, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, g, "10.0.0.1:11211")
+
+	// A recovered instance joins and the remaining one keeps its handler
+	p <- []discovery.Instance{
+		{Address: "10.0.0.1:11211", Zone: "a", Healthy: true},
+		{Address: "10.0.0.2:11211", Zone: "b", Healthy: true},
+	}
+	waitFor(t, g, "10.0.0.1:11211", "10.0.0.2:11211")
+
+	// With none healthy, all of them are used
+	p <- []discovery.Instance{
+		{Address: "10.0.0.1:11211", Zone: "a", Healthy: false},
+		{Address: "10.0.0.3:11211", Zone: "b", Healthy: false},
+	}
+	waitFor(t, g, "10.0.0.1:11211", "10.0.0.3:11211")
+
+	p <- nil
+	waitFor(t, g)
+
+	if made["10.0.0.1:11211"] != 1 || made["10.0.0.2:11211"] != 1 || made["10.0.0.3:11211"] != 1 {
+		t.Fatalf("Expected one handler per address while it stays discovered, got %v", made)
+	}
+}
+
+func TestFromConfig(t *testing.T) {
+	if _, err := discovery.FromConfig("nosuchprovider:x"); err == nil {
+		t.Fatal("Expected an unknown provider to fail")
+	}
+}
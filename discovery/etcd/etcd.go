@@ -0,0 +1,388 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package etcd is a discovery provider that watches the instances of a service registered under a
+// key prefix in etcd, through the JSON gateway of the etcd v3 API. Each key under the prefix is one
+// instance. Its value is either just the address, as host:port, or a JSON object:
+//
+//	{"address": "10.0.0.1:11211", "zone": "us-east-1a", "healthy": true}
+//
+// Instances are healthy unless their value says otherwise. Registering each key with a lease
+// that the instance keeps alive makes it disappear on its own when the instance dies.
+//
+// The provider is selected with a configuration string of URL query parameters:
+//
+//	etcd:prefix=/services/memcached/&addr=http://127.0.0.1:2379
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/netflix/rend/discovery"
+	"github.com/netflix/rend/metrics"
+)
+
+var MetricErrors = metrics.AddCounter("discovery_etcd_errors", nil)
+
+func init() {
+	discovery.Register("etcd", func(conf string) (discovery.Provider, error) {
+		c, err := ParseConfig(conf)
+		if err != nil {
+			return nil, err
+		}
+		return New(c)
+	})
+}
+
+// Config configures an etcd provider
+type Config struct {
+	// Address of an etcd server
+	Addr   string
+	Prefix string
+	// File holding an auth token, sent as the Authorization header. Empty uses the ETCD_TOKEN
+	// environment variable, if set.
+	TokenFile string
+	// PEM CA certificates to verify the server with instead of the system roots
+	CAFile string
+	// Timeout for reading the instances. Watches stay open as long as they last.
+	Timeout time.Duration
+	// How long to wait before trying again after an error
+	Retry time.Duration
+}
+
+const (
+	defaultAddr    = "http://127.0.0.1:2379"
+	defaultTimeout = 5 * time.Second
+	defaultRetry   = 5 * time.Second
+)
+
+// ParseConfig parses a configuration string of URL query parameters. prefix is required. The
+// rest are optional: addr, token_file, ca_file, timeout, and retry.
+func ParseConfig(conf string) (Config, error) {
+	c := Config{
+		Addr:    defaultAddr,
+		Timeout: defaultTimeout,
+		Retry:   defaultRetry,
+	}
+
+	q, err := url.ParseQuery(conf)
+	if err != nil {
+		return c, err
+	}
+
+	for name := range q {
+		val := q.Get(name)
+
+		switch name {
+		case "addr":
+			c.Addr = strings.TrimRight(val, "/")
+		case "prefix":
+			c.Prefix = val
+		case "token_file":
+			c.TokenFile = val
+		case "ca_file":
+			c.CAFile = val
+		case "timeout", "retry":
+			d, err := time.ParseDuration(val)
+			if err != nil || d <= 0 {
+				return c, fmt.Errorf("Invalid etcd %s %q", name, val)
+			}
+			if name == "timeout" {
+				c.Timeout = d
+			} else {
+				c.Retry = d
+			}
+		default:
+			return c, fmt.Errorf("Unknown etcd discovery provider option %q", name)
+		}
+	}
+
+	if c.Prefix == "" {
+		return c, errors.New("The etcd discovery provider needs a key prefix, e.g. etcd:prefix=/services/memcached/")
+	}
+	if c.Addr == "" {
+		return c, errors.New("etcd addr can't be empty")
+	}
+
+	return c, nil
+}
+
+// Provider watches a key prefix in etcd
+type Provider struct {
+	c Config
+	// client has no timeout since watches are long lived; requests that shouldn't be use a context
+	client *http.Client
+}
+
+func New(c Config) (*Provider, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if c.CAFile != "" {
+		ca, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("No certificates found in etcd CA file %s", c.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &Provider{
+		c:      c,
+		client: &http.Client{Transport: transport},
+	}, nil
+}
+
+func (p *Provider) token() (string, error) {
+	if p.c.TokenFile == "" {
+		return os.Getenv("ETCD_TOKEN"), nil
+	}
+
+	buf, err := ioutil.ReadFile(p.c.TokenFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(buf)), nil
+}
+
+// rangeEnd is the end of the range of keys with the prefix: the prefix with its last byte
+// incremented, after dropping any trailing 0xff bytes
+func rangeEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	// every key
+	return "\x00"
+}
+
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func (p *Provider) post(ctx context.Context, path string, body interface{}) (*http.Response, error) {
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", p.c.Addr+path, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	token, err := p.token()
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return nil, fmt.Errorf("etcd returned %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+
+	return res, nil
+}
+
+// The JSON gateway encodes 64-bit integers as strings and bytes as base64
+type header struct {
+	Revision string `json:"revision"`
+}
+
+type keyValue struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type rangeResponse struct {
+	Header header     `json:"header"`
+	Kvs    []keyValue `json:"kvs"`
+}
+
+type watchResponse struct {
+	Result struct {
+		Header          header            `json:"header"`
+		Created         bool              `json:"created"`
+		Canceled        bool              `json:"canceled"`
+		CompactRevision string            `json:"compact_revision"`
+		Events          []json.RawMessage `json:"events"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type value struct {
+	Address string `json:"address"`
+	Zone    string `json:"zone"`
+	Healthy *bool  `json:"healthy"`
+}
+
+func parseValue(buf []byte) (discovery.Instance, error) {
+	buf = bytes.TrimSpace(buf)
+	if len(buf) > 0 && buf[0] != '{' {
+		return discovery.Instance{Address: string(buf), Healthy: true}, nil
+	}
+
+	var v value
+	if err := json.Unmarshal(buf, &v); err != nil {
+		return discovery.Instance{}, err
+	}
+	if v.Address == "" {
+		return discovery.Instance{}, errors.New("No address")
+	}
+
+	return discovery.Instance{
+		Address: v.Address,
+		Zone:    v.Zone,
+		Healthy: v.Healthy == nil || *v.Healthy,
+	}, nil
+}
+
+// list reads the instances and the revision they were read at
+func (p *Provider) list(ctx context.Context) ([]discovery.Instance, int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.c.Timeout)
+	defer cancel()
+
+	res, err := p.post(ctx, "/v3/kv/range", map[string]string{
+		"key":       b64(p.c.Prefix),
+		"range_end": b64(rangeEnd(p.c.Prefix)),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+
+	var rr rangeResponse
+	if err := json.NewDecoder(res.Body).Decode(&rr); err != nil {
+		return nil, 0, err
+	}
+
+	rev, err := strconv.ParseInt(rr.Header.Revision, 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Invalid etcd revision %q", rr.Header.Revision)
+	}
+
+	instances := make([]discovery.Instance, 0, len(rr.Kvs))
+	for _, kv := range rr.Kvs {
+		i, err := parseValue(kv.Value)
+		if err != nil {
+			log.Printf("Ignoring invalid etcd instance %s: %v\n", kv.Key, err)
+			metrics.IncCounter(MetricErrors)
+			continue
+		}
+		instances = append(instances, i)
+	}
+
+	return instances, rev, nil
+}
+
+// watch blocks until something under the prefix changes after rev, or the watch fails
+func (p *Provider) watch(ctx context.Context, rev int64) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	res, err := p.post(ctx, "/v3/watch", map[string]interface{}{
+		"create_request": map[string]string{
+			"key":            b64(p.c.Prefix),
+			"range_end":      b64(rangeEnd(p.c.Prefix)),
+			"start_revision": strconv.FormatInt(rev+1, 10),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	dec := json.NewDecoder(res.Body)
+	for {
+		var wr watchResponse
+		if err := dec.Decode(&wr); err != nil {
+			if err == io.EOF {
+				return errors.New("etcd closed the watch")
+			}
+			return err
+		}
+
+		switch {
+		case wr.Error != nil:
+			return errors.New(wr.Error.Message)
+		case wr.Result.Canceled:
+			// e.g. the revision was compacted, so the next list has to start over
+			return fmt.Errorf("etcd canceled the watch, compact revision %s", wr.Result.CompactRevision)
+		case len(wr.Result.Events) > 0:
+			return nil
+		}
+	}
+}
+
+// Watch reports the instances, then waits for a change and reads them all again. Reading them
+// again instead of applying each event keeps this simple and correct after compactions and
+// reconnects, and services don't change often enough for it to matter.
+func (p *Provider) Watch(ctx context.Context, f func([]discovery.Instance)) error {
+	for {
+		instances, rev, err := p.list(ctx)
+		if err == nil {
+			f(instances)
+			err = p.watch(ctx, rev)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil {
+			continue
+		}
+
+		log.Printf("Error watching etcd prefix %s, retrying in %v: %v\n", p.c.Prefix, p.c.Retry, err)
+		metrics.IncCounter(MetricErrors)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(p.c.Retry):
+		}
+	}
+}
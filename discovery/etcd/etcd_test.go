@@ -0,0 +1,169 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/discovery"
+	"github.com/netflix/rend/discovery/etcd"
+)
+
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// fakeEtcd serves just enough of the v3 JSON gateway: a range over the prefix and a watch that
+// reports one event each time change is called
+type fakeEtcd struct {
+	sync.Mutex
+	rev     int
+	values  map[string]string
+	changed chan struct{}
+}
+
+func (f *fakeEtcd) change(key, val string) {
+	f.Lock()
+	if val == "" {
+		delete(f.values, key)
+	} else {
+		f.values[key] = val
+	}
+	f.rev++
+	f.Unlock()
+	f.changed <- struct{}{}
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/v3/kv/range":
+		var body struct {
+			Key      string `json:"key"`
+			RangeEnd string `json:"range_end"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body.Key != b64("/svc/") || body.RangeEnd != b64("/svc0") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		f.Lock()
+		defer f.Unlock()
+		var kvs []map[string]string
+		for _, k := range []string{"/svc/a", "/svc/b", "/svc/c"} {
+			if v, ok := f.values[k]; ok {
+				kvs = append(kvs, map[string]string{"key": b64(k), "value": b64(v)})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"header": map[string]string{"revision": fmt.Sprint(f.rev)},
+			"kvs":    kvs,
+		})
+
+	case "/v3/watch":
+		fmt.Fprint(w, `{"result":{"header":{"revision":"1"},"created":true}}`)
+		w.(http.Flusher).Flush()
+
+		select {
+		case <-f.changed:
+			fmt.Fprint(w, `{"result":{"header":{"revision":"2"},"events":[{"kv":{"key":"L3N2Yy9h"}}]}}`)
+		case <-r.Context().Done():
+		}
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestEtcd(t *testing.T) {
+	f := &fakeEtcd{
+		rev: 1,
+		values: map[string]string{
+			"/svc/a": `{"address": "10.0.0.1:11211", "zone": "us-east-1a"}`,
+			"/svc/b": "10.0.0.2:11211",
+			"/svc/c": `{"zone": "no address"}`,
+		},
+		changed: make(chan struct{}),
+	}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	p, err := discovery.FromConfig("etcd:prefix=/svc/&addr=" + srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reports := make(chan []discovery.Instance, 10)
+	done := make(chan error)
+	go func() {
+		done <- p.Watch(ctx, func(i []discovery.Instance) { reports <- i })
+	}()
+
+	expected := []discovery.Instance{
+		{Address: "10.0.0.1:11211", Zone: "us-east-1a", Healthy: true},
+		{Address: "10.0.0.2:11211", Healthy: true},
+	}
+	if got := <-reports; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+
+	f.change("/svc/a", `{"address": "10.0.0.1:11211", "zone": "us-east-1a", "healthy": false}`)
+	expected[0].Healthy = false
+	if got := <-reports; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+
+	f.change("/svc/b", "")
+	expected = expected[:1]
+	select {
+	case got := <-reports:
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("Expected %v, got %v", expected, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a report after the delete")
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatal("Expected the watch to stop when canceled, got", err)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	c, err := etcd.ParseConfig("prefix=/svc/&addr=https://etcd:2379/&timeout=1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Addr != "https://etcd:2379" || c.Prefix != "/svc/" || c.Timeout != time.Second {
+		t.Fatalf("Unexpected config %+v", c)
+	}
+
+	for _, bad := range []string{"", "addr=http://etcd:2379", "prefix=/a&timeout=soon", "prefix=/a&nope=1"} {
+		if _, err := etcd.ParseConfig(bad); err == nil {
+			t.Errorf("Expected %q to fail", bad)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package eureka is a discovery provider that finds the instances of an application, like an
+// EVCache cluster, in a Netflix Eureka registry through its REST API. Eureka has no way to watch
+// for changes, so the application is fetched again every refresh interval, the same way Eureka
+// clients do.
+//
+// An instance is healthy while its status is UP. Its zone is the availability zone from its AWS
+// data center info, so together with --zone reads stay in the instance's own zone. The port is the
+// instance's registered port, or the value of an instance metadata key when port_key is given,
+// since EVCache nodes register the port of their sidecar rather than the memcached port.
+//
+// The provider is selected with a configuration string of URL query parameters:
+//
+//	eureka:app=EVCACHE_USERS&urls=http://eureka-a:8080/eureka/v2,http://eureka-b:8080/eureka/v2
+//
+// The URLs are tried in order, moving on to the next when one fails.
+package eureka
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/netflix/rend/discovery"
+	"github.com/netflix/rend/metrics"
+)
+
+var MetricErrors = metrics.AddCounter("discovery_eureka_errors", nil)
+
+func init() {
+	discovery.Register("eureka", func(conf string) (discovery.Provider, error) {
+		c, err := ParseConfig(conf)
+		if err != nil {
+			return nil, err
+		}
+		return New(c), nil
+	})
+}
+
+// Config configures a Eureka provider
+type Config struct {
+	// Base URLs of the Eureka servers, e.g. http://eureka:8080/eureka/v2
+	URLs []string
+	App  string
+	// Instance metadata key holding the port to connect to. Empty uses the registered port.
+	PortKey string
+	// Connect to the instances' host names instead of their IP addresses
+	UseHostname bool
+	// How often the instances are fetched
+	Refresh time.Duration
+	// Timeout for each fetch
+	Timeout time.Duration
+}
+
+const (
+	defaultRefresh = 30 * time.Second
+	defaultTimeout = 5 * time.Second
+)
+
+// ParseConfig parses a configuration string of URL query parameters. app and urls, a comma
+// separated list, are required. The rest are optional: port_key, use_hostname, refresh, and
+// timeout.
+func ParseConfig(conf string) (Config, error) {
+	c := Config{
+		Refresh: defaultRefresh,
+		Timeout: defaultTimeout,
+	}
+
+	q, err := url.ParseQuery(conf)
+	if err != nil {
+		return c, err
+	}
+
+	for name := range q {
+		val := q.Get(name)
+
+		switch name {
+		case "urls":
+			for _, u := range strings.Split(val, ",") {
+				if u = strings.TrimRight(strings.TrimSpace(u), "/"); u != "" {
+					c.URLs = append(c.URLs, u)
+				}
+			}
+		case "app":
+			c.App = val
+		case "port_key":
+			c.PortKey = val
+		case "use_hostname":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return c, fmt.Errorf("Invalid Eureka use_hostname %q", val)
+			}
+			c.UseHostname = b
+		case "refresh", "timeout":
+			d, err := time.ParseDuration(val)
+			if err != nil || d <= 0 {
+				return c, fmt.Errorf("Invalid Eureka %s %q", name, val)
+			}
+			if name == "refresh" {
+				c.Refresh = d
+			} else {
+				c.Timeout = d
+			}
+		default:
+			return c, fmt.Errorf("Unknown Eureka discovery provider option %q", name)
+		}
+	}
+
+	if c.App == "" {
+		return c, errors.New("The Eureka discovery provider needs an app, e.g. eureka:app=EVCACHE_USERS&urls=http://eureka:8080/eureka/v2")
+	}
+	if len(c.URLs) == 0 {
+		return c, errors.New("The Eureka discovery provider needs the urls of the Eureka servers")
+	}
+
+	return c, nil
+}
+
+// Provider polls an application in Eureka
+type Provider struct {
+	c      Config
+	client *http.Client
+	// index of the URL that worked last, only used by Watch
+	current int
+}
+
+func New(c Config) *Provider {
+	return &Provider{
+		c:      c,
+		client: &http.Client{Timeout: c.Timeout},
+	}
+}
+
+type instance struct {
+	HostName string `json:"hostName"`
+	IPAddr   string `json:"ipAddr"`
+	Status   string `json:"status"`
+	Port     struct {
+		Port json.Number `json:"$"`
+	} `json:"port"`
+	DataCenterInfo struct {
+		Metadata map[string]string `json:"metadata"`
+	} `json:"dataCenterInfo"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+type application struct {
+	Application struct {
+		// Eureka sends an object instead of a list when there's only one instance
+		Instance json.RawMessage `json:"instance"`
+	} `json:"application"`
+}
+
+func (p *Provider) convert(in instance) (discovery.Instance, error) {
+	host := in.IPAddr
+	if p.c.UseHostname || host == "" {
+		host = in.HostName
+	}
+	if host == "" {
+		return discovery.Instance{}, errors.New("No address")
+	}
+
+	port := in.Port.Port.String()
+	if p.c.PortKey != "" {
+		if port = in.Metadata[p.c.PortKey]; port == "" {
+			return discovery.Instance{}, fmt.Errorf("No %s in the metadata", p.c.PortKey)
+		}
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return discovery.Instance{}, fmt.Errorf("Invalid port %q", port)
+	}
+
+	return discovery.Instance{
+		Address: net.JoinHostPort(host, port),
+		Zone:    in.DataCenterInfo.Metadata["availability-zone"],
+		Healthy: in.Status == "UP",
+	}, nil
+}
+
+func (p *Provider) fetch(ctx context.Context, base string) ([]discovery.Instance, error) {
+	req, err := http.NewRequest("GET", base+"/apps/"+url.PathEscape(p.c.App), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		// The application has no instances registered
+		return []discovery.Instance{}, nil
+	default:
+		body, _ := ioutil.ReadAll(res.Body)
+		return nil, fmt.Errorf("Eureka returned %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+
+	var app application
+	if err := json.NewDecoder(res.Body).Decode(&app); err != nil {
+		return nil, err
+	}
+
+	var raw []instance
+	if ins := bytes.TrimSpace(app.Application.Instance); len(ins) > 0 && ins[0] == '{' {
+		var one instance
+		if err := json.Unmarshal(ins, &one); err != nil {
+			return nil, err
+		}
+		raw = append(raw, one)
+	} else if len(ins) > 0 {
+		if err := json.Unmarshal(ins, &raw); err != nil {
+			return nil, err
+		}
+	}
+
+	instances := make([]discovery.Instance, 0, len(raw))
+	for _, in := range raw {
+		i, err := p.convert(in)
+		if err != nil {
+			log.Printf("Ignoring invalid Eureka instance %s of %s: %v\n", in.HostName, p.c.App, err)
+			metrics.IncCounter(MetricErrors)
+			continue
+		}
+		instances = append(instances, i)
+	}
+
+	return instances, nil
+}
+
+// Watch fetches the instances every refresh interval, reporting them each time. A fetch that fails
+// on every Eureka server is logged and the last known instances are kept.
+func (p *Provider) Watch(ctx context.Context, f func([]discovery.Instance)) error {
+	for {
+		var err error
+		for tries := 0; tries < len(p.c.URLs); tries++ {
+			var instances []discovery.Instance
+			if instances, err = p.fetch(ctx, p.c.URLs[p.current]); err == nil {
+				f(instances)
+				break
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			log.Printf("Error fetching %s from Eureka at %s: %v\n", p.c.App, p.c.URLs[p.current], err)
+			metrics.IncCounter(MetricErrors)
+			p.current = (p.current + 1) % len(p.c.URLs)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(p.c.Refresh):
+		}
+	}
+}
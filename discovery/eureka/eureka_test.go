@@ -0,0 +1,117 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eureka_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/discovery"
+	"github.com/netflix/rend/discovery/eureka"
+)
+
+const twoInstances = `{"application": {"name": "EVCACHE_USERS", "instance": [
+  {"hostName": "ec2-1.compute.amazonaws.com", "ipAddr": "10.0.0.1", "status": "UP", "port": {"$": 7001, "@enabled": "true"},
+   "dataCenterInfo": {"name": "Amazon", "metadata": {"availability-zone": "us-east-1a"}},
+   "metadata": {"evcache.port": "11211"}},
+  {"hostName": "ec2-2.compute.amazonaws.com", "ipAddr": "10.0.0.2", "status": "OUT_OF_SERVICE", "port": {"$": "7001"},
+   "dataCenterInfo": {"name": "Amazon", "metadata": {"availability-zone": "us-east-1b"}},
+   "metadata": {"evcache.port": "11211"}},
+  {"hostName": "ec2-3.compute.amazonaws.com", "ipAddr": "10.0.0.3", "status": "UP", "port": {"$": 7001}, "metadata": {}}
+]}}`
+
+// A single instance is an object instead of a list
+const oneInstance = `{"application": {"name": "EVCACHE_USERS", "instance":
+  {"hostName": "ec2-4.compute.amazonaws.com", "ipAddr": "10.0.0.4", "status": "UP", "port": {"$": 7001},
+   "dataCenterInfo": {"name": "MyOwn"}, "metadata": {"evcache.port": "11211"}}
+}}`
+
+func TestEureka(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	var fetches int32
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/eureka/v2/apps/EVCACHE_USERS" || r.Header.Get("Accept") != "application/json" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if atomic.AddInt32(&fetches, 1) == 1 {
+			w.Write([]byte(twoInstances))
+		} else {
+			w.Write([]byte(oneInstance))
+		}
+	}))
+	defer up.Close()
+
+	p, err := discovery.FromConfig("eureka:app=EVCACHE_USERS&port_key=evcache.port&refresh=10ms&urls=" +
+		down.URL + "/eureka/v2," + up.URL + "/eureka/v2/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reports := make(chan []discovery.Instance, 10)
+	done := make(chan error)
+	go func() {
+		done <- p.Watch(ctx, func(i []discovery.Instance) { reports <- i })
+	}()
+
+	// The instance without the port key is left out
+	for i, expected := range [][]discovery.Instance{
+		{
+			{Address: "10.0.0.1:11211", Zone: "us-east-1a", Healthy: true},
+			{Address: "10.0.0.2:11211", Zone: "us-east-1b", Healthy: false},
+		},
+		{{Address: "10.0.0.4:11211", Healthy: true}},
+	} {
+		select {
+		case got := <-reports:
+			if !reflect.DeepEqual(got, expected) {
+				t.Fatalf("Report %d: expected %v, got %v", i, expected, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Report %d never came", i)
+		}
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatal("Expected the watch to stop when canceled, got", err)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	c, err := eureka.ParseConfig("app=EVCACHE_USERS&urls=http://a/eureka/v2/,%20http://b/eureka/v2&refresh=1m&use_hostname=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c.URLs, []string{"http://a/eureka/v2", "http://b/eureka/v2"}) || c.Refresh != time.Minute || !c.UseHostname {
+		t.Fatalf("Unexpected config %+v", c)
+	}
+
+	for _, bad := range []string{"", "app=A", "urls=http://a", "app=A&urls=http://a&refresh=0s", "app=A&urls=http://a&nope=1"} {
+		if _, err := eureka.ParseConfig(bad); err == nil {
+			t.Errorf("Expected %q to fail", bad)
+		}
+	}
+}
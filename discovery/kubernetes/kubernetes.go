@@ -0,0 +1,508 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package kubernetes is a discovery provider that watches the endpoints of a Kubernetes Service
+// through the API server, so rend can run as a sidecar without reloading its configuration when
+// cache pods come and go. By default it watches the Service's EndpointSlices, which carry each
+// pod's zone; api=endpoints watches the older Endpoints object instead, for clusters without
+// EndpointSlices.
+//
+// An instance is healthy while its pod is ready. A pod that's shutting down stops being ready as
+// soon as it starts terminating, so it's drained: requests already sent to it finish, and new ones
+// go to the other pods while it's still up.
+//
+// The provider is selected with a configuration string of URL query parameters:
+//
+//	kubernetes:service=memcached&port=memcache
+//
+// Inside a pod, the API server address, namespace, CA, and token all default to the ones Kubernetes
+// provides to the pod's service account, which needs permission to list and watch the endpoints.
+package kubernetes
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/netflix/rend/discovery"
+	"github.com/netflix/rend/metrics"
+)
+
+var MetricErrors = metrics.AddCounter("discovery_kubernetes_errors", nil)
+
+func init() {
+	discovery.Register("kubernetes", func(conf string) (discovery.Provider, error) {
+		c, err := ParseConfig(conf)
+		if err != nil {
+			return nil, err
+		}
+		return New(c)
+	})
+}
+
+const (
+	// APIEndpointSlices watches discovery.k8s.io/v1 EndpointSlices
+	APIEndpointSlices = "endpointslices"
+	// APIEndpoints watches v1 Endpoints
+	APIEndpoints = "endpoints"
+)
+
+// Config configures a Kubernetes provider
+type Config struct {
+	// Address of the API server
+	Addr      string
+	Namespace string
+	Service   string
+	// Name of the port to connect to. Empty uses the only one, or the first TCP one if there are
+	// several.
+	Port string
+	// API to watch, APIEndpointSlices or APIEndpoints
+	API string
+	// File holding the bearer token, read again on every request since service account tokens
+	// are rotated
+	TokenFile string
+	// PEM CA certificates to verify the API server with. Empty uses the system roots.
+	CAFile string
+	// How long to wait before trying again after an error
+	Retry time.Duration
+}
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	defaultNamespace  = "default"
+	defaultRetry      = 5 * time.Second
+
+	// how long the API server keeps a watch open before it has to be made again
+	watchTimeout = 5 * time.Minute
+)
+
+// ParseConfig parses a configuration string of URL query parameters. service is required. The
+// rest are optional: addr, namespace, port, api, token_file, ca_file, and retry. Missing addr,
+// namespace, token_file, and ca_file come from the pod's environment and service account.
+func ParseConfig(conf string) (Config, error) {
+	c := Config{
+		API:   APIEndpointSlices,
+		Retry: defaultRetry,
+	}
+
+	q, err := url.ParseQuery(conf)
+	if err != nil {
+		return c, err
+	}
+
+	for name := range q {
+		val := q.Get(name)
+
+		switch name {
+		case "addr":
+			c.Addr = strings.TrimRight(val, "/")
+		case "namespace":
+			c.Namespace = val
+		case "service":
+			c.Service = val
+		case "port":
+			c.Port = val
+		case "api":
+			if val != APIEndpointSlices && val != APIEndpoints {
+				return c, fmt.Errorf("Invalid Kubernetes api %q, expected %s or %s", val, APIEndpointSlices, APIEndpoints)
+			}
+			c.API = val
+		case "token_file":
+			c.TokenFile = val
+		case "ca_file":
+			c.CAFile = val
+		case "retry":
+			d, err := time.ParseDuration(val)
+			if err != nil || d <= 0 {
+				return c, fmt.Errorf("Invalid Kubernetes retry %q", val)
+			}
+			c.Retry = d
+		default:
+			return c, fmt.Errorf("Unknown Kubernetes discovery provider option %q", name)
+		}
+	}
+
+	if c.Service == "" {
+		return c, errors.New("The Kubernetes discovery provider needs a service, e.g. kubernetes:service=memcached")
+	}
+
+	inCluster := c.Addr == ""
+	if inCluster {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return c, errors.New("Not running in a Kubernetes pod, so the Kubernetes discovery provider needs an addr")
+		}
+		c.Addr = "https://" + net.JoinHostPort(host, port)
+	}
+	if c.Namespace == "" {
+		c.Namespace = defaultNamespace
+		if buf, err := ioutil.ReadFile(serviceAccountDir + "/namespace"); err == nil {
+			c.Namespace = strings.TrimSpace(string(buf))
+		}
+	}
+	if c.TokenFile == "" {
+		if _, err := os.Stat(serviceAccountDir + "/token"); err == nil {
+			c.TokenFile = serviceAccountDir + "/token"
+		}
+	}
+	if c.CAFile == "" && inCluster {
+		c.CAFile = serviceAccountDir + "/ca.crt"
+	}
+
+	return c, nil
+}
+
+// Provider watches the endpoints of a Service
+type Provider struct {
+	c Config
+	// client has no timeout since watches are long lived; the API server ends them on its own
+	client *http.Client
+}
+
+func New(c Config) (*Provider, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if c.CAFile != "" {
+		ca, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("No certificates found in Kubernetes CA file %s", c.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &Provider{
+		c:      c,
+		client: &http.Client{Transport: transport},
+	}, nil
+}
+
+func (p *Provider) get(ctx context.Context, q url.Values) (*http.Response, error) {
+	path := "/apis/discovery.k8s.io/v1/namespaces/" + url.PathEscape(p.c.Namespace) + "/endpointslices"
+	if p.c.API == APIEndpointSlices {
+		q.Set("labelSelector", "kubernetes.io/service-name="+p.c.Service)
+	} else {
+		path = "/api/v1/namespaces/" + url.PathEscape(p.c.Namespace) + "/endpoints"
+		q.Set("fieldSelector", "metadata.name="+p.c.Service)
+	}
+
+	req, err := http.NewRequest("GET", p.c.Addr+path+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	if p.c.TokenFile != "" {
+		buf, err := ioutil.ReadFile(p.c.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(buf)))
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return nil, fmt.Errorf("Kubernetes API server returned %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+
+	return res, nil
+}
+
+type objectMeta struct {
+	Name            string `json:"name"`
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+type endpointPort struct {
+	Name     string `json:"name"`
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+}
+
+// pickPort returns the port with the given name, or the only or first TCP port without a name
+func pickPort(ports []endpointPort, name string) (int, bool) {
+	for _, p := range ports {
+		if name != "" && p.Name == name {
+			return p.Port, true
+		}
+	}
+	if name != "" {
+		return 0, false
+	}
+	for _, p := range ports {
+		if p.Protocol == "" || p.Protocol == "TCP" {
+			return p.Port, true
+		}
+	}
+	return 0, false
+}
+
+type endpointSlice struct {
+	Metadata  objectMeta     `json:"metadata"`
+	Ports     []endpointPort `json:"ports"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			// Unset means ready, per the API
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+		Zone string `json:"zone"`
+	} `json:"endpoints"`
+}
+
+func (s endpointSlice) instances(portName string) []discovery.Instance {
+	port, ok := pickPort(s.Ports, portName)
+	if !ok {
+		return nil
+	}
+
+	var instances []discovery.Instance
+	for _, e := range s.Endpoints {
+		// Every address is the same pod, so only the first is used
+		if len(e.Addresses) == 0 {
+			continue
+		}
+		instances = append(instances, discovery.Instance{
+			Address: net.JoinHostPort(e.Addresses[0], strconv.Itoa(port)),
+			Zone:    e.Zone,
+			Healthy: e.Conditions.Ready == nil || *e.Conditions.Ready,
+		})
+	}
+	return instances
+}
+
+type endpointAddress struct {
+	IP string `json:"ip"`
+}
+
+type endpoints struct {
+	Metadata objectMeta `json:"metadata"`
+	Subsets  []struct {
+		Addresses         []endpointAddress `json:"addresses"`
+		NotReadyAddresses []endpointAddress `json:"notReadyAddresses"`
+		Ports             []endpointPort    `json:"ports"`
+	} `json:"subsets"`
+}
+
+func (e endpoints) instances(portName string) []discovery.Instance {
+	var instances []discovery.Instance
+	for _, s := range e.Subsets {
+		port, ok := pickPort(s.Ports, portName)
+		if !ok {
+			continue
+		}
+		for _, a := range s.Addresses {
+			instances = append(instances, discovery.Instance{Address: net.JoinHostPort(a.IP, strconv.Itoa(port)), Healthy: true})
+		}
+		for _, a := range s.NotReadyAddresses {
+			instances = append(instances, discovery.Instance{Address: net.JoinHostPort(a.IP, strconv.Itoa(port))})
+		}
+	}
+	return instances
+}
+
+// decode returns the name, resource version, and instances of an EndpointSlice or Endpoints
+func (p *Provider) decode(raw json.RawMessage) (string, string, []discovery.Instance, error) {
+	if p.c.API == APIEndpointSlices {
+		var s endpointSlice
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return "", "", nil, err
+		}
+		return s.Metadata.Name, s.Metadata.ResourceVersion, s.instances(p.c.Port), nil
+	}
+
+	var e endpoints
+	if err := json.Unmarshal(raw, &e); err != nil {
+		return "", "", nil, err
+	}
+	return e.Metadata.Name, e.Metadata.ResourceVersion, e.instances(p.c.Port), nil
+}
+
+type list struct {
+	Metadata objectMeta        `json:"metadata"`
+	Items    []json.RawMessage `json:"items"`
+}
+
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// errExpired means the resource version being watched from is too old, so it has to be listed
+// again
+var errExpired = errors.New("Kubernetes resource version expired")
+
+// state is the instances of every object (EndpointSlice or Endpoints) of the service by name
+type state map[string][]discovery.Instance
+
+func (s state) instances() []discovery.Instance {
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var instances []discovery.Instance
+	for _, name := range names {
+		instances = append(instances, s[name]...)
+	}
+	return instances
+}
+
+func (p *Provider) list(ctx context.Context) (state, string, error) {
+	res, err := p.get(ctx, url.Values{})
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	var l list
+	if err := json.NewDecoder(res.Body).Decode(&l); err != nil {
+		return nil, "", err
+	}
+
+	s := make(state, len(l.Items))
+	for _, item := range l.Items {
+		name, _, instances, err := p.decode(item)
+		if err != nil {
+			return nil, "", err
+		}
+		s[name] = instances
+	}
+
+	return s, l.Metadata.ResourceVersion, nil
+}
+
+// watch applies changes to s as they happen, calling f after each one, until the watch ends. It
+// returns the resource version to watch from next.
+func (p *Provider) watch(ctx context.Context, s state, version string, f func([]discovery.Instance)) (string, error) {
+	q := url.Values{}
+	q.Set("watch", "true")
+	q.Set("resourceVersion", version)
+	q.Set("allowWatchBookmarks", "true")
+	q.Set("timeoutSeconds", strconv.Itoa(int(watchTimeout/time.Second)))
+
+	res, err := p.get(ctx, q)
+	if err != nil {
+		return version, err
+	}
+	defer res.Body.Close()
+
+	dec := json.NewDecoder(res.Body)
+	for {
+		var ev watchEvent
+		if err := dec.Decode(&ev); err != nil {
+			if err == io.EOF {
+				// The watch timed out, which is normal
+				return version, nil
+			}
+			return version, err
+		}
+
+		if ev.Type == "ERROR" {
+			var status struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}
+			json.Unmarshal(ev.Object, &status)
+			if status.Code == http.StatusGone {
+				return version, errExpired
+			}
+			return version, fmt.Errorf("Kubernetes watch error %d: %s", status.Code, status.Message)
+		}
+
+		name, rv, instances, err := p.decode(ev.Object)
+		if err != nil {
+			return version, err
+		}
+		if rv != "" {
+			version = rv
+		}
+
+		switch ev.Type {
+		case "ADDED", "MODIFIED":
+			s[name] = instances
+		case "DELETED":
+			delete(s, name)
+		default:
+			// BOOKMARK only moves the resource version forward
+			continue
+		}
+
+		f(s.instances())
+	}
+}
+
+// Watch lists the endpoints, then watches them for changes from where the list left off. The list
+// is only made again when the API server no longer has the history to continue a watch from.
+func (p *Provider) Watch(ctx context.Context, f func([]discovery.Instance)) error {
+	var s state
+	var version string
+
+	for {
+		var err error
+		if s == nil {
+			if s, version, err = p.list(ctx); err == nil {
+				f(s.instances())
+			}
+		}
+		if err == nil {
+			version, err = p.watch(ctx, s, version, f)
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil {
+			continue
+		}
+		if err == errExpired {
+			s = nil
+			continue
+		}
+
+		log.Printf("Error watching Kubernetes service %s/%s, retrying in %v: %v\n", p.c.Namespace, p.c.Service, p.c.Retry, err)
+		metrics.IncCounter(MetricErrors)
+		s = nil
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(p.c.Retry):
+		}
+	}
+}
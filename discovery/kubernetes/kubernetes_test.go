@@ -0,0 +1,168 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/discovery"
+	"github.com/netflix/rend/discovery/kubernetes"
+)
+
+const (
+	sliceA = `{"metadata": {"name": "mc-a", "resourceVersion": "%d"},
+	  "ports": [{"name": "metrics", "port": 9150, "protocol": "TCP"}, {"name": "memcache", "port": 11211, "protocol": "TCP"}],
+	  "endpoints": [
+	    {"addresses": ["10.0.0.1"], "conditions": {"ready": true}, "zone": "us-east-1a"},
+	    {"addresses": ["10.0.0.2"], "conditions": {"ready": %v}, "zone": "us-east-1b"}
+	  ]}`
+	sliceB = `{"metadata": {"name": "mc-b", "resourceVersion": "%d"},
+	  "ports": [{"name": "memcache", "port": 11211}],
+	  "endpoints": [{"addresses": ["10.0.0.3"], "conditions": {}}]}`
+)
+
+func TestKubernetes(t *testing.T) {
+	lists := 0
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path != "/apis/discovery.k8s.io/v1/namespaces/cache/endpointslices" ||
+			q.Get("labelSelector") != "kubernetes.io/service-name=memcached" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if q.Get("watch") != "true" {
+			lists++
+			fmt.Fprintf(w, `{"metadata": {"resourceVersion": "10"}, "items": [`+sliceA+`, `+sliceB+`]}`, 10, true, 10)
+			return
+		}
+
+		if lists > 1 {
+			<-r.Context().Done()
+			return
+		}
+
+		switch q.Get("resourceVersion") {
+		case "10":
+			// The second pod starts terminating, a bookmark, then the other slice goes away
+			fmt.Fprintf(w, `{"type": "MODIFIED", "object": `+sliceA+`}`+"\n", 13, false)
+			fmt.Fprint(w, `{"type": "BOOKMARK", "object": {"metadata": {"resourceVersion": "14"}}}`+"\n")
+			fmt.Fprintf(w, `{"type": "DELETED", "object": `+sliceB+`}`+"\n", 15)
+		case "15":
+			fmt.Fprint(w, `{"type": "ERROR", "object": {"kind": "Status", "code": 410, "message": "too old"}}`+"\n")
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	p, err := discovery.FromConfig("kubernetes:service=memcached&namespace=cache&port=memcache&addr=" + srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reports := make(chan []discovery.Instance, 10)
+	done := make(chan error)
+	go func() {
+		done <- p.Watch(ctx, func(i []discovery.Instance) { reports <- i })
+	}()
+
+	a1 := discovery.Instance{Address: "10.0.0.1:11211", Zone: "us-east-1a", Healthy: true}
+	a2 := discovery.Instance{Address: "10.0.0.2:11211", Zone: "us-east-1b", Healthy: true}
+	b := discovery.Instance{Address: "10.0.0.3:11211", Healthy: true}
+	a2draining := a2
+	a2draining.Healthy = false
+
+	for i, expected := range [][]discovery.Instance{
+		{a1, a2, b},
+		{a1, a2draining, b},
+		{a1, a2draining},
+		// listed again after the resource version expired
+		{a1, a2, b},
+	} {
+		select {
+		case got := <-reports:
+			if !reflect.DeepEqual(got, expected) {
+				t.Fatalf("Report %d: expected %v, got %v", i, expected, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Report %d never came", i)
+		}
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatal("Expected the watch to stop when canceled, got", err)
+	}
+}
+
+func TestEndpoints(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/default/endpoints" || r.URL.Query().Get("fieldSelector") != "metadata.name=memcached" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.URL.Query().Get("watch") == "true" {
+			<-r.Context().Done()
+			return
+		}
+		fmt.Fprint(w, `{"metadata": {"resourceVersion": "3"}, "items": [{"metadata": {"name": "memcached"}, "subsets": [
+		  {"addresses": [{"ip": "10.0.0.1"}], "notReadyAddresses": [{"ip": "10.0.0.2"}], "ports": [{"port": 11211, "protocol": "TCP"}]}
+		]}]}`)
+	}))
+	defer srv.Close()
+
+	p, err := discovery.FromConfig("kubernetes:service=memcached&namespace=default&api=endpoints&addr=" + srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reports := make(chan []discovery.Instance, 1)
+	go p.Watch(ctx, func(i []discovery.Instance) { reports <- i })
+
+	expected := []discovery.Instance{
+		{Address: "10.0.0.1:11211", Healthy: true},
+		{Address: "10.0.0.2:11211", Healthy: false},
+	}
+	if got := <-reports; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	c, err := kubernetes.ParseConfig("service=memcached&addr=https://k8s:6443/&namespace=cache&api=endpoints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Addr != "https://k8s:6443" || c.Namespace != "cache" || c.API != kubernetes.APIEndpoints {
+		t.Fatalf("Unexpected config %+v", c)
+	}
+
+	for _, bad := range []string{"", "addr=https://k8s:6443", "service=a&addr=x&api=pods", "service=a&addr=x&nope=1"} {
+		if _, err := kubernetes.ParseConfig(bad); err == nil {
+			t.Errorf("Expected %q to fail", bad)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gctune manages the settings that decide how often the garbage collector runs. Rend's
+// heap is small compared to the rate it allocates request buffers at, so with the Go defaults the
+// collector runs far more often than it needs to. A higher GC percent, a soft memory limit or a
+// heap ballast each let the heap grow further between collections.
+package gctune
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync"
+
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricGCPercent     = metrics.AddIntGauge("gc_percent", nil)
+	MetricGCMemoryLimit = metrics.AddIntGauge("gc_memory_limit", nil)
+	MetricGCBallast     = metrics.AddIntGauge("gc_ballast_bytes", nil)
+)
+
+// Config is a set of garbage collector settings
+type Config struct {
+	// GCPercent is the same as the GOGC environment variable: a collection starts when the heap has
+	// grown by this percentage since the last one. 0 keeps the setting the process started with
+	// and a negative value turns the collector off.
+	GCPercent int `json:"gc_percent"`
+
+	// MemoryLimit is a soft limit on the memory used by the Go runtime in bytes, the same as the
+	// GOMEMLIMIT environment variable. The collector runs more often as it gets close, whatever the
+	// GC percent. 0 keeps the setting the process started with.
+	MemoryLimit int64 `json:"memory_limit"`
+
+	// Ballast is the size in bytes of a never used allocation that makes the heap look bigger to
+	// the collector, so it runs less often. The ballast is never touched, so it takes address space
+	// but very little real memory. It does count towards the memory limit and the heap in
+	// runtime.MemStats, and so towards any load shedding thresholds. 0 means no ballast.
+	Ballast int `json:"ballast"`
+}
+
+// Tuner applies garbage collector settings and keeps track of the ones in effect. There should be
+// only one in a process since the settings are global.
+type Tuner struct {
+	lock sync.Mutex
+	conf Config
+
+	// what the process started with, for settings of 0
+	startPercent int
+	startLimit   int64
+
+	ballast []byte
+}
+
+// NewTuner creates a Tuner that hasn't changed anything yet
+func NewTuner() *Tuner {
+	// Neither setting can be read without setting it, so put the GC percent straight back
+	percent := debug.SetGCPercent(100)
+	debug.SetGCPercent(percent)
+
+	return &Tuner{
+		startPercent: percent,
+		startLimit:   debug.SetMemoryLimit(-1),
+	}
+}
+
+// Apply replaces the current settings with the ones in c
+func (t *Tuner) Apply(c Config) error {
+	if c.MemoryLimit < 0 {
+		return fmt.Errorf("memory limit must be >= 0")
+	}
+	if c.Ballast < 0 {
+		return fmt.Errorf("ballast must be >= 0")
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	percent := c.GCPercent
+	if percent == 0 {
+		percent = t.startPercent
+	}
+	debug.SetGCPercent(percent)
+
+	limit := c.MemoryLimit
+	if limit == 0 {
+		limit = t.startLimit
+	}
+	debug.SetMemoryLimit(limit)
+
+	if c.Ballast != len(t.ballast) {
+		t.ballast = nil
+		if c.Ballast > 0 {
+			t.ballast = make([]byte, c.Ballast)
+		}
+		// Without a collection the old ballast would hold on to its memory until the next one
+		runtime.GC()
+	}
+
+	if percent < 0 {
+		metrics.SetIntGauge(MetricGCPercent, 0)
+	} else {
+		metrics.SetIntGauge(MetricGCPercent, uint64(percent))
+	}
+	metrics.SetIntGauge(MetricGCMemoryLimit, uint64(limit))
+	metrics.SetIntGauge(MetricGCBallast, uint64(len(t.ballast)))
+
+	if t.conf != c {
+		log.Printf("GC settings changed from %+v to %+v\n", t.conf, c)
+	}
+	t.conf = c
+
+	return nil
+}
+
+// Config returns the settings in effect
+func (t *Tuner) Config() Config {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.conf
+}
+
+type gcStatus struct {
+	Config
+	HeapAlloc     uint64  `json:"heap_alloc"`
+	NextGC        uint64  `json:"next_gc"`
+	NumGC         uint32  `json:"num_gc"`
+	GCCPUFraction float64 `json:"gc_cpu_fraction"`
+}
+
+// ServeHTTP reports the current settings and the state of the heap as JSON. A POST with any of the
+// gc_percent, memory_limit and ballast parameters changes those settings first and keeps the rest.
+func (t *Tuner) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		c := t.Config()
+
+		for _, p := range []struct {
+			name string
+			set  func(v int64)
+		}{
+			{"gc_percent", func(v int64) { c.GCPercent = int(v) }},
+			{"memory_limit", func(v int64) { c.MemoryLimit = v }},
+			{"ballast", func(v int64) { c.Ballast = int(v) }},
+		} {
+			s := r.FormValue(p.name)
+			if s == "" {
+				continue
+			}
+			v, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Bad %s: %v", p.name, err), http.StatusBadRequest)
+				return
+			}
+			p.set(v)
+		}
+
+		if err := t.Apply(c); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	status := gcStatus{
+		Config:        t.Config(),
+		HeapAlloc:     ms.HeapAlloc,
+		NextGC:        ms.NextGC,
+		NumGC:         ms.NumGC,
+		GCCPUFraction: ms.GCCPUFraction,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,86 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gctune_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime/debug"
+	"testing"
+
+	"github.com/netflix/rend/gctune"
+)
+
+func gcPercent() int {
+	p := debug.SetGCPercent(100)
+	debug.SetGCPercent(p)
+	return p
+}
+
+func TestApply(t *testing.T) {
+	start := gcPercent()
+	startLimit := debug.SetMemoryLimit(-1)
+
+	tu := gctune.NewTuner()
+	if err := tu.Apply(gctune.Config{GCPercent: 400, MemoryLimit: 1 << 40, Ballast: 1 << 20}); err != nil {
+		t.Fatal(err)
+	}
+	if gcPercent() != 400 || debug.SetMemoryLimit(-1) != 1<<40 {
+		t.Fatalf("Expected the settings to be applied, got %d and %d", gcPercent(), debug.SetMemoryLimit(-1))
+	}
+
+	// Going back to zeroes restores what the process started with
+	if err := tu.Apply(gctune.Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if gcPercent() != start || debug.SetMemoryLimit(-1) != startLimit {
+		t.Fatalf("Expected the starting settings back, got %d and %d", gcPercent(), debug.SetMemoryLimit(-1))
+	}
+
+	if err := tu.Apply(gctune.Config{Ballast: -1}); err == nil {
+		t.Fatal("Expected a negative ballast to be rejected")
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	tu := gctune.NewTuner()
+	defer tu.Apply(gctune.Config{})
+
+	if err := tu.Apply(gctune.Config{GCPercent: 200}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the given parameters change
+	rec := httptest.NewRecorder()
+	tu.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/gc?ballast=4096", nil))
+
+	var status struct {
+		gctune.Config
+		NumGC uint32 `json:"num_gc"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Config != (gctune.Config{GCPercent: 200, Ballast: 4096}) || status.NumGC == 0 {
+		t.Fatalf("Unexpected status %s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	tu.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/gc?gc_percent=lots", nil))
+	if rec.Code != http.StatusBadRequest || tu.Config().GCPercent != 200 {
+		t.Fatalf("Expected a bad GC percent to be rejected, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+
+	"github.com/netflix/rend/common"
+)
+
+// Incrementer is implemented by handlers that can increment and decrement numbers atomically, like
+// memcached and the inmem handler. The value must be a decimal number below 2^64, or the request
+// fails with common.ErrBadIncDecValue. Increments wrap around at 2^64 and decrements stop at 0, as
+// in memcached. A key that isn't there fails with common.ErrKeyNotFound unless the request says to
+// create it. Both return the new value.
+type Incrementer interface {
+	Incr(cmd common.ArithRequest) (uint64, error)
+	Decr(cmd common.ArithRequest) (uint64, error)
+}
+
+// IncrementerV2 is the context-aware form of Incrementer for HandlerV2 implementations.
+type IncrementerV2 interface {
+	Incr(ctx context.Context, cmd common.ArithRequest) (uint64, error)
+	Decr(ctx context.Context, cmd common.ArithRequest) (uint64, error)
+}
+
+// Incr increments the key in cmd using h, or returns common.ErrNotSupported if h doesn't implement
+// Incrementer. Doing it on top of the other operations could lose concurrent updates, so there is no
+// fallback.
+func Incr(h Handler, cmd common.ArithRequest) (uint64, error) {
+	if i, ok := h.(Incrementer); ok {
+		return i.Incr(cmd)
+	}
+	return 0, common.ErrNotSupported
+}
+
+// Decr decrements the key in cmd using h, or returns common.ErrNotSupported if h doesn't implement
+// Incrementer.
+func Decr(h Handler, cmd common.ArithRequest) (uint64, error) {
+	if i, ok := h.(Incrementer); ok {
+		return i.Decr(cmd)
+	}
+	return 0, common.ErrNotSupported
+}
+
+// IncrV2 is the HandlerV2 counterpart of Incr.
+func IncrV2(ctx context.Context, h HandlerV2, cmd common.ArithRequest) (uint64, error) {
+	if i, ok := h.(IncrementerV2); ok {
+		return i.Incr(ctx, cmd)
+	}
+	return 0, common.ErrNotSupported
+}
+
+// DecrV2 is the HandlerV2 counterpart of Decr.
+func DecrV2(ctx context.Context, h HandlerV2, cmd common.ArithRequest) (uint64, error) {
+	if i, ok := h.(IncrementerV2); ok {
+		return i.Decr(ctx, cmd)
+	}
+	return 0, common.ErrNotSupported
+}
+
+func (v v2Handler) Incr(ctx context.Context, cmd common.ArithRequest) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	defer v.interrupt(ctx)()
+	return Incr(v.h, cmd)
+}
+
+func (v v2Handler) Decr(ctx context.Context, cmd common.ArithRequest) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	defer v.interrupt(ctx)()
+	return Decr(v.h, cmd)
+}
+
+func (v v1Handler) Incr(cmd common.ArithRequest) (uint64, error) {
+	return IncrV2(context.Background(), v.h, cmd)
+}
+
+func (v v1Handler) Decr(cmd common.ArithRequest) (uint64, error) {
+	return DecrV2(context.Background(), v.h, cmd)
+}
+
+// ApplyDelta adds delta to the decimal number in value, or subtracts it if decr is set, with the
+// same rules as Incrementer. Trailing spaces are allowed since memcached leaves them behind when a
+// decrement makes a number shorter.
+func ApplyDelta(value []byte, delta uint64, decr bool) (uint64, error) {
+	n, err := strconv.ParseUint(string(bytes.TrimRight(value, " ")), 10, 64)
+	if err != nil {
+		return 0, common.ErrBadIncDecValue
+	}
+
+	switch {
+	case !decr:
+		return n + delta, nil
+	case delta > n:
+		return 0, nil
+	}
+	return n - delta, nil
+}
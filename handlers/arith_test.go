@@ -0,0 +1,126 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers_test
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/inmem"
+)
+
+func TestApplyDelta(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		delta uint64
+		decr  bool
+		want  uint64
+		err   error
+	}{
+		{"10", 5, false, 15, nil},
+		{"10", 5, true, 5, nil},
+		{"3", 5, true, 0, nil},
+		{"9   ", 1, false, 10, nil},
+		{strconv.FormatUint(math.MaxUint64, 10), 2, false, 1, nil},
+		{"", 1, false, 0, common.ErrBadIncDecValue},
+		{"abc", 1, false, 0, common.ErrBadIncDecValue},
+		{"-1", 1, false, 0, common.ErrBadIncDecValue},
+		{"18446744073709551616", 1, false, 0, common.ErrBadIncDecValue},
+	} {
+		got, err := handlers.ApplyDelta([]byte(tc.value), tc.delta, tc.decr)
+		if got != tc.want || err != tc.err {
+			t.Errorf("ApplyDelta(%q, %d, %v) = %d, %v, expected %d, %v", tc.value, tc.delta, tc.decr, got, err, tc.want, tc.err)
+		}
+	}
+}
+
+func TestIncr(t *testing.T) {
+	h, _ := inmem.New()
+	key := []byte("incr:counter")
+
+	if _, err := handlers.Incr(h, common.ArithRequest{Key: key, Delta: 1}); err != common.ErrKeyNotFound {
+		t.Fatalf("Expected a miss incrementing a key that isn't there, got %v", err)
+	}
+	n, err := handlers.Incr(h, common.ArithRequest{Key: key, Delta: 1, Initial: 40, Create: true})
+	if err != nil || n != 40 {
+		t.Fatalf("Expected the key created with the initial value, got %d %v", n, err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				handlers.Incr(h, common.ArithRequest{Key: key, Delta: 2})
+				handlers.Decr(h, common.ArithRequest{Key: key, Delta: 1})
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n, err := handlers.Incr(h, common.ArithRequest{Key: key}); err != nil || n != 1040 {
+		t.Fatalf("Expected no updates lost, got %d %v", n, err)
+	}
+	if res := gets(t, h, key); string(res.Data) != "1040" {
+		t.Fatalf("Expected the value stored in decimal, got %q", res.Data)
+	}
+
+	h.Set(common.SetRequest{Key: key, Data: []byte("text")})
+	if _, err := handlers.Decr(h, common.ArithRequest{Key: key, Delta: 1}); err != common.ErrBadIncDecValue {
+		t.Fatalf("Expected decrementing text to fail, got %v", err)
+	}
+
+	var unsupported struct{ handlers.Handler }
+	unsupported.Handler = h
+	if _, err := handlers.Incr(unsupported, common.ArithRequest{Key: key, Delta: 1}); err != common.ErrNotSupported {
+		t.Fatalf("Expected handlers without counters to be unsupported, got %v", err)
+	}
+}
+
+func TestAddConcurrent(t *testing.T) {
+	h, _ := inmem.New()
+	key := []byte("add:concurrent")
+
+	var wg sync.WaitGroup
+	results := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results <- h.Add(common.SetRequest{Key: key, Data: []byte("x")})
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	added := 0
+	for err := range results {
+		switch err {
+		case nil:
+			added++
+		case common.ErrNotAdded:
+		default:
+			t.Fatal(err)
+		}
+	}
+	if added != 1 {
+		t.Fatalf("Expected exactly one add to win, %d did", added)
+	}
+}
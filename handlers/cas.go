@@ -0,0 +1,127 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"context"
+	"encoding/binary"
+
+	"github.com/netflix/rend/common"
+)
+
+// CASer is implemented by handlers that give every version of a value its own CAS value, like
+// memcached and the inmem handler. Gets is a get that fills in each hit's Cas. CompareAndSwap does
+// the set only if the key's CAS value is still the one in the request, and otherwise fails with
+// common.ErrKeyExists, or common.ErrKeyNotFound if the key isn't there.
+type CASer interface {
+	Gets(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error)
+	CompareAndSwap(cmd common.CASRequest) error
+}
+
+// CASerV2 is the context-aware form of CASer for HandlerV2 implementations.
+type CASerV2 interface {
+	Gets(ctx context.Context, cmd common.GetRequest) (<-chan common.GetResponse, <-chan error)
+	CompareAndSwap(ctx context.Context, cmd common.CASRequest) error
+}
+
+// Gets gets the keys in cmd along with their CAS values using h. For handlers that don't implement
+// CASer, the CAS value is emulated as the ValueHash of the data, see CompareAndSwap.
+func Gets(h Handler, cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	if c, ok := h.(CASer); ok {
+		return c.Gets(cmd)
+	}
+	return emulatedGets(h.Get(cmd))
+}
+
+// CompareAndSwap does the set in cmd using h if the key's CAS value still matches. For handlers
+// that don't implement CASer it's a SetIfMatch on the hash of the value, which means a key that was
+// written again with the same value still matches.
+func CompareAndSwap(h Handler, cmd common.CASRequest) error {
+	if c, ok := h.(CASer); ok {
+		return c.CompareAndSwap(cmd)
+	}
+	return SetIfMatch(h, casMatch(cmd))
+}
+
+// GetsV2 is the HandlerV2 counterpart of Gets.
+func GetsV2(ctx context.Context, h HandlerV2, cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	if c, ok := h.(CASerV2); ok {
+		return c.Gets(ctx, cmd)
+	}
+	return emulatedGets(h.Get(ctx, cmd))
+}
+
+// CompareAndSwapV2 is the HandlerV2 counterpart of CompareAndSwap.
+func CompareAndSwapV2(ctx context.Context, h HandlerV2, cmd common.CASRequest) error {
+	if c, ok := h.(CASerV2); ok {
+		return c.CompareAndSwap(ctx, cmd)
+	}
+	return SetIfMatchV2(ctx, h, casMatch(cmd))
+}
+
+func (v v2Handler) Gets(ctx context.Context, cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	if err := ctx.Err(); err != nil {
+		dataOut := make(chan common.GetResponse)
+		close(dataOut)
+		return dataOut, errChan(err)
+	}
+	i, ok := v.h.(Interrupter)
+	if !ok {
+		return Gets(v.h, cmd)
+	}
+	release := i.Interrupt(ctx)
+	dataOut, errorOut := Gets(v.h, cmd)
+	return dataOut, releaseAfter(errorOut, release)
+}
+
+func (v v2Handler) CompareAndSwap(ctx context.Context, cmd common.CASRequest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer v.interrupt(ctx)()
+	return CompareAndSwap(v.h, cmd)
+}
+
+func (v v1Handler) Gets(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	return GetsV2(context.Background(), v.h, cmd)
+}
+
+func (v v1Handler) CompareAndSwap(cmd common.CASRequest) error {
+	return CompareAndSwapV2(context.Background(), v.h, cmd)
+}
+
+func emulatedGets(in <-chan common.GetResponse, errs <-chan error) (<-chan common.GetResponse, <-chan error) {
+	out := make(chan common.GetResponse, cap(in))
+	go func() {
+		for res := range in {
+			if !res.Miss {
+				res.Cas = common.ValueHash(res.Data)
+			}
+			out <- res
+		}
+		close(out)
+	}()
+	return out, errs
+}
+
+func casMatch(cmd common.CASRequest) common.SetIfMatchRequest {
+	match := make([]byte, 8)
+	binary.BigEndian.PutUint64(match, cmd.Cas)
+	return common.SetIfMatchRequest{
+		SetRequest: cmd.SetRequest,
+		Match:      match,
+		MatchHash:  true,
+	}
+}
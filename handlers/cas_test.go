@@ -0,0 +1,126 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/inmem"
+)
+
+func gets(t *testing.T, h handlers.Handler, key []byte) common.GetResponse {
+	t.Helper()
+	resChan, errChan := handlers.Gets(h, common.GetRequest{Keys: [][]byte{key}, Opaques: []uint32{0}, Quiet: []bool{false}})
+	var res common.GetResponse
+	for r := range resChan {
+		res = r
+	}
+	for err := range errChan {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// noCAS hides the inmem handler's CAS values, so they're emulated with value hashes
+type noCAS struct {
+	handlers.Handler
+}
+
+func (n noCAS) SetIfMatch(cmd common.SetIfMatchRequest) error {
+	return handlers.SetIfMatch(n.Handler, cmd)
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	h, _ := inmem.New()
+
+	for name, ch := range map[string]handlers.Handler{"native": h, "emulated": noCAS{h}} {
+		key := []byte("cas:" + name)
+		swap := func(data string, cas uint64) error {
+			return handlers.CompareAndSwap(ch, common.CASRequest{
+				SetRequest: common.SetRequest{Key: key, Data: []byte(data)},
+				Cas:        cas,
+			})
+		}
+
+		if err := swap("x", 1); err != common.ErrKeyNotFound {
+			t.Fatalf("%s: Expected a miss swapping a key that isn't there, got %v", name, err)
+		}
+
+		h.Set(common.SetRequest{Key: key, Data: []byte("x")})
+		res := gets(t, ch, key)
+		if res.Miss || res.Cas == 0 {
+			t.Fatalf("%s: Expected a hit with a CAS value, got %+v", name, res)
+		}
+
+		h.Set(common.SetRequest{Key: key, Data: []byte("y")})
+		if err := swap("z", res.Cas); err != common.ErrKeyExists {
+			t.Fatalf("%s: Expected the swap to fail after another write, got %v", name, err)
+		}
+
+		res = gets(t, ch, key)
+		if err := swap("z", res.Cas); err != nil {
+			t.Fatalf("%s: Error swapping: %v", name, err)
+		}
+		if err := swap("w", res.Cas); err != common.ErrKeyExists {
+			t.Fatalf("%s: Expected swapping with a used CAS value to fail, got %v", name, err)
+		}
+		if res := gets(t, ch, key); string(res.Data) != "z" {
+			t.Fatalf("%s: Expected the swapped value, got %q", name, res.Data)
+		}
+	}
+
+	// a touch doesn't change the value, so it keeps its CAS value
+	key := []byte("cas:touch")
+	h.Set(common.SetRequest{Key: key, Data: []byte("x")})
+	before := gets(t, h, key).Cas
+	h.Touch(common.TouchRequest{Key: key, Exptime: 100})
+	if after := gets(t, h, key).Cas; after != before {
+		t.Fatalf("Expected a touch to keep the CAS value %d, got %d", before, after)
+	}
+}
+
+func TestCompareAndSwapConcurrent(t *testing.T) {
+	h, _ := inmem.New()
+	key := []byte("cas:concurrent")
+	h.Set(common.SetRequest{Key: key, Data: []byte("start")})
+	cas := gets(t, h, key).Cas
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	won := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := handlers.CompareAndSwap(h, common.CASRequest{
+				SetRequest: common.SetRequest{Key: key, Data: []byte("mine")},
+				Cas:        cas,
+			})
+			if err == nil {
+				lock.Lock()
+				won++
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if won != 1 {
+		t.Fatalf("Expected exactly one swap to win, %d did", won)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package chaos injects faults into the requests of a backend, so the handling of backend failures
+// in orchestrators, failover, and clients can be tried out on purpose instead of during a real
+// incident. Each kind of operation can be given its own rates of errors, latency spikes, short
+// reads, and dropped connections, and injection can be turned on and off and reconfigured at
+// runtime through the admin endpoint. A Chaos starts out disabled, so wrapping a backend in one
+// changes nothing until it's told to.
+package chaos
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+// Fault is what is injected into one kind of operation. Every rate is the fraction of operations,
+// between 0 and 1, that get the fault.
+type Fault struct {
+	// Errors fail the operation with a temporary failure without doing it
+	Errors float64 `json:"errors,omitempty"`
+	// Spikes delay the operation by Latency before doing it
+	Spikes  float64  `json:"spikes,omitempty"`
+	Latency Duration `json:"latency,omitempty"`
+	// ShortReads do the operation but cut its response short, as if the connection broke while
+	// reading it: gets return only some of their keys before an error, everything else only the
+	// error. The connection is closed afterwards since it would be out of sync.
+	ShortReads float64 `json:"short_reads,omitempty"`
+	// Drops close the connection to the backend without doing the operation
+	Drops float64 `json:"drops,omitempty"`
+}
+
+// Config is the faults to inject
+type Config struct {
+	Enabled bool `json:"enabled"`
+	// Faults are by operation: get (including gete), set (including add, replace, append,
+	// prepend, incr and decr), delete, touch, gat, and flush. The fault for "*" applies to
+	// operations without one of their own.
+	Faults map[string]Fault `json:"faults"`
+}
+
+// Duration is a time.Duration that is written in JSON as a string like "50ms"
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// kinds of faults, as they're tagged in metrics
+const (
+	faultError = "error"
+	faultSpike = "spike"
+	faultShort = "short_read"
+	faultDrop  = "drop"
+)
+
+// Chaos is the configuration shared by all connections to a backend
+type Chaos struct {
+	hc       handlers.HandlerConst
+	injected map[string]uint32
+
+	lock sync.RWMutex
+	conf Config
+}
+
+// New wraps the backend of hc in a Chaos, disabled to begin with. The name identifies it in
+// metrics.
+func New(name string, hc handlers.HandlerConst) *Chaos {
+	c := &Chaos{
+		hc:       hc,
+		injected: make(map[string]uint32),
+	}
+	for _, f := range []string{faultError, faultSpike, faultShort, faultDrop} {
+		c.injected[f] = metrics.AddCounter("chaos_injected", metrics.Tags{"pool": name, "fault": f})
+	}
+	return c
+}
+
+// Config returns the current configuration
+func (c *Chaos) Config() Config {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.conf
+}
+
+// Configure replaces the configuration. It returns an error, and changes nothing, if any rate is
+// outside of 0 to 1.
+func (c *Chaos) Configure(conf Config) error {
+	for op, f := range conf.Faults {
+		for _, r := range []float64{f.Errors, f.Spikes, f.ShortReads, f.Drops} {
+			if r < 0 || r > 1 {
+				return fmt.Errorf("Rates must be between 0 and 1, got %v for %s", r, op)
+			}
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.conf = conf
+	return nil
+}
+
+// SetEnabled turns injection on or off without changing the faults
+func (c *Chaos) SetEnabled(enabled bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.conf.Enabled = enabled
+}
+
+// fault returns what to inject into op, which is nothing while disabled
+func (c *Chaos) fault(op string) Fault {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if !c.conf.Enabled {
+		return Fault{}
+	}
+	if f, ok := c.conf.Faults[op]; ok {
+		return f
+	}
+	return c.conf.Faults["*"]
+}
+
+// hit decides whether an operation gets a fault with the given rate, counting it if so
+func (c *Chaos) hit(rate float64, fault string) bool {
+	if rate <= 0 || rand.Float64() >= rate {
+		return false
+	}
+	metrics.IncCounter(c.injected[fault])
+	return true
+}
+
+// ServeHTTP reports the configuration as JSON. A POST with a JSON body replaces it first, and a POST
+// with an enabled parameter, i.e. ?enabled=true or ?enabled=false, only turns injection on or off.
+func (c *Chaos) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if v := r.URL.Query().Get("enabled"); v != "" {
+			enabled, err := strconv.ParseBool(v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Bad enabled parameter %q, expected true or false", v), http.StatusBadRequest)
+				return
+			}
+			c.SetEnabled(enabled)
+		} else {
+			var conf Config
+			if err := json.NewDecoder(r.Body).Decode(&conf); err != nil {
+				http.Error(w, "Bad configuration: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := c.Configure(conf); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.Config())
+}
+
+// HandlerConst returns a constructor for handlers that inject the faults. Each one connects to the
+// backend the first time it's used, and again after a fault closed the connection.
+func (c *Chaos) HandlerConst() handlers.HandlerConst {
+	return func() (handlers.Handler, error) {
+		return &Handler{c: c}, nil
+	}
+}
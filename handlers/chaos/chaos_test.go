@@ -0,0 +1,195 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaos_test
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/chaos"
+	"github.com/netflix/rend/handlers/inmem"
+)
+
+// counted returns a constructor for in-memory handlers that counts the connections made
+func counted(n *int) handlers.HandlerConst {
+	return func() (handlers.Handler, error) {
+		*n++
+		return inmem.New()
+	}
+}
+
+func get(t *testing.T, h handlers.Handler, keys ...string) ([]common.GetResponse, error) {
+	req := common.GetRequest{}
+	for _, k := range keys {
+		req.Keys = append(req.Keys, []byte(k))
+		req.Opaques = append(req.Opaques, 0)
+		req.Quiet = append(req.Quiet, false)
+	}
+
+	var res []common.GetResponse
+	var err error
+
+	resChan, errChan := h.Get(req)
+	for resChan != nil || errChan != nil {
+		select {
+		case r, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			} else {
+				res = append(res, r)
+			}
+		case e, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			} else {
+				err = e
+			}
+		}
+	}
+	return res, err
+}
+
+func TestChaos(t *testing.T) {
+	var conns int
+	c := chaos.New("test", counted(&conns))
+	h, _ := c.HandlerConst()()
+
+	set := common.SetRequest{Key: []byte("chaos:a"), Data: []byte("a")}
+	if err := h.Set(set); err != nil {
+		t.Fatalf("Expected nothing to be injected before configuring, got %v", err)
+	}
+
+	err := c.Configure(chaos.Config{
+		Enabled: true,
+		Faults: map[string]chaos.Fault{
+			"set":    {Errors: 1},
+			"delete": {Drops: 1},
+			"get":    {ShortReads: 1},
+			"*":      {Spikes: 1, Latency: chaos.Duration(20 * time.Millisecond)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Set(common.SetRequest{Key: []byte("chaos:b"), Data: []byte("b")}); !errors.Is(err, common.ErrTempFailure) {
+		t.Fatalf("Expected an injected error, got %v", err)
+	}
+
+	if err := h.Delete(common.DeleteRequest{Key: set.Key}); err != io.EOF {
+		t.Fatalf("Expected a dropped connection, got %v", err)
+	}
+
+	start := time.Now()
+	if err := h.Touch(common.TouchRequest{Key: set.Key}); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Fatal("Expected the default fault to delay touches")
+	}
+	if conns != 2 {
+		t.Fatalf("Expected a new connection after the drop, made %d", conns)
+	}
+
+	res, err := get(t, h, "chaos:a", "chaos:b")
+	if err != io.ErrUnexpectedEOF || len(res) != 1 {
+		t.Fatalf("Expected a short read of one key, got %v and %v", res, err)
+	}
+
+	c.SetEnabled(false)
+	res, err = get(t, h, "chaos:a", "chaos:b")
+	if err != nil || len(res) != 2 || res[0].Miss || !res[1].Miss {
+		t.Fatalf("Expected nothing injected once disabled, got %v and %v", res, err)
+	}
+	if conns != 3 {
+		t.Fatalf("Expected a new connection after the short read, made %d", conns)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	var conns int
+	c := chaos.New("http", counted(&conns))
+
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(`{"enabled": true, "faults": {"get": {"spikes": 0.5, "latency": "50ms"}}}`)))
+	if w.Code != 200 {
+		t.Fatalf("Expected the configuration to be accepted, got %d %s", w.Code, w.Body)
+	}
+	f := c.Config().Faults["get"]
+	if !c.Config().Enabled || f.Spikes != 0.5 || time.Duration(f.Latency) != 50*time.Millisecond {
+		t.Fatalf("Unexpected configuration %+v", c.Config())
+	}
+	if !strings.Contains(w.Body.String(), `"latency":"50ms"`) {
+		t.Fatalf("Expected the configuration back, got %s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	c.ServeHTTP(w, httptest.NewRequest("POST", "/?enabled=false", nil))
+	if w.Code != 200 || c.Config().Enabled || c.Config().Faults["get"].Spikes != 0.5 {
+		t.Fatalf("Expected injection to be turned off and the faults kept, got %d %+v", w.Code, c.Config())
+	}
+
+	w = httptest.NewRecorder()
+	c.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(`{"faults": {"*": {"errors": 2}}}`)))
+	if w.Code != 400 || c.Config().Faults["get"].Spikes != 0.5 {
+		t.Fatalf("Expected a rate over 1 to be rejected, got %d", w.Code)
+	}
+}
+
+func TestFlushAndArith(t *testing.T) {
+	var conns int
+	c := chaos.New("flush", counted(&conns))
+	h, _ := c.HandlerConst()()
+
+	incr := common.ArithRequest{Key: []byte("chaos:n"), Delta: 1, Create: true}
+	if v, err := handlers.Incr(h, incr); err != nil || v != 0 {
+		t.Fatalf("Expected the counter to be made, got %d and %v", v, err)
+	}
+	if v, err := handlers.Incr(h, incr); err != nil || v != 1 {
+		t.Fatalf("Expected the counter to go up, got %d and %v", v, err)
+	}
+
+	err := c.Configure(chaos.Config{
+		Enabled: true,
+		Faults: map[string]chaos.Fault{
+			"set":   {Errors: 1},
+			"flush": {Errors: 1},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := handlers.Decr(h, incr); !errors.Is(err, common.ErrTempFailure) {
+		t.Fatalf("Expected decrements to get the faults of sets, got %v", err)
+	}
+	if err := handlers.Flush(h, common.FlushRequest{}); !errors.Is(err, common.ErrTempFailure) {
+		t.Fatalf("Expected an injected flush error, got %v", err)
+	}
+
+	c.SetEnabled(false)
+	if err := handlers.Flush(h, common.FlushRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := get(t, h, "chaos:n"); err != nil || len(res) != 1 || !res[0].Miss {
+		t.Fatalf("Expected the flush to reach the backend, got %v and %v", res, err)
+	}
+}
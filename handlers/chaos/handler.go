@@ -0,0 +1,274 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chaos
+
+import (
+	"io"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+// Handler is the per-connection handler for a Chaos, with its own connection to the backend
+type Handler struct {
+	c    *Chaos
+	conn handlers.Handler
+}
+
+// backend returns the connection to the backend, making it if there isn't one
+func (h *Handler) backend() (handlers.Handler, error) {
+	if h.conn == nil {
+		conn, err := h.c.hc()
+		if err != nil {
+			return nil, err
+		}
+		h.conn = conn
+	}
+	return h.conn, nil
+}
+
+// drop closes the connection to the backend, so the next operation makes a new one
+func (h *Handler) drop() {
+	if h.conn != nil {
+		h.conn.Close()
+		h.conn = nil
+	}
+}
+
+// before injects the faults for op that come before it's done. It returns the connection to do it
+// on and whether its response should be cut short, or an error if it shouldn't be done at all.
+func (h *Handler) before(op string) (handlers.Handler, bool, error) {
+	f := h.c.fault(op)
+
+	if h.c.hit(f.Drops, faultDrop) {
+		h.drop()
+		return nil, false, io.EOF
+	}
+	if h.c.hit(f.Spikes, faultSpike) {
+		time.Sleep(time.Duration(f.Latency))
+	}
+	if h.c.hit(f.Errors, faultError) {
+		return nil, false, common.ErrTempFailure
+	}
+
+	conn, err := h.backend()
+	if err != nil {
+		return nil, false, err
+	}
+	return conn, h.c.hit(f.ShortReads, faultShort), nil
+}
+
+// do runs f on the backend for op with its faults. A fatal error from the backend drops the
+// connection as well.
+func (h *Handler) do(op string, f func(handlers.Handler) error) error {
+	conn, short, err := h.before(op)
+	if err != nil {
+		return err
+	}
+
+	err = f(conn)
+	if short {
+		h.drop()
+		return io.ErrUnexpectedEOF
+	}
+	if err != nil && common.ClassOf(err) == common.ClassFatal {
+		h.drop()
+	}
+	return err
+}
+
+func (h *Handler) Set(cmd common.SetRequest) error {
+	return h.do("set", func(c handlers.Handler) error { return c.Set(cmd) })
+}
+
+func (h *Handler) Add(cmd common.SetRequest) error {
+	return h.do("set", func(c handlers.Handler) error { return c.Add(cmd) })
+}
+
+func (h *Handler) Replace(cmd common.SetRequest) error {
+	return h.do("set", func(c handlers.Handler) error { return c.Replace(cmd) })
+}
+
+func (h *Handler) Append(cmd common.SetRequest) error {
+	return h.do("set", func(c handlers.Handler) error { return c.Append(cmd) })
+}
+
+func (h *Handler) Prepend(cmd common.SetRequest) error {
+	return h.do("set", func(c handlers.Handler) error { return c.Prepend(cmd) })
+}
+
+func (h *Handler) Delete(cmd common.DeleteRequest) error {
+	return h.do("delete", func(c handlers.Handler) error { return c.Delete(cmd) })
+}
+
+func (h *Handler) Touch(cmd common.TouchRequest) error {
+	return h.do("touch", func(c handlers.Handler) error { return c.Touch(cmd) })
+}
+
+func (h *Handler) Incr(cmd common.ArithRequest) (uint64, error) {
+	var v uint64
+	err := h.do("set", func(c handlers.Handler) error {
+		var err error
+		v, err = handlers.Incr(c, cmd)
+		return err
+	})
+	return v, err
+}
+
+func (h *Handler) Decr(cmd common.ArithRequest) (uint64, error) {
+	var v uint64
+	err := h.do("set", func(c handlers.Handler) error {
+		var err error
+		v, err = handlers.Decr(c, cmd)
+		return err
+	})
+	return v, err
+}
+
+func (h *Handler) Flush(cmd common.FlushRequest) error {
+	return h.do("flush", func(c handlers.Handler) error { return handlers.Flush(c, cmd) })
+}
+
+func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	var res common.GetResponse
+	err := h.do("gat", func(c handlers.Handler) error {
+		var err error
+		res, err = c.GAT(cmd)
+		return err
+	})
+	return res, err
+}
+
+func (h *Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	dataOut := make(chan common.GetResponse, len(cmd.Keys))
+	errorOut := make(chan error, 1)
+
+	conn, short, err := h.before("get")
+	if err != nil {
+		close(dataOut)
+		errorOut <- err
+		close(errorOut)
+		return dataOut, errorOut
+	}
+
+	resChan, errChan := conn.Get(cmd)
+	if !short {
+		return resChan, errChan
+	}
+
+	// Only the first half of the keys make it before the connection breaks
+	go func() {
+		defer close(dataOut)
+		defer close(errorOut)
+
+		n := 0
+		drain(resChan, errChan, func(r common.GetResponse) {
+			if n < len(cmd.Keys)/2 {
+				dataOut <- r
+			}
+			n++
+		})
+		h.drop()
+		errorOut <- io.ErrUnexpectedEOF
+	}()
+
+	return dataOut, errorOut
+}
+
+func (h *Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	dataOut := make(chan common.GetEResponse, len(cmd.Keys))
+	errorOut := make(chan error, 1)
+
+	conn, short, err := h.before("get")
+	if err != nil {
+		close(dataOut)
+		errorOut <- err
+		close(errorOut)
+		return dataOut, errorOut
+	}
+
+	resChan, errChan := conn.GetE(cmd)
+	if !short {
+		return resChan, errChan
+	}
+
+	go func() {
+		defer close(dataOut)
+		defer close(errorOut)
+
+		n := 0
+		drainE(resChan, errChan, func(r common.GetEResponse) {
+			if n < len(cmd.Keys)/2 {
+				dataOut <- r
+			}
+			n++
+		})
+		h.drop()
+		errorOut <- io.ErrUnexpectedEOF
+	}()
+
+	return dataOut, errorOut
+}
+
+// Ping checks the backend with the faults for "*", so probes of a backend with chaos see it too
+func (h *Handler) Ping() error {
+	return h.do("*", handlers.Ping)
+}
+
+// Close closes the connection to the backend
+func (h *Handler) Close() error {
+	if h.conn == nil {
+		return nil
+	}
+	err := h.conn.Close()
+	h.conn = nil
+	return err
+}
+
+// drain reads everything from the channels of a handler Get, calling f for each response
+func drain(resChan <-chan common.GetResponse, errChan <-chan error, f func(common.GetResponse)) {
+	for resChan != nil || errChan != nil {
+		select {
+		case res, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			} else {
+				f(res)
+			}
+		case _, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			}
+		}
+	}
+}
+
+func drainE(resChan <-chan common.GetEResponse, errChan <-chan error, f func(common.GetEResponse)) {
+	for resChan != nil || errChan != nil {
+		select {
+		case res, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			} else {
+				f(res)
+			}
+		case _, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			}
+		}
+	}
+}
@@ -0,0 +1,308 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"context"
+
+	"github.com/netflix/rend/common"
+)
+
+// HandlerV2 is the context-aware form of Handler. The context carries the cancellation and the
+// deadline of the frontend request an operation is done for. Implementations should stop their
+// backend I/O and return ctx.Err() once the context is done instead of running the operation to
+// completion for a client that is no longer waiting.
+type HandlerV2 interface {
+	Set(ctx context.Context, cmd common.SetRequest) error
+	Add(ctx context.Context, cmd common.SetRequest) error
+	Replace(ctx context.Context, cmd common.SetRequest) error
+	Append(ctx context.Context, cmd common.SetRequest) error
+	Prepend(ctx context.Context, cmd common.SetRequest) error
+	Get(ctx context.Context, cmd common.GetRequest) (<-chan common.GetResponse, <-chan error)
+	GetE(ctx context.Context, cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error)
+	GAT(ctx context.Context, cmd common.GATRequest) (common.GetResponse, error)
+	Delete(ctx context.Context, cmd common.DeleteRequest) error
+	Touch(ctx context.Context, cmd common.TouchRequest) error
+	Close() error
+}
+
+type HandlerConstV2 func() (HandlerV2, error)
+
+// V2 adapts a Handler to HandlerV2. The adapter keeps new operations from starting after the
+// context is done, and if h is an Interrupter the I/O of each operation is bounded by its context
+// as well. Any other Handler can't be interrupted once an operation has started. If h is itself the
+// result of V1, the original HandlerV2 is returned.
+func V2(h Handler) HandlerV2 {
+	if h == nil {
+		return nil
+	}
+	if u, ok := h.(interface {
+		V2() HandlerV2
+	}); ok {
+		return u.V2()
+	}
+	return v2Handler{h: h}
+}
+
+// V1 adapts a HandlerV2 to Handler, doing every operation with a background context. If h is
+// itself the result of V2, the original Handler is returned.
+func V1(h HandlerV2) Handler {
+	if h == nil {
+		return nil
+	}
+	if u, ok := h.(interface {
+		V1() Handler
+	}); ok {
+		return u.V1()
+	}
+	return v1Handler{h: h}
+}
+
+// ConstV1 adapts a HandlerConstV2 so its handlers can be given anywhere a HandlerConst is expected.
+// Orchestrators built with orcas.ConstV2 still get the HandlerV2 and the request contexts.
+func ConstV1(hc HandlerConstV2) HandlerConst {
+	return func() (Handler, error) {
+		h, err := hc()
+		if err != nil {
+			return nil, err
+		}
+		return V1(h), nil
+	}
+}
+
+// Underlying returns the Handler that h was adapted from, through any number of V1 and V2
+// adaptations, or h itself. Wrappers that look for a specific Handler implementation should look
+// at the underlying handler.
+func Underlying(h Handler) Handler {
+	return V1(V2(h))
+}
+
+// Context returns the context of the request h is currently serving. Only the handlers an
+// orchestrator is given by orcas.ConstV2 know it, which lets a Handler used as a wrapper inside an
+// orchestrator find e.g. the request ID for its log lines. Any other handler gives a background
+// context.
+func Context(h Handler) context.Context {
+	if c, ok := h.(interface {
+		Context() context.Context
+	}); ok {
+		return c.Context()
+	}
+	return context.Background()
+}
+
+// Interrupter is implemented by handlers whose backend I/O can be cut short part way through an
+// operation. Interrupt bounds the I/O of the operations done on the handler by ctx, its deadline
+// and its cancellation, until the returned func is called. Wrappers should forward it to the
+// handler they wrap.
+type Interrupter interface {
+	Interrupt(ctx context.Context) (release func())
+}
+
+// Interrupt bounds the operations done on h by ctx until the returned func is called, if h is an
+// Interrupter. Anything else is left alone.
+func Interrupt(h Handler, ctx context.Context) func() {
+	if i, ok := h.(Interrupter); ok {
+		return i.Interrupt(ctx)
+	}
+	return func() {}
+}
+
+type v2Handler struct {
+	h Handler
+}
+
+func (v v2Handler) interrupt(ctx context.Context) func() {
+	return Interrupt(v.h, ctx)
+}
+
+// releaseAfter calls release once a get is done with its I/O, which is when its error channel is
+// closed. The error, if any, is passed on afterwards.
+func releaseAfter(errIn <-chan error, release func()) <-chan error {
+	errOut := make(chan error, 1)
+	go func() {
+		defer close(errOut)
+		var err error
+		for e := range errIn {
+			err = e
+		}
+		release()
+		if err != nil {
+			errOut <- err
+		}
+	}()
+	return errOut
+}
+
+func (v v2Handler) V1() Handler {
+	return v.h
+}
+
+func (v v2Handler) Set(ctx context.Context, cmd common.SetRequest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer v.interrupt(ctx)()
+	return v.h.Set(cmd)
+}
+
+func (v v2Handler) Add(ctx context.Context, cmd common.SetRequest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer v.interrupt(ctx)()
+	return v.h.Add(cmd)
+}
+
+func (v v2Handler) Replace(ctx context.Context, cmd common.SetRequest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer v.interrupt(ctx)()
+	return v.h.Replace(cmd)
+}
+
+func (v v2Handler) Append(ctx context.Context, cmd common.SetRequest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer v.interrupt(ctx)()
+	return v.h.Append(cmd)
+}
+
+func (v v2Handler) Prepend(ctx context.Context, cmd common.SetRequest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer v.interrupt(ctx)()
+	return v.h.Prepend(cmd)
+}
+
+func (v v2Handler) Get(ctx context.Context, cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	if err := ctx.Err(); err != nil {
+		dataOut := make(chan common.GetResponse)
+		close(dataOut)
+		return dataOut, errChan(err)
+	}
+	i, ok := v.h.(Interrupter)
+	if !ok {
+		return v.h.Get(cmd)
+	}
+	release := i.Interrupt(ctx)
+	dataOut, errorOut := v.h.Get(cmd)
+	return dataOut, releaseAfter(errorOut, release)
+}
+
+func (v v2Handler) GetE(ctx context.Context, cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	if err := ctx.Err(); err != nil {
+		dataOut := make(chan common.GetEResponse)
+		close(dataOut)
+		return dataOut, errChan(err)
+	}
+	i, ok := v.h.(Interrupter)
+	if !ok {
+		return v.h.GetE(cmd)
+	}
+	release := i.Interrupt(ctx)
+	dataOut, errorOut := v.h.GetE(cmd)
+	return dataOut, releaseAfter(errorOut, release)
+}
+
+func (v v2Handler) GAT(ctx context.Context, cmd common.GATRequest) (common.GetResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return common.GetResponse{}, err
+	}
+	defer v.interrupt(ctx)()
+	return v.h.GAT(cmd)
+}
+
+func (v v2Handler) Delete(ctx context.Context, cmd common.DeleteRequest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer v.interrupt(ctx)()
+	return v.h.Delete(cmd)
+}
+
+func (v v2Handler) Touch(ctx context.Context, cmd common.TouchRequest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer v.interrupt(ctx)()
+	return v.h.Touch(cmd)
+}
+
+func (v v2Handler) Close() error {
+	return v.h.Close()
+}
+
+// errChan returns a closed channel holding only err, following the contract of Get and GetE
+func errChan(err error) <-chan error {
+	errOut := make(chan error, 1)
+	errOut <- err
+	close(errOut)
+	return errOut
+}
+
+type v1Handler struct {
+	h HandlerV2
+}
+
+func (v v1Handler) V2() HandlerV2 {
+	return v.h
+}
+
+func (v v1Handler) Set(cmd common.SetRequest) error {
+	return v.h.Set(context.Background(), cmd)
+}
+
+func (v v1Handler) Add(cmd common.SetRequest) error {
+	return v.h.Add(context.Background(), cmd)
+}
+
+func (v v1Handler) Replace(cmd common.SetRequest) error {
+	return v.h.Replace(context.Background(), cmd)
+}
+
+func (v v1Handler) Append(cmd common.SetRequest) error {
+	return v.h.Append(context.Background(), cmd)
+}
+
+func (v v1Handler) Prepend(cmd common.SetRequest) error {
+	return v.h.Prepend(context.Background(), cmd)
+}
+
+func (v v1Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	return v.h.Get(context.Background(), cmd)
+}
+
+func (v v1Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	return v.h.GetE(context.Background(), cmd)
+}
+
+func (v v1Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	return v.h.GAT(context.Background(), cmd)
+}
+
+func (v v1Handler) Delete(cmd common.DeleteRequest) error {
+	return v.h.Delete(context.Background(), cmd)
+}
+
+func (v v1Handler) Touch(cmd common.TouchRequest) error {
+	return v.h.Touch(context.Background(), cmd)
+}
+
+func (v v1Handler) Close() error {
+	return v.h.Close()
+}
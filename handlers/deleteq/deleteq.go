@@ -0,0 +1,418 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package deleteq retries deletes that failed because of the backend, e.g. a timeout or a broken
+// connection. A delete that is lost leaves the old value to be served until it expires, which
+// clients see as a write that didn't take, so each one is queued and tried again in the background
+// with a growing delay, up to a limit. The queue can be saved to a file so a restart doesn't lose
+// it.
+//
+// A retry deletes the key from every target the queue was made with, in order, which is usually
+// L2 and then L1: the delete failing on L2 means it never got to L1 either. A key that is set again
+// before its retry is dropped from the queue, since the retry would delete the new value.
+package deleteq
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/logging"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricQueued      = metrics.AddCounter("delete_queue_queued", nil)
+	MetricDropped     = metrics.AddCounter("delete_queue_dropped", nil)
+	MetricCancelled   = metrics.AddCounter("delete_queue_cancelled", nil)
+	MetricRetries     = metrics.AddCounter("delete_queue_retries", nil)
+	MetricRetryErrors = metrics.AddCounter("delete_queue_retry_errors", nil)
+	MetricDone        = metrics.AddCounter("delete_queue_done", nil)
+	MetricGaveUp      = metrics.AddCounter("delete_queue_gave_up", nil)
+	MetricSaveErrors  = metrics.AddCounter("delete_queue_save_errors", nil)
+)
+
+// Config says how failed deletes are retried
+type Config struct {
+	// Attempts is how many times a delete is retried before giving up on it
+	Attempts int
+
+	// Backoff is how long to wait before the first retry. It doubles after every failed retry, up
+	// to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Max is the most deletes queued at once. Deletes that fail while the queue is full are lost.
+	Max int
+
+	// Path is a file to save the queue to, at most once every SaveInterval, and to load it from
+	// when the queue is made. Empty keeps the queue in memory only.
+	Path         string
+	SaveInterval time.Duration
+}
+
+type entry struct {
+	Key      []byte    `json:"key"`
+	Queued   time.Time `json:"queued"`
+	Attempts int       `json:"attempts"`
+	Next     time.Time `json:"next"`
+}
+
+// Queue is the set of deletes waiting to be retried, shared by every connection
+type Queue struct {
+	conf    Config
+	targets []handlers.HandlerConst
+	conns   []handlers.Handler
+
+	lock    sync.Mutex
+	pending map[string]*entry
+	dirty   bool
+	wake    chan struct{}
+	done    chan struct{}
+}
+
+// New makes a queue that retries deletes on each of targets, in order, and starts retrying any
+// deletes saved in conf.Path.
+func New(conf Config, targets ...handlers.HandlerConst) (*Queue, error) {
+	if conf.Attempts < 1 {
+		conf.Attempts = 1
+	}
+	if conf.Backoff <= 0 {
+		conf.Backoff = 100 * time.Millisecond
+	}
+	if conf.MaxBackoff < conf.Backoff {
+		conf.MaxBackoff = conf.Backoff
+	}
+	if conf.SaveInterval <= 0 {
+		conf.SaveInterval = time.Second
+	}
+
+	q := &Queue{
+		conf:    conf,
+		targets: targets,
+		conns:   make([]handlers.Handler, len(targets)),
+		pending: make(map[string]*entry),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+
+	if conf.Path != "" {
+		if err := q.load(); err != nil {
+			return nil, err
+		}
+		go q.saver()
+	}
+
+	metrics.RegisterIntGaugeCallback("delete_queue_depth", nil, func() uint64 {
+		return uint64(q.Status().Pending)
+	})
+	metrics.RegisterIntGaugeCallback("delete_queue_oldest_age_ms", nil, func() uint64 {
+		return uint64(q.Status().OldestAge / time.Millisecond)
+	})
+
+	go q.retrier()
+
+	return q, nil
+}
+
+// failed reports whether err means the backend itself is in trouble, so the delete may not have
+// been done, as opposed to the key not being there
+func failed(err error) bool {
+	if err == nil {
+		return false
+	}
+	c := common.ClassOf(err)
+	return c == common.ClassFatal || c == common.ClassServer
+}
+
+// add queues a retry of the delete of key
+func (q *Queue) add(key []byte) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if _, ok := q.pending[string(key)]; ok {
+		return
+	}
+	if q.conf.Max > 0 && len(q.pending) >= q.conf.Max {
+		metrics.IncCounter(MetricDropped)
+		return
+	}
+
+	now := time.Now()
+	q.pending[string(key)] = &entry{
+		Key:    append([]byte(nil), key...),
+		Queued: now,
+		Next:   now.Add(q.conf.Backoff),
+	}
+	q.dirty = true
+	metrics.IncCounter(MetricQueued)
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// forget drops the queued delete of key, if there is one, since key was written since
+func (q *Queue) forget(key []byte) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if _, ok := q.pending[string(key)]; ok {
+		delete(q.pending, string(key))
+		q.dirty = true
+		metrics.IncCounter(MetricCancelled)
+	}
+}
+
+// retrier retries every delete when it's due, one at a time
+func (q *Queue) retrier() {
+	timer := time.NewTimer(time.Hour)
+
+	for {
+		due, next := q.due()
+		for _, e := range due {
+			q.retry(e)
+		}
+		if len(due) > 0 {
+			continue
+		}
+
+		wait := time.Hour
+		if !next.IsZero() {
+			wait = time.Until(next)
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-timer.C:
+		case <-q.wake:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-q.done:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// due returns copies of the entries whose retries are due, and when the next one after them is
+func (q *Queue) due() ([]entry, time.Time) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	now := time.Now()
+	var due []entry
+	var next time.Time
+	for _, e := range q.pending {
+		if !e.Next.After(now) {
+			due = append(due, *e)
+		} else if next.IsZero() || e.Next.Before(next) {
+			next = e.Next
+		}
+	}
+	return due, next
+}
+
+// retry deletes the key of e from every target, and requeues it with a longer delay if that fails
+func (q *Queue) retry(e entry) {
+	metrics.IncCounter(MetricRetries)
+
+	err := q.delete(e.Key)
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	cur, ok := q.pending[string(e.Key)]
+	if !ok || cur.Queued != e.Queued {
+		// forgotten during the retry
+		return
+	}
+	q.dirty = true
+
+	if err == nil {
+		delete(q.pending, string(e.Key))
+		metrics.IncCounter(MetricDone)
+		return
+	}
+
+	metrics.IncCounter(MetricRetryErrors)
+	cur.Attempts++
+	if cur.Attempts >= q.conf.Attempts {
+		delete(q.pending, string(e.Key))
+		metrics.IncCounter(MetricGaveUp)
+		log.Printf("Giving up on deleting %q after %d attempts: %v\n", logging.Key(e.Key), cur.Attempts, err)
+		return
+	}
+
+	backoff := q.conf.Backoff << uint(cur.Attempts)
+	if backoff > q.conf.MaxBackoff || backoff <= 0 {
+		backoff = q.conf.MaxBackoff
+	}
+	cur.Next = time.Now().Add(backoff)
+}
+
+// delete deletes key from every target in order, stopping at the first one that fails
+func (q *Queue) delete(key []byte) error {
+	for i, hc := range q.targets {
+		if q.conns[i] == nil {
+			h, err := hc()
+			if err != nil {
+				return err
+			}
+			q.conns[i] = h
+		}
+
+		err := q.conns[i].Delete(common.DeleteRequest{Key: key})
+		if errors.Is(err, common.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			if common.ClassOf(err) == common.ClassFatal {
+				q.conns[i].Close()
+				q.conns[i] = nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// load queues the deletes saved in the file, to be retried right away
+func (q *Queue) load() error {
+	buf, err := ioutil.ReadFile(q.conf.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var entries []entry
+	if err := json.Unmarshal(buf, &entries); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for i := range entries {
+		e := &entries[i]
+		e.Next = now
+		q.pending[string(e.Key)] = e
+	}
+	if len(entries) > 0 {
+		log.Printf("Loaded %d deletes to retry from %s\n", len(entries), q.conf.Path)
+	}
+	return nil
+}
+
+// saver saves the queue whenever it has changed, at most once every save interval
+func (q *Queue) saver() {
+	t := time.NewTicker(q.conf.SaveInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-q.done:
+			return
+		}
+		if err := q.save(); err != nil {
+			log.Println("Error saving the delete queue:", err.Error())
+			metrics.IncCounter(MetricSaveErrors)
+		}
+	}
+}
+
+// Close stops retrying and saves the queue one last time. Deletes still queued are retried by the
+// next queue made with the same file.
+func (q *Queue) Close() error {
+	close(q.done)
+	if q.conf.Path == "" {
+		return nil
+	}
+	return q.save()
+}
+
+// save writes the queue to its file if it has changed. The file is replaced as a whole so a crash
+// while saving leaves the previous one.
+func (q *Queue) save() error {
+	q.lock.Lock()
+	if !q.dirty {
+		q.lock.Unlock()
+		return nil
+	}
+	entries := make([]entry, 0, len(q.pending))
+	for _, e := range q.pending {
+		entries = append(entries, *e)
+	}
+	q.dirty = false
+	q.lock.Unlock()
+
+	buf, err := json.Marshal(entries)
+	if err == nil {
+		tmp := q.conf.Path + ".tmp"
+		if err = ioutil.WriteFile(tmp, buf, 0644); err == nil {
+			err = os.Rename(tmp, q.conf.Path)
+		}
+	}
+
+	if err != nil {
+		// try again next time
+		q.lock.Lock()
+		q.dirty = true
+		q.lock.Unlock()
+	}
+	return err
+}
+
+// Status is a snapshot of the queue
+type Status struct {
+	Pending int `json:"pending"`
+	// OldestAge is how long the oldest queued delete has been waiting, 0 if there are none
+	OldestAge time.Duration `json:"oldest_age_ns"`
+	// Oldest is when the oldest queued delete failed, nil if there are none
+	Oldest *time.Time `json:"oldest,omitempty"`
+}
+
+// Status reports how many deletes are queued and how old the oldest one is
+func (q *Queue) Status() Status {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	s := Status{Pending: len(q.pending)}
+	for _, e := range q.pending {
+		if s.Oldest == nil || e.Queued.Before(*s.Oldest) {
+			queued := e.Queued
+			s.Oldest = &queued
+		}
+	}
+	if s.Oldest != nil {
+		s.OldestAge = time.Since(*s.Oldest)
+	}
+	return s
+}
+
+// ServeHTTP reports the status of the queue as JSON
+func (q *Queue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(q.Status())
+}
@@ -0,0 +1,192 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deleteq_test
+
+import (
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/deleteq"
+)
+
+// fakeBackend is a map that can be taken down, where every request fails like a broken connection
+type fakeBackend struct {
+	sync.Mutex
+	data map[string]string
+	down bool
+}
+
+func newFakeBackend(keys ...string) *fakeBackend {
+	f := &fakeBackend{data: make(map[string]string)}
+	for _, k := range keys {
+		f.data[k] = "old"
+	}
+	return f
+}
+
+func (f *fakeBackend) hc() handlers.HandlerConst {
+	return func() (handlers.Handler, error) { return f, nil }
+}
+
+func (f *fakeBackend) setDown(down bool) {
+	f.Lock()
+	defer f.Unlock()
+	f.down = down
+}
+
+func (f *fakeBackend) has(key string) bool {
+	f.Lock()
+	defer f.Unlock()
+	_, ok := f.data[key]
+	return ok
+}
+
+func (f *fakeBackend) Set(cmd common.SetRequest) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.down {
+		return io.EOF
+	}
+	f.data[string(cmd.Key)] = string(cmd.Data)
+	return nil
+}
+
+func (f *fakeBackend) Delete(cmd common.DeleteRequest) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.down {
+		return io.EOF
+	}
+	if _, ok := f.data[string(cmd.Key)]; !ok {
+		return common.ErrKeyNotFound
+	}
+	delete(f.data, string(cmd.Key))
+	return nil
+}
+
+func (f *fakeBackend) Add(cmd common.SetRequest) error     { return f.Set(cmd) }
+func (f *fakeBackend) Replace(cmd common.SetRequest) error { return f.Set(cmd) }
+func (f *fakeBackend) Append(cmd common.SetRequest) error  { return f.Set(cmd) }
+func (f *fakeBackend) Prepend(cmd common.SetRequest) error { return f.Set(cmd) }
+func (f *fakeBackend) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	panic("unused")
+}
+func (f *fakeBackend) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	panic("unused")
+}
+func (f *fakeBackend) GAT(cmd common.GATRequest) (common.GetResponse, error) { panic("unused") }
+func (f *fakeBackend) Touch(cmd common.TouchRequest) error                   { panic("unused") }
+func (f *fakeBackend) Close() error                                          { return nil }
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for", what)
+		}
+	}
+}
+
+func del(t *testing.T, hc handlers.HandlerConst, key string) error {
+	h, err := hc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h.Delete(common.DeleteRequest{Key: []byte(key)})
+}
+
+func TestRetry(t *testing.T) {
+	l1, l2 := newFakeBackend("a", "b"), newFakeBackend("a", "b")
+	q, err := deleteq.New(deleteq.Config{Attempts: 10, Backoff: 5 * time.Millisecond, Max: 10}, l2.hc(), l1.hc())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	hc := q.Handler(l2.hc())
+
+	l2.setDown(true)
+	if err := del(t, hc, "a"); err == nil {
+		t.Fatal("Expected the delete to fail while L2 is down")
+	}
+	if err := del(t, hc, "b"); err == nil {
+		t.Fatal("Expected the delete to fail while L2 is down")
+	}
+	if s := q.Status(); s.Pending != 2 || s.Oldest == nil {
+		t.Fatalf("Expected 2 queued deletes, got %+v", s)
+	}
+
+	// b is written again before it's retried, so the retry must not delete the new value
+	l2.setDown(false)
+	h, _ := hc()
+	if err := h.Set(common.SetRequest{Key: []byte("b"), Data: []byte("new")}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the queue to drain", func() bool { return q.Status().Pending == 0 })
+	if l2.has("a") || l1.has("a") {
+		t.Fatal("Expected a to be deleted from both backends")
+	}
+	if !l2.has("b") {
+		t.Fatal("Expected the new value of b to be kept")
+	}
+}
+
+func TestGiveUp(t *testing.T) {
+	l2 := newFakeBackend("a")
+	q, err := deleteq.New(deleteq.Config{Attempts: 2, Backoff: time.Millisecond}, l2.hc())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	l2.setDown(true)
+	del(t, q.Handler(l2.hc()), "a")
+	waitFor(t, "the retries to run out", func() bool { return q.Status().Pending == 0 })
+
+	l2.setDown(false)
+	if !l2.has("a") {
+		t.Fatal("Expected a to still be there after giving up")
+	}
+}
+
+func TestPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deletes.json")
+	l2 := newFakeBackend("a")
+	l2.setDown(true)
+
+	conf := deleteq.Config{Attempts: 1000, Backoff: time.Hour, Path: path, SaveInterval: 5 * time.Millisecond}
+	q, err := deleteq.New(conf, l2.hc())
+	if err != nil {
+		t.Fatal(err)
+	}
+	del(t, q.Handler(l2.hc()), "a")
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new queue, as after a restart, picks up the saved delete and retries it right away
+	l2.setDown(false)
+	q2, err := deleteq.New(conf, l2.hc())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q2.Close()
+	waitFor(t, "the saved delete to be retried", func() bool { return !l2.has("a") })
+	waitFor(t, "the queue to drain", func() bool { return q2.Status().Pending == 0 })
+}
@@ -0,0 +1,140 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deleteq
+
+import (
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+// Handler wraps the handlers made by hc so deletes that fail because of the backend are queued to
+// be retried, and writes drop queued deletes of the keys they write
+func (q *Queue) Handler(hc handlers.HandlerConst) handlers.HandlerConst {
+	return func() (handlers.Handler, error) {
+		h, err := hc()
+		if err != nil {
+			return nil, err
+		}
+		return &handler{Handler: h, q: q}, nil
+	}
+}
+
+type handler struct {
+	handlers.Handler
+	q *Queue
+}
+
+// write does a write of key with f, forgetting any queued delete of key if it succeeds
+func (h *handler) write(key []byte, f func() error) error {
+	err := f()
+	if err == nil {
+		h.q.forget(key)
+	}
+	return err
+}
+
+func (h *handler) Set(cmd common.SetRequest) error {
+	return h.write(cmd.Key, func() error { return h.Handler.Set(cmd) })
+}
+
+func (h *handler) Add(cmd common.SetRequest) error {
+	return h.write(cmd.Key, func() error { return h.Handler.Add(cmd) })
+}
+
+func (h *handler) Replace(cmd common.SetRequest) error {
+	return h.write(cmd.Key, func() error { return h.Handler.Replace(cmd) })
+}
+
+func (h *handler) Delete(cmd common.DeleteRequest) error {
+	err := h.Handler.Delete(cmd)
+	if failed(err) {
+		h.q.add(cmd.Key)
+	}
+	return err
+}
+
+func (h *handler) MultiDelete(cmd common.MultiDeleteRequest) []error {
+	errs := handlers.MultiDelete(h.Handler, cmd)
+	for i, err := range errs {
+		if failed(err) {
+			h.q.add(cmd.Deletes[i].Key)
+		}
+	}
+	return errs
+}
+
+func (h *handler) MultiSet(cmd common.MultiSetRequest) []error {
+	errs := handlers.MultiSet(h.Handler, cmd)
+	for i, err := range errs {
+		if err == nil {
+			h.q.forget(cmd.Sets[i].Key)
+		}
+	}
+	return errs
+}
+
+func (h *handler) SetIfMatch(cmd common.SetIfMatchRequest) error {
+	return handlers.SetIfMatch(h.Handler, cmd)
+}
+
+func (h *handler) Incr(cmd common.ArithRequest) (uint64, error) {
+	return handlers.Incr(h.Handler, cmd)
+}
+
+func (h *handler) Decr(cmd common.ArithRequest) (uint64, error) {
+	return handlers.Decr(h.Handler, cmd)
+}
+
+func (h *handler) GetEach(cmd common.GetRequest, f func(common.GetResponse) error) error {
+	return handlers.GetEach(h.Handler, cmd, f)
+}
+
+func (h *handler) GetEEach(cmd common.GetRequest, f func(common.GetEResponse) error) error {
+	return handlers.GetEEach(h.Handler, cmd, f)
+}
+
+func (h *handler) Gets(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	return handlers.Gets(h.Handler, cmd)
+}
+
+func (h *handler) CompareAndSwap(cmd common.CASRequest) error {
+	return handlers.CompareAndSwap(h.Handler, cmd)
+}
+
+func (h *handler) GetLock(cmd common.GetLockRequest) (common.GetLockResponse, error) {
+	return handlers.GetLock(h.Handler, cmd)
+}
+
+func (h *handler) Unlock(cmd common.UnlockRequest) error {
+	return handlers.Unlock(h.Handler, cmd)
+}
+
+func (h *handler) Flush(cmd common.FlushRequest) error {
+	return handlers.Flush(h.Handler, cmd)
+}
+
+func (h *handler) Ping() error {
+	return handlers.Ping(h.Handler)
+}
+
+func (h *handler) Keys(prefix []byte) ([][]byte, error) {
+	return handlers.Keys(h.Handler, prefix)
+}
+
+func (h *handler) ServerTime() (time.Time, error) {
+	return handlers.ServerTime(h.Handler)
+}
@@ -0,0 +1,372 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package failover puts a standby backend behind a primary one. When requests to the primary keep
+// failing it's marked down and the standby takes its reads and writes, so an outage of the primary
+// is a brief blip instead of every request missing. While it's down the primary is probed, and
+// once it's back it takes over again, either automatically after it has stayed healthy for a while
+// or when told to through its admin endpoint.
+//
+// Keys written while the standby is in charge are remembered, up to a limit, and deleted from both
+// backends when failing back: the primary would otherwise serve the values it had before the
+// failover, and the standby the ones from this failover the next time it takes over.
+package failover
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricFailovers       = metrics.AddCounter("failover_failovers", nil)
+	MetricFailbacks       = metrics.AddCounter("failover_failbacks", nil)
+	MetricPrimaryErrors   = metrics.AddCounter("failover_primary_errors", nil)
+	MetricStandbyRequests = metrics.AddCounter("failover_standby_requests", nil)
+	MetricProbeErrors     = metrics.AddCounter("failover_probe_errors", nil)
+	MetricRepaired        = metrics.AddCounter("failover_repaired_keys", nil)
+	MetricRepairErrors    = metrics.AddCounter("failover_repair_errors", nil)
+	MetricRepairDropped   = metrics.AddCounter("failover_repair_dropped", nil)
+)
+
+// Config says when to fail over and back
+type Config struct {
+	// Threshold is how many requests in a row have to fail on the primary to mark it down
+	Threshold int
+
+	// Probe is how often the primary is checked while it's down
+	Probe time.Duration
+
+	// ManualFailBack leaves the standby in charge until failing back is requested through the admin
+	// endpoint, instead of failing back once the primary has been healthy for FailBackDelay
+	ManualFailBack bool
+	FailBackDelay  time.Duration
+
+	// Repair is the most keys written during a failover that are remembered to be deleted when
+	// failing back. Past that, the rest may be stale until they expire.
+	Repair int
+}
+
+// Failover is the state shared by all connections to a primary and its standby
+type Failover struct {
+	primary, standby handlers.HandlerConst
+	conf             Config
+	window           uint32
+
+	// consecutive failures on the primary, and 1 while the standby is in charge, read on every
+	// request without taking the lock
+	failures int32
+	down     int32
+
+	lock         sync.Mutex
+	since        time.Time
+	healthySince time.Time
+	written      map[string]struct{}
+	overflow     bool
+	failovers    uint64
+	failbacks    uint64
+}
+
+// New makes a failover from primary to standby. The name identifies it in metrics.
+func New(name string, conf Config, primary, standby handlers.HandlerConst) *Failover {
+	if conf.Threshold < 1 {
+		conf.Threshold = 1
+	}
+
+	f := &Failover{
+		primary: primary,
+		standby: standby,
+		conf:    conf,
+		window:  metrics.AddHistogram("failover_window", false, metrics.Tags{"pool": name}),
+		since:   time.Now(),
+		written: make(map[string]struct{}),
+	}
+
+	metrics.RegisterIntGaugeCallback("failover_active", metrics.Tags{"pool": name}, func() uint64 {
+		return uint64(atomic.LoadInt32(&f.down))
+	})
+
+	go f.prober()
+
+	return f
+}
+
+// Down reports whether the primary is marked down and the standby is in charge
+func (f *Failover) Down() bool {
+	return atomic.LoadInt32(&f.down) == 1
+}
+
+// failed reports whether err means the backend itself is in trouble, as opposed to the request
+func failed(err error) bool {
+	if err == nil {
+		return false
+	}
+	c := common.ClassOf(err)
+	return c == common.ClassFatal || c == common.ClassServer
+}
+
+// observe records the outcome of a request to the primary, marking it down after too many
+// failures in a row
+func (f *Failover) observe(err error) {
+	if !failed(err) {
+		if atomic.LoadInt32(&f.failures) != 0 {
+			atomic.StoreInt32(&f.failures, 0)
+		}
+		return
+	}
+
+	metrics.IncCounter(MetricPrimaryErrors)
+	if atomic.AddInt32(&f.failures, 1) >= int32(f.conf.Threshold) {
+		f.FailOver(err.Error())
+	}
+}
+
+// FailOver hands the primary's requests to the standby, giving the reason it's logged with
+func (f *Failover) FailOver(reason string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.Down() {
+		return
+	}
+
+	log.Println("Failing over to the standby:", reason)
+	metrics.IncCounter(MetricFailovers)
+	f.failovers++
+	f.since = time.Now()
+	f.healthySince = time.Time{}
+	atomic.StoreInt32(&f.down, 1)
+}
+
+// record remembers that key is about to be written on the standby. It returns false if the primary
+// took over again in the meantime, in which case the write should go there.
+func (f *Failover) record(key []byte) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if !f.Down() {
+		return false
+	}
+
+	if _, ok := f.written[string(key)]; !ok {
+		if len(f.written) < f.conf.Repair {
+			f.written[string(key)] = struct{}{}
+		} else {
+			if !f.overflow {
+				log.Println("Too many keys written during the failover to repair them all")
+			}
+			f.overflow = true
+			metrics.IncCounter(MetricRepairDropped)
+		}
+	}
+
+	return true
+}
+
+// FailBack hands requests back to the primary. The keys written during the failover are first
+// deleted from the primary, and it fails if that can't be done.
+func (f *Failover) FailBack() error {
+	f.lock.Lock()
+	if !f.Down() {
+		f.lock.Unlock()
+		return nil
+	}
+	keys := f.takeWritten()
+	f.lock.Unlock()
+
+	// Most keys are deleted while the standby is still in charge, then the few written since are
+	// deleted after switching, which at worst deletes a new value from the primary
+	if err := repair(f.primary, keys); err != nil {
+		f.lock.Lock()
+		for _, k := range keys {
+			f.written[k] = struct{}{}
+		}
+		f.lock.Unlock()
+		return err
+	}
+
+	f.lock.Lock()
+	rest := f.takeWritten()
+	overflow := f.overflow
+	f.overflow = false
+	atomic.StoreInt32(&f.failures, 0)
+	atomic.StoreInt32(&f.down, 0)
+	window := time.Since(f.since)
+	f.since = time.Now()
+	f.failbacks++
+	f.lock.Unlock()
+
+	log.Printf("Failed back to the primary after %v\n", window)
+	if overflow {
+		log.Println("Some keys written during the failover weren't repaired and may be stale until they expire")
+	}
+	metrics.IncCounter(MetricFailbacks)
+	metrics.ObserveHist(f.window, uint64(window))
+
+	if err := repair(f.primary, rest); err != nil {
+		log.Println("Error deleting keys written during the failover from the primary:", err.Error())
+	}
+	if err := repair(f.standby, append(keys, rest...)); err != nil {
+		log.Println("Error deleting keys written during the failover from the standby:", err.Error())
+	}
+
+	return nil
+}
+
+// takeWritten returns the recorded keys and forgets them. The lock must be held.
+func (f *Failover) takeWritten() []string {
+	keys := make([]string, 0, len(f.written))
+	for k := range f.written {
+		keys = append(keys, k)
+	}
+	f.written = make(map[string]struct{})
+	return keys
+}
+
+// repair deletes keys from the backend of hc on a connection of its own
+func repair(hc handlers.HandlerConst, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	h, err := hc()
+	if err != nil {
+		metrics.IncCounter(MetricRepairErrors)
+		return err
+	}
+	defer h.Close()
+
+	for _, k := range keys {
+		switch err := h.Delete(common.DeleteRequest{Key: []byte(k)}); err {
+		case nil, common.ErrKeyNotFound:
+			metrics.IncCounter(MetricRepaired)
+		default:
+			metrics.IncCounter(MetricRepairErrors)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// prober checks the primary while it's down, and fails back once it has been healthy long enough
+func (f *Failover) prober() {
+	if f.conf.Probe <= 0 {
+		return
+	}
+
+	for range time.Tick(f.conf.Probe) {
+		if !f.Down() {
+			continue
+		}
+
+		err := probe(f.primary)
+
+		f.lock.Lock()
+		if err != nil {
+			f.healthySince = time.Time{}
+		} else if f.healthySince.IsZero() {
+			f.healthySince = time.Now()
+		}
+		ready := !f.conf.ManualFailBack && !f.healthySince.IsZero() && time.Since(f.healthySince) >= f.conf.FailBackDelay
+		f.lock.Unlock()
+
+		if err != nil {
+			metrics.IncCounter(MetricProbeErrors)
+		}
+		if ready {
+			if err := f.FailBack(); err != nil {
+				log.Println("Error failing back to the primary:", err.Error())
+			}
+		}
+	}
+}
+
+// probe checks the backend of hc on a connection of its own
+func probe(hc handlers.HandlerConst) error {
+	h, err := hc()
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+	return handlers.Ping(h)
+}
+
+// Status is a snapshot of a failover
+type Status struct {
+	Active string `json:"active"`
+	// Since is when the active backend took over, or when the failover was made
+	Since          time.Time `json:"since"`
+	PrimaryHealthy bool      `json:"primary_healthy"`
+	Failovers      uint64    `json:"failovers"`
+	Failbacks      uint64    `json:"failbacks"`
+	PendingRepairs int       `json:"pending_repairs"`
+}
+
+// Status reports the state of the failover
+func (f *Failover) Status() Status {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	s := Status{
+		Active:         "primary",
+		Since:          f.since,
+		PrimaryHealthy: !f.Down() || !f.healthySince.IsZero(),
+		Failovers:      f.failovers,
+		Failbacks:      f.failbacks,
+		PendingRepairs: len(f.written),
+	}
+	if f.Down() {
+		s.Active = "standby"
+	}
+	return s
+}
+
+// ServeHTTP reports the status of the failover as JSON. A POST with an active parameter, i.e.
+// ?active=standby or ?active=primary, fails over or back first.
+func (f *Failover) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		switch active := r.FormValue("active"); active {
+		case "standby":
+			f.FailOver("requested through the admin endpoint")
+		case "primary":
+			if err := f.FailBack(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+		default:
+			http.Error(w, fmt.Sprintf("Unknown backend %q, expected primary or standby", active), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f.Status())
+}
+
+// HandlerConst returns a constructor for handlers that use the failover. Each one connects to the
+// primary and standby the first time it uses them.
+func (f *Failover) HandlerConst() handlers.HandlerConst {
+	return func() (handlers.Handler, error) {
+		return &Handler{f: f}, nil
+	}
+}
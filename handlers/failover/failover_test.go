@@ -0,0 +1,289 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package failover_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/failover"
+)
+
+// fakeBackend is a map that can be taken down, where every request fails like a broken connection
+type fakeBackend struct {
+	sync.Mutex
+	data map[string]string
+	down bool
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{data: make(map[string]string)}
+}
+
+func (f *fakeBackend) hc() handlers.HandlerConst {
+	return func() (handlers.Handler, error) { return f, nil }
+}
+
+func (f *fakeBackend) setDown(down bool) {
+	f.Lock()
+	defer f.Unlock()
+	f.down = down
+}
+
+func (f *fakeBackend) value(key string) (string, bool) {
+	f.Lock()
+	defer f.Unlock()
+	v, ok := f.data[key]
+	return v, ok
+}
+
+func (f *fakeBackend) Set(cmd common.SetRequest) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.down {
+		return io.EOF
+	}
+	f.data[string(cmd.Key)] = string(cmd.Data)
+	return nil
+}
+
+func (f *fakeBackend) Delete(cmd common.DeleteRequest) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.down {
+		return io.EOF
+	}
+	if _, ok := f.data[string(cmd.Key)]; !ok {
+		return common.ErrKeyNotFound
+	}
+	delete(f.data, string(cmd.Key))
+	return nil
+}
+
+func (f *fakeBackend) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	dataOut := make(chan common.GetResponse, len(cmd.Keys))
+	errorOut := make(chan error, 1)
+	f.Lock()
+	defer f.Unlock()
+	if f.down {
+		errorOut <- io.EOF
+	} else {
+		for i, k := range cmd.Keys {
+			v, ok := f.data[string(k)]
+			dataOut <- common.GetResponse{Key: k, Data: []byte(v), Miss: !ok, Opaque: cmd.Opaques[i]}
+		}
+	}
+	close(dataOut)
+	close(errorOut)
+	return dataOut, errorOut
+}
+
+func (f *fakeBackend) Flush(cmd common.FlushRequest) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.down {
+		return io.EOF
+	}
+	f.data = make(map[string]string)
+	return nil
+}
+
+func (f *fakeBackend) Ping() error {
+	f.Lock()
+	defer f.Unlock()
+	if f.down {
+		return io.EOF
+	}
+	return nil
+}
+
+func (f *fakeBackend) Add(cmd common.SetRequest) error     { return f.Set(cmd) }
+func (f *fakeBackend) Replace(cmd common.SetRequest) error { return f.Set(cmd) }
+func (f *fakeBackend) Append(cmd common.SetRequest) error  { return f.Set(cmd) }
+func (f *fakeBackend) Prepend(cmd common.SetRequest) error { return f.Set(cmd) }
+func (f *fakeBackend) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	panic("unused")
+}
+func (f *fakeBackend) GAT(cmd common.GATRequest) (common.GetResponse, error) { panic("unused") }
+func (f *fakeBackend) Touch(cmd common.TouchRequest) error                   { panic("unused") }
+func (f *fakeBackend) Close() error                                          { return nil }
+
+func get(t *testing.T, h handlers.Handler, key string) (string, bool) {
+	res, errs := h.Get(common.GetRequest{Keys: [][]byte{[]byte(key)}, Opaques: []uint32{0}, Quiet: []bool{false}})
+	var r common.GetResponse
+	for res != nil || errs != nil {
+		select {
+		case x, ok := <-res:
+			if !ok {
+				res = nil
+			} else {
+				r = x
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+			} else {
+				t.Fatal(err)
+			}
+		}
+	}
+	return string(r.Data), !r.Miss
+}
+
+func set(h handlers.Handler, key, value string) error {
+	return h.Set(common.SetRequest{Key: []byte(key), Data: []byte(value)})
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for", what)
+		}
+	}
+}
+
+func TestFailover(t *testing.T) {
+	primary, standby := newFakeBackend(), newFakeBackend()
+	f := failover.New("test", failover.Config{
+		Threshold:     2,
+		Probe:         10 * time.Millisecond,
+		FailBackDelay: 50 * time.Millisecond,
+		Repair:        100,
+	}, primary.hc(), standby.hc())
+
+	h, _ := f.HandlerConst()()
+
+	if err := set(h, "a", "old"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := primary.value("a"); !ok || f.Down() {
+		t.Fatal("Expected the write to go to the primary")
+	}
+
+	primary.setDown(true)
+	if err := set(h, "a", "new"); err == nil || f.Down() {
+		t.Fatal("Expected a single failure to be returned without failing over")
+	}
+	if err := set(h, "a", "new"); err != nil || !f.Down() {
+		t.Fatalf("Expected the second failure to fail over and go to the standby, got %v", err)
+	}
+	if v, ok := get(t, h, "a"); !ok || v != "new" {
+		t.Fatalf("Expected the standby to serve the write, got %q, %v", v, ok)
+	}
+
+	primary.setDown(false)
+	waitFor(t, "fail back", func() bool { return !f.Down() })
+
+	// the primary's old value and the standby's copy are both gone
+	if _, ok := get(t, h, "a"); ok {
+		t.Error("Expected the key written during the failover to be deleted from the primary")
+	}
+	if _, ok := standby.value("a"); ok {
+		t.Error("Expected the key written during the failover to be deleted from the standby")
+	}
+
+	if s := f.Status(); s.Active != "primary" || s.Failovers != 1 || s.Failbacks != 1 {
+		t.Errorf("Unexpected status %+v", s)
+	}
+}
+
+func TestManualFailBack(t *testing.T) {
+	primary, standby := newFakeBackend(), newFakeBackend()
+	f := failover.New("manual", failover.Config{
+		Threshold:      1,
+		Probe:          5 * time.Millisecond,
+		ManualFailBack: true,
+		Repair:         100,
+	}, primary.hc(), standby.hc())
+
+	status := func(method, query string) failover.Status {
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, httptest.NewRequest(method, "/admin/failover/manual"+query, nil))
+		if w.Code != 200 {
+			t.Fatalf("Got status %d: %s", w.Code, w.Body.String())
+		}
+		var s failover.Status
+		if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	if s := status("POST", "?active=standby"); s.Active != "standby" {
+		t.Fatalf("Expected to fail over, got %+v", s)
+	}
+
+	h, _ := f.HandlerConst()()
+	if err := set(h, "b", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := standby.value("b"); !ok {
+		t.Fatal("Expected the write to go to the standby")
+	}
+
+	waitFor(t, "a healthy probe", func() bool { return f.Status().PrimaryHealthy })
+	time.Sleep(20 * time.Millisecond)
+	if s := status("GET", ""); s.Active != "standby" || s.PendingRepairs != 1 {
+		t.Fatalf("Expected to stay on the standby until told otherwise, got %+v", s)
+	}
+
+	if s := status("POST", "?active=primary"); s.Active != "primary" || s.PendingRepairs != 0 {
+		t.Fatalf("Expected to fail back, got %+v", s)
+	}
+
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("POST", "/admin/failover/manual?active=tertiary", nil))
+	if w.Code != 400 {
+		t.Errorf("Expected an unknown backend to be rejected, got %d", w.Code)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	primary, standby := newFakeBackend(), newFakeBackend()
+	f := failover.New("flush", failover.Config{Threshold: 1, Repair: 100}, primary.hc(), standby.hc())
+	h, _ := f.HandlerConst()()
+
+	if err := set(h, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	standby.data["b"] = "stale"
+
+	if err := handlers.Flush(h, common.FlushRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := primary.value("a"); ok {
+		t.Error("Expected the flush to reach the primary")
+	}
+	if _, ok := standby.value("b"); ok {
+		t.Error("Expected the flush to reach the standby too")
+	}
+
+	f.FailOver("test")
+	if err := set(h, "c", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := handlers.Flush(h, common.FlushRequest{}); err != common.ErrTempFailure {
+		t.Fatalf("Expected flushes to be refused during a failover, got %v", err)
+	}
+	if _, ok := standby.value("c"); !ok {
+		t.Error("Expected the standby to be left alone during a failover")
+	}
+}
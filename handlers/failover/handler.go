@@ -0,0 +1,245 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package failover
+
+import (
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+// Handler is the per-connection handler for a Failover, with its own connections to the primary
+// and the standby
+type Handler struct {
+	f                *Failover
+	primary, standby handlers.Handler
+}
+
+// on runs f on the connection in c, first making it with hc if there isn't one. A fatal error
+// drops the connection so the next request makes a new one.
+func on(c *handlers.Handler, hc handlers.HandlerConst, f func(handlers.Handler) error) error {
+	if *c == nil {
+		h, err := hc()
+		if err != nil {
+			return err
+		}
+		*c = h
+	}
+
+	err := f(*c)
+	if err != nil && common.ClassOf(err) == common.ClassFatal {
+		(*c).Close()
+		*c = nil
+	}
+	return err
+}
+
+// do runs f on the primary, or on the standby while the primary is down. A request that fails and
+// marks the primary down is run again on the standby. For writes, key is the key written, which is
+// remembered when the standby takes the write.
+func (h *Handler) do(key []byte, f func(handlers.Handler) error) error {
+	if !h.f.Down() {
+		err := on(&h.primary, h.f.primary, f)
+		h.f.observe(err)
+		if !failed(err) || !h.f.Down() {
+			return err
+		}
+	}
+
+	if key != nil && !h.f.record(key) {
+		// failed back since
+		err := on(&h.primary, h.f.primary, f)
+		h.f.observe(err)
+		return err
+	}
+
+	metrics.IncCounter(MetricStandbyRequests)
+	return on(&h.standby, h.f.standby, f)
+}
+
+func (h *Handler) Set(cmd common.SetRequest) error {
+	return h.do(cmd.Key, func(c handlers.Handler) error { return c.Set(cmd) })
+}
+
+func (h *Handler) Add(cmd common.SetRequest) error {
+	return h.do(cmd.Key, func(c handlers.Handler) error { return c.Add(cmd) })
+}
+
+func (h *Handler) Replace(cmd common.SetRequest) error {
+	return h.do(cmd.Key, func(c handlers.Handler) error { return c.Replace(cmd) })
+}
+
+func (h *Handler) Append(cmd common.SetRequest) error {
+	return h.do(cmd.Key, func(c handlers.Handler) error { return c.Append(cmd) })
+}
+
+func (h *Handler) Prepend(cmd common.SetRequest) error {
+	return h.do(cmd.Key, func(c handlers.Handler) error { return c.Prepend(cmd) })
+}
+
+func (h *Handler) Delete(cmd common.DeleteRequest) error {
+	return h.do(cmd.Key, func(c handlers.Handler) error { return c.Delete(cmd) })
+}
+
+func (h *Handler) Touch(cmd common.TouchRequest) error {
+	return h.do(cmd.Key, func(c handlers.Handler) error { return c.Touch(cmd) })
+}
+
+func (h *Handler) Incr(cmd common.ArithRequest) (uint64, error) {
+	var v uint64
+	err := h.do(cmd.Key, func(c handlers.Handler) error {
+		var err error
+		v, err = handlers.Incr(c, cmd)
+		return err
+	})
+	return v, err
+}
+
+func (h *Handler) Decr(cmd common.ArithRequest) (uint64, error) {
+	var v uint64
+	err := h.do(cmd.Key, func(c handlers.Handler) error {
+		var err error
+		v, err = handlers.Decr(c, cmd)
+		return err
+	})
+	return v, err
+}
+
+// Flush flushes the primary and then the standby, so a later failover doesn't serve what was there
+// before. It fails temporarily during a failover, since a flush of the standby alone would leave
+// the primary's keys to come back after failing back.
+func (h *Handler) Flush(cmd common.FlushRequest) error {
+	if h.f.Down() {
+		return common.ErrTempFailure
+	}
+
+	flush := func(c handlers.Handler) error { return handlers.Flush(c, cmd) }
+	err := on(&h.primary, h.f.primary, flush)
+	h.f.observe(err)
+	if err != nil {
+		return err
+	}
+	return on(&h.standby, h.f.standby, flush)
+}
+
+func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	var res common.GetResponse
+	err := h.do(cmd.Key, func(c handlers.Handler) error {
+		var err error
+		res, err = c.GAT(cmd)
+		return err
+	})
+	return res, err
+}
+
+func (h *Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	dataOut := make(chan common.GetResponse, len(cmd.Keys))
+	errorOut := make(chan error, 1)
+
+	go func() {
+		defer close(dataOut)
+		defer close(errorOut)
+
+		// Responses are collected before any are sent so a primary that fails partway through can
+		// be retried on the standby without sending any key twice
+		var res []common.GetResponse
+		err := h.do(nil, func(c handlers.Handler) error {
+			res = res[:0]
+			resChan, errChan := c.Get(cmd)
+			return handlers.DrainGet(resChan, errChan, func(r common.GetResponse) error {
+				res = append(res, r)
+				return nil
+			})
+		})
+
+		for _, r := range res {
+			dataOut <- r
+		}
+		if err != nil {
+			errorOut <- err
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+func (h *Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	dataOut := make(chan common.GetEResponse, len(cmd.Keys))
+	errorOut := make(chan error, 1)
+
+	go func() {
+		defer close(dataOut)
+		defer close(errorOut)
+
+		var res []common.GetEResponse
+		err := h.do(nil, func(c handlers.Handler) error {
+			res = res[:0]
+			resChan, errChan := c.GetE(cmd)
+			return handlers.DrainGetE(resChan, errChan, func(r common.GetEResponse) error {
+				res = append(res, r)
+				return nil
+			})
+		})
+
+		for _, r := range res {
+			dataOut <- r
+		}
+		if err != nil {
+			errorOut <- err
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+func (h *Handler) Keys(prefix []byte) ([][]byte, error) {
+	var keys [][]byte
+	err := h.do(nil, func(c handlers.Handler) error {
+		var err error
+		keys, err = handlers.Keys(c, prefix)
+		return err
+	})
+	return keys, err
+}
+
+func (h *Handler) ServerTime() (time.Time, error) {
+	var t time.Time
+	err := h.do(nil, func(c handlers.Handler) error {
+		var err error
+		t, err = handlers.ServerTime(c)
+		return err
+	})
+	return t, err
+}
+
+func (h *Handler) Ping() error {
+	return h.do(nil, handlers.Ping)
+}
+
+// Close closes the connections to both backends
+func (h *Handler) Close() error {
+	var err error
+	for _, c := range []*handlers.Handler{&h.primary, &h.standby} {
+		if *c != nil {
+			if cerr := (*c).Close(); err == nil {
+				err = cerr
+			}
+			*c = nil
+		}
+	}
+	return err
+}
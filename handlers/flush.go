@@ -0,0 +1,61 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"context"
+
+	"github.com/netflix/rend/common"
+)
+
+// Flusher is implemented by handlers that can remove every key at once, like memcached's flush_all.
+type Flusher interface {
+	Flush(cmd common.FlushRequest) error
+}
+
+// FlusherV2 is the context-aware form of Flusher for HandlerV2 implementations.
+type FlusherV2 interface {
+	Flush(ctx context.Context, cmd common.FlushRequest) error
+}
+
+// Flush removes every key from h, or returns common.ErrNotSupported if h doesn't implement Flusher.
+// Deleting the keys one at a time instead wouldn't be atomic and can't reach keys that aren't
+// listed, so there is no fallback.
+func Flush(h Handler, cmd common.FlushRequest) error {
+	if f, ok := h.(Flusher); ok {
+		return f.Flush(cmd)
+	}
+	return common.ErrNotSupported
+}
+
+// FlushV2 is the HandlerV2 counterpart of Flush.
+func FlushV2(ctx context.Context, h HandlerV2, cmd common.FlushRequest) error {
+	if f, ok := h.(FlusherV2); ok {
+		return f.Flush(ctx, cmd)
+	}
+	return common.ErrNotSupported
+}
+
+func (v v2Handler) Flush(ctx context.Context, cmd common.FlushRequest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer v.interrupt(ctx)()
+	return Flush(v.h, cmd)
+}
+
+func (v v1Handler) Flush(cmd common.FlushRequest) error {
+	return FlushV2(context.Background(), v.h, cmd)
+}
@@ -0,0 +1,396 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package hedged reduces tail latency caused by occasional slow backend nodes. Reads are sent to
+// the primary backend as usual, and if they haven't finished after a short delay the same read is
+// sent to an alternate backend holding the same data, e.g. a replica. Whichever finishes first
+// without an error is used.
+//
+// Only reads are hedged. Everything else goes to the primary alone, so keeping the alternate up to
+// date is left to whatever already maintains it as a replica.
+package hedged
+
+import (
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricHedged        = metrics.AddCounter("hedge_requests", nil)
+	MetricAlternateWins = metrics.AddCounter("hedge_alternate_wins", nil)
+	MetricAbandoned     = metrics.AddCounter("hedge_abandoned_conns", nil)
+	MetricErrors        = metrics.AddCounter("hedge_errors", nil)
+)
+
+// backend is one side of the hedge. A read that lost the race may still be running on the
+// connection, and since a connection can't take another request until the last one is done, the
+// connection is replaced instead of waiting on what is likely a slow node.
+type backend struct {
+	hc   handlers.HandlerConst
+	h    handlers.Handler
+	busy chan struct{}
+}
+
+func (b *backend) get() (handlers.Handler, error) {
+	if b.busy != nil {
+		select {
+		case <-b.busy:
+		default:
+			metrics.IncCounter(MetricAbandoned)
+			b.h.Close()
+			b.h = nil
+		}
+		b.busy = nil
+	}
+
+	if b.h == nil {
+		h, err := b.hc()
+		if err != nil {
+			return nil, err
+		}
+		b.h = h
+	}
+
+	return b.h, nil
+}
+
+func (b *backend) close() error {
+	if b.h == nil {
+		return nil
+	}
+	return b.h.Close()
+}
+
+// New returns a constructor for handlers that hedge reads against the alternate after delay. Each
+// handler connects to the alternate the first time it hedges.
+func New(primary, alternate handlers.HandlerConst, delay time.Duration) handlers.HandlerConst {
+	return func() (handlers.Handler, error) {
+		p, err := primary()
+		if err != nil {
+			return nil, err
+		}
+
+		return &Handler{
+			primary:   &backend{hc: primary, h: p},
+			alternate: &backend{hc: alternate},
+			delay:     delay,
+		}, nil
+	}
+}
+
+// Handler hedges Get and GetE and sends everything else to the primary
+type Handler struct {
+	primary   *backend
+	alternate *backend
+	delay     time.Duration
+}
+
+func (h *Handler) Set(cmd common.SetRequest) error {
+	p, err := h.primary.get()
+	if err != nil {
+		return err
+	}
+	return p.Set(cmd)
+}
+
+func (h *Handler) Add(cmd common.SetRequest) error {
+	p, err := h.primary.get()
+	if err != nil {
+		return err
+	}
+	return p.Add(cmd)
+}
+
+func (h *Handler) Replace(cmd common.SetRequest) error {
+	p, err := h.primary.get()
+	if err != nil {
+		return err
+	}
+	return p.Replace(cmd)
+}
+
+func (h *Handler) Append(cmd common.SetRequest) error {
+	p, err := h.primary.get()
+	if err != nil {
+		return err
+	}
+	return p.Append(cmd)
+}
+
+func (h *Handler) Prepend(cmd common.SetRequest) error {
+	p, err := h.primary.get()
+	if err != nil {
+		return err
+	}
+	return p.Prepend(cmd)
+}
+
+func (h *Handler) Delete(cmd common.DeleteRequest) error {
+	p, err := h.primary.get()
+	if err != nil {
+		return err
+	}
+	return p.Delete(cmd)
+}
+
+func (h *Handler) Touch(cmd common.TouchRequest) error {
+	p, err := h.primary.get()
+	if err != nil {
+		return err
+	}
+	return p.Touch(cmd)
+}
+
+func (h *Handler) Incr(cmd common.ArithRequest) (uint64, error) {
+	p, err := h.primary.get()
+	if err != nil {
+		return 0, err
+	}
+	return handlers.Incr(p, cmd)
+}
+
+func (h *Handler) Decr(cmd common.ArithRequest) (uint64, error) {
+	p, err := h.primary.get()
+	if err != nil {
+		return 0, err
+	}
+	return handlers.Decr(p, cmd)
+}
+
+// Flushes are writes like deletes, so they go to the primary
+func (h *Handler) Flush(cmd common.FlushRequest) error {
+	p, err := h.primary.get()
+	if err != nil {
+		return err
+	}
+	return handlers.Flush(p, cmd)
+}
+
+// Locks are writes, so they go to the primary
+func (h *Handler) GetLock(cmd common.GetLockRequest) (common.GetLockResponse, error) {
+	p, err := h.primary.get()
+	if err != nil {
+		return common.GetLockResponse{}, err
+	}
+	return handlers.GetLock(p, cmd)
+}
+
+func (h *Handler) Unlock(cmd common.UnlockRequest) error {
+	p, err := h.primary.get()
+	if err != nil {
+		return err
+	}
+	return handlers.Unlock(p, cmd)
+}
+
+// Keys lists the primary's keys, since that's where writes and deletes go
+func (h *Handler) Keys(prefix []byte) ([][]byte, error) {
+	p, err := h.primary.get()
+	if err != nil {
+		return nil, err
+	}
+	return handlers.Keys(p, prefix)
+}
+
+func (h *Handler) ServerTime() (time.Time, error) {
+	p, err := h.primary.get()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return handlers.ServerTime(p)
+}
+
+func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	p, err := h.primary.get()
+	if err != nil {
+		return common.GetResponse{}, err
+	}
+	return p.GAT(cmd)
+}
+
+func (h *Handler) Close() error {
+	err := h.primary.close()
+	if aerr := h.alternate.close(); err == nil {
+		err = aerr
+	}
+	return err
+}
+
+// hedge runs read against the primary, and against the alternate too if the primary takes longer
+// than the delay, and returns the first result without an error. read must collect the whole
+// response before returning it.
+func (h *Handler) hedge(read func(handlers.Handler) (interface{}, error)) (interface{}, error) {
+	type result struct {
+		res interface{}
+		err error
+	}
+
+	start := func(b *backend) (chan result, error) {
+		hd, err := b.get()
+		if err != nil {
+			return nil, err
+		}
+
+		done := make(chan result, 1)
+		busy := make(chan struct{})
+		b.busy = busy
+
+		go func() {
+			res, err := read(hd)
+			// The connection is free again before anyone hears about the result, so a
+			// finished read is never mistaken for one still in flight
+			close(busy)
+			done <- result{res, err}
+		}()
+
+		return done, nil
+	}
+
+	pdone, err := start(h.primary)
+	if err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(h.delay)
+	select {
+	case r := <-pdone:
+		timer.Stop()
+		return r.res, r.err
+	case <-timer.C:
+	}
+
+	metrics.IncCounter(MetricHedged)
+
+	adone, err := start(h.alternate)
+	if err != nil {
+		metrics.IncCounter(MetricErrors)
+		r := <-pdone
+		return r.res, r.err
+	}
+
+	// If the first to finish failed, give the other one a chance
+	var first result
+	select {
+	case first = <-pdone:
+		if first.err == nil {
+			return first.res, nil
+		}
+		metrics.IncCounter(MetricErrors)
+		r := <-adone
+		if r.err == nil {
+			metrics.IncCounter(MetricAlternateWins)
+		}
+		return r.res, r.err
+
+	case first = <-adone:
+		if first.err == nil {
+			metrics.IncCounter(MetricAlternateWins)
+			return first.res, nil
+		}
+		metrics.IncCounter(MetricErrors)
+		r := <-pdone
+		return r.res, r.err
+	}
+}
+
+func (h *Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	dataOut := make(chan common.GetResponse, len(cmd.Keys))
+	errorOut := make(chan error, 1)
+
+	go func() {
+		defer close(dataOut)
+		defer close(errorOut)
+
+		res, err := h.hedge(func(hd handlers.Handler) (interface{}, error) {
+			var ret []common.GetResponse
+			var err error
+			resChan, errChan := hd.Get(cmd)
+			for resChan != nil || errChan != nil {
+				select {
+				case r, ok := <-resChan:
+					if !ok {
+						resChan = nil
+					} else {
+						ret = append(ret, r)
+					}
+				case e, ok := <-errChan:
+					if !ok {
+						errChan = nil
+					} else {
+						err = e
+					}
+				}
+			}
+			return ret, err
+		})
+
+		if err != nil {
+			errorOut <- err
+			return
+		}
+
+		for _, r := range res.([]common.GetResponse) {
+			dataOut <- r
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+func (h *Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	dataOut := make(chan common.GetEResponse, len(cmd.Keys))
+	errorOut := make(chan error, 1)
+
+	go func() {
+		defer close(dataOut)
+		defer close(errorOut)
+
+		res, err := h.hedge(func(hd handlers.Handler) (interface{}, error) {
+			var ret []common.GetEResponse
+			var err error
+			resChan, errChan := hd.GetE(cmd)
+			for resChan != nil || errChan != nil {
+				select {
+				case r, ok := <-resChan:
+					if !ok {
+						resChan = nil
+					} else {
+						ret = append(ret, r)
+					}
+				case e, ok := <-errChan:
+					if !ok {
+						errChan = nil
+					} else {
+						err = e
+					}
+				}
+			}
+			return ret, err
+		})
+
+		if err != nil {
+			errorOut <- err
+			return
+		}
+
+		for _, r := range res.([]common.GetEResponse) {
+			dataOut <- r
+		}
+	}()
+
+	return dataOut, errorOut
+}
@@ -0,0 +1,147 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hedged_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/hedged"
+)
+
+// slowHandler answers every get with its name after a delay
+type slowHandler struct {
+	handlers.Handler
+	name   string
+	delay  time.Duration
+	closed *int
+}
+
+func (s slowHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	resChan := make(chan common.GetResponse)
+	errChan := make(chan error)
+	go func() {
+		time.Sleep(s.delay)
+		for i, k := range cmd.Keys {
+			resChan <- common.GetResponse{Key: k, Data: []byte(s.name), Opaque: cmd.Opaques[i]}
+		}
+		close(resChan)
+		close(errChan)
+	}()
+	return resChan, errChan
+}
+
+func (s slowHandler) Set(cmd common.SetRequest) error { return nil }
+
+func (s slowHandler) Close() error {
+	*s.closed++
+	return nil
+}
+
+func constOf(h handlers.Handler) handlers.HandlerConst {
+	return func() (handlers.Handler, error) { return h, nil }
+}
+
+func get(t *testing.T, h handlers.Handler) string {
+	resChan, errChan := h.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte("foo")},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+	var data string
+	for res := range resChan {
+		data = string(res.Data)
+	}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestHedged(t *testing.T) {
+	var pclosed, aclosed int
+
+	t.Run("FastPrimary", func(t *testing.T) {
+		p := slowHandler{name: "primary", closed: &pclosed}
+		a := slowHandler{name: "alternate", closed: &aclosed}
+		h, _ := hedged.New(constOf(p), constOf(a), 50*time.Millisecond)()
+
+		if got := get(t, h); got != "primary" {
+			t.Fatalf("Expected a fast primary to answer, got %s", got)
+		}
+		if got := get(t, h); got != "primary" || pclosed != 0 {
+			t.Fatalf("Expected the primary connection to be reused, got %s and %d closes", got, pclosed)
+		}
+	})
+
+	t.Run("SlowPrimary", func(t *testing.T) {
+		p := slowHandler{name: "primary", delay: 200 * time.Millisecond, closed: &pclosed}
+		a := slowHandler{name: "alternate", closed: &aclosed}
+		h, _ := hedged.New(constOf(p), constOf(a), time.Millisecond)()
+
+		if got := get(t, h); got != "alternate" {
+			t.Fatalf("Expected the hedge to answer for a slow primary, got %s", got)
+		}
+
+		// The primary is still busy with the lost read, so its connection is replaced
+		h.Set(common.SetRequest{})
+		if pclosed != 1 {
+			t.Fatalf("Expected the busy primary connection to be closed, got %d closes", pclosed)
+		}
+	})
+}
+
+// counter counts the flushes and increments sent to it
+type counter struct {
+	slowHandler
+	flushes, incrs *int
+}
+
+func (c counter) Flush(cmd common.FlushRequest) error {
+	*c.flushes++
+	return nil
+}
+
+func (c counter) Incr(cmd common.ArithRequest) (uint64, error) {
+	*c.incrs++
+	return uint64(*c.incrs), nil
+}
+
+func (c counter) Decr(cmd common.ArithRequest) (uint64, error) {
+	*c.incrs--
+	return uint64(*c.incrs), nil
+}
+
+func TestWrites(t *testing.T) {
+	var closed, pflushes, pincrs, aflushes, aincrs int
+	p := counter{slowHandler{name: "primary", closed: &closed}, &pflushes, &pincrs}
+	a := counter{slowHandler{name: "alternate", closed: &closed}, &aflushes, &aincrs}
+	h, _ := hedged.New(constOf(p), constOf(a), time.Millisecond)()
+
+	if v, err := handlers.Incr(h, common.ArithRequest{Key: []byte("foo"), Delta: 1}); err != nil || v != 1 {
+		t.Fatalf("Expected the primary to increment, got %d and %v", v, err)
+	}
+	if v, err := handlers.Decr(h, common.ArithRequest{Key: []byte("foo"), Delta: 1}); err != nil || v != 0 {
+		t.Fatalf("Expected the primary to decrement, got %d and %v", v, err)
+	}
+	if err := handlers.Flush(h, common.FlushRequest{}); err != nil || pflushes != 1 {
+		t.Fatalf("Expected the primary to be flushed, got %v and %d flushes", err, pflushes)
+	}
+	if aflushes != 0 || aincrs != 0 {
+		t.Fatal("Expected writes to stay off the alternate")
+	}
+}
@@ -0,0 +1,357 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inmem
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+// Policy decides which entry is evicted when the in-memory store is over its limits. The store
+// tells it about every key that's added, read, or removed, and asks it for a victim until it's
+// back under its limits. Calls are serialized by the store, so implementations don't need locks of
+// their own.
+type Policy interface {
+	// Add is called when a key that wasn't in the store is stored
+	Add(key string)
+	// Access is called when a key in the store is read or written
+	Access(key string)
+	// Remove is called when a key leaves the store for any reason other than being evicted
+	Remove(key string)
+	// Evict removes a key from the policy and returns it to be evicted from the store. It returns
+	// false when there is nothing left to evict.
+	Evict() (string, bool)
+}
+
+// PolicyFactory creates a Policy from a configuration string, which is empty if none was given
+type PolicyFactory func(conf string) (Policy, error)
+
+var (
+	policies     = make(map[string]PolicyFactory)
+	policiesLock = new(sync.RWMutex)
+)
+
+func init() {
+	RegisterPolicy("fifo", func(string) (Policy, error) { return newListPolicy(false), nil })
+	RegisterPolicy("lru", func(string) (Policy, error) { return newListPolicy(true), nil })
+	RegisterPolicy("lfu", func(string) (Policy, error) { return newLFU(), nil })
+	RegisterPolicy("arc", func(string) (Policy, error) { return newARC(), nil })
+}
+
+// RegisterPolicy makes an eviction policy available by name, like handlers.Register does for
+// handlers. Registering the same name twice panics.
+func RegisterPolicy(name string, f PolicyFactory) {
+	policiesLock.Lock()
+	defer policiesLock.Unlock()
+
+	if f == nil {
+		panic("inmem: RegisterPolicy factory is nil for " + name)
+	}
+	if _, dup := policies[name]; dup {
+		panic("inmem: RegisterPolicy called twice for " + name)
+	}
+
+	policies[name] = f
+}
+
+// Policies returns the sorted names of all registered eviction policies
+func Policies() []string {
+	policiesLock.RLock()
+	defer policiesLock.RUnlock()
+
+	names := make([]string, 0, len(policies))
+	for name := range policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// PolicyFromConfig resolves a configuration string of the form "name" or "name:conf" to a Policy
+func PolicyFromConfig(spec string) (Policy, error) {
+	name, conf := handlers.SplitSpec(spec)
+
+	policiesLock.RLock()
+	f, ok := policies[name]
+	policiesLock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("Unknown eviction policy %q. Registered policies: %s", name, strings.Join(Policies(), ", "))
+	}
+
+	return f(conf)
+}
+
+// Config says how the in-memory store is laid out and reclaims memory. Past either size limit,
+// entries are evicted as chosen by the policy, and with neither, nothing is evicted. Expired entries
+// are reclaimed when they're next used unless ReclaimRate is set.
+type Config struct {
+	// MaxBytes is the most memory entries can use, counting their keys, values, and a fixed
+	// overhead per entry. 0 is unlimited.
+	MaxBytes int64
+	// MaxItems is the most entries there can be. 0 is unlimited.
+	MaxItems int
+	// Policy is the eviction policy, as a configuration for PolicyFromConfig. Empty is "lru".
+	Policy string
+	// ReclaimRate is the most expired entries reclaimed per second as they expire, see wheel. 0
+	// leaves them until they're next used.
+	ReclaimRate int
+	// OnExpire, if set, is called with the key of every entry reclaimed as it expires. Entries
+	// found expired when they're next used are removed without it.
+	OnExpire func(key []byte)
+	// Shards is how many parts the store is split into by key hash, each with its own lock. 0
+	// keeps DefaultShards.
+	Shards int
+	// OffHeapBytes is the size of the memory outside the Go heap that large values are kept in,
+	// see offHeap. 0 keeps every value on the heap.
+	OffHeapBytes int64
+	// OffHeapMinSize is the smallest value kept off the heap
+	OffHeapMinSize int
+}
+
+// the rough per entry cost of the map and the entry itself, beyond the key and value
+const entryOverhead = 64
+
+// the number of recently evicted keys remembered to tell when one comes right back
+const recentEvictions = 4096
+
+// eviction is the state of a store with limits
+type eviction struct {
+	conf   Config
+	name   string
+	policy Policy
+
+	// Gets run under the read lock, so a policy's Access calls are serialized by this instead
+	lock sync.Mutex
+
+	// guarded by the shard's write lock
+	bytes      int64
+	recent     map[string]int
+	recentRing []string
+	recentPos  int
+
+	evictions    uint32
+	reinsertions uint32
+}
+
+func size(key string, e entry) int64 {
+	return int64(len(key) + len(e.data) + entryOverhead)
+}
+
+// Configure sets how the shared in-memory store is laid out and reclaims memory. It must be called
+// before the store is used, and before OpenWAL so the replayed entries are held to the limits too.
+func Configure(conf Config) error {
+	return singleton.configure(conf)
+}
+
+func (h *Handler) configure(conf Config) error {
+	if conf.Shards > 0 {
+		h.reshard(conf.Shards)
+	}
+	h.shardMetrics()
+	if conf.OffHeapBytes > 0 {
+		if int64(int(conf.OffHeapBytes)) != conf.OffHeapBytes {
+			return fmt.Errorf("Off-heap size %d is too large for this platform", conf.OffHeapBytes)
+		}
+		off, err := newOffHeap(int(conf.OffHeapBytes), conf.OffHeapMinSize)
+		if err != nil {
+			return err
+		}
+		h.off = off
+	}
+	if err := h.limit(conf); err != nil {
+		return err
+	}
+	if conf.ReclaimRate > 0 {
+		h.onExpire = conf.OnExpire
+		h.expireAt(conf.ReclaimRate)
+	}
+	return nil
+}
+
+// limit sets up eviction if there are limits. They are split evenly between the shards, each of
+// which evicts on its own.
+func (h *Handler) limit(conf Config) error {
+	if conf.MaxBytes <= 0 && conf.MaxItems <= 0 {
+		return nil
+	}
+
+	spec := conf.Policy
+	if spec == "" {
+		spec = "lru"
+	}
+	name, _ := handlers.SplitSpec(spec)
+	tags := metrics.Tags{"policy": name}
+
+	n := len(h.shards)
+	per := conf
+	per.MaxBytes = (conf.MaxBytes + int64(n) - 1) / int64(n)
+	per.MaxItems = (conf.MaxItems + n - 1) / n
+
+	policies := make([]Policy, n)
+	for i := range policies {
+		p, err := PolicyFromConfig(spec)
+		if err != nil {
+			return err
+		}
+		policies[i] = p
+	}
+
+	evictions := metrics.AddCounter("inmem_evictions", tags)
+	reinsertions := metrics.AddCounter("inmem_reinsertions", tags)
+
+	for i, s := range h.shards {
+		s.mutex.Lock()
+		s.ev = &eviction{
+			conf:         per,
+			name:         name,
+			policy:       policies[i],
+			recent:       make(map[string]int, recentEvictions/n+1),
+			recentRing:   make([]string, recentEvictions/n+1),
+			evictions:    evictions,
+			reinsertions: reinsertions,
+		}
+		for k, e := range s.data {
+			s.ev.bytes += size(k, e)
+			s.ev.policy.Add(k)
+		}
+		s.evict()
+		s.mutex.Unlock()
+	}
+
+	metrics.RegisterIntGaugeCallback("inmem_bytes", tags, func() uint64 {
+		var total int64
+		for _, s := range h.shards {
+			s.mutex.RLock()
+			total += s.ev.bytes
+			s.mutex.RUnlock()
+		}
+		return uint64(total)
+	})
+
+	return nil
+}
+
+// insert stores an entry without writing it to the WAL, evicting others if the shard is now over
+// its limits. An entry without a CAS value is a new value and gets the next one, while one that has
+// a CAS value, e.g. after a touch, keeps it. The write lock must be held.
+func (s *shard) insert(key string, e entry) {
+	if e.cas == 0 {
+		e.cas = atomic.AddUint64(&s.h.cas, 1)
+	}
+	if s.wheel != nil {
+		s.wheel.schedule(key, e.exptime)
+	}
+
+	old, ok := s.data[key]
+	// an entry written back with its own value, like by a touch, keeps the reference to it
+	if off := s.h.off; !off.owns(e.data) {
+		e.data = off.store(e.data)
+		if ok {
+			off.release(old.data)
+		}
+	}
+	s.data[key] = e
+
+	ev := s.ev
+	if ev == nil {
+		return
+	}
+
+	ev.lock.Lock()
+	if ok {
+		ev.bytes -= size(key, old)
+		ev.policy.Access(key)
+	} else {
+		if _, recent := ev.recent[key]; recent {
+			metrics.IncCounter(ev.reinsertions)
+		}
+		ev.policy.Add(key)
+	}
+	ev.lock.Unlock()
+
+	ev.bytes += size(key, e)
+	s.evict()
+}
+
+// drop removes an entry without writing it to the WAL. The write lock must be held.
+func (s *shard) drop(key string) {
+	old, ok := s.data[key]
+	if !ok {
+		return
+	}
+	delete(s.data, key)
+	s.h.off.release(old.data)
+
+	if s.wheel != nil {
+		s.wheel.remove(key)
+	}
+	if ev := s.ev; ev != nil {
+		ev.bytes -= size(key, old)
+		ev.lock.Lock()
+		ev.policy.Remove(key)
+		ev.lock.Unlock()
+	}
+}
+
+// touched tells the policy a key was used. Only the read lock needs to be held.
+func (s *shard) touched(key string) {
+	if ev := s.ev; ev != nil {
+		ev.lock.Lock()
+		ev.policy.Access(key)
+		ev.lock.Unlock()
+	}
+}
+
+// evict removes entries chosen by the policy until the shard is within its limits. The write lock
+// must be held.
+func (s *shard) evict() {
+	ev := s.ev
+
+	ev.lock.Lock()
+	defer ev.lock.Unlock()
+
+	for (ev.conf.MaxBytes > 0 && ev.bytes > ev.conf.MaxBytes) || (ev.conf.MaxItems > 0 && len(s.data) > ev.conf.MaxItems) {
+		key, ok := ev.policy.Evict()
+		if !ok {
+			return
+		}
+
+		if e, ok := s.data[key]; ok {
+			ev.bytes -= size(key, e)
+			delete(s.data, key)
+			s.h.off.release(e.data)
+			if s.wheel != nil {
+				s.wheel.remove(key)
+			}
+		}
+		metrics.IncCounter(ev.evictions)
+
+		// a key evicted again is only forgotten once its latest eviction is
+		if old := ev.recentRing[ev.recentPos]; ev.recent[old] == ev.recentPos {
+			delete(ev.recent, old)
+		}
+		ev.recentRing[ev.recentPos] = key
+		ev.recent[key] = ev.recentPos
+		ev.recentPos = (ev.recentPos + 1) % len(ev.recentRing)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inmem
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/netflix/rend/common"
+)
+
+func has(h *Handler, key string) bool {
+	_, ok := contents(h)[key]
+	return ok
+}
+
+func read(h *Handler, key string) {
+	resChan, _ := h.Get(common.GetRequest{Keys: [][]byte{[]byte(key)}, Opaques: []uint32{0}, Quiet: []bool{false}})
+	for range resChan {
+	}
+}
+
+func set(h *Handler, key string) {
+	h.Set(common.SetRequest{Key: []byte(key), Data: []byte("value")})
+}
+
+func TestEviction(t *testing.T) {
+	limited := func(t *testing.T, policy string, conf Config) *Handler {
+		t.Helper()
+		h := newHandler(1)
+		conf.Policy = policy
+		if err := h.configure(conf); err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	for _, tc := range []struct {
+		policy  string
+		evicted string
+	}{
+		// a is read, b is read twice, c isn't read, then d is added
+		{"fifo", "a"},
+		{"lru", "c"},
+		{"lfu", "c"},
+		{"arc", "c"},
+		{"slru", "c"},
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			h := limited(t, tc.policy, Config{MaxItems: 3})
+			set(h, "a")
+			set(h, "b")
+			set(h, "c")
+			read(h, "b")
+			read(h, "a")
+			read(h, "b")
+			set(h, "d")
+
+			if has(h, tc.evicted) || len(contents(h)) != 3 {
+				t.Fatalf("Expected %s to be evicted, got %v", tc.evicted, contents(h))
+			}
+		})
+	}
+
+	for _, policy := range []string{"arc", "slru"} {
+		t.Run("ScanResistance/"+policy, func(t *testing.T) {
+			h := limited(t, policy, Config{MaxItems: 10})
+			for i := 0; i < 10; i++ {
+				set(h, fmt.Sprint("fill", i))
+			}
+			for _, key := range []string{"hot1", "hot2"} {
+				set(h, key)
+				read(h, key)
+				read(h, key)
+			}
+			for i := 0; i < 100; i++ {
+				set(h, fmt.Sprint("scan", i))
+			}
+			if !has(h, "hot1") || !has(h, "hot2") {
+				t.Fatalf("Expected the keys read again to survive a scan, got %v", contents(h))
+			}
+		})
+	}
+
+	t.Run("MaxBytes", func(t *testing.T) {
+		h := limited(t, "", Config{MaxBytes: 10 * (entryOverhead + 10)})
+		for i := 0; i < 100; i++ {
+			set(h, fmt.Sprint("key", i))
+		}
+		if n := len(contents(h)); n == 0 || n > 10 {
+			t.Fatalf("Expected at most 10 entries left, got %d", n)
+		}
+		if h.shards[0].ev.bytes > h.shards[0].ev.conf.MaxBytes {
+			t.Fatalf("Expected at most %d bytes, got %d", h.shards[0].ev.conf.MaxBytes, h.shards[0].ev.bytes)
+		}
+
+		for i := 0; i < 100; i++ {
+			h.Delete(common.DeleteRequest{Key: []byte(fmt.Sprint("key", i))})
+		}
+		if h.shards[0].ev.bytes != 0 {
+			t.Fatalf("Expected no bytes used once everything is deleted, got %d", h.shards[0].ev.bytes)
+		}
+	})
+
+	for _, policy := range []string{"random", "slru:hot=60&warm=40", "slru:cold=10"} {
+		if err := newHandler(1).configure(Config{MaxItems: 1, Policy: policy}); err == nil {
+			t.Fatalf("Expected policy %s to be an error", policy)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inmem
+
+import (
+	"time"
+
+	"github.com/netflix/rend/clock"
+	"github.com/netflix/rend/metrics"
+)
+
+var MetricReclaimed = metrics.AddCounter("inmem_expired_reclaimed", nil)
+
+// The wheel has a level of one second slots and levels above it whose slots each span a whole
+// turn of the level below
+const (
+	wheelLevels = 4
+	level0Bits  = 8
+	levelBits   = 6
+)
+
+// keys reclaimed per hold of the lock, so reclaiming doesn't hold up requests for long
+const reclaimBatch = 256
+
+type wheelPos struct {
+	level, slot int
+}
+
+// far is the position of keys that expire after the top level's span
+var far = wheelPos{-1, 0}
+
+// wheel is a hierarchical timing wheel of the keys with an expiration time. Each second the
+// cursor moves one slot along the bottom level and the keys in that slot are due. Keys expiring
+// further out are in a higher level, in slots that each cover a whole turn of the level below;
+// when the cursor gets to the start of such a slot, its keys are spread over the levels below.
+// That makes scheduling and each second's step constant time no matter how far out keys expire.
+// Each shard has its own, guarded by the shard's write lock.
+type wheel struct {
+	now    uint32
+	levels [wheelLevels][]map[string]struct{}
+	far    map[string]struct{}
+	where  map[string]wheelPos
+	when   map[string]uint32
+
+	// keys that are due but haven't been reclaimed yet
+	due []string
+}
+
+func newWheel(now uint32) *wheel {
+	w := &wheel{
+		now:   now,
+		far:   make(map[string]struct{}),
+		where: make(map[string]wheelPos),
+		when:  make(map[string]uint32),
+	}
+	for l := range w.levels {
+		n := 1 << levelBits
+		if l == 0 {
+			n = 1 << level0Bits
+		}
+		w.levels[l] = make([]map[string]struct{}, n)
+		for i := range w.levels[l] {
+			w.levels[l][i] = make(map[string]struct{})
+		}
+	}
+	return w
+}
+
+// shift is log2 of the seconds each slot of a level spans
+func shift(level int) uint {
+	if level == 0 {
+		return 0
+	}
+	return uint(level0Bits + levelBits*(level-1))
+}
+
+// schedule puts key in the slot for its expiration time, or takes it out if it doesn't expire
+func (w *wheel) schedule(key string, deadline uint32) {
+	w.remove(key)
+	if deadline == 0 {
+		return
+	}
+
+	// Entries expire the second after their deadline, and ones that already have are due next
+	at := uint64(deadline) + 1
+	if at <= uint64(w.now) {
+		at = uint64(w.now) + 1
+	}
+
+	delta := at - uint64(w.now)
+	for l := range w.levels {
+		span := uint64(len(w.levels[l])) << shift(l)
+		if delta < span {
+			slot := int(at>>shift(l)) & (len(w.levels[l]) - 1)
+			w.levels[l][slot][key] = struct{}{}
+			w.where[key] = wheelPos{l, slot}
+			w.when[key] = deadline
+			return
+		}
+	}
+
+	w.far[key] = struct{}{}
+	w.where[key] = far
+	w.when[key] = deadline
+}
+
+func (w *wheel) remove(key string) {
+	pos, ok := w.where[key]
+	if !ok {
+		return
+	}
+	if pos == far {
+		delete(w.far, key)
+	} else {
+		delete(w.levels[pos.level][pos.slot], key)
+	}
+	delete(w.where, key)
+	delete(w.when, key)
+}
+
+// advance moves the cursor up to now, adding the keys that came due to w.due
+func (w *wheel) advance(now uint32) {
+	for w.now < now {
+		w.now++
+
+		// Cascade from the top down, so keys move as many levels as they need to
+		for l := wheelLevels - 1; l > 0; l-- {
+			if w.now&(1<<shift(l)-1) != 0 {
+				continue
+			}
+			slot := int(w.now>>shift(l)) & (len(w.levels[l]) - 1)
+			if l == wheelLevels-1 && slot == 0 {
+				w.cascade(w.far)
+			}
+			w.cascade(w.levels[l][slot])
+		}
+
+		slot := int(w.now) & (len(w.levels[0]) - 1)
+		for key := range w.levels[0][slot] {
+			w.due = append(w.due, key)
+			delete(w.levels[0][slot], key)
+			delete(w.where, key)
+			delete(w.when, key)
+		}
+	}
+}
+
+// cascade reschedules the keys in a slot, which now fit in a lower level
+func (w *wheel) cascade(slot map[string]struct{}) {
+	keys := make([]string, 0, len(slot))
+	for key := range slot {
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		w.schedule(key, w.when[key])
+	}
+}
+
+// expireAt starts reclaiming expired entries, at most rate of them a second
+func (h *Handler) expireAt(rate int) {
+	now := clock.Unix()
+	for _, s := range h.shards {
+		s.mutex.Lock()
+		s.wheel = newWheel(now)
+		for k, e := range s.data {
+			s.wheel.schedule(k, e.exptime)
+		}
+		s.mutex.Unlock()
+	}
+
+	metrics.RegisterIntGaugeCallback("inmem_expiry_scheduled", nil, func() uint64 {
+		var n int
+		for _, s := range h.shards {
+			s.mutex.RLock()
+			n += len(s.wheel.where)
+			s.mutex.RUnlock()
+		}
+		return uint64(n)
+	})
+	metrics.RegisterIntGaugeCallback("inmem_expiry_pending", nil, func() uint64 {
+		var n int
+		for _, s := range h.shards {
+			s.mutex.RLock()
+			n += len(s.wheel.due)
+			s.mutex.RUnlock()
+		}
+		return uint64(n)
+	})
+
+	go func() {
+		for range time.Tick(time.Second) {
+			h.reclaim(rate)
+		}
+	}()
+}
+
+// reclaim moves the wheels up to now and removes up to rate of the entries that are due, split
+// evenly between the shards. The rest wait for the next second.
+func (h *Handler) reclaim(rate int) {
+	per := (rate + len(h.shards) - 1) / len(h.shards)
+	for _, s := range h.shards {
+		s.reclaim(per, h.onExpire)
+	}
+}
+
+// reclaim removes up to rate due entries from the shard, calling onExpire, if it's set, with each
+// reclaimed key once the lock is released
+func (s *shard) reclaim(rate int, onExpire func(key []byte)) {
+	s.lock()
+	s.wheel.advance(clock.Unix())
+	s.mutex.Unlock()
+
+	for reclaimed := 0; reclaimed < rate; {
+		s.lock()
+		w := s.wheel
+		n := min(min(len(w.due), rate-reclaimed), reclaimBatch)
+		if n == 0 {
+			s.mutex.Unlock()
+			return
+		}
+
+		var expired []string
+		for _, key := range w.due[:n] {
+			// a key written since it came due has been scheduled again
+			if e, ok := s.data[key]; ok && e.isExpired() {
+				s.drop(key)
+				metrics.IncCounter(MetricReclaimed)
+				if onExpire != nil {
+					expired = append(expired, key)
+				}
+			}
+		}
+		w.due = w.due[n:]
+		reclaimed += n
+		s.mutex.Unlock()
+
+		for _, key := range expired {
+			onExpire([]byte(key))
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inmem
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/clock"
+	"github.com/netflix/rend/common"
+)
+
+func TestWheel(t *testing.T) {
+	const start = 1<<26 - 1000
+	w := newWheel(start)
+
+	deadlines := map[string]uint32{"never": 0, "past": start - 10}
+	for _, d := range []uint32{0, 1, 5, 254, 255, 256, 300, 16383, 16384, 70000, 1<<20 + 3, 1<<26 + 10} {
+		deadlines[fmt.Sprint("in", d)] = start + d
+	}
+	for key, d := range deadlines {
+		w.schedule(key, d)
+	}
+
+	// Rescheduling moves a key, and a key without an expiration isn't scheduled
+	w.schedule("in300", start+400)
+	deadlines["in300"] = start + 400
+	w.schedule("in5", 0)
+	delete(deadlines, "in5")
+
+	// Going all the way to the far key would take too long, but it should be in the top level once
+	// the far keys cascade at the start of its next turn
+	farKey := fmt.Sprint("in", 1<<26+10)
+	delete(deadlines, farKey)
+	if w.where[farKey] != far {
+		t.Fatalf("Expected %s to be far out, got %v", farKey, w.where[farKey])
+	}
+
+	for now := uint32(start + 1); now <= start+1<<20+20; now++ {
+		w.advance(now)
+		for _, key := range w.due {
+			d, ok := deadlines[key]
+			if !ok {
+				t.Fatalf("%s came due at %d but isn't scheduled", key, now)
+			}
+			if expected := d + 1; d < start && now != start+1 || d >= start && now != expected {
+				t.Fatalf("%s with deadline %d came due at %d", key, d, now)
+			}
+			delete(deadlines, key)
+		}
+		w.due = w.due[:0]
+	}
+
+	if pos := w.where[farKey]; pos.level != wheelLevels-1 {
+		t.Fatalf("Expected %s to have moved to the top level, got %v", farKey, pos)
+	}
+
+	delete(deadlines, "never")
+	if len(deadlines) != 0 {
+		t.Fatalf("Expected every key to come due, left %v", deadlines)
+	}
+}
+
+type fakeClock struct {
+	now int64
+}
+
+func (f *fakeClock) Now() time.Time {
+	return time.Unix(atomic.LoadInt64(&f.now), 0)
+}
+
+func TestReclaim(t *testing.T) {
+	fake := &fakeClock{now: time.Now().Unix()}
+	clock.Set(fake)
+	defer clock.Set(clock.Monotonic())
+
+	var expired []string
+	onExpire := func(key []byte) { expired = append(expired, string(key)) }
+
+	h := newHandler(1)
+	if err := h.configure(Config{MaxItems: 100, ReclaimRate: 5, OnExpire: onExpire}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		h.Set(common.SetRequest{Key: []byte(fmt.Sprint("short", i)), Data: []byte("value"), Exptime: 10})
+	}
+	h.Set(common.SetRequest{Key: []byte("long"), Data: []byte("value"), Exptime: 1000})
+	h.Set(common.SetRequest{Key: []byte("forever"), Data: []byte("value")})
+
+	stored := func() int {
+		s := h.shards[0]
+		s.mutex.RLock()
+		defer s.mutex.RUnlock()
+		return len(s.data)
+	}
+
+	atomic.AddInt64(&fake.now, 11)
+	h.reclaim(5)
+	if n := stored(); n != 7 {
+		t.Fatalf("Expected 5 of the expired entries reclaimed, %d entries left", n)
+	}
+	if len(expired) != 5 {
+		t.Fatalf("Expected OnExpire called for each reclaimed entry, got %v", expired)
+	}
+	h.reclaim(5)
+	if n := stored(); n != 2 {
+		t.Fatalf("Expected the rest reclaimed on the next pass, %d entries left", n)
+	}
+	value := entry{data: []byte("value")}
+	if h.shards[0].ev.bytes != size("long", value)+size("forever", value) {
+		t.Fatalf("Expected the reclaimed entries to be taken out of the size, got %d", h.shards[0].ev.bytes)
+	}
+
+	atomic.AddInt64(&fake.now, 1000)
+	h.reclaim(5)
+	if n := stored(); n != 1 || !has(h, "forever") {
+		t.Fatalf("Expected only the entry without an expiration left, got %v", contents(h))
+	}
+	if len(expired) != 11 || expired[10] != "long" {
+		t.Fatalf("Expected OnExpire called for every expired entry, got %v", expired)
+	}
+}
@@ -15,9 +15,15 @@
 package inmem
 
 import (
+	"bytes"
+	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"strconv"
+
+	"github.com/netflix/rend/clock"
 	"github.com/netflix/rend/common"
 	"github.com/netflix/rend/handlers"
 )
@@ -26,20 +32,88 @@ type entry struct {
 	exptime uint32
 	flags   uint32
 	data    []byte
+	// unique for every value the store has held, see insert
+	cas uint64
 }
 
 func (e entry) isExpired() bool {
-	return e.exptime != 0 && e.exptime < uint32(time.Now().Unix())
+	return clock.Expired(e.exptime)
 }
 
+// lock is a lock taken with GetLock. Locks are kept apart from the data, so they aren't affected by
+// writes or deletes of the key, the same as the locks the handlers package emulates for backends
+// without their own.
+type lock struct {
+	token   uint64
+	exptime uint32
+}
+
+const maxLocks = 1024
+
+// DefaultShards is how many shards the store is split into unless configured otherwise
+const DefaultShards = 16
+
+// MaxShards is the most shards the store can be split into
+const MaxShards = 1024
+
+// Handler is the in-memory store. Keys are spread over shards by their hash, each with its own
+// map and lock, so requests for different keys rarely wait on each other.
 type Handler struct {
+	// the last CAS value given out, first to keep it 64-bit aligned for atomic access
+	cas uint64
+
+	shards []*shard
+
+	// journals every change to the shards when persistence is on, see OpenWAL
+	wal *wal
+
+	// called with the keys of entries reclaimed as they expire, see Config.OnExpire
+	onExpire func(key []byte)
+
+	// holds large values when they're kept off the heap, see Config.OffHeapBytes
+	off *offHeap
+
+	// the flush waiting for its delay to pass, if any, see Flush
+	flushMutex sync.Mutex
+	flushTimer *time.Timer
+}
+
+// shard is one part of the store. Everything in it is guarded by its mutex.
+type shard struct {
+	// how many times the lock was taken and how many of those had to wait for it, for metrics. They
+	// come first to keep them 64-bit aligned for atomic access.
+	locked, waited         uint64
+	readLocked, readWaited uint64
+
+	h     *Handler
 	data  map[string]entry
-	mutex *sync.RWMutex
+	locks map[string]lock
+	mutex sync.RWMutex
+
+	// evicts entries past the limits when there are some, see Configure
+	ev *eviction
+	// reclaims entries as they expire, when on
+	wheel *wheel
+}
+
+func newHandler(shards int) *Handler {
+	h := &Handler{shards: make([]*shard, shards)}
+	for i := range h.shards {
+		h.shards[i] = &shard{
+			h:     h,
+			data:  make(map[string]entry),
+			locks: make(map[string]lock),
+		}
+	}
+	return h
 }
 
-var singleton = &Handler{
-	data:  make(map[string]entry),
-	mutex: new(sync.RWMutex),
+var singleton = newHandler(DefaultShards)
+
+func init() {
+	handlers.Register("inmem", func(conf string) (handlers.HandlerConst, error) {
+		return New, nil
+	})
 }
 
 func New() (handlers.Handler, error) {
@@ -47,201 +121,506 @@ func New() (handlers.Handler, error) {
 	return singleton, nil
 }
 
+func (h *Handler) shard(key []byte) *shard {
+	if len(h.shards) == 1 {
+		return h.shards[0]
+	}
+	return h.shards[common.ValueHash(key)%uint64(len(h.shards))]
+}
+
+// lock takes the write lock, counting whether it had to wait
+func (s *shard) lock() {
+	atomic.AddUint64(&s.locked, 1)
+	if !s.mutex.TryLock() {
+		atomic.AddUint64(&s.waited, 1)
+		s.mutex.Lock()
+	}
+}
+
+// rlock takes the read lock, counting whether it had to wait
+func (s *shard) rlock() {
+	atomic.AddUint64(&s.readLocked, 1)
+	if !s.mutex.TryRLock() {
+		atomic.AddUint64(&s.readWaited, 1)
+		s.mutex.RLock()
+	}
+}
+
+// lockAll takes the write lock of every shard, for changes to the whole store
+func (h *Handler) lockAll() {
+	for _, s := range h.shards {
+		s.mutex.Lock()
+	}
+}
+
+func (h *Handler) unlockAll() {
+	for _, s := range h.shards {
+		s.mutex.Unlock()
+	}
+}
+
+// lookup finds an entry that hasn't expired. One that has is removed. The value of one that's found
+// must be released once it's no longer used, see offHeap.
+func (s *shard) lookup(key []byte) (entry, bool) {
+	s.rlock()
+	e, ok := s.data[string(key)]
+	expired := ok && e.isExpired()
+	if ok && !expired {
+		s.touched(string(key))
+		s.h.off.retain(e.data)
+	}
+	s.mutex.RUnlock()
+
+	if expired {
+		s.lock()
+		// it could have been written again in the meantime
+		if e, ok := s.data[string(key)]; ok && e.isExpired() {
+			s.drop(string(key))
+		}
+		s.mutex.Unlock()
+	}
+
+	return e, ok && !expired
+}
+
 func (h *Handler) Set(cmd common.SetRequest) error {
-	h.mutex.Lock()
+	return h.shard(cmd.Key).Set(cmd)
+}
+
+func (h *Handler) Add(cmd common.SetRequest) error {
+	return h.shard(cmd.Key).Add(cmd)
+}
+
+func (h *Handler) Replace(cmd common.SetRequest) error {
+	return h.shard(cmd.Key).Replace(cmd)
+}
+
+func (h *Handler) SetIfMatch(cmd common.SetIfMatchRequest) error {
+	return h.shard(cmd.Key).SetIfMatch(cmd)
+}
+
+func (h *Handler) CompareAndSwap(cmd common.CASRequest) error {
+	return h.shard(cmd.Key).CompareAndSwap(cmd)
+}
+
+func (h *Handler) Incr(cmd common.ArithRequest) (uint64, error) {
+	return h.shard(cmd.Key).arith(cmd, false)
+}
+
+func (h *Handler) Decr(cmd common.ArithRequest) (uint64, error) {
+	return h.shard(cmd.Key).arith(cmd, true)
+}
+
+func (h *Handler) Append(cmd common.SetRequest) error {
+	return h.shard(cmd.Key).Append(cmd)
+}
+
+func (h *Handler) Prepend(cmd common.SetRequest) error {
+	return h.shard(cmd.Key).Prepend(cmd)
+}
+
+func (h *Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	dataOut := make(chan common.GetResponse, len(cmd.Keys))
+	errorOut := make(chan error)
 
-	var exptime uint32
-	if cmd.Exptime > 0 {
-		exptime = uint32(time.Now().Unix()) + cmd.Exptime
+	h.GetEach(cmd, func(res common.GetResponse) error {
+		res.Data = h.off.copied(res.Data)
+		dataOut <- res
+		return nil
+	})
+
+	close(dataOut)
+	close(errorOut)
+	return dataOut, errorOut
+}
+
+// GetEach answers a get on the calling goroutine, see handlers.SyncGetter
+func (h *Handler) GetEach(cmd common.GetRequest, f func(common.GetResponse) error) error {
+	for idx, bk := range cmd.Keys {
+		e, ok := h.shard(bk).lookup(bk)
+
+		res := common.GetResponse{
+			Miss:   true,
+			Quiet:  cmd.Quiet[idx],
+			Opaque: cmd.Opaques[idx],
+			Key:    bk,
+		}
+		if ok {
+			res.Miss = false
+			res.Flags = e.flags
+			res.Data = e.data
+			res.Cas = e.cas
+		}
+
+		err := f(res)
+		h.off.release(res.Data)
+		if err != nil {
+			return err
+		}
 	}
 
-	h.data[string(cmd.Key)] = entry{
-		data:    cmd.Data,
-		exptime: exptime,
-		flags:   cmd.Flags,
+	return nil
+}
+
+// Gets is the same as Get, which always fills in the CAS values
+func (h *Handler) Gets(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	return h.Get(cmd)
+}
+
+func (h *Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	dataOut := make(chan common.GetEResponse, len(cmd.Keys))
+	errorOut := make(chan error)
+
+	h.GetEEach(cmd, func(res common.GetEResponse) error {
+		res.Data = h.off.copied(res.Data)
+		dataOut <- res
+		return nil
+	})
+
+	close(dataOut)
+	close(errorOut)
+	return dataOut, errorOut
+}
+
+// GetEEach answers a gete on the calling goroutine, see handlers.SyncGetter
+func (h *Handler) GetEEach(cmd common.GetRequest, f func(common.GetEResponse) error) error {
+	for idx, bk := range cmd.Keys {
+		e, ok := h.shard(bk).lookup(bk)
+
+		res := common.GetEResponse{
+			Miss:   true,
+			Quiet:  cmd.Quiet[idx],
+			Opaque: cmd.Opaques[idx],
+			Key:    bk,
+		}
+		if ok {
+			res.Miss = false
+			res.Exptime = e.exptime
+			res.Flags = e.flags
+			res.Data = e.data
+		}
+
+		err := f(res)
+		h.off.release(res.Data)
+		if err != nil {
+			return err
+		}
 	}
 
-	h.mutex.Unlock()
 	return nil
 }
 
-func (h *Handler) Add(cmd common.SetRequest) error {
-	h.mutex.Lock()
+func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	return h.shard(cmd.Key).GAT(cmd)
+}
 
-	e, ok := h.data[string(cmd.Key)]
+func (h *Handler) Delete(cmd common.DeleteRequest) error {
+	return h.shard(cmd.Key).Delete(cmd)
+}
 
-	if ok || e.isExpired() {
-		delete(h.data, string(cmd.Key))
-		h.mutex.Unlock()
-		return common.ErrKeyExists
+func (h *Handler) Touch(cmd common.TouchRequest) error {
+	return h.shard(cmd.Key).Touch(cmd)
+}
+
+func (h *Handler) GetLock(cmd common.GetLockRequest) (common.GetLockResponse, error) {
+	return h.shard(cmd.Key).GetLock(cmd)
+}
+
+func (h *Handler) Unlock(cmd common.UnlockRequest) error {
+	return h.shard(cmd.Key).Unlock(cmd)
+}
+
+// Keys scans every shard for keys starting with prefix, skipping expired entries
+func (h *Handler) Keys(prefix []byte) ([][]byte, error) {
+	var keys [][]byte
+	for _, s := range h.shards {
+		s.rlock()
+		for k, e := range s.data {
+			if !e.isExpired() && bytes.HasPrefix([]byte(k), prefix) {
+				keys = append(keys, []byte(k))
+			}
+		}
+		s.mutex.RUnlock()
+	}
+
+	return keys, nil
+}
+
+// Flush removes every entry, one shard at a time, so it isn't atomic across shards. Locks are kept
+// since they don't hold any data. Like memcached, a flush with a delay removes every entry once
+// the delay has passed, including those set in the meantime, and any flush replaces a delayed one
+// that hasn't happened yet.
+func (h *Handler) Flush(cmd common.FlushRequest) error {
+	h.flushMutex.Lock()
+	defer h.flushMutex.Unlock()
+
+	if h.flushTimer != nil {
+		h.flushTimer.Stop()
+		h.flushTimer = nil
+	}
+
+	if at, now := clock.Deadline(cmd.Delay), clock.Unix(); at > now {
+		h.flushTimer = time.AfterFunc(time.Duration(at-now)*time.Second, func() {
+			if err := h.flush(); err != nil {
+				log.Println("Error in delayed flush:", err.Error())
+			}
+		})
+		return nil
+	}
+
+	return h.flush()
+}
+
+func (h *Handler) flush() error {
+	for _, s := range h.shards {
+		if err := s.flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *shard) flush() error {
+	s.lock()
+	defer s.mutex.Unlock()
+
+	for key := range s.data {
+		if err := s.remove(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Handler) Close() error {
+	return nil
+}
+
+// put stores an entry, writing it to the WAL first if there is one. The mutex must be held.
+func (s *shard) put(key string, e entry) error {
+	if w := s.h.wal; w != nil {
+		if err := w.append(opSet, key, e); err != nil {
+			return err
+		}
 	}
+	s.insert(key, e)
+	return nil
+}
 
-	var exptime uint32
-	if cmd.Exptime > 0 {
-		exptime = uint32(time.Now().Unix()) + cmd.Exptime
+// remove deletes an entry, writing the delete to the WAL first if there is one. The mutex must be
+// held.
+func (s *shard) remove(key string) error {
+	if w := s.h.wal; w != nil {
+		if err := w.append(opDelete, key, entry{}); err != nil {
+			return err
+		}
 	}
+	s.drop(key)
+	return nil
+}
+
+func (s *shard) Set(cmd common.SetRequest) error {
+	s.lock()
 
-	h.data[string(cmd.Key)] = entry{
+	exptime := clock.Deadline(cmd.Exptime)
+
+	err := s.put(string(cmd.Key), entry{
 		data:    cmd.Data,
 		exptime: exptime,
 		flags:   cmd.Flags,
+	})
+
+	s.mutex.Unlock()
+	return err
+}
+
+func (s *shard) Add(cmd common.SetRequest) error {
+	s.lock()
+
+	// an expired entry is replaced like a missing one
+	if e, ok := s.data[string(cmd.Key)]; ok && !e.isExpired() {
+		s.mutex.Unlock()
+		return common.ErrNotAdded
 	}
 
-	h.mutex.Unlock()
-	return nil
+	exptime := clock.Deadline(cmd.Exptime)
+
+	err := s.put(string(cmd.Key), entry{
+		data:    cmd.Data,
+		exptime: exptime,
+		flags:   cmd.Flags,
+	})
+
+	s.mutex.Unlock()
+	return err
 }
 
-func (h *Handler) Replace(cmd common.SetRequest) error {
-	h.mutex.Lock()
+func (s *shard) Replace(cmd common.SetRequest) error {
+	s.lock()
 
-	e, ok := h.data[string(cmd.Key)]
+	e, ok := s.data[string(cmd.Key)]
 
 	if !ok || e.isExpired() {
-		delete(h.data, string(cmd.Key))
-		h.mutex.Unlock()
+		s.drop(string(cmd.Key))
+		s.mutex.Unlock()
 		return common.ErrKeyNotFound
 	}
 
-	var exptime uint32
-	if cmd.Exptime > 0 {
-		exptime = uint32(time.Now().Unix()) + cmd.Exptime
-	}
+	exptime := clock.Deadline(cmd.Exptime)
 
-	h.data[string(cmd.Key)] = entry{
+	err := s.put(string(cmd.Key), entry{
 		data:    cmd.Data,
 		exptime: exptime,
 		flags:   cmd.Flags,
-	}
+	})
 
-	h.mutex.Unlock()
-	return nil
+	s.mutex.Unlock()
+	return err
 }
 
-func (h *Handler) Append(cmd common.SetRequest) error {
-	h.mutex.Lock()
+// SetIfMatch performs the check and the set together while holding the lock, so there is no window
+// for a concurrent change.
+func (s *shard) SetIfMatch(cmd common.SetIfMatchRequest) error {
+	s.lock()
 
-	e, ok := h.data[string(cmd.Key)]
+	e, ok := s.data[string(cmd.Key)]
 
 	if !ok || e.isExpired() {
-		delete(h.data, string(cmd.Key))
-		h.mutex.Unlock()
+		s.drop(string(cmd.Key))
+		s.mutex.Unlock()
 		return common.ErrKeyNotFound
 	}
 
-	h.data[string(cmd.Key)] = entry{
-		data:    append(e.data, cmd.Data...),
-		exptime: e.exptime,
-		flags:   e.flags,
+	if !cmd.Matches(e.data) {
+		s.mutex.Unlock()
+		return common.ErrKeyExists
 	}
 
-	h.mutex.Unlock()
-	return nil
+	exptime := clock.Deadline(cmd.Exptime)
+
+	err := s.put(string(cmd.Key), entry{
+		data:    cmd.Data,
+		exptime: exptime,
+		flags:   cmd.Flags,
+	})
+
+	s.mutex.Unlock()
+	return err
 }
 
-func (h *Handler) Prepend(cmd common.SetRequest) error {
-	h.mutex.Lock()
+// CompareAndSwap, like SetIfMatch, checks and sets while holding the lock
+func (s *shard) CompareAndSwap(cmd common.CASRequest) error {
+	s.lock()
 
-	e, ok := h.data[string(cmd.Key)]
+	e, ok := s.data[string(cmd.Key)]
 
 	if !ok || e.isExpired() {
-		delete(h.data, string(cmd.Key))
-		h.mutex.Unlock()
+		s.drop(string(cmd.Key))
+		s.mutex.Unlock()
 		return common.ErrKeyNotFound
 	}
 
-	h.data[string(cmd.Key)] = entry{
-		data:    append(cmd.Data, e.data...),
-		exptime: e.exptime,
-		flags:   e.flags,
+	if e.cas != cmd.Cas {
+		s.mutex.Unlock()
+		return common.ErrKeyExists
 	}
 
-	h.mutex.Unlock()
-	return nil
+	exptime := clock.Deadline(cmd.Exptime)
+
+	err := s.put(string(cmd.Key), entry{
+		data:    cmd.Data,
+		exptime: exptime,
+		flags:   cmd.Flags,
+	})
+
+	s.mutex.Unlock()
+	return err
 }
 
-func (h *Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
-	dataOut := make(chan common.GetResponse, len(cmd.Keys))
-	errorOut := make(chan error)
+// arith increments or decrements a number in place. The new value keeps the flags and expiration
+// time of the old one.
+func (s *shard) arith(cmd common.ArithRequest, decr bool) (uint64, error) {
+	s.lock()
+	defer s.mutex.Unlock()
 
-	h.mutex.RLock()
+	e, ok := s.data[string(cmd.Key)]
 
-	for idx, bk := range cmd.Keys {
-		e, ok := h.data[string(bk)]
-
-		if !ok || e.isExpired() {
-			delete(h.data, string(bk))
-			dataOut <- common.GetResponse{
-				Miss:   true,
-				Quiet:  cmd.Quiet[idx],
-				Opaque: cmd.Opaques[idx],
-				Key:    bk,
-			}
-			continue
+	if !ok || e.isExpired() {
+		s.drop(string(cmd.Key))
+		if !cmd.Create {
+			return 0, common.ErrKeyNotFound
 		}
 
-		dataOut <- common.GetResponse{
-			Miss:   false,
-			Quiet:  cmd.Quiet[idx],
-			Opaque: cmd.Opaques[idx],
-			Flags:  e.flags,
-			Key:    bk,
-			Data:   e.data,
-		}
+		err := s.put(string(cmd.Key), entry{
+			data:    []byte(strconv.FormatUint(cmd.Initial, 10)),
+			exptime: clock.Deadline(cmd.Exptime),
+		})
+		return cmd.Initial, err
 	}
 
-	h.mutex.RUnlock()
+	n, err := handlers.ApplyDelta(e.data, cmd.Delta, decr)
+	if err != nil {
+		return 0, err
+	}
 
-	close(dataOut)
-	close(errorOut)
-	return dataOut, errorOut
+	err = s.put(string(cmd.Key), entry{
+		data:    []byte(strconv.FormatUint(n, 10)),
+		exptime: e.exptime,
+		flags:   e.flags,
+	})
+	return n, err
 }
 
-func (h *Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
-	dataOut := make(chan common.GetEResponse, len(cmd.Keys))
-	errorOut := make(chan error)
+func (s *shard) Append(cmd common.SetRequest) error {
+	s.lock()
 
-	h.mutex.RLock()
+	e, ok := s.data[string(cmd.Key)]
 
-	for idx, bk := range cmd.Keys {
-		e, ok := h.data[string(bk)]
-
-		if !ok || e.isExpired() {
-			delete(h.data, string(bk))
-			dataOut <- common.GetEResponse{
-				Miss:   true,
-				Quiet:  cmd.Quiet[idx],
-				Opaque: cmd.Opaques[idx],
-				Key:    bk,
-			}
-			continue
-		}
+	if !ok || e.isExpired() {
+		s.drop(string(cmd.Key))
+		s.mutex.Unlock()
+		return common.ErrKeyNotFound
+	}
 
-		dataOut <- common.GetEResponse{
-			Miss:    false,
-			Quiet:   cmd.Quiet[idx],
-			Opaque:  cmd.Opaques[idx],
-			Exptime: e.exptime,
-			Flags:   e.flags,
-			Key:     bk,
-			Data:    e.data,
-		}
+	err := s.put(string(cmd.Key), entry{
+		data:    append(e.data, cmd.Data...),
+		exptime: e.exptime,
+		flags:   e.flags,
+	})
+
+	s.mutex.Unlock()
+	return err
+}
+
+func (s *shard) Prepend(cmd common.SetRequest) error {
+	s.lock()
+
+	e, ok := s.data[string(cmd.Key)]
+
+	if !ok || e.isExpired() {
+		s.drop(string(cmd.Key))
+		s.mutex.Unlock()
+		return common.ErrKeyNotFound
 	}
 
-	h.mutex.RUnlock()
+	err := s.put(string(cmd.Key), entry{
+		data:    append(cmd.Data, e.data...),
+		exptime: e.exptime,
+		flags:   e.flags,
+	})
 
-	close(dataOut)
-	close(errorOut)
-	return dataOut, errorOut
+	s.mutex.Unlock()
+	return err
 }
 
-func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
-	h.mutex.Lock()
+func (s *shard) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	s.lock()
 
-	e, ok := h.data[string(cmd.Key)]
+	e, ok := s.data[string(cmd.Key)]
 
 	if !ok || e.isExpired() {
-		delete(h.data, string(cmd.Key))
-		h.mutex.Unlock()
+		s.drop(string(cmd.Key))
+		s.mutex.Unlock()
 		return common.GetResponse{
 			Miss:   true,
 			Opaque: cmd.Opaque,
@@ -249,56 +628,111 @@ func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
 		}, nil
 	}
 
-	if cmd.Exptime > 0 {
-		e.exptime = uint32(time.Now().Unix()) + cmd.Exptime
-	} else {
-		e.exptime = 0
-	}
+	e.exptime = clock.Deadline(cmd.Exptime)
 
-	h.data[string(cmd.Key)] = e
+	if err := s.put(string(cmd.Key), e); err != nil {
+		s.mutex.Unlock()
+		return common.GetResponse{}, err
+	}
 
-	h.mutex.Unlock()
+	data := s.h.off.copied(e.data)
+	s.mutex.Unlock()
 
 	return common.GetResponse{
 		Miss:   false,
 		Opaque: cmd.Opaque,
 		Flags:  e.flags,
 		Key:    cmd.Key,
-		Data:   e.data,
+		Data:   data,
+		Cas:    e.cas,
 	}, nil
 }
 
-func (h *Handler) Delete(cmd common.DeleteRequest) error {
-	h.mutex.Lock()
-	delete(h.data, string(cmd.Key))
-	h.mutex.Unlock()
-	return nil
+func (s *shard) Delete(cmd common.DeleteRequest) error {
+	s.lock()
+	err := s.remove(string(cmd.Key))
+	s.mutex.Unlock()
+	return err
 }
 
-func (h *Handler) Touch(cmd common.TouchRequest) error {
-	h.mutex.Lock()
+func (s *shard) Touch(cmd common.TouchRequest) error {
+	s.lock()
 
-	e, ok := h.data[string(cmd.Key)]
+	e, ok := s.data[string(cmd.Key)]
 
 	if !ok || e.isExpired() {
-		delete(h.data, string(cmd.Key))
-		h.mutex.Unlock()
+		s.drop(string(cmd.Key))
+		s.mutex.Unlock()
 		return common.ErrKeyNotFound
 	}
 
-	if cmd.Exptime > 0 {
-		e.exptime = uint32(time.Now().Unix()) + cmd.Exptime
-	} else {
-		e.exptime = 0
+	e.exptime = clock.Deadline(cmd.Exptime)
+
+	err := s.put(string(cmd.Key), e)
+
+	s.mutex.Unlock()
+
+	return err
+}
+
+func (s *shard) GetLock(cmd common.GetLockRequest) (common.GetLockResponse, error) {
+	token, err := handlers.NewLockToken()
+	if err != nil {
+		return common.GetLockResponse{}, err
 	}
 
-	h.data[string(cmd.Key)] = e
+	s.lock()
+	defer s.mutex.Unlock()
 
-	h.mutex.Unlock()
+	now := clock.Unix()
 
-	return nil
+	if l, ok := s.locks[string(cmd.Key)]; ok && l.exptime >= now {
+		return common.GetLockResponse{}, common.ErrLocked
+	}
+
+	e, ok := s.data[string(cmd.Key)]
+	if !ok || e.isExpired() {
+		return common.GetLockResponse{}, common.ErrKeyNotFound
+	}
+
+	s.touched(string(cmd.Key))
+
+	// locks that expired without an unlock are only swept out once there are enough of them
+	if len(s.locks) >= maxLocks {
+		for k, l := range s.locks {
+			if l.exptime < now {
+				delete(s.locks, k)
+			}
+		}
+	}
+
+	s.locks[string(cmd.Key)] = lock{
+		token:   token,
+		exptime: now + common.LockTimeOf(cmd),
+	}
+
+	return common.GetLockResponse{
+		Key:    cmd.Key,
+		Data:   s.h.off.copied(e.data),
+		Opaque: cmd.Opaque,
+		Flags:  e.flags,
+		Token:  token,
+	}, nil
 }
 
-func (h *Handler) Close() error {
+func (s *shard) Unlock(cmd common.UnlockRequest) error {
+	s.lock()
+	defer s.mutex.Unlock()
+
+	l, ok := s.locks[string(cmd.Key)]
+	if !ok || l.exptime < clock.Unix() {
+		delete(s.locks, string(cmd.Key))
+		return common.ErrNotLocked
+	}
+	if l.token != cmd.Token {
+		return common.ErrLocked
+	}
+
+	delete(s.locks, string(cmd.Key))
 	return nil
 }
@@ -0,0 +1,198 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inmem
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricOffHeapFull = metrics.AddCounter("inmem_offheap_full", nil)
+)
+
+const (
+	// every chunk starts with its reference count and size class
+	chunkHeader = 8
+	minChunk    = 64
+	maxChunk    = 64 << 20
+	// each size class is this much bigger than the last, like memcached's slabs
+	chunkGrowth = 1.25
+)
+
+// chunkSizes are the size classes of the off-heap region, from minChunk to maxChunk
+var chunkSizes = func() []int {
+	var sizes []int
+	for size := minChunk; size < maxChunk; size = (int(float64(size)*chunkGrowth) + 7) &^ 7 {
+		sizes = append(sizes, size)
+	}
+	return append(sizes, maxChunk)
+}()
+
+// offHeap holds large values outside of the Go heap, in a single anonymous memory mapping, so the
+// garbage collector neither marks them nor counts them towards the heap size that paces it. A store
+// of many gigabytes then costs the collector no more than its keys do.
+//
+// The mapping is split into chunks of a few size classes as it's used. Freed chunks are only reused
+// for values of the same class, the same as memcached's slabs, so a store whose value sizes shift a
+// lot over its lifetime can run out of chunks of the right size early. Values that don't fit are
+// kept on the heap.
+//
+// Chunks are reference counted, since a value is still being written to a client after the lock
+// protecting it is released and may be overwritten or evicted in the meantime. The store holds one
+// reference for as long as the entry is in it, and readers take another while the lock is held and
+// release it once they're done.
+type offHeap struct {
+	mem  []byte
+	base uintptr
+	// smallest value kept off the heap
+	min int
+
+	lock sync.Mutex
+	// the start of the part of mem never used yet
+	next int
+	free [][]int
+
+	// guarded by lock
+	used   int64
+	values int64
+}
+
+func newOffHeap(size int, min int) (*offHeap, error) {
+	mem, err := mapAnonymous(size)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &offHeap{
+		mem:  mem,
+		base: uintptr(unsafe.Pointer(&mem[0])),
+		min:  min,
+		free: make([][]int, len(chunkSizes)),
+	}
+
+	metrics.RegisterIntGaugeCallback("inmem_offheap_capacity", nil, func() uint64 {
+		return uint64(len(o.mem))
+	})
+	metrics.RegisterIntGaugeCallback("inmem_offheap_used", nil, func() uint64 {
+		o.lock.Lock()
+		defer o.lock.Unlock()
+		return uint64(o.used)
+	})
+	metrics.RegisterIntGaugeCallback("inmem_offheap_values", nil, func() uint64 {
+		o.lock.Lock()
+		defer o.lock.Unlock()
+		return uint64(o.values)
+	})
+
+	return o, nil
+}
+
+// store copies data into a new chunk holding one reference, or returns it as it is if it's too small
+// or there's no room for it. Data already in a chunk is returned as it is too.
+func (o *offHeap) store(data []byte) []byte {
+	if o == nil || len(data) < o.min || o.owns(data) {
+		return data
+	}
+
+	class := sort.SearchInts(chunkSizes, len(data)+chunkHeader)
+	if class == len(chunkSizes) {
+		return data
+	}
+
+	o.lock.Lock()
+	var off int
+	if free := o.free[class]; len(free) > 0 {
+		off = free[len(free)-1]
+		o.free[class] = free[:len(free)-1]
+	} else if o.next+chunkSizes[class] <= len(o.mem) {
+		off = o.next
+		o.next += chunkSizes[class]
+	} else {
+		o.lock.Unlock()
+		metrics.IncCounter(MetricOffHeapFull)
+		return data
+	}
+	o.used += int64(chunkSizes[class])
+	o.values++
+	o.lock.Unlock()
+
+	*o.refs(off) = 1
+	o.mem[off+4] = byte(class)
+
+	start := off + chunkHeader
+	end := start + len(data)
+	copy(o.mem[start:end], data)
+
+	// the capacity is cut to the length so appending to the value never writes past it
+	return o.mem[start:end:end]
+}
+
+// owns returns whether data is in a chunk
+func (o *offHeap) owns(data []byte) bool {
+	if o == nil || cap(data) == 0 {
+		return false
+	}
+	p := uintptr(unsafe.Pointer(&data[:1][0]))
+	return p >= o.base && p < o.base+uintptr(len(o.mem))
+}
+
+func (o *offHeap) refs(off int) *int32 {
+	return (*int32)(unsafe.Pointer(&o.mem[off]))
+}
+
+func (o *offHeap) chunk(data []byte) int {
+	return int(uintptr(unsafe.Pointer(&data[:1][0]))-o.base) - chunkHeader
+}
+
+// retain takes another reference to data if it's in a chunk. The lock of the entry it belongs to
+// must be held, so the store's own reference can't be released at the same time.
+func (o *offHeap) retain(data []byte) {
+	if o.owns(data) {
+		atomic.AddInt32(o.refs(o.chunk(data)), 1)
+	}
+}
+
+// release gives up a reference to data if it's in a chunk, freeing the chunk with the last one
+func (o *offHeap) release(data []byte) {
+	if !o.owns(data) {
+		return
+	}
+
+	off := o.chunk(data)
+	if atomic.AddInt32(o.refs(off), -1) > 0 {
+		return
+	}
+
+	class := int(o.mem[off+4])
+	o.lock.Lock()
+	o.free[class] = append(o.free[class], off)
+	o.used -= int64(chunkSizes[class])
+	o.values--
+	o.lock.Unlock()
+}
+
+// copied returns data on the heap, for values that are used after their entry's lock is released
+// without a reference to them. The lock must be held.
+func (o *offHeap) copied(data []byte) []byte {
+	if !o.owns(data) {
+		return data
+	}
+	return append([]byte(nil), data...)
+}
@@ -0,0 +1,94 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inmem
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+
+	"github.com/netflix/rend/common"
+)
+
+func TestOffHeap(t *testing.T) {
+	// room for two of the values below
+	chunk := chunkSizes[sort.SearchInts(chunkSizes, 1001+chunkHeader)]
+	h := newHandler(1)
+	if err := h.configure(Config{OffHeapBytes: 2 * int64(chunk), OffHeapMinSize: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := func(key string) entry {
+		t.Helper()
+		e, ok := h.shards[0].data[key]
+		if !ok {
+			t.Fatalf("Expected %s to be stored", key)
+		}
+		return e
+	}
+	get := func(key string) (data []byte) {
+		h.GetEach(common.GetRequest{Keys: [][]byte{[]byte(key)}, Opaques: []uint32{0}, Quiet: []bool{false}}, func(res common.GetResponse) error {
+			data = append(data, res.Data...)
+			return nil
+		})
+		return data
+	}
+
+	large := bytes.Repeat([]byte("a"), 1000)
+	h.Set(common.SetRequest{Key: []byte("small"), Data: []byte("value")})
+	h.Set(common.SetRequest{Key: []byte("large"), Data: large})
+
+	if h.off.owns(stored("small").data) {
+		t.Fatal("Expected a value under the minimum size to stay on the heap")
+	}
+	if !h.off.owns(stored("large").data) || !bytes.Equal(get("large"), large) {
+		t.Fatal("Expected a large value to be stored off the heap and read back")
+	}
+
+	// A value being read is kept while it's overwritten, until the reader is done with it
+	e, _ := h.shards[0].lookup([]byte("large"))
+	h.Set(common.SetRequest{Key: []byte("large"), Data: bytes.Repeat([]byte("b"), 1000)})
+	if !bytes.Equal(e.data, large) || h.off.values != 2 {
+		t.Fatalf("Expected the value being read to be kept, with %d values off the heap", h.off.values)
+	}
+	h.off.release(e.data)
+	if h.off.values != 1 {
+		t.Fatalf("Expected the old value freed once released, with %d values off the heap", h.off.values)
+	}
+
+	// Touches keep the value, appends make a new one, and the channel API gets a copy
+	h.Touch(common.TouchRequest{Key: []byte("large"), Exptime: 100})
+	h.Append(common.SetRequest{Key: []byte("large"), Data: []byte("c")})
+	if h.off.values != 1 || !bytes.Equal(get("large"), append(bytes.Repeat([]byte("b"), 1000), 'c')) {
+		t.Fatalf("Expected the appended value in place of the old one, with %d values off the heap", h.off.values)
+	}
+	resChan, _ := h.Get(common.GetRequest{Keys: [][]byte{[]byte("large")}, Opaques: []uint32{0}, Quiet: []bool{false}})
+	if res := <-resChan; h.off.owns(res.Data) {
+		t.Fatal("Expected the channel API to get a copy of the value")
+	}
+
+	// Values that don't fit stay on the heap
+	h.Set(common.SetRequest{Key: []byte("other"), Data: large})
+	h.Set(common.SetRequest{Key: []byte("full"), Data: large})
+	if h.off.owns(stored("full").data) || !bytes.Equal(get("full"), large) {
+		t.Fatal("Expected a value that doesn't fit to be kept on the heap")
+	}
+
+	h.Delete(common.DeleteRequest{Key: []byte("large")})
+	h.Flush(common.FlushRequest{})
+	if h.off.values != 0 || h.off.used != 0 {
+		t.Fatalf("Expected every value freed, %d values in %d bytes left", h.off.values, h.off.used)
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inmem
+
+import (
+	"container/heap"
+	"container/list"
+
+	"github.com/netflix/rend/metrics"
+)
+
+var MetricARCGhostHits = metrics.AddCounter("inmem_arc_ghost_hits", nil)
+
+// listPolicy evicts the key at the back of a list that keys are added to the front of. Moving keys
+// to the front when they're accessed makes it LRU, and leaving them where they are makes it FIFO.
+type listPolicy struct {
+	lru   bool
+	order *list.List
+	elems map[string]*list.Element
+}
+
+func newListPolicy(lru bool) *listPolicy {
+	return &listPolicy{
+		lru:   lru,
+		order: list.New(),
+		elems: make(map[string]*list.Element),
+	}
+}
+
+func (p *listPolicy) Add(key string) {
+	p.elems[key] = p.order.PushFront(key)
+}
+
+func (p *listPolicy) Access(key string) {
+	if el, ok := p.elems[key]; ok && p.lru {
+		p.order.MoveToFront(el)
+	}
+}
+
+func (p *listPolicy) Remove(key string) {
+	if el, ok := p.elems[key]; ok {
+		p.order.Remove(el)
+		delete(p.elems, key)
+	}
+}
+
+func (p *listPolicy) Evict() (string, bool) {
+	el := p.order.Back()
+	if el == nil {
+		return "", false
+	}
+	key := p.order.Remove(el).(string)
+	delete(p.elems, key)
+	return key, true
+}
+
+// lfu evicts the key accessed the fewest times, and of those, the one accessed longest ago
+type lfu struct {
+	items lfuHeap
+	index map[string]*lfuItem
+	clock uint64
+}
+
+type lfuItem struct {
+	key   string
+	count uint64
+	last  uint64
+	pos   int
+}
+
+type lfuHeap []*lfuItem
+
+func (h lfuHeap) Len() int { return len(h) }
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count < h[j].count
+	}
+	return h[i].last < h[j].last
+}
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].pos, h[j].pos = i, j
+}
+func (h *lfuHeap) Push(x interface{}) {
+	it := x.(*lfuItem)
+	it.pos = len(*h)
+	*h = append(*h, it)
+}
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	it := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return it
+}
+
+func newLFU() *lfu {
+	return &lfu{index: make(map[string]*lfuItem)}
+}
+
+func (p *lfu) Add(key string) {
+	p.clock++
+	it := &lfuItem{key: key, count: 1, last: p.clock}
+	p.index[key] = it
+	heap.Push(&p.items, it)
+}
+
+func (p *lfu) Access(key string) {
+	if it, ok := p.index[key]; ok {
+		p.clock++
+		it.count++
+		it.last = p.clock
+		heap.Fix(&p.items, it.pos)
+	}
+}
+
+func (p *lfu) Remove(key string) {
+	if it, ok := p.index[key]; ok {
+		heap.Remove(&p.items, it.pos)
+		delete(p.index, key)
+	}
+}
+
+func (p *lfu) Evict() (string, bool) {
+	if len(p.items) == 0 {
+		return "", false
+	}
+	it := heap.Pop(&p.items).(*lfuItem)
+	delete(p.index, it.key)
+	return it.key, true
+}
+
+// arc is the Adaptive Replacement Cache. Keys seen once are in t1 and keys seen again are in t2,
+// and the keys recently evicted from each are remembered in the ghost lists b1 and b2. A key that
+// comes back while it's still a ghost shows which list was evicted from too eagerly, and p, the
+// share of the cache t1 aims for, moves towards it. That keeps a scan of keys that are only read
+// once from pushing out the ones read over and over.
+//
+// The store evicts by size rather than by a number of entries, so the ghost lists are bounded by
+// the most entries the cache has held instead of a fixed capacity.
+type arc struct {
+	t1, t2, b1, b2 *list.List
+	where          map[string]*arcEntry
+	p              int
+	capacity       int
+}
+
+type arcEntry struct {
+	list *list.List
+	el   *list.Element
+}
+
+func newARC() *arc {
+	return &arc{
+		t1:    list.New(),
+		t2:    list.New(),
+		b1:    list.New(),
+		b2:    list.New(),
+		where: make(map[string]*arcEntry),
+	}
+}
+
+func (p *arc) move(key string, to *list.List) {
+	if e, ok := p.where[key]; ok {
+		e.list.Remove(e.el)
+		e.list, e.el = to, to.PushFront(key)
+		return
+	}
+	p.where[key] = &arcEntry{list: to, el: to.PushFront(key)}
+}
+
+func (p *arc) forget(key string) {
+	if e, ok := p.where[key]; ok {
+		e.list.Remove(e.el)
+		delete(p.where, key)
+	}
+}
+
+func (p *arc) Add(key string) {
+	ghost := false
+	if e, ok := p.where[key]; ok {
+		switch e.list {
+		case p.b1:
+			ghost = true
+			p.p = min(p.capacity, p.p+max(p.b2.Len()/max(p.b1.Len(), 1), 1))
+		case p.b2:
+			ghost = true
+			p.p = max(0, p.p-max(p.b1.Len()/max(p.b2.Len(), 1), 1))
+		}
+	}
+
+	if ghost {
+		metrics.IncCounter(MetricARCGhostHits)
+		p.move(key, p.t2)
+	} else {
+		p.move(key, p.t1)
+	}
+
+	if n := p.t1.Len() + p.t2.Len(); n > p.capacity {
+		p.capacity = n
+	}
+	p.trim()
+}
+
+// trim forgets the oldest ghosts past the capacity
+func (p *arc) trim() {
+	for p.b1.Len()+p.b2.Len() > p.capacity {
+		if p.b1.Len() > p.b2.Len() {
+			p.forget(p.b1.Back().Value.(string))
+		} else {
+			p.forget(p.b2.Back().Value.(string))
+		}
+	}
+}
+
+func (p *arc) Access(key string) {
+	if e, ok := p.where[key]; ok && (e.list == p.t1 || e.list == p.t2) {
+		p.move(key, p.t2)
+	}
+}
+
+func (p *arc) Remove(key string) {
+	if e, ok := p.where[key]; ok && (e.list == p.t1 || e.list == p.t2) {
+		p.forget(key)
+	}
+}
+
+func (p *arc) Evict() (string, bool) {
+	from, ghosts := p.t2, p.b2
+	if p.t1.Len() > 0 && (p.t1.Len() > p.p || p.t2.Len() == 0) {
+		from, ghosts = p.t1, p.b1
+	}
+
+	el := from.Back()
+	if el == nil {
+		return "", false
+	}
+	key := el.Value.(string)
+	p.move(key, ghosts)
+	p.trim()
+	return key, true
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
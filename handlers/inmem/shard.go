@@ -0,0 +1,72 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inmem
+
+import (
+	"strconv"
+	"sync/atomic"
+
+	"github.com/netflix/rend/metrics"
+)
+
+// reshard splits the store into n shards, moving over whatever it already holds. It's only done
+// while configuring, before eviction and expiry are set up.
+func (h *Handler) reshard(n int) {
+	if n == len(h.shards) {
+		return
+	}
+
+	h.lockAll()
+	old := h.shards
+	h.shards = newHandler(n).shards
+	for _, s := range h.shards {
+		s.h = h
+	}
+	for _, s := range old {
+		for k, e := range s.data {
+			h.shard([]byte(k)).data[k] = e
+		}
+		for k, l := range s.locks {
+			h.shard([]byte(k)).locks[k] = l
+		}
+	}
+	for _, s := range old {
+		s.mutex.Unlock()
+	}
+}
+
+// shardMetrics reports how often each shard's lock was contended and how many entries it holds,
+// which shows whether there are enough shards and whether a few hot keys land on the same one
+func (h *Handler) shardMetrics() {
+	metrics.RegisterBulkCallback(func() ([]metrics.IntMetric, []metrics.FloatMetric) {
+		ret := make([]metrics.IntMetric, 0, 5*len(h.shards))
+		for i, s := range h.shards {
+			tags := metrics.Tags{"shard": strconv.Itoa(i)}
+
+			s.mutex.RLock()
+			items := len(s.data)
+			s.mutex.RUnlock()
+
+			ret = append(ret,
+				metrics.IntMetric{Name: "inmem_shard_locks", Val: atomic.LoadUint64(&s.locked), Tgs: tags},
+				metrics.IntMetric{Name: "inmem_shard_lock_waits", Val: atomic.LoadUint64(&s.waited), Tgs: tags},
+				metrics.IntMetric{Name: "inmem_shard_read_locks", Val: atomic.LoadUint64(&s.readLocked), Tgs: tags},
+				metrics.IntMetric{Name: "inmem_shard_read_lock_waits", Val: atomic.LoadUint64(&s.readWaited), Tgs: tags},
+				metrics.IntMetric{Name: "inmem_shard_items", Val: uint64(items), Tgs: tags},
+			)
+		}
+		return ret, nil
+	})
+}
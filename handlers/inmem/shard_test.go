@@ -0,0 +1,149 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inmem
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+)
+
+func TestShards(t *testing.T) {
+	t.Run("Spread", func(t *testing.T) {
+		h := newHandler(8)
+		for i := 0; i < 1000; i++ {
+			set(h, fmt.Sprint("key", i))
+		}
+
+		for i, s := range h.shards {
+			if len(s.data) == 0 {
+				t.Fatalf("Expected keys in every shard, shard %d is empty", i)
+			}
+			for k := range s.data {
+				if h.shard([]byte(k)) != s {
+					t.Fatalf("Key %q is in shard %d but hashes to another", k, i)
+				}
+			}
+		}
+
+		keys, _ := h.Keys([]byte("key"))
+		if len(keys) != 1000 {
+			t.Fatalf("Expected every key listed across the shards, got %d", len(keys))
+		}
+	})
+
+	t.Run("Reshard", func(t *testing.T) {
+		h := newHandler(DefaultShards)
+		for i := 0; i < 100; i++ {
+			set(h, fmt.Sprint("key", i))
+		}
+		before := contents(h)
+
+		if err := h.configure(Config{Shards: 3, MaxItems: 30}); err != nil {
+			t.Fatal(err)
+		}
+		if len(h.shards) != 3 {
+			t.Fatalf("Expected 3 shards, got %d", len(h.shards))
+		}
+		for _, s := range h.shards {
+			if s.h != h {
+				t.Fatal("Expected the new shards to point back at the handler")
+			}
+			if s.ev.conf.MaxItems != 10 {
+				t.Fatalf("Expected the item limit split between the shards, got %d", s.ev.conf.MaxItems)
+			}
+			if len(s.data) > 10 {
+				t.Fatalf("Expected each shard held to its share of the limit, got %d", len(s.data))
+			}
+		}
+		for k, v := range contents(h) {
+			if before[k] != v {
+				t.Fatalf("Expected %q to keep its value %q, got %q", k, before[k], v)
+			}
+		}
+	})
+
+	t.Run("Flush", func(t *testing.T) {
+		h := newHandler(8)
+		for i := 0; i < 100; i++ {
+			set(h, fmt.Sprint("key", i))
+		}
+
+		if err := h.Flush(common.FlushRequest{}); err != nil {
+			t.Fatal(err)
+		}
+		for i, s := range h.shards {
+			if len(s.data) != 0 {
+				t.Fatalf("Expected every shard flushed, shard %d has %d keys", i, len(s.data))
+			}
+		}
+	})
+
+	t.Run("DelayedFlush", func(t *testing.T) {
+		h := newHandler(2)
+		set(h, "before")
+
+		// a later flush replaces a delayed one
+		h.Flush(common.FlushRequest{Delay: 3600})
+		if err := h.Flush(common.FlushRequest{Delay: 1}); err != nil {
+			t.Fatal(err)
+		}
+		set(h, "after")
+		if len(contents(h)) != 2 {
+			t.Fatalf("Expected nothing flushed before the delay, got %v", contents(h))
+		}
+
+		// keys set during the delay are flushed too
+		for start := time.Now(); len(contents(h)) != 0; time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 3*time.Second {
+				t.Fatalf("Expected everything flushed after the delay, got %v", contents(h))
+			}
+		}
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		h := newHandler(4)
+
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < 500; i++ {
+					key := fmt.Sprint("key", g, "-", i%50)
+					set(h, key)
+					read(h, key)
+					h.Touch(common.TouchRequest{Key: []byte(key), Exptime: 100})
+					if i%7 == 0 {
+						h.Delete(common.DeleteRequest{Key: []byte(key)})
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+
+		var locked, read uint64
+		for _, s := range h.shards {
+			locked += s.locked
+			read += s.readLocked
+		}
+		if locked == 0 || read == 0 {
+			t.Fatalf("Expected the locks counted, got %d writes and %d reads", locked, read)
+		}
+	})
+}
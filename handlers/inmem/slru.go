@@ -0,0 +1,213 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inmem
+
+import (
+	"container/list"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricSLRUHotToWarm  = metrics.AddCounter("inmem_slru_hot_to_warm", nil)
+	MetricSLRUHotToCold  = metrics.AddCounter("inmem_slru_hot_to_cold", nil)
+	MetricSLRUWarmToCold = metrics.AddCounter("inmem_slru_warm_to_cold", nil)
+	MetricSLRUColdToWarm = metrics.AddCounter("inmem_slru_cold_to_warm", nil)
+	MetricSLRUWarmBumps  = metrics.AddCounter("inmem_slru_warm_bumps", nil)
+)
+
+// defaults for the share of entries in the hot and warm segments, in percent
+const (
+	defaultHotPercent  = 20
+	defaultWarmPercent = 40
+)
+
+const (
+	segHot = iota
+	segWarm
+	segCold
+)
+
+var segNames = [...]string{"hot", "warm", "cold"}
+
+// slru is a segmented LRU like memcached's, in three segments. New keys go into hot, and keys
+// leaving hot go to warm if they were read while in it, or to cold if not. Keys are only evicted
+// from cold, and one read there moves up to warm, so a key has to be read more than once to stay
+// around for long and a scan of keys read once only cycles through hot and cold. Keys at the end
+// of warm that were read since they got there go back to its front, and the others drop to cold.
+//
+// The hot and warm segments are kept to a share of all the keys the policy holds, and cold gets
+// the rest.
+type slru struct {
+	hotPercent, warmPercent int
+
+	segs [3]*list.List
+	// the lengths of the segments for metrics, which are read without the store's lock
+	lens  [3]int64
+	elems map[string]*list.Element
+}
+
+type slruEntry struct {
+	key    string
+	seg    int
+	active bool
+}
+
+func init() {
+	RegisterPolicy("slru", func(conf string) (Policy, error) {
+		return newSLRU(conf)
+	})
+}
+
+// newSLRU makes a segmented LRU from a configuration like "hot=20&warm=40", the percentage of keys
+// held in the hot and warm segments
+func newSLRU(conf string) (*slru, error) {
+	p := &slru{
+		hotPercent:  defaultHotPercent,
+		warmPercent: defaultWarmPercent,
+		elems:       make(map[string]*list.Element),
+	}
+	for i := range p.segs {
+		p.segs[i] = list.New()
+	}
+
+	q, err := url.ParseQuery(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	for name := range q {
+		val := q.Get(name)
+
+		switch name {
+		case "hot", "warm":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 || n > 98 {
+				return nil, fmt.Errorf("Invalid SLRU %s percentage %q", name, val)
+			}
+			if name == "hot" {
+				p.hotPercent = n
+			} else {
+				p.warmPercent = n
+			}
+		default:
+			return nil, fmt.Errorf("Unknown SLRU eviction policy option %q", name)
+		}
+	}
+
+	if p.hotPercent+p.warmPercent >= 100 {
+		return nil, fmt.Errorf("The SLRU hot and warm segments must leave room for cold, got %d%% and %d%%", p.hotPercent, p.warmPercent)
+	}
+
+	for i, name := range segNames {
+		i := i
+		metrics.RegisterIntGaugeCallback("inmem_slru_items", metrics.Tags{"segment": name}, func() uint64 {
+			return uint64(atomic.LoadInt64(&p.lens[i]))
+		})
+	}
+
+	return p, nil
+}
+
+// push puts an entry at the front of a segment
+func (p *slru) push(e *slruEntry, seg int) {
+	e.seg, e.active = seg, false
+	p.elems[e.key] = p.segs[seg].PushFront(e)
+}
+
+// move takes an entry out of its segment and puts it at the front of another
+func (p *slru) move(el *list.Element, seg int) {
+	e := el.Value.(*slruEntry)
+	p.segs[e.seg].Remove(el)
+	p.push(e, seg)
+}
+
+// balance moves keys out of hot and warm until they're within their shares
+func (p *slru) balance() {
+	total := len(p.elems)
+
+	for p.segs[segHot].Len() > total*p.hotPercent/100 {
+		el := p.segs[segHot].Back()
+		if el.Value.(*slruEntry).active {
+			metrics.IncCounter(MetricSLRUHotToWarm)
+			p.move(el, segWarm)
+		} else {
+			metrics.IncCounter(MetricSLRUHotToCold)
+			p.move(el, segCold)
+		}
+	}
+
+	for p.segs[segWarm].Len() > total*p.warmPercent/100 {
+		el := p.segs[segWarm].Back()
+		if el.Value.(*slruEntry).active {
+			// Each bump clears the flag, so this ends once every key in warm has been seen
+			metrics.IncCounter(MetricSLRUWarmBumps)
+			p.move(el, segWarm)
+		} else {
+			metrics.IncCounter(MetricSLRUWarmToCold)
+			p.move(el, segCold)
+		}
+	}
+
+	for i, seg := range p.segs {
+		atomic.StoreInt64(&p.lens[i], int64(seg.Len()))
+	}
+}
+
+func (p *slru) Add(key string) {
+	p.push(&slruEntry{key: key}, segHot)
+	p.balance()
+}
+
+func (p *slru) Access(key string) {
+	el, ok := p.elems[key]
+	if !ok {
+		return
+	}
+
+	if e := el.Value.(*slruEntry); e.seg == segCold {
+		metrics.IncCounter(MetricSLRUColdToWarm)
+		p.move(el, segWarm)
+		p.balance()
+	} else {
+		e.active = true
+	}
+}
+
+func (p *slru) Remove(key string) {
+	el, ok := p.elems[key]
+	if !ok {
+		return
+	}
+	p.segs[el.Value.(*slruEntry).seg].Remove(el)
+	delete(p.elems, key)
+	p.balance()
+}
+
+func (p *slru) Evict() (string, bool) {
+	// cold is only empty when there are too few keys for the shares to leave it any
+	for _, seg := range []int{segCold, segWarm, segHot} {
+		if el := p.segs[seg].Back(); el != nil {
+			key := el.Value.(*slruEntry).key
+			p.Remove(key)
+			return key, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,213 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inmem
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricSnapshots       = metrics.AddCounter("inmem_snapshots", nil)
+	MetricSnapshotErrors  = metrics.AddCounter("inmem_snapshot_errors", nil)
+	MetricRestores        = metrics.AddCounter("inmem_restores", nil)
+	MetricRestoreErrors   = metrics.AddCounter("inmem_restore_errors", nil)
+	MetricRestoredEntries = metrics.AddCounter("inmem_restored_entries", nil)
+)
+
+// A snapshot starts with this, followed by WAL records of every entry
+var snapshotMagic = []byte("rend-inmem-snapshot\x01")
+
+var errNotSnapshot = errors.New("Not an in-memory snapshot")
+
+// Snapshot writes every entry in the shared in-memory store that hasn't expired to w, with its
+// flags and absolute expiration time, and returns how many were written. Each shard is copied as
+// it is when the snapshot gets to it; writes to it after that aren't in it.
+func Snapshot(w io.Writer) (int, error) {
+	return singleton.snapshot(w)
+}
+
+// Restore loads a snapshot made by Snapshot into the shared in-memory store, possibly on another
+// host, and returns how many entries were loaded. Entries that have expired since are skipped, as
+// are keys the store already has, since those were written after the snapshot was taken.
+func Restore(r io.Reader) (int, error) {
+	return singleton.restore(r)
+}
+
+// SnapshotFile atomically writes a snapshot to the file at path
+func SnapshotFile(path string) (int, error) {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	bw := bufio.NewWriter(f)
+	n, err := Snapshot(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// RestoreFile restores the snapshot in the file at path
+func RestoreFile(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return Restore(f)
+}
+
+func (h *Handler) snapshot(w io.Writer) (int, error) {
+	metrics.IncCounter(MetricSnapshots)
+
+	live := h.live()
+	defer h.release(live)
+
+	_, err := w.Write(snapshotMagic)
+	if err == nil {
+		err = writeEntries(w, live)
+	}
+	if err != nil {
+		metrics.IncCounter(MetricSnapshotErrors)
+		return 0, err
+	}
+
+	return len(live), nil
+}
+
+func (h *Handler) restore(r io.Reader) (int, error) {
+	metrics.IncCounter(MetricRestores)
+
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || !bytes.Equal(magic, snapshotMagic) {
+		metrics.IncCounter(MetricRestoreErrors)
+		return 0, errNotSnapshot
+	}
+
+	restored := 0
+	for {
+		_, op, key, e, err := readEntry(br)
+		if err == io.EOF {
+			return restored, nil
+		}
+		if err == nil && op != opSet {
+			err = errCorruptEntry
+		}
+		if err != nil {
+			metrics.IncCounter(MetricRestoreErrors)
+			return restored, err
+		}
+
+		if e.isExpired() {
+			continue
+		}
+
+		s := h.shard([]byte(key))
+		s.lock()
+		if cur, ok := s.data[key]; !ok || cur.isExpired() {
+			if err = s.put(key, e); err == nil {
+				restored++
+				metrics.IncCounter(MetricRestoredEntries)
+			}
+		}
+		s.mutex.Unlock()
+
+		if err != nil {
+			metrics.IncCounter(MetricRestoreErrors)
+			return restored, err
+		}
+	}
+}
+
+// SnapshotHandler serves snapshots of the shared in-memory store. A GET responds with the
+// snapshot itself, which can be piped straight to the RestoreHandler of another host. A POST with
+// path=<file> writes it to that file on this host instead.
+var SnapshotHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/octet-stream")
+		bw := bufio.NewWriter(w)
+		if _, err := Snapshot(bw); err == nil {
+			bw.Flush()
+		}
+
+	case http.MethodPost:
+		path := r.FormValue("path")
+		if path == "" {
+			http.Error(w, "a path to write the snapshot to is required", http.StatusBadRequest)
+			return
+		}
+		n, err := SnapshotFile(path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "wrote %d entries to %s\n", n, path)
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "snapshots are fetched with GET or written to a file with POST", http.StatusMethodNotAllowed)
+	}
+})
+
+// RestoreHandler restores a snapshot POSTed to it, or with path=<file>, the one in that file on
+// this host.
+var RestoreHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "restores must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var n int
+	var err error
+	if path := r.URL.Query().Get("path"); path != "" {
+		n, err = RestoreFile(path)
+	} else {
+		n, err = Restore(r.Body)
+	}
+
+	if err != nil {
+		http.Error(w, fmt.Sprintf("restored %d entries before failing: %s", n, err.Error()), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "restored %d entries\n", n)
+})
@@ -0,0 +1,66 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inmem
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+)
+
+func TestSnapshot(t *testing.T) {
+	src := newHandler(4)
+	src.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar"), Flags: 7, Exptime: 3600})
+	src.Set(common.SetRequest{Key: []byte("forever"), Data: []byte("value")})
+	src.Set(common.SetRequest{Key: []byte("newer"), Data: []byte("old")})
+
+	past := uint32(time.Now().Add(-time.Hour).Unix())
+	src.Set(common.SetRequest{Key: []byte("expired"), Data: []byte("gone"), Exptime: past})
+
+	buf := new(bytes.Buffer)
+	if n, err := src.snapshot(buf); err != nil || n != 3 {
+		t.Fatalf("Expected 3 entries in the snapshot, got %d, %v", n, err)
+	}
+
+	dst := newHandler(4)
+	dst.Set(common.SetRequest{Key: []byte("newer"), Data: []byte("new")})
+
+	if n, err := dst.restore(buf); err != nil || n != 2 {
+		t.Fatalf("Expected 2 entries restored, got %d, %v", n, err)
+	}
+
+	expected := contents(src)
+	expected["newer"] = contents(dst)["newer"]
+	delete(expected, "expired")
+	got := contents(dst)
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+	for k, v := range expected {
+		if got[k] != v {
+			t.Fatalf("Expected %s to be %s, got %s", k, v, got[k])
+		}
+	}
+	if !strings.HasPrefix(got["newer"], "new/") {
+		t.Fatalf("Expected a key written since the snapshot to be kept, got %s", got["newer"])
+	}
+
+	if _, err := dst.restore(strings.NewReader("not a snapshot")); err != errNotSnapshot {
+		t.Fatalf("Expected garbage to be rejected, got %v", err)
+	}
+}
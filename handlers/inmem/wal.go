@@ -0,0 +1,480 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inmem
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricWALWrites      = metrics.AddCounter("inmem_wal_writes", nil)
+	MetricWALWriteErrors = metrics.AddCounter("inmem_wal_write_errors", nil)
+	MetricWALSyncErrors  = metrics.AddCounter("inmem_wal_sync_errors", nil)
+	MetricWALRotations   = metrics.AddCounter("inmem_wal_rotations", nil)
+	MetricWALCompactions = metrics.AddCounter("inmem_wal_compactions", nil)
+	MetricWALCompactErrs = metrics.AddCounter("inmem_wal_compaction_errors", nil)
+	MetricWALReplayed    = metrics.AddCounter("inmem_wal_replayed", nil)
+	MetricWALCorrupt     = metrics.AddCounter("inmem_wal_corrupt", nil)
+)
+
+// WALConfig says where and how the in-memory store is journaled, see OpenWAL
+type WALConfig struct {
+	// Dir holds the segments of the log. It's created if it doesn't exist.
+	Dir string
+	// SegmentSize is the size at which a segment is closed and a new one started
+	SegmentSize int64
+	// MaxSegments is how many segments there can be before they're compacted into one
+	MaxSegments int
+	// SyncInterval is how often the log is synced to disk. Writes reach the OS as they're made, so
+	// they survive the process restarting either way, but one that wasn't synced yet can be lost if
+	// the machine goes down. 0 leaves syncing to the OS.
+	SyncInterval time.Duration
+}
+
+const (
+	opSet    = 1
+	opDelete = 2
+
+	// crc and payload length
+	recordHeaderLen = 4 + 4
+	// op, exptime, flags, key length
+	payloadHeaderLen = 1 + 4 + 4 + 2
+
+	segmentSuffix = ".wal"
+)
+
+var (
+	errWALOpen      = errors.New("The in-memory WAL is already open")
+	errCorruptEntry = errors.New("Corrupt WAL entry")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// wal is the journal of an in-memory store. Every change is appended to the newest segment before
+// it's made, as the entry the key ends up with, or a delete, so replaying the segments in order
+// rebuilds the store. Entries keep their absolute expiration time and expired ones are skipped on
+// replay, and compaction rewrites everything up to the newest segment as just the entries that are
+// still alive. All of it is guarded by its mutex, which is taken after the lock of the shard being
+// written to so each key's changes are logged in the order they're made.
+type wal struct {
+	conf  WALConfig
+	h     *Handler
+	mutex sync.Mutex
+
+	f     *os.File
+	size  int64
+	first uint64
+	last  uint64
+
+	compacting bool
+	buf        []byte
+}
+
+// OpenWAL persists the shared in-memory store to a write-ahead log in conf.Dir, first loading
+// whatever a previous process left there. It can only be opened once.
+func OpenWAL(conf WALConfig) error {
+	return singleton.openWAL(conf)
+}
+
+func (h *Handler) openWAL(conf WALConfig) error {
+	h.lockAll()
+	defer h.unlockAll()
+
+	if h.wal != nil {
+		return errWALOpen
+	}
+
+	if err := os.MkdirAll(conf.Dir, 0755); err != nil {
+		return err
+	}
+
+	ids, err := segments(conf.Dir)
+	if err != nil {
+		return err
+	}
+
+	data := make(map[string]entry)
+	for i, id := range ids {
+		if err := replay(segmentPath(conf.Dir, id), data, i == len(ids)-1); err != nil {
+			return err
+		}
+	}
+
+	// through insert so the entries are held to the limits, see Configure
+	for k, e := range data {
+		if !e.isExpired() {
+			h.shard([]byte(k)).insert(k, e)
+		}
+	}
+
+	w := &wal{conf: conf, h: h}
+	if len(ids) > 0 {
+		w.first, w.last = ids[0], ids[len(ids)-1]
+	}
+
+	// New writes always go to a new segment, so a torn write at the end of the last one is never
+	// followed by good entries
+	if err := w.open(w.last + 1); err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		w.first = w.last
+	}
+	h.wal = w
+
+	if conf.SyncInterval > 0 {
+		go w.syncer(conf.SyncInterval)
+	}
+	w.mutex.Lock()
+	w.maybeCompact()
+	w.mutex.Unlock()
+
+	return nil
+}
+
+// segments lists the ids of the segments in dir, oldest first
+func segments(dir string) ([]uint64, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []uint64
+	for _, name := range names {
+		id, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), segmentSuffix), 16, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func segmentPath(dir string, id uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%016x%s", id, segmentSuffix))
+}
+
+// replay applies the entries in the segment at path to data. A partial or corrupt entry ends the
+// segment: at the end of the last one it's a write that was cut short and it's truncated away,
+// anywhere else it's logged and the rest of the segment is skipped.
+func replay(path string, data map[string]entry, last bool) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var good int64
+
+	for {
+		n, op, key, e, err := readEntry(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			metrics.IncCounter(MetricWALCorrupt)
+			if last {
+				log.Printf("Truncating the in-memory WAL segment %s at %d: %v\n", path, good, err.Error())
+				return f.Truncate(good)
+			}
+			log.Printf("Skipping the rest of the in-memory WAL segment %s from %d: %v\n", path, good, err.Error())
+			return nil
+		}
+		good += n
+
+		metrics.IncCounter(MetricWALReplayed)
+		switch op {
+		case opSet:
+			data[key] = e
+		case opDelete:
+			delete(data, key)
+		}
+	}
+}
+
+// readEntry reads one entry and returns how many bytes it took
+func readEntry(r *bufio.Reader) (int64, byte, string, entry, error) {
+	var hdr [recordHeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errCorruptEntry
+		}
+		return 0, 0, "", entry{}, err
+	}
+
+	crc := binary.BigEndian.Uint32(hdr[0:])
+	length := binary.BigEndian.Uint32(hdr[4:])
+	if length < payloadHeaderLen {
+		return 0, 0, "", entry{}, errCorruptEntry
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil || crc32.Checksum(payload, crcTable) != crc {
+		return 0, 0, "", entry{}, errCorruptEntry
+	}
+
+	op := payload[0]
+	e := entry{
+		exptime: binary.BigEndian.Uint32(payload[1:]),
+		flags:   binary.BigEndian.Uint32(payload[5:]),
+	}
+	keylen := int(binary.BigEndian.Uint16(payload[9:]))
+	if payloadHeaderLen+keylen > len(payload) || (op != opSet && op != opDelete) {
+		return 0, 0, "", entry{}, errCorruptEntry
+	}
+
+	key := string(payload[payloadHeaderLen : payloadHeaderLen+keylen])
+	e.data = payload[payloadHeaderLen+keylen:]
+
+	return recordHeaderLen + int64(length), op, key, e, nil
+}
+
+// encode appends the record for an entry to buf
+func encode(buf []byte, op byte, key string, e entry) []byte {
+	length := payloadHeaderLen + len(key) + len(e.data)
+
+	start := len(buf)
+	buf = append(buf, make([]byte, recordHeaderLen+payloadHeaderLen)...)
+	buf = append(buf, key...)
+	buf = append(buf, e.data...)
+
+	rec := buf[start:]
+	binary.BigEndian.PutUint32(rec[4:], uint32(length))
+	rec[8] = op
+	binary.BigEndian.PutUint32(rec[9:], e.exptime)
+	binary.BigEndian.PutUint32(rec[13:], e.flags)
+	binary.BigEndian.PutUint16(rec[17:], uint16(len(key)))
+	binary.BigEndian.PutUint32(rec[0:], crc32.Checksum(rec[recordHeaderLen:], crcTable))
+
+	return buf
+}
+
+// open starts writing to a new segment
+func (w *wal) open(id uint64) error {
+	f, err := os.OpenFile(segmentPath(w.conf.Dir, id), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w.f, w.size, w.last = f, 0, id
+	return nil
+}
+
+// rotate closes the current segment and starts the next one
+func (w *wal) rotate() error {
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	metrics.IncCounter(MetricWALRotations)
+	return w.open(w.last + 1)
+}
+
+// append writes a change to the current segment, returning an error the client can be given if it
+// couldn't be written, in which case the change must not be made
+func (w *wal) append(op byte, key string, e entry) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.buf = encode(w.buf[:0], op, key, e)
+
+	n, err := w.f.Write(w.buf)
+	w.size += int64(n)
+	if err != nil {
+		log.Println("Error writing to the in-memory WAL:", err.Error())
+		metrics.IncCounter(MetricWALWriteErrors)
+
+		// Whatever made it out is a torn entry that would end the segment on replay, so the
+		// segment is abandoned for a new one
+		if n > 0 {
+			if rerr := w.rotate(); rerr != nil {
+				log.Println("Error rotating the in-memory WAL:", rerr.Error())
+			}
+		}
+		return common.ErrInternal
+	}
+
+	metrics.IncCounter(MetricWALWrites)
+
+	if w.size >= w.conf.SegmentSize {
+		if err := w.rotate(); err != nil {
+			log.Println("Error rotating the in-memory WAL:", err.Error())
+		}
+		w.maybeCompact()
+	}
+
+	return nil
+}
+
+// maybeCompact starts a compaction in the background if there are too many segments and one isn't
+// already running. The mutex must be held.
+func (w *wal) maybeCompact() {
+	if w.compacting || w.last-w.first+1 <= uint64(w.conf.MaxSegments) {
+		return
+	}
+	w.compacting = true
+	go w.compact()
+}
+
+// compact replaces every segment before the current one with a single segment of the entries alive
+// when it started. The snapshot takes the place of the newest of those segments and the older ones
+// are deleted after, so the log replays to the same entries if compaction is cut short at any
+// point. The shards are copied one at a time after the rotation, so some changes made meanwhile
+// can be in both the snapshot and the current segment, which replays over it to the same entries.
+func (w *wal) compact() {
+	w.mutex.Lock()
+	err := w.rotate()
+	upto := w.last - 1
+	first := w.first
+	w.mutex.Unlock()
+
+	var live []keyEntry
+	if err == nil {
+		live = w.h.live()
+	}
+
+	if err == nil {
+		err = writeSegment(w.conf.Dir, upto, func(bw *bufio.Writer) error {
+			return writeEntries(bw, live)
+		})
+		w.h.release(live)
+	}
+	if err == nil {
+		for id := first; id < upto; id++ {
+			if rerr := os.Remove(segmentPath(w.conf.Dir, id)); rerr != nil && !os.IsNotExist(rerr) {
+				err = rerr
+			}
+		}
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.compacting = false
+
+	if err != nil {
+		log.Println("Error compacting the in-memory WAL:", err.Error())
+		metrics.IncCounter(MetricWALCompactErrs)
+		return
+	}
+
+	metrics.IncCounter(MetricWALCompactions)
+	w.first = upto
+
+	// segments may have filled up while this one ran
+	w.maybeCompact()
+}
+
+type keyEntry struct {
+	key string
+	e   entry
+}
+
+// live copies out the entries that haven't expired, a shard at a time. Entries are never modified
+// in place, so the copy stays as it is after each shard's lock is released. The values must be
+// released with release once they're written out.
+func (h *Handler) live() []keyEntry {
+	var live []keyEntry
+	for _, s := range h.shards {
+		s.rlock()
+		for k, e := range s.data {
+			if !e.isExpired() {
+				h.off.retain(e.data)
+				live = append(live, keyEntry{k, e})
+			}
+		}
+		s.mutex.RUnlock()
+	}
+	return live
+}
+
+// release gives up the references to the values of entries copied out by live
+func (h *Handler) release(entries []keyEntry) {
+	for _, x := range entries {
+		h.off.release(x.e.data)
+	}
+}
+
+// writeEntries writes entries as WAL records to w
+func writeEntries(w io.Writer, entries []keyEntry) error {
+	var buf []byte
+	for _, x := range entries {
+		buf = encode(buf[:0], opSet, x.key, x.e)
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSegment atomically replaces the segment id with what write writes
+func writeSegment(dir string, id uint64, write func(*bufio.Writer) error) error {
+	path := segmentPath(dir, id)
+	tmp := path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	if err = write(bw); err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func (w *wal) syncer(interval time.Duration) {
+	for range time.Tick(interval) {
+		w.mutex.Lock()
+		f := w.f
+		w.mutex.Unlock()
+
+		// A segment closed in the meantime was synced when it was rotated out
+		if err := f.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+			log.Println("Error syncing the in-memory WAL:", err.Error())
+			metrics.IncCounter(MetricWALSyncErrors)
+		}
+	}
+}
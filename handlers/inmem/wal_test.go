@@ -0,0 +1,121 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inmem
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+)
+
+func contents(h *Handler) map[string]string {
+	ret := make(map[string]string)
+	live := h.live()
+	for _, x := range live {
+		ret[x.key] = fmt.Sprintf("%s/%d/%d", x.e.data, x.e.flags, x.e.exptime)
+	}
+	h.release(live)
+	return ret
+}
+
+func waitCompacted(t *testing.T, h *Handler) {
+	t.Helper()
+	for i := 0; i < 500; i++ {
+		h.wal.mutex.Lock()
+		done := !h.wal.compacting
+		h.wal.mutex.Unlock()
+		if done {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("Timed out waiting for the compaction")
+}
+
+func TestWAL(t *testing.T) {
+	conf := WALConfig{Dir: t.TempDir(), SegmentSize: 256, MaxSegments: 3}
+
+	h := newHandler(4)
+	if err := h.openWAL(conf); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.openWAL(conf); err != errWALOpen {
+		t.Fatalf("Expected a second open to fail, got %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprint("key", i%20))
+		h.Set(common.SetRequest{Key: key, Data: []byte(fmt.Sprint("value", i)), Flags: uint32(i)})
+		switch i % 5 {
+		case 1:
+			h.Delete(common.DeleteRequest{Key: key})
+		case 2:
+			h.Append(common.SetRequest{Key: key, Data: []byte("-appended")})
+		case 3:
+			h.Touch(common.TouchRequest{Key: key, Exptime: 3600})
+		}
+	}
+
+	// Already expired, so it's left out of the replay
+	past := uint32(time.Now().Add(-time.Hour).Unix())
+	h.Set(common.SetRequest{Key: []byte("expired"), Data: []byte("gone"), Exptime: past})
+
+	waitCompacted(t, h)
+
+	expected := contents(h)
+	if len(expected) == 0 {
+		t.Fatal("Expected some keys to be left")
+	}
+
+	ids, err := segments(conf.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) > conf.MaxSegments {
+		t.Fatalf("Expected the segments to be compacted, got %d", len(ids))
+	}
+
+	// A write cut short by a crash is at the end of the last segment
+	f, err := os.OpenFile(segmentPath(conf.Dir, ids[len(ids)-1]), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(encode(nil, opSet, "torn", entry{data: []byte("torn value")})[:12])
+	f.Close()
+
+	restarted := newHandler(4)
+	if err := restarted.openWAL(conf); err != nil {
+		t.Fatal(err)
+	}
+	waitCompacted(t, restarted)
+	if got := contents(restarted); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected the replay to give\n%v\ngot\n%v", expected, got)
+	}
+
+	// The torn write is gone, so writes after it are replayed too
+	restarted.Set(common.SetRequest{Key: []byte("after"), Data: []byte("restart")})
+	again := newHandler(4)
+	if err := again.openWAL(conf); err != nil {
+		t.Fatal(err)
+	}
+	waitCompacted(t, again)
+	if got := contents(again); len(got) != len(expected)+1 || got["after"] == "" {
+		t.Fatalf("Expected the write after the restart to be replayed, got %v", got)
+	}
+}
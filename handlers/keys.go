@@ -0,0 +1,98 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/netflix/rend/common"
+)
+
+// KeyLister is implemented by handlers that can enumerate the keys their backend holds, like
+// memcached's lru_crawler metadump. It's optional and meant for administration, not for serving
+// requests: listing may be slow and, for backends that keep writing while it runs, is only a
+// snapshot of some moment during the listing.
+type KeyLister interface {
+	Keys(prefix []byte) ([][]byte, error)
+}
+
+// KeyListerV2 is the context-aware form of KeyLister for HandlerV2 implementations.
+type KeyListerV2 interface {
+	Keys(ctx context.Context, prefix []byte) ([][]byte, error)
+}
+
+// Keys returns the keys starting with prefix that h holds, or common.ErrNotSupported if h can't
+// list its keys.
+func Keys(h Handler, prefix []byte) ([][]byte, error) {
+	if kl, ok := h.(KeyLister); ok {
+		return kl.Keys(prefix)
+	}
+	return nil, common.ErrNotSupported
+}
+
+// KeysV2 is the HandlerV2 counterpart of Keys.
+func KeysV2(ctx context.Context, h HandlerV2, prefix []byte) ([][]byte, error) {
+	if kl, ok := h.(KeyListerV2); ok {
+		return kl.Keys(ctx, prefix)
+	}
+	return nil, common.ErrNotSupported
+}
+
+func (v v2Handler) Keys(ctx context.Context, prefix []byte) ([][]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer v.interrupt(ctx)()
+	return Keys(v.h, prefix)
+}
+
+func (v v1Handler) Keys(prefix []byte) ([][]byte, error) {
+	return KeysV2(context.Background(), v.h, prefix)
+}
+
+// Purge deletes every key starting with prefix from h, or with expire set, touches them to expire
+// in a second instead. Keys that disappear on their own in the meantime don't count as errors. It
+// returns how many keys were purged, which is accurate up to the first error.
+func Purge(h Handler, prefix []byte, expire bool) (int, error) {
+	keys, err := Keys(h, prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, key := range keys {
+		// backends should only return matching keys, but a purge is not the place to trust that
+		if !bytes.HasPrefix(key, prefix) {
+			continue
+		}
+
+		if expire {
+			err = h.Touch(common.TouchRequest{Key: key, Exptime: 1})
+		} else {
+			err = h.Delete(common.DeleteRequest{Key: key})
+		}
+
+		switch err {
+		case nil:
+			purged++
+		case common.ErrKeyNotFound:
+		default:
+			return purged, err
+		}
+	}
+
+	return purged, nil
+}
@@ -0,0 +1,55 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers_test
+
+import (
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/inmem"
+)
+
+func TestPurge(t *testing.T) {
+	h, _ := inmem.New()
+	for _, key := range []string{"catalog:v3:a", "catalog:v3:b", "catalog:v2:a", "catalog"} {
+		h.Set(common.SetRequest{Key: []byte(key), Data: []byte("x")})
+	}
+
+	n, err := handlers.Purge(h, []byte("catalog:v3:"), false)
+	if err != nil || n != 2 {
+		t.Fatalf("Expected 2 keys purged, got %d %v", n, err)
+	}
+
+	keys, _ := handlers.Keys(h, []byte("catalog"))
+	if len(keys) != 2 {
+		t.Fatalf("Expected the other 2 keys to be left, got %q", keys)
+	}
+
+	// expiring touches the keys instead, so they're still there for now
+	if n, err := handlers.Purge(h, []byte("catalog:v2:"), true); err != nil || n != 1 {
+		t.Fatalf("Expected 1 key expired, got %d %v", n, err)
+	}
+	if keys, _ := handlers.Keys(h, []byte("catalog:v2:")); len(keys) != 1 {
+		t.Fatalf("Expected the expired key to be there until it expires, got %q", keys)
+	}
+
+	// hides the inmem handler's Keys
+	var unlisted struct{ handlers.Handler }
+	unlisted.Handler = h
+	if _, err := handlers.Purge(unlisted, []byte("catalog"), false); err != common.ErrNotSupported {
+		t.Fatalf("Expected handlers that can't list keys to not be purged, got %v", err)
+	}
+}
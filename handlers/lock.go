@@ -0,0 +1,257 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+
+	"github.com/netflix/rend/common"
+)
+
+// Locker is implemented by handlers with their own locks, like the inmem handler. A lock only keeps
+// out other lockers: gets, writes and deletes of a locked key go through as usual.
+//
+// GetLock fails with common.ErrLocked if the key is already locked and common.ErrKeyNotFound if it
+// isn't there. Unlock fails with common.ErrNotLocked if the key isn't locked (or the lock already
+// expired) and common.ErrLocked if the token is for someone else's lock.
+type Locker interface {
+	GetLock(cmd common.GetLockRequest) (common.GetLockResponse, error)
+	Unlock(cmd common.UnlockRequest) error
+}
+
+// LockerV2 is the context-aware form of Locker for HandlerV2 implementations.
+type LockerV2 interface {
+	GetLock(ctx context.Context, cmd common.GetLockRequest) (common.GetLockResponse, error)
+	Unlock(ctx context.Context, cmd common.UnlockRequest) error
+}
+
+// GetLock locks the key in cmd and gets its value using h. For handlers that don't implement
+// Locker, the lock is emulated with a lock key next to the key: an add of the lock key that expires
+// with the lock, holding the token. A released lock leaves an empty lock key behind for a moment,
+// which is taken over by a compare and swap.
+func GetLock(h Handler, cmd common.GetLockRequest) (common.GetLockResponse, error) {
+	if l, ok := h.(Locker); ok {
+		return l.GetLock(cmd)
+	}
+	return emulatedGetLock(context.Background(), V2(h), cmd)
+}
+
+// Unlock releases the lock on the key in cmd using h. The emulated lock is released by a compare
+// and swap of the lock key as it was when its token was checked, so a lock that expires in between
+// and is taken by someone else stays theirs. Handlers that don't implement CASer only emulate the
+// compare and swap, see CompareAndSwap. With handlers that can't do that either, the lock key is
+// deleted after the check, so a lock taken in between by someone else is released.
+func Unlock(h Handler, cmd common.UnlockRequest) error {
+	if l, ok := h.(Locker); ok {
+		return l.Unlock(cmd)
+	}
+	return emulatedUnlock(context.Background(), V2(h), cmd)
+}
+
+// GetLockV2 is the HandlerV2 counterpart of GetLock.
+func GetLockV2(ctx context.Context, h HandlerV2, cmd common.GetLockRequest) (common.GetLockResponse, error) {
+	if l, ok := h.(LockerV2); ok {
+		return l.GetLock(ctx, cmd)
+	}
+	return emulatedGetLock(ctx, h, cmd)
+}
+
+// UnlockV2 is the HandlerV2 counterpart of Unlock.
+func UnlockV2(ctx context.Context, h HandlerV2, cmd common.UnlockRequest) error {
+	if l, ok := h.(LockerV2); ok {
+		return l.Unlock(ctx, cmd)
+	}
+	return emulatedUnlock(ctx, h, cmd)
+}
+
+func (v v2Handler) GetLock(ctx context.Context, cmd common.GetLockRequest) (common.GetLockResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return common.GetLockResponse{}, err
+	}
+	defer v.interrupt(ctx)()
+	return GetLock(v.h, cmd)
+}
+
+func (v v2Handler) Unlock(ctx context.Context, cmd common.UnlockRequest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer v.interrupt(ctx)()
+	return Unlock(v.h, cmd)
+}
+
+func (v v1Handler) GetLock(cmd common.GetLockRequest) (common.GetLockResponse, error) {
+	return GetLockV2(context.Background(), v.h, cmd)
+}
+
+func (v v1Handler) Unlock(cmd common.UnlockRequest) error {
+	return UnlockV2(context.Background(), v.h, cmd)
+}
+
+// NewLockToken returns a random token for a new lock. It's never 0, so clients can use 0 to mean no
+// lock.
+func NewLockToken() (uint64, error) {
+	var buf [8]byte
+	for {
+		if _, err := rand.Read(buf[:]); err != nil {
+			return 0, err
+		}
+		if token := binary.BigEndian.Uint64(buf[:]); token != 0 {
+			return token, nil
+		}
+	}
+}
+
+func emulatedGetLock(ctx context.Context, h HandlerV2, cmd common.GetLockRequest) (common.GetLockResponse, error) {
+	token, err := NewLockToken()
+	if err != nil {
+		return common.GetLockResponse{}, err
+	}
+	tokenBuf := make([]byte, 8)
+	binary.BigEndian.PutUint64(tokenBuf, token)
+
+	lock := lockKey(cmd.Key)
+	set := common.SetRequest{Key: lock, Data: tokenBuf, Exptime: common.LockTimeOf(cmd)}
+	err = h.Add(ctx, set)
+	if errors.Is(err, common.ErrKeyExists) || errors.Is(err, common.ErrItemNotStored) {
+		err = takeReleasedLock(ctx, h, set)
+	}
+	if err != nil {
+		return common.GetLockResponse{}, err
+	}
+
+	res, err := getOne(ctx, h, cmd.Key, false)
+	if err == nil && res.Miss {
+		err = common.ErrKeyNotFound
+	}
+	if err != nil {
+		// nothing to hold a lock on
+		emulatedUnlock(ctx, h, common.UnlockRequest{Key: cmd.Key, Token: token})
+		return common.GetLockResponse{}, err
+	}
+
+	return common.GetLockResponse{
+		Key:    cmd.Key,
+		Data:   res.Data,
+		Opaque: cmd.Opaque,
+		Flags:  res.Flags,
+		Token:  token,
+	}, nil
+}
+
+// releasedLockTime is how long, in seconds, the empty lock key of a released lock is kept. It can't
+// be deleted only if it's unchanged, so it's swapped for an empty one that expires soon instead.
+const releasedLockTime = 1
+
+// takeReleasedLock locks with set, a lock key holding a new token, if the lock key that's there
+// already is one left behind by an unlock
+func takeReleasedLock(ctx context.Context, h HandlerV2, set common.SetRequest) error {
+	res, err := getOne(ctx, h, set.Key, true)
+	if err != nil {
+		return err
+	}
+	if res.Miss {
+		// Expired since the add, and could be locked again by anyone. Leave it to the next try.
+		return common.ErrLocked
+	}
+	if len(res.Data) != 0 {
+		return common.ErrLocked
+	}
+
+	err = CompareAndSwapV2(ctx, h, common.CASRequest{SetRequest: set, Cas: res.Cas})
+	if errors.Is(err, common.ErrKeyExists) || errors.Is(err, common.ErrKeyNotFound) || errors.Is(err, common.ErrNotSupported) {
+		return common.ErrLocked
+	}
+	return err
+}
+
+func emulatedUnlock(ctx context.Context, h HandlerV2, cmd common.UnlockRequest) error {
+	lock := lockKey(cmd.Key)
+
+	res, err := getOne(ctx, h, lock, true)
+	if err != nil {
+		return err
+	}
+	if res.Miss || len(res.Data) == 0 {
+		return common.ErrNotLocked
+	}
+	if len(res.Data) != 8 || binary.BigEndian.Uint64(res.Data) != cmd.Token {
+		return common.ErrLocked
+	}
+
+	err = CompareAndSwapV2(ctx, h, common.CASRequest{
+		SetRequest: common.SetRequest{Key: lock, Data: []byte{}, Exptime: releasedLockTime},
+		Cas:        res.Cas,
+	})
+	switch {
+	case errors.Is(err, common.ErrKeyExists):
+		// expired and locked again by someone else
+		return common.ErrLocked
+	case errors.Is(err, common.ErrKeyNotFound):
+		return common.ErrNotLocked
+	case errors.Is(err, common.ErrNotSupported):
+		if err := h.Delete(ctx, common.DeleteRequest{Key: lock}); err != nil && !errors.Is(err, common.ErrKeyNotFound) {
+			return err
+		}
+		return nil
+	}
+	return err
+}
+
+// lockKey is the key an emulated lock on key is kept under. Text protocol clients can't send a NUL
+// byte in a key, so it won't collide with their keys.
+func lockKey(key []byte) []byte {
+	return append(append(make([]byte, 0, len(key)+5), key...), "\x00lock"...)
+}
+
+// getOne gets a single key, along with its CAS value if cas is set
+func getOne(ctx context.Context, h HandlerV2, key []byte, cas bool) (common.GetResponse, error) {
+	var res common.GetResponse
+	req := common.GetRequest{
+		Keys:    [][]byte{key},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	}
+	var resChan <-chan common.GetResponse
+	var errChan <-chan error
+	if cas {
+		resChan, errChan = GetsV2(ctx, h, req)
+	} else {
+		resChan, errChan = h.Get(ctx, req)
+	}
+
+	var err error
+	for resChan != nil || errChan != nil {
+		select {
+		case r, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			} else {
+				res = r
+			}
+		case e, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			} else {
+				err = e
+			}
+		}
+	}
+
+	return res, err
+}
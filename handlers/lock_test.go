@@ -0,0 +1,142 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers_test
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/clock"
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/inmem"
+)
+
+// casOnly hides the inmem handler's own locks but not its CAS values
+type casOnly struct {
+	handlers.Handler
+	handlers.CASer
+}
+
+func TestLock(t *testing.T) {
+	h, _ := inmem.New()
+
+	// hides the inmem handler's own locks, so they're emulated with lock keys
+	var emulated struct{ handlers.Handler }
+	emulated.Handler = h
+	// emulated locks released with the inmem handler's compare and swap
+	cas := casOnly{Handler: h, CASer: h.(handlers.CASer)}
+
+	for name, lh := range map[string]handlers.Handler{"native": h, "emulated": emulated, "cas": cas} {
+		key := []byte("lock:" + name)
+
+		if _, err := handlers.GetLock(lh, common.GetLockRequest{Key: key}); err != common.ErrKeyNotFound {
+			t.Fatalf("%s: Expected a miss locking a key that isn't there, got %v", name, err)
+		}
+
+		h.Set(common.SetRequest{Key: key, Data: []byte("x"), Flags: 7})
+
+		res, err := handlers.GetLock(lh, common.GetLockRequest{Key: key, Opaque: 3})
+		if err != nil {
+			t.Fatalf("%s: Error locking: %v", name, err)
+		}
+		if string(res.Data) != "x" || res.Flags != 7 || res.Opaque != 3 || res.Token == 0 {
+			t.Fatalf("%s: Unexpected lock response: %+v", name, res)
+		}
+
+		if _, err := handlers.GetLock(lh, common.GetLockRequest{Key: key}); err != common.ErrLocked {
+			t.Fatalf("%s: Expected a second lock to fail, got %v", name, err)
+		}
+
+		// writes go through
+		if err := h.Set(common.SetRequest{Key: key, Data: []byte("y")}); err != nil {
+			t.Fatalf("%s: Expected writes to a locked key to work, got %v", name, err)
+		}
+
+		if err := handlers.Unlock(lh, common.UnlockRequest{Key: key, Token: res.Token + 1}); err != common.ErrLocked {
+			t.Fatalf("%s: Expected unlocking with the wrong token to fail, got %v", name, err)
+		}
+		if err := handlers.Unlock(lh, common.UnlockRequest{Key: key, Token: res.Token}); err != nil {
+			t.Fatalf("%s: Error unlocking: %v", name, err)
+		}
+		if err := handlers.Unlock(lh, common.UnlockRequest{Key: key, Token: res.Token}); err != common.ErrNotLocked {
+			t.Fatalf("%s: Expected unlocking twice to fail, got %v", name, err)
+		}
+
+		res, err = handlers.GetLock(lh, common.GetLockRequest{Key: key})
+		if err != nil || string(res.Data) != "y" {
+			t.Fatalf("%s: Expected to lock again after unlocking, got %+v %v", name, res, err)
+		}
+	}
+}
+
+type fakeClock struct {
+	now int64
+}
+
+func (f *fakeClock) Now() time.Time {
+	return time.Unix(atomic.LoadInt64(&f.now), 0)
+}
+
+// beforeSwap runs a func before the first compare and swap it's asked to do
+type beforeSwap struct {
+	casOnly
+	f func()
+}
+
+func (b *beforeSwap) CompareAndSwap(cmd common.CASRequest) error {
+	if f := b.f; f != nil {
+		b.f = nil
+		f()
+	}
+	return b.casOnly.CompareAndSwap(cmd)
+}
+
+func TestUnlockAfterExpiry(t *testing.T) {
+	fake := &fakeClock{now: time.Now().Unix()}
+	clock.Set(fake)
+	defer clock.Set(clock.Monotonic())
+
+	h, _ := inmem.New()
+	other := casOnly{Handler: h, CASer: h.(handlers.CASer)}
+	lh := &beforeSwap{casOnly: other}
+	key := []byte("foo")
+	h.Set(common.SetRequest{Key: key, Data: []byte("x")})
+
+	first, err := handlers.GetLock(lh, common.GetLockRequest{Key: key, LockTime: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first lock expires and the key is locked again after its token was checked
+	var second common.GetLockResponse
+	lh.f = func() {
+		atomic.AddInt64(&fake.now, 5)
+		if second, err = handlers.GetLock(other, common.GetLockRequest{Key: key, LockTime: 10}); err != nil {
+			t.Fatalf("Expected to lock again after the lock expired, got %v", err)
+		}
+	}
+
+	if err := handlers.Unlock(lh, common.UnlockRequest{Key: key, Token: first.Token}); err != common.ErrLocked {
+		t.Fatalf("Expected unlocking an expired lock taken by someone else to fail, got %v", err)
+	}
+	if _, err := handlers.GetLock(lh, common.GetLockRequest{Key: key}); err != common.ErrLocked {
+		t.Fatalf("Expected the second lock to still hold the key, got %v", err)
+	}
+	if err := handlers.Unlock(lh, common.UnlockRequest{Key: key, Token: second.Token}); err != nil {
+		t.Fatalf("Error unlocking the second lock: %v", err)
+	}
+}
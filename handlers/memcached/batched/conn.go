@@ -18,6 +18,7 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
 	"math/rand"
 	"net"
@@ -362,7 +363,7 @@ func (c conn) reader() {
 					oops(ioerr, batch.responses)
 				}
 
-				if err != common.ErrKeyNotFound && err != common.ErrKeyExists && err != common.ErrItemNotStored {
+				if !errors.Is(err, common.ErrKeyNotFound) && !errors.Is(err, common.ErrKeyExists) && !errors.Is(err, common.ErrItemNotStored) {
 					println("UH OH", err.Error())
 				}
 
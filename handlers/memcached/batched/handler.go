@@ -16,6 +16,7 @@ package batched
 
 import (
 	"math/rand"
+	"net"
 
 	"github.com/netflix/rend/common"
 )
@@ -39,6 +40,9 @@ type Opts struct {
 	EvaluationIntervalSec uint32
 	LoadFactorExpandRatio float64
 	OverloadedConnRatio   float64
+
+	// Dial connects to the backend. Nil uses net.Dial.
+	Dial func(network, addr string) (net.Conn, error)
 }
 
 var defaultOpts = Opts{
@@ -51,18 +55,21 @@ var defaultOpts = Opts{
 	OverloadedConnRatio:   0.2,
 }
 
+// uint32ValueOrDefault and float64ValueOrDefault give the default for a setting left at 0 and keep
+// any other value. They used to do the opposite, so every setting in Opts was ignored in favor of
+// its default and settings left at 0 stayed 0.
 func uint32ValueOrDefault(val uint32, def uint32) uint32 {
 	if val <= 0 {
-		return val
+		return def
 	}
-	return def
+	return val
 }
 
 func float64ValueOrDefault(val float64, def float64) float64 {
 	if val <= 0 {
-		return val
+		return def
 	}
-	return def
+	return val
 }
 
 // NewHandler creates a new handler with the given unix socket as the connected backend. The first
@@ -88,6 +95,7 @@ func NewHandler(sock string, opts Opts) Handler {
 		EvaluationIntervalSec: uint32ValueOrDefault(opts.EvaluationIntervalSec, defaultOpts.EvaluationIntervalSec),
 		LoadFactorExpandRatio: float64ValueOrDefault(opts.LoadFactorExpandRatio, defaultOpts.LoadFactorExpandRatio),
 		OverloadedConnRatio:   float64ValueOrDefault(opts.OverloadedConnRatio, defaultOpts.OverloadedConnRatio),
+		Dial:                  opts.Dial,
 	}
 
 	return Handler{
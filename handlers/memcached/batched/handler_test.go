@@ -0,0 +1,32 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package batched
+
+import "testing"
+
+func TestValueOrDefault(t *testing.T) {
+	if v := uint32ValueOrDefault(0, defaultOpts.BatchSize); v != defaultOpts.BatchSize {
+		t.Errorf("Expected an unset batch size to be the default, got %d", v)
+	}
+	if v := uint32ValueOrDefault(100, defaultOpts.BatchSize); v != 100 {
+		t.Errorf("Expected a batch size of 100 to be kept, got %d", v)
+	}
+	if v := float64ValueOrDefault(0, defaultOpts.OverloadedConnRatio); v != defaultOpts.OverloadedConnRatio {
+		t.Errorf("Expected an unset ratio to be the default, got %f", v)
+	}
+	if v := float64ValueOrDefault(0.5, defaultOpts.OverloadedConnRatio); v != 0.5 {
+		t.Errorf("Expected a ratio of 0.5 to be kept, got %f", v)
+	}
+}
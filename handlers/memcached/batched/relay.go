@@ -21,6 +21,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/netflix/rend/handlers/pool"
 	"github.com/netflix/rend/metrics"
 )
 
@@ -102,7 +103,12 @@ func (r *relay) addConn() {
 	r.addConnLock.Lock()
 	defer r.addConnLock.Unlock()
 
-	c, err := net.Dial("unix", r.sock)
+	dial := r.opts.Dial
+	if dial == nil {
+		dial = net.Dial
+	}
+
+	c, err := dial(pool.Network(r.sock), r.sock)
 	if err != nil {
 		// For now, just increment the metric and return.
 		metrics.IncCounter(MetricBatchConnectionFailure)
@@ -17,11 +17,14 @@ package chunked
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"io"
 	"math"
-	"time"
+	"strconv"
 
+	"github.com/netflix/rend/clock"
 	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
 	"github.com/netflix/rend/metrics"
 	"github.com/netflix/rend/protocol/binprot"
 )
@@ -94,6 +97,13 @@ var (
 	MetricCmdPrependMissesToken   = metrics.AddCounter("cmd_prepend_misses_token", nil)
 	MetricCmdPrependMissesTokenL1 = metrics.AddCounter("cmd_prepend_misses_token_l1", nil)
 	MetricCmdPrependMissesTokenL2 = metrics.AddCounter("cmd_prepend_misses_token_l2", nil)
+
+	// Sets that failed part way through their chunks, and whether the metadata could be deleted
+	// after. Reads of values with missing chunks or chunks from another write are torn reads.
+	MetricCmdSetTorn              = metrics.AddCounter("cmd_set_torn", nil)
+	MetricCmdSetTornCleanups      = metrics.AddCounter("cmd_set_torn_cleanups", nil)
+	MetricCmdSetTornCleanupErrors = metrics.AddCounter("cmd_set_torn_cleanup_errors", nil)
+	MetricTornReads               = metrics.AddCounter("torn_reads", nil)
 )
 
 func readResponseHeader(r *bufio.Reader) (binprot.ResponseHeader, error) {
@@ -111,26 +121,52 @@ func readResponseHeader(r *bufio.Reader) (binprot.ResponseHeader, error) {
 	return resHeader, nil
 }
 
+// the bufio default
+const defaultBufSize = 4096
+
 // Handler implements a backend for Rend that communicates to a remote memcached server
 type Handler struct {
-	rw   *bufio.ReadWriter
-	conn io.ReadWriteCloser
+	rw    *bufio.ReadWriter
+	conn  io.ReadWriteCloser
+	tiers tiers
 }
 
 // NewHandler returns an implementation of handlers.Handler that implements a special interaction
 // with the memcached server to pack data into fixed-size chunks in order to store either very
 // large objects or to avoid memory fragmentation overhead when data sizes rapidly change.
 func NewHandler(conn io.ReadWriteCloser) Handler {
-	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	return NewHandlerSize(conn, 0, 0)
+}
+
+// NewHandlerSize is the same as NewHandler but with the given read and write buffer sizes, in
+// bytes. Sizes of 0 or less use the bufio default.
+func NewHandlerSize(conn io.ReadWriteCloser, readBufSize, writeBufSize int) Handler {
+	return NewHandlerTiers(conn, readBufSize, writeBufSize, nil)
+}
+
+// NewHandlerTiers is the same as NewHandlerSize but splits values into chunks of one of the given
+// sizes, picked per value, instead of DefaultChunkSizes. The sizes are the full size of each chunk
+// in memcached and must pass CheckChunkSizes. Items written with any other chunk size, e.g. before
+// the sizes were changed, are still read as written.
+func NewHandlerTiers(conn io.ReadWriteCloser, readBufSize, writeBufSize int, chunkSizes []int) Handler {
+	if readBufSize <= 0 {
+		readBufSize = defaultBufSize
+	}
+	if writeBufSize <= 0 {
+		writeBufSize = defaultBufSize
+	}
+
+	rw := bufio.NewReadWriter(bufio.NewReaderSize(conn, readBufSize), bufio.NewWriterSize(conn, writeBufSize))
 	return Handler{
-		rw:   rw,
-		conn: conn,
+		rw:    rw,
+		conn:  conn,
+		tiers: newTiers(chunkSizes),
 	}
 }
 
 func (h Handler) reset() {
-	h.rw.Reader.Reset(bufio.NewReader(h.conn))
-	h.rw.Writer.Reset(bufio.NewWriter(h.conn))
+	h.rw.Reader.Reset(h.conn)
+	h.rw.Writer.Reset(h.conn)
 }
 
 // Close closes the Handler's underlying io.ReadWriteCloser.
@@ -139,6 +175,14 @@ func (h Handler) Close() error {
 	return h.conn.Close()
 }
 
+// Ping sends a noop to the remote backend to check that it answers
+func (h Handler) Ping() error {
+	if err := binprot.WriteNoopCmd(h.rw.Writer, 0); err != nil {
+		return err
+	}
+	return simpleCmdLocal(h.rw, true)
+}
+
 // Set performs a set request on the remote backend
 func (h Handler) Set(cmd common.SetRequest) error {
 	return h.handleSetCommon(cmd, common.RequestSet)
@@ -155,11 +199,6 @@ func (h Handler) Replace(cmd common.SetRequest) error {
 }
 
 const (
-	// TODO: Make configurable at command line
-	// might be a constructor argument
-	// Slab 12, ~1KB per chunk
-	chunkMaxSize = 1184
-
 	// Format of headers in memcached:
 	//
 	// Key size + 1 + Header (Flags + Key + 2 bytes (\r\n) + 4 bytes (2 spaces and 1 \r)) + Chunk Size + CAS Size + 3
@@ -178,15 +217,6 @@ const (
 	chunkOverhead = 67 + 4
 )
 
-func chunkSize(keylen int) (dataSize, fullSize uint32) {
-	fullSize = uint32(chunkMaxSize - chunkOverhead - keylen)
-	dataSize = fullSize - tokenSize
-	return
-}
-
-// The maximum differential TTL allowed by memcached
-const realTimeMaxDelta = 60 * 60 * 24 * 30
-
 // Takes a TTL in seconds and returns the unix time in seconds when the item will expire.
 func exptime(ttl uint32) (exp uint32, expired bool) {
 	// zero is the special forever case
@@ -194,11 +224,11 @@ func exptime(ttl uint32) (exp uint32, expired bool) {
 		return 0, false
 	}
 
-	now := uint32(time.Now().Unix())
+	now := clock.Unix()
 
 	// The memcached protocol has a... "quirk" where any expiration time over 30
 	// days is considered to be a unix timestamp.
-	if ttl > realTimeMaxDelta {
+	if ttl > clock.RealTimeMaxDelta {
 		return ttl, (ttl < now)
 	}
 
@@ -213,7 +243,15 @@ func (h Handler) handleSetCommon(cmd common.SetRequest, reqType common.RequestTy
 	}
 
 	// Specialized chunk reader to make the code here much simpler
-	dataSize, fullSize := chunkSize(len(cmd.Key))
+	dataSize, fullSize := h.tiers.chunkSize(len(cmd.Key), len(cmd.Data))
+	if cmd.Flags&common.FlagMask(common.FlagNoChunk) != 0 {
+		if d, f, ok := whole(len(cmd.Key), len(cmd.Data)); ok {
+			dataSize, fullSize = d, f
+			metrics.IncCounter(MetricCmdSetUnchunked)
+		} else {
+			metrics.IncCounter(MetricCmdSetUnchunkedTooLarge)
+		}
+	}
 	limChunkReader := newChunkLimitedReader(bytes.NewBuffer(cmd.Data), int64(dataSize), int64(len(cmd.Data)))
 	numChunks := int(math.Ceil(float64(len(cmd.Data)) / float64(dataSize)))
 	token := <-tokens
@@ -225,7 +263,7 @@ func (h Handler) handleSetCommon(cmd common.SetRequest, reqType common.RequestTy
 		NumChunks: uint32(numChunks),
 		ChunkSize: dataSize,
 		Token:     token,
-		Instime:   uint32(time.Now().Unix()),
+		Instime:   clock.Unix(),
 		Exptime:   exp,
 	}
 
@@ -266,17 +304,15 @@ func (h Handler) handleSetCommon(cmd common.SetRequest, reqType common.RequestTy
 			return ioerr
 		}
 
-		// For Add and Replace, the error here will be common.ErrKeyExists or common.ErrKeyNotFound
-		// respectively. For each, this is the right response to send to the requestor. The error
-		// here is overloaded because it would signal a true error for sets, but a normal "error"
-		// response for Add and Replace.
+		// For Add and Replace, the error here will be common.ErrNotAdded or common.ErrKeyNotFound
+		// respectively. For each, this is the right response to send to the requestor. It would
+		// signal a true error for sets, but a normal "error" response for Add and Replace.
 		return err
 	}
 
-	// Write all the data chunks
-	// TODO: Clean up if a data chunk write fails
-	// Failure can mean the write failing at the I/O level
-	// or at the memcached level, e.g. response == ERROR
+	// Write all the data chunks. From here on the metadata points to chunks that may not all be
+	// written, so a failure has to clean it up; otherwise readers would fetch every chunk only to
+	// find out from the tokens that the value is torn.
 	chunkNum := 0
 	for limChunkReader.More() {
 		// Build this chunk's key
@@ -284,46 +320,43 @@ func (h Handler) handleSetCommon(cmd common.SetRequest, reqType common.RequestTy
 
 		// Write the key
 		if err := binprot.WriteSetCmd(h.rw.Writer, key, cmd.Flags, cmd.Exptime, fullSize, 0); err != nil {
-			return err
+			return h.tornSet(cmd.Key, err, false)
 		}
 		// Write token
 		n, err := h.rw.Write(token[:])
 		metrics.IncCounterBy(common.MetricBytesWrittenLocal, uint64(n))
 		if err != nil {
-			return err
+			return h.tornSet(cmd.Key, err, false)
 		}
 		// Write value
 		n2, err := io.Copy(h.rw.Writer, limChunkReader)
 		metrics.IncCounterBy(common.MetricBytesWrittenLocal, uint64(n2))
 		if err != nil {
-			return err
+			return h.tornSet(cmd.Key, err, false)
 		}
 		// There's some additional overhead here calling Flush() because it causes a write() syscall
 		// The set case is already a slow path and is async from the client perspective for our use
 		// case so this is not a problem.
 		if err := h.rw.Flush(); err != nil {
-			return err
+			return h.tornSet(cmd.Key, err, false)
 		}
 
 		// Read server's response
 		resHeader, err = readResponseHeader(h.rw.Reader)
 		if err != nil {
-			if err == common.ErrNoMem {
+			if errors.Is(err, common.ErrNoMem) {
 				metrics.IncCounter(MetricCmdSetErrorsOOM)
 			}
-			// Reset the ReadWriter to prevent sending garbage to memcached
-			// otherwise we get disconnected. This is last-ditch and probably won't help. We should
-			// probably just disconnect and reconnect to clear OS buffers
-			h.reset()
 
-			// Discard repsonse body
+			// Discard response body. Once it's read the connection is in sync again, so the
+			// metadata can be deleted on it.
 			n, ioerr := h.rw.Discard(int(resHeader.TotalBodyLength))
 			metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
 			if ioerr != nil {
-				return ioerr
+				return h.tornSet(cmd.Key, ioerr, false)
 			}
 
-			return err
+			return h.tornSet(cmd.Key, err, true)
 		}
 
 		// Reset for next iteration
@@ -334,6 +367,33 @@ func (h Handler) handleSetCommon(cmd common.SetRequest, reqType common.RequestTy
 	return nil
 }
 
+// tornSet handles a set that failed with err after its metadata was written. If the connection is
+// still usable the metadata is deleted, so the partial value is a plain miss from then on. If it
+// isn't, nothing more can be sent on it and the torn value is left for readers to find, which they
+// do by its tokens; the stream is reset so the next request doesn't start with a partial one.
+func (h Handler) tornSet(key []byte, err error, usable bool) error {
+	metrics.IncCounter(MetricCmdSetTorn)
+
+	if !usable {
+		h.reset()
+		return err
+	}
+
+	// The key is rebuilt since the chunk keys were appended to the same array
+	if werr := binprot.WriteDeleteCmd(h.rw.Writer, metaKey(key), 0); werr != nil {
+		metrics.IncCounter(MetricCmdSetTornCleanupErrors)
+		return err
+	}
+	switch derr := simpleCmdLocal(h.rw, true); {
+	case derr == nil, errors.Is(derr, common.ErrKeyNotFound):
+		metrics.IncCounter(MetricCmdSetTornCleanups)
+	default:
+		metrics.IncCounter(MetricCmdSetTornCleanupErrors)
+	}
+
+	return err
+}
+
 // Append performs an append request on the remote backend
 func (h Handler) Append(cmd common.SetRequest) error {
 	return h.handleAppendPrependCommon(cmd, common.RequestAppend)
@@ -354,9 +414,74 @@ func (h Handler) handleAppendPrependCommon(cmd common.SetRequest, reqType common
 		panic("Bad request type in appendPrependCommon!")
 	}
 
-	_, metaData, err := getMetadata(h.rw, cmd.Key)
+	dataBuf, metaData, err := h.readWhole(cmd.Key, reqType)
+	if err != nil {
+		return err
+	}
+
+	// append or prepend, the meat of the request
+	if reqType == common.RequestAppend {
+		dataBuf = append(dataBuf, cmd.Data...)
+	} else {
+		dataBuf = append(cmd.Data, dataBuf...)
+	}
+
+	// now put it again. Insert time won't be exact, here, but the expiration is still valid
+	setcmd := common.SetRequest{
+		Key:     cmd.Key,
+		Data:    dataBuf,
+		Flags:   metaData.OrigFlags,
+		Exptime: metaData.Exptime,
+	}
+	return h.handleSetCommon(setcmd, common.RequestSet)
+}
+
+// Incr performs an increment on the remote backend. memcached can't increment a value that's split
+// into chunks, so the value is read, incremented, and written back, like for an append. Concurrent
+// updates of the key can be lost unless they're serialized, e.g. by the locking orchestrator.
+func (h Handler) Incr(cmd common.ArithRequest) (uint64, error) {
+	return h.arith(cmd, false, common.RequestIncr)
+}
+
+// Decr performs a decrement on the remote backend, the same way as Incr
+func (h Handler) Decr(cmd common.ArithRequest) (uint64, error) {
+	return h.arith(cmd, true, common.RequestDecr)
+}
+
+func (h Handler) arith(cmd common.ArithRequest, decr bool, reqType common.RequestType) (uint64, error) {
+	data, metaData, err := h.readWhole(cmd.Key, reqType)
+	if errors.Is(err, common.ErrKeyNotFound) && cmd.Create {
+		setcmd := common.SetRequest{
+			Key:     cmd.Key,
+			Data:    []byte(strconv.FormatUint(cmd.Initial, 10)),
+			Exptime: cmd.Exptime,
+		}
+		return cmd.Initial, h.handleSetCommon(setcmd, common.RequestSet)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	value, err := handlers.ApplyDelta(data, cmd.Delta, decr)
 	if err != nil {
-		if err == common.ErrKeyNotFound {
+		return 0, err
+	}
+
+	setcmd := common.SetRequest{
+		Key:     cmd.Key,
+		Data:    []byte(strconv.FormatUint(value, 10)),
+		Flags:   metaData.OrigFlags,
+		Exptime: metaData.Exptime,
+	}
+	return value, h.handleSetCommon(setcmd, common.RequestSet)
+}
+
+// readWhole reads every chunk of the value of key, for the commands that change a value based on
+// what it was. A value with chunks missing or from another write is a miss.
+func (h Handler) readWhole(key []byte, reqType common.RequestType) ([]byte, metadata, error) {
+	_, metaData, err := getMetadata(h.rw, key)
+	if err != nil {
+		if errors.Is(err, common.ErrKeyNotFound) {
 			switch reqType {
 			case common.RequestAppend:
 				metrics.IncCounter(MetricCmdAppendMissesMeta)
@@ -364,27 +489,27 @@ func (h Handler) handleAppendPrependCommon(cmd common.SetRequest, reqType common
 				metrics.IncCounter(MetricCmdPrependMissesMeta)
 			}
 
-			return common.ErrKeyNotFound
+			return nil, metaData, common.ErrKeyNotFound
 		}
 
-		return err
+		return nil, metaData, err
 	}
 
 	// Write all the get commands before reading
-	cmdSize := int(metaData.NumChunks)*(len(cmd.Key)+4 /* key suffix */ +binprot.ReqHeaderLen) + binprot.ReqHeaderLen /* for the noop */
+	cmdSize := int(metaData.NumChunks)*(len(key)+4 /* key suffix */ +binprot.ReqHeaderLen) + binprot.ReqHeaderLen /* for the noop */
 	cmdbuf := bytes.NewBuffer(make([]byte, 0, cmdSize))
 	for i := 0; i < int(metaData.NumChunks); i++ {
-		chunkKey := chunkKey(cmd.Key, i)
+		chunkKey := chunkKey(key, i)
 		binprot.WriteGetQCmd(cmdbuf, chunkKey, 0)
 	}
 	binprot.WriteNoopCmd(cmdbuf, 0)
 
 	// Write everyhing and flush to ensure it's sent
 	if _, err := h.rw.ReadFrom(cmdbuf); err != nil {
-		return err
+		return nil, metaData, err
 	}
 	if err := h.rw.Flush(); err != nil {
-		return err
+		return nil, metaData, err
 	}
 
 	dataBuf := make([]byte, int(metaData.Length))
@@ -402,7 +527,7 @@ func (h Handler) handleAppendPrependCommon(cmd common.SetRequest, reqType common
 	for {
 		opcodeNoop, err := getLocalIntoBuf(h.rw.Reader, metaData, tokenBuf, dataBuf, chunk, int(metaData.ChunkSize))
 		if err != nil {
-			if err == common.ErrKeyNotFound {
+			if errors.Is(err, common.ErrKeyNotFound) {
 				if !miss {
 					switch reqType {
 					case common.RequestAppend:
@@ -438,28 +563,14 @@ func (h Handler) handleAppendPrependCommon(cmd common.SetRequest, reqType common
 	}
 
 	if lastErr != nil {
-		return lastErr
+		return nil, metaData, lastErr
 	}
 	if miss {
-		//fmt.Println("Get miss because of missing chunk")
-		return common.ErrKeyNotFound
-	}
-
-	// append or prepend, the meat of the request
-	if reqType == common.RequestAppend {
-		dataBuf = append(dataBuf, cmd.Data...)
-	} else {
-		dataBuf = append(cmd.Data, dataBuf...)
+		metrics.IncCounter(MetricTornReads)
+		return nil, metaData, common.ErrKeyNotFound
 	}
 
-	// now put it again. Insert time won't be exact, here, but the expiration is still valid
-	setcmd := common.SetRequest{
-		Key:     cmd.Key,
-		Data:    dataBuf,
-		Flags:   metaData.OrigFlags,
-		Exptime: metaData.Exptime,
-	}
-	return h.handleSetCommon(setcmd, common.RequestSet)
+	return dataBuf, metaData, nil
 }
 
 // Get performs a batched get request on the remote backend. The channels returned
@@ -469,11 +580,11 @@ func (h Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan e
 	// No buffering here so there's not multiple gets in memory
 	dataOut := make(chan common.GetResponse)
 	errorOut := make(chan error)
-	go realHandleGet(cmd, dataOut, errorOut, h.rw)
+	go realHandleGet(cmd, dataOut, errorOut, h.rw, h.tiers)
 	return dataOut, errorOut
 }
 
-func realHandleGet(cmd common.GetRequest, dataOut chan common.GetResponse, errorOut chan error, rw *bufio.ReadWriter) {
+func realHandleGet(cmd common.GetRequest, dataOut chan common.GetResponse, errorOut chan error, rw *bufio.ReadWriter, t tiers) {
 	// read index
 	// make buf
 	// for numChunks do
@@ -496,7 +607,7 @@ outer:
 
 		_, metaData, err := getMetadata(rw, key)
 		if err != nil {
-			if err == common.ErrKeyNotFound {
+			if errors.Is(err, common.ErrKeyNotFound) {
 				metrics.IncCounter(MetricCmdGetMissesMeta)
 				dataOut <- missResponse
 				continue outer
@@ -507,6 +618,9 @@ outer:
 		}
 
 		missResponse.Flags = metaData.OrigFlags
+		if !t.current(len(key), metaData) {
+			metrics.IncCounter(MetricCmdGetLegacyChunks)
+		}
 
 		cmdSize := int(metaData.NumChunks)*(len(key)+4 /* key suffix */ +binprot.ReqHeaderLen) + binprot.ReqHeaderLen /* for the noop */
 		cmdbuf := bytes.NewBuffer(make([]byte, 0, cmdSize))
@@ -551,7 +665,7 @@ outer:
 		for {
 			opcodeNoop, err := getLocalIntoBuf(rw.Reader, metaData, tokenBuf, dataBuf, chunk, int(metaData.ChunkSize))
 			if err != nil {
-				if err == common.ErrKeyNotFound {
+				if errors.Is(err, common.ErrKeyNotFound) {
 					if !miss {
 						metrics.IncCounter(MetricCmdGetMissesChunk)
 						miss = true
@@ -584,7 +698,7 @@ outer:
 			return
 		}
 		if miss {
-			//fmt.Println("Get miss because of missing chunk")
+			metrics.IncCounter(MetricTornReads)
 			dataOut <- missResponse
 			continue outer
 		}
@@ -630,7 +744,7 @@ func (h Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
 
 	_, metaData, err := getAndTouchMetadata(h.rw, cmd.Key, cmd.Exptime)
 	if err != nil {
-		if err == common.ErrKeyNotFound {
+		if errors.Is(err, common.ErrKeyNotFound) {
 			metrics.IncCounter(MetricCmdGatMissesMeta)
 			return missResponse, nil
 		}
@@ -639,6 +753,9 @@ func (h Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
 	}
 
 	missResponse.Flags = metaData.OrigFlags
+	if !h.tiers.current(len(cmd.Key), metaData) {
+		metrics.IncCounter(MetricCmdGatLegacyChunks)
+	}
 
 	// Write all the GAT commands before reading
 	for i := 0; i < int(metaData.NumChunks); i++ {
@@ -675,7 +792,7 @@ func (h Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
 	for {
 		opcodeNoop, err := getLocalIntoBuf(h.rw.Reader, metaData, tokenBuf, dataBuf, chunk, int(metaData.ChunkSize))
 		if err != nil {
-			if err == common.ErrKeyNotFound {
+			if errors.Is(err, common.ErrKeyNotFound) {
 				if !miss {
 					metrics.IncCounter(MetricCmdGatMissesChunk)
 					miss = true
@@ -707,7 +824,7 @@ func (h Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
 		return common.GetResponse{}, lastErr
 	}
 	if miss {
-		//fmt.Println("GAT miss because of missing chunk")
+		metrics.IncCounter(MetricTornReads)
 		return missResponse, nil
 	}
 
@@ -731,7 +848,7 @@ func (h Handler) Delete(cmd common.DeleteRequest) error {
 	metaKey, metaData, err := getMetadata(h.rw, cmd.Key)
 
 	if err != nil {
-		if err == common.ErrKeyNotFound {
+		if errors.Is(err, common.ErrKeyNotFound) {
 			metrics.IncCounter(MetricCmdDeleteMissesMeta)
 		}
 		return err
@@ -742,7 +859,7 @@ func (h Handler) Delete(cmd common.DeleteRequest) error {
 		return err
 	}
 	if err := simpleCmdLocal(h.rw, true); err != nil {
-		if err == common.ErrKeyNotFound {
+		if errors.Is(err, common.ErrKeyNotFound) {
 			metrics.IncCounter(MetricCmdDeleteMissesMeta)
 		}
 		return err
@@ -763,7 +880,7 @@ func (h Handler) Delete(cmd common.DeleteRequest) error {
 	miss := false
 	for i := 0; i < int(metaData.NumChunks); i++ {
 		if err := simpleCmdLocal(h.rw, false); err != nil {
-			if err == common.ErrKeyNotFound && !miss {
+			if errors.Is(err, common.ErrKeyNotFound) && !miss {
 				metrics.IncCounter(MetricCmdDeleteMissesChunk)
 				miss = true
 			}
@@ -791,7 +908,7 @@ func (h Handler) Touch(cmd common.TouchRequest) error {
 	metaKey, metaData, err := getMetadata(h.rw, cmd.Key)
 
 	if err != nil {
-		if err == common.ErrKeyNotFound {
+		if errors.Is(err, common.ErrKeyNotFound) {
 			metrics.IncCounter(MetricCmdTouchMissesMeta)
 		}
 
@@ -813,7 +930,7 @@ func (h Handler) Touch(cmd common.TouchRequest) error {
 	miss := false
 	for i := 0; i < int(metaData.NumChunks); i++ {
 		if err := simpleCmdLocal(h.rw, false); err != nil {
-			if err == common.ErrKeyNotFound && !miss {
+			if errors.Is(err, common.ErrKeyNotFound) && !miss {
 				metrics.IncCounter(MetricCmdTouchMissesChunk)
 				miss = true
 			}
@@ -0,0 +1,201 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunked
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/netflix/rend/common"
+)
+
+// fakeMemcached answers the binary commands the chunked handler sends from a map. Sets of keys
+// with the suffix in nomem fail with an out of memory error, with a message in the body.
+type fakeMemcached struct {
+	lock  sync.Mutex
+	data  map[string][]byte
+	nomem string
+}
+
+func (f *fakeMemcached) serve(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		hdr := make([]byte, 24)
+		if _, err := io.ReadFull(conn, hdr); err != nil {
+			return
+		}
+		opcode := hdr[1]
+		keylen := int(binary.BigEndian.Uint16(hdr[2:4]))
+		extralen := int(hdr[4])
+		body := make([]byte, binary.BigEndian.Uint32(hdr[8:12]))
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+		key := string(body[extralen : extralen+keylen])
+		value := body[extralen+keylen:]
+
+		f.lock.Lock()
+		switch opcode {
+		case 0x01, 0x02, 0x03: // set, add, replace
+			if f.nomem != "" && strings.HasSuffix(key, f.nomem) {
+				respond(conn, opcode, 0x82, nil, []byte("Out of memory"))
+			} else {
+				f.data[key] = append([]byte(nil), value...)
+				respond(conn, opcode, 0, nil, nil)
+			}
+		case 0x00, 0x09: // get, getq
+			if v, ok := f.data[key]; ok {
+				respond(conn, opcode, 0, make([]byte, 4), v)
+			} else if opcode == 0x00 {
+				respond(conn, opcode, 0x01, nil, []byte("Not found"))
+			}
+		case 0x04: // delete
+			if _, ok := f.data[key]; ok {
+				delete(f.data, key)
+				respond(conn, opcode, 0, nil, nil)
+			} else {
+				respond(conn, opcode, 0x01, nil, []byte("Not found"))
+			}
+		case 0x0a: // noop
+			respond(conn, opcode, 0, nil, nil)
+		}
+		f.lock.Unlock()
+	}
+}
+
+func respond(w io.Writer, opcode uint8, status uint16, extras, value []byte) {
+	hdr := make([]byte, 24)
+	hdr[0] = 0x81
+	hdr[1] = opcode
+	hdr[4] = uint8(len(extras))
+	binary.BigEndian.PutUint16(hdr[6:8], status)
+	binary.BigEndian.PutUint32(hdr[8:12], uint32(len(extras)+len(value)))
+	w.Write(append(append(hdr, extras...), value...))
+}
+
+func TestTornSetCleanup(t *testing.T) {
+	f := &fakeMemcached{data: make(map[string][]byte), nomem: "-1"}
+	// A real socket, since the handler writes whole batches of commands before reading
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			f.serve(conn)
+		}
+	}()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandlerTiers(client, 0, 0, []int{MinChunkSize})
+	defer h.Close()
+
+	key := []byte("torn")
+	value := bytes.Repeat([]byte("x"), 1000)
+
+	// The second chunk fails, after the metadata and the first chunk are written
+	if err := h.Set(common.SetRequest{Key: key, Data: value}); !errors.Is(err, common.ErrNoMem) {
+		t.Fatalf("Expected the out of memory error from the second chunk, got %v", err)
+	}
+
+	f.lock.Lock()
+	_, meta := f.data["torn-meta"]
+	_, first := f.data["torn-0"]
+	f.lock.Unlock()
+	if meta || !first {
+		t.Fatalf("Expected the metadata to be deleted and only the first chunk left, got meta %v, first chunk %v", meta, first)
+	}
+
+	// The connection is still in sync and the torn value is a plain miss
+	res, errs := h.Get(common.GetRequest{Keys: [][]byte{key}, Opaques: []uint32{0}, Quiet: []bool{false}})
+	for r := range res {
+		if !r.Miss {
+			t.Fatalf("Expected a miss for the torn value, got %q", r.Data)
+		}
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	f.lock.Lock()
+	f.nomem = ""
+	f.lock.Unlock()
+
+	if err := h.Set(common.SetRequest{Key: key, Data: value}); err != nil {
+		t.Fatal(err)
+	}
+	res, errs = h.Get(common.GetRequest{Keys: [][]byte{key}, Opaques: []uint32{0}, Quiet: []bool{false}})
+	for r := range res {
+		if r.Miss || !bytes.Equal(r.Data, value) {
+			t.Fatalf("Expected the value once the set succeeds, got miss %v, %q", r.Miss, r.Data)
+		}
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArith(t *testing.T) {
+	f := &fakeMemcached{data: make(map[string][]byte)}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			f.serve(conn)
+		}
+	}()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(client)
+	defer h.Close()
+
+	key := []byte("n")
+	if _, err := h.Incr(common.ArithRequest{Key: key, Delta: 1}); err != common.ErrKeyNotFound {
+		t.Fatalf("Expected a missing key to stay missing without Create, got %v", err)
+	}
+	if v, err := h.Incr(common.ArithRequest{Key: key, Delta: 1, Initial: 5, Create: true}); err != nil || v != 5 {
+		t.Fatalf("Expected the initial value, got %d %v", v, err)
+	}
+	if v, err := h.Incr(common.ArithRequest{Key: key, Delta: 10}); err != nil || v != 15 {
+		t.Fatalf("Expected 15, got %d %v", v, err)
+	}
+	if v, err := h.Decr(common.ArithRequest{Key: key, Delta: 20}); err != nil || v != 0 {
+		t.Fatalf("Expected decrements to stop at 0, got %d %v", v, err)
+	}
+
+	if err := h.Set(common.SetRequest{Key: key, Data: []byte("abc")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Incr(common.ArithRequest{Key: key, Delta: 1}); err != common.ErrBadIncDecValue {
+		t.Fatalf("Expected a value that isn't a number to fail, got %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunked
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricCmdGetLegacyChunks = metrics.AddCounter("cmd_get_legacy_chunks", nil)
+	MetricCmdGatLegacyChunks = metrics.AddCounter("cmd_gat_legacy_chunks", nil)
+
+	MetricCmdSetUnchunked         = metrics.AddCounter("cmd_set_unchunked", nil)
+	MetricCmdSetUnchunkedTooLarge = metrics.AddCounter("cmd_set_unchunked_too_large", nil)
+)
+
+// DefaultChunkSizes is the single chunk size used when none are given, which fits in memcached's
+// slab 12 at ~1KB per chunk
+var DefaultChunkSizes = []int{1184}
+
+// the longest key memcached accepts
+const maxKeyLength = 250
+
+// memcached's default limit on the size of an item
+const maxItemSize = 1024 * 1024
+
+// MinChunkSize is the smallest chunk size that holds some data for the longest key memcached accepts
+const MinChunkSize = chunkOverhead + maxKeyLength + tokenSize + 1
+
+// CheckChunkSizes returns an error if any of the chunk sizes is too small to be used
+func CheckChunkSizes(sizes []int) error {
+	for _, s := range sizes {
+		if s < MinChunkSize {
+			return fmt.Errorf("Chunk size %d is smaller than the minimum of %d", s, MinChunkSize)
+		}
+	}
+	return nil
+}
+
+// tiers are the chunk sizes a handler writes with, smallest first. Each size is the full size of a
+// chunk item in memcached, overhead included, so it can be matched to the slab classes.
+type tiers []uint32
+
+func newTiers(sizes []int) tiers {
+	if len(sizes) == 0 {
+		sizes = DefaultChunkSizes
+	}
+
+	t := make(tiers, 0, len(sizes))
+	for _, s := range sizes {
+		t = append(t, uint32(s))
+	}
+	sort.Slice(t, func(i, j int) bool { return t[i] < t[j] })
+
+	return t
+}
+
+// chunkSize returns the size of the data in each chunk that a value of the given length is split
+// into, and the size of each chunk's value in memcached, which is the data and the token. The tier is the largest one whose data fits in the value, so every chunk but the
+// last is full and the padding is always less than the value itself. Mid-sized values aren't
+// padded out to a chunk much larger than they are, and huge ones take fewer round trips in larger
+// chunks. Values smaller than every tier go in one chunk of the smallest.
+func (t tiers) chunkSize(keylen, length int) (dataSize, valueSize uint32) {
+	tier := t[0]
+	for _, size := range t[1:] {
+		if int(dataSizeOf(size, keylen)) > length {
+			break
+		}
+		tier = size
+	}
+	dataSize = dataSizeOf(tier, keylen)
+	return dataSize, dataSize + tokenSize
+}
+
+// current reports whether an item was written with one of the tiers. Items are read with the chunk
+// size in their metadata whatever it is, so items written before the tiers changed are still
+// served until they're overwritten or expire. Appends and prepends rewrite the whole value, which
+// moves it to the current tiers. This only tells how many old items are left.
+func (t tiers) current(keylen int, md metadata) bool {
+	if md.NumChunks == 1 && md.ChunkSize == md.Length && md.OrigFlags&common.FlagMask(common.FlagNoChunk) != 0 {
+		return true
+	}
+	for _, size := range t {
+		if dataSizeOf(size, keylen) == md.ChunkSize {
+			return true
+		}
+	}
+	return false
+}
+
+// whole returns the sizes to write a value in a single chunk of exactly its length, for values
+// whose flags have the common.FlagNoChunk bit. A value too large for one memcached item can't be,
+// and is chunked as usual.
+func whole(keylen, length int) (dataSize, valueSize uint32, ok bool) {
+	if length == 0 || chunkOverhead+keylen+tokenSize+length > maxItemSize {
+		return 0, 0, false
+	}
+	return uint32(length), uint32(length) + tokenSize, true
+}
+
+func dataSizeOf(fullSize uint32, keylen int) uint32 {
+	return fullSize - uint32(chunkOverhead+keylen) - tokenSize
+}
@@ -0,0 +1,89 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunked
+
+import (
+	"testing"
+
+	"github.com/netflix/rend/common"
+)
+
+func TestTierChunkSize(t *testing.T) {
+	tr := newTiers([]int{262144, 16384, 65536})
+	key := []byte("somekey")
+	data := func(full int) int { return int(dataSizeOf(uint32(full), len(key))) }
+
+	tests := []struct {
+		length int
+		want   uint32
+	}{
+		{0, 16384},
+		{100, 16384},
+		{data(16384), 16384},
+		{data(65536) - 1, 16384},
+		{data(65536), 65536},
+		{100000, 65536},
+		{10 * 1024 * 1024, 262144},
+	}
+
+	for _, test := range tests {
+		dataSize, valueSize := tr.chunkSize(len(key), test.length)
+		if want := dataSizeOf(test.want, len(key)); dataSize != want || valueSize != want+tokenSize {
+			t.Errorf("Value of %d bytes: expected chunks of %d, got %d bytes of data in %d", test.length, test.want, dataSize, valueSize)
+		}
+	}
+}
+
+func TestTierCurrent(t *testing.T) {
+	old := newTiers(nil)
+	tr := newTiers([]int{16384, 65536})
+	key := []byte("somekey")
+
+	dataSize, _ := old.chunkSize(len(key), 5000)
+	md := metadata{ChunkSize: dataSize}
+	if tr.current(len(key), md) {
+		t.Fatal("Expected an item written with the default size to be from an old tier")
+	}
+	if !old.current(len(key), md) {
+		t.Fatal("Expected an item to be from the tiers it was written with")
+	}
+
+	if err := CheckChunkSizes([]int{MinChunkSize - 1}); err == nil {
+		t.Fatal("Expected a chunk size too small for the longest key to be rejected")
+	}
+}
+
+func TestWhole(t *testing.T) {
+	key := []byte("somekey")
+
+	if dataSize, valueSize, ok := whole(len(key), 5000); !ok || dataSize != 5000 || valueSize != 5000+tokenSize {
+		t.Fatalf("Expected a value in one chunk of its own size, got %d bytes of data in %d", dataSize, valueSize)
+	}
+	if _, _, ok := whole(len(key), 0); ok {
+		t.Fatal("Expected an empty value to be chunked as usual")
+	}
+	if _, _, ok := whole(len(key), maxItemSize); ok {
+		t.Fatal("Expected a value too large for one item to be chunked as usual")
+	}
+
+	mask, err := common.ReserveFlagBit(common.FlagNoChunk, 31)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := metadata{Length: 5000, NumChunks: 1, ChunkSize: 5000, OrigFlags: mask}
+	if !newTiers(nil).current(len(key), md) {
+		t.Fatal("Expected an unchunked item to count as current")
+	}
+}
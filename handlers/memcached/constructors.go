@@ -15,29 +15,65 @@
 package memcached
 
 import (
+	"errors"
+	"io"
 	"log"
-	"net"
+	"strconv"
+	"strings"
 
 	"github.com/netflix/rend/handlers"
 	"github.com/netflix/rend/handlers/memcached/batched"
 	"github.com/netflix/rend/handlers/memcached/chunked"
 	"github.com/netflix/rend/handlers/memcached/std"
+	"github.com/netflix/rend/handlers/pool"
 )
 
+func init() {
+	handlers.Register("memcached", sockFactory(Regular))
+	handlers.Register("chunked", sockFactory(Chunked))
+	handlers.Register("batched", sockFactory(func(sock string) handlers.HandlerConst {
+		// The zero value for the options means all defaults
+		return Batched(sock, batched.Opts{})
+	}))
+}
+
+// sockFactory adapts a constructor taking a unix domain socket path to a handlers.HandlerFactory.
+// The configuration string is the socket path, or a host:port to connect over TCP.
+func sockFactory(f func(sock string) handlers.HandlerConst) handlers.HandlerFactory {
+	return func(conf string) (handlers.HandlerConst, error) {
+		if conf == "" {
+			return nil, errors.New("A unix domain socket path or host:port is required, e.g. memcached:/tmp/memcached.sock")
+		}
+		return f(conf), nil
+	}
+}
+
 // Regular returns an implementation of the Handler interface that does standard,
 // direct interactions with the external memcached backend which is listening on
 // the specified unix domain socket.
 func Regular(sock string) handlers.HandlerConst {
-	return func() (handlers.Handler, error) {
-		conn, err := net.Dial("unix", sock)
+	return RegularBufSize(sock, 0, 0)
+}
+
+// RegularBufSize is the same as Regular but with the given read and write buffer
+// sizes for each connection. Sizes of 0 or less use the default of 4k. A connection
+// that fails or gets out of sync with its responses is replaced with a new one.
+//
+// Like every constructor here, the connections and operations are counted in the
+// metrics of the pool named after the socket path. A sock of the form host:port is
+// connected to over TCP instead.
+func RegularBufSize(sock string, readBufSize, writeBufSize int) handlers.HandlerConst {
+	p := pool.Get(sock)
+	dial := func() (io.ReadWriteCloser, error) {
+		return p.Dial(pool.Network(sock), sock)
+	}
+	return p.Handler(func() (handlers.Handler, error) {
+		h, err := std.NewHandlerDialer(dial, readBufSize, writeBufSize)
 		if err != nil {
-			if conn != nil {
-				conn.Close()
-			}
 			return nil, err
 		}
-		return std.NewHandler(conn), nil
-	}
+		return h, nil
+	})
 }
 
 // Chunked returns an implementation of the Handler interface that implements an
@@ -45,8 +81,21 @@ func Regular(sock string) handlers.HandlerConst {
 // external memcached backend is expected to be listening on the specified unix
 // domain socket.
 func Chunked(sock string) handlers.HandlerConst {
-	return func() (handlers.Handler, error) {
-		conn, err := net.Dial("unix", sock)
+	return ChunkedBufSize(sock, 0, 0)
+}
+
+// ChunkedBufSize is the same as Chunked but with the given read and write buffer
+// sizes for each connection. Sizes of 0 or less use the default of 4k.
+func ChunkedBufSize(sock string, readBufSize, writeBufSize int) handlers.HandlerConst {
+	return ChunkedTiers(sock, readBufSize, writeBufSize, nil)
+}
+
+// ChunkedTiers is the same as ChunkedBufSize but each value is split into chunks of one of the
+// given sizes, see chunked.NewHandlerTiers. No sizes means chunked.DefaultChunkSizes.
+func ChunkedTiers(sock string, readBufSize, writeBufSize int, chunkSizes []int) handlers.HandlerConst {
+	p := pool.Get(sock)
+	return p.Handler(func() (handlers.Handler, error) {
+		conn, err := p.Dial(pool.Network(sock), sock)
 		if err != nil {
 			log.Println("Error opening connection:", err.Error())
 			if conn != nil {
@@ -54,14 +103,35 @@ func Chunked(sock string) handlers.HandlerConst {
 			}
 			return nil, err
 		}
-		return chunked.NewHandler(conn), nil
+		return chunked.NewHandlerTiers(conn, readBufSize, writeBufSize, chunkSizes), nil
+	})
+}
+
+// ParseChunkSizes parses a comma separated list of chunk sizes for ChunkedTiers and checks that
+// each can be used
+func ParseChunkSizes(s string) ([]int, error) {
+	var sizes []int
+	for _, f := range strings.Split(s, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return nil, err
+		}
+		sizes = append(sizes, size)
 	}
+	if err := chunked.CheckChunkSizes(sizes); err != nil {
+		return nil, err
+	}
+	return sizes, nil
 }
 
 // Batched returns an implementation of the Handler interface that multiplexes
 // requests on to a connection pool in order to reduce the overhead per request.
 func Batched(sock string, opts batched.Opts) handlers.HandlerConst {
-	return func() (handlers.Handler, error) {
-		return batched.NewHandler(sock, opts), nil
+	p := pool.Get(sock)
+	if opts.Dial == nil {
+		opts.Dial = p.Dial
 	}
+	return p.Handler(func() (handlers.Handler, error) {
+		return batched.NewHandler(sock, opts), nil
+	})
 }
@@ -0,0 +1,195 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package std
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/protocol/binprot"
+)
+
+var (
+	MetricBackendDesyncs          = metrics.AddCounter("std_backend_desyncs", nil)
+	MetricBackendReconnects       = metrics.AddCounter("std_backend_reconnects", nil)
+	MetricBackendReconnectFailure = metrics.AddCounter("std_backend_reconnect_failures", nil)
+)
+
+// ErrDesync means a response from the backend doesn't belong to the request it was read for. Once
+// that happens nothing else read from the connection can be trusted.
+var ErrDesync = errors.New("Backend response out of sync with its request")
+
+// maxBodyLength bounds the body of any response, which is far beyond any value memcached will
+// store. A longer body means the header is garbage, and reading or discarding it would hang or
+// take the connection further out of step.
+const maxBodyLength = 1 << 30
+
+// Dialer opens a new connection to the backend
+type Dialer func() (io.ReadWriteCloser, error)
+
+// backend is the connection under a Handler. With a dialer it can replace the connection with a
+// fresh one after an error leaves the old one in an unknown state.
+type backend struct {
+	io.ReadWriteCloser
+	dial Dialer
+	rw   *bufio.ReadWriter
+
+	// opaque of the next request
+	opaque uint32
+
+	// release ends the latest interrupt
+	release func()
+}
+
+// next returns n consecutive opaque values for a request, or a batch of them
+func (b *backend) next(n int) uint32 {
+	o := b.opaque
+	b.opaque += uint32(n)
+	return o
+}
+
+// deadliner is a connection that can bound its I/O in time, like a net.Conn
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+// interrupt bounds the I/O on the connection by ctx until the returned func is called: reads and
+// writes fail once the deadline of ctx has passed, or right away once ctx is done for any other
+// reason. The operation then fails like for any other I/O error and the connection is replaced or
+// closed by fail, since the rest of its response may still be on the way. Connections that can't
+// take a deadline are left alone.
+//
+// The returned func can be called more than once. Getting a new interrupt ends the one from
+// before, which may still be pending after a get whose results were all read already.
+func (b *backend) interrupt(ctx context.Context) func() {
+	if b.release != nil {
+		b.release()
+		b.release = nil
+	}
+
+	conn, ok := b.ReadWriteCloser.(deadliner)
+	if !ok || ctx.Done() == nil {
+		return func() {}
+	}
+
+	if d, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(d)
+	}
+	fired := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		// A deadline in the past fails any read or write in progress
+		conn.SetDeadline(time.Unix(1, 0))
+		close(fired)
+	})
+
+	var once sync.Once
+	b.release = func() {
+		once.Do(func() {
+			if !stop() {
+				// Wait for it so the deadline isn't set again after it's cleared
+				<-fired
+			}
+			conn.SetDeadline(time.Time{})
+		})
+	}
+	return b.release
+}
+
+// fail handles an error from the connection. Errors from the backend about the request itself
+// are returned as they are. For anything else, with a dialer the connection is replaced and the
+// error is reported as a temporary failure of this one request. Without a dialer, or if the dial
+// fails, the error is returned as is and the connection can't be used again. A connection whose
+// I/O timed out part way through a request is closed, so nothing else is read from it.
+func (b *backend) fail(err error) error {
+	if err == nil || common.IsAppError(err) {
+		return err
+	}
+
+	if errors.Is(err, ErrDesync) {
+		metrics.IncCounter(MetricBackendDesyncs)
+	}
+	if b.dial == nil {
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			b.ReadWriteCloser.Close()
+		}
+		return err
+	}
+
+	b.ReadWriteCloser.Close()
+
+	conn, dialErr := b.dial()
+	if dialErr != nil {
+		metrics.IncCounter(MetricBackendReconnectFailure)
+		log.Printf("Error reconnecting to backend after %v: %v\n", err, dialErr)
+		return err
+	}
+
+	metrics.IncCounter(MetricBackendReconnects)
+	log.Printf("Reconnected to backend after %v\n", err)
+
+	// Anything buffered in either direction belongs to the old connection
+	b.ReadWriteCloser = conn
+	b.rw.Reader.Reset(b)
+	b.rw.Writer.Reset(b)
+
+	return common.Wrap(common.ErrTempFailure, err)
+}
+
+// readHeader reads a response header and checks that it answers the request with the given
+// opcode and opaque
+func readHeader(r io.Reader, opcode uint8, opaque uint32) (binprot.ResponseHeader, error) {
+	rh, err := binprot.ReadResponseHeader(r)
+	if err != nil {
+		if err == binprot.ErrBadMagic {
+			err = fmt.Errorf("%w: bad magic byte", ErrDesync)
+		}
+		return rh, err
+	}
+
+	switch {
+	case rh.Opcode != opcode:
+		err = fmt.Errorf("%w: got opcode 0x%x, expected 0x%x", ErrDesync, rh.Opcode, opcode)
+	case rh.OpaqueToken != opaque:
+		err = fmt.Errorf("%w: got opaque %d, expected %d", ErrDesync, rh.OpaqueToken, opaque)
+	default:
+		err = checkBodyLength(rh)
+	}
+	if err != nil {
+		binprot.PutResponseHeader(rh)
+		return rh, err
+	}
+
+	return rh, nil
+}
+
+// checkBodyLength checks that the body of a response is long enough for its key and extras and
+// not unreasonably long
+func checkBodyLength(rh binprot.ResponseHeader) error {
+	if uint32(rh.KeyLength)+uint32(rh.ExtraLength) > rh.TotalBodyLength || rh.TotalBodyLength > maxBodyLength {
+		return fmt.Errorf("%w: body length %d with %d bytes of key and %d bytes of extras",
+			ErrDesync, rh.TotalBodyLength, rh.KeyLength, rh.ExtraLength)
+	}
+	return nil
+}
@@ -16,6 +16,9 @@ package std
 
 import (
 	"bufio"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 
 	"github.com/netflix/rend/common"
@@ -23,8 +26,8 @@ import (
 	"github.com/netflix/rend/protocol/binprot"
 )
 
-func readResponseHeader(r *bufio.Reader) (binprot.ResponseHeader, error) {
-	resHeader, err := binprot.ReadResponseHeader(r)
+func readResponseHeader(r *bufio.Reader, opcode uint8, opaque uint32) (binprot.ResponseHeader, error) {
+	resHeader, err := readHeader(r, opcode, opaque)
 	if err != nil {
 		return binprot.ResponseHeader{}, err
 	}
@@ -38,19 +41,60 @@ func readResponseHeader(r *bufio.Reader) (binprot.ResponseHeader, error) {
 	return resHeader, nil
 }
 
-// Handler implements a backend for Rend that communicates to a remote memcached server
+// the bufio default
+const defaultBufSize = 4096
+
+// Handler implements a backend for Rend that communicates to a remote memcached server.
+//
+// Every response is checked against the request it was read for: the magic byte, the opcode, the
+// opaque value and the body length. A response that doesn't fit, or any other error that leaves
+// the connection in an unknown state, means the rest of the stream can't be trusted either.
 type Handler struct {
 	rw   *bufio.ReadWriter
-	conn io.Closer
+	conn *backend
 }
 
 // NewHandler returns an implementation of handlers.Handler that implements a straightforward
 // request-response like normal memcached usage.
 func NewHandler(conn io.ReadWriteCloser) Handler {
-	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	return NewHandlerSize(conn, 0, 0)
+}
+
+// NewHandlerSize is the same as NewHandler but with the given read and write buffer sizes, in
+// bytes. Sizes of 0 or less use the bufio default.
+//
+// The handler can't recover from a connection that goes out of sync with its responses, so it
+// returns the error like any other connection failure and can't be used again afterwards.
+func NewHandlerSize(conn io.ReadWriteCloser, readBufSize, writeBufSize int) Handler {
+	return newHandler(conn, nil, readBufSize, writeBufSize)
+}
+
+// NewHandlerDialer is the same as NewHandlerSize but connects with dial, and dials again to
+// replace a connection that failed or went out of sync with its responses. The request that
+// found the problem fails with a temporary error and the handler carries on with the new
+// connection.
+func NewHandlerDialer(dial Dialer, readBufSize, writeBufSize int) (Handler, error) {
+	conn, err := dial()
+	if err != nil {
+		return Handler{}, err
+	}
+	return newHandler(conn, dial, readBufSize, writeBufSize), nil
+}
+
+func newHandler(conn io.ReadWriteCloser, dial Dialer, readBufSize, writeBufSize int) Handler {
+	if readBufSize <= 0 {
+		readBufSize = defaultBufSize
+	}
+	if writeBufSize <= 0 {
+		writeBufSize = defaultBufSize
+	}
+
+	b := &backend{ReadWriteCloser: conn, dial: dial}
+	b.rw = bufio.NewReadWriter(bufio.NewReaderSize(b, readBufSize), bufio.NewWriterSize(b, writeBufSize))
+
 	return Handler{
-		rw:   rw,
-		conn: conn,
+		rw:   b.rw,
+		conn: b,
 	}
 }
 
@@ -60,47 +104,58 @@ func (h Handler) Close() error {
 	return h.conn.Close()
 }
 
+// Interrupt bounds the I/O of the operations done until the returned func is called by ctx, see
+// handlers.Interrupter. An operation cut short fails like for any other connection error.
+func (h Handler) Interrupt(ctx context.Context) func() {
+	return h.conn.interrupt(ctx)
+}
+
 // Set performs a set request on the remote backend
 func (h Handler) Set(cmd common.SetRequest) error {
-	if err := binprot.WriteSetCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), 0); err != nil {
-		return err
+	opaque := h.conn.next(1)
+	if err := binprot.WriteSetCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), opaque); err != nil {
+		return h.conn.fail(err)
 	}
-	return h.handleSetCommon(cmd)
+	return h.conn.fail(h.handleSetCommon(cmd, binprot.OpcodeSet, opaque))
 }
 
 // Add performs an add request on the remote backend
 func (h Handler) Add(cmd common.SetRequest) error {
-	if err := binprot.WriteAddCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), 0); err != nil {
-		return err
+	opaque := h.conn.next(1)
+	if err := binprot.WriteAddCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), opaque); err != nil {
+		return h.conn.fail(err)
 	}
-	return h.handleSetCommon(cmd)
+	return h.conn.fail(h.handleSetCommon(cmd, binprot.OpcodeAdd, opaque))
 }
 
 // Replace performs a replace request on the remote backend
 func (h Handler) Replace(cmd common.SetRequest) error {
-	if err := binprot.WriteReplaceCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), 0); err != nil {
-		return err
+	opaque := h.conn.next(1)
+	if err := binprot.WriteReplaceCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), opaque); err != nil {
+		return h.conn.fail(err)
 	}
-	return h.handleSetCommon(cmd)
+	return h.conn.fail(h.handleSetCommon(cmd, binprot.OpcodeReplace, opaque))
 }
 
 // Append performs an append request on the remote backend
 func (h Handler) Append(cmd common.SetRequest) error {
-	if err := binprot.WriteAppendCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), 0); err != nil {
-		return err
+	opaque := h.conn.next(1)
+	if err := binprot.WriteAppendCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), opaque); err != nil {
+		return h.conn.fail(err)
 	}
-	return h.handleSetCommon(cmd)
+	return h.conn.fail(h.handleSetCommon(cmd, binprot.OpcodeAppend, opaque))
 }
 
 // Prepend performs a prepend request on the remote backend
 func (h Handler) Prepend(cmd common.SetRequest) error {
-	if err := binprot.WritePrependCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), 0); err != nil {
-		return err
+	opaque := h.conn.next(1)
+	if err := binprot.WritePrependCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), opaque); err != nil {
+		return h.conn.fail(err)
 	}
-	return h.handleSetCommon(cmd)
+	return h.conn.fail(h.handleSetCommon(cmd, binprot.OpcodePrepend, opaque))
 }
 
-func (h Handler) handleSetCommon(cmd common.SetRequest) error {
+func (h Handler) handleSetCommon(cmd common.SetRequest, opcode uint8, opaque uint32) error {
 	// TODO: should there be a unique flags value for regular data?
 
 	// Write value
@@ -112,7 +167,10 @@ func (h Handler) handleSetCommon(cmd common.SetRequest) error {
 	}
 
 	// Read server's response
-	resHeader, err := readResponseHeader(h.rw.Reader)
+	resHeader, err := readResponseHeader(h.rw.Reader, opcode, opaque)
+	if err != nil && !common.IsAppError(err) {
+		return err
+	}
 	if err != nil {
 		// Discard response body
 		n, ioerr := h.rw.Discard(int(resHeader.TotalBodyLength))
@@ -121,64 +179,197 @@ func (h Handler) handleSetCommon(cmd common.SetRequest) error {
 			return ioerr
 		}
 
-		// For Add and Replace, the error here will be common.ErrKeyExists or common.ErrKeyNotFound
-		// respectively. For each, this is the right response to send to the requestor. The error
-		// here is overloaded because it would signal a true error for sets, but a normal "error"
-		// response for Add and Replace.
+		// For Add and Replace, the error here will be common.ErrNotAdded or common.ErrKeyNotFound
+		// respectively. For each, this is the right response to send to the requestor. It would
+		// signal a true error for sets, but a normal "error" response for Add and Replace.
 		return err
 	}
 
 	return nil
 }
 
+// SetIfMatch performs a conditional set on the remote backend as a get followed by a set with the
+// CAS value from the get. If the value changes between the two, the backend rejects the set and
+// the result is common.ErrKeyExists, the same as a value that didn't match to begin with.
+func (h Handler) SetIfMatch(cmd common.SetIfMatchRequest) error {
+	opaque := h.conn.next(2)
+	if err := binprot.WriteGetCmd(h.rw.Writer, cmd.Key, opaque); err != nil {
+		return h.conn.fail(err)
+	}
+
+	data, _, _, cas, err := getLocalCAS(h.rw, binprot.OpcodeGet, opaque, false)
+	if err != nil {
+		return h.conn.fail(err)
+	}
+
+	if !cmd.Matches(data) {
+		return common.ErrKeyExists
+	}
+
+	if err := binprot.WriteSetCASCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), opaque+1, cas); err != nil {
+		return h.conn.fail(err)
+	}
+
+	return h.conn.fail(h.handleSetCommon(cmd.SetRequest, binprot.OpcodeSet, opaque+1))
+}
+
+// MultiSet performs all of the sets in cmd on the remote backend in a single round trip. Each set is
+// written as a quiet set with consecutive opaque values, followed by a noop. The backend only
+// responds to the sets that failed, so every response read before the noop's is an error for the
+// set it names.
+func (h Handler) MultiSet(cmd common.MultiSetRequest) []error {
+	errs := make([]error, len(cmd.Sets))
+	base := h.conn.next(len(errs) + 1)
+
+	for i, set := range cmd.Sets {
+		if err := binprot.WriteSetQCmd(h.rw.Writer, set.Key, set.Flags, set.Exptime, uint32(len(set.Data)), base+uint32(i)); err != nil {
+			return failBatch(errs, h.conn.fail(err))
+		}
+
+		h.rw.Write(set.Data)
+		metrics.IncCounterBy(common.MetricBytesWrittenLocal, uint64(len(set.Data)))
+	}
+
+	return h.readQuietResponses(errs, base, binprot.OpcodeSetQ)
+}
+
+// MultiDelete performs all of the deletes in cmd on the remote backend in a single round trip, the
+// same way as MultiSet. A miss is the error common.ErrKeyNotFound for that delete.
+func (h Handler) MultiDelete(cmd common.MultiDeleteRequest) []error {
+	errs := make([]error, len(cmd.Deletes))
+	base := h.conn.next(len(errs) + 1)
+
+	for i, del := range cmd.Deletes {
+		if err := binprot.WriteDeleteQCmd(h.rw.Writer, del.Key, base+uint32(i)); err != nil {
+			return failBatch(errs, h.conn.fail(err))
+		}
+	}
+
+	return h.readQuietResponses(errs, base, binprot.OpcodeDeleteQ)
+}
+
+// readQuietResponses ends a batch of quiet commands with the given opcode and consecutive opaque
+// values from base with a noop, then collects the error responses for them until the noop's
+// response arrives.
+func (h Handler) readQuietResponses(errs []error, base uint32, opcode uint8) []error {
+	noopOpaque := base + uint32(len(errs))
+
+	if err := binprot.WriteNoopCmd(h.rw.Writer, noopOpaque); err != nil {
+		return failBatch(errs, h.conn.fail(err))
+	}
+
+	if err := h.rw.Flush(); err != nil {
+		return failBatch(errs, h.conn.fail(err))
+	}
+
+	for {
+		resHeader, err := binprot.ReadResponseHeader(h.rw.Reader)
+		if err != nil {
+			if err == binprot.ErrBadMagic {
+				err = fmt.Errorf("%w: bad magic byte", ErrDesync)
+			}
+			return failBatch(errs, h.conn.fail(err))
+		}
+		binprot.PutResponseHeader(resHeader)
+
+		// Only failed commands from this batch and the noop can answer
+		idx := resHeader.OpaqueToken - base
+		switch {
+		case idx > uint32(len(errs)), idx == uint32(len(errs)) && resHeader.Opcode != binprot.OpcodeNoop,
+			idx < uint32(len(errs)) && resHeader.Opcode != opcode:
+			err = fmt.Errorf("%w: got opcode 0x%x with opaque %d in a batch from %d to %d",
+				ErrDesync, resHeader.Opcode, resHeader.OpaqueToken, base, noopOpaque)
+		default:
+			err = checkBodyLength(resHeader)
+		}
+		if err != nil {
+			return failBatch(errs, h.conn.fail(err))
+		}
+
+		// Discard any response body, the error message adds nothing to the decoded error
+		n, ioerr := h.rw.Discard(int(resHeader.TotalBodyLength))
+		metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
+		if ioerr != nil {
+			return failBatch(errs, h.conn.fail(ioerr))
+		}
+
+		if idx == uint32(len(errs)) {
+			return errs
+		}
+
+		if err := binprot.DecodeError(resHeader); err != nil {
+			errs[idx] = err
+		}
+	}
+}
+
+// failBatch gives err to every command in a batch that hasn't already failed. The outcome of the
+// rest is unknown once the connection fails part way through.
+func failBatch(errs []error, err error) []error {
+	for i := range errs {
+		if errs[i] == nil {
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
 // Get performs a batched get request on the remote backend. The channels returned
 // are expected to be read from until either a single error is received or the
 // response channel is exhausted.
 func (h Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
 	dataOut := make(chan common.GetResponse)
 	errorOut := make(chan error)
-	go realHandleGet(cmd, dataOut, errorOut, h.rw)
+	go realHandleGet(cmd, dataOut, errorOut, h.rw, h.conn)
 	return dataOut, errorOut
 }
 
-func realHandleGet(cmd common.GetRequest, dataOut chan common.GetResponse, errorOut chan error, rw *bufio.ReadWriter) {
+func realHandleGet(cmd common.GetRequest, dataOut chan common.GetResponse, errorOut chan error, rw *bufio.ReadWriter, b *backend) {
 	defer close(errorOut)
 	defer close(dataOut)
 
+	err := getEach(cmd, rw, b, func(res common.GetResponse) error {
+		dataOut <- res
+		return nil
+	})
+	if err != nil {
+		errorOut <- err
+	}
+}
+
+// GetEach performs a get on the calling goroutine, see handlers.SyncGetter. Keys are fetched one
+// at a time, so stopping part way leaves the connection in sync.
+func (h Handler) GetEach(cmd common.GetRequest, f func(common.GetResponse) error) error {
+	return getEach(cmd, h.rw, h.conn, f)
+}
+
+func getEach(cmd common.GetRequest, rw *bufio.ReadWriter, b *backend, f func(common.GetResponse) error) error {
 	for idx, key := range cmd.Keys {
-		if err := binprot.WriteGetCmd(rw.Writer, key, 0); err != nil {
-			errorOut <- err
-			return
+		opaque := b.next(1)
+		if err := binprot.WriteGetCmd(rw.Writer, key, opaque); err != nil {
+			return b.fail(err)
 		}
 
-		data, flags, _, err := getLocal(rw, false)
-		if err != nil {
-			if err == common.ErrKeyNotFound {
-				dataOut <- common.GetResponse{
-					Miss:   true,
-					Quiet:  cmd.Quiet[idx],
-					Opaque: cmd.Opaques[idx],
-					Flags:  flags,
-					Key:    key,
-					Data:   nil,
-				}
-
-				continue
-			}
-
-			errorOut <- err
-			return
+		data, flags, _, err := getLocal(rw, binprot.OpcodeGet, opaque, false)
+		miss := errors.Is(err, common.ErrKeyNotFound)
+		if err != nil && !miss {
+			return b.fail(err)
 		}
 
-		dataOut <- common.GetResponse{
-			Miss:   false,
+		err = f(common.GetResponse{
+			Miss:   miss,
 			Quiet:  cmd.Quiet[idx],
 			Opaque: cmd.Opaques[idx],
 			Flags:  flags,
 			Key:    key,
 			Data:   data,
+		})
+		if err != nil {
+			return err
 		}
 	}
+
+	return nil
 }
 
 // GetE performs a batched gete request on the remote backend. The channels returned
@@ -187,61 +378,68 @@ func realHandleGet(cmd common.GetRequest, dataOut chan common.GetResponse, error
 func (h Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
 	dataOut := make(chan common.GetEResponse)
 	errorOut := make(chan error)
-	go realHandleGetE(cmd, dataOut, errorOut, h.rw)
+	go realHandleGetE(cmd, dataOut, errorOut, h.rw, h.conn)
 	return dataOut, errorOut
 }
 
-func realHandleGetE(cmd common.GetRequest, dataOut chan common.GetEResponse, errorOut chan error, rw *bufio.ReadWriter) {
+func realHandleGetE(cmd common.GetRequest, dataOut chan common.GetEResponse, errorOut chan error, rw *bufio.ReadWriter, b *backend) {
 	defer close(errorOut)
 	defer close(dataOut)
 
+	err := getEEach(cmd, rw, b, func(res common.GetEResponse) error {
+		dataOut <- res
+		return nil
+	})
+	if err != nil {
+		errorOut <- err
+	}
+}
+
+// GetEEach performs a gete on the calling goroutine, see handlers.SyncGetter
+func (h Handler) GetEEach(cmd common.GetRequest, f func(common.GetEResponse) error) error {
+	return getEEach(cmd, h.rw, h.conn, f)
+}
+
+func getEEach(cmd common.GetRequest, rw *bufio.ReadWriter, b *backend, f func(common.GetEResponse) error) error {
 	for idx, key := range cmd.Keys {
-		if err := binprot.WriteGetECmd(rw.Writer, key, 0); err != nil {
-			errorOut <- err
-			return
+		opaque := b.next(1)
+		if err := binprot.WriteGetECmd(rw.Writer, key, opaque); err != nil {
+			return b.fail(err)
 		}
 
-		data, flags, exp, err := getLocal(rw, true)
-		if err != nil {
-			if err == common.ErrKeyNotFound {
-				dataOut <- common.GetEResponse{
-					Miss:    true,
-					Quiet:   cmd.Quiet[idx],
-					Opaque:  cmd.Opaques[idx],
-					Flags:   flags,
-					Exptime: exp,
-					Key:     key,
-					Data:    nil,
-				}
-
-				continue
-			}
-
-			errorOut <- err
-			return
+		data, flags, exp, err := getLocal(rw, binprot.OpcodeGetE, opaque, true)
+		miss := errors.Is(err, common.ErrKeyNotFound)
+		if err != nil && !miss {
+			return b.fail(err)
 		}
 
-		dataOut <- common.GetEResponse{
-			Miss:    false,
+		err = f(common.GetEResponse{
+			Miss:    miss,
 			Quiet:   cmd.Quiet[idx],
 			Opaque:  cmd.Opaques[idx],
 			Flags:   flags,
 			Exptime: exp,
 			Key:     key,
 			Data:    data,
+		})
+		if err != nil {
+			return err
 		}
 	}
+
+	return nil
 }
 
 // GAT performs a get-and-touch request on the remote backend
 func (h Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
-	if err := binprot.WriteGATCmd(h.rw.Writer, cmd.Key, cmd.Exptime, 0); err != nil {
-		return common.GetResponse{}, err
+	opaque := h.conn.next(1)
+	if err := binprot.WriteGATCmd(h.rw.Writer, cmd.Key, cmd.Exptime, opaque); err != nil {
+		return common.GetResponse{}, h.conn.fail(err)
 	}
 
-	data, flags, _, err := getLocal(h.rw, false)
+	data, flags, _, err := getLocal(h.rw, binprot.OpcodeGat, opaque, false)
 	if err != nil {
-		if err == common.ErrKeyNotFound {
+		if errors.Is(err, common.ErrKeyNotFound) {
 			return common.GetResponse{
 				Miss:   true,
 				Quiet:  false,
@@ -252,7 +450,7 @@ func (h Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
 			}, nil
 		}
 
-		return common.GetResponse{}, err
+		return common.GetResponse{}, h.conn.fail(err)
 	}
 
 	return common.GetResponse{
@@ -265,18 +463,68 @@ func (h Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
 	}, nil
 }
 
+// Ping sends a noop to the remote backend to check that it answers
+func (h Handler) Ping() error {
+	opaque := h.conn.next(1)
+	if err := binprot.WriteNoopCmd(h.rw.Writer, opaque); err != nil {
+		return h.conn.fail(err)
+	}
+	return h.conn.fail(simpleCmdLocal(h.rw, binprot.OpcodeNoop, opaque))
+}
+
 // Delete performs a delete request on the remote backend
 func (h Handler) Delete(cmd common.DeleteRequest) error {
-	if err := binprot.WriteDeleteCmd(h.rw.Writer, cmd.Key, 0); err != nil {
-		return err
+	opaque := h.conn.next(1)
+	if err := binprot.WriteDeleteCmd(h.rw.Writer, cmd.Key, opaque); err != nil {
+		return h.conn.fail(err)
 	}
-	return simpleCmdLocal(h.rw)
+	return h.conn.fail(simpleCmdLocal(h.rw, binprot.OpcodeDelete, opaque))
+}
+
+// Flush performs a flush request on the remote backend, which does any delay itself
+func (h Handler) Flush(cmd common.FlushRequest) error {
+	opaque := h.conn.next(1)
+	if err := binprot.WriteFlushCmd(h.rw.Writer, cmd.Delay, opaque); err != nil {
+		return h.conn.fail(err)
+	}
+	return h.conn.fail(simpleCmdLocal(h.rw, binprot.OpcodeFlush, opaque))
+}
+
+// Incr performs an increment request on the remote backend
+func (h Handler) Incr(cmd common.ArithRequest) (uint64, error) {
+	return h.arith(cmd, binprot.OpcodeIncrement)
+}
+
+// Decr performs a decrement request on the remote backend
+func (h Handler) Decr(cmd common.ArithRequest) (uint64, error) {
+	return h.arith(cmd, binprot.OpcodeDecrement)
+}
+
+func (h Handler) arith(cmd common.ArithRequest, opcode uint8) (uint64, error) {
+	// memcached only creates missing keys for expiration times other than this one
+	exptime := cmd.Exptime
+	if !cmd.Create {
+		exptime = 0xffffffff
+	}
+
+	opaque := h.conn.next(1)
+	write := binprot.WriteIncrCmd
+	if opcode == binprot.OpcodeDecrement {
+		write = binprot.WriteDecrCmd
+	}
+	if err := write(h.rw.Writer, cmd.Key, cmd.Delta, cmd.Initial, exptime, opaque); err != nil {
+		return 0, h.conn.fail(err)
+	}
+
+	value, err := arithLocal(h.rw, opcode, opaque)
+	return value, h.conn.fail(err)
 }
 
 // Touch performs a touch request on the remote backend
 func (h Handler) Touch(cmd common.TouchRequest) error {
-	if err := binprot.WriteTouchCmd(h.rw.Writer, cmd.Key, cmd.Exptime, 0); err != nil {
-		return err
+	opaque := h.conn.next(1)
+	if err := binprot.WriteTouchCmd(h.rw.Writer, cmd.Key, cmd.Exptime, opaque); err != nil {
+		return h.conn.fail(err)
 	}
-	return simpleCmdLocal(h.rw)
+	return h.conn.fail(simpleCmdLocal(h.rw, binprot.OpcodeTouch, opaque))
 }
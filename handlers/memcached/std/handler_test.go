@@ -0,0 +1,408 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package std_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/memcached/std"
+	"github.com/netflix/rend/protocol/binprot"
+)
+
+// fakeBackend answers every request on conn with an empty successful response made by respond
+// from the request's opcode and opaque
+func fakeBackend(conn net.Conn, respond func(opcode uint8, opaque uint32) []byte) {
+	defer conn.Close()
+
+	hdr := make([]byte, 24)
+	for {
+		if _, err := io.ReadFull(conn, hdr); err != nil {
+			return
+		}
+		body := binary.BigEndian.Uint32(hdr[8:12])
+		if _, err := io.CopyN(io.Discard, conn, int64(body)); err != nil {
+			return
+		}
+		// Quiet commands may have nothing to say, and an empty write would block on a pipe
+		if res := respond(hdr[1], binary.BigEndian.Uint32(hdr[12:16])); len(res) > 0 {
+			if _, err := conn.Write(res); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func response(opcode uint8, opaque, bodyLen uint32) []byte {
+	res := make([]byte, 24+int(bodyLen))
+	res[0] = binprot.MagicResponse
+	res[1] = opcode
+	binary.BigEndian.PutUint32(res[8:12], bodyLen)
+	binary.BigEndian.PutUint32(res[12:16], opaque)
+	return res
+}
+
+func good(opcode uint8, opaque uint32) []byte { return response(opcode, opaque, 0) }
+
+func TestDesync(t *testing.T) {
+	tests := []struct {
+		name    string
+		respond func(opcode uint8, opaque uint32) []byte
+	}{
+		{"opaque", func(opcode uint8, opaque uint32) []byte { return response(opcode, opaque+1, 0) }},
+		{"opcode", func(opcode uint8, opaque uint32) []byte { return response(opcode+1, opaque, 0) }},
+		{"magic", func(opcode uint8, opaque uint32) []byte {
+			res := response(opcode, opaque, 0)
+			res[0] = 0
+			return res
+		}},
+		{"length", func(opcode uint8, opaque uint32) []byte {
+			res := response(opcode, opaque, 0)
+			binary.BigEndian.PutUint32(res[8:12], 1<<31)
+			return res
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Without a dialer the error can only be passed on
+			client, server := net.Pipe()
+			go fakeBackend(server, test.respond)
+			h := std.NewHandler(client)
+			defer h.Close()
+
+			err := h.Delete(common.DeleteRequest{Key: []byte("foo")})
+			if !errors.Is(err, std.ErrDesync) || common.IsAppError(err) {
+				t.Fatalf("Expected a desync error, got %v", err)
+			}
+
+			// With a dialer the first connection is replaced with one that behaves
+			dials := 0
+			dial := func() (io.ReadWriteCloser, error) {
+				dials++
+				client, server := net.Pipe()
+				if dials == 1 {
+					go fakeBackend(server, test.respond)
+				} else {
+					go fakeBackend(server, good)
+				}
+				return client, nil
+			}
+
+			h, err = std.NewHandlerDialer(dial, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer h.Close()
+
+			err = h.Delete(common.DeleteRequest{Key: []byte("foo")})
+			if !errors.Is(err, std.ErrDesync) || !errors.Is(err, common.ErrTempFailure) {
+				t.Fatalf("Expected a temporary failure from a desync, got %v", err)
+			}
+			if dials != 2 {
+				t.Fatalf("Expected the connection to be replaced, got %d dials", dials)
+			}
+			if err := h.Delete(common.DeleteRequest{Key: []byte("foo")}); err != nil {
+				t.Fatalf("Expected the new connection to work, got %v", err)
+			}
+		})
+	}
+}
+
+func TestDesyncBatch(t *testing.T) {
+	// Answers a quiet delete from outside the batch, which the noop would otherwise hide
+	client, server := net.Pipe()
+	go fakeBackend(server, func(opcode uint8, opaque uint32) []byte {
+		if opcode == binprot.OpcodeNoop {
+			return append(response(binprot.OpcodeDeleteQ, opaque+7, 0), good(opcode, opaque)...)
+		}
+		return nil
+	})
+	h := std.NewHandler(client)
+	defer h.Close()
+
+	errs := h.MultiDelete(common.MultiDeleteRequest{Deletes: []common.DeleteRequest{
+		{Key: []byte("foo")},
+		{Key: []byte("bar")},
+	}})
+	for i, err := range errs {
+		if !errors.Is(err, std.ErrDesync) {
+			t.Fatalf("Expected a desync error for delete %d, got %v", i, err)
+		}
+	}
+}
+
+func TestGetHitChecked(t *testing.T) {
+	// A hit without the flags would have the flags read out of the value
+	client, server := net.Pipe()
+	go fakeBackend(server, func(opcode uint8, opaque uint32) []byte {
+		return response(opcode, opaque, 3)
+	})
+	h := std.NewHandler(client)
+	defer h.Close()
+
+	_, err := h.GAT(common.GATRequest{Key: []byte("foo")})
+	if !errors.Is(err, std.ErrDesync) {
+		t.Fatalf("Expected a desync error, got %v", err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeBackend(server, good)
+	h := std.NewHandler(client)
+	defer h.Close()
+
+	if err := h.Ping(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	dump := "key=catalog%3Av3%3Aa exp=-1 la=1 cas=1 fetch=no cls=1 size=63\r\n" +
+		"key=catalog%3Av2%3Ab exp=-1 la=1 cas=2 fetch=no cls=1 size=63\r\n" +
+		"key=catalog%3Av3%3Ac%20d exp=-1 la=1 cas=3 fetch=no cls=1 size=63\r\n" +
+		"END\r\n"
+
+	dial := func() (io.ReadWriteCloser, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			line := make([]byte, len("lru_crawler metadump all\r\n"))
+			if _, err := io.ReadFull(server, line); err != nil || string(line) != "lru_crawler metadump all\r\n" {
+				return
+			}
+			server.Write([]byte(dump))
+		}()
+		return client, nil
+	}
+
+	h, err := std.NewHandlerDialer(dial, 0, 0)
+	if err != nil {
+		t.Fatalf("Error creating handler: %v", err)
+	}
+
+	keys, err := h.Keys([]byte("catalog:v3:"))
+	if err != nil {
+		t.Fatalf("Error listing keys: %v", err)
+	}
+	if len(keys) != 2 || string(keys[0]) != "catalog:v3:a" || string(keys[1]) != "catalog:v3:c d" {
+		t.Fatalf("Expected the two catalog:v3: keys, got %q", keys)
+	}
+
+	client, server := net.Pipe()
+	defer server.Close()
+	if _, err := std.NewHandler(client).Keys(nil); err != common.ErrNotSupported {
+		t.Fatalf("Expected a handler without a dialer to not list keys, got %v", err)
+	}
+}
+
+func TestServerTime(t *testing.T) {
+	dial := func() (io.ReadWriteCloser, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			line := make([]byte, len("stats\r\n"))
+			if _, err := io.ReadFull(server, line); err != nil || string(line) != "stats\r\n" {
+				return
+			}
+			server.Write([]byte("STAT pid 1\r\nSTAT uptime 10\r\nSTAT time 1500000000\r\nSTAT version 1.6.9\r\nEND\r\n"))
+		}()
+		return client, nil
+	}
+
+	h, err := std.NewHandlerDialer(dial, 0, 0)
+	if err != nil {
+		t.Fatalf("Error creating handler: %v", err)
+	}
+
+	st, err := h.ServerTime()
+	if err != nil || st.Unix() != 1500000000 {
+		t.Fatalf("Expected the time from the stats, got %v %v", st, err)
+	}
+}
+
+func TestArith(t *testing.T) {
+	// a backend with just enough of memcached's arithmetic to check what the handler sends
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		counters := make(map[string]uint64)
+		hdr := make([]byte, 24)
+		for {
+			if _, err := io.ReadFull(server, hdr); err != nil {
+				return
+			}
+			body := make([]byte, binary.BigEndian.Uint32(hdr[8:12]))
+			if _, err := io.ReadFull(server, body); err != nil {
+				return
+			}
+			opcode, opaque := hdr[1], binary.BigEndian.Uint32(hdr[12:16])
+			delta, initial := binary.BigEndian.Uint64(body[0:8]), binary.BigEndian.Uint64(body[8:16])
+			exptime, key := binary.BigEndian.Uint32(body[16:20]), string(body[20:])
+
+			v, ok := counters[key]
+			switch {
+			case !ok && exptime == 0xffffffff:
+				res := response(opcode, opaque, 0)
+				binary.BigEndian.PutUint16(res[6:8], binprot.StatusKeyEnoent)
+				server.Write(res)
+				continue
+			case !ok:
+				v = initial
+			case opcode == binprot.OpcodeIncrement:
+				v += delta
+			case delta > v:
+				v = 0
+			default:
+				v -= delta
+			}
+			counters[key] = v
+
+			res := response(opcode, opaque, 8)
+			binary.BigEndian.PutUint64(res[24:], v)
+			server.Write(res)
+		}
+	}()
+	h := std.NewHandler(client)
+	defer h.Close()
+
+	if _, err := h.Incr(common.ArithRequest{Key: []byte("n"), Delta: 1}); err != common.ErrKeyNotFound {
+		t.Fatalf("Expected a missing key to stay missing without Create, got %v", err)
+	}
+
+	steps := []struct {
+		decr     bool
+		cmd      common.ArithRequest
+		expected uint64
+	}{
+		{false, common.ArithRequest{Key: []byte("n"), Delta: 1, Initial: 10, Create: true}, 10},
+		{false, common.ArithRequest{Key: []byte("n"), Delta: 5}, 15},
+		{true, common.ArithRequest{Key: []byte("n"), Delta: 4}, 11},
+		{true, common.ArithRequest{Key: []byte("n"), Delta: 100}, 0},
+	}
+	for i, s := range steps {
+		f := h.Incr
+		if s.decr {
+			f = h.Decr
+		}
+		v, err := f(s.cmd)
+		if err != nil || v != s.expected {
+			t.Fatalf("Step %d: expected %d, got %d %v", i, s.expected, v, err)
+		}
+	}
+}
+
+// stall reads every request on conn and never answers
+func stall(conn net.Conn) {
+	defer conn.Close()
+	io.Copy(io.Discard, conn)
+}
+
+func TestInterrupt(t *testing.T) {
+	// The first connection stalls and every one after it answers
+	newHandler := func(t *testing.T) (handlers.HandlerV2, *int) {
+		dials := 0
+		dial := func() (io.ReadWriteCloser, error) {
+			dials++
+			client, server := net.Pipe()
+			if dials == 1 {
+				go stall(server)
+			} else {
+				go fakeBackend(server, good)
+			}
+			return client, nil
+		}
+		h, err := std.NewHandlerDialer(dial, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { h.Close() })
+		return handlers.V2(h), &dials
+	}
+
+	check := func(t *testing.T, h handlers.HandlerV2, dials *int, err error, start time.Time) {
+		t.Helper()
+		if !errors.Is(err, common.ErrTempFailure) {
+			t.Fatalf("Expected a temporary failure, got %v", err)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Fatalf("Expected the operation to be cut short, took %v", d)
+		}
+		if *dials != 2 {
+			t.Fatalf("Expected the stalled connection to be replaced, got %d dials", *dials)
+		}
+		if err := h.Delete(context.Background(), common.DeleteRequest{Key: []byte("foo")}); err != nil {
+			t.Fatalf("Expected the new connection to work, got %v", err)
+		}
+	}
+
+	t.Run("Deadline", func(t *testing.T) {
+		h, dials := newHandler(t)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		err := h.Delete(ctx, common.DeleteRequest{Key: []byte("foo")})
+		check(t, h, dials, err, start)
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		h, dials := newHandler(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+
+		start := time.Now()
+		err := h.Delete(ctx, common.DeleteRequest{Key: []byte("foo")})
+		check(t, h, dials, err, start)
+	})
+
+	t.Run("Get", func(t *testing.T) {
+		h, dials := newHandler(t)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		dataOut, errorOut := h.Get(ctx, common.GetRequest{Keys: [][]byte{[]byte("foo")}, Opaques: []uint32{0}, Quiet: []bool{false}})
+		for range dataOut {
+			t.Fatal("Expected no data from a stalled backend")
+		}
+		check(t, h, dials, <-errorOut, start)
+	})
+
+	t.Run("Done", func(t *testing.T) {
+		// A context that ends after its operation leaves the connection alone
+		client, server := net.Pipe()
+		go fakeBackend(server, good)
+		h := handlers.V2(std.NewHandler(client))
+		defer h.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		if err := h.Delete(ctx, common.DeleteRequest{Key: []byte("foo")}); err != nil {
+			t.Fatal(err)
+		}
+		cancel()
+		if err := h.Delete(context.Background(), common.DeleteRequest{Key: []byte("foo")}); err != nil {
+			t.Fatalf("Expected the connection to still work, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,87 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package std
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/url"
+
+	"github.com/netflix/rend/common"
+)
+
+// Keys lists the keys in the backend that start with prefix using lru_crawler metadump. Memcached
+// only speaks that in the text protocol and picks the protocol of a connection from its first
+// command, so the dump runs on a connection of its own. Handlers made without a dialer can't list
+// keys.
+func (h Handler) Keys(prefix []byte) ([][]byte, error) {
+	if h.conn.dial == nil {
+		return nil, common.ErrNotSupported
+	}
+
+	conn, err := h.conn.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return metadump(conn, prefix)
+}
+
+// metadump runs lru_crawler metadump on a text protocol connection. Each line of the dump is a
+// list of name=value pairs starting with the URI encoded key.
+func metadump(rw io.ReadWriter, prefix []byte) ([][]byte, error) {
+	if _, err := io.WriteString(rw, "lru_crawler metadump all\r\n"); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(rw)
+	var keys [][]byte
+
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = bytes.TrimRight(line, "\r\n")
+
+		switch {
+		case bytes.Equal(line, []byte("END")):
+			return keys, nil
+		case bytes.HasPrefix(line, []byte("BUSY")):
+			// another crawl is running
+			return nil, common.ErrBusy
+		case bytes.HasPrefix(line, []byte("ERROR")), bytes.HasPrefix(line, []byte("CLIENT_ERROR")):
+			// a memcached older than 1.4.32 or started without the crawler
+			return nil, common.ErrNotSupported
+		case !bytes.HasPrefix(line, []byte("key=")):
+			continue
+		}
+
+		field := line[len("key="):]
+		if idx := bytes.IndexByte(field, ' '); idx >= 0 {
+			field = field[:idx]
+		}
+
+		key, err := url.PathUnescape(string(field))
+		if err != nil {
+			return nil, common.ErrInternal
+		}
+		if bytes.HasPrefix([]byte(key), prefix) {
+			keys = append(keys, []byte(key))
+		}
+	}
+}
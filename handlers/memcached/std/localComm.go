@@ -17,6 +17,7 @@ package std
 import (
 	"bufio"
 	"encoding/binary"
+	"fmt"
 	"io"
 
 	"github.com/netflix/rend/common"
@@ -24,12 +25,12 @@ import (
 	"github.com/netflix/rend/protocol/binprot"
 )
 
-func simpleCmdLocal(rw *bufio.ReadWriter) error {
+func simpleCmdLocal(rw *bufio.ReadWriter, opcode uint8, opaque uint32) error {
 	if err := rw.Flush(); err != nil {
 		return err
 	}
 
-	resHeader, err := binprot.ReadResponseHeader(rw)
+	resHeader, err := readHeader(rw, opcode, opaque)
 	if err != nil {
 		return err
 	}
@@ -52,14 +53,54 @@ func simpleCmdLocal(rw *bufio.ReadWriter) error {
 	return err
 }
 
-func getLocal(rw *bufio.ReadWriter, readExp bool) (data []byte, flags, exp uint32, err error) {
+// arithLocal reads the response to an increment or decrement, which is the new value
+func arithLocal(rw *bufio.ReadWriter, opcode uint8, opaque uint32) (uint64, error) {
 	if err := rw.Flush(); err != nil {
-		return nil, 0, 0, err
+		return 0, err
 	}
 
-	resHeader, err := binprot.ReadResponseHeader(rw)
+	resHeader, err := readHeader(rw, opcode, opaque)
 	if err != nil {
-		return nil, 0, 0, err
+		return 0, err
+	}
+	defer binprot.PutResponseHeader(resHeader)
+
+	if err := binprot.DecodeError(resHeader); err != nil {
+		n, ioerr := rw.Discard(int(resHeader.TotalBodyLength))
+		metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
+		if ioerr != nil {
+			return 0, ioerr
+		}
+		return 0, err
+	}
+
+	if resHeader.TotalBodyLength != 8 || resHeader.KeyLength != 0 || resHeader.ExtraLength != 0 {
+		return 0, fmt.Errorf("%w: arithmetic response with %d bytes of body", ErrDesync, resHeader.TotalBodyLength)
+	}
+
+	var value uint64
+	if err := binary.Read(rw, binary.BigEndian, &value); err != nil {
+		return 0, err
+	}
+	metrics.IncCounterBy(common.MetricBytesReadLocal, 8)
+
+	return value, nil
+}
+
+func getLocal(rw *bufio.ReadWriter, opcode uint8, opaque uint32, readExp bool) (data []byte, flags, exp uint32, err error) {
+	data, flags, exp, _, err = getLocalCAS(rw, opcode, opaque, readExp)
+	return
+}
+
+// getLocalCAS is getLocal that also returns the CAS value of the item
+func getLocalCAS(rw *bufio.ReadWriter, opcode uint8, opaque uint32, readExp bool) (data []byte, flags, exp uint32, cas uint64, err error) {
+	if err := rw.Flush(); err != nil {
+		return nil, 0, 0, 0, err
+	}
+
+	resHeader, err := readHeader(rw, opcode, opaque)
+	if err != nil {
+		return nil, 0, 0, 0, err
 	}
 	defer binprot.PutResponseHeader(resHeader)
 
@@ -68,9 +109,19 @@ func getLocal(rw *bufio.ReadWriter, readExp bool) (data []byte, flags, exp uint3
 		n, ioerr := rw.Discard(int(resHeader.TotalBodyLength))
 		metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
 		if ioerr != nil {
-			return nil, 0, 0, ioerr
+			return nil, 0, 0, 0, ioerr
 		}
-		return nil, 0, 0, err
+		return nil, 0, 0, 0, err
+	}
+
+	// A hit always has the flags, and the expiration time for gete. The key isn't sent back.
+	extraLen := uint8(4)
+	if readExp {
+		extraLen = 8
+	}
+	if resHeader.ExtraLength != extraLen || resHeader.KeyLength != 0 {
+		return nil, 0, 0, 0, fmt.Errorf("%w: hit with %d bytes of key and %d bytes of extras",
+			ErrDesync, resHeader.KeyLength, resHeader.ExtraLength)
 	}
 
 	var serverFlags uint32
@@ -91,8 +142,8 @@ func getLocal(rw *bufio.ReadWriter, readExp bool) (data []byte, flags, exp uint3
 	n, err := io.ReadAtLeast(rw, buf, int(dataLen))
 	metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
 	if err != nil {
-		return nil, 0, 0, err
+		return nil, 0, 0, 0, err
 	}
 
-	return buf, serverFlags, serverExp, nil
+	return buf, serverFlags, serverExp, resHeader.CASToken, nil
 }
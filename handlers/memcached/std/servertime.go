@@ -0,0 +1,76 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package std
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/netflix/rend/common"
+)
+
+// ServerTime returns memcached's clock from the time line of its stats. Like Keys, this runs on a
+// text protocol connection of its own, so handlers made without a dialer can't tell the time.
+func (h Handler) ServerTime() (time.Time, error) {
+	if h.conn.dial == nil {
+		return time.Time{}, common.ErrNotSupported
+	}
+
+	conn, err := h.conn.dial()
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer conn.Close()
+
+	return statsTime(conn)
+}
+
+// statsTime runs stats on a text protocol connection and reads the STAT time line, which is the
+// server's unix time in seconds
+func statsTime(rw io.ReadWriter) (time.Time, error) {
+	if _, err := io.WriteString(rw, "stats\r\n"); err != nil {
+		return time.Time{}, err
+	}
+
+	r := bufio.NewReader(rw)
+	var t time.Time
+
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return time.Time{}, err
+		}
+		line = bytes.TrimRight(line, "\r\n")
+
+		switch {
+		case bytes.Equal(line, []byte("END")):
+			if t.IsZero() {
+				return time.Time{}, common.ErrNotSupported
+			}
+			return t, nil
+		case bytes.HasPrefix(line, []byte("ERROR")), bytes.HasPrefix(line, []byte("CLIENT_ERROR")):
+			return time.Time{}, common.ErrNotSupported
+		case bytes.HasPrefix(line, []byte("STAT time ")):
+			secs, err := strconv.ParseInt(string(line[len("STAT time "):]), 10, 64)
+			if err != nil {
+				return time.Time{}, common.ErrInternal
+			}
+			t = time.Unix(secs, 0)
+		}
+	}
+}
@@ -0,0 +1,360 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package migration
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+// Handler is the per-connection handler for a Migration. In the dual phase the old backend is
+// authoritative: a write fails if it fails there, while a write that fails to be mirrored to the
+// new backend is resynced, since the new backend may have been left with an outdated value.
+type Handler struct {
+	m   *Migration
+	old handlers.Handler
+	new handlers.Handler
+}
+
+func (h *Handler) mirrorFailed(key []byte, err error) {
+	log.Println("Error mirroring write to new backend during migration:", err.Error())
+	metrics.IncCounter(MetricMirrorErrors)
+	h.resync(key)
+}
+
+// resync brings the new backend's copy of a key back in line with the old backend after a write
+// that couldn't be applied to it the same way. Reads are served from the new backend first, so
+// the key is removed from it and copied over again. If it can't be removed now, the copier
+// removes it before copying.
+func (h *Handler) resync(key []byte) {
+	if err := h.new.Delete(common.DeleteRequest{Key: key}); err != nil && !errors.Is(err, common.ErrKeyNotFound) {
+		log.Println("Error removing outdated key from new backend during migration:", err.Error())
+		metrics.IncCounter(MetricMirrorErrors)
+		h.m.enqueue(key, true)
+		return
+	}
+	h.m.Enqueue(key)
+}
+
+func (h *Handler) Set(cmd common.SetRequest) error {
+	switch h.m.Phase() {
+	case PhaseOld:
+		return h.old.Set(cmd)
+	case PhaseNew:
+		return h.new.Set(cmd)
+	}
+
+	if err := h.old.Set(cmd); err != nil {
+		return err
+	}
+	if err := h.new.Set(cmd); err != nil {
+		h.mirrorFailed(cmd.Key, err)
+	}
+	return nil
+}
+
+// conditional performs an operation whose result depends on the existing value. Whether it
+// applies is decided by the old backend. The new backend can't be updated the same way because
+// its copy of the key may be missing, so the key is resynced instead.
+func (h *Handler) conditional(cmd common.SetRequest, oldOp, newOp func(common.SetRequest) error) error {
+	switch h.m.Phase() {
+	case PhaseOld:
+		return oldOp(cmd)
+	case PhaseNew:
+		return newOp(cmd)
+	}
+
+	if err := oldOp(cmd); err != nil {
+		return err
+	}
+
+	h.resync(cmd.Key)
+	return nil
+}
+
+func (h *Handler) Add(cmd common.SetRequest) error {
+	return h.conditional(cmd, h.old.Add, h.new.Add)
+}
+
+func (h *Handler) Replace(cmd common.SetRequest) error {
+	return h.conditional(cmd, h.old.Replace, h.new.Replace)
+}
+
+func (h *Handler) Append(cmd common.SetRequest) error {
+	return h.conditional(cmd, h.old.Append, h.new.Append)
+}
+
+func (h *Handler) Prepend(cmd common.SetRequest) error {
+	return h.conditional(cmd, h.old.Prepend, h.new.Prepend)
+}
+
+func (h *Handler) Delete(cmd common.DeleteRequest) error {
+	switch h.m.Phase() {
+	case PhaseOld:
+		return h.old.Delete(cmd)
+	case PhaseNew:
+		return h.new.Delete(cmd)
+	}
+
+	err := h.old.Delete(cmd)
+	if err != nil && !errors.Is(err, common.ErrKeyNotFound) {
+		return err
+	}
+
+	if nerr := h.new.Delete(cmd); nerr != nil && !errors.Is(nerr, common.ErrKeyNotFound) {
+		h.mirrorFailed(cmd.Key, nerr)
+	}
+
+	return err
+}
+
+// authoritative is the backend that holds locks and whose clock decides expiration: the old one
+// until the migration is done
+func (h *Handler) authoritative() handlers.Handler {
+	if h.m.Phase() == PhaseNew {
+		return h.new
+	}
+	return h.old
+}
+
+func (h *Handler) GetLock(cmd common.GetLockRequest) (common.GetLockResponse, error) {
+	return handlers.GetLock(h.authoritative(), cmd)
+}
+
+func (h *Handler) Unlock(cmd common.UnlockRequest) error {
+	return handlers.Unlock(h.authoritative(), cmd)
+}
+
+func (h *Handler) ServerTime() (time.Time, error) {
+	return handlers.ServerTime(h.authoritative())
+}
+
+// Flush flushes whichever backends are in use in the current phase, both in the dual phase like
+// deletes
+func (h *Handler) Flush(cmd common.FlushRequest) error {
+	switch h.m.Phase() {
+	case PhaseOld:
+		return handlers.Flush(h.old, cmd)
+	case PhaseNew:
+		return handlers.Flush(h.new, cmd)
+	}
+
+	if err := handlers.Flush(h.old, cmd); err != nil {
+		return err
+	}
+	return handlers.Flush(h.new, cmd)
+}
+
+// Keys lists the keys of whichever backends are in use in the current phase. In the dual phase a
+// key in both is only listed once.
+func (h *Handler) Keys(prefix []byte) ([][]byte, error) {
+	switch h.m.Phase() {
+	case PhaseOld:
+		return handlers.Keys(h.old, prefix)
+	case PhaseNew:
+		return handlers.Keys(h.new, prefix)
+	}
+
+	keys, err := handlers.Keys(h.old, prefix)
+	if err != nil {
+		return nil, err
+	}
+	newKeys, err := handlers.Keys(h.new, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]struct{}, len(keys))
+	for _, k := range keys {
+		seen[string(k)] = struct{}{}
+	}
+	for _, k := range newKeys {
+		if _, ok := seen[string(k)]; !ok {
+			keys = append(keys, k)
+		}
+	}
+
+	return keys, nil
+}
+
+func (h *Handler) Touch(cmd common.TouchRequest) error {
+	switch h.m.Phase() {
+	case PhaseOld:
+		return h.old.Touch(cmd)
+	case PhaseNew:
+		return h.new.Touch(cmd)
+	}
+
+	if err := h.old.Touch(cmd); err != nil {
+		return err
+	}
+
+	if err := h.new.Touch(cmd); err != nil && !errors.Is(err, common.ErrKeyNotFound) {
+		h.mirrorFailed(cmd.Key, err)
+	}
+
+	return nil
+}
+
+func (h *Handler) fallbackHit(key []byte) {
+	atomic.AddUint64(&h.m.fallbackHits, 1)
+	metrics.IncCounter(MetricFallbackHits)
+	h.m.Enqueue(key)
+}
+
+func (h *Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	switch h.m.Phase() {
+	case PhaseOld:
+		return h.old.Get(cmd)
+	case PhaseNew:
+		return h.new.Get(cmd)
+	}
+
+	dataOut := make(chan common.GetResponse, len(cmd.Keys))
+	errorOut := make(chan error, 1)
+
+	go func() {
+		defer close(dataOut)
+		defer close(errorOut)
+
+		var miss common.GetRequest
+
+		resChan, errChan := h.new.Get(cmd)
+		err := handlers.DrainGet(resChan, errChan, func(res common.GetResponse) error {
+			if res.Miss {
+				miss.Keys = append(miss.Keys, res.Key)
+				miss.Opaques = append(miss.Opaques, res.Opaque)
+				miss.Quiet = append(miss.Quiet, res.Quiet)
+				return nil
+			}
+			dataOut <- res
+			return nil
+		})
+		if err != nil {
+			errorOut <- err
+			return
+		}
+
+		if len(miss.Keys) == 0 {
+			return
+		}
+
+		resChan, errChan = h.old.Get(miss)
+		err = handlers.DrainGet(resChan, errChan, func(res common.GetResponse) error {
+			if !res.Miss {
+				h.fallbackHit(res.Key)
+			}
+			dataOut <- res
+			return nil
+		})
+		if err != nil {
+			errorOut <- err
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+func (h *Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	switch h.m.Phase() {
+	case PhaseOld:
+		return h.old.GetE(cmd)
+	case PhaseNew:
+		return h.new.GetE(cmd)
+	}
+
+	dataOut := make(chan common.GetEResponse, len(cmd.Keys))
+	errorOut := make(chan error, 1)
+
+	go func() {
+		defer close(dataOut)
+		defer close(errorOut)
+
+		var miss common.GetRequest
+
+		resChan, errChan := h.new.GetE(cmd)
+		err := handlers.DrainGetE(resChan, errChan, func(res common.GetEResponse) error {
+			if res.Miss {
+				miss.Keys = append(miss.Keys, res.Key)
+				miss.Opaques = append(miss.Opaques, res.Opaque)
+				miss.Quiet = append(miss.Quiet, res.Quiet)
+				return nil
+			}
+			dataOut <- res
+			return nil
+		})
+		if err != nil {
+			errorOut <- err
+			return
+		}
+
+		if len(miss.Keys) == 0 {
+			return
+		}
+
+		resChan, errChan = h.old.GetE(miss)
+		err = handlers.DrainGetE(resChan, errChan, func(res common.GetEResponse) error {
+			if !res.Miss {
+				h.fallbackHit(res.Key)
+			}
+			dataOut <- res
+			return nil
+		})
+		if err != nil {
+			errorOut <- err
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	switch h.m.Phase() {
+	case PhaseOld:
+		return h.old.GAT(cmd)
+	case PhaseNew:
+		return h.new.GAT(cmd)
+	}
+
+	// The touch has to apply to the old backend as the authority, whether or not it hits in new
+	res, err := h.old.GAT(cmd)
+	if err != nil || res.Miss {
+		return res, err
+	}
+
+	nres, err := h.new.GAT(cmd)
+	if err != nil {
+		h.mirrorFailed(cmd.Key, err)
+	} else if nres.Miss {
+		h.fallbackHit(cmd.Key)
+	}
+
+	return res, nil
+}
+
+// Close closes both backends
+func (h *Handler) Close() error {
+	err := h.old.Close()
+	if nerr := h.new.Close(); err == nil {
+		err = nerr
+	}
+	return err
+}
@@ -0,0 +1,381 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package migration moves a cache from one backend to another without going cold. A Migration
+// starts out dual-writing: every write goes to the old backend, which stays authoritative, and is
+// mirrored to the new one, while reads are served from the new backend with a fallback to the old
+// one. Keys that are only found in the old backend are copied in the background, as are keys fed
+// in from a key list. Once enough has been copied, the migration is cut over and the old backend
+// is no longer used.
+package migration
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricFallbackHits = metrics.AddCounter("migration_fallback_hits", nil)
+	MetricMirrorErrors = metrics.AddCounter("migration_mirror_errors", nil)
+	MetricCopied       = metrics.AddCounter("migration_copied", nil)
+	MetricCopySkipped  = metrics.AddCounter("migration_copy_skipped", nil)
+	MetricCopyMisses   = metrics.AddCounter("migration_copy_misses", nil)
+	MetricCopyErrors   = metrics.AddCounter("migration_copy_errors", nil)
+	MetricCopyDropped  = metrics.AddCounter("migration_copy_dropped", nil)
+	MetricPhaseChanges = metrics.AddCounter("migration_phase_changes", nil)
+)
+
+// Phase is the stage a migration is in
+type Phase int32
+
+const (
+	// PhaseOld uses only the old backend, as if there was no migration. This is the rollback.
+	PhaseOld Phase = iota
+	// PhaseDual writes to both backends and reads from the new one with a fallback to the old one
+	PhaseDual
+	// PhaseNew uses only the new backend. This is the cutover.
+	PhaseNew
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseOld:
+		return "old"
+	case PhaseDual:
+		return "dual"
+	case PhaseNew:
+		return "new"
+	}
+	return "unknown"
+}
+
+// ParsePhase is the inverse of Phase.String
+func ParsePhase(s string) (Phase, error) {
+	switch s {
+	case "old":
+		return PhaseOld, nil
+	case "dual":
+		return PhaseDual, nil
+	case "new":
+		return PhaseNew, nil
+	}
+	return PhaseOld, fmt.Errorf("Unknown migration phase %q", s)
+}
+
+// the number of keys waiting to be copied before more are dropped
+const copyQueueSize = 100000
+
+// Migration holds the state of a migration shared by all connections
+type Migration struct {
+	// progress, for reporting. These are first to keep them 64-bit aligned for atomic access.
+	enqueued     uint64
+	copied       uint64
+	skipped      uint64
+	misses       uint64
+	copyErrors   uint64
+	dropped      uint64
+	fallbackHits uint64
+
+	from, to    handlers.HandlerConst
+	copyExptime uint32
+	phase       int32
+
+	queue chan copyRequest
+
+	// set by the copier once the old backend turns out not to support gete
+	noGetE bool
+}
+
+// copyRequest is a key waiting to be copied. A key being resynced is removed from the new backend
+// before it's copied, since the copy doesn't overwrite what's there already.
+type copyRequest struct {
+	key    []byte
+	resync bool
+}
+
+// New starts a migration in the dual-write phase. The name identifies the migration in metrics.
+//
+// Copied keys keep the expiration time they have in the old backend if it gives it out with gete,
+// like rend's own in-memory backend. Memcached doesn't, so keys copied from it are all written to
+// the new backend with copyExptime instead, however long they had left. Keys that should expire
+// sooner than that live on in the new backend until copyExptime, or until they are written again.
+func New(name string, from, to handlers.HandlerConst, copyExptime uint32) *Migration {
+	m := &Migration{
+		from:        from,
+		to:          to,
+		copyExptime: copyExptime,
+		phase:       int32(PhaseDual),
+		queue:       make(chan copyRequest, copyQueueSize),
+	}
+
+	tags := metrics.Tags{"migration": name}
+	metrics.RegisterIntGaugeCallback("migration_copy_queue_depth", tags, func() uint64 {
+		return uint64(len(m.queue))
+	})
+
+	go m.copier()
+
+	return m
+}
+
+func (m *Migration) Phase() Phase {
+	return Phase(atomic.LoadInt32(&m.phase))
+}
+
+// SetPhase switches every connection to the given phase for their next request
+func (m *Migration) SetPhase(p Phase) {
+	if old := Phase(atomic.SwapInt32(&m.phase, int32(p))); old != p {
+		log.Printf("Migration phase changed from %v to %v\n", old, p)
+		metrics.IncCounter(MetricPhaseChanges)
+	}
+}
+
+// Enqueue schedules a key to be copied from the old backend to the new one. It returns false if
+// the queue is full and the key was dropped.
+func (m *Migration) Enqueue(key []byte) bool {
+	return m.enqueue(key, false)
+}
+
+func (m *Migration) enqueue(key []byte, resync bool) bool {
+	select {
+	case m.queue <- copyRequest{key: append([]byte(nil), key...), resync: resync}:
+		atomic.AddUint64(&m.enqueued, 1)
+		return true
+	default:
+		atomic.AddUint64(&m.dropped, 1)
+		metrics.IncCounter(MetricCopyDropped)
+		return false
+	}
+}
+
+// CopyKeysFrom reads keys, one per line, and queues them all to be copied. Unlike Enqueue it
+// waits for room in the queue, so an arbitrarily large key list can be fed through.
+func (m *Migration) CopyKeysFrom(r io.Reader) error {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		m.queue <- copyRequest{key: append([]byte(nil), s.Bytes()...)}
+		atomic.AddUint64(&m.enqueued, 1)
+	}
+	return s.Err()
+}
+
+// HandlerConst returns a constructor for per-connection handlers that follow the migration
+func (m *Migration) HandlerConst() handlers.HandlerConst {
+	return func() (handlers.Handler, error) {
+		src, err := m.from()
+		if err != nil {
+			return nil, err
+		}
+
+		dst, err := m.to()
+		if err != nil {
+			src.Close()
+			return nil, err
+		}
+
+		return &Handler{
+			m:   m,
+			old: src,
+			new: dst,
+		}, nil
+	}
+}
+
+func (m *Migration) copier() {
+	var src, dst handlers.Handler
+
+	for req := range m.queue {
+		if m.Phase() != PhaseDual {
+			// Nothing to copy into while rolled back, and nothing to copy from once cut over
+			continue
+		}
+
+		var err error
+		if src == nil {
+			if src, err = m.from(); err != nil {
+				m.copyFailed(err)
+				continue
+			}
+		}
+		if dst == nil {
+			if dst, err = m.to(); err != nil {
+				m.copyFailed(err)
+				continue
+			}
+		}
+
+		if req.resync {
+			err = dst.Delete(common.DeleteRequest{Key: req.key})
+			if errors.Is(err, common.ErrKeyNotFound) {
+				err = nil
+			}
+		}
+		if err == nil {
+			err = m.copyKey(src, dst, req.key)
+		}
+		if err != nil {
+			m.copyFailed(err)
+			// start from fresh connections in case these are broken
+			src.Close()
+			dst.Close()
+			src, dst = nil, nil
+		}
+	}
+}
+
+func (m *Migration) copyFailed(err error) {
+	log.Println("Error copying key for migration:", err.Error())
+	atomic.AddUint64(&m.copyErrors, 1)
+	metrics.IncCounter(MetricCopyErrors)
+}
+
+func (m *Migration) copyKey(src, dst handlers.Handler, key []byte) error {
+	res, err := m.readSource(src, key)
+	if err != nil {
+		return err
+	}
+
+	if res.Miss {
+		atomic.AddUint64(&m.misses, 1)
+		metrics.IncCounter(MetricCopyMisses)
+		return nil
+	}
+
+	// Add instead of set so a newer mirrored write is never overwritten by the copy
+	err = dst.Add(common.SetRequest{
+		Key:     key,
+		Data:    res.Data,
+		Flags:   res.Flags,
+		Exptime: res.Exptime,
+	})
+
+	switch common.ClassOf(err) {
+	case common.ClassNone:
+		atomic.AddUint64(&m.copied, 1)
+		metrics.IncCounter(MetricCopied)
+	case common.ClassConflict:
+		atomic.AddUint64(&m.skipped, 1)
+		metrics.IncCounter(MetricCopySkipped)
+	default:
+		return err
+	}
+
+	return nil
+}
+
+// readSource reads a key from the old backend along with its expiration time. If the backend
+// doesn't support gete, it's read with a plain get from then on and the copy expires after
+// copyExptime.
+func (m *Migration) readSource(src handlers.Handler, key []byte) (common.GetEResponse, error) {
+	if !m.noGetE {
+		res, err := getOneE(src, key)
+		if !errors.Is(err, common.ErrUnknownCmd) && !errors.Is(err, common.ErrNotSupported) {
+			return res, err
+		}
+		m.noGetE = true
+	}
+
+	res, err := getOne(src, key)
+	return common.GetEResponse{
+		Key:     res.Key,
+		Data:    res.Data,
+		Flags:   res.Flags,
+		Exptime: m.copyExptime,
+		Miss:    res.Miss,
+	}, err
+}
+
+func getOneE(h handlers.Handler, key []byte) (common.GetEResponse, error) {
+	var res common.GetEResponse
+	resChan, errChan := h.GetE(common.GetRequest{
+		Keys:    [][]byte{key},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+	err := handlers.DrainGetE(resChan, errChan, func(r common.GetEResponse) error {
+		res = r
+		return nil
+	})
+	return res, err
+}
+
+func getOne(h handlers.Handler, key []byte) (common.GetResponse, error) {
+	var res common.GetResponse
+	resChan, errChan := h.Get(common.GetRequest{
+		Keys:    [][]byte{key},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+	err := handlers.DrainGet(resChan, errChan, func(r common.GetResponse) error {
+		res = r
+		return nil
+	})
+	return res, err
+}
+
+// Status is a snapshot of the progress of a migration
+type Status struct {
+	Phase        string `json:"phase"`
+	Queued       int    `json:"queued"`
+	Enqueued     uint64 `json:"enqueued"`
+	Copied       uint64 `json:"copied"`
+	Skipped      uint64 `json:"skipped"`
+	Misses       uint64 `json:"misses"`
+	CopyErrors   uint64 `json:"copy_errors"`
+	Dropped      uint64 `json:"dropped"`
+	FallbackHits uint64 `json:"fallback_hits"`
+}
+
+func (m *Migration) Status() Status {
+	return Status{
+		Phase:        m.Phase().String(),
+		Queued:       len(m.queue),
+		Enqueued:     atomic.LoadUint64(&m.enqueued),
+		Copied:       atomic.LoadUint64(&m.copied),
+		Skipped:      atomic.LoadUint64(&m.skipped),
+		Misses:       atomic.LoadUint64(&m.misses),
+		CopyErrors:   atomic.LoadUint64(&m.copyErrors),
+		Dropped:      atomic.LoadUint64(&m.dropped),
+		FallbackHits: atomic.LoadUint64(&m.fallbackHits),
+	}
+}
+
+// ServeHTTP reports the status of the migration as JSON. A POST with a phase parameter, e.g.
+// ?phase=new, switches the migration to that phase first.
+func (m *Migration) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		p, err := ParsePhase(r.FormValue("phase"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m.SetPhase(p)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.Status())
+}
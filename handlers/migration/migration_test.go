@@ -0,0 +1,277 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package migration_test
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/inmem"
+	"github.com/netflix/rend/handlers/migration"
+)
+
+// mapHandler is just enough of a handler for a migration. It's shared by the connections and the
+// background copier, so it has to be locked.
+type mapHandler struct {
+	sync.Mutex
+	data map[string]string
+}
+
+func newMapHandler() *mapHandler {
+	return &mapHandler{data: make(map[string]string)}
+}
+
+func (m *mapHandler) get(key string) (string, bool) {
+	m.Lock()
+	defer m.Unlock()
+	v, ok := m.data[key]
+	return v, ok
+}
+
+func (m *mapHandler) Set(cmd common.SetRequest) error {
+	m.Lock()
+	defer m.Unlock()
+	m.data[string(cmd.Key)] = string(cmd.Data)
+	return nil
+}
+
+func (m *mapHandler) Add(cmd common.SetRequest) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.data[string(cmd.Key)]; ok {
+		return common.ErrNotAdded
+	}
+	m.data[string(cmd.Key)] = string(cmd.Data)
+	return nil
+}
+
+func (m *mapHandler) Replace(cmd common.SetRequest) error { return common.ErrItemNotStored }
+func (m *mapHandler) Append(cmd common.SetRequest) error  { return common.ErrItemNotStored }
+func (m *mapHandler) Prepend(cmd common.SetRequest) error { return common.ErrItemNotStored }
+
+// GetE isn't supported, like in memcached
+func (m *mapHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	resChan := make(chan common.GetEResponse)
+	close(resChan)
+	errChan := make(chan error, 1)
+	errChan <- common.ErrUnknownCmd
+	close(errChan)
+	return resChan, errChan
+}
+func (m *mapHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	return common.GetResponse{Miss: true}, nil
+}
+func (m *mapHandler) Touch(cmd common.TouchRequest) error { return nil }
+func (m *mapHandler) Close() error                        { return nil }
+
+func (m *mapHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	resChan := make(chan common.GetResponse, len(cmd.Keys))
+	errChan := make(chan error)
+
+	for i, k := range cmd.Keys {
+		v, ok := m.get(string(k))
+		resChan <- common.GetResponse{
+			Key:    k,
+			Data:   []byte(v),
+			Opaque: cmd.Opaques[i],
+			Quiet:  cmd.Quiet[i],
+			Miss:   !ok,
+		}
+	}
+
+	close(resChan)
+	close(errChan)
+	return resChan, errChan
+}
+
+func (m *mapHandler) Delete(cmd common.DeleteRequest) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.data[string(cmd.Key)]; !ok {
+		return common.ErrKeyNotFound
+	}
+	delete(m.data, string(cmd.Key))
+	return nil
+}
+
+func constOf(h handlers.Handler) handlers.HandlerConst {
+	return func() (handlers.Handler, error) { return h, nil }
+}
+
+func getAll(t *testing.T, h handlers.Handler, keys ...string) map[string]string {
+	req := common.GetRequest{}
+	for i, k := range keys {
+		req.Keys = append(req.Keys, []byte(k))
+		req.Opaques = append(req.Opaques, uint32(i))
+		req.Quiet = append(req.Quiet, false)
+	}
+
+	ret := make(map[string]string)
+	resChan, errChan := h.Get(req)
+	for resChan != nil || errChan != nil {
+		select {
+		case res, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			} else if !res.Miss {
+				ret[string(res.Key)] = string(res.Data)
+			}
+		case err, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			} else {
+				t.Fatalf("Unexpected error from get: %v", err)
+			}
+		}
+	}
+	return ret
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("Timed out waiting for migration")
+}
+
+func TestMigration(t *testing.T) {
+	old, nw := newMapHandler(), newMapHandler()
+	old.data["existing"] = "a"
+	old.data["listed"] = "b"
+
+	m := migration.New("test", constOf(old), constOf(nw), 0)
+	h, err := m.HandlerConst()()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// writes go to both
+	h.Set(common.SetRequest{Key: []byte("written"), Data: []byte("c")})
+	if _, ok := nw.get("written"); !ok {
+		t.Fatal("Expected write to be mirrored to the new backend")
+	}
+
+	// reads fall back to the old backend and queue the key for copying
+	got := getAll(t, h, "existing", "written", "nothing")
+	if got["existing"] != "a" || got["written"] != "c" || len(got) != 2 {
+		t.Fatalf("Unexpected get results %v", got)
+	}
+	waitFor(t, func() bool { _, ok := nw.get("existing"); return ok })
+	if s := m.Status(); s.FallbackHits != 1 {
+		t.Fatalf("Expected 1 fallback hit, got %+v", s)
+	}
+
+	// key lists are copied in the background
+	if err := m.CopyKeysFrom(strings.NewReader("listed\n\nwritten\n")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { s := m.Status(); return s.Copied == 2 && s.Skipped == 1 })
+
+	// after cutover only the new backend is used
+	m.SetPhase(migration.PhaseNew)
+	h.Delete(common.DeleteRequest{Key: []byte("listed")})
+	if _, ok := old.get("listed"); !ok {
+		t.Fatal("Expected the old backend to be untouched after cutover")
+	}
+	if got := getAll(t, h, "listed"); len(got) != 0 {
+		t.Fatalf("Expected a miss after delete, got %v", got)
+	}
+}
+
+// flakyHandler fails the next writes it's given
+type flakyHandler struct {
+	*mapHandler
+	fails int
+}
+
+func (f *flakyHandler) fail() error {
+	f.Lock()
+	defer f.Unlock()
+	if f.fails == 0 {
+		return nil
+	}
+	f.fails--
+	return common.ErrTempFailure
+}
+
+func (f *flakyHandler) Set(cmd common.SetRequest) error {
+	if err := f.fail(); err != nil {
+		return err
+	}
+	return f.mapHandler.Set(cmd)
+}
+
+func (f *flakyHandler) Delete(cmd common.DeleteRequest) error {
+	if err := f.fail(); err != nil {
+		return err
+	}
+	return f.mapHandler.Delete(cmd)
+}
+
+func TestMirrorFailed(t *testing.T) {
+	// fails is how many writes to the new backend fail: just the set, or the removal after it too
+	for _, fails := range []int{1, 2} {
+		old, nw := newMapHandler(), &flakyHandler{mapHandler: newMapHandler()}
+		m := migration.New("test", constOf(old), constOf(nw), 0)
+		h, err := m.HandlerConst()()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("a")})
+		nw.Lock()
+		nw.fails = fails
+		nw.Unlock()
+		if err := h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("b")}); err != nil {
+			t.Fatalf("Expected the write to succeed on the old backend, got %v", err)
+		}
+
+		// The outdated value is never read back, and the new one is copied over
+		waitFor(t, func() bool { v, _ := nw.get("foo"); return v == "b" })
+		if got := getAll(t, h, "foo"); got["foo"] != "b" {
+			t.Fatalf("Expected the new value after %d failed writes, got %v", fails, got)
+		}
+	}
+}
+
+func TestCopyExptime(t *testing.T) {
+	old, _ := inmem.New()
+	nw, _ := inmem.New()
+	old.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("a"), Exptime: 100})
+
+	m := migration.New("test", constOf(old), constOf(nw), 0)
+	m.Enqueue([]byte("foo"))
+
+	var res common.GetEResponse
+	waitFor(t, func() bool {
+		resChan, errChan := nw.GetE(common.GetRequest{Keys: [][]byte{[]byte("foo")}, Opaques: []uint32{0}, Quiet: []bool{false}})
+		for r := range resChan {
+			res = r
+		}
+		<-errChan
+		return !res.Miss && res.Key != nil
+	})
+
+	if now := uint32(time.Now().Unix()); res.Exptime < now+90 || res.Exptime > now+100 {
+		t.Fatalf("Expected the copy to keep the old backend's expiration, got %d at %d", res.Exptime, now)
+	}
+}
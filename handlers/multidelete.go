@@ -0,0 +1,69 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"context"
+
+	"github.com/netflix/rend/common"
+)
+
+// MultiDeleter is implemented by handlers that can do a whole batch of deletes in fewer round trips
+// than doing them one by one. It is optional; MultiDelete falls back to serial deletes for handlers
+// without it.
+//
+// The returned slice has one entry per delete in the request, in the same order, and is nil for
+// each delete that succeeded. A delete of a key that isn't there gets common.ErrKeyNotFound as for
+// a single delete.
+type MultiDeleter interface {
+	MultiDelete(cmd common.MultiDeleteRequest) []error
+}
+
+// MultiDeleterV2 is the context-aware form of MultiDeleter for HandlerV2 implementations.
+type MultiDeleterV2 interface {
+	MultiDelete(ctx context.Context, cmd common.MultiDeleteRequest) []error
+}
+
+// MultiDelete does all the deletes in cmd using h, in the same way MultiSet does sets.
+func MultiDelete(h Handler, cmd common.MultiDeleteRequest) []error {
+	if md, ok := h.(MultiDeleter); ok {
+		return md.MultiDelete(cmd)
+	}
+	return serialBatch(len(cmd.Deletes), func(i int) error {
+		return h.Delete(cmd.Deletes[i])
+	})
+}
+
+// MultiDeleteV2 is the HandlerV2 counterpart of MultiDelete.
+func MultiDeleteV2(ctx context.Context, h HandlerV2, cmd common.MultiDeleteRequest) []error {
+	if md, ok := h.(MultiDeleterV2); ok {
+		return md.MultiDelete(ctx, cmd)
+	}
+	return serialBatch(len(cmd.Deletes), func(i int) error {
+		return h.Delete(ctx, cmd.Deletes[i])
+	})
+}
+
+func (v v2Handler) MultiDelete(ctx context.Context, cmd common.MultiDeleteRequest) []error {
+	if err := ctx.Err(); err != nil {
+		return fillErrors(len(cmd.Deletes), err)
+	}
+	defer v.interrupt(ctx)()
+	return MultiDelete(v.h, cmd)
+}
+
+func (v v1Handler) MultiDelete(cmd common.MultiDeleteRequest) []error {
+	return MultiDeleteV2(context.Background(), v.h, cmd)
+}
@@ -0,0 +1,98 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"context"
+
+	"github.com/netflix/rend/common"
+)
+
+// MultiSetter is implemented by handlers that can do a whole batch of sets in fewer round trips
+// than doing them one by one, e.g. by writing all of them to the backend before reading any of
+// the responses. It is optional; MultiSet falls back to serial sets for handlers without it.
+//
+// The returned slice has one entry per set in the request, in the same order, and is nil for each
+// set that succeeded.
+type MultiSetter interface {
+	MultiSet(cmd common.MultiSetRequest) []error
+}
+
+// MultiSetterV2 is the context-aware form of MultiSetter for HandlerV2 implementations.
+type MultiSetterV2 interface {
+	MultiSet(ctx context.Context, cmd common.MultiSetRequest) []error
+}
+
+// MultiSet does all the sets in cmd using h. If h implements MultiSetter, the whole batch is given
+// to it at once. Otherwise the sets are done one at a time, stopping at the first error that isn't
+// an application error since the connection to the backend can't be trusted after that. The
+// remaining sets are all given that same error.
+func MultiSet(h Handler, cmd common.MultiSetRequest) []error {
+	if ms, ok := h.(MultiSetter); ok {
+		return ms.MultiSet(cmd)
+	}
+	return serialBatch(len(cmd.Sets), func(i int) error {
+		return h.Set(cmd.Sets[i])
+	})
+}
+
+// MultiSetV2 is the HandlerV2 counterpart of MultiSet.
+func MultiSetV2(ctx context.Context, h HandlerV2, cmd common.MultiSetRequest) []error {
+	if ms, ok := h.(MultiSetterV2); ok {
+		return ms.MultiSet(ctx, cmd)
+	}
+	return serialBatch(len(cmd.Sets), func(i int) error {
+		return h.Set(ctx, cmd.Sets[i])
+	})
+}
+
+// serialBatch does n operations one at a time with op, stopping at the first error that isn't an
+// application error and giving it to all of the operations that remain.
+func serialBatch(n int, op func(i int) error) []error {
+	errs := make([]error, n)
+
+	for i := range errs {
+		errs[i] = op(i)
+
+		if errs[i] != nil && !common.IsAppError(errs[i]) {
+			for j := i + 1; j < len(errs); j++ {
+				errs[j] = errs[i]
+			}
+			break
+		}
+	}
+
+	return errs
+}
+
+func (v v2Handler) MultiSet(ctx context.Context, cmd common.MultiSetRequest) []error {
+	if err := ctx.Err(); err != nil {
+		return fillErrors(len(cmd.Sets), err)
+	}
+	defer v.interrupt(ctx)()
+	return MultiSet(v.h, cmd)
+}
+
+func (v v1Handler) MultiSet(cmd common.MultiSetRequest) []error {
+	return MultiSetV2(context.Background(), v.h, cmd)
+}
+
+func fillErrors(n int, err error) []error {
+	errs := make([]error, n)
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
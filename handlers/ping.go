@@ -0,0 +1,60 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"context"
+)
+
+// Pinger is implemented by handlers that can check that their backend is there and answering
+// without touching any data, like a memcached noop. It's used to verify new connections before
+// they are put to work.
+type Pinger interface {
+	Ping() error
+}
+
+// PingerV2 is the context-aware form of Pinger for HandlerV2 implementations.
+type PingerV2 interface {
+	Ping(ctx context.Context) error
+}
+
+// Ping checks the backend of h if h implements Pinger. Any other handler is assumed to be fine,
+// since having been created is all it can show.
+func Ping(h Handler) error {
+	if p, ok := h.(Pinger); ok {
+		return p.Ping()
+	}
+	return nil
+}
+
+// PingV2 is the HandlerV2 counterpart of Ping.
+func PingV2(ctx context.Context, h HandlerV2) error {
+	if p, ok := h.(PingerV2); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (v v2Handler) Ping(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer v.interrupt(ctx)()
+	return Ping(v.h)
+}
+
+func (v v1Handler) Ping() error {
+	return PingV2(context.Background(), v.h)
+}
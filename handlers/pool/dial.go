@@ -0,0 +1,298 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DialConfig says how connections to a pool are made. The zero value dials like net.Dial.
+type DialConfig struct {
+	// Timeout is the longest a single attempt, including resolving the host, may take. 0 leaves it
+	// to the operating system, which can be minutes for an address that doesn't answer.
+	Timeout time.Duration
+	// Retries is how many more attempts are made after a failed one
+	Retries int
+	// RetryBackoff is the wait before the first retry, doubling for each one after
+	RetryBackoff time.Duration
+	// Prefer is "ipv4" or "ipv6" to try a host's addresses of that family first, or empty to try
+	// them in the order the resolver returned them.
+	Prefer string
+	// FallbackDelay is how long an address is given to connect before the next one is tried
+	// alongside it, as in happy eyeballs (RFC 6555). 0 is the Go default of 300ms, and a negative
+	// delay only tries the next address once one fails.
+	FallbackDelay time.Duration
+	// Parallel is how many of a host's addresses are tried at once from the start. The first to
+	// connect is used and the others are closed. 0 is 1.
+	Parallel int
+}
+
+const defaultFallbackDelay = 300 * time.Millisecond
+
+func (c DialConfig) validate() error {
+	if c.Timeout < 0 || c.Retries < 0 || c.RetryBackoff < 0 || c.Parallel < 0 {
+		return errors.New("Dial timeout, retries, retry backoff, and parallel attempts must be >= 0")
+	}
+	if c.Prefer != "" && c.Prefer != "ipv4" && c.Prefer != "ipv6" {
+		return fmt.Errorf("Unknown address family preference %q, should be ipv4 or ipv6", c.Prefer)
+	}
+	return nil
+}
+
+// ParseDialConfig changes the settings of c given in conf, a set of URL query parameters named
+// timeout, retries, retry_backoff, prefer, fallback_delay, and parallel, e.g.
+// timeout=200ms&retries=2&prefer=ipv4.
+func ParseDialConfig(c DialConfig, conf string) (DialConfig, error) {
+	q, err := url.ParseQuery(conf)
+	if err != nil {
+		return c, err
+	}
+
+	for name, vals := range q {
+		v := vals[len(vals)-1]
+		switch name {
+		case "timeout":
+			c.Timeout, err = time.ParseDuration(v)
+		case "retries":
+			c.Retries, err = strconv.Atoi(v)
+		case "retry_backoff":
+			c.RetryBackoff, err = time.ParseDuration(v)
+		case "prefer":
+			c.Prefer = v
+		case "fallback_delay":
+			c.FallbackDelay, err = time.ParseDuration(v)
+		case "parallel":
+			c.Parallel, err = strconv.Atoi(v)
+		default:
+			return c, fmt.Errorf("Unknown dial setting %q", name)
+		}
+		if err != nil {
+			return c, fmt.Errorf("Bad dial setting %s: %v", name, err)
+		}
+	}
+
+	return c, c.validate()
+}
+
+type dialRule struct {
+	pattern string
+	conf    DialConfig
+}
+
+var (
+	dialDefault DialConfig
+	dialRules   []dialRule
+	dialLock    = new(sync.RWMutex)
+)
+
+// SetDefaultDialConfig sets how connections are made to the pools no pattern given to SetDialConfig
+// matches
+func SetDefaultDialConfig(c DialConfig) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+
+	dialLock.Lock()
+	defer dialLock.Unlock()
+	dialDefault = c
+	return nil
+}
+
+// SetDialConfig sets how connections are made to the pools whose names match pattern, a path.Match
+// pattern like 10.0.1.*:11211 or /var/run/*.sock. Patterns are tried in the order they were set
+// and the first to match is used.
+func SetDialConfig(pattern string, c DialConfig) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("Bad pool pattern %q: %v", pattern, err)
+	}
+	if err := c.validate(); err != nil {
+		return err
+	}
+
+	dialLock.Lock()
+	defer dialLock.Unlock()
+	dialRules = append(dialRules, dialRule{pattern, c})
+	return nil
+}
+
+// DialConfig returns how connections to the pool are made
+func (p *Pool) DialConfig() DialConfig {
+	dialLock.RLock()
+	defer dialLock.RUnlock()
+
+	for _, r := range dialRules {
+		if ok, _ := path.Match(r.pattern, p.name); ok {
+			return r.conf
+		}
+	}
+	return dialDefault
+}
+
+// dial makes a single attempt at connecting to addr
+func (c DialConfig) dial(network, addr string) (net.Conn, error) {
+	ctx := context.Background()
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	if network != "tcp" || (c.Prefer == "" && c.Parallel <= 1) {
+		d := net.Dialer{FallbackDelay: c.FallbackDelay}
+		return d.DialContext(ctx, network, addr)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if c.Prefer != "" {
+		v4 := c.Prefer == "ipv4"
+		sort.SliceStable(ips, func(i, j int) bool {
+			return (ips[i].IP.To4() != nil) == v4 && (ips[j].IP.To4() != nil) != v4
+		})
+	}
+
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("No addresses found for %s", host)
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip.String(), port)
+	}
+	return c.race(ctx, network, addrs)
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// race dials the addresses, starting Parallel of them right away and another each time one fails
+// or the fallback delay passes without a connection. The first connection made is returned.
+func (c DialConfig) race(ctx context.Context, network string, addrs []string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, network, addr)
+			results <- dialResult{conn, err}
+		}()
+	}
+
+	parallel := c.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+	for next < len(addrs) && next < parallel {
+		start()
+	}
+
+	delay := c.FallbackDelay
+	if delay == 0 {
+		delay = defaultFallbackDelay
+	}
+
+	var firstErr error
+	for pending > 0 {
+		var fallback <-chan time.Time
+		var t *time.Timer
+		if next < len(addrs) && delay > 0 {
+			t = time.NewTimer(delay)
+			fallback = t.C
+		}
+
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// the dials that lost are cancelled, and closed in case they connected anyway
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				if t != nil {
+					t.Stop()
+				}
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) {
+				start()
+			}
+
+		case <-fallback:
+			start()
+		}
+
+		if t != nil {
+			t.Stop()
+		}
+	}
+
+	return nil, firstErr
+}
+
+// ParseDialRules parses per pool dial settings of the form pattern=settings, separated by commas,
+// e.g. 10.0.1.*:11211=timeout=100ms&retries=2,/var/run/*.sock=timeout=10ms, and sets them with
+// SetDialConfig. The settings are as for ParseDialConfig, each starting from base.
+func ParseDialRules(base DialConfig, rules string) error {
+	for _, rule := range strings.Split(rules, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		pattern, conf := rule, ""
+		if i := strings.Index(rule, "="); i >= 0 {
+			pattern, conf = rule[:i], rule[i+1:]
+		}
+
+		c, err := ParseDialConfig(base, conf)
+		if err != nil {
+			return fmt.Errorf("%s: %v", pattern, err)
+		}
+		if err := SetDialConfig(pattern, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/timer"
+)
+
+// Handler wraps the handlers made by hc so the latency and errors of every operation are counted
+// for the pool. Creating a handler that fails counts as a dial failure, for handlers that don't
+// dial through the pool themselves.
+func (p *Pool) Handler(hc handlers.HandlerConst) handlers.HandlerConst {
+	return func() (handlers.Handler, error) {
+		h, err := hc()
+		if err != nil {
+			metrics.IncCounter(p.metricDialFailures)
+			return nil, err
+		}
+		if h == nil {
+			return nil, nil
+		}
+		return &handler{h: h, p: p}, nil
+	}
+}
+
+type handler struct {
+	h handlers.Handler
+	p *Pool
+}
+
+// done records the latency of an operation on the pool and passes its error through. Misses,
+// existing keys, and failed conditions are normal answers, not errors of the backend.
+func (h *handler) done(hist uint32, start uint64, err error) error {
+	metrics.ObserveHist(hist, timer.Since(start))
+
+	if err != nil && !common.IsAppError(err) && !errors.Is(err, common.ErrNotSupported) {
+		metrics.IncCounter(h.p.metricErrors)
+	}
+	return err
+}
+
+func (h *handler) write(op func() error) error {
+	start := timer.Now()
+	return h.done(h.p.histWrites, start, op())
+}
+
+func (h *handler) Set(cmd common.SetRequest) error {
+	return h.write(func() error { return h.h.Set(cmd) })
+}
+
+func (h *handler) Add(cmd common.SetRequest) error {
+	return h.write(func() error { return h.h.Add(cmd) })
+}
+
+func (h *handler) Replace(cmd common.SetRequest) error {
+	return h.write(func() error { return h.h.Replace(cmd) })
+}
+
+func (h *handler) Append(cmd common.SetRequest) error {
+	return h.write(func() error { return h.h.Append(cmd) })
+}
+
+func (h *handler) Prepend(cmd common.SetRequest) error {
+	return h.write(func() error { return h.h.Prepend(cmd) })
+}
+
+func (h *handler) Delete(cmd common.DeleteRequest) error {
+	return h.write(func() error { return h.h.Delete(cmd) })
+}
+
+func (h *handler) Touch(cmd common.TouchRequest) error {
+	return h.write(func() error { return h.h.Touch(cmd) })
+}
+
+func (h *handler) SetIfMatch(cmd common.SetIfMatchRequest) error {
+	return h.write(func() error { return handlers.SetIfMatch(h.h, cmd) })
+}
+
+// A batch is timed as a whole, since that's how long the connection was busy with it
+func (h *handler) MultiSet(cmd common.MultiSetRequest) []error {
+	start := timer.Now()
+	errs := handlers.MultiSet(h.h, cmd)
+	h.batchDone(start, errs)
+	return errs
+}
+
+func (h *handler) MultiDelete(cmd common.MultiDeleteRequest) []error {
+	start := timer.Now()
+	errs := handlers.MultiDelete(h.h, cmd)
+	h.batchDone(start, errs)
+	return errs
+}
+
+// batchDone records a batch, counting an error once even though every remaining item gets it
+func (h *handler) batchDone(start uint64, errs []error) {
+	var err error
+	for _, e := range errs {
+		if e != nil && !common.IsAppError(e) {
+			err = e
+			break
+		}
+	}
+	h.done(h.p.histWrites, start, err)
+}
+
+func (h *handler) Incr(cmd common.ArithRequest) (uint64, error) {
+	start := timer.Now()
+	v, err := handlers.Incr(h.h, cmd)
+	return v, h.done(h.p.histWrites, start, err)
+}
+
+func (h *handler) Decr(cmd common.ArithRequest) (uint64, error) {
+	start := timer.Now()
+	v, err := handlers.Decr(h.h, cmd)
+	return v, h.done(h.p.histWrites, start, err)
+}
+
+func (h *handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	start := timer.Now()
+	res, err := h.h.GAT(cmd)
+	return res, h.done(h.p.histReads, start, err)
+}
+
+// Locking a key is timed as a write since it stores the lock
+func (h *handler) GetLock(cmd common.GetLockRequest) (common.GetLockResponse, error) {
+	start := timer.Now()
+	res, err := handlers.GetLock(h.h, cmd)
+	return res, h.done(h.p.histWrites, start, err)
+}
+
+func (h *handler) Unlock(cmd common.UnlockRequest) error {
+	return h.write(func() error { return handlers.Unlock(h.h, cmd) })
+}
+
+// Gets are timed until the backend has answered every key, which means passing the responses
+// through here on their way out.
+func (h *handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	start := timer.Now()
+	resChan, errChan := h.h.Get(cmd)
+
+	dataOut := make(chan common.GetResponse)
+	errorOut := make(chan error)
+
+	lease := getLeases.Start()
+	go func() {
+		defer lease.Done()
+		defer close(dataOut)
+		defer close(errorOut)
+
+		var err error
+		for resChan != nil || errChan != nil {
+			select {
+			case res, ok := <-resChan:
+				if !ok {
+					resChan = nil
+				} else {
+					dataOut <- res
+				}
+			case e, ok := <-errChan:
+				if !ok {
+					errChan = nil
+				} else {
+					err = e
+					errorOut <- e
+				}
+			}
+		}
+
+		h.done(h.p.histReads, start, err)
+	}()
+
+	return dataOut, errorOut
+}
+
+func (h *handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	start := timer.Now()
+	resChan, errChan := h.h.GetE(cmd)
+
+	dataOut := make(chan common.GetEResponse)
+	errorOut := make(chan error)
+
+	lease := getLeases.Start()
+	go func() {
+		defer lease.Done()
+		defer close(dataOut)
+		defer close(errorOut)
+
+		var err error
+		for resChan != nil || errChan != nil {
+			select {
+			case res, ok := <-resChan:
+				if !ok {
+					resChan = nil
+				} else {
+					dataOut <- res
+				}
+			case e, ok := <-errChan:
+				if !ok {
+					errChan = nil
+				} else {
+					err = e
+					errorOut <- e
+				}
+			}
+		}
+
+		h.done(h.p.histReads, start, err)
+	}()
+
+	return dataOut, errorOut
+}
+
+// Synchronous gets are timed the same way, without a goroutine in between
+func (h *handler) GetEach(cmd common.GetRequest, f func(common.GetResponse) error) error {
+	start := timer.Now()
+	err := handlers.GetEach(h.h, cmd, f)
+	h.done(h.p.histReads, start, err)
+	return err
+}
+
+func (h *handler) GetEEach(cmd common.GetRequest, f func(common.GetEResponse) error) error {
+	start := timer.Now()
+	err := handlers.GetEEach(h.h, cmd, f)
+	h.done(h.p.histReads, start, err)
+	return err
+}
+
+// A ping is timed as a read, it's the round trip of the smallest request there is
+func (h *handler) Ping() error {
+	start := timer.Now()
+	return h.done(h.p.histReads, start, handlers.Ping(h.h))
+}
+
+// Listing keys is administration, not traffic, so it isn't timed
+func (h *handler) Keys(prefix []byte) ([][]byte, error) {
+	return handlers.Keys(h.h, prefix)
+}
+
+func (h *handler) ServerTime() (time.Time, error) {
+	return handlers.ServerTime(h.h)
+}
+
+// Like listing keys, a flush is administration and isn't timed
+func (h *handler) Flush(cmd common.FlushRequest) error {
+	return handlers.Flush(h.h, cmd)
+}
+
+func (h *handler) Interrupt(ctx context.Context) func() {
+	return handlers.Interrupt(h.h, ctx)
+}
+
+func (h *handler) Close() error {
+	return h.h.Close()
+}
@@ -0,0 +1,213 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pool keeps connection and latency metrics for each backend pool separately, tagged with
+// the pool name, so one slow or flapping shard stands out instead of disappearing into the L1 and
+// L2 totals. A pool is usually one backend address, like the unix socket of a memcached instance.
+//
+// Connections made with Pool.Dial count towards the open connections, dials, dial failures and
+// latency, reconnects, and bytes in and out of the pool. How they're dialed can be set for each
+// pool, see SetDialConfig. Handlers wrapped with Pool.Handler add the latency
+// of every read and write, and the errors that aren't just a miss or a failed condition.
+package pool
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/timer"
+	"github.com/netflix/rend/watchdog"
+)
+
+// The goroutines passing get responses through are leaked if whoever asked for them stops reading
+// before the channels are closed, and connections are leaked if they're never closed
+var (
+	getLeases  = watchdog.NewKind("pool_get_responses", true)
+	connLeases = watchdog.NewKind("pool_conns", false)
+)
+
+var (
+	pools     = make(map[string]*Pool)
+	poolsLock = new(sync.Mutex)
+)
+
+// Pool tracks the connections and operations of one backend pool
+type Pool struct {
+	// connections open right now, and closed after an I/O error and not replaced yet. These are
+	// first to keep them 64-bit aligned for atomic access.
+	open   int64
+	broken int64
+
+	name string
+
+	metricDials        uint32
+	metricDialFailures uint32
+	metricDialRetries  uint32
+	metricReconnects   uint32
+	metricBytesIn      uint32
+	metricBytesOut     uint32
+	metricErrors       uint32
+
+	histDials  uint32
+	histReads  uint32
+	histWrites uint32
+}
+
+// Get returns the pool with the given name, creating it and its metrics the first time. Every
+// caller with the same name shares the same pool.
+func Get(name string) *Pool {
+	poolsLock.Lock()
+	defer poolsLock.Unlock()
+
+	if p, ok := pools[name]; ok {
+		return p
+	}
+
+	tags := metrics.Tags{"pool": name}
+	p := &Pool{
+		name:               name,
+		metricDials:        metrics.AddCounter("pool_dials", tags),
+		metricDialFailures: metrics.AddCounter("pool_dial_failures", tags),
+		metricDialRetries:  metrics.AddCounter("pool_dial_retries", tags),
+		metricReconnects:   metrics.AddCounter("pool_reconnects", tags),
+		metricBytesIn:      metrics.AddCounter("pool_bytes_in", tags),
+		metricBytesOut:     metrics.AddCounter("pool_bytes_out", tags),
+		metricErrors:       metrics.AddCounter("pool_errors", tags),
+		histDials:          metrics.AddHistogram("pool_dial", false, tags),
+		histReads:          metrics.AddHistogram("pool_read", false, tags),
+		histWrites:         metrics.AddHistogram("pool_write", false, tags),
+	}
+	metrics.RegisterIntGaugeCallback("pool_open_connections", tags, func() uint64 {
+		return uint64(atomic.LoadInt64(&p.open))
+	})
+
+	pools[name] = p
+	return p
+}
+
+// Name returns the name the pool's metrics are tagged with
+func (p *Pool) Name() string {
+	return p.name
+}
+
+// Open returns the number of connections to the pool that are open right now
+func (p *Pool) Open() int {
+	return int(atomic.LoadInt64(&p.open))
+}
+
+// Network returns the network to dial a backend address on. Addresses of the form host:port, like
+// the ones found by service discovery, are tcp and anything else is the path of a unix domain
+// socket.
+func Network(addr string) string {
+	if strings.HasPrefix(addr, "/") || strings.HasPrefix(addr, ".") {
+		return "unix"
+	}
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return "tcp"
+	}
+	return "unix"
+}
+
+// Dial connects to the pool as its DialConfig says, counting the connection in the pool's metrics.
+// Every attempt counts as a dial, and its latency is observed whether or not it connects. A dial
+// that replaces a connection that was closed after an I/O error counts as a reconnect.
+func (p *Pool) Dial(network, addr string) (net.Conn, error) {
+	conf := p.DialConfig()
+	backoff := conf.RetryBackoff
+
+	var c net.Conn
+	for attempt := 0; ; attempt++ {
+		metrics.IncCounter(p.metricDials)
+		start := timer.Now()
+		var err error
+		c, err = conf.dial(network, addr)
+		metrics.ObserveHist(p.histDials, timer.Since(start))
+		if err == nil {
+			break
+		}
+
+		metrics.IncCounter(p.metricDialFailures)
+		if attempt == conf.Retries {
+			return nil, err
+		}
+		metrics.IncCounter(p.metricDialRetries)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	atomic.AddInt64(&p.open, 1)
+
+	for {
+		b := atomic.LoadInt64(&p.broken)
+		if b <= 0 {
+			break
+		}
+		if atomic.CompareAndSwapInt64(&p.broken, b, b-1) {
+			metrics.IncCounter(p.metricReconnects)
+			break
+		}
+	}
+
+	return &conn{Conn: c, p: p, lease: connLeases.Start()}, nil
+}
+
+// conn counts the bytes read and written and remembers whether the connection ever failed
+type conn struct {
+	net.Conn
+	p     *Pool
+	lease watchdog.Lease
+
+	failed int32
+	closed int32
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	metrics.IncCounterBy(c.p.metricBytesIn, uint64(n))
+	c.check(err)
+	return n, err
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	metrics.IncCounterBy(c.p.metricBytesOut, uint64(n))
+	c.check(err)
+	return n, err
+}
+
+// Timeouts don't count as failures since the connection is still usable afterwards
+func (c *conn) check(err error) {
+	if err == nil {
+		return
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return
+	}
+	atomic.StoreInt32(&c.failed, 1)
+}
+
+func (c *conn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		atomic.AddInt64(&c.p.open, -1)
+		c.lease.Done()
+		if atomic.LoadInt32(&c.failed) == 1 {
+			atomic.AddInt64(&c.p.broken, 1)
+		}
+	}
+	return c.Conn.Close()
+}
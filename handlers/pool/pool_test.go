@@ -0,0 +1,199 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers/inmem"
+	"github.com/netflix/rend/handlers/pool"
+)
+
+func TestDial(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sock := filepath.Join(dir, "backend.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	p := pool.Get(sock)
+	if pool.Get(sock) != p {
+		t.Fatal("Expected pools with the same name to be shared")
+	}
+
+	c, err := p.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Open() != 1 {
+		t.Fatalf("Expected one open connection, got %d", p.Open())
+	}
+
+	// The backend hung up, so this is a broken connection to be replaced
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected the read to fail")
+	}
+	c.Close()
+	c.Close()
+	if p.Open() != 0 {
+		t.Fatalf("Expected no open connections, got %d", p.Open())
+	}
+
+	if _, err := p.Dial("unix", filepath.Join(dir, "missing.sock")); err == nil {
+		t.Fatal("Expected dialing a missing socket to fail")
+	}
+	if p.Open() != 0 {
+		t.Fatalf("Expected a failed dial not to be counted as open, got %d", p.Open())
+	}
+}
+
+func TestHandler(t *testing.T) {
+	h, err := pool.Get("TestHandler").Handler(inmem.New)()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Set(common.SetRequest{Key: []byte("TestPoolHandler"), Data: []byte("foo")}); err != nil {
+		t.Fatal(err)
+	}
+
+	resChan, errChan := h.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte("TestPoolHandler"), []byte("TestPoolHandlerMissing")},
+		Opaques: []uint32{0, 1},
+		Quiet:   []bool{false, false},
+	})
+
+	var hits, misses int
+	for resChan != nil || errChan != nil {
+		select {
+		case res, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			} else if res.Miss {
+				misses++
+			} else if string(res.Data) == "foo" {
+				hits++
+			}
+		case err, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			} else {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if hits != 1 || misses != 1 {
+		t.Fatalf("Expected a hit and a miss to be passed through, got %d and %d", hits, misses)
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	for addr, network := range map[string]string{
+		"/tmp/memcached.sock": "unix",
+		"./memcached.sock":    "unix",
+		"memcached.sock":      "unix",
+		"10.0.0.1:11211":      "tcp",
+		"cache-1:11211":       "tcp",
+		"[::1]:11211":         "tcp",
+	} {
+		if got := pool.Network(addr); got != network {
+			t.Errorf("Network(%q) = %s, expected %s", addr, got, network)
+		}
+	}
+}
+
+func TestDialConfig(t *testing.T) {
+	base := pool.DialConfig{Timeout: time.Second}
+	c, err := pool.ParseDialConfig(base, "retries=2&retry_backoff=5ms&prefer=ipv4&fallback_delay=-1ms&parallel=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := pool.DialConfig{Timeout: time.Second, Retries: 2, RetryBackoff: 5 * time.Millisecond, Prefer: "ipv4", FallbackDelay: -time.Millisecond, Parallel: 2}
+	if c != expected {
+		t.Fatalf("Expected %+v, got %+v", expected, c)
+	}
+	for _, conf := range []string{"timeout=soon", "retries=-1", "prefer=ipx", "speed=fast"} {
+		if _, err := pool.ParseDialConfig(base, conf); err == nil {
+			t.Errorf("Expected %q to be rejected", conf)
+		}
+	}
+
+	if err := pool.ParseDialRules(base, "TestDialConfig-a*=retries=1, TestDialConfig-*=retries=3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.SetDialConfig("[", base); err == nil {
+		t.Fatal("Expected a bad pattern to be rejected")
+	}
+	for name, retries := range map[string]int{"TestDialConfig-ab": 1, "TestDialConfig-b": 3, "TestDialConfig": 0} {
+		if c := pool.Get(name).DialConfig(); c.Retries != retries {
+			t.Errorf("Expected %s to be dialed with %d retries, got %+v", name, retries, c)
+		}
+	}
+
+	// Retries give up after the last one
+	pool.SetDialConfig("TestDialRetry", pool.DialConfig{Retries: 2, RetryBackoff: time.Millisecond})
+	start := time.Now()
+	if _, err := pool.Get("TestDialRetry").Dial("unix", "/nonexistent/backend.sock"); err == nil || time.Since(start) < 3*time.Millisecond {
+		t.Fatalf("Expected the dial to fail after backing off, got %v after %v", err, time.Since(start))
+	}
+
+	// A host's addresses are raced, in order of preference
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	pool.SetDialConfig("TestDialRace", pool.DialConfig{Timeout: time.Second, Prefer: "ipv6", Parallel: 2})
+	conn, err := pool.Get("TestDialRace").Dial("tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
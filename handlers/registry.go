@@ -0,0 +1,96 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// HandlerFactory creates a HandlerConst from a configuration string. The meaning of the string is
+// entirely up to the implementation, e.g. the memcached handlers take the path of the unix domain
+// socket to connect to. An empty string means no configuration was given.
+type HandlerFactory func(conf string) (HandlerConst, error)
+
+var (
+	registry     = make(map[string]HandlerFactory)
+	registryLock = new(sync.RWMutex)
+)
+
+func init() {
+	Register("nil", func(conf string) (HandlerConst, error) {
+		return NilHandler, nil
+	})
+}
+
+// Register makes a handler implementation available by name so it can be selected by a
+// configuration string instead of being wired up in code. Implementations are expected to call
+// this from an init() function, which means a third-party handler only needs to be imported (even
+// as a blank import) to be usable. Registering the same name twice panics.
+func Register(name string, f HandlerFactory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if f == nil {
+		panic("handlers: Register factory is nil for " + name)
+	}
+	if _, dup := registry[name]; dup {
+		panic("handlers: Register called twice for " + name)
+	}
+
+	registry[name] = f
+}
+
+// Registered returns the sorted names of all registered handler implementations.
+func Registered() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// FromConfig resolves a configuration string of the form "name" or "name:conf" to a HandlerConst
+// using the registered factory for that name.
+func FromConfig(spec string) (HandlerConst, error) {
+	name, conf := SplitSpec(spec)
+
+	registryLock.RLock()
+	f, ok := registry[name]
+	registryLock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("Unknown handler %q. Registered handlers: %s", name, strings.Join(Registered(), ", "))
+	}
+
+	return f(conf)
+}
+
+// SplitSpec splits a "name:conf" configuration string into its name and configuration parts.
+// Only the first colon is significant, so the configuration part may itself contain colons.
+func SplitSpec(spec string) (name, conf string) {
+	spec = strings.TrimSpace(spec)
+	if idx := strings.IndexByte(spec, ':'); idx >= 0 {
+		return spec[:idx], spec[idx+1:]
+	}
+	return spec, ""
+}
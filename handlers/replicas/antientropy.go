@@ -0,0 +1,202 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replicas
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/timer"
+)
+
+var (
+	MetricAntiEntropyRanges    = metrics.AddCounter("replica_antientropy_ranges", nil)
+	MetricAntiEntropyKeys      = metrics.AddCounter("replica_antientropy_keys", nil)
+	MetricAntiEntropyDivergent = metrics.AddCounter("replica_antientropy_divergent", nil)
+	MetricAntiEntropyBytes     = metrics.AddCounter("replica_antientropy_bytes", nil)
+	MetricAntiEntropyErrors    = metrics.AddCounter("replica_antientropy_errors", nil)
+
+	// Completed walks over every range, and the range the current walk is up to
+	GaugeAntiEntropyPasses = metrics.AddIntGauge("replica_antientropy_passes", nil)
+	GaugeAntiEntropyRange  = metrics.AddIntGauge("replica_antientropy_range", nil)
+)
+
+// keys compared with a single get to every replica
+const antiEntropyBatch = 100
+
+// inRange reports whether key is in range r of n, going by its hash
+func inRange(key []byte, r, n int) bool {
+	return common.ValueHash(key)%uint64(n) == uint64(r)
+}
+
+// throttle paces the bytes sent through it to a rate per second. 0 is unlimited.
+type throttle struct {
+	rate  int
+	start time.Time
+	bytes int
+}
+
+func (t *throttle) wait(n int) {
+	metrics.IncCounterBy(MetricAntiEntropyBytes, uint64(n))
+	if t.rate <= 0 {
+		return
+	}
+
+	if t.start.IsZero() {
+		t.start = time.Now()
+	}
+	t.bytes += n
+
+	ahead := time.Duration(float64(t.bytes)/float64(t.rate)*float64(time.Second)) - time.Since(t.start)
+	if ahead > 0 {
+		time.Sleep(ahead)
+	}
+}
+
+// antiEntropy compares one range of the keys across every replica each AntiEntropy interval and
+// repairs the replicas that differ, walking all the ranges in turn. Quorum reads only repair the
+// keys that are read and only across the replicas asked, so without this a key that's rarely read
+// could stay different for as long as it lives.
+func (g *Group) antiEntropy() {
+	h := &Handler{
+		g:     g,
+		conns: make(map[*node]handlers.Handler),
+	}
+
+	var next, passes int
+	for range time.Tick(g.conf.AntiEntropy) {
+		if err := h.compareRange(next, g.conf.AntiEntropyRanges); err != nil {
+			log.Println("Error comparing replicas:", err.Error())
+			metrics.IncCounter(MetricAntiEntropyErrors)
+		}
+
+		if next = (next + 1) % g.conf.AntiEntropyRanges; next == 0 {
+			passes++
+			metrics.SetIntGauge(GaugeAntiEntropyPasses, uint64(passes))
+		}
+		metrics.SetIntGauge(GaugeAntiEntropyRange, uint64(next))
+	}
+}
+
+// compareRange compares the keys in range r of n across every replica. The keys are the ones any
+// replica lists, see handlers.KeyLister, so a key missing from some replicas is still found. The
+// values read and written are paced to AntiEntropyBandwidth.
+func (h *Handler) compareRange(r, n int) error {
+	metrics.IncCounter(MetricAntiEntropyRanges)
+
+	nodes := h.members()
+	if len(nodes) < 2 {
+		return nil
+	}
+
+	seen := make(map[string]struct{})
+	var keys [][]byte
+	listed := false
+	for _, nd := range nodes {
+		c, err := h.conn(nd)
+		if err != nil {
+			continue
+		}
+
+		all, err := handlers.Keys(c, nil)
+		if errors.Is(err, common.ErrNotSupported) {
+			continue
+		} else if err != nil {
+			h.done(nd, 0, err)
+			continue
+		}
+		listed = true
+
+		for _, key := range all {
+			if _, ok := seen[string(key)]; !ok && inRange(key, r, n) {
+				seen[string(key)] = struct{}{}
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	if !listed {
+		return errNoKeyLister
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+
+	t := &throttle{rate: h.g.conf.AntiEntropyBandwidth}
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > antiEntropyBatch {
+			batch = batch[:antiEntropyBatch]
+		}
+		keys = keys[len(batch):]
+
+		// Removed replicas are left out, and new ones are compared from the next batch on
+		nodes = h.members()
+		start := timer.Now()
+		answers, replied := h.getAll(nodes, batch)
+		if replied < len(nodes) {
+			// A replica that didn't answer can't be compared, and the others may not be the
+			// freshest without it
+			metrics.IncCounter(MetricAntiEntropyErrors)
+			continue
+		}
+
+		for k := range batch {
+			metrics.IncCounter(MetricAntiEntropyKeys)
+
+			best := 0
+			read := 0
+			for i := range nodes {
+				read += len(answers[i][k].Data)
+				if fresher(answers[i][k], answers[best][k]) {
+					best = i
+				}
+			}
+			t.wait(read)
+
+			freshest := answers[best][k]
+			if freshest.Miss {
+				continue
+			}
+
+			divergent := false
+			for i, nd := range nodes {
+				if same(answers[i][k], freshest) {
+					continue
+				}
+				divergent = true
+
+				// a recent delete that only some replicas got, see quorum
+				if h.g.conf.Tombstones != nil && h.g.conf.Tombstones.Contains(batch[k]) {
+					metrics.IncCounter(MetricRepairsSkipped)
+					continue
+				}
+
+				h.fix(repair{n: nd, res: freshest, stale: answers[i][k], since: start})
+				t.wait(len(freshest.Data))
+			}
+			if divergent {
+				metrics.IncCounter(MetricAntiEntropyDivergent)
+			}
+		}
+	}
+
+	return nil
+}
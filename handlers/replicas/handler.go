@@ -0,0 +1,413 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replicas
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	errNoReplicas  = errors.New("No replicas configured")
+	errNoKeyLister = errors.New("No replica can list its keys")
+)
+
+// Handler is the per-connection handler for a Group. It keeps its own connection to each replica,
+// made the first time that replica is used.
+type Handler struct {
+	g     *Group
+	conns map[*node]handlers.Handler
+
+	// the group's members when connections were last pruned
+	last []*node
+}
+
+// members returns the group's current replicas, first closing connections to any that were removed
+// since the last request
+func (h *Handler) members() []*node {
+	nodes := h.g.members()
+
+	// Update always makes a new slice, so the same first element means nothing changed
+	if len(nodes) == len(h.last) && (len(nodes) == 0 || &nodes[0] == &h.last[0]) {
+		return nodes
+	}
+	h.last = nodes
+
+	current := make(map[*node]struct{}, len(nodes))
+	for _, n := range nodes {
+		current[n] = struct{}{}
+	}
+	for n, c := range h.conns {
+		if _, ok := current[n]; !ok {
+			c.Close()
+			delete(h.conns, n)
+		}
+	}
+
+	return nodes
+}
+
+func (h *Handler) conn(n *node) (handlers.Handler, error) {
+	if c, ok := h.conns[n]; ok {
+		return c, nil
+	}
+
+	c, err := n.Handler()
+	if err != nil {
+		n.fail(h.g.conf.Backoff)
+		return nil, err
+	}
+	h.conns[n] = c
+	return c, nil
+}
+
+// done records the outcome of a request to n that took d. On a fatal error the connection is
+// dropped and a new one is made next time.
+func (h *Handler) done(n *node, d time.Duration, err error) {
+	if !failed(err) {
+		n.observe(d)
+		return
+	}
+
+	n.fail(h.g.conf.Backoff)
+
+	if c, ok := h.conns[n]; ok && common.ClassOf(err) == common.ClassFatal {
+		c.Close()
+		delete(h.conns, n)
+	}
+}
+
+// read runs f against replicas from best to worst until one doesn't fail
+func (h *Handler) read(f func(handlers.Handler) error) error {
+	nodes := h.members()
+	err := errNoReplicas
+
+	for attempt, i := range h.g.order(nodes) {
+		if attempt > 0 {
+			metrics.IncCounter(MetricFallbacks)
+		}
+
+		n := nodes[i]
+
+		var c handlers.Handler
+		if c, err = h.conn(n); err != nil {
+			continue
+		}
+
+		start := time.Now()
+		err = f(c)
+		h.done(n, time.Since(start), err)
+
+		if !failed(err) {
+			if n.local {
+				metrics.IncCounter(MetricReadsLocal)
+			} else {
+				metrics.IncCounter(MetricReadsRemote)
+			}
+			return err
+		}
+	}
+
+	return err
+}
+
+// write runs f against every replica at once. The result is the one from the best replica that
+// didn't fail, so e.g. a miss on a delete is still reported as a miss. It only fails if every
+// replica did. Replicas with a queue are given the op made by queued instead, and aren't waited
+// for, see Config.Queue.
+func (h *Handler) write(f func(int, handlers.Handler) error, queued func() op) error {
+	return h.writeTo(h.enqueue(h.members(), queued), f)
+}
+
+// enqueue pushes the op made by queued to the queue of each of nodes that has one, if any of them
+// will be written to directly, and returns the replicas left to write to
+func (h *Handler) enqueue(nodes []*node, queued func() op) []*node {
+	direct := 0
+	for _, n := range nodes {
+		if n.queue == nil {
+			direct++
+		}
+	}
+	if direct == 0 || direct == len(nodes) {
+		return nodes
+	}
+
+	o := queued()
+	rest := make([]*node, 0, direct)
+	for _, n := range nodes {
+		if n.queue != nil {
+			n.queue.push(o)
+		} else {
+			rest = append(rest, n)
+		}
+	}
+	return rest
+}
+
+// writeTo is write for the given replicas. f is passed the index of the replica in nodes and a
+// connection to it.
+func (h *Handler) writeTo(nodes []*node, f func(int, handlers.Handler) error) error {
+	if len(nodes) == 0 {
+		return errNoReplicas
+	}
+
+	errs := make([]error, len(nodes))
+	took := make([]time.Duration, len(nodes))
+	started := make([]bool, len(nodes))
+
+	wg := new(sync.WaitGroup)
+	for i, n := range nodes {
+		c, err := h.conn(n)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		started[i] = true
+		wg.Add(1)
+		go func(i int, c handlers.Handler) {
+			defer wg.Done()
+			start := time.Now()
+			errs[i] = f(i, c)
+			took[i] = time.Since(start)
+		}(i, c)
+	}
+
+	wg.Wait()
+
+	for i, n := range nodes {
+		if started[i] {
+			h.done(n, took[i], errs[i])
+		}
+	}
+
+	order := h.g.order(nodes)
+	for _, i := range order {
+		if !failed(errs[i]) {
+			return errs[i]
+		}
+	}
+	return errs[order[0]]
+}
+
+func (h *Handler) Set(cmd common.SetRequest) error {
+	return h.store(cmd, handlers.Handler.Set)
+}
+
+func (h *Handler) Add(cmd common.SetRequest) error {
+	return h.store(cmd, handlers.Handler.Add)
+}
+
+func (h *Handler) Replace(cmd common.SetRequest) error {
+	return h.store(cmd, handlers.Handler.Replace)
+}
+
+func (h *Handler) Append(cmd common.SetRequest) error {
+	return h.store(cmd, handlers.Handler.Append)
+}
+
+func (h *Handler) Prepend(cmd common.SetRequest) error {
+	return h.store(cmd, handlers.Handler.Prepend)
+}
+
+// store is write for the commands that store a value
+func (h *Handler) store(cmd common.SetRequest, f func(handlers.Handler, common.SetRequest) error) error {
+	return h.write(func(_ int, c handlers.Handler) error { return f(c, cmd) }, func() op {
+		cmd.Key = append([]byte(nil), cmd.Key...)
+		cmd.Data = append([]byte(nil), cmd.Data...)
+		return func(c handlers.Handler) error { return f(c, cmd) }
+	})
+}
+
+func (h *Handler) Delete(cmd common.DeleteRequest) error {
+	if h.g.conf.Tombstones != nil {
+		h.g.conf.Tombstones.Add(cmd.Key)
+	}
+	return h.write(func(_ int, c handlers.Handler) error { return c.Delete(cmd) }, func() op {
+		cmd.Key = append([]byte(nil), cmd.Key...)
+		return func(c handlers.Handler) error { return c.Delete(cmd) }
+	})
+}
+
+func (h *Handler) Touch(cmd common.TouchRequest) error {
+	return h.write(func(_ int, c handlers.Handler) error { return c.Touch(cmd) }, func() op {
+		cmd.Key = append([]byte(nil), cmd.Key...)
+		return func(c handlers.Handler) error { return c.Touch(cmd) }
+	})
+}
+
+// Flush flushes every replica, like a write. Queued writes before it are still done first, so a
+// replica with a queue ends up flushed too.
+func (h *Handler) Flush(cmd common.FlushRequest) error {
+	return h.write(func(_ int, c handlers.Handler) error { return handlers.Flush(c, cmd) }, func() op {
+		return func(c handlers.Handler) error { return handlers.Flush(c, cmd) }
+	})
+}
+
+// GAT touches the key on every replica, since the expiration time has to match everywhere, and
+// returns the value from the best one that has it. Replicas with a queue are only touched, since
+// their value isn't waited for.
+func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	nodes := h.enqueue(h.members(), func() op {
+		touch := common.TouchRequest{Key: append([]byte(nil), cmd.Key...), Exptime: cmd.Exptime}
+		return func(c handlers.Handler) error { return c.Touch(touch) }
+	})
+	res := make([]common.GetResponse, len(nodes))
+
+	err := h.writeTo(nodes, func(i int, c handlers.Handler) error {
+		var err error
+		res[i], err = c.GAT(cmd)
+		return err
+	})
+	if err != nil {
+		return common.GetResponse{}, err
+	}
+
+	for _, i := range h.g.order(nodes) {
+		if res[i].Key != nil && !res[i].Miss {
+			return res[i], nil
+		}
+	}
+
+	return common.GetResponse{
+		Miss:   true,
+		Key:    cmd.Key,
+		Opaque: cmd.Opaque,
+	}, nil
+}
+
+func (h *Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	dataOut := make(chan common.GetResponse, len(cmd.Keys))
+	errorOut := make(chan error, 1)
+
+	go func() {
+		defer close(dataOut)
+		defer close(errorOut)
+
+		if h.g.conf.ReadQuorum > 1 {
+			res, err := h.quorum(cmd)
+			for _, r := range res {
+				dataOut <- common.GetResponse{
+					Key:    r.Key,
+					Data:   r.Data,
+					Opaque: r.Opaque,
+					Flags:  r.Flags,
+					Miss:   r.Miss,
+					Quiet:  r.Quiet,
+				}
+			}
+			if err != nil {
+				errorOut <- err
+			}
+			return
+		}
+
+		// Responses are collected before any are sent so a replica that fails partway through
+		// can be retried on another without sending any key twice
+		var res []common.GetResponse
+		err := h.read(func(c handlers.Handler) error {
+			res = res[:0]
+			resChan, errChan := c.Get(cmd)
+			return handlers.DrainGet(resChan, errChan, func(r common.GetResponse) error {
+				res = append(res, r)
+				return nil
+			})
+		})
+
+		for _, r := range res {
+			dataOut <- r
+		}
+		if err != nil {
+			errorOut <- err
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+func (h *Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	dataOut := make(chan common.GetEResponse, len(cmd.Keys))
+	errorOut := make(chan error, 1)
+
+	go func() {
+		defer close(dataOut)
+		defer close(errorOut)
+
+		var res []common.GetEResponse
+		var err error
+		if h.g.conf.ReadQuorum > 1 {
+			res, err = h.quorum(cmd)
+		} else {
+			err = h.read(func(c handlers.Handler) error {
+				res = res[:0]
+				resChan, errChan := c.GetE(cmd)
+				return handlers.DrainGetE(resChan, errChan, func(r common.GetEResponse) error {
+					res = append(res, r)
+					return nil
+				})
+			})
+		}
+
+		for _, r := range res {
+			dataOut <- r
+		}
+		if err != nil {
+			errorOut <- err
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+func (h *Handler) Keys(prefix []byte) ([][]byte, error) {
+	var keys [][]byte
+	err := h.read(func(c handlers.Handler) error {
+		var err error
+		keys, err = handlers.Keys(c, prefix)
+		return err
+	})
+	return keys, err
+}
+
+func (h *Handler) ServerTime() (time.Time, error) {
+	var t time.Time
+	err := h.read(func(c handlers.Handler) error {
+		var err error
+		t, err = handlers.ServerTime(c)
+		return err
+	})
+	return t, err
+}
+
+func (h *Handler) Ping() error {
+	return h.read(handlers.Ping)
+}
+
+// Close closes the connections to every replica
+func (h *Handler) Close() error {
+	var err error
+	for n, c := range h.conns {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+		delete(h.conns, n)
+	}
+	return err
+}
@@ -0,0 +1,285 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replicas
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+// The rest of what happens to queued writes is counted per replica, see Group.metrics. Writes
+// still queued for a replica that's removed can't be, since the replica is gone along with them.
+var MetricQueueDiscarded = metrics.AddCounter("replica_queue_discarded", nil)
+
+// the first wait before a queued write that failed is tried again. It doubles with every failure
+// in a row, up to Config.Backoff.
+const queueRetryMin = 10 * time.Millisecond
+
+// DropPolicy is which write is dropped when a replica's queue is full
+type DropPolicy int
+
+const (
+	// DropNewest drops the write being queued, so the replica gets the writes up to when the queue
+	// filled up
+	DropNewest DropPolicy = iota
+	// DropOldest drops the write that has been waiting the longest, so the replica gets the most
+	// recent writes
+	DropOldest
+)
+
+func (p DropPolicy) String() string {
+	switch p {
+	case DropNewest:
+		return "newest"
+	case DropOldest:
+		return "oldest"
+	}
+	return "unknown"
+}
+
+// ParseDropPolicy is the inverse of DropPolicy.String
+func ParseDropPolicy(s string) (DropPolicy, error) {
+	switch s {
+	case "newest":
+		return DropNewest, nil
+	case "oldest":
+		return DropOldest, nil
+	}
+	return DropNewest, fmt.Errorf("Unknown queue drop policy %q", s)
+}
+
+// op is a write to one replica. A queued op has its own copy of the request, since the request's
+// buffers are reused once the client has its answer.
+type op func(handlers.Handler) error
+
+type queuedOp struct {
+	op     op
+	queued time.Time
+}
+
+// queueCounts is what happened to the writes queued for one replica. The counts only go up and
+// are updated atomically.
+type queueCounts struct {
+	queued, written, dropped, expired, retries uint64
+}
+
+// queue holds the writes to a replica in another zone until they're done, see Config.Queue. Each
+// one has its own connection and backoff, so a replica that's slow or down only holds up its own
+// writes.
+type queue struct {
+	n    *node
+	conf *Config
+
+	lock sync.Mutex
+	ops  []queuedOp
+	// when the op being written was queued, zero if there isn't one
+	current time.Time
+	backoff time.Duration
+	stopped bool
+
+	counts queueCounts
+
+	wake chan struct{}
+	done chan struct{}
+}
+
+func newQueue(n *node, conf *Config) *queue {
+	q := &queue{
+		n:    n,
+		conf: conf,
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// stop ends the writes to a replica that was removed. Writes still queued are discarded, along with
+// one waiting to be tried again.
+func (q *queue) stop() {
+	q.lock.Lock()
+	metrics.IncCounterBy(MetricQueueDiscarded, uint64(len(q.ops)))
+	q.ops = nil
+	q.stopped = true
+	q.lock.Unlock()
+
+	close(q.done)
+}
+
+// counted returns the counts of the queue's writes so far
+func (q *queue) counted() queueCounts {
+	return queueCounts{
+		queued:  atomic.LoadUint64(&q.counts.queued),
+		written: atomic.LoadUint64(&q.counts.written),
+		dropped: atomic.LoadUint64(&q.counts.dropped),
+		expired: atomic.LoadUint64(&q.counts.expired),
+		retries: atomic.LoadUint64(&q.counts.retries),
+	}
+}
+
+// push queues an op, dropping one if the queue is full
+func (q *queue) push(o op) {
+	q.lock.Lock()
+	if q.stopped {
+		q.lock.Unlock()
+		metrics.IncCounter(MetricQueueDiscarded)
+		return
+	}
+	if len(q.ops) >= q.conf.Queue {
+		atomic.AddUint64(&q.counts.dropped, 1)
+		if q.conf.QueueDrop == DropNewest {
+			q.lock.Unlock()
+			return
+		}
+		q.ops[0] = queuedOp{}
+		q.ops = q.ops[1:]
+	}
+	q.ops = append(q.ops, queuedOp{op: o, queued: time.Now()})
+	q.lock.Unlock()
+
+	atomic.AddUint64(&q.counts.queued, 1)
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// take waits for the oldest op and removes it from the queue. It returns false once the queue is
+// stopped.
+func (q *queue) take() (queuedOp, bool) {
+	for {
+		q.lock.Lock()
+		if len(q.ops) > 0 {
+			o := q.ops[0]
+			q.ops[0] = queuedOp{}
+			q.ops = q.ops[1:]
+			q.current = o.queued
+			q.lock.Unlock()
+			return o, true
+		}
+		q.current = time.Time{}
+		q.lock.Unlock()
+
+		select {
+		case <-q.wake:
+		case <-q.done:
+			return queuedOp{}, false
+		}
+	}
+}
+
+// lag is how many writes are waiting, counting the one being written, and how long the oldest of
+// them has been waiting
+func (q *queue) lag() (int, time.Duration, time.Duration) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	depth := len(q.ops)
+	oldest := q.current
+	if !oldest.IsZero() {
+		depth++
+	} else if depth > 0 {
+		oldest = q.ops[0].queued
+	}
+
+	var age time.Duration
+	if !oldest.IsZero() {
+		age = time.Since(oldest)
+	}
+	return depth, age, q.backoff
+}
+
+func (q *queue) setBackoff(d time.Duration) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.backoff = d
+}
+
+// run writes the queued ops in order. An op that fails because of the replica is tried again after
+// a backoff until it works or is older than Config.QueueMaxAge, so the replica never gets writes
+// out of order.
+func (q *queue) run() {
+	var c handlers.Handler
+	defer func() {
+		if c != nil {
+			c.Close()
+		}
+	}()
+
+	var backoff time.Duration
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+
+	for {
+		o, ok := q.take()
+		if !ok {
+			return
+		}
+
+		for {
+			if max := q.conf.QueueMaxAge; max > 0 && time.Since(o.queued) > max {
+				atomic.AddUint64(&q.counts.expired, 1)
+				break
+			}
+
+			var err error
+			if c == nil {
+				c, err = q.n.Handler()
+			}
+			if err == nil {
+				start := time.Now()
+				err = o.op(c)
+				if !failed(err) {
+					q.n.observe(time.Since(start))
+					atomic.AddUint64(&q.counts.written, 1)
+					backoff = 0
+					q.setBackoff(0)
+					break
+				}
+				if common.ClassOf(err) == common.ClassFatal {
+					c.Close()
+					c = nil
+				}
+			}
+
+			q.n.fail(q.conf.Backoff)
+			atomic.AddUint64(&q.counts.retries, 1)
+
+			if backoff *= 2; backoff < queueRetryMin {
+				backoff = queueRetryMin
+			}
+			if backoff > q.conf.Backoff && q.conf.Backoff >= queueRetryMin {
+				backoff = q.conf.Backoff
+			}
+			q.setBackoff(backoff)
+
+			timer.Reset(backoff)
+			select {
+			case <-timer.C:
+			case <-q.done:
+				timer.Stop()
+				metrics.IncCounter(MetricQueueDiscarded)
+				return
+			}
+		}
+	}
+}
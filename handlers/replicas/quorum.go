@@ -0,0 +1,269 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replicas
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/timer"
+)
+
+var (
+	MetricQuorumReads    = metrics.AddCounter("replica_quorum_reads", nil)
+	MetricDisagreements  = metrics.AddCounter("replica_disagreements", nil)
+	MetricRepairs        = metrics.AddCounter("replica_repairs", nil)
+	MetricRepairsSkipped = metrics.AddCounter("replica_repairs_skipped", nil)
+	MetricRepairErrors   = metrics.AddCounter("replica_repair_errors", nil)
+	MetricRepairsDropped = metrics.AddCounter("replica_repairs_dropped", nil)
+)
+
+// the number of repairs waiting to be written before more are dropped
+const repairQueueSize = 10000
+
+// repair brings a lagging replica up to date with the freshest value of a key. stale is what the
+// replica had, so the repair doesn't overwrite a write that happened since.
+type repair struct {
+	n     *node
+	res   common.GetEResponse
+	stale common.GetEResponse
+	// when the value was read, for the tombstones
+	since uint64
+}
+
+// fresher reports whether a is a fresher answer than b. The value that expires last is taken to
+// be the one written last, which holds as long as writes of a key use the same TTL. Any value is
+// fresher than a miss.
+func fresher(a, b common.GetEResponse) bool {
+	if a.Miss || b.Miss {
+		return !a.Miss && b.Miss
+	}
+	return a.Exptime > b.Exptime
+}
+
+// same reports whether two replicas gave the same answer
+func same(a, b common.GetEResponse) bool {
+	if a.Miss || b.Miss {
+		return a.Miss == b.Miss
+	}
+	return a.Flags == b.Flags && a.Exptime == b.Exptime && bytes.Equal(a.Data, b.Data)
+}
+
+// quorum gets the keys from the best ReadQuorum replicas at once and answers each key with the
+// freshest value any of them had. Replicas that answered with something else are repaired in the
+// background. If none of them answer, the keys are read like without a quorum. The responses are
+// in the order of the keys, with their opaques and quiet flags.
+func (h *Handler) quorum(cmd common.GetRequest) ([]common.GetEResponse, error) {
+	metrics.IncCounter(MetricQuorumReads)
+	start := timer.Now()
+
+	nodes := h.members()
+	order := h.g.order(nodes)
+	if len(order) > h.g.conf.ReadQuorum {
+		order = order[:h.g.conf.ReadQuorum]
+	}
+	chosen := make([]*node, len(order))
+	for i, idx := range order {
+		chosen[i] = nodes[idx]
+	}
+
+	answers, replied := h.getAll(chosen, cmd.Keys)
+	if replied == 0 {
+		metrics.IncCounter(MetricFallbacks)
+		var res []common.GetEResponse
+		err := h.read(func(c handlers.Handler) error {
+			res = res[:0]
+			resChan, errChan := c.GetE(cmd)
+			return handlers.DrainGetE(resChan, errChan, func(r common.GetEResponse) error {
+				res = append(res, r)
+				return nil
+			})
+		})
+		return res, err
+	}
+
+	out := make([]common.GetEResponse, len(cmd.Keys))
+	for k := range cmd.Keys {
+		// Replicas are in order of preference, so the best one wins a tie
+		best := -1
+		for i := range chosen {
+			if answers[i] != nil && (best < 0 || fresher(answers[i][k], answers[best][k])) {
+				best = i
+			}
+		}
+
+		out[k] = answers[best][k]
+		out[k].Key = cmd.Keys[k]
+		out[k].Opaque, out[k].Quiet = 0, false
+		if k < len(cmd.Opaques) {
+			out[k].Opaque = cmd.Opaques[k]
+		}
+		if k < len(cmd.Quiet) {
+			out[k].Quiet = cmd.Quiet[k]
+		}
+
+		if out[k].Miss {
+			continue
+		}
+
+		// A recently deleted key could be a delete that only some replicas got, so the replicas
+		// with the value are the stale ones and spreading it would undo the delete
+		tombstoned := h.g.conf.Tombstones != nil && h.g.conf.Tombstones.Contains(cmd.Keys[k])
+
+		disagree := false
+		for i, n := range chosen {
+			if answers[i] != nil && !same(answers[i][k], answers[best][k]) {
+				disagree = true
+				if tombstoned {
+					metrics.IncCounter(MetricRepairsSkipped)
+					continue
+				}
+				h.g.repair(repair{n: n, res: out[k], stale: answers[i][k], since: start})
+			}
+		}
+		if disagree {
+			metrics.IncCounter(MetricDisagreements)
+		}
+	}
+
+	return out, nil
+}
+
+// getAll gets the keys from every one of nodes at once. The answers from each replica are in the
+// order of the keys, or nil if it failed, and replied is how many replicas answered.
+func (h *Handler) getAll(nodes []*node, keys [][]byte) (answers [][]common.GetEResponse, replied int) {
+	// Every replica is asked for every key with its index as the opaque, so answers can be matched
+	// up by key no matter what each backend does with quiet misses
+	req := common.GetRequest{
+		Keys:    keys,
+		Opaques: make([]uint32, len(keys)),
+		Quiet:   make([]bool, len(keys)),
+	}
+	for i := range req.Opaques {
+		req.Opaques[i] = uint32(i)
+	}
+
+	answers = make([][]common.GetEResponse, len(nodes))
+	h.writeTo(nodes, func(i int, c handlers.Handler) error {
+		res := make([]common.GetEResponse, len(keys))
+		got := make([]bool, len(keys))
+		resChan, errChan := c.GetE(req)
+		err := handlers.DrainGetE(resChan, errChan, func(r common.GetEResponse) error {
+			if int(r.Opaque) < len(res) {
+				res[r.Opaque], got[r.Opaque] = r, true
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for k, ok := range got {
+			if !ok {
+				res[k] = common.GetEResponse{Key: keys[k], Miss: true}
+			}
+		}
+		answers[i] = res
+		return nil
+	})
+
+	for _, a := range answers {
+		if a != nil {
+			replied++
+		}
+	}
+	return answers, replied
+}
+
+// repair queues a repair, dropping it if the queue is full
+func (g *Group) repair(r repair) {
+	select {
+	case g.repairs <- r:
+	default:
+		metrics.IncCounter(MetricRepairsDropped)
+	}
+}
+
+// repairer writes queued repairs, on connections of its own
+func (g *Group) repairer() {
+	h := &Handler{
+		g:     g,
+		conns: make(map[*node]handlers.Handler),
+	}
+
+	for r := range g.repairs {
+		// close connections to replicas that were removed
+		h.members()
+		h.fix(r)
+	}
+}
+
+// fix writes a repair and counts how it went
+func (h *Handler) fix(r repair) {
+	c, err := h.conn(r.n)
+	if err != nil {
+		metrics.IncCounter(MetricRepairErrors)
+		return
+	}
+
+	set := common.SetRequest{
+		Key:     r.res.Key,
+		Data:    r.res.Data,
+		Flags:   r.res.Flags,
+		Exptime: r.res.Exptime,
+	}
+
+	// A replica that missed only gets the value if it still doesn't have one, and one with a stale
+	// value only if it still has that value, so a write since is never undone. Backends that can't
+	// check the value are set anyway.
+	write := func() error {
+		if r.stale.Miss {
+			return c.Add(set)
+		}
+		match := make([]byte, 8)
+		binary.BigEndian.PutUint64(match, common.ValueHash(r.stale.Data))
+		err := handlers.SetIfMatch(c, common.SetIfMatchRequest{SetRequest: set, Match: match, MatchHash: true})
+		if errors.Is(err, common.ErrNotSupported) {
+			err = c.Set(set)
+		}
+		return err
+	}
+
+	if t := h.g.conf.Tombstones; t != nil {
+		err = t.Guard(set.Key, r.since, write, func() error {
+			return c.Delete(common.DeleteRequest{Key: set.Key})
+		})
+	} else {
+		err = write()
+	}
+
+	switch {
+	case err == nil:
+		metrics.IncCounter(MetricRepairs)
+	case errors.Is(err, common.ErrKeyExists), errors.Is(err, common.ErrKeyNotFound), errors.Is(err, common.ErrItemNotStored):
+		metrics.IncCounter(MetricRepairsSkipped)
+	default:
+		metrics.IncCounter(MetricRepairErrors)
+		if failed(err) {
+			log.Printf("Error repairing replica %s: %v\n", r.n.Name, err.Error())
+			h.done(r.n, 0, err)
+		}
+	}
+}
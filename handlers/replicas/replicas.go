@@ -0,0 +1,345 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package replicas serves a cache from several backends that each hold a full copy of the data,
+// e.g. one per availability zone. Writes go to every replica so they stay in sync. Reads go to the
+// best replica: one in the same zone as this instance if it's healthy, since reads across zones
+// cost both latency and transfer, and otherwise whichever healthy replica has been the fastest,
+// going by an exponentially weighted moving average (EWMA) of its latency. A read that fails on one
+// replica is tried on the next best.
+//
+// Replicas drift apart when a write only reaches some of them. With a read quorum, reads ask
+// several replicas at once, answer with the freshest value and bring the others up to date in the
+// background. A background anti-entropy job does the same for keys that aren't read, comparing a
+// range of keys across every replica at a time.
+//
+// With a queue, writes to replicas in other zones don't wait for them. Each of those replicas has
+// a bounded queue of writes of its own, written in order in the background, so one far away or
+// struggling replica falls behind on its own instead of slowing down every write.
+package replicas
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/tombstone"
+)
+
+var (
+	MetricReadsLocal  = metrics.AddCounter("replica_reads_local", nil)
+	MetricReadsRemote = metrics.AddCounter("replica_reads_remote", nil)
+	MetricFallbacks   = metrics.AddCounter("replica_read_fallbacks", nil)
+	MetricFailures    = metrics.AddCounter("replica_failures", nil)
+)
+
+// weight of the newest latency in the EWMA
+const ewmaWeight = 0.2
+
+// Replica is one backend holding a copy of the data
+type Replica struct {
+	// Name identifies the replica in metrics
+	Name    string
+	Zone    string
+	Handler handlers.HandlerConst
+}
+
+// Config says how replicas are chosen for reads
+type Config struct {
+	// Zone is the zone this instance runs in
+	Zone string
+	// CrossZonePenalty is added to the latency of replicas in other zones when comparing them, so a
+	// replica in the same zone is read from unless it's at least this much slower
+	CrossZonePenalty time.Duration
+	// Backoff is how long a replica that failed is passed over for reads. It's still written to,
+	// so it doesn't miss writes while it's avoided.
+	Backoff time.Duration
+	// ReadQuorum is how many replicas each get asks, see quorum. 0 or 1 reads from the best one.
+	ReadQuorum int
+	// AntiEntropy is how often a range of keys is compared across every replica and the replicas
+	// that differ are repaired, see antiEntropy. 0 disables it.
+	AntiEntropy time.Duration
+	// AntiEntropyRanges is how many ranges the keys are split into, by hash, so each comparison
+	// only looks at a sample of them. Every key is compared once every AntiEntropyRanges intervals.
+	AntiEntropyRanges int
+	// AntiEntropyBandwidth caps the bytes per second of values read and written by comparisons.
+	// 0 is unlimited.
+	AntiEntropyBandwidth int
+	// Tombstones, if set, records deletes so repairs don't bring deleted keys back. A delete that
+	// only reached some replicas would otherwise be undone by the first quorum read of the key.
+	Tombstones *tombstone.Set
+	// Queue, if above 0, is how many writes each replica in another zone can have waiting. Writes
+	// only wait for the replicas in this instance's zone and are queued for the others, or wait for
+	// every replica like without a queue if none are in this zone. 0 waits for every replica.
+	Queue int
+	// QueueMaxAge is how long a queued write can wait before it's dropped instead of written, e.g.
+	// since the value has likely expired by then anyway. 0 is no limit.
+	QueueMaxAge time.Duration
+	// QueueDrop is which write is dropped when a queue is full
+	QueueDrop DropPolicy
+}
+
+// ParseReplicas parses a comma separated list of zone=handler pairs, where the handler is a
+// configuration for handlers.FromConfig, e.g.
+// "us-east-1a=memcached:/tmp/a.sock,us-east-1b=memcached:/tmp/b.sock". Each replica is named
+// after its zone, with a number after it if there's more than one in a zone.
+func ParseReplicas(s string) ([]Replica, error) {
+	var replicas []Replica
+	perZone := make(map[string]int)
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		idx := strings.IndexByte(part, '=')
+		if idx <= 0 || idx == len(part)-1 {
+			return nil, fmt.Errorf("Invalid replica %q, expected zone=handler", part)
+		}
+
+		zone := part[:idx]
+		hc, err := handlers.FromConfig(part[idx+1:])
+		if err != nil {
+			return nil, err
+		}
+
+		name := zone
+		if perZone[zone]++; perZone[zone] > 1 {
+			name = fmt.Sprintf("%s-%d", zone, perZone[zone])
+		}
+
+		replicas = append(replicas, Replica{Name: name, Zone: zone, Handler: hc})
+	}
+
+	return replicas, nil
+}
+
+// node is the state of a replica shared by every connection
+type node struct {
+	Replica
+	local bool
+
+	lock      sync.Mutex
+	ewma      float64
+	downUntil time.Time
+
+	// writes waiting for a replica in another zone, nil for replicas that are always written to
+	// directly
+	queue *queue
+}
+
+func (n *node) observe(d time.Duration) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.ewma == 0 {
+		n.ewma = float64(d)
+	} else {
+		n.ewma += ewmaWeight * (float64(d) - n.ewma)
+	}
+}
+
+func (n *node) fail(backoff time.Duration) {
+	metrics.IncCounter(MetricFailures)
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.downUntil = time.Now().Add(backoff)
+}
+
+// score is how good a replica is to read from, lower is better, and whether it's healthy
+func (n *node) score(penalty time.Duration, now time.Time) (float64, bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	s := n.ewma
+	if !n.local {
+		s += float64(penalty)
+	}
+	return s, !now.Before(n.downUntil)
+}
+
+// Group is a set of replicas and what's known about them, shared by all connections
+type Group struct {
+	conf Config
+
+	lock  sync.RWMutex
+	nodes []*node
+
+	// values to write to lagging replicas, see quorum
+	repairs chan repair
+}
+
+// New makes a group of the given replicas
+func New(conf Config, replicas []Replica) *Group {
+	g := &Group{conf: conf}
+	g.Update(replicas)
+
+	if conf.ReadQuorum > 1 {
+		g.repairs = make(chan repair, repairQueueSize)
+		go g.repairer()
+	}
+	if conf.AntiEntropy > 0 {
+		if g.conf.AntiEntropyRanges < 1 {
+			g.conf.AntiEntropyRanges = 1
+		}
+		go g.antiEntropy()
+	}
+
+	metrics.RegisterBulkCallback(g.metrics)
+
+	return g
+}
+
+// Update changes the replicas in the group, e.g. as backends are added and removed by service
+// discovery. Replicas that keep their name also keep their handler and what's known about their
+// latency and health. Connections to replicas that were removed are closed the next time each
+// connection is used.
+func (g *Group) Update(replicas []Replica) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	old := make(map[string]*node, len(g.nodes))
+	for _, n := range g.nodes {
+		old[n.Name] = n
+	}
+
+	nodes := make([]*node, 0, len(replicas))
+	for _, r := range replicas {
+		n, ok := old[r.Name]
+		if !ok || n.Zone != r.Zone {
+			n = &node{Replica: r, local: r.Zone == g.conf.Zone}
+			if !n.local && g.conf.Queue > 0 {
+				n.queue = newQueue(n, &g.conf)
+			}
+		} else {
+			delete(old, r.Name)
+		}
+		nodes = append(nodes, n)
+	}
+
+	for _, n := range old {
+		if n.queue != nil {
+			n.queue.stop()
+		}
+	}
+
+	// Never modified after this so it can be used without the lock
+	g.nodes = nodes
+}
+
+// members is the current replicas
+func (g *Group) members() []*node {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return g.nodes
+}
+
+// Replicas returns the names of the current replicas
+func (g *Group) Replicas() []string {
+	nodes := g.members()
+	names := make([]string, len(nodes))
+	for i, n := range nodes {
+		names[i] = n.Name
+	}
+	return names
+}
+
+func (g *Group) metrics() ([]metrics.IntMetric, []metrics.FloatMetric) {
+	nodes := g.members()
+
+	ret := make([]metrics.IntMetric, 0, len(nodes))
+	for _, n := range nodes {
+		n.lock.Lock()
+		ewma := n.ewma
+		n.lock.Unlock()
+
+		tgs := metrics.Tags{"replica": n.Name}
+		ret = append(ret, metrics.IntMetric{
+			Name: "replica_latency_ewma",
+			Val:  uint64(ewma),
+			Tgs:  tgs,
+		})
+
+		if n.queue != nil {
+			depth, age, backoff := n.queue.lag()
+			counts := n.queue.counted()
+			ret = append(ret,
+				metrics.IntMetric{Name: "replica_queue_depth", Val: uint64(depth), Tgs: tgs},
+				metrics.IntMetric{Name: "replica_queue_age_ms", Val: uint64(age / time.Millisecond), Tgs: tgs},
+				metrics.IntMetric{Name: "replica_queue_backoff_ms", Val: uint64(backoff / time.Millisecond), Tgs: tgs},
+				metrics.IntMetric{Name: "replica_queue_writes", Val: counts.queued, Tgs: tgs},
+				metrics.IntMetric{Name: "replica_queue_written", Val: counts.written, Tgs: tgs},
+				metrics.IntMetric{Name: "replica_queue_dropped", Val: counts.dropped, Tgs: tgs},
+				metrics.IntMetric{Name: "replica_queue_expired", Val: counts.expired, Tgs: tgs},
+				metrics.IntMetric{Name: "replica_queue_retries", Val: counts.retries, Tgs: tgs},
+			)
+		}
+	}
+
+	return ret, nil
+}
+
+// order returns the indexes of nodes from best to worst to read from. Healthy replicas come first,
+// but the others are still there to try when none of the healthy ones work out.
+func (g *Group) order(nodes []*node) []int {
+	type ranked struct {
+		idx     int
+		score   float64
+		healthy bool
+	}
+
+	now := time.Now()
+	ranks := make([]ranked, len(nodes))
+	for i, n := range nodes {
+		s, healthy := n.score(g.conf.CrossZonePenalty, now)
+		ranks[i] = ranked{i, s, healthy}
+	}
+
+	sort.SliceStable(ranks, func(i, j int) bool {
+		if ranks[i].healthy != ranks[j].healthy {
+			return ranks[i].healthy
+		}
+		return ranks[i].score < ranks[j].score
+	})
+
+	order := make([]int, len(ranks))
+	for i, r := range ranks {
+		order[i] = r.idx
+	}
+	return order
+}
+
+// HandlerConst returns a constructor for handlers that use the group. Each one connects to a
+// replica the first time it's used.
+func (g *Group) HandlerConst() handlers.HandlerConst {
+	return func() (handlers.Handler, error) {
+		return &Handler{
+			g:     g,
+			conns: make(map[*node]handlers.Handler),
+		}, nil
+	}
+}
+
+// failed reports whether err means the replica couldn't serve the request, as opposed to an answer
+// like a miss that any replica would have given
+func failed(err error) bool {
+	switch common.ClassOf(err) {
+	case common.ClassFatal, common.ClassServer:
+		return true
+	}
+	return false
+}
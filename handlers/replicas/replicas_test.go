@@ -0,0 +1,599 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replicas_test
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/replicas"
+	"github.com/netflix/rend/metrics"
+)
+
+// fakeReplica is just enough of a handler to tell which replica served a request. It can be made
+// slow, or down, where every request fails like a broken connection.
+type fakeReplica struct {
+	sync.Mutex
+	data  map[string]string
+	exp   map[string]uint32
+	down  bool
+	delay time.Duration
+	gets  int
+}
+
+func newFakeReplica() *fakeReplica {
+	return &fakeReplica{data: make(map[string]string), exp: make(map[string]uint32)}
+}
+
+func (f *fakeReplica) hc() handlers.HandlerConst {
+	return func() (handlers.Handler, error) { return f, nil }
+}
+
+func (f *fakeReplica) setDown(down bool) {
+	f.Lock()
+	defer f.Unlock()
+	f.down = down
+}
+
+func (f *fakeReplica) numGets() int {
+	f.Lock()
+	defer f.Unlock()
+	return f.gets
+}
+
+func (f *fakeReplica) begin() error {
+	f.Lock()
+	down, delay := f.down, f.delay
+	f.Unlock()
+
+	time.Sleep(delay)
+	if down {
+		return io.EOF
+	}
+	return nil
+}
+
+func (f *fakeReplica) Set(cmd common.SetRequest) error {
+	if err := f.begin(); err != nil {
+		return err
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.data[string(cmd.Key)] = string(cmd.Data)
+	f.exp[string(cmd.Key)] = cmd.Exptime
+	return nil
+}
+
+func (f *fakeReplica) value(key string) (string, uint32, bool) {
+	f.Lock()
+	defer f.Unlock()
+	v, ok := f.data[key]
+	return v, f.exp[key], ok
+}
+
+func (f *fakeReplica) Add(cmd common.SetRequest) error {
+	if _, _, ok := f.value(string(cmd.Key)); ok {
+		return common.ErrItemNotStored
+	}
+	return f.Set(cmd)
+}
+
+func (f *fakeReplica) SetIfMatch(cmd common.SetIfMatchRequest) error {
+	v, _, ok := f.value(string(cmd.Key))
+	if !ok {
+		return common.ErrKeyNotFound
+	}
+	if !cmd.Matches([]byte(v)) {
+		return common.ErrKeyExists
+	}
+	return f.Set(cmd.SetRequest)
+}
+
+func (f *fakeReplica) Delete(cmd common.DeleteRequest) error {
+	if err := f.begin(); err != nil {
+		return err
+	}
+	f.Lock()
+	defer f.Unlock()
+	if _, ok := f.data[string(cmd.Key)]; !ok {
+		return common.ErrKeyNotFound
+	}
+	delete(f.data, string(cmd.Key))
+	return nil
+}
+
+func (f *fakeReplica) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	resChan := make(chan common.GetResponse, len(cmd.Keys))
+	errChan := make(chan error, 1)
+	defer close(resChan)
+	defer close(errChan)
+
+	f.Lock()
+	f.gets++
+	f.Unlock()
+
+	if err := f.begin(); err != nil {
+		errChan <- err
+		return resChan, errChan
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	for i, k := range cmd.Keys {
+		v, ok := f.data[string(k)]
+		resChan <- common.GetResponse{Key: k, Data: []byte(v), Miss: !ok, Opaque: cmd.Opaques[i]}
+	}
+	return resChan, errChan
+}
+
+func (f *fakeReplica) Replace(cmd common.SetRequest) error { return common.ErrItemNotStored }
+func (f *fakeReplica) Append(cmd common.SetRequest) error  { return common.ErrItemNotStored }
+func (f *fakeReplica) Prepend(cmd common.SetRequest) error { return common.ErrItemNotStored }
+func (f *fakeReplica) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	resChan := make(chan common.GetEResponse, len(cmd.Keys))
+	errChan := make(chan error, 1)
+	defer close(resChan)
+	defer close(errChan)
+
+	if err := f.begin(); err != nil {
+		errChan <- err
+		return resChan, errChan
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	f.gets++
+	for i, k := range cmd.Keys {
+		v, ok := f.data[string(k)]
+		resChan <- common.GetEResponse{Key: k, Data: []byte(v), Exptime: f.exp[string(k)], Miss: !ok, Opaque: cmd.Opaques[i]}
+	}
+	return resChan, errChan
+}
+func (f *fakeReplica) Keys(prefix []byte) ([][]byte, error) {
+	f.Lock()
+	defer f.Unlock()
+	var keys [][]byte
+	for k := range f.data {
+		keys = append(keys, []byte(k))
+	}
+	return keys, nil
+}
+func (f *fakeReplica) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	return common.GetResponse{Miss: true}, nil
+}
+func (f *fakeReplica) Touch(cmd common.TouchRequest) error { return nil }
+func (f *fakeReplica) Close() error                        { return nil }
+
+func get(t *testing.T, h handlers.Handler, key string) (string, bool) {
+	t.Helper()
+
+	resChan, errChan := h.Get(common.GetRequest{Keys: [][]byte{[]byte(key)}, Opaques: []uint32{0}})
+	var res common.GetResponse
+	for r := range resChan {
+		res = r
+	}
+	if err := <-errChan; err != nil {
+		t.Fatalf("Get %s: %v", key, err)
+	}
+	return string(res.Data), !res.Miss
+}
+
+func TestReplicas(t *testing.T) {
+	t.Run("WritesGoEverywhere", func(t *testing.T) {
+		a, b := newFakeReplica(), newFakeReplica()
+		g := replicas.New(replicas.Config{Zone: "a", Backoff: time.Minute}, []replicas.Replica{
+			{Name: "a", Zone: "a", Handler: a.hc()},
+			{Name: "b", Zone: "b", Handler: b.hc()},
+		})
+		h, _ := g.HandlerConst()()
+
+		if err := h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar")}); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		if a.data["foo"] != "bar" || b.data["foo"] != "bar" {
+			t.Fatalf("Set didn't reach every replica: a=%q b=%q", a.data["foo"], b.data["foo"])
+		}
+
+		// A replica being down doesn't fail a write the others took
+		b.setDown(true)
+		if err := h.Delete(common.DeleteRequest{Key: []byte("foo")}); err != nil {
+			t.Fatalf("Delete with one replica down: %v", err)
+		}
+		if err := h.Delete(common.DeleteRequest{Key: []byte("foo")}); err != common.ErrKeyNotFound {
+			t.Fatalf("Delete of missing key: got %v, expected ErrKeyNotFound", err)
+		}
+
+		a.setDown(true)
+		if err := h.Delete(common.DeleteRequest{Key: []byte("foo")}); common.ClassOf(err) != common.ClassFatal {
+			t.Fatalf("Delete with every replica down: got %v, expected a fatal error", err)
+		}
+	})
+
+	t.Run("PrefersLocalZone", func(t *testing.T) {
+		remote, local := newFakeReplica(), newFakeReplica()
+		g := replicas.New(replicas.Config{Zone: "a", CrossZonePenalty: time.Second, Backoff: time.Minute}, []replicas.Replica{
+			{Name: "b", Zone: "b", Handler: remote.hc()},
+			{Name: "a", Zone: "a", Handler: local.hc()},
+		})
+		h, _ := g.HandlerConst()()
+
+		h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar")})
+
+		for i := 0; i < 5; i++ {
+			if v, ok := get(t, h, "foo"); !ok || v != "bar" {
+				t.Fatalf("Get: got %q %v", v, ok)
+			}
+		}
+		if local.numGets() != 5 || remote.numGets() != 0 {
+			t.Fatalf("Reads should stay in zone: local %d remote %d", local.numGets(), remote.numGets())
+		}
+	})
+
+	t.Run("FallsBackAcrossZones", func(t *testing.T) {
+		local, remote := newFakeReplica(), newFakeReplica()
+		g := replicas.New(replicas.Config{Zone: "a", CrossZonePenalty: time.Second, Backoff: time.Minute}, []replicas.Replica{
+			{Name: "a", Zone: "a", Handler: local.hc()},
+			{Name: "b", Zone: "b", Handler: remote.hc()},
+		})
+		h, _ := g.HandlerConst()()
+
+		h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar")})
+		local.setDown(true)
+
+		if v, ok := get(t, h, "foo"); !ok || v != "bar" {
+			t.Fatalf("Get with local replica down: got %q %v", v, ok)
+		}
+		if local.numGets() != 1 || remote.numGets() != 1 {
+			t.Fatalf("Expected one failed local read and one remote: local %d remote %d", local.numGets(), remote.numGets())
+		}
+
+		// The local replica is backed off, so it isn't tried first while it's down
+		get(t, h, "foo")
+		if local.numGets() != 1 || remote.numGets() != 2 {
+			t.Fatalf("Local replica should be avoided: local %d remote %d", local.numGets(), remote.numGets())
+		}
+	})
+
+	t.Run("PrefersFaster", func(t *testing.T) {
+		slow, fast := newFakeReplica(), newFakeReplica()
+		slow.delay = 20 * time.Millisecond
+		g := replicas.New(replicas.Config{Backoff: time.Minute}, []replicas.Replica{
+			{Name: "slow", Zone: "b", Handler: slow.hc()},
+			{Name: "fast", Zone: "c", Handler: fast.hc()},
+		})
+		h, _ := g.HandlerConst()()
+
+		// Writes go to both, which measures both
+		h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar")})
+
+		for i := 0; i < 5; i++ {
+			get(t, h, "foo")
+		}
+		if fast.numGets() != 5 || slow.numGets() != 0 {
+			t.Fatalf("Reads should go to the faster replica: fast %d slow %d", fast.numGets(), slow.numGets())
+		}
+	})
+}
+
+func TestUpdate(t *testing.T) {
+	a, b := newFakeReplica(), newFakeReplica()
+	g := replicas.New(replicas.Config{Zone: "a", Backoff: time.Minute}, []replicas.Replica{
+		{Name: "a", Zone: "a", Handler: a.hc()},
+	})
+	h, _ := g.HandlerConst()()
+
+	h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar")})
+
+	g.Update([]replicas.Replica{{Name: "b", Zone: "a", Handler: b.hc()}})
+	if names := g.Replicas(); len(names) != 1 || names[0] != "b" {
+		t.Fatalf("Expected only b after the update, got %v", names)
+	}
+
+	// Existing connections pick up the new members
+	if _, ok := get(t, h, "foo"); ok {
+		t.Fatal("Expected a miss on the new replica")
+	}
+	if a.numGets() != 0 || b.numGets() != 1 {
+		t.Fatalf("Expected the read to go to the new replica: a %d b %d", a.numGets(), b.numGets())
+	}
+
+	g.Update(nil)
+	if err := h.Set(common.SetRequest{Key: []byte("foo")}); err == nil {
+		t.Fatal("Expected a write with no replicas to fail")
+	}
+}
+
+func TestQuorum(t *testing.T) {
+	a, b, c := newFakeReplica(), newFakeReplica(), newFakeReplica()
+	g := replicas.New(replicas.Config{Zone: "a", Backoff: time.Minute, ReadQuorum: 3}, []replicas.Replica{
+		{Name: "a", Zone: "a", Handler: a.hc()},
+		{Name: "b", Zone: "a", Handler: b.hc()},
+		{Name: "c", Zone: "a", Handler: c.hc()},
+	})
+	h, _ := g.HandlerConst()()
+
+	// a missed the last write and c missed both
+	a.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("old"), Exptime: 2000000000})
+	b.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("new"), Exptime: 2000000100})
+
+	if v, ok := get(t, h, "foo"); !ok || v != "new" {
+		t.Fatalf("Expected the freshest value, got %q %v", v, ok)
+	}
+
+	for _, r := range []*fakeReplica{a, c} {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if v, exp, _ := r.value("foo"); v == "new" && exp == 2000000100 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("Timed out waiting for the lagging replicas to be repaired")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	if _, ok := get(t, h, "bar"); ok {
+		t.Fatal("Expected a miss everywhere to be a miss")
+	}
+	if _, _, ok := c.value("bar"); ok {
+		t.Fatal("Expected nothing to repair for a miss everywhere")
+	}
+
+	// When the replicas asked don't answer, the others are still read
+	g = replicas.New(replicas.Config{Zone: "a", Backoff: time.Minute, ReadQuorum: 2}, []replicas.Replica{
+		{Name: "a", Zone: "a", Handler: a.hc()},
+		{Name: "b", Zone: "a", Handler: b.hc()},
+		{Name: "c", Zone: "a", Handler: c.hc()},
+	})
+	h, _ = g.HandlerConst()()
+	a.setDown(true)
+	b.setDown(true)
+	if v, ok := get(t, h, "foo"); !ok || v != "new" {
+		t.Fatalf("Expected to fall back to the last replica, got %q %v", v, ok)
+	}
+}
+
+func TestAntiEntropy(t *testing.T) {
+	a, b := newFakeReplica(), newFakeReplica()
+
+	// Nothing reads these keys, so only the anti-entropy job can bring the replicas together
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		switch i % 3 {
+		case 0:
+			a.Set(common.SetRequest{Key: key, Data: []byte("new"), Exptime: 2000000100})
+		case 1:
+			a.Set(common.SetRequest{Key: key, Data: []byte("old"), Exptime: 2000000000})
+			b.Set(common.SetRequest{Key: key, Data: []byte("new"), Exptime: 2000000100})
+		case 2:
+			a.Set(common.SetRequest{Key: key, Data: []byte("new"), Exptime: 2000000100})
+			b.Set(common.SetRequest{Key: key, Data: []byte("new"), Exptime: 2000000100})
+		}
+	}
+
+	replicas.New(replicas.Config{
+		Backoff:           time.Minute,
+		AntiEntropy:       time.Millisecond,
+		AntiEntropyRanges: 3,
+	}, []replicas.Replica{
+		{Name: "a", Handler: a.hc()},
+		{Name: "b", Handler: b.hc()},
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprint("key", i)
+		for _, r := range []*fakeReplica{a, b} {
+			for {
+				if v, exp, _ := r.value(key); v == "new" && exp == 2000000100 {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("Timed out waiting for %s to be repaired", key)
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+		}
+	}
+}
+
+func TestQueue(t *testing.T) {
+	waitFor := func(t *testing.T, r *fakeReplica, key string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if _, _, ok := r.value(key); ok {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %s to reach the remote replica", key)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	t.Run("DoesntWaitForRemote", func(t *testing.T) {
+		local, remote := newFakeReplica(), newFakeReplica()
+		remote.delay = time.Second
+		g := replicas.New(replicas.Config{Zone: "a", Backoff: time.Minute, Queue: 10}, []replicas.Replica{
+			{Name: "a", Zone: "a", Handler: local.hc()},
+			{Name: "b", Zone: "b", Handler: remote.hc()},
+		})
+		h, _ := g.HandlerConst()()
+
+		start := time.Now()
+		key, data := []byte("foo"), []byte("bar")
+		if err := h.Set(common.SetRequest{Key: key, Data: data}); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		if d := time.Since(start); d > 500*time.Millisecond {
+			t.Fatalf("Set waited %v for the remote replica", d)
+		}
+		if v, _, _ := local.value("foo"); v != "bar" {
+			t.Fatalf("Set didn't reach the local replica: %q", v)
+		}
+
+		// the client's buffers can be reused once it has its answer
+		copy(key, "xxx")
+		copy(data, "xxx")
+
+		waitFor(t, remote, "foo")
+		if v, _, _ := remote.value("foo"); v != "bar" {
+			t.Fatalf("Expected the remote replica to get its own copy of the write, got %q", v)
+		}
+	})
+
+	for _, policy := range []replicas.DropPolicy{replicas.DropNewest, replicas.DropOldest} {
+		t.Run("Drop"+policy.String(), func(t *testing.T) {
+			local, remote := newFakeReplica(), newFakeReplica()
+			remote.setDown(true)
+			g := replicas.New(replicas.Config{
+				Zone:      "a",
+				Backoff:   20 * time.Millisecond,
+				Queue:     1,
+				QueueDrop: policy,
+			}, []replicas.Replica{
+				{Name: "a", Zone: "a", Handler: local.hc()},
+				{Name: "b", Zone: "b", Handler: remote.hc()},
+			})
+			h, _ := g.HandlerConst()()
+
+			// The first write is taken off the queue and retried while the replica is down, the
+			// second waits behind it, and the third finds the queue full
+			h.Set(common.SetRequest{Key: []byte("1"), Data: []byte("1")})
+			time.Sleep(50 * time.Millisecond)
+			h.Set(common.SetRequest{Key: []byte("2"), Data: []byte("2")})
+			h.Set(common.SetRequest{Key: []byte("3"), Data: []byte("3")})
+
+			for _, k := range []string{"1", "2", "3"} {
+				if _, _, ok := local.value(k); !ok {
+					t.Fatalf("Expected %s to reach the local replica", k)
+				}
+			}
+
+			remote.setDown(false)
+			kept, dropped := "2", "3"
+			if policy == replicas.DropOldest {
+				kept, dropped = "3", "2"
+			}
+			waitFor(t, remote, "1")
+			waitFor(t, remote, kept)
+			if _, _, ok := remote.value(dropped); ok {
+				t.Fatalf("Expected %s to be dropped", dropped)
+			}
+		})
+	}
+
+	t.Run("Counts", func(t *testing.T) {
+		stat := func(name string) string {
+			for _, s := range metrics.Stats() {
+				if s.Name == name {
+					return s.Value
+				}
+			}
+			return ""
+		}
+
+		local, remote := newFakeReplica(), newFakeReplica()
+		remote.setDown(true)
+		g := replicas.New(replicas.Config{Zone: "a", Backoff: time.Minute, Queue: 1}, []replicas.Replica{
+			{Name: "counts-a", Zone: "a", Handler: local.hc()},
+			{Name: "counts-b", Zone: "b", Handler: remote.hc()},
+		})
+		h, _ := g.HandlerConst()()
+
+		// one write waits to be retried, one waits behind it, and one is dropped
+		h.Set(common.SetRequest{Key: []byte("1"), Data: []byte("1")})
+		time.Sleep(20 * time.Millisecond)
+		h.Set(common.SetRequest{Key: []byte("2"), Data: []byte("2")})
+		h.Set(common.SetRequest{Key: []byte("3"), Data: []byte("3")})
+
+		for name, expected := range map[string]string{
+			"replica_queue_writes:replica=counts-b":  "2",
+			"replica_queue_dropped:replica=counts-b": "1",
+			"replica_queue_written:replica=counts-b": "0",
+		} {
+			if v := stat(name); v != expected {
+				t.Errorf("Expected %s to be %s, got %q", name, expected, v)
+			}
+		}
+		if v := stat("replica_queue_retries:replica=counts-b"); v == "0" || v == "" {
+			t.Errorf("Expected the write to the replica that's down to be retried, got %q", v)
+		}
+		if v := stat("replica_queue_dropped:replica=counts-a"); v != "" {
+			t.Errorf("Expected no queue counts for the local replica, got %q", v)
+		}
+
+		before, _ := strconv.Atoi(stat("replica_queue_discarded"))
+		g.Update([]replicas.Replica{{Name: "counts-a", Zone: "a", Handler: local.hc()}})
+		// the write being retried is discarded once the queue notices it was stopped
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+			after, _ := strconv.Atoi(stat("replica_queue_discarded"))
+			if after-before == 2 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected both writes left for the removed replica to be discarded, got %d", after-before)
+			}
+		}
+	})
+
+	t.Run("NoLocalReplicas", func(t *testing.T) {
+		b, c := newFakeReplica(), newFakeReplica()
+		g := replicas.New(replicas.Config{Zone: "a", Backoff: time.Minute, Queue: 10}, []replicas.Replica{
+			{Name: "b", Zone: "b", Handler: b.hc()},
+			{Name: "c", Zone: "c", Handler: c.hc()},
+		})
+		h, _ := g.HandlerConst()()
+
+		// with nothing to wait for, every replica is written to directly
+		b.setDown(true)
+		c.setDown(true)
+		if err := h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar")}); common.ClassOf(err) != common.ClassFatal {
+			t.Fatalf("Expected the write to wait for the remote replicas and fail, got %v", err)
+		}
+	})
+}
+
+func TestParseReplicas(t *testing.T) {
+	rs, err := replicas.ParseReplicas("a=nil, b=nil,b=nil")
+	if err != nil {
+		t.Fatalf("ParseReplicas: %v", err)
+	}
+
+	names := []string{"a", "b", "b-2"}
+	zones := []string{"a", "b", "b"}
+	if len(rs) != len(names) {
+		t.Fatalf("Expected %d replicas, got %d", len(names), len(rs))
+	}
+	for i, r := range rs {
+		if r.Name != names[i] || r.Zone != zones[i] {
+			t.Errorf("Replica %d: got %s in %s, expected %s in %s", i, r.Name, r.Zone, names[i], zones[i])
+		}
+	}
+
+	for _, bad := range []string{"", "a", "=nil", "a=", "a=nosuchhandler"} {
+		if _, err := replicas.ParseReplicas(bad); err == nil {
+			t.Errorf("ParseReplicas(%q) should have failed", bad)
+		}
+	}
+}
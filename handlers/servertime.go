@@ -0,0 +1,61 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"github.com/netflix/rend/common"
+)
+
+// ServerTimer is implemented by handlers whose backend keeps its own clock, like memcached. The
+// backend's clock decides when entries expire, so it's worth knowing when it disagrees with ours.
+type ServerTimer interface {
+	ServerTime() (time.Time, error)
+}
+
+// ServerTimerV2 is the context-aware form of ServerTimer for HandlerV2 implementations.
+type ServerTimerV2 interface {
+	ServerTime(ctx context.Context) (time.Time, error)
+}
+
+// ServerTime returns the current time of h's backend, or common.ErrNotSupported if h can't tell.
+func ServerTime(h Handler) (time.Time, error) {
+	if st, ok := h.(ServerTimer); ok {
+		return st.ServerTime()
+	}
+	return time.Time{}, common.ErrNotSupported
+}
+
+// ServerTimeV2 is the HandlerV2 counterpart of ServerTime.
+func ServerTimeV2(ctx context.Context, h HandlerV2) (time.Time, error) {
+	if st, ok := h.(ServerTimerV2); ok {
+		return st.ServerTime(ctx)
+	}
+	return time.Time{}, common.ErrNotSupported
+}
+
+func (v v2Handler) ServerTime(ctx context.Context) (time.Time, error) {
+	if err := ctx.Err(); err != nil {
+		return time.Time{}, err
+	}
+	defer v.interrupt(ctx)()
+	return ServerTime(v.h)
+}
+
+func (v v1Handler) ServerTime() (time.Time, error) {
+	return ServerTimeV2(context.Background(), v.h)
+}
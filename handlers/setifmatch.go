@@ -0,0 +1,65 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"context"
+
+	"github.com/netflix/rend/common"
+)
+
+// SetIfMatcher is implemented by handlers that support conditional sets. The set must only be done
+// if the key currently holds a value that matches the request, and otherwise fail with
+// common.ErrKeyExists, or common.ErrKeyNotFound if the key isn't there at all. Handlers that can't
+// do the check and the set atomically should still detect a concurrent change between the two, e.g.
+// using CAS, and fail with common.ErrKeyExists.
+type SetIfMatcher interface {
+	SetIfMatch(cmd common.SetIfMatchRequest) error
+}
+
+// SetIfMatcherV2 is the context-aware form of SetIfMatcher for HandlerV2 implementations.
+type SetIfMatcherV2 interface {
+	SetIfMatch(ctx context.Context, cmd common.SetIfMatchRequest) error
+}
+
+// SetIfMatch does the conditional set in cmd using h, or returns common.ErrNotSupported if h
+// doesn't implement SetIfMatcher. A conditional set can't be emulated safely on top of the other
+// operations, so there is no fallback.
+func SetIfMatch(h Handler, cmd common.SetIfMatchRequest) error {
+	if sm, ok := h.(SetIfMatcher); ok {
+		return sm.SetIfMatch(cmd)
+	}
+	return common.ErrNotSupported
+}
+
+// SetIfMatchV2 is the HandlerV2 counterpart of SetIfMatch.
+func SetIfMatchV2(ctx context.Context, h HandlerV2, cmd common.SetIfMatchRequest) error {
+	if sm, ok := h.(SetIfMatcherV2); ok {
+		return sm.SetIfMatch(ctx, cmd)
+	}
+	return common.ErrNotSupported
+}
+
+func (v v2Handler) SetIfMatch(ctx context.Context, cmd common.SetIfMatchRequest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer v.interrupt(ctx)()
+	return SetIfMatch(v.h, cmd)
+}
+
+func (v v1Handler) SetIfMatch(cmd common.SetIfMatchRequest) error {
+	return SetIfMatchV2(context.Background(), v.h, cmd)
+}
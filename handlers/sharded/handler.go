@@ -0,0 +1,439 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharded
+
+import (
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/timer"
+)
+
+// Handler is the per-connection handler for a Group. It keeps its own connection to each node,
+// made the first time that node is used.
+type Handler struct {
+	g     *Group
+	conns []handlers.Handler
+}
+
+func (h *Handler) conn(i int) (handlers.Handler, error) {
+	if h.conns[i] == nil {
+		c, err := h.g.nodes[i].Handler()
+		if err != nil {
+			return nil, err
+		}
+		h.conns[i] = c
+	}
+	return h.conns[i], nil
+}
+
+// check drops the connection to node i after a fatal error so a new one is made next time
+func (h *Handler) check(i int, err error) error {
+	if common.ClassOf(err) == common.ClassFatal && h.conns[i] != nil {
+		h.conns[i].Close()
+		h.conns[i] = nil
+	}
+	return err
+}
+
+// owner runs f with a connection to the node that owns key
+func (h *Handler) owner(key []byte, f func(handlers.Handler) error) error {
+	i := h.g.owner(key)
+	c, err := h.conn(i)
+	if err != nil {
+		return err
+	}
+	return h.check(i, f(c))
+}
+
+func (h *Handler) Set(cmd common.SetRequest) error {
+	return h.owner(cmd.Key, func(c handlers.Handler) error { return c.Set(cmd) })
+}
+
+func (h *Handler) Add(cmd common.SetRequest) error {
+	return h.owner(cmd.Key, func(c handlers.Handler) error { return c.Add(cmd) })
+}
+
+func (h *Handler) Replace(cmd common.SetRequest) error {
+	return h.owner(cmd.Key, func(c handlers.Handler) error { return c.Replace(cmd) })
+}
+
+func (h *Handler) Append(cmd common.SetRequest) error {
+	return h.owner(cmd.Key, func(c handlers.Handler) error { return c.Append(cmd) })
+}
+
+func (h *Handler) Prepend(cmd common.SetRequest) error {
+	return h.owner(cmd.Key, func(c handlers.Handler) error { return c.Prepend(cmd) })
+}
+
+func (h *Handler) Delete(cmd common.DeleteRequest) error {
+	return h.owner(cmd.Key, func(c handlers.Handler) error { return c.Delete(cmd) })
+}
+
+func (h *Handler) Touch(cmd common.TouchRequest) error {
+	return h.owner(cmd.Key, func(c handlers.Handler) error { return c.Touch(cmd) })
+}
+
+func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	var res common.GetResponse
+	err := h.owner(cmd.Key, func(c handlers.Handler) error {
+		var err error
+		res, err = c.GAT(cmd)
+		return err
+	})
+	return res, err
+}
+
+func (h *Handler) Incr(cmd common.ArithRequest) (uint64, error) {
+	var v uint64
+	err := h.owner(cmd.Key, func(c handlers.Handler) error {
+		var err error
+		v, err = handlers.Incr(c, cmd)
+		return err
+	})
+	return v, err
+}
+
+func (h *Handler) Decr(cmd common.ArithRequest) (uint64, error) {
+	var v uint64
+	err := h.owner(cmd.Key, func(c handlers.Handler) error {
+		var err error
+		v, err = handlers.Decr(c, cmd)
+		return err
+	})
+	return v, err
+}
+
+func (h *Handler) GetLock(cmd common.GetLockRequest) (common.GetLockResponse, error) {
+	var res common.GetLockResponse
+	err := h.owner(cmd.Key, func(c handlers.Handler) error {
+		var err error
+		res, err = handlers.GetLock(c, cmd)
+		return err
+	})
+	return res, err
+}
+
+func (h *Handler) Unlock(cmd common.UnlockRequest) error {
+	return h.owner(cmd.Key, func(c handlers.Handler) error { return handlers.Unlock(c, cmd) })
+}
+
+// split groups the keys of a multi-key get by the node that owns them. Each node's request keeps
+// the keys in their original order, and idx has their positions in cmd.
+func (h *Handler) split(cmd common.GetRequest) (map[int]common.GetRequest, map[int][]int) {
+	reqs := make(map[int]common.GetRequest)
+	idx := make(map[int][]int)
+
+	for i, key := range cmd.Keys {
+		n := h.g.owner(key)
+		r := reqs[n]
+		r.Keys = append(r.Keys, key)
+		if i < len(cmd.Opaques) {
+			r.Opaques = append(r.Opaques, cmd.Opaques[i])
+		}
+		if i < len(cmd.Quiet) {
+			r.Quiet = append(r.Quiet, cmd.Quiet[i])
+		}
+		r.NoopOpaque = cmd.NoopOpaque
+		r.NoopEnd = cmd.NoopEnd
+		reqs[n] = r
+		idx[n] = append(idx[n], i)
+	}
+
+	return reqs, idx
+}
+
+// fanOut runs get against every node in reqs at once and returns the errors of the nodes that
+// failed. Unless failed nodes' keys are answered as misses, connection errors are returned before
+// running anything, so no key is answered twice if the client retries.
+func (h *Handler) fanOut(reqs map[int]common.GetRequest, get func(n int, c handlers.Handler, req common.GetRequest) error) map[int]error {
+	failed := make(map[int]error)
+	conns := make(map[int]handlers.Handler, len(reqs))
+	for n := range reqs {
+		c, err := h.conn(n)
+		if err != nil {
+			metrics.IncCounter(h.g.getErrors[n])
+			failed[n] = err
+			if !h.g.missFailed {
+				return failed
+			}
+			continue
+		}
+		conns[n] = c
+	}
+
+	run := func(n int, c handlers.Handler, req common.GetRequest) error {
+		start := timer.Now()
+		err := get(n, c, req)
+		metrics.ObserveHist(h.g.getHists[n], timer.Since(start))
+		if err != nil {
+			metrics.IncCounter(h.g.getErrors[n])
+		}
+		return err
+	}
+
+	if len(conns) == 1 {
+		for n, c := range conns {
+			if err := run(n, c, reqs[n]); err != nil {
+				failed[n] = h.check(n, err)
+			}
+		}
+		return failed
+	}
+
+	errs := make(map[int]error, len(conns))
+	lock := new(sync.Mutex)
+	wg := new(sync.WaitGroup)
+
+	for n, c := range conns {
+		wg.Add(1)
+		go func(n int, c handlers.Handler, req common.GetRequest) {
+			defer wg.Done()
+			err := run(n, c, req)
+			lock.Lock()
+			errs[n] = err
+			lock.Unlock()
+		}(n, c, reqs[n])
+	}
+	wg.Wait()
+
+	for n, err := range errs {
+		if err != nil {
+			failed[n] = h.check(n, err)
+		}
+	}
+	return failed
+}
+
+// partial handles the nodes that failed during a multi-key get. If the group answers their keys
+// as misses, miss is called with the position of each key that wasn't answered yet; otherwise one
+// of the errors is returned.
+func (h *Handler) partial(failed map[int]error, idx map[int][]int, answered []int, miss func(i int)) error {
+	var err error
+	for n, e := range failed {
+		if !h.g.missFailed {
+			err = e
+			continue
+		}
+		if answered[n] >= len(idx[n]) {
+			continue
+		}
+		for _, i := range idx[n][answered[n]:] {
+			metrics.IncCounter(h.g.partialMisses)
+			miss(i)
+		}
+	}
+	return err
+}
+
+// missFor is the miss a key is answered with when its node fails
+func missFor(cmd common.GetRequest, i int) common.GetResponse {
+	res := common.GetResponse{Key: cmd.Keys[i], Miss: true}
+	if i < len(cmd.Opaques) {
+		res.Opaque = cmd.Opaques[i]
+	}
+	if i < len(cmd.Quiet) {
+		res.Quiet = cmd.Quiet[i]
+	}
+	return res
+}
+
+func missForE(cmd common.GetRequest, i int) common.GetEResponse {
+	m := missFor(cmd, i)
+	return common.GetEResponse{Key: m.Key, Opaque: m.Opaque, Miss: true, Quiet: m.Quiet}
+}
+
+// Get asks every node that owns some of the keys at once. When one node owns all of them its
+// responses are passed straight through; otherwise they're collected and sent in the order the
+// keys were asked for. If some of the nodes fail, the keys they didn't answer are either misses or
+// the whole get fails, depending on the group's PartialFailures.
+func (h *Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	reqs, idx := h.split(cmd)
+
+	dataOut := make(chan common.GetResponse, len(cmd.Keys))
+	errorOut := make(chan error, 1)
+
+	go func() {
+		defer close(dataOut)
+		defer close(errorOut)
+
+		res := make([]common.GetResponse, len(cmd.Keys))
+		found := make([]bool, len(cmd.Keys))
+		// how many of each node's keys it answered, each only written by the node's own goroutine
+		answered := make([]int, len(h.g.nodes))
+
+		failed := h.fanOut(reqs, func(n int, c handlers.Handler, req common.GetRequest) error {
+			resChan, errChan := c.Get(req)
+			if len(reqs) == 1 {
+				return handlers.DrainGet(resChan, errChan, func(r common.GetResponse) error {
+					answered[n]++
+					dataOut <- r
+					return nil
+				})
+			}
+
+			// Each node answers its keys in order
+			return handlers.DrainGet(resChan, errChan, func(r common.GetResponse) error {
+				if j := answered[n]; j < len(idx[n]) {
+					res[idx[n][j]], found[idx[n][j]] = r, true
+					answered[n]++
+				}
+				return nil
+			})
+		})
+
+		miss := func(i int) { res[i], found[i] = missFor(cmd, i), true }
+		if len(reqs) == 1 {
+			miss = func(i int) { dataOut <- missFor(cmd, i) }
+		}
+		err := h.partial(failed, idx, answered, miss)
+
+		for i := range res {
+			if found[i] {
+				dataOut <- res[i]
+			}
+		}
+		if err != nil {
+			errorOut <- err
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+func (h *Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	reqs, idx := h.split(cmd)
+
+	dataOut := make(chan common.GetEResponse, len(cmd.Keys))
+	errorOut := make(chan error, 1)
+
+	go func() {
+		defer close(dataOut)
+		defer close(errorOut)
+
+		res := make([]common.GetEResponse, len(cmd.Keys))
+		found := make([]bool, len(cmd.Keys))
+		// how many of each node's keys it answered, each only written by the node's own goroutine
+		answered := make([]int, len(h.g.nodes))
+
+		failed := h.fanOut(reqs, func(n int, c handlers.Handler, req common.GetRequest) error {
+			resChan, errChan := c.GetE(req)
+			if len(reqs) == 1 {
+				return handlers.DrainGetE(resChan, errChan, func(r common.GetEResponse) error {
+					answered[n]++
+					dataOut <- r
+					return nil
+				})
+			}
+
+			return handlers.DrainGetE(resChan, errChan, func(r common.GetEResponse) error {
+				if j := answered[n]; j < len(idx[n]) {
+					res[idx[n][j]], found[idx[n][j]] = r, true
+					answered[n]++
+				}
+				return nil
+			})
+		})
+
+		miss := func(i int) { res[i], found[i] = missForE(cmd, i), true }
+		if len(reqs) == 1 {
+			miss = func(i int) { dataOut <- missForE(cmd, i) }
+		}
+		err := h.partial(failed, idx, answered, miss)
+
+		for i := range res {
+			if found[i] {
+				dataOut <- res[i]
+			}
+		}
+		if err != nil {
+			errorOut <- err
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+// Keys lists the keys of every node
+func (h *Handler) Keys(prefix []byte) ([][]byte, error) {
+	var keys [][]byte
+	for i := range h.g.nodes {
+		c, err := h.conn(i)
+		if err != nil {
+			return nil, err
+		}
+		k, err := handlers.Keys(c, prefix)
+		if err != nil {
+			return nil, h.check(i, err)
+		}
+		keys = append(keys, k...)
+	}
+	return keys, nil
+}
+
+// Flush flushes every node, stopping at the first that fails
+func (h *Handler) Flush(cmd common.FlushRequest) error {
+	for i := range h.g.nodes {
+		c, err := h.conn(i)
+		if err != nil {
+			return err
+		}
+		if err := handlers.Flush(c, cmd); err != nil {
+			return h.check(i, err)
+		}
+	}
+	return nil
+}
+
+// Ping checks every node
+func (h *Handler) Ping() error {
+	for i := range h.g.nodes {
+		c, err := h.conn(i)
+		if err != nil {
+			return err
+		}
+		if err := handlers.Ping(c); err != nil {
+			return h.check(i, err)
+		}
+	}
+	return nil
+}
+
+func (h *Handler) ServerTime() (time.Time, error) {
+	c, err := h.conn(0)
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, err := handlers.ServerTime(c)
+	return t, h.check(0, err)
+}
+
+// Close closes the connections to every node
+func (h *Handler) Close() error {
+	var err error
+	for i, c := range h.conns {
+		if c == nil {
+			continue
+		}
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+		h.conns[i] = nil
+	}
+	return err
+}
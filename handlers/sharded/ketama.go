@@ -0,0 +1,181 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharded
+
+import (
+	"crypto/md5"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// HashFunc hashes a key to a position on a ketama ring
+type HashFunc func(key []byte) uint32
+
+// The key hashes twemproxy supports, as it computes them. Some differ from the usual definitions:
+// fnv1a_64 is done in 32 bits and crc32 keeps only 15 bits, both for compatibility with
+// libmemcached, and bytes over 0x7f are sign extended where twemproxy reads them as signed chars.
+var hashes = map[string]HashFunc{
+	"md5": func(key []byte) uint32 {
+		return ketamaHash(md5.Sum(key), 0)
+	},
+	"fnv1_64": func(key []byte) uint32 {
+		h := uint64(0xcbf29ce484222325)
+		for _, b := range key {
+			h *= 0x100000001b3
+			h ^= uint64(int64(int8(b)))
+		}
+		return uint32(h)
+	},
+	"fnv1a_64": func(key []byte) uint32 {
+		h := uint32(0xcbf29ce484222325 & math.MaxUint32)
+		for _, b := range key {
+			h ^= uint32(int32(int8(b)))
+			h *= 0x100000001b3 & math.MaxUint32
+		}
+		return h
+	},
+	"fnv1_32": func(key []byte) uint32 {
+		h := uint32(2166136261)
+		for _, b := range key {
+			h *= 16777619
+			h ^= uint32(int32(int8(b)))
+		}
+		return h
+	},
+	"fnv1a_32": func(key []byte) uint32 {
+		h := uint32(2166136261)
+		for _, b := range key {
+			h ^= uint32(int32(int8(b)))
+			h *= 16777619
+		}
+		return h
+	},
+	"crc32": func(key []byte) uint32 {
+		return (crc32.ChecksumIEEE(key) >> 16) & 0x7fff
+	},
+	"crc32a": crc32.ChecksumIEEE,
+	"one_at_a_time": func(key []byte) uint32 {
+		var h uint32
+		for _, b := range key {
+			h += uint32(int32(int8(b)))
+			h += h << 10
+			h ^= h >> 6
+		}
+		h += h << 3
+		h ^= h >> 11
+		h += h << 15
+		return h
+	},
+}
+
+// Hash returns the twemproxy key hash with the given name: md5, fnv1_64, fnv1a_64 (twemproxy's
+// default), fnv1_32, fnv1a_32, crc32, crc32a, or one_at_a_time
+func Hash(name string) (HashFunc, error) {
+	if h, ok := hashes[name]; ok {
+		return h, nil
+	}
+	return nil, fmt.Errorf("Unknown hash %q", name)
+}
+
+// ketamaHash is the 32-bit little endian word of an MD5 digest at the given index, 0 to 3
+func ketamaHash(sum [16]byte, idx int) uint32 {
+	return uint32(sum[3+idx*4])<<24 | uint32(sum[2+idx*4])<<16 | uint32(sum[1+idx*4])<<8 | uint32(sum[idx*4])
+}
+
+type ketamaPoint struct {
+	value uint32
+	node  int
+}
+
+// ketama is the continuum of libketama as twemproxy builds it
+type ketama struct {
+	points []ketamaPoint
+	hash   HashFunc
+	shares []float64
+}
+
+// NewKetama makes a ring that maps keys to nodes exactly the way twemproxy's ketama distribution
+// does for a pool with the same servers, in the same order, with the same names and weights, so
+// it can take over from twemproxy without moving any keys. That holds as long as twemproxy wasn't
+// ejecting failed hosts (auto_eject_hosts), which changes its ring. Nodes with a weight of 0 own
+// no keys.
+func NewKetama(names []string, weights []int, hash HashFunc) Ring {
+	const pointsPerServer = 160
+
+	live, total := 0, 0
+	for _, w := range weights {
+		if w > 0 {
+			live++
+			total += w
+		}
+	}
+
+	k := &ketama{
+		hash:   hash,
+		shares: make([]float64, len(names)),
+	}
+
+	for i, name := range names {
+		if weights[i] <= 0 {
+			continue
+		}
+
+		// twemproxy figures this in single precision floats, except for the tiny double that's
+		// added before rounding down, and the result has to match to the point
+		pct := float32(weights[i]) / float32(total)
+		perServer := int(math.Floor(float64(float32(float64(pct*pointsPerServer/4*float32(live))+0.0000000001)))) * 4
+
+		for j := 0; j < perServer/4; j++ {
+			sum := md5.Sum([]byte(name + "-" + strconv.Itoa(j)))
+			for x := 0; x < 4; x++ {
+				k.points = append(k.points, ketamaPoint{ketamaHash(sum, x), i})
+			}
+		}
+	}
+
+	// Ties are vanishingly rare, and twemproxy's qsort leaves them in no particular order anyway
+	sort.SliceStable(k.points, func(i, j int) bool { return k.points[i].value < k.points[j].value })
+
+	for i, p := range k.points {
+		prev := uint32(0)
+		if i > 0 {
+			prev = k.points[i-1].value
+		}
+		k.shares[p.node] += float64(p.value-prev) / (1 << 32)
+	}
+	if len(k.points) > 0 {
+		k.shares[k.points[0].node] += float64(math.MaxUint32-k.points[len(k.points)-1].value) / (1 << 32)
+	}
+
+	return k
+}
+
+func (k *ketama) Owner(key []byte) int {
+	h := k.hash(key)
+
+	// the first point at or after the hash, wrapping around to the start
+	idx := sort.Search(len(k.points), func(i int) bool { return k.points[i].value >= h })
+	if idx == len(k.points) {
+		idx = 0
+	}
+	return k.points[idx].node
+}
+
+func (k *ketama) Shares() []float64 {
+	return k.shares
+}
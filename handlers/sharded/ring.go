@@ -0,0 +1,137 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharded
+
+import (
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Ring decides which node owns each key. Implementations are read only once made, so they can be
+// shared by every connection.
+type Ring interface {
+	// Owner returns the index of the node that owns the key
+	Owner(key []byte) int
+	// Shares returns the fraction of the key space each node owns, by index
+	Shares() []float64
+}
+
+const (
+	// points on the ring for each unit of a node's weight
+	pointsPerWeight = 160
+
+	// the key space is split into 2^partitionBits partitions for bounded loads
+	partitionBits = 14
+	partitions    = 1 << partitionBits
+)
+
+// hash64 is 64-bit FNV-1a with a finalizer mixed in, since FNV alone spreads similar short strings
+// like the names of ring points poorly
+func hash64(b []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(b)
+	x := h.Sum64()
+
+	// from MurmurHash3's fmix64
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+type point struct {
+	hash uint64
+	node int
+}
+
+// bounded is consistent hashing with bounded loads. Each node gets points on a ring in proportion
+// to its weight. The key space is split into fixed partitions, and each partition belongs to the
+// owner of the first point after its start, unless that node already has its limit of
+// partitions, in which case it goes to the next node around the ring that doesn't. A node's limit
+// is its fair share, by weight, times the load bound, so no node ends up with much more than its
+// share of keys from an unlucky spread of points, while membership changes still move few keys.
+type bounded struct {
+	owners []int
+	shares []float64
+}
+
+// NewBounded makes a ring over nodes with the given weights. A loadBound of at least 1 caps every
+// node at that multiple of its fair share of the key space, e.g. 1.25 for at most 25% over; 0
+// doesn't cap them, which is plain weighted consistent hashing. Nodes with a weight of 0 own no
+// keys. At least one weight must be positive.
+func NewBounded(names []string, weights []int, loadBound float64) Ring {
+	var points []point
+	total := 0
+	for i, name := range names {
+		total += weights[i]
+		for j := 0; j < weights[i]*pointsPerWeight; j++ {
+			points = append(points, point{hash64([]byte(name + "-" + strconv.Itoa(j))), i})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].node < points[j].node
+	})
+
+	limits := make([]int, len(names))
+	for i := range limits {
+		limits[i] = partitions
+		if loadBound > 0 {
+			limits[i] = int(math.Ceil(loadBound * partitions * float64(weights[i]) / float64(total)))
+		}
+	}
+
+	b := &bounded{
+		owners: make([]int, partitions),
+		shares: make([]float64, len(names)),
+	}
+
+	counts := make([]int, len(names))
+	for p := range b.owners {
+		start := uint64(p) << (64 - partitionBits)
+		idx := sort.Search(len(points), func(i int) bool { return points[i].hash >= start })
+
+		// The limits add up to more than the number of partitions, so some node always has room
+		for {
+			n := points[idx%len(points)].node
+			if counts[n] < limits[n] {
+				b.owners[p] = n
+				counts[n]++
+				break
+			}
+			idx++
+		}
+	}
+
+	for i, c := range counts {
+		b.shares[i] = float64(c) / partitions
+	}
+
+	return b
+}
+
+func (b *bounded) Owner(key []byte) int {
+	return b.owners[hash64(key)>>(64-partitionBits)]
+}
+
+func (b *bounded) Shares() []float64 {
+	return b.shares
+}
@@ -0,0 +1,222 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sharded spreads keys over several backends that each hold part of the data, using a
+// consistent hash so adding or removing a node only moves the keys it gains or loses. Nodes are
+// weighted, e.g. by how much memory they have, and get a share of the keys in proportion to their
+// weight. Requests for a single key go to the node that owns it; gets for many keys are split up
+// by node and sent to all of them at once.
+package sharded
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+// Node is one backend holding a share of the keys
+type Node struct {
+	// Name places the node on the ring, so it should stay the same when the node is replaced to
+	// keep its keys
+	Name    string
+	Weight  int
+	Handler handlers.HandlerConst
+}
+
+// Backend makes the handler for the node at the given address
+type Backend func(addr string) (handlers.HandlerConst, error)
+
+// ParseNodes parses a comma separated list of nodes in the same form as the servers of a
+// twemproxy (nutcracker) pool: the address, a colon and the weight, then optionally a space and a
+// name, e.g. "10.0.0.1:11211:2 cache1,10.0.0.2:11211:1 cache2". The address is a host:port or
+// the path of a unix domain socket and is given to backend to connect to it.
+//
+// A node without a name is named after its address, leaving out the port when it's the default
+// memcached port of 11211, which is how twemproxy and libmemcached name them too.
+func ParseNodes(s string, backend Backend) ([]Node, error) {
+	var nodes []Node
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+
+		var name string
+		if idx := strings.IndexByte(part, ' '); idx >= 0 {
+			part, name = part[:idx], strings.TrimSpace(part[idx+1:])
+		}
+
+		idx := strings.LastIndexByte(part, ':')
+		if idx <= 0 {
+			return nil, fmt.Errorf("Invalid node %q, expected address:weight", part)
+		}
+		addr := part[:idx]
+		weight, err := strconv.Atoi(part[idx+1:])
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("Invalid weight in node %q", part)
+		}
+
+		if name == "" {
+			name = strings.TrimSuffix(addr, ":11211")
+		}
+
+		hc, err := backend(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		nodes = append(nodes, Node{Name: name, Weight: weight, Handler: hc})
+	}
+
+	return nodes, nil
+}
+
+// Config says how keys are spread over the nodes
+type Config struct {
+	// LoadBound is the most keys a node gets as a multiple of its fair share by weight, e.g. 1.25
+	// for at most 25% more. 0 doesn't bound them.
+	LoadBound float64
+
+	// Distribution is how keys are placed on the ring: "bounded" (the default) for the ring above,
+	// or "ketama" to place them exactly as twemproxy's ketama distribution does, see NewKetama.
+	// The load bound doesn't apply to ketama.
+	Distribution string
+
+	// Hash is the twemproxy key hash used by the ketama distribution, fnv1a_64 by default
+	Hash string
+
+	// HashTag is two characters, like twemproxy's hash_tag, that mark the part of a key that's
+	// hashed when a key contains both, e.g. "{}" puts user{1}:name and user{1}:email on the
+	// same node. Empty hashes whole keys.
+	HashTag string
+
+	// PartialFailures is what a multi-key get does when some of the nodes it asks fail: "error"
+	// (the default) fails the whole get, and "miss" answers the keys of the failed nodes as misses
+	// so the keys on healthy nodes are still served.
+	PartialFailures string
+}
+
+// Group is a set of nodes and the ring that spreads keys over them, shared by all connections
+type Group struct {
+	nodes []Node
+	ring  Ring
+	tag   string
+
+	missFailed    bool
+	partialMisses uint32
+
+	// per node
+	getHists  []uint32
+	getErrors []uint32
+}
+
+// New makes a group of the given nodes
+func New(conf Config, nodes []Node) (*Group, error) {
+	if conf.LoadBound != 0 && conf.LoadBound < 1 {
+		return nil, errors.New("The load bound must be at least 1, or 0 for none")
+	}
+	if conf.HashTag != "" && len(conf.HashTag) != 2 {
+		return nil, errors.New("The hash tag must be two characters")
+	}
+	switch conf.PartialFailures {
+	case "", "error", "miss":
+	default:
+		return nil, fmt.Errorf("Unknown partial failure policy %q, expected error or miss", conf.PartialFailures)
+	}
+
+	names := make([]string, len(nodes))
+	weights := make([]int, len(nodes))
+	total := 0
+	seen := make(map[string]struct{}, len(nodes))
+	for i, n := range nodes {
+		if _, dup := seen[n.Name]; dup {
+			return nil, fmt.Errorf("Two nodes are named %s", n.Name)
+		}
+		seen[n.Name] = struct{}{}
+
+		names[i], weights[i] = n.Name, n.Weight
+		total += n.Weight
+	}
+	if total == 0 {
+		return nil, errors.New("At least one node needs a weight above 0")
+	}
+
+	g := &Group{
+		nodes:         nodes,
+		tag:           conf.HashTag,
+		missFailed:    conf.PartialFailures == "miss",
+		partialMisses: metrics.AddCounter("shard_get_partial_misses", nil),
+		getHists:      make([]uint32, len(nodes)),
+		getErrors:     make([]uint32, len(nodes)),
+	}
+
+	switch conf.Distribution {
+	case "", "bounded":
+		g.ring = NewBounded(names, weights, conf.LoadBound)
+	case "ketama":
+		name := conf.Hash
+		if name == "" {
+			name = "fnv1a_64"
+		}
+		hash, err := Hash(name)
+		if err != nil {
+			return nil, err
+		}
+		g.ring = NewKetama(names, weights, hash)
+	default:
+		return nil, fmt.Errorf("Unknown distribution %q, expected bounded or ketama", conf.Distribution)
+	}
+
+	for i, share := range g.ring.Shares() {
+		tags := metrics.Tags{"shard": nodes[i].Name}
+		metrics.SetFloatGauge(metrics.AddFloatGauge("shard_key_share", tags), share)
+		g.getHists[i] = metrics.AddHistogram("shard_get", false, tags)
+		g.getErrors[i] = metrics.AddCounter("shard_get_errors", tags)
+	}
+
+	return g, nil
+}
+
+// Owner returns the name of the node that owns the key
+func (g *Group) Owner(key []byte) string {
+	return g.nodes[g.owner(key)].Name
+}
+
+// owner returns the index of the node that owns the key. With a hash tag, only the part of the key
+// between the first opening character and the closing one after it is hashed, as long as it isn't
+// empty, which is how twemproxy does it.
+func (g *Group) owner(key []byte) int {
+	if g.tag != "" {
+		if start := bytes.IndexByte(key, g.tag[0]); start >= 0 {
+			if end := bytes.IndexByte(key[start+1:], g.tag[1]); end > 0 {
+				return g.ring.Owner(key[start+1 : start+1+end])
+			}
+		}
+	}
+	return g.ring.Owner(key)
+}
+
+// HandlerConst returns a constructor for handlers that use the group. Each one connects to a node
+// the first time it's used.
+func (g *Group) HandlerConst() handlers.HandlerConst {
+	return func() (handlers.Handler, error) {
+		return &Handler{
+			g:     g,
+			conns: make([]handlers.Handler, len(g.nodes)),
+		}, nil
+	}
+}
@@ -0,0 +1,389 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharded_test
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/sharded"
+)
+
+func TestBounded(t *testing.T) {
+	names := []string{"small", "medium", "large", "large2"}
+	weights := []int{1, 2, 4, 4}
+
+	for _, bound := range []float64{0, 1.1, 1.25} {
+		r := sharded.NewBounded(names, weights, bound)
+
+		for i, share := range r.Shares() {
+			fair := float64(weights[i]) / 11
+			if bound > 0 && share > fair*bound+0.001 {
+				t.Errorf("Bound %v: %s has %.3f of the keys, more than %.3f", bound, names[i], share, fair*bound)
+			}
+			// Even unbounded, the shares should be in the neighborhood of the weights
+			if math.Abs(share-fair) > fair*0.3 {
+				t.Errorf("Bound %v: %s has %.3f of the keys, expected about %.3f", bound, names[i], share, fair)
+			}
+		}
+
+		// Keys land where the shares say
+		counts := make([]int, len(names))
+		for k := 0; k < 100000; k++ {
+			counts[r.Owner([]byte(fmt.Sprintf("key%d", k)))]++
+		}
+		for i, c := range counts {
+			if got, expected := float64(c)/100000, r.Shares()[i]; math.Abs(got-expected) > 0.02 {
+				t.Errorf("Bound %v: %s got %.3f of the keys, expected %.3f", bound, names[i], got, expected)
+			}
+		}
+	}
+}
+
+func TestBoundedMovesFewKeys(t *testing.T) {
+	before := sharded.NewBounded([]string{"a", "b", "c", "d"}, []int{1, 1, 1, 1}, 1.25)
+	after := sharded.NewBounded([]string{"a", "b", "c", "d", "e"}, []int{1, 1, 1, 1, 1}, 1.25)
+
+	moved := 0
+	for k := 0; k < 100000; k++ {
+		key := []byte(fmt.Sprintf("key%d", k))
+		if b, a := before.Owner(key), after.Owner(key); b != a && a != 4 {
+			moved++
+		}
+	}
+
+	// Only keys moving to the new node need to move, plus a few from the load bound
+	if float64(moved)/100000 > 0.05 {
+		t.Fatalf("%d of 100000 keys moved between existing nodes", moved)
+	}
+}
+
+// mapHandler is just enough of a handler to tell which node has which keys
+type mapHandler struct {
+	sync.Mutex
+	data map[string]string
+	// fail makes gets answer their first key and then fail with it
+	fail error
+}
+
+func (m *mapHandler) Set(cmd common.SetRequest) error {
+	m.Lock()
+	defer m.Unlock()
+	m.data[string(cmd.Key)] = string(cmd.Data)
+	return nil
+}
+
+func (m *mapHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	resChan := make(chan common.GetResponse, len(cmd.Keys))
+	errChan := make(chan error, 1)
+	defer close(resChan)
+	defer close(errChan)
+
+	m.Lock()
+	defer m.Unlock()
+	for i, k := range cmd.Keys {
+		if m.fail != nil && i > 0 {
+			errChan <- m.fail
+			break
+		}
+		v, ok := m.data[string(k)]
+		resChan <- common.GetResponse{Key: k, Data: []byte(v), Miss: !ok, Opaque: cmd.Opaques[i], Quiet: cmd.Quiet[i]}
+	}
+	return resChan, errChan
+}
+
+func (m *mapHandler) Add(cmd common.SetRequest) error     { return common.ErrItemNotStored }
+func (m *mapHandler) Replace(cmd common.SetRequest) error { return common.ErrItemNotStored }
+func (m *mapHandler) Append(cmd common.SetRequest) error  { return common.ErrItemNotStored }
+func (m *mapHandler) Prepend(cmd common.SetRequest) error { return common.ErrItemNotStored }
+func (m *mapHandler) Delete(cmd common.DeleteRequest) error {
+	return common.ErrKeyNotFound
+}
+func (m *mapHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	return nil, nil
+}
+func (m *mapHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	return common.GetResponse{Miss: true}, nil
+}
+func (m *mapHandler) Touch(cmd common.TouchRequest) error { return nil }
+func (m *mapHandler) Close() error                        { return nil }
+
+func TestHandler(t *testing.T) {
+	backends := make(map[string]*mapHandler)
+	nodes, err := sharded.ParseNodes("10.0.0.1:11211:1 one,10.0.0.2:11211:1,/tmp/three.sock:2", func(addr string) (handlers.HandlerConst, error) {
+		m := &mapHandler{data: make(map[string]string)}
+		backends[addr] = m
+		return func() (handlers.Handler, error) { return m, nil }, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{"one", "10.0.0.2", "/tmp/three.sock"}
+	for i, n := range nodes {
+		if n.Name != names[i] {
+			t.Errorf("Node %d: expected name %s, got %s", i, names[i], n.Name)
+		}
+	}
+
+	g, err := sharded.New(sharded.Config{LoadBound: 1.25}, nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, _ := g.HandlerConst()()
+
+	req := common.GetRequest{}
+	for k := 0; k < 100; k++ {
+		key := []byte(fmt.Sprintf("key%d", k))
+		if err := h.Set(common.SetRequest{Key: key, Data: key}); err != nil {
+			t.Fatal(err)
+		}
+		req.Keys = append(req.Keys, key)
+		req.Opaques = append(req.Opaques, uint32(k))
+		req.Quiet = append(req.Quiet, false)
+	}
+
+	// Each key is only on its owner
+	addrs := map[string]string{"one": "10.0.0.1:11211", "10.0.0.2": "10.0.0.2:11211", "/tmp/three.sock": "/tmp/three.sock"}
+	for _, key := range req.Keys {
+		for addr, m := range backends {
+			_, ok := m.data[string(key)]
+			if owner := addrs[g.Owner(key)] == addr; ok != owner {
+				t.Fatalf("Key %s on %s: %v, owner %v", key, addr, ok, owner)
+			}
+		}
+	}
+
+	// A get across every node answers in order
+	req.Keys = append(req.Keys, []byte("missing"))
+	req.Opaques = append(req.Opaques, 100)
+	req.Quiet = append(req.Quiet, false)
+
+	resChan, errChan := h.Get(req)
+	i := 0
+	for res := range resChan {
+		if res.Opaque != uint32(i) || string(res.Key) != string(req.Keys[i]) {
+			t.Fatalf("Response %d out of order: %s %d", i, res.Key, res.Opaque)
+		}
+		if miss := i == 100; res.Miss != miss || (!miss && string(res.Data) != string(res.Key)) {
+			t.Fatalf("Unexpected response %d: %+v", i, res)
+		}
+		i++
+	}
+	if err := <-errChan; err != nil || i != len(req.Keys) {
+		t.Fatalf("Expected %d responses and no error, got %d %v", len(req.Keys), i, err)
+	}
+
+	if _, err := sharded.New(sharded.Config{LoadBound: 0.5}, nodes); err == nil {
+		t.Fatal("Expected a load bound under 1 to fail")
+	}
+	for _, bad := range []string{"10.0.0.1:11211:x", "10.0.0.1:11211:-1", ":1"} {
+		if _, err := sharded.ParseNodes(bad, nil); err == nil {
+			t.Errorf("Expected node %q to fail", bad)
+		}
+	}
+}
+
+func TestHashes(t *testing.T) {
+	tests := []struct {
+		hash string
+		key  string
+		want uint32
+	}{
+		{"md5", "", 0xd98c1dd4},
+		{"fnv1_64", "a", 0x8601b7be},
+		{"fnv1a_64", "a", 0x8601ec8c},
+		{"fnv1_32", "a", 0x050c5d7e},
+		{"fnv1a_32", "a", 0xe40c292c},
+		{"fnv1a_32", "\xff", 0xf9f3a14e},
+		{"crc32", "a", 0x68b7},
+		{"crc32a", "a", 0xe8b7be43},
+		{"one_at_a_time", "a", 0xca2e9442},
+	}
+
+	for _, test := range tests {
+		h, err := sharded.Hash(test.hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := h([]byte(test.key)); got != test.want {
+			t.Errorf("%s(%q) = %#x, want %#x", test.hash, test.key, got, test.want)
+		}
+	}
+
+	if _, err := sharded.Hash("hsieh"); err == nil {
+		t.Error("Expected an unsupported hash to fail")
+	}
+}
+
+func TestKetama(t *testing.T) {
+	names := []string{"10.0.0.1", "10.0.0.2:11212", "cache3"}
+	weights := []int{1, 2, 3}
+
+	md5, _ := sharded.Hash("md5")
+	r := sharded.NewKetama(names, weights, md5)
+
+	// as placed by twemproxy's ketama continuum
+	want := []int{1, 2, 2, 2, 2, 2, 1, 0, 2, 2, 1, 0, 1, 2, 0, 0, 0, 2, 1, 2}
+	for k, w := range want {
+		if got := r.Owner([]byte(fmt.Sprintf("key%d", k))); got != w {
+			t.Errorf("key%d went to %d, want %d", k, got, w)
+		}
+	}
+
+	fnv, _ := sharded.Hash("fnv1a_64")
+	r = sharded.NewKetama(names, weights, fnv)
+	keys := []string{"foo", "bar", "baz", "qux", "hello", "world", "rend", "memcached"}
+	want = []int{1, 1, 1, 2, 2, 2, 2, 1}
+	for i, key := range keys {
+		if got := r.Owner([]byte(key)); got != want[i] {
+			t.Errorf("%s went to %d, want %d", key, got, want[i])
+		}
+	}
+
+	sum := 0.0
+	for i, share := range r.Shares() {
+		if fair := float64(weights[i]) / 6; math.Abs(share-fair) > 0.1 {
+			t.Errorf("%s has %.3f of the keys, expected about %.3f", names[i], share, fair)
+		}
+		sum += share
+	}
+	if math.Abs(sum-1) > 1e-9 {
+		t.Errorf("Shares add up to %f", sum)
+	}
+
+	// With equal weights the other nodes' points stay put, so only the removed node's keys move
+	before := sharded.NewKetama([]string{"a", "b", "c", "d"}, []int{1, 1, 1, 1}, md5)
+	after := sharded.NewKetama([]string{"a", "b", "c"}, []int{1, 1, 1}, md5)
+	for k := 0; k < 10000; k++ {
+		key := []byte(fmt.Sprintf("key%d", k))
+		if b, a := before.Owner(key), after.Owner(key); b != 3 && b != a {
+			t.Fatalf("%s moved from %d to %d", key, b, a)
+		}
+	}
+}
+
+func TestHashTag(t *testing.T) {
+	nodes := make([]sharded.Node, 8)
+	for i := range nodes {
+		nodes[i] = sharded.Node{Name: fmt.Sprintf("node%d", i), Weight: 1}
+	}
+
+	g, err := sharded.New(sharded.Config{Distribution: "ketama", HashTag: "{}"}, nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	untagged, err := sharded.New(sharded.Config{Distribution: "ketama"}, nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		user := fmt.Sprintf("user%d", i)
+		if a, b := g.Owner([]byte("{"+user+"}:name")), g.Owner([]byte("x:{"+user+"}:email")); a != b {
+			t.Fatalf("%s is split over %s and %s", user, a, b)
+		}
+		if a, b := g.Owner([]byte(user)), g.Owner([]byte("{"+user+"}")); a != b {
+			t.Fatalf("%s went to %s untagged and %s tagged", user, a, b)
+		}
+		// an empty tag hashes the whole key
+		if a, b := g.Owner([]byte("{}"+user)), untagged.Owner([]byte("{}"+user)); a != b {
+			t.Fatalf("{}%s went to %s, not %s", user, a, b)
+		}
+	}
+
+	if _, err := sharded.New(sharded.Config{HashTag: "{"}, nodes); err == nil {
+		t.Error("Expected a one character hash tag to fail")
+	}
+	if _, err := sharded.New(sharded.Config{Distribution: "modula"}, nodes); err == nil {
+		t.Error("Expected an unknown distribution to fail")
+	}
+}
+
+func TestPartialFailures(t *testing.T) {
+	var backends []*mapHandler
+	nodes, err := sharded.ParseNodes("10.0.0.1:11211:1,10.0.0.2:11211:1,10.0.0.3:11211:1", func(addr string) (handlers.HandlerConst, error) {
+		m := &mapHandler{data: make(map[string]string)}
+		backends = append(backends, m)
+		if addr == "10.0.0.3:11211" {
+			return func() (handlers.Handler, error) { return nil, errors.New("refused") }, nil
+		}
+		return func() (handlers.Handler, error) { return m, nil }, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(policy string, keys int) ([]common.GetResponse, error) {
+		g, err := sharded.New(sharded.Config{PartialFailures: policy}, nodes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, _ := g.HandlerConst()()
+
+		req := common.GetRequest{}
+		for k := 0; k < keys; k++ {
+			key := []byte(fmt.Sprintf("key%d", k))
+			// the unreachable node can't be written to
+			h.Set(common.SetRequest{Key: key, Data: key})
+			req.Keys = append(req.Keys, key)
+			req.Opaques = append(req.Opaques, uint32(k))
+			req.Quiet = append(req.Quiet, k%2 == 0)
+		}
+
+		var res []common.GetResponse
+		resChan, errChan := h.Get(req)
+		for r := range resChan {
+			res = append(res, r)
+		}
+		return res, <-errChan
+	}
+
+	// The second node answers one key and fails, the third can't be reached
+	backends[1].fail = errors.New("broken")
+
+	if _, err := get("error", 100); err == nil {
+		t.Fatal("Expected the get to fail")
+	}
+
+	// Keys on the healthy node are served and the rest are misses, still in order
+	for _, keys := range []int{1, 100} {
+		res, err := get("miss", keys)
+		if err != nil || len(res) != keys {
+			t.Fatalf("Expected %d responses and no error, got %d %v", keys, len(res), err)
+		}
+		hits := 0
+		for i, r := range res {
+			if r.Opaque != uint32(i) || string(r.Key) != fmt.Sprintf("key%d", i) || r.Quiet != (i%2 == 0) {
+				t.Fatalf("Response %d out of order: %+v", i, r)
+			}
+			if !r.Miss {
+				hits++
+			}
+		}
+		if keys == 100 && (hits == 0 || hits == keys) {
+			t.Fatalf("Expected some but not all of the keys to be hits, got %d", hits)
+		}
+	}
+
+	if _, err := sharded.New(sharded.Config{PartialFailures: "retry"}, nodes); err == nil {
+		t.Error("Expected an unknown partial failure policy to fail")
+	}
+}
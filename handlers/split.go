@@ -0,0 +1,391 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricSplitGets        = metrics.AddCounter("split_gets", nil)
+	MetricSplitGetBatches  = metrics.AddCounter("split_get_batches", nil)
+	MetricSplitConnErrors  = metrics.AddCounter("split_get_conn_errors", nil)
+	MetricSplitConnsOpened = metrics.AddCounter("split_get_conns_opened", nil)
+)
+
+// SplitPolicy bounds the gets sent to a backend at once, so one client's enormous multiget doesn't
+// hold a backend connection for as long as it takes to answer all of it
+type SplitPolicy struct {
+	// MaxKeys is the most keys sent to the backend in one get. Gets with more keys are split into
+	// batches of this many. 0 disables splitting.
+	MaxKeys int
+	// Parallel is the most batches of one get in flight at once, each on a backend connection of
+	// its own. The extra connections are made the first time they're needed and kept for the
+	// handler's lifetime. 1 or less sends the batches one after the other.
+	Parallel int
+}
+
+// Split wraps the handlers made by hc so the gets they're given are split by p. Responses come back
+// in the order the keys were asked for, as if the get had been sent whole; a batch that fails
+// ends the get after the responses to the batches before it.
+func Split(hc HandlerConst, p SplitPolicy) HandlerConst {
+	if p.MaxKeys <= 0 {
+		return hc
+	}
+	if p.Parallel < 1 {
+		p.Parallel = 1
+	}
+
+	return func() (Handler, error) {
+		h, err := hc()
+		if err != nil {
+			return nil, err
+		}
+		conns := make([]Handler, p.Parallel)
+		conns[0] = h
+		return &splitHandler{Handler: h, hc: hc, p: p, conns: conns}, nil
+	}
+}
+
+type splitHandler struct {
+	Handler
+	hc HandlerConst
+	p  SplitPolicy
+
+	// conns[0] is the wrapped handler, the rest are made as they're needed
+	conns []Handler
+}
+
+// batch is one batch of a split get: the backend ran it, and replay passes its responses on
+type batch struct {
+	replay func() error
+	err    error
+}
+
+// run splits cmd into batches and runs get for each of them, MaxKeys at a time and up to Parallel
+// at once. The batches are replayed in order as soon as every one before them has been, and get
+// is called with the connection to use. After a batch fails nothing else is started, and when run
+// returns none of the connections are in use anymore.
+func (h *splitHandler) run(cmd common.GetRequest, get func(c Handler, cmd common.GetRequest) batch) error {
+	batches := h.split(cmd)
+	metrics.IncCounter(MetricSplitGets)
+	metrics.IncCounterBy(MetricSplitGetBatches, uint64(len(batches)))
+
+	workers := h.connect(len(batches))
+	results := make([]chan batch, len(batches))
+	for i := range results {
+		results[i] = make(chan batch, 1)
+	}
+
+	var stopped int32
+	jobs := make(chan int, len(batches))
+	errs := make([]error, workers)
+	wg := new(sync.WaitGroup)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := range jobs {
+				if atomic.LoadInt32(&stopped) == 1 {
+					results[i] <- batch{}
+					continue
+				}
+				b := get(h.conns[w], batches[i])
+				if b.err != nil {
+					errs[w] = b.err
+				}
+				results[i] <- b
+			}
+		}(w)
+	}
+
+	// Batches are only handed out as far as a batch per worker past the one being replayed, so the
+	// responses held for reassembly stay bounded by Parallel batches
+	queued := 0
+	var err error
+	for i := 0; i < len(batches); i++ {
+		for err == nil && queued < len(batches) && queued < i+workers {
+			jobs <- queued
+			queued++
+		}
+		if i >= queued {
+			break
+		}
+
+		b := <-results[i]
+		if err != nil {
+			continue
+		}
+		if b.replay != nil {
+			err = b.replay()
+		}
+		if err == nil {
+			err = b.err
+		}
+		if err != nil {
+			atomic.StoreInt32(&stopped, 1)
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	// Extra connections that broke are made again next time
+	for w := 1; w < workers; w++ {
+		if errs[w] != nil && common.ClassOf(errs[w]) == common.ClassFatal {
+			h.conns[w].Close()
+			h.conns[w] = nil
+		}
+	}
+
+	return err
+}
+
+// split cuts cmd into gets of at most MaxKeys keys, with their opaques and quiet flags
+func (h *splitHandler) split(cmd common.GetRequest) []common.GetRequest {
+	var res []common.GetRequest
+	for start := 0; start < len(cmd.Keys); start += h.p.MaxKeys {
+		end := start + h.p.MaxKeys
+		if end > len(cmd.Keys) {
+			end = len(cmd.Keys)
+		}
+
+		b := common.GetRequest{
+			Keys:       cmd.Keys[start:end],
+			NoopOpaque: cmd.NoopOpaque,
+			NoopEnd:    cmd.NoopEnd,
+		}
+		if len(cmd.Opaques) >= end {
+			b.Opaques = cmd.Opaques[start:end]
+		}
+		if len(cmd.Quiet) >= end {
+			b.Quiet = cmd.Quiet[start:end]
+		}
+		res = append(res, b)
+	}
+	return res
+}
+
+// connect makes sure there are connections for as many workers as the batches can use, and
+// returns how many there are. A connection that can't be made leaves fewer workers.
+func (h *splitHandler) connect(batches int) int {
+	want := h.p.Parallel
+	if batches < want {
+		want = batches
+	}
+
+	n := 1
+	for i := 1; i < want; i++ {
+		if h.conns[i] == nil {
+			c, err := h.hc()
+			if err != nil || c == nil {
+				metrics.IncCounter(MetricSplitConnErrors)
+				continue
+			}
+			metrics.IncCounter(MetricSplitConnsOpened)
+			h.conns[i] = c
+		}
+		// keep the connections in use at the front
+		h.conns[n], h.conns[i] = h.conns[i], h.conns[n]
+		n++
+	}
+	return n
+}
+
+func (h *splitHandler) large(cmd common.GetRequest) bool {
+	return len(cmd.Keys) > h.p.MaxKeys
+}
+
+func (h *splitHandler) GetEach(cmd common.GetRequest, f func(common.GetResponse) error) error {
+	if !h.large(cmd) {
+		return GetEach(h.Handler, cmd, f)
+	}
+	return h.run(cmd, func(c Handler, cmd common.GetRequest) batch {
+		var res []common.GetResponse
+		err := GetEach(c, cmd, func(r common.GetResponse) error {
+			// the data is only ours until we return, and this is replayed later
+			r.Data = append([]byte(nil), r.Data...)
+			res = append(res, r)
+			return nil
+		})
+		return batch{err: err, replay: func() error {
+			for _, r := range res {
+				if err := f(r); err != nil {
+					return err
+				}
+			}
+			return nil
+		}}
+	})
+}
+
+func (h *splitHandler) GetEEach(cmd common.GetRequest, f func(common.GetEResponse) error) error {
+	if !h.large(cmd) {
+		return GetEEach(h.Handler, cmd, f)
+	}
+	return h.run(cmd, func(c Handler, cmd common.GetRequest) batch {
+		var res []common.GetEResponse
+		err := GetEEach(c, cmd, func(r common.GetEResponse) error {
+			r.Data = append([]byte(nil), r.Data...)
+			res = append(res, r)
+			return nil
+		})
+		return batch{err: err, replay: func() error {
+			for _, r := range res {
+				if err := f(r); err != nil {
+					return err
+				}
+			}
+			return nil
+		}}
+	})
+}
+
+// getChans answers a get through channels with each, like the handler itself would
+func getChans(cmd common.GetRequest, each func(f func(common.GetResponse) error) error) (<-chan common.GetResponse, <-chan error) {
+	dataOut := make(chan common.GetResponse, len(cmd.Keys))
+	errorOut := make(chan error, 1)
+
+	go func() {
+		defer close(dataOut)
+		defer close(errorOut)
+
+		err := each(func(r common.GetResponse) error {
+			dataOut <- r
+			return nil
+		})
+		if err != nil {
+			errorOut <- err
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+func (h *splitHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	if !h.large(cmd) {
+		return h.Handler.Get(cmd)
+	}
+	return getChans(cmd, func(f func(common.GetResponse) error) error { return h.GetEach(cmd, f) })
+}
+
+func (h *splitHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	if !h.large(cmd) {
+		return h.Handler.GetE(cmd)
+	}
+
+	dataOut := make(chan common.GetEResponse, len(cmd.Keys))
+	errorOut := make(chan error, 1)
+
+	go func() {
+		defer close(dataOut)
+		defer close(errorOut)
+
+		err := h.GetEEach(cmd, func(r common.GetEResponse) error {
+			dataOut <- r
+			return nil
+		})
+		if err != nil {
+			errorOut <- err
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+func (h *splitHandler) Gets(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	if !h.large(cmd) {
+		return Gets(h.Handler, cmd)
+	}
+	return getChans(cmd, func(f func(common.GetResponse) error) error {
+		return h.run(cmd, func(c Handler, cmd common.GetRequest) batch {
+			var res []common.GetResponse
+			resChan, errChan := Gets(c, cmd)
+			err := DrainGet(resChan, errChan, func(r common.GetResponse) error {
+				res = append(res, r)
+				return nil
+			})
+			return batch{err: err, replay: func() error {
+				for _, r := range res {
+					if err := f(r); err != nil {
+						return err
+					}
+				}
+				return nil
+			}}
+		})
+	})
+}
+
+func (h *splitHandler) Close() error {
+	for _, c := range h.conns[1:] {
+		if c != nil {
+			c.Close()
+		}
+	}
+	return h.Handler.Close()
+}
+
+func (h *splitHandler) MultiDelete(cmd common.MultiDeleteRequest) []error {
+	return MultiDelete(h.Handler, cmd)
+}
+
+func (h *splitHandler) MultiSet(cmd common.MultiSetRequest) []error {
+	return MultiSet(h.Handler, cmd)
+}
+
+func (h *splitHandler) SetIfMatch(cmd common.SetIfMatchRequest) error {
+	return SetIfMatch(h.Handler, cmd)
+}
+
+func (h *splitHandler) Incr(cmd common.ArithRequest) (uint64, error) {
+	return Incr(h.Handler, cmd)
+}
+
+func (h *splitHandler) Decr(cmd common.ArithRequest) (uint64, error) {
+	return Decr(h.Handler, cmd)
+}
+
+func (h *splitHandler) CompareAndSwap(cmd common.CASRequest) error {
+	return CompareAndSwap(h.Handler, cmd)
+}
+
+func (h *splitHandler) GetLock(cmd common.GetLockRequest) (common.GetLockResponse, error) {
+	return GetLock(h.Handler, cmd)
+}
+
+func (h *splitHandler) Unlock(cmd common.UnlockRequest) error {
+	return Unlock(h.Handler, cmd)
+}
+
+func (h *splitHandler) Flush(cmd common.FlushRequest) error {
+	return Flush(h.Handler, cmd)
+}
+
+func (h *splitHandler) Ping() error {
+	return Ping(h.Handler)
+}
+
+func (h *splitHandler) Keys(prefix []byte) ([][]byte, error) {
+	return Keys(h.Handler, prefix)
+}
+
+func (h *splitHandler) ServerTime() (time.Time, error) {
+	return ServerTime(h.Handler)
+}
@@ -0,0 +1,154 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers_test
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/inmem"
+)
+
+// splitConn is one backend connection of a split handler. It records the size of every get it's
+// given and fails gets of the key in fail.
+type splitConn struct {
+	handlers.Handler
+	lock  *sync.Mutex
+	sizes *[]int
+	fail  string
+}
+
+func (c splitConn) GetEach(cmd common.GetRequest, f func(common.GetResponse) error) error {
+	c.lock.Lock()
+	*c.sizes = append(*c.sizes, len(cmd.Keys))
+	c.lock.Unlock()
+
+	for _, k := range cmd.Keys {
+		if string(k) == c.fail {
+			return errors.New("backend failed")
+		}
+	}
+	return handlers.GetEach(c.Handler, cmd, f)
+}
+
+func (c splitConn) GetEEach(cmd common.GetRequest, f func(common.GetEResponse) error) error {
+	return handlers.GetEEach(c.Handler, cmd, f)
+}
+
+func TestSplit(t *testing.T) {
+	h, _ := inmem.New()
+
+	req := common.GetRequest{}
+	for i := 0; i < 25; i++ {
+		key := fmt.Sprintf("split:%d", i)
+		if i%3 != 0 {
+			h.Set(common.SetRequest{Key: []byte(key), Data: []byte(key)})
+		}
+		req.Keys = append(req.Keys, []byte(key))
+		req.Opaques = append(req.Opaques, uint32(i))
+		req.Quiet = append(req.Quiet, false)
+	}
+
+	mk := func(p handlers.SplitPolicy, fail string) (handlers.Handler, *[]int, *int) {
+		lock := new(sync.Mutex)
+		sizes := new([]int)
+		conns := new(int)
+		hc := func() (handlers.Handler, error) {
+			lock.Lock()
+			*conns++
+			lock.Unlock()
+			return splitConn{Handler: h, lock: lock, sizes: sizes, fail: fail}, nil
+		}
+		sh, _ := handlers.Split(hc, p)()
+		return sh, sizes, conns
+	}
+
+	for _, p := range []handlers.SplitPolicy{{MaxKeys: 4, Parallel: 1}, {MaxKeys: 4, Parallel: 3}, {MaxKeys: 100, Parallel: 3}} {
+		t.Run(fmt.Sprintf("%d-%d", p.MaxKeys, p.Parallel), func(t *testing.T) {
+			sh, sizes, conns := mk(p, "")
+
+			var got []uint32
+			err := handlers.GetEach(sh, req, func(res common.GetResponse) error {
+				if res.Miss == (res.Opaque%3 != 0) || (!res.Miss && string(res.Data) != string(res.Key)) {
+					t.Errorf("Wrong response for %s: %+v", res.Key, res)
+				}
+				got = append(got, res.Opaque)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			for i, o := range got {
+				if o != uint32(i) {
+					t.Fatalf("Responses out of order: %v", got)
+				}
+			}
+			if len(got) != len(req.Keys) {
+				t.Fatalf("Expected %d responses, got %d", len(req.Keys), len(got))
+			}
+
+			batches := (len(req.Keys) + p.MaxKeys - 1) / p.MaxKeys
+			if len(*sizes) != batches {
+				t.Errorf("Expected %d batches, got %v", batches, *sizes)
+			}
+			for _, s := range *sizes {
+				if s > p.MaxKeys {
+					t.Errorf("Batch of %d keys is over the limit of %d", s, p.MaxKeys)
+				}
+			}
+
+			want := p.Parallel
+			if batches == 1 {
+				want = 1
+			}
+			if *conns != want {
+				t.Errorf("Expected %d backend connections, got %d", want, *conns)
+			}
+		})
+	}
+
+	t.Run("error", func(t *testing.T) {
+		sh, _, _ := mk(handlers.SplitPolicy{MaxKeys: 4, Parallel: 3}, "split:13")
+
+		var got []uint32
+		err := handlers.GetEach(sh, req, func(res common.GetResponse) error {
+			got = append(got, res.Opaque)
+			return nil
+		})
+		if err == nil {
+			t.Fatal("Expected the failed batch's error")
+		}
+
+		// Everything before the failed batch is answered, and nothing after it
+		if len(got) != 12 {
+			t.Fatalf("Expected the 12 responses before the failed batch, got %v", got)
+		}
+		for i, o := range got {
+			if o != uint32(i) {
+				t.Fatalf("Responses out of order: %v", got)
+			}
+		}
+
+		resChan, errChan := sh.Get(req)
+		if err := handlers.DrainGet(resChan, errChan, func(common.GetResponse) error { return nil }); err == nil {
+			t.Fatal("Expected the failed batch's error from Get")
+		}
+	})
+}
@@ -0,0 +1,147 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"context"
+
+	"github.com/netflix/rend/common"
+)
+
+// SyncGetter is implemented by handlers that can answer gets on the calling goroutine, handing
+// each response to a callback instead of sending it on a channel. It is optional; GetEach and
+// GetEEach fall back to Get and GetE for handlers without it. A get of a single key from a
+// handler with it costs no goroutine and no channel operations.
+//
+// Each response for the keys in cmd, hit or miss, is passed to f in order. If the handler fails,
+// or f returns an error, no more responses are passed and the error is returned. A response's data
+// may only be used until f returns, since the handler can reuse its memory after that, so f must
+// copy it to keep it.
+type SyncGetter interface {
+	GetEach(cmd common.GetRequest, f func(common.GetResponse) error) error
+	GetEEach(cmd common.GetRequest, f func(common.GetEResponse) error) error
+}
+
+// SyncGetterV2 is the context-aware form of SyncGetter for HandlerV2 implementations.
+type SyncGetterV2 interface {
+	GetEach(ctx context.Context, cmd common.GetRequest, f func(common.GetResponse) error) error
+	GetEEach(ctx context.Context, cmd common.GetRequest, f func(common.GetEResponse) error) error
+}
+
+// GetEach passes each response to the get in cmd to f using h, see SyncGetter.
+func GetEach(h Handler, cmd common.GetRequest, f func(common.GetResponse) error) error {
+	if sg, ok := h.(SyncGetter); ok {
+		return sg.GetEach(cmd, f)
+	}
+	resChan, errChan := h.Get(cmd)
+	return DrainGet(resChan, errChan, f)
+}
+
+// GetEEach passes each response to the gete in cmd to f using h, see SyncGetter.
+func GetEEach(h Handler, cmd common.GetRequest, f func(common.GetEResponse) error) error {
+	if sg, ok := h.(SyncGetter); ok {
+		return sg.GetEEach(cmd, f)
+	}
+	resChan, errChan := h.GetE(cmd)
+	return DrainGetE(resChan, errChan, f)
+}
+
+// GetEachV2 is the HandlerV2 counterpart of GetEach.
+func GetEachV2(ctx context.Context, h HandlerV2, cmd common.GetRequest, f func(common.GetResponse) error) error {
+	if sg, ok := h.(SyncGetterV2); ok {
+		return sg.GetEach(ctx, cmd, f)
+	}
+	resChan, errChan := h.Get(ctx, cmd)
+	return DrainGet(resChan, errChan, f)
+}
+
+// GetEEachV2 is the HandlerV2 counterpart of GetEEach.
+func GetEEachV2(ctx context.Context, h HandlerV2, cmd common.GetRequest, f func(common.GetEResponse) error) error {
+	if sg, ok := h.(SyncGetterV2); ok {
+		return sg.GetEEach(ctx, cmd, f)
+	}
+	resChan, errChan := h.GetE(ctx, cmd)
+	return DrainGetE(resChan, errChan, f)
+}
+
+// DrainGet passes the responses on resChan to f until it fails, for a SyncGetter that has to fall
+// back to channels for some requests. The channels are read until both are closed either way, so
+// whatever is sending on them is never left blocked.
+func DrainGet(resChan <-chan common.GetResponse, errChan <-chan error, f func(common.GetResponse) error) error {
+	var err error
+	for resChan != nil || errChan != nil {
+		select {
+		case res, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			} else if err == nil {
+				err = f(res)
+			}
+		case e, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			} else if err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+// DrainGetE is DrainGet for GetE
+func DrainGetE(resChan <-chan common.GetEResponse, errChan <-chan error, f func(common.GetEResponse) error) error {
+	var err error
+	for resChan != nil || errChan != nil {
+		select {
+		case res, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			} else if err == nil {
+				err = f(res)
+			}
+		case e, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			} else if err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+func (v v2Handler) GetEach(ctx context.Context, cmd common.GetRequest, f func(common.GetResponse) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer v.interrupt(ctx)()
+	return GetEach(v.h, cmd, f)
+}
+
+func (v v2Handler) GetEEach(ctx context.Context, cmd common.GetRequest, f func(common.GetEResponse) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer v.interrupt(ctx)()
+	return GetEEach(v.h, cmd, f)
+}
+
+func (v v1Handler) GetEach(cmd common.GetRequest, f func(common.GetResponse) error) error {
+	return GetEachV2(context.Background(), v.h, cmd, f)
+}
+
+func (v v1Handler) GetEEach(cmd common.GetRequest, f func(common.GetEResponse) error) error {
+	return GetEEachV2(context.Background(), v.h, cmd, f)
+}
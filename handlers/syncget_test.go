@@ -0,0 +1,104 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/inmem"
+)
+
+// chanGets answers gets only through channels, from a goroutine the way backend handlers do, and
+// closes done once that goroutine has sent everything
+type chanGets struct {
+	handlers.Handler
+	done chan struct{}
+}
+
+func (c chanGets) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	resChan, errChan := c.Handler.Get(cmd)
+	dataOut := make(chan common.GetResponse)
+	errorOut := make(chan error)
+
+	go func() {
+		defer close(c.done)
+		defer close(errorOut)
+		defer close(dataOut)
+		for res := range resChan {
+			dataOut <- res
+		}
+		for err := range errChan {
+			errorOut <- err
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+func TestGetEach(t *testing.T) {
+	h, _ := inmem.New()
+	h.Set(common.SetRequest{Key: []byte("each:a"), Data: []byte("a")})
+	h.Set(common.SetRequest{Key: []byte("each:c"), Data: []byte("c")})
+
+	req := common.GetRequest{
+		Keys:    [][]byte{[]byte("each:a"), []byte("each:b"), []byte("each:c")},
+		Opaques: []uint32{1, 2, 3},
+		Quiet:   []bool{false, false, false},
+	}
+
+	for name, mk := range map[string]func() (handlers.Handler, chan struct{}){
+		"sync": func() (handlers.Handler, chan struct{}) { return h, nil },
+		"channels": func() (handlers.Handler, chan struct{}) {
+			done := make(chan struct{})
+			return chanGets{Handler: h, done: done}, done
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			gh, _ := mk()
+
+			var got []string
+			err := handlers.GetEach(gh, req, func(res common.GetResponse) error {
+				if res.Miss {
+					got = append(got, "miss")
+				} else {
+					got = append(got, string(res.Data))
+				}
+				return nil
+			})
+			if err != nil || len(got) != 3 || got[0] != "a" || got[1] != "miss" || got[2] != "c" {
+				t.Fatalf("Unexpected responses %q %v", got, err)
+			}
+
+			// Stopping part way returns the callback's error, and a handler answering through
+			// channels isn't left blocked sending the rest
+			gh, done := mk()
+			stop := errors.New("stop")
+			n := 0
+			err = handlers.GetEach(gh, req, func(res common.GetResponse) error {
+				n++
+				return stop
+			})
+			if err != stop || n != 1 {
+				t.Fatalf("Expected to stop after the first response, got %d responses and %v", n, err)
+			}
+			if done != nil {
+				<-done
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricWarmHandlersCreated = metrics.AddCounter("warm_handlers_created", nil)
+	MetricWarmHandlersUsed    = metrics.AddCounter("warm_handlers_used", nil)
+	MetricWarmHandlersCold    = metrics.AddCounter("warm_handlers_cold", nil)
+	MetricWarmErrors          = metrics.AddCounter("warm_errors", nil)
+)
+
+// Warmer keeps a number of handlers made and checked ahead of time, so a new client connection
+// doesn't have to wait for its backend connections to be dialed and set up. Each handler handed
+// out is replaced in the background. When there are no spares left a handler is made on the
+// spot, the same as without a Warmer.
+type Warmer struct {
+	name   string
+	hc     HandlerConst
+	spares chan Handler
+	refill chan struct{}
+}
+
+// NewWarmer creates a Warmer that keeps n spare handlers from hc. The name identifies the backend
+// in errors and log lines. It starts out empty until Warm is called.
+func NewWarmer(name string, hc HandlerConst, n int) *Warmer {
+	w := &Warmer{
+		name:   name,
+		hc:     hc,
+		spares: make(chan Handler, n),
+		refill: make(chan struct{}, n),
+	}
+	go w.refiller()
+	return w
+}
+
+// Warm makes and pings handlers until there are as many spares as the Warmer keeps, or ctx is
+// done. It stops at the first handler that fails, which means the backend isn't fully usable yet.
+// It can be called again at any time to top the spares back up.
+func (w *Warmer) Warm(ctx context.Context) error {
+	for len(w.spares) < cap(w.spares) {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("Warming up %s: %v", w.name, err)
+		}
+
+		h, err := w.make()
+		if err != nil {
+			return err
+		}
+		// Handler constructors like NilHandler have nothing to warm up
+		if h == nil {
+			return nil
+		}
+
+		select {
+		case w.spares <- h:
+		default:
+			// filled up by the refiller in the mean time
+			h.Close()
+			return nil
+		}
+	}
+	return nil
+}
+
+// Spares returns the number of handlers ready to be handed out right now
+func (w *Warmer) Spares() int {
+	return len(w.spares)
+}
+
+// Handler is a HandlerConst that hands out a spare if there is one
+func (w *Warmer) Handler() (Handler, error) {
+	select {
+	case h := <-w.spares:
+		metrics.IncCounter(MetricWarmHandlersUsed)
+		select {
+		case w.refill <- struct{}{}:
+		default:
+		}
+		return h, nil
+	default:
+		metrics.IncCounter(MetricWarmHandlersCold)
+		return w.hc()
+	}
+}
+
+func (w *Warmer) make() (Handler, error) {
+	h, err := w.hc()
+	if err != nil {
+		metrics.IncCounter(MetricWarmErrors)
+		return nil, fmt.Errorf("Warming up %s: %v", w.name, err)
+	}
+	if h == nil {
+		return nil, nil
+	}
+
+	if err := Ping(h); err != nil {
+		metrics.IncCounter(MetricWarmErrors)
+		h.Close()
+		return nil, fmt.Errorf("Warming up %s: %v", w.name, err)
+	}
+
+	metrics.IncCounter(MetricWarmHandlersCreated)
+	return h, nil
+}
+
+// refiller replaces the spares that are handed out
+func (w *Warmer) refiller() {
+	for range w.refill {
+		h, err := w.make()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if h == nil {
+			continue
+		}
+
+		select {
+		case w.spares <- h:
+		default:
+			h.Close()
+		}
+	}
+}
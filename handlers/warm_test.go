@@ -0,0 +1,91 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/handlers"
+)
+
+// pingHandler only pings, and fails to if its backend is down
+type pingHandler struct {
+	handlers.Handler
+	id   int32
+	down *int32
+}
+
+func (h pingHandler) Ping() error {
+	if atomic.LoadInt32(h.down) == 1 {
+		return errors.New("down")
+	}
+	return nil
+}
+
+func (h pingHandler) Close() error { return nil }
+
+func TestWarmer(t *testing.T) {
+	var made, down int32
+	hc := func() (handlers.Handler, error) {
+		return pingHandler{id: atomic.AddInt32(&made, 1), down: &down}, nil
+	}
+
+	w := handlers.NewWarmer("test", hc, 3)
+	if err := w.Warm(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if w.Spares() != 3 || atomic.LoadInt32(&made) != 3 {
+		t.Fatalf("Expected 3 spares, got %d after making %d", w.Spares(), made)
+	}
+
+	// A spare is handed out and replaced in the background
+	h, err := w.Handler()
+	if err != nil || h.(pingHandler).id != 1 {
+		t.Fatalf("Expected the first spare, got %v, %v", h, err)
+	}
+	for deadline := time.Now().Add(time.Second); w.Spares() < 3; {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the spare to be replaced")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Without spares a handler is made on the spot
+	atomic.StoreInt32(&down, 1)
+	for i := 0; i < 3; i++ {
+		w.Handler()
+	}
+	if err := w.Warm(context.Background()); err == nil {
+		t.Fatal("Expected warming up a down backend to fail")
+	}
+	for w.Spares() > 0 {
+		w.Handler()
+	}
+	before := atomic.LoadInt32(&made)
+	if h, err := w.Handler(); err != nil || h.(pingHandler).id <= before {
+		t.Fatalf("Expected a new handler, got %v, %v", h, err)
+	}
+}
+
+func TestWarmerNilHandler(t *testing.T) {
+	w := handlers.NewWarmer("nil", handlers.NilHandler, 3)
+	if err := w.Warm(context.Background()); err != nil || w.Spares() != 0 {
+		t.Fatalf("Expected nothing to warm up, got %d spares and %v", w.Spares(), err)
+	}
+}
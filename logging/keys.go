@@ -0,0 +1,200 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/metrics"
+)
+
+var MetricKeySecretRotations = metrics.AddCounter("log_key_secret_rotations", nil)
+
+const (
+	// hex characters of the HMAC kept in a hashed key, the same as capture keeps
+	hashedKeyLength = 32
+	// secrets remembered so keys logged before a rotation can still be looked up
+	keySecretHistory = 4
+)
+
+type keySecret struct {
+	id     string
+	secret []byte
+	since  time.Time
+}
+
+var (
+	keyLock sync.Mutex
+	// keySecretFunc returns the current secret, nil if keys are logged as they are
+	keySecretFunc func() []byte
+	// newest first
+	keySecrets []keySecret
+)
+
+// SetKeySecret makes Key hash keys with an HMAC under the secret returned by secret, which is asked
+// for on every call so a rotated secret takes effect right away. Keys appear raw until this is
+// called, and again if it's called with nil.
+func SetKeySecret(secret func() []byte) {
+	keyLock.Lock()
+	keySecretFunc = secret
+	keySecrets = nil
+	keyLock.Unlock()
+}
+
+// HashesKeys returns whether Key hashes keys
+func HashesKeys() bool {
+	keyLock.Lock()
+	defer keyLock.Unlock()
+	return keySecretFunc != nil
+}
+
+// Key returns the form of key that goes in logs and reports: the key itself, or if a secret was
+// set with SetKeySecret, h:<secret id>:<HMAC-SHA256 of the key, in hex>. The secret id tells which
+// secret a hash was made with, so hashes from before and after a rotation aren't confused.
+func Key(key []byte) string {
+	keyLock.Lock()
+	if keySecretFunc == nil {
+		keyLock.Unlock()
+		return string(key)
+	}
+	s := currentKeySecret()
+	keyLock.Unlock()
+
+	return hashKey(s, key)
+}
+
+// currentKeySecret returns the secret in use, remembering it if it's new. keyLock must be held.
+func currentKeySecret() keySecret {
+	secret := keySecretFunc()
+	if len(keySecrets) > 0 && bytes.Equal(keySecrets[0].secret, secret) {
+		return keySecrets[0]
+	}
+
+	if len(keySecrets) > 0 {
+		metrics.IncCounter(MetricKeySecretRotations)
+	}
+
+	sum := sha256.Sum256(secret)
+	s := keySecret{
+		id:     hex.EncodeToString(sum[:2]),
+		secret: append([]byte(nil), secret...),
+		since:  time.Now(),
+	}
+
+	keySecrets = append([]keySecret{s}, keySecrets...)
+	if len(keySecrets) > keySecretHistory {
+		keySecrets = keySecrets[:keySecretHistory]
+	}
+
+	return s
+}
+
+func hashKey(s keySecret, key []byte) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write(key)
+	return "h:" + s.id + ":" + hex.EncodeToString(mac.Sum(nil))[:hashedKeyLength]
+}
+
+// HashedKey is what a key looks like in logs under one secret
+type HashedKey struct {
+	Hash string `json:"hash"`
+	// Since is when the secret was first used by this process
+	Since time.Time `json:"secret_since"`
+}
+
+// LookupKey returns the hashes of key under the current secret and the ones before it that this
+// process has used, newest first. It returns nil if keys aren't hashed.
+func LookupKey(key []byte) []HashedKey {
+	keyLock.Lock()
+	if keySecretFunc == nil {
+		keyLock.Unlock()
+		return nil
+	}
+	currentKeySecret()
+	secrets := append([]keySecret(nil), keySecrets...)
+	keyLock.Unlock()
+
+	res := make([]HashedKey, len(secrets))
+	for i, s := range secrets {
+		res[i] = HashedKey{Hash: hashKey(s, key), Since: s.since}
+	}
+	return res
+}
+
+type keyLookup struct {
+	Key    string      `json:"key"`
+	Hashes []HashedKey `json:"hashes"`
+}
+
+// KeyHandler is the lookup tool for hashed keys. Hashes can't be reversed, so it's given the keys
+// an operator suspects, in key parameters or one per line in a POST body, and returns their hashes
+// as JSON. With a hash parameter it only returns the keys that hash to it, which finds the key
+// behind a log line among a list of candidates. Since it's served on the admin port, anyone who
+// can reach it is trusted with raw keys already.
+var KeyHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if !HashesKeys() {
+		http.Error(w, "Keys aren't hashed", http.StatusNotFound)
+		return
+	}
+
+	keys := r.URL.Query()["key"]
+	if r.Method == http.MethodPost {
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				keys = append(keys, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if len(keys) == 0 {
+		http.Error(w, "No keys to look up", http.StatusBadRequest)
+		return
+	}
+
+	hash := r.URL.Query().Get("hash")
+	res := []keyLookup{}
+	for _, k := range keys {
+		hashes := LookupKey([]byte(k))
+		if hash != "" && !matches(hashes, hash) {
+			continue
+		}
+		res = append(res, keyLookup{Key: k, Hashes: hashes})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+})
+
+func matches(hashes []HashedKey, hash string) bool {
+	for _, h := range hashes {
+		if h.Hash == hash {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,330 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logging holds the settings that decide what rend logs about the requests it serves, so
+// they can be changed from the admin channel while a problem is happening rather than with a
+// restart that gets rid of it. Every change is recorded, and reverts to the settings the process
+// was started with after a while, so a debugging session left behind doesn't fill the disks.
+//
+// The level only applies to logs written through this package. Errors are always logged.
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricChanges = metrics.AddCounter("log_settings_changes", nil)
+	MetricReverts = metrics.AddCounter("log_settings_reverts", nil)
+)
+
+// Level is how much is logged
+type Level int32
+
+const (
+	// LevelError only logs errors
+	LevelError Level = iota
+	// LevelInfo also logs slow, timed, and sampled requests
+	LevelInfo
+	// LevelDebug also logs connections opening and closing
+	LevelDebug
+)
+
+var levelNames = []string{"error", "info", "debug"}
+
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return strconv.Itoa(int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level with the given name
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if s == name {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown log level %q, should be one of %s", s, strings.Join(levelNames, ", "))
+}
+
+func (l Level) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.String())
+}
+
+// Settings decide what is logged
+type Settings struct {
+	Level Level `json:"level"`
+	// SlowRequests replaces the SlowRequestThreshold of every listener if it's set
+	SlowRequests time.Duration `json:"slow_requests"`
+	// AccessSampleRate is the fraction of requests written to the access log, from 0 to 1
+	AccessSampleRate float64 `json:"access_sample_rate"`
+}
+
+func (s Settings) validate() error {
+	if s.Level < LevelError || s.Level > LevelDebug {
+		return fmt.Errorf("Unknown log level %v", s.Level)
+	}
+	if s.SlowRequests < 0 {
+		return fmt.Errorf("Slow request threshold must be >= 0")
+	}
+	if s.AccessSampleRate < 0 || s.AccessSampleRate > 1 {
+		return fmt.Errorf("Access log sample rate must be between 0 and 1")
+	}
+	return nil
+}
+
+// Change is a change to the settings made at runtime
+type Change struct {
+	Time time.Time `json:"time"`
+	// By is who made the change, e.g. the address an admin request came from
+	By   string   `json:"by"`
+	From Settings `json:"from"`
+	To   Settings `json:"to"`
+	// Until is when the change reverts. It's zero for changes that stay, and for reverts
+	// themselves.
+	Until time.Time `json:"until,omitempty"`
+}
+
+// the most changes remembered
+const historySize = 100
+
+var (
+	current atomic.Value
+
+	lock    sync.Mutex
+	base    Settings
+	until   time.Time
+	revert  *time.Timer
+	history []Change
+)
+
+func init() {
+	current.Store(Settings{Level: LevelInfo})
+	base = Settings{Level: LevelInfo}
+}
+
+// Configure sets the settings the process starts with, which every change reverts to. It's meant to
+// be called once at startup.
+func Configure(s Settings) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	base = s
+	current.Store(s)
+	return nil
+}
+
+// Current returns the settings in effect
+func Current() Settings {
+	return current.Load().(Settings)
+}
+
+// Set changes the settings. After d they go back to the ones the process was started with, unless
+// d is 0, in which case they stay. The change and who made it are logged and recorded.
+func Set(s Settings, d time.Duration, by string) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+	if d < 0 {
+		return fmt.Errorf("Duration must be >= 0")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if revert != nil {
+		revert.Stop()
+		revert = nil
+	}
+	until = time.Time{}
+
+	c := Change{Time: time.Now(), By: by, From: Current(), To: s}
+	if d > 0 {
+		until = c.Time.Add(d)
+		c.Until = until
+		revert = time.AfterFunc(d, func() { revertTo(c.Until) })
+	}
+	apply(c)
+	metrics.IncCounter(MetricChanges)
+
+	return nil
+}
+
+// Revert goes back to the settings the process was started with
+func Revert(by string) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if revert != nil {
+		revert.Stop()
+		revert = nil
+	}
+	until = time.Time{}
+	apply(Change{Time: time.Now(), By: by, From: Current(), To: base})
+	metrics.IncCounter(MetricReverts)
+}
+
+// revertTo reverts the change that was to last until the given time, unless it's been replaced
+func revertTo(t time.Time) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if !until.Equal(t) {
+		return
+	}
+	revert = nil
+	until = time.Time{}
+	apply(Change{Time: time.Now(), By: "expiry", From: Current(), To: base})
+	metrics.IncCounter(MetricReverts)
+}
+
+// apply puts a change in effect and records it. The lock must be held.
+func apply(c Change) {
+	current.Store(c.To)
+
+	if len(history) == historySize {
+		history = append(history[:0], history[1:]...)
+	}
+	history = append(history, c)
+
+	if c.Until.IsZero() {
+		log.Printf("Log settings changed by %s from %+v to %+v\n", c.By, c.From, c.To)
+	} else {
+		log.Printf("Log settings changed by %s from %+v to %+v until %v\n", c.By, c.From, c.To, c.Until.Format(time.RFC3339))
+	}
+}
+
+// Enabled returns whether logs at the level are written
+func Enabled(l Level) bool {
+	return Current().Level >= l
+}
+
+// Infof logs at LevelInfo
+func Infof(format string, args ...interface{}) {
+	if Enabled(LevelInfo) {
+		log.Printf(format, args...)
+	}
+}
+
+// Debugf logs at LevelDebug
+func Debugf(format string, args ...interface{}) {
+	if Enabled(LevelDebug) {
+		log.Printf(format, args...)
+	}
+}
+
+// SlowRequests returns the slow request threshold that replaces listeners' own, or 0 if they keep
+// theirs
+func SlowRequests() time.Duration {
+	return Current().SlowRequests
+}
+
+// SampleAccess returns whether a request should be written to the access log
+func SampleAccess() bool {
+	rate := Current().AccessSampleRate
+	return rate > 0 && (rate >= 1 || rand.Float64() < rate)
+}
+
+type status struct {
+	Current Settings `json:"current"`
+	Base    Settings `json:"base"`
+	// Until is when the current settings revert to the base ones, if they do
+	Until   time.Time `json:"until,omitempty"`
+	History []Change  `json:"history"`
+}
+
+// DefaultRevert is how long changes made with Handler last if the request doesn't say
+var DefaultRevert = 15 * time.Minute
+
+// Handler reports the settings and the changes made to them as JSON. A POST with any of the level,
+// slow_requests, and access_sample_rate parameters changes those settings and keeps the rest, for
+// the duration in the for parameter (DefaultRevert if it's missing, and for good if it's 0). A
+// POST with revert=true goes back to the settings the process was started with.
+var Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if err := post(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	lock.Lock()
+	st := status{
+		Current: Current(),
+		Base:    base,
+		Until:   until,
+		History: append([]Change{}, history...),
+	}
+	lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+})
+
+func post(r *http.Request) error {
+	if revert, _ := strconv.ParseBool(r.FormValue("revert")); revert {
+		Revert(r.RemoteAddr)
+		return nil
+	}
+
+	s := Current()
+	if v := r.FormValue("level"); v != "" {
+		l, err := ParseLevel(v)
+		if err != nil {
+			return err
+		}
+		s.Level = l
+	}
+	if v := r.FormValue("slow_requests"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("Bad slow_requests: %v", err)
+		}
+		s.SlowRequests = d
+	}
+	if v := r.FormValue("access_sample_rate"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("Bad access_sample_rate: %v", err)
+		}
+		s.AccessSampleRate = f
+	}
+
+	d := DefaultRevert
+	if v := r.FormValue("for"); v != "" {
+		var err error
+		if d, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("Bad for: %v", err)
+		}
+	}
+
+	return Set(s, d, r.RemoteAddr)
+}
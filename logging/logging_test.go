@@ -0,0 +1,205 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/logging"
+)
+
+func TestSetReverts(t *testing.T) {
+	base := logging.Settings{Level: logging.LevelInfo, AccessSampleRate: 0.01}
+	if err := logging.Configure(base); err != nil {
+		t.Fatal(err)
+	}
+
+	debug := logging.Settings{Level: logging.LevelDebug, SlowRequests: time.Millisecond, AccessSampleRate: 1}
+	if err := logging.Set(debug, 50*time.Millisecond, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if logging.Current() != debug || !logging.Enabled(logging.LevelDebug) || !logging.SampleAccess() {
+		t.Fatalf("Expected the new settings in effect, got %+v", logging.Current())
+	}
+
+	for i := 0; logging.Current() != base; i++ {
+		if i == 100 {
+			t.Fatalf("Expected the settings to revert, got %+v", logging.Current())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A change replacing another one isn't reverted by the first one expiring
+	logging.Set(debug, 30*time.Millisecond, "test")
+	logging.Set(logging.Settings{Level: logging.LevelError}, 0, "test")
+	time.Sleep(60 * time.Millisecond)
+	if logging.Current().Level != logging.LevelError {
+		t.Fatalf("Expected the lasting change to stay, got %+v", logging.Current())
+	}
+	logging.Revert("test")
+	if logging.Current() != base {
+		t.Fatalf("Expected a revert to go back to the base settings, got %+v", logging.Current())
+	}
+
+	for _, s := range []logging.Settings{
+		{Level: logging.LevelDebug + 1},
+		{SlowRequests: -1},
+		{AccessSampleRate: 2},
+	} {
+		if logging.Set(s, 0, "test") == nil {
+			t.Fatalf("Expected %+v to be rejected", s)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	if err := logging.Configure(logging.Settings{Level: logging.LevelInfo}); err != nil {
+		t.Fatal(err)
+	}
+	defer logging.Revert("test")
+
+	post := func(form url.Values) (int, map[string]interface{}) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/admin/logging", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		logging.Handler.ServeHTTP(rec, req)
+
+		var res map[string]interface{}
+		json.Unmarshal(rec.Body.Bytes(), &res)
+		return rec.Code, res
+	}
+
+	code, res := post(url.Values{"level": {"debug"}, "slow_requests": {"5ms"}, "for": {"1h"}})
+	if code != http.StatusOK || logging.Current().Level != logging.LevelDebug || logging.SlowRequests() != 5*time.Millisecond {
+		t.Fatalf("Expected the change to apply, got %d %+v", code, logging.Current())
+	}
+	if cur := res["current"].(map[string]interface{}); cur["level"] != "debug" || res["until"] == nil {
+		t.Fatalf("Expected the change in the response with when it reverts, got %v", res)
+	}
+	history := res["history"].([]interface{})
+	if last := history[len(history)-1].(map[string]interface{}); !strings.HasPrefix(last["by"].(string), "192.0.2.1") {
+		t.Fatalf("Expected the change recorded with who made it, got %v", last)
+	}
+
+	if code, _ := post(url.Values{"level": {"loud"}}); code != http.StatusBadRequest {
+		t.Fatalf("Expected an unknown level to be rejected, got %d", code)
+	}
+
+	post(url.Values{"revert": {"true"}})
+	if logging.Current().Level != logging.LevelInfo {
+		t.Fatalf("Expected a revert to go back to info, got %+v", logging.Current())
+	}
+}
+
+func TestKey(t *testing.T) {
+	if k := logging.Key([]byte("user:1234")); k != "user:1234" {
+		t.Fatalf("Expected keys as they are without a secret, got %q", k)
+	}
+
+	secret := []byte("first")
+	logging.SetKeySecret(func() []byte { return secret })
+	defer logging.SetKeySecret(nil)
+
+	first := logging.Key([]byte("user:1234"))
+	if !strings.HasPrefix(first, "h:") || strings.Contains(first, "1234") || len(first) != len("h:0000:")+32 {
+		t.Fatalf("Expected a hashed key, got %q", first)
+	}
+	if k := logging.Key([]byte("user:1234")); k != first {
+		t.Fatalf("Expected the same hash for the same key, got %q and %q", first, k)
+	}
+	if k := logging.Key([]byte("user:1235")); k == first {
+		t.Fatalf("Expected a different hash for another key, got %q", k)
+	}
+
+	secret = []byte("second")
+	second := logging.Key([]byte("user:1234"))
+	if second == first || second[:7] == first[:7] {
+		t.Fatalf("Expected a rotated secret to change the hash and its secret id, got %q and %q", first, second)
+	}
+
+	hashes := logging.LookupKey([]byte("user:1234"))
+	if len(hashes) != 2 || hashes[0].Hash != second || hashes[1].Hash != first {
+		t.Fatalf("Expected the hashes under the current and previous secrets, got %+v", hashes)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/logging/keys?hash="+url.QueryEscape(first), strings.NewReader("user:1\nuser:1234\nuser:2\n"))
+	rec := httptest.NewRecorder()
+	logging.KeyHandler.ServeHTTP(rec, req)
+
+	var res []struct {
+		Key    string
+		Hashes []logging.HashedKey
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].Key != "user:1234" {
+		t.Fatalf("Expected only the candidate with the hash, got %+v", res)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	if _, err := logging.StartTrace("", "", time.Minute, "test"); err == nil {
+		t.Fatal("Expected a trace matching everything to be rejected")
+	}
+	if _, err := logging.StartTrace("user:*", "", logging.MaxTrace+time.Second, "test"); err == nil {
+		t.Fatal("Expected a trace longer than the maximum to be rejected")
+	}
+
+	keys, err := logging.StartTrace("user:1*", "", time.Minute, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := logging.StartTrace("", "10.0.0.1", 20*time.Millisecond, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logging.StopTrace(keys.ID, "test")
+
+	match := func(id uint64, remote string, keys ...string) uint64 {
+		var ks [][]byte
+		for _, k := range keys {
+			ks = append(ks, []byte(k))
+		}
+		return logging.MatchTrace(id, remote, ks)
+	}
+
+	if id := match(1, "tcp:10.0.0.2:1234", "other", "user:123"); id != keys.ID {
+		t.Fatalf("Expected a multiget with a matching key to match trace %d, got %d", keys.ID, id)
+	}
+	if id := match(1, "tcp:10.0.0.2:1234", "user:2"); id != 0 {
+		t.Fatalf("Expected no trace to match, got %d", id)
+	}
+	if id := match(1, "tcp:10.0.0.1:1234", "user:2"); id != conn.ID {
+		t.Fatalf("Expected the client's address to match trace %d, got %d", conn.ID, id)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if id := match(1, "tcp:10.0.0.1:1234", "user:2"); id != 0 {
+		t.Fatalf("Expected trace %d to have ended, got %d", conn.ID, id)
+	}
+
+	traces := logging.Traces()
+	if len(traces) != 1 || traces[0].ID != keys.ID || traces[0].Requests != 1 {
+		t.Fatalf("Unexpected traces %+v", traces)
+	}
+}
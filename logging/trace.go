@@ -0,0 +1,228 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricTracesStarted  = metrics.AddCounter("log_traces_started", nil)
+	MetricTracedRequests = metrics.AddCounter("log_traced_requests", nil)
+)
+
+const (
+	// DefaultTrace is how long a trace lasts if it's started without a duration
+	DefaultTrace = time.Minute
+	// MaxTrace is the longest a trace can last, so one that's forgotten about doesn't keep logging
+	MaxTrace = 10 * time.Minute
+)
+
+// Trace logs everything about the requests for some keys or from some connection, for a while,
+// without turning up logging for everyone else. Traced requests are logged whatever the level.
+type Trace struct {
+	ID uint64 `json:"id"`
+	// Keys is a pattern for path.Match that the key of a request, or any of its keys, has to
+	// match, e.g. user:1234:*. A hashed key as it appears in the logs matches that key exactly.
+	// Empty matches any key.
+	Keys string `json:"keys,omitempty"`
+	// Conn is the ID of the connection the requests have to come from, or the client's address,
+	// as /admin/conns shows them. The address matches without the network or the port too, e.g.
+	// 10.0.0.1:54321 or 10.0.0.1 for tcp:10.0.0.1:54321. Empty matches any connection.
+	Conn  string    `json:"conn,omitempty"`
+	By    string    `json:"by"`
+	Start time.Time `json:"start"`
+	Until time.Time `json:"until"`
+	// Requests is how many requests have been traced
+	Requests uint64 `json:"requests"`
+}
+
+var (
+	// tracing is the number of traces running, checked before anything else for every request
+	tracing int32
+
+	traceLock sync.Mutex
+	traceNext uint64
+	traces    = make(map[uint64]*Trace)
+)
+
+// StartTrace starts tracing the requests matching keys and conn, see Trace, for d. At least one
+// of them has to be set, and d can't be longer than MaxTrace.
+func StartTrace(keys, conn string, d time.Duration, by string) (Trace, error) {
+	if keys == "" && conn == "" {
+		return Trace{}, fmt.Errorf("A trace needs keys or a conn to match")
+	}
+	if _, err := path.Match(keys, ""); err != nil {
+		return Trace{}, fmt.Errorf("Bad keys pattern %q: %v", keys, err)
+	}
+	if d <= 0 || d > MaxTrace {
+		return Trace{}, fmt.Errorf("Trace duration must be > 0 and at most %v", MaxTrace)
+	}
+
+	traceLock.Lock()
+	defer traceLock.Unlock()
+
+	traceNext++
+	now := time.Now()
+	t := &Trace{ID: traceNext, Keys: keys, Conn: conn, By: by, Start: now, Until: now.Add(d)}
+	traces[t.ID] = t
+	atomic.StoreInt32(&tracing, int32(len(traces)))
+	time.AfterFunc(d, func() { StopTrace(t.ID, "expiry") })
+
+	metrics.IncCounter(MetricTracesStarted)
+	log.Printf("Trace %d of keys %q on conn %q started by %s until %v\n", t.ID, keys, conn, by, t.Until.Format(time.RFC3339))
+	return *t, nil
+}
+
+// StopTrace stops a trace early. It returns false if there's no such trace running.
+func StopTrace(id uint64, by string) bool {
+	traceLock.Lock()
+	defer traceLock.Unlock()
+
+	t, ok := traces[id]
+	if !ok {
+		return false
+	}
+	delete(traces, id)
+	atomic.StoreInt32(&tracing, int32(len(traces)))
+
+	log.Printf("Trace %d stopped by %s after %d requests\n", id, by, t.Requests)
+	return true
+}
+
+// Traces returns the traces running, oldest first
+func Traces() []Trace {
+	traceLock.Lock()
+	defer traceLock.Unlock()
+
+	res := make([]Trace, 0, len(traces))
+	for id := uint64(1); id <= traceNext && len(res) < len(traces); id++ {
+		if t, ok := traces[id]; ok {
+			res = append(res, *t)
+		}
+	}
+	return res
+}
+
+// Tracing reports whether any trace is running. It's cheap enough to call for every request.
+func Tracing() bool {
+	return atomic.LoadInt32(&tracing) > 0
+}
+
+// MatchTrace returns the ID of the oldest trace matching a request with the given keys from the
+// given connection, whose remote address is in the network:address form, and counts the request
+// as traced. It returns 0 if none match.
+func MatchTrace(conn uint64, remote string, keys [][]byte) uint64 {
+	if !Tracing() {
+		return 0
+	}
+
+	traceLock.Lock()
+	defer traceLock.Unlock()
+
+	var match *Trace
+	for _, t := range traces {
+		if (match == nil || t.ID < match.ID) && t.matchesConn(conn, remote) && t.matchesKeys(keys) {
+			match = t
+		}
+	}
+	if match == nil {
+		return 0
+	}
+
+	match.Requests++
+	metrics.IncCounter(MetricTracedRequests)
+	return match.ID
+}
+
+func (t *Trace) matchesConn(conn uint64, remote string) bool {
+	if t.Conn == "" || t.Conn == strconv.FormatUint(conn, 10) || t.Conn == remote {
+		return true
+	}
+	i := strings.IndexByte(remote, ':')
+	if i < 0 {
+		return false
+	}
+	addr := remote[i+1:]
+	host, _, err := net.SplitHostPort(addr)
+	return t.Conn == addr || err == nil && t.Conn == host
+}
+
+func (t *Trace) matchesKeys(keys [][]byte) bool {
+	if t.Keys == "" {
+		return true
+	}
+	for _, k := range keys {
+		if strings.HasPrefix(t.Keys, "h:") && Key(k) == t.Keys {
+			return true
+		}
+		if ok, _ := path.Match(t.Keys, string(k)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Tracef logs for the trace with the given ID, whatever the level
+func Tracef(id uint64, format string, args ...interface{}) {
+	log.Printf("Trace %d: "+format, append([]interface{}{id}, args...)...)
+}
+
+// TraceHandler lists the traces running as JSON. A POST with keys, conn, or both starts a new one
+// lasting for the duration in the for parameter (DefaultTrace if it's missing), and a POST with
+// stop=<id> stops one.
+var TraceHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if v := r.FormValue("stop"); v != "" {
+			id, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Bad stop: %v", err), http.StatusBadRequest)
+				return
+			}
+			if !StopTrace(id, r.RemoteAddr) {
+				http.Error(w, fmt.Sprintf("No trace %d running", id), http.StatusNotFound)
+				return
+			}
+		} else {
+			d := DefaultTrace
+			if v := r.FormValue("for"); v != "" {
+				var err error
+				if d, err = time.ParseDuration(v); err != nil {
+					http.Error(w, fmt.Sprintf("Bad for: %v", err), http.StatusBadRequest)
+					return
+				}
+			}
+			if _, err := StartTrace(r.FormValue("keys"), r.FormValue("conn"), d, r.RemoteAddr); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Traces())
+})
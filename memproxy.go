@@ -15,25 +15,66 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"log"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
 	"runtime/debug"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/netflix/rend/admin"
+	"github.com/netflix/rend/capture"
+	"github.com/netflix/rend/cdc"
+	_ "github.com/netflix/rend/cdc/kafka"
+	"github.com/netflix/rend/clock"
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/consistency"
+	"github.com/netflix/rend/discovery"
+	_ "github.com/netflix/rend/discovery/consul"
+	_ "github.com/netflix/rend/discovery/etcd"
+	_ "github.com/netflix/rend/discovery/eureka"
+	_ "github.com/netflix/rend/discovery/kubernetes"
+	"github.com/netflix/rend/gctune"
 	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/chaos"
+	"github.com/netflix/rend/handlers/deleteq"
+	"github.com/netflix/rend/handlers/failover"
+	"github.com/netflix/rend/handlers/hedged"
 	"github.com/netflix/rend/handlers/inmem"
 	"github.com/netflix/rend/handlers/memcached"
 	"github.com/netflix/rend/handlers/memcached/batched"
+	"github.com/netflix/rend/handlers/migration"
+	"github.com/netflix/rend/handlers/pool"
+	"github.com/netflix/rend/handlers/replicas"
+	"github.com/netflix/rend/handlers/sharded"
+	"github.com/netflix/rend/logging"
 	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/notify"
 	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/peer"
+	"github.com/netflix/rend/prefixstats"
+	"github.com/netflix/rend/priority"
+	"github.com/netflix/rend/profiling"
 	"github.com/netflix/rend/protocol"
 	"github.com/netflix/rend/protocol/binprot"
 	"github.com/netflix/rend/protocol/textprot"
+	"github.com/netflix/rend/quota"
+	"github.com/netflix/rend/secrets"
+	_ "github.com/netflix/rend/secrets/kms"
+	_ "github.com/netflix/rend/secrets/vault"
+	"github.com/netflix/rend/selftest"
 	"github.com/netflix/rend/server"
+	"github.com/netflix/rend/tombstone"
+	"github.com/netflix/rend/watchdog"
 )
 
 func init() {
@@ -43,7 +84,7 @@ func init() {
 	}
 
 	// Setting up signal handlers
-	sigs := make(chan os.Signal)
+	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, os.Interrupt)
 
 	go func() {
@@ -63,13 +104,26 @@ var (
 	chunked bool
 	l1sock  string
 	l1inmem bool
+	wal     inmem.WALConfig
+	limits  inmem.Config
+	restore string
 
 	l1batched bool
 	batchOpts batched.Opts
 
+	chunkSizes []int
+
 	l2enabled bool
 	l2sock    string
 
+	l1handler string
+	l2handler string
+	orca      string
+
+	canaryOrca    string
+	canaryPercent float64
+	canaryByKey   bool
+
 	locked      bool
 	concurrency int
 	multiReader bool
@@ -78,11 +132,160 @@ var (
 	batchPort       int
 	useDomainSocket bool
 	sockPath        string
+	wsPort          int
+	wsOrigins       []string
+	acceptors       int
+	readBufSize     int
+	writeBufSize    int
+	adaptiveBufs    bool
+	backendReadBuf  int
+	backendWriteBuf int
+	dialConf        pool.DialConfig
+	proxyProtocol   bool
+	allowedClients  []*net.IPNet
+	slowRequests    time.Duration
+	logConf         logging.Settings
+	timingInterval  int
+	echoRequestIDs  bool
+	strictness      protocol.Strictness
+	batchStrictness protocol.Strictness
+	quietGets       orcas.QuietGetErrors
+	batchQuietGets  orcas.QuietGetErrors
+	quirks          protocol.Quirks
+	batchQuirks     protocol.Quirks
+	listenProtos    []string
+	batchProtos     []string
+	vbuckets        *protocol.VBuckets
+
+	zeroCopyMin int
+
+	profileConf  profiling.Config
+	gcConf       gctune.Config
+	watchdogConf watchdog.Config
+
+	consistencyInterval   time.Duration
+	consistencySampleRate float64
+	consistencySampleSize int
+	consistencyRepair     bool
+
+	prefixDelimiter string
+	prefixConf      prefixstats.Config
+
+	clockSkewMax      time.Duration
+	clockSkewInterval time.Duration
+
+	captureFile   string
+	captureRate   float64
+	captureSecret string
+
+	logKeySecret string
+
+	secretsConf    string
+	secretsRefresh time.Duration
+
+	l1migrateTo        string
+	l2migrateTo        string
+	migrateKeysFile    string
+	migrateCopyExptime uint
+
+	peerListen string
+	peerAddrs  []string
+	peerTLS    peer.TLSConfig
+
+	cdcSink string
+	cdcOpts cdc.Opts
+
+	notifyPort   int
+	notifyBuffer int
+
+	refreshThreshold   time.Duration
+	refreshProbability float64
+	refreshWorkers     int
+
+	stalePolicy  orcas.StalePolicy
+	staleFlagBit int
+
+	l1hedgeTo  string
+	l2hedgeTo  string
+	hedgeDelay time.Duration
+
+	l1replicas    string
+	l2replicas    string
+	replicaConfig replicas.Config
+
+	l1discovery      string
+	l2discovery      string
+	discoveryHandler string
+	discoveryTimeout time.Duration
+
+	l1shards     string
+	l2shards     string
+	shardHandler string
+	shardConfig  sharded.Config
+
+	tombstoneTTL time.Duration
+	tombstoneMax int
+
+	l1standby      string
+	l2standby      string
+	failoverConfig failover.Config
+	failBack       string
+
+	deleteRetries deleteq.Config
+
+	chaosEnabled bool
+
+	budgetPolicy orcas.BudgetPolicy
+
+	priorityConcurrency int
+	priorityRules       []priority.Rule
+
+	quotas []quota.Quota
+
+	sizePolicy      orcas.SizePolicy
+	batchSizePolicy orcas.SizePolicy
+	backfillPolicy  orcas.BackfillPolicy
+	batchGetSplit   handlers.SplitPolicy
+
+	classPolicy      orcas.ClassPolicy
+	l1OnlyFlagBit    int
+	l2OnlyFlagBit    int
+	replicateFlagBit int
+	noChunkFlagBit   int
+
+	mode               orcas.Mode
+	maintenanceMessage string
+
+	shedPolicy   orcas.ShedPolicy
+	shedInterval time.Duration
+
+	selfTest        bool
+	selfTestTimeout time.Duration
+
+	warmConns   int
+	warmTimeout time.Duration
+
+	healthInterval time.Duration
 )
 
+// health collects how the backends are doing as they're set up, see /admin/health
+var health *admin.Health
+
 func init() {
 	flag.BoolVar(&chunked, "chunked", false, "If --chunked is specified, the chunked handler is used for L1")
 	flag.BoolVar(&l1inmem, "l1-inmem", false, "Use the debug in-memory in-process L1 cache")
+	flag.Int64Var(&limits.MaxBytes, "inmem-max-bytes", 0, "Most memory in bytes the in-memory cache uses for entries before evicting them. 0 is unlimited.")
+	flag.IntVar(&limits.MaxItems, "inmem-max-items", 0, "Most entries the in-memory cache holds before evicting them. 0 is unlimited.")
+	flag.IntVar(&limits.ReclaimRate, "inmem-reclaim-rate", 10000, "Most expired entries the in-memory cache reclaims per second as they expire. 0 leaves them in memory until they're next used.")
+	flag.IntVar(&limits.Shards, "inmem-shards", inmem.DefaultShards, "Number of shards the in-memory cache is split into by key hash, each with its own lock")
+	flag.Int64Var(&limits.OffHeapBytes, "inmem-offheap-bytes", 0, "Bytes of memory outside the Go heap to keep large in-memory cache values in, so garbage collection doesn't have to deal with them. Values that don't fit stay on the heap. Linux only. 0 keeps every value on the heap.")
+	flag.IntVar(&limits.OffHeapMinSize, "inmem-offheap-min-size", 1024, "Smallest value in bytes kept off the heap with --inmem-offheap-bytes")
+	flag.StringVar(&limits.Policy, "inmem-eviction", "lru", "Eviction policy of the in-memory cache when it's over --inmem-max-bytes or --inmem-max-items: "+strings.Join(inmem.Policies(), ", "))
+	flag.StringVar(&wal.Dir, "inmem-wal", "", "Directory of a write-ahead log that the in-memory cache is journaled to and reloaded from at startup, so it survives restarts. Empty keeps it in memory only.")
+	flag.Int64Var(&wal.SegmentSize, "inmem-wal-segment-size", 64*1024*1024, "Size in bytes at which the in-memory WAL starts a new segment")
+	flag.IntVar(&wal.MaxSegments, "inmem-wal-max-segments", 8, "Number of in-memory WAL segments at which they are compacted into one holding only the keys that are still alive")
+	flag.DurationVar(&wal.SyncInterval, "inmem-wal-sync", time.Second, "Interval between syncs of the in-memory WAL to disk. Writes survive a restart of the process either way. 0 leaves syncing to the OS.")
+	flag.StringVar(&restore, "inmem-restore", "", "Snapshot file of the in-memory cache to load at startup, e.g. one written through /admin/inmem/snapshot before a deploy or on another host. A missing file starts empty. Empty disables it.")
 	flag.StringVar(&l1sock, "l1-sock", "invalid.sock", "Specifies the unix socket to connect to L1")
 
 	var tempBatchSize,
@@ -106,6 +309,13 @@ func init() {
 	flag.BoolVar(&l2enabled, "l2-enabled", false, "Specifies if l2 is enabled")
 	flag.StringVar(&l2sock, "l2-sock", "invalid.sock", "Specifies the unix socket to connect to L2. Only used if --l2-enabled is true.")
 
+	flag.StringVar(&l1handler, "l1-handler", "", "Selects a registered L1 handler by name, with optional configuration after a colon, e.g. memcached:/tmp/memcached.sock. Overrides --l1-inmem, --chunked, --l1-batched, and --l1-sock.")
+	flag.StringVar(&l2handler, "l2-handler", "", "Selects a registered L2 handler by name, with optional configuration after a colon. Implies --l2-enabled and overrides --l2-sock.")
+	flag.StringVar(&orca, "orca", "", "Selects a registered orchestrator by name, with optional configuration after a colon. Defaults to l1only, or l1l2 if L2 is enabled.")
+	flag.StringVar(&canaryOrca, "canary-orca", "", "Sends a share of the traffic on the main port to this orchestrator instead, given the same way as --orca, so it can be compared with the one it would replace. The split and the per-side numbers are at /admin/canary, where POSTing enabled=false sends everything back to the usual orchestrator.")
+	flag.Float64Var(&canaryPercent, "canary-percent", 1, "Percentage of traffic sent to the --canary-orca orchestrator. Can be changed at runtime by POSTing percent to /admin/canary.")
+	flag.BoolVar(&canaryByKey, "canary-by-key", false, "Split canary traffic by a hash of each key instead of by connection, so a key is always served by the same orchestrator")
+
 	flag.BoolVar(&locked, "locked", false, "Add locking to overall operations (above L1/L2 layers)")
 	flag.IntVar(&concurrency, "concurrency", 8, "Concurrency level. 2^(concurrency) parallel operations permitted, assuming no collisions. Large values (>16) are likely useless and will eat up RAM. Default of 8 means 256 operations (on different keys) can happen in parallel.")
 	flag.BoolVar(&multiReader, "multi-reader", true, "Allow (or disallow) multiple readers on the same key. If chunking is used, this will always be false and setting it to true will be ignored.")
@@ -114,6 +324,206 @@ func init() {
 	flag.IntVar(&batchPort, "bp", 11212, "External port to listen on for batch systems")
 	flag.BoolVar(&useDomainSocket, "use-domain-socket", false, "Listen on a domain socket instead of a TCP port. --port will be ignored.")
 	flag.StringVar(&sockPath, "sock-path", "/tmp/invalid.sock", "The socket path to listen on. Only valid in conjunction with --use-domain-socket.")
+	flag.IntVar(&acceptors, "acceptors", 1, "Number of listening sockets (and accept loops) to open per TCP port using SO_REUSEPORT. Linux only for values above 1.")
+	flag.IntVar(&readBufSize, "read-buf-size", 0, "The read buffer size per external connection (bytes). 0 assumes the default of 4k, or a maximum of 64k with --adaptive-buffers.")
+	flag.IntVar(&writeBufSize, "write-buf-size", 0, "The write buffer size per external connection (bytes). 0 assumes the default of 4k, or a maximum of 64k with --adaptive-buffers.")
+	flag.BoolVar(&adaptiveBufs, "adaptive-buffers", false, "Start external connections with small buffers and grow or shrink them based on observed value sizes, up to --read-buf-size and --write-buf-size.")
+	flag.IntVar(&backendReadBuf, "backend-read-buf-size", 0, "The read buffer size per connection to the L1 and L2 memcached backends (bytes). Not used by the batched handler. 0 assumes the default of 4k.")
+	flag.IntVar(&backendWriteBuf, "backend-write-buf-size", 0, "The write buffer size per connection to the L1 and L2 memcached backends (bytes). Not used by the batched handler. 0 assumes the default of 4k.")
+	flag.DurationVar(&dialConf.Timeout, "backend-dial-timeout", 0, "Longest a single attempt at connecting to a backend may take. 0 leaves it to the operating system, which can take minutes for an address that doesn't answer.")
+	flag.IntVar(&dialConf.Retries, "backend-dial-retries", 0, "Number of times a failed backend connection attempt is retried before giving up")
+	flag.DurationVar(&dialConf.RetryBackoff, "backend-dial-retry-backoff", 10*time.Millisecond, "Wait before the first retry of a backend connection attempt, doubling for each one after")
+	flag.StringVar(&dialConf.Prefer, "backend-dial-prefer", "", "Address family a backend host's addresses are tried in first, ipv4 or ipv6. Empty uses the resolver's order.")
+	flag.DurationVar(&dialConf.FallbackDelay, "backend-dial-fallback-delay", 0, "How long a backend address gets to connect before the next one of the same host is tried alongside it (happy eyeballs). 0 is 300ms, and negative only tries the next one after a failure.")
+	flag.IntVar(&dialConf.Parallel, "backend-dial-parallel", 1, "Number of a backend host's addresses connected to at once, keeping the first to connect")
+	var tempDialRules string
+	flag.StringVar(&tempDialRules, "backend-dial-pools", "", "Comma separated dial settings for the backend pools whose addresses match a pattern, overriding the --backend-dial flags, e.g. 10.0.1.*:11211=timeout=100ms&retries=2,/var/run/*.sock=timeout=10ms. Settings are timeout, retries, retry_backoff, prefer, fallback_delay, and parallel.")
+	var tempChunkSizes string
+	flag.StringVar(&tempChunkSizes, "chunk-sizes", "", "Comma separated sizes in bytes of the chunks the --chunked handler splits values into, each the full size of an item in memcached. Each value is stored in the largest size its data fits in, so padding is kept below the size of the value. Items written with other sizes are still read. Defaults to a single size of 1184, which fits in memcached's slab class 12.")
+	flag.BoolVar(&proxyProtocol, "proxy-protocol", false, "Require a PROXY protocol (v1 or v2) header on every TCP connection, as sent by HAProxy and most L4 load balancers. The client address it carries is used for logging, --allowed-clients, and the client_conns and client_ops metrics.")
+	var tempAllowedClients string
+	flag.StringVar(&tempAllowedClients, "allowed-clients", "", "Comma separated list of networks in CIDR notation that clients must connect from, e.g. 10.0.0.0/8,127.0.0.1/32. Empty allows all.")
+	flag.DurationVar(&slowRequests, "slow-request-threshold", 0, "Log every request that takes at least this long, with its request ID, command and key. 0 disables the log.")
+	var tempLogLevel string
+	flag.StringVar(&tempLogLevel, "log-level", "info", "What is logged besides errors: error, info (slow, timed, and sampled requests), or debug (connections too). Can be changed at runtime at /admin/logging.")
+	flag.Float64Var(&logConf.AccessSampleRate, "access-log-sample-rate", 0, "Fraction of requests, between 0 and 1, logged with their request ID, command, key, and duration")
+	flag.StringVar(&logKeySecret, "log-key-secret", "", "Secret to HMAC keys with before they appear in logs, consistency reports, and prefix stats, or secret:<name> to get it from --secrets-provider, where it can be rotated. Hashes can be matched with keys at /admin/logging/keys. Empty logs keys as they are.")
+	flag.DurationVar(&logging.DefaultRevert, "log-revert-after", logging.DefaultRevert, "How long log settings changed at /admin/logging last before reverting, unless the change says otherwise")
+	flag.IntVar(&timingInterval, "timing-sample-interval", 0, "Log how long one in this many requests spent parsing, in L1, in L2, backfilling L1 and responding, with its request ID, command and key. 0 disables timing.")
+	flag.BoolVar(&echoRequestIDs, "echo-request-ids", false, "Send the request ID back with every error response: at the end of the error line in the text protocol and in the CAS field in the binary protocol.")
+	var tempStrictness, tempBatchStrictness string
+	var tempProfile, tempBatchProfile string
+	flag.StringVar(&tempStrictness, "strictness", "lenient", "How closely clients of the main listener are held to the memcached protocol: lenient accepts what memcached does along with rend's extensions, strict rejects anything the spec doesn't allow with an error saying what was wrong")
+	flag.StringVar(&tempBatchStrictness, "batch-strictness", "lenient", "Like --strictness, for the batch listener")
+	var tempQuietGets, tempBatchQuietGets string
+	flag.StringVar(&tempQuietGets, "quiet-get-errors", "error", "How the main listener answers the quiet keys of a get that a backend failed before answering: error fails the get, miss answers them as misses (reading through to L2 if L1 failed) so only keys that aren't quiet get the error. Only errors the backend answered with become misses; a broken backend connection or a timeout still fails the get and closes the connection.")
+	flag.StringVar(&tempBatchQuietGets, "batch-quiet-get-errors", "error", "Like --quiet-get-errors, for the batch listener")
+	flag.StringVar(&tempProfile, "client-profile", "none", "Client library whose memcached quirks the main listener reproduces: none, spymemcached, libmemcached, or php-memcached")
+	flag.IntVar(&zeroCopyMin, "zero-copy-min-size", 16*1024, "Write values of at least this many bytes to clients straight from the buffers they were read into, without copying them into the write buffer first. 0 copies every value.")
+	flag.StringVar(&tempBatchProfile, "batch-client-profile", "none", "Like --client-profile, for the batch listener")
+	var tempListenProtos, tempBatchProtos string
+	flag.StringVar(&tempListenProtos, "protocols", "", "Comma separated protocols the main listener serves, out of binary and text. Clients speaking any other protocol get an error in their own protocol and are disconnected. Empty serves both.")
+	flag.StringVar(&tempBatchProtos, "batch-protocols", "", "Like --protocols, for the batch listener")
+	var tempVBuckets string
+	flag.StringVar(&tempVBuckets, "vbuckets", "", "Comma separated vbucket IDs and ranges this instance owns, e.g. 0-511. Binary requests for other vbuckets get NOT_MY_VBUCKET. Empty serves every vbucket.")
+	flag.IntVar(&wsPort, "ws-port", 0, "Port to serve the WebSocket JSON protocol on, at the /ws path. 0 disables it.")
+	var tempWSOrigins string
+	flag.StringVar(&tempWSOrigins, "ws-allowed-origins", "", "Comma separated list of origins, e.g. https://tools.example.com, whose pages may open WebSocket connections besides the server's own. * allows any. Connections are also limited by --allowed-clients.")
+
+	flag.StringVar(&profileConf.Endpoint, "profile-endpoint", "", "URL of a continuous profiling service to upload pprof profiles to. Empty disables continuous profiling.")
+	flag.DurationVar(&profileConf.Interval, "profile-interval", time.Minute, "Time between profile captures")
+	flag.DurationVar(&profileConf.CPUDuration, "profile-cpu-duration", 10*time.Second, "Length of each CPU profile. 0 disables CPU profiles.")
+	flag.BoolVar(&profileConf.Heap, "profile-heap", true, "Capture heap profiles")
+	flag.Float64Var(&profileConf.SampleRate, "profile-sample-rate", 1, "Probability that any given interval is profiled, between 0 and 1")
+	flag.DurationVar(&watchdogConf.Interval, "watchdog-interval", 10*time.Second, "Time between checks for leaked goroutines and backend connections, reported at /admin/watchdog. 0 disables the watchdog.")
+	flag.DurationVar(&watchdogConf.MaxAge, "watchdog-max-age", time.Minute, "How long a goroutine passing get responses through can run before the watchdog reports it as leaked")
+	flag.IntVar(&watchdogConf.GoroutinesPerConn, "watchdog-goroutines-per-conn", 0, "Most goroutines each client connection is expected to need, beyond those running at startup. More are reported as a possible leak. 0 disables the check.")
+	flag.StringVar(&watchdogConf.DumpDir, "watchdog-dump-dir", "", "Directory the watchdog writes the stacks of every goroutine to when it finds a leak. Empty disables dumps.")
+	flag.DurationVar(&watchdogConf.DumpInterval, "watchdog-dump-interval", 10*time.Minute, "Least time between two goroutine dumps")
+	flag.IntVar(&gcConf.GCPercent, "gc-percent", 0, "Same as GOGC: the heap growth (percent) since the last collection that starts the next one. Negative turns the collector off. 0 keeps GOGC or the Go default. Can be changed at runtime by POSTing to /admin/gc.")
+	flag.Int64Var(&gcConf.MemoryLimit, "gc-memory-limit", 0, "Same as GOMEMLIMIT: a soft limit (bytes) on the memory used by the Go runtime, which makes the collector run more often as it gets close. 0 keeps GOMEMLIMIT or no limit.")
+	flag.IntVar(&gcConf.Ballast, "gc-ballast", 0, "Size (bytes) of an unused allocation that makes the collector run less often for little real memory. It counts towards --gc-memory-limit and the --shed-*-heap thresholds. 0 means no ballast.")
+	flag.IntVar(&profileConf.MemProfileRate, "profile-mem-rate", 0, "Overrides runtime.MemProfileRate, the average bytes allocated per heap profile sample. 0 keeps the Go default.")
+
+	flag.DurationVar(&consistencyInterval, "consistency-check-interval", 0, "Interval between background L1 / L2 consistency checks. 0 disables background checks, but checks can still be run on demand by POSTing to /consistency. Only used if L2 is enabled.")
+	flag.Float64Var(&consistencySampleRate, "consistency-sample-rate", 0.001, "Fraction of keys, between 0 and 1, eligible to be sampled for consistency checks")
+	flag.IntVar(&consistencySampleSize, "consistency-sample-size", 1000, "Maximum number of sampled keys compared in each consistency check")
+	flag.BoolVar(&consistencyRepair, "consistency-repair", false, "Delete keys from L1 that are found to be inconsistent with L2")
+
+	flag.StringVar(&prefixDelimiter, "prefix-stats-delimiter", "", "Single character that ends a key prefix, e.g. ':'. Estimated key counts, bytes, and value formats per prefix are reported in metrics and at /admin/prefixes. Empty disables prefix stats.")
+	flag.IntVar(&prefixConf.Depth, "prefix-stats-depth", 1, "How many delimiters a key prefix includes, e.g. 2 to group catalog:v3:item under catalog:v3:")
+	flag.Float64Var(&prefixConf.SampleRate, "prefix-stats-sample-rate", 0.01, "Fraction of keys, between 0 and 1, sampled for prefix stats")
+	flag.IntVar(&prefixConf.MaxPrefixes, "prefix-stats-max", 256, "Maximum number of prefixes tracked. Keys under any prefix after that are counted as (other).")
+
+	flag.DurationVar(&clockSkewMax, "clock-skew-max", 5*time.Second, "Largest difference allowed between the clock used for TTLs, the host's wall clock, and the clocks of memcached backends before it's logged and counted in clock_skew_alarms. 0 disables the skew checks.")
+	flag.DurationVar(&clockSkewInterval, "clock-skew-interval", time.Minute, "How often clocks are compared for --clock-skew-max")
+
+	flag.StringVar(&captureFile, "capture-file", "", "Record a sample of parsed requests, with anonymized keys, to this file for later replay. Empty disables capture.")
+	flag.Float64Var(&captureRate, "capture-sample-rate", 0.01, "Fraction of keys, between 0 and 1, whose requests are captured")
+	flag.StringVar(&captureSecret, "capture-secret", "", "Secret used to anonymize captured keys, or secret:<name> to get it from --secrets-provider. Empty uses a random secret, so keys can't be correlated across captures.")
+
+	flag.StringVar(&secretsConf, "secrets-provider", "", "Registered secrets provider that secret:<name> values of other arguments are looked up in, with optional configuration after a colon, e.g. env:REND_, file:/run/secrets, vault:addr=https://vault:8200, or kms:region=us-east-1&source=file:/etc/rend/encrypted")
+	flag.DurationVar(&secretsRefresh, "secrets-refresh", 5*time.Minute, "How often secrets that can be rotated while running are fetched again from --secrets-provider. 0 disables refreshing.")
+
+	flag.StringVar(&l1migrateTo, "l1-migrate-to", "", "Starts migrating L1 to the handler with this configuration, e.g. memcached:/tmp/new.sock. Writes go to both, reads fall back to the current L1, and the phase is controlled at /migration/l1. Empty disables migration.")
+	flag.StringVar(&l2migrateTo, "l2-migrate-to", "", "Starts migrating L2 to the handler with this configuration, like --l1-migrate-to. The phase is controlled at /migration/l2. Only used if L2 is enabled.")
+	flag.StringVar(&migrateKeysFile, "migrate-keys-file", "", "File with one key per line to copy to the new backend of every running migration")
+	flag.UintVar(&migrateCopyExptime, "migrate-copy-exptime", 0, "Expiration time given to keys copied by a migration from a backend that doesn't report one, like memcached (seconds). Every copied key gets it however long it had left. 0 means no expiration.")
+
+	var tempPeers, tempPeerSANs string
+	flag.StringVar(&peerListen, "peer-listen", "", "Address to receive L1 invalidations from peer rend instances on, e.g. :11213. This is UDP, or TCP with mutual TLS if --peer-tls-cert is given. Empty disables peer invalidation.")
+	flag.StringVar(&tempPeers, "peers", "", "Comma separated list of peer addresses (host:port) to broadcast L1 invalidations to. May include this instance. Only used with --peer-listen.")
+	flag.StringVar(&peerTLS.CertFile, "peer-tls-cert", "", "PEM certificate this instance presents to its peers. Setting it sends peer invalidations over mutual TLS.")
+	flag.StringVar(&peerTLS.KeyFile, "peer-tls-key", "", "PEM private key for --peer-tls-cert, or secret:<name> to get it from --secrets-provider")
+	flag.StringVar(&peerTLS.CAFile, "peer-tls-ca", "", "PEM CA certificate(s) that peer certificates must be signed by")
+	flag.StringVar(&tempPeerSANs, "peer-tls-allowed-sans", "", "Comma separated patterns, e.g. *.cache.example.com or spiffe://example.com/rend/*, matched against peer certificate DNS, IP, and URI SANs. Empty allows any certificate signed by --peer-tls-ca.")
+	flag.DurationVar(&peerTLS.Reload, "peer-tls-reload", time.Minute, "How often the peer TLS files are checked for rotated certificates. 0 disables reloading.")
+
+	flag.StringVar(&cdcSink, "cdc-sink", "", "Publishes every completed set, delete, and touch to this registered change data capture sink, with optional configuration after a colon, e.g. file:/var/log/rend/cdc.json or kafka:brokers=kafka1:9092&topic=rend-cdc. Empty disables CDC.")
+	flag.IntVar(&cdcOpts.BufferSize, "cdc-buffer-size", 10000, "Number of CDC events buffered while waiting for the sink before new ones are dropped")
+	flag.IntVar(&cdcOpts.BatchSize, "cdc-batch-size", 100, "Most CDC events handed to the sink at once")
+	flag.IntVar(&notifyPort, "notify-port", 0, "Port to stream keyspace notifications on, at the /notify path, for clients keeping near caches. Each ?prefix= parameter picks keys to be notified about. 0 disables notifications.")
+	flag.IntVar(&notifyBuffer, "notify-buffer", notify.DefaultBuffer, "Number of notifications a subscriber can fall behind by before they are dropped and it is told to start over")
+
+	flag.DurationVar(&refreshThreshold, "refresh-ahead-threshold", 0, "L1 hits with less than this much time to live may be refreshed from L2 in the background before they expire. Requires an L1 that supports gete. 0 disables refresh-ahead. Only used if L2 is enabled.")
+	flag.Float64Var(&refreshProbability, "refresh-ahead-probability", 1, "Chance that a hit is refreshed right at its expiry, between 0 and 1. The chance scales down linearly to 0 at --refresh-ahead-threshold.")
+	flag.IntVar(&refreshWorkers, "refresh-ahead-workers", 4, "Number of background workers refreshing keys, each with its own L1 and L2 connection")
+
+	flag.DurationVar(&stalePolicy.Window, "stale-window", 0, "Keep L1 entries this long past their TTL so they can still be served, stale, during L2 outages. 0 disables soft TTLs. Only used if L2 is enabled.")
+	flag.BoolVar(&stalePolicy.Revalidate, "stale-revalidate", false, "Serve stale L1 entries immediately while refreshing them in the background, instead of only when L2 fails")
+	flag.IntVar(&staleFlagBit, "stale-flag-bit", -1, "Bit (0-31) to set in the flags of stale values when they are served. -1 leaves flags unchanged.")
+
+	flag.StringVar(&l1hedgeTo, "l1-hedge-to", "", "Handler configuration of an alternate L1 with the same data, e.g. memcached:/tmp/replica.sock. Reads that take longer than --hedge-delay are also sent there and the first answer wins. Empty disables hedging.")
+	flag.StringVar(&l2hedgeTo, "l2-hedge-to", "", "Handler configuration of an alternate L2 to hedge reads against, like --l1-hedge-to. Only used if L2 is enabled.")
+	flag.DurationVar(&hedgeDelay, "hedge-delay", 2*time.Millisecond, "How long a read waits on the primary backend before it is hedged")
+
+	flag.StringVar(&l1replicas, "l1-replicas", "", "Comma separated zone=handler pairs of L1 replicas that each hold all the data, e.g. us-east-1a=memcached:/tmp/a.sock,us-east-1b=memcached:/tmp/b.sock. Replaces the L1 handler. Writes go to all of them and reads go to the best one, preferring --zone. Empty disables replicas.")
+	flag.StringVar(&l2replicas, "l2-replicas", "", "Comma separated zone=handler pairs of L2 replicas, like --l1-replicas. Replaces the L2 handler. Only used if L2 is enabled.")
+	flag.StringVar(&replicaConfig.Zone, "zone", "", "Zone this instance runs in. Replicas in the same zone are read from first.")
+	flag.DurationVar(&replicaConfig.CrossZonePenalty, "replica-cross-zone-penalty", 5*time.Millisecond, "Latency added to replicas in other zones when choosing where to read, so reads only leave the zone when the local replica is at least this much slower")
+	flag.DurationVar(&replicaConfig.Backoff, "replica-backoff", 10*time.Second, "How long a replica that failed is passed over for reads")
+	flag.IntVar(&replicaConfig.ReadQuorum, "replica-read-quorum", 1, "How many replicas each get asks at once. Above 1, the freshest value is returned and replicas that answered differently are repaired in the background.")
+	flag.DurationVar(&replicaConfig.AntiEntropy, "replica-anti-entropy-interval", 0, "Interval between background comparisons of a range of keys across every replica, repairing the replicas that differ. Needs replicas that can list their keys, like memcached. 0 disables it.")
+	flag.IntVar(&replicaConfig.AntiEntropyRanges, "replica-anti-entropy-ranges", 64, "Number of ranges the keys are split into for anti-entropy. Each comparison covers one, so every key is compared once every this many intervals.")
+	flag.IntVar(&replicaConfig.AntiEntropyBandwidth, "replica-anti-entropy-bandwidth", 1024*1024, "Maximum bytes per second of values read and written by anti-entropy. 0 is unlimited.")
+	var tempReplicaQueueDrop string
+	flag.IntVar(&replicaConfig.Queue, "replica-queue", 0, "Most writes each replica outside --zone can have waiting. Writes then only wait for the replicas in --zone, and are written to the others in order in the background, each at its own pace. 0 makes every write wait for every replica.")
+	flag.DurationVar(&replicaConfig.QueueMaxAge, "replica-queue-max-age", 0, "How long a write can wait in a replica's queue before it's dropped instead of written. 0 is no limit. Only used with --replica-queue.")
+	flag.StringVar(&tempReplicaQueueDrop, "replica-queue-drop", "newest", "Which write is dropped when a replica's queue is full: newest drops the write being queued, oldest the one that has waited the longest. Only used with --replica-queue.")
+
+	flag.StringVar(&l1discovery, "l1-discovery", "", "Registered discovery provider that finds the L1 backends, with its configuration after a colon, e.g. consul:service=memcached, etcd:prefix=/services/memcached/, kubernetes:service=memcached, or eureka:app=EVCACHE_USERS&urls=http://eureka:8080/eureka/v2. The healthy instances are used as replicas like --l1-replicas and kept up to date as they change. Empty disables discovery.")
+	flag.StringVar(&l2discovery, "l2-discovery", "", "Registered discovery provider that finds the L2 backends, like --l1-discovery. Only used if L2 is enabled.")
+	flag.StringVar(&discoveryHandler, "discovery-handler", "memcached", "Registered handler used for discovered backends, given each one's host:port as its configuration")
+	flag.DurationVar(&discoveryTimeout, "discovery-timeout", 30*time.Second, "How long to wait at startup for discovery to find the backends")
+
+	flag.StringVar(&l1shards, "l1-shards", "", "Comma separated L1 nodes that each hold part of the keys, in the form of twemproxy servers: address:weight with an optional space and name, e.g. 10.0.0.1:11211:2 cache1,10.0.0.2:11211:1 cache2. Replaces the L1 handler. Keys are spread over them by consistent hashing in proportion to their weights. Empty disables sharding.")
+	flag.StringVar(&l2shards, "l2-shards", "", "Comma separated L2 nodes that each hold part of the keys, like --l1-shards. Replaces the L2 handler. Only used if L2 is enabled.")
+	flag.StringVar(&shardHandler, "shard-handler", "memcached", "Registered handler used for shard nodes, given each one's address as its configuration")
+	flag.Float64Var(&shardConfig.LoadBound, "shard-load-bound", 1.25, "Most keys a shard node gets as a multiple of its fair share by weight, e.g. 1.25 for at most 25% over. 0 doesn't bound them.")
+	flag.StringVar(&shardConfig.Distribution, "shard-distribution", "bounded", "How keys are placed on the shard nodes: bounded for a consistent hash with a load bound, or ketama to place every key on the same node twemproxy's ketama distribution would, given the same servers in the same order")
+	flag.StringVar(&shardConfig.Hash, "shard-hash", "fnv1a_64", "Key hash for the ketama distribution, like twemproxy's hash: md5, fnv1_64, fnv1a_64, fnv1_32, fnv1a_32, crc32, crc32a, or one_at_a_time")
+	flag.StringVar(&shardConfig.HashTag, "shard-hash-tag", "", "Two characters, like twemproxy's hash_tag, marking the part of a key that's hashed to pick its shard node, e.g. {} so user{1}:a and user{1}:b land together. Empty hashes whole keys.")
+	flag.StringVar(&shardConfig.PartialFailures, "shard-partial-failures", "error", "What a multi-key get does when some of the shard nodes fail: error to fail the whole get, or miss to answer the failed nodes' keys as misses and serve the rest")
+
+	flag.DurationVar(&tombstoneTTL, "tombstone-ttl", 10*time.Second, "How long deleted keys are remembered so that L1 backfills, refreshes, and replica repairs that read the key before the delete don't bring it back. 0 disables tombstones.")
+	flag.IntVar(&tombstoneMax, "tombstone-max", 100000, "Most deleted keys remembered at once. The oldest are forgotten first.")
+
+	flag.StringVar(&l1standby, "l1-standby", "", "Standby for L1 that takes its requests while it's down, as a handler configuration, e.g. memcached:10.0.1.1:11211. The status is at /admin/failover/l1, where a POST with active=primary or active=standby switches by hand. Empty disables failover.")
+	flag.StringVar(&l2standby, "l2-standby", "", "Standby for L2 that takes its requests while it's down, like --l1-standby. The status is at /admin/failover/l2. Only used if L2 is enabled.")
+	flag.IntVar(&failoverConfig.Threshold, "failover-threshold", 3, "Requests in a row that have to fail on a backend with a standby to fail over")
+	flag.DurationVar(&failoverConfig.Probe, "failover-probe", time.Second, "How often a backend that was failed over is checked")
+	flag.StringVar(&failBack, "failback", "auto", "How to fail back once a backend that was failed over is healthy again: auto after --failback-delay, or manual through its admin endpoint")
+	flag.DurationVar(&failoverConfig.FailBackDelay, "failback-delay", 30*time.Second, "How long a backend that was failed over has to stay healthy before failing back automatically")
+	flag.IntVar(&failoverConfig.Repair, "failover-repair-keys", 100000, "Most keys written during a failover that are deleted from both backends when failing back, so neither serves stale values")
+	flag.IntVar(&deleteRetries.Attempts, "l2-delete-retries", 0, "Times an L2 delete that failed because of the backend, e.g. with a timeout, is retried in the background, deleting the key from L2 and then L1. 0 disables retries.")
+	flag.DurationVar(&deleteRetries.Backoff, "l2-delete-retry-backoff", 100*time.Millisecond, "How long a failed L2 delete waits before its first retry. It doubles after every failed retry.")
+	flag.DurationVar(&deleteRetries.MaxBackoff, "l2-delete-retry-max-backoff", 30*time.Second, "Longest a failed L2 delete waits between retries")
+	flag.IntVar(&deleteRetries.Max, "l2-delete-queue-max", 100000, "Most failed L2 deletes waiting to be retried. Past that, more failures aren't retried.")
+	flag.StringVar(&deleteRetries.Path, "l2-delete-queue-file", "", "File the failed L2 deletes waiting to be retried are saved to every second and loaded from at startup, so a restart doesn't lose them. Empty keeps them in memory only.")
+
+	flag.BoolVar(&chaosEnabled, "chaos", false, "Wrap L1 and L2 in fault injection for trying out failure handling. Faults are configured at /admin/chaos/l1 and /admin/chaos/l2 and nothing is injected until they are.")
+
+	flag.DurationVar(&budgetPolicy.Total, "budget", 0, "Total latency budget for each request across L1 and L2. Backend operations that run out of budget are abandoned. 0 disables budgets.")
+	flag.DurationVar(&budgetPolicy.L1, "budget-l1", 0, "Most of the budget a single L1 operation may use, leaving the rest for L2. L1 reads that run out are treated as misses. 0 lets L1 use the whole budget.")
+
+	var tempBatchPrefixes, tempInteractivePrefixes string
+	flag.IntVar(&priorityConcurrency, "priority-concurrency", 0, "Maximum concurrent backend operations. When saturated, interactive traffic goes ahead of batch traffic. Traffic on --bp is batch and everything else is interactive unless a prefix says otherwise. 0 disables prioritization.")
+	flag.StringVar(&tempBatchPrefixes, "priority-batch-prefixes", "", "Comma separated key prefixes that are always batch traffic, e.g. warm:,precompute:")
+	flag.StringVar(&tempInteractivePrefixes, "priority-interactive-prefixes", "", "Comma separated key prefixes that are always interactive traffic")
+
+	var tempQuotas string
+	flag.StringVar(&tempQuotas, "quotas", "", "Semicolon separated byte quotas on the keys stored under groups of prefixes, each as [tenant=]prefix[,prefix...]:bytes[:reject|evict], e.g. search=search:,rank::10000000000;ads::1000000000:evict. A tenant over its quota has writes rejected, or its own oldest keys deleted to make room in evict mode.")
+
+	flag.IntVar(&sizePolicy.L1Max, "l1-max-value-size", 0, "Values larger than this (bytes) skip L1 and are only stored in L2. 0 means no limit. Only used if L2 is enabled.")
+	flag.IntVar(&sizePolicy.L1OnlyMax, "l1-only-max-value-size", 0, "Values up to this size (bytes) are only stored in L1 and skip L2. 0 stores every value in L2. Only used if L2 is enabled.")
+	flag.IntVar(&l1OnlyFlagBit, "l1-only-flag-bit", -1, "Bit (0-31) of the flags that clients set on values to only store them in L1. -1 disables the hint. Only used if L2 is enabled.")
+	flag.IntVar(&l2OnlyFlagBit, "l2-only-flag-bit", -1, "Bit (0-31) of the flags that clients set on values to only store them in L2, without copying them into L1 on reads. -1 disables the hint. Only used if L2 is enabled.")
+	flag.IntVar(&replicateFlagBit, "replicate-flag-bit", -1, "Bit (0-31) of the flags that clients set on values to store them in both L1 and L2, whatever their size or other hints. -1 disables the hint. Only used if L2 is enabled.")
+	flag.IntVar(&noChunkFlagBit, "no-chunk-flag-bit", -1, "Bit (0-31) of the flags that clients set on values to have the chunked L1 write them in one piece of exactly their size, if it fits in a memcached item. -1 disables the hint.")
+	flag.IntVar(&batchSizePolicy.L1Max, "bp-l1-max-value-size", 0, "Same as --l1-max-value-size for the batch port")
+	flag.IntVar(&batchSizePolicy.L1OnlyMax, "bp-l1-only-max-value-size", 0, "Same as --l1-only-max-value-size for the batch port")
+	flag.IntVar(&batchGetSplit.MaxKeys, "bp-get-max-keys", 0, "Multigets on the batch port with more keys than this are sent to the backends in batches of this many, and answered in order as if they were sent whole. 0 sends every get whole.")
+	flag.IntVar(&batchGetSplit.Parallel, "bp-get-parallel", 4, "How many batches of one split multiget on the batch port are sent at once, each on a backend connection of its own. Only used if --bp-get-max-keys is set.")
+	flag.IntVar(&backfillPolicy.MaxSize, "backfill-max-size", 0, "Values larger than this (bytes) read from L2 on an L1 miss are served without being copied into L1. Unlike --l1-max-value-size, sets still store them in L1. 0 means no limit.")
+	flag.IntVar(&backfillPolicy.MinHits, "backfill-min-hits", 0, "Values read from L2 on an L1 miss are only copied into L1 once their key has been read this many times recently, counting the read being served. 0 or 1 copies every value.")
+
+	var tempMode, tempFlushScope string
+	flag.StringVar(&tempMode, "mode", "normal", "Starting mode: normal, read-only (reject writes), write-only (every read misses, for warming), or maintenance (reject everything). Can be changed at runtime by POSTing to /admin/mode.")
+	flag.StringVar(&tempFlushScope, "flush-scope", "both", "Which tiers a binary flush empties: both (L2 and then L1), l1, or l2")
+	flag.StringVar(&maintenanceMessage, "maintenance-message", "maintenance", "Error message sent to clients in maintenance mode")
+
+	flag.Uint64Var(&shedPolicy.LargeSetHeap, "shed-large-sets-heap", 0, "Heap size (bytes) above which writes larger than --shed-large-set-size are rejected. 0 disables this stage.")
+	flag.IntVar(&shedPolicy.LargeSet, "shed-large-set-size", 64*1024, "Largest value (bytes) accepted while shedding large sets")
+	flag.Uint64Var(&shedPolicy.MultigetHeap, "shed-multigets-heap", 0, "Heap size (bytes) above which gets for more than --shed-multiget-keys keys are rejected, along with large sets. 0 disables this stage.")
+	flag.IntVar(&shedPolicy.MultigetKeys, "shed-multiget-keys", 10, "Most keys a get may ask for while shedding multigets")
+	flag.Uint64Var(&shedPolicy.WritesHeap, "shed-writes-heap", 0, "Heap size (bytes) above which every write is rejected, along with large multigets. Deletes and touches are still served. 0 disables this stage.")
+	flag.DurationVar(&shedInterval, "shed-interval", time.Second, "How often the heap size is checked for load shedding")
+
+	flag.BoolVar(&selfTest, "selftest", false, "Start up as usual, run a short suite of operations against every listener, print the results, and exit with a non-zero status if any failed. The same suite can be run against a live instance by requesting /admin/selftest.")
+	flag.IntVar(&warmConns, "backend-warm-conns", 0, "Backend connections to L1 and to L2 that are made and checked ahead of time, before the listeners start, so new client connections don't wait for them. Each one handed out is replaced in the background. 0 disables warm-up.")
+	flag.DurationVar(&warmTimeout, "backend-warm-timeout", 10*time.Second, "Longest the listeners wait for backend warm-up. They start anyway afterwards, while /admin/ready reports not ready until warm-up succeeds.")
+	flag.DurationVar(&healthInterval, "health-check-interval", 5*time.Second, "How often the backends and other dependencies reported at /admin/health are checked. A check that takes longer fails.")
+	flag.DurationVar(&selfTestTimeout, "selftest-timeout", 10*time.Second, "Time limit for the self test against each listener, including waiting for it to start")
 
 	flag.Parse()
 
@@ -147,6 +557,304 @@ func init() {
 		os.Exit(-1)
 	}
 
+	if l2handler != "" {
+		l2enabled = true
+	}
+	if name, _ := handlers.SplitSpec(l1handler); name == "chunked" {
+		chunked = true
+	}
+
+	if tempChunkSizes != "" {
+		var err error
+		if chunkSizes, err = memcached.ParseChunkSizes(tempChunkSizes); err != nil {
+			fmt.Println("ERROR: argument --chunk-sizes:", err.Error())
+			os.Exit(-1)
+		}
+	}
+
+	if tempAllowedClients != "" {
+		for _, cidr := range strings.Split(tempAllowedClients, ",") {
+			_, n, err := net.ParseCIDR(strings.TrimSpace(cidr))
+			if err != nil {
+				fmt.Println("ERROR: argument --allowed-clients:", err.Error())
+				os.Exit(-1)
+			}
+			allowedClients = append(allowedClients, n)
+		}
+	}
+
+	if tempWSOrigins != "" {
+		for _, o := range strings.Split(tempWSOrigins, ",") {
+			wsOrigins = append(wsOrigins, strings.TrimSpace(o))
+		}
+	}
+
+	if tempPeers != "" {
+		for _, p := range strings.Split(tempPeers, ",") {
+			peerAddrs = append(peerAddrs, strings.TrimSpace(p))
+		}
+	}
+	if tempPeerSANs != "" {
+		for _, p := range strings.Split(tempPeerSANs, ",") {
+			peerTLS.AllowedSANs = append(peerTLS.AllowedSANs, strings.TrimSpace(p))
+		}
+	}
+
+	priorityRules = append(priority.ParseRules(tempInteractivePrefixes, priority.Interactive),
+		priority.ParseRules(tempBatchPrefixes, priority.Batch)...)
+
+	if sizePolicy.L1Max < 0 || sizePolicy.L1OnlyMax < 0 || batchSizePolicy.L1Max < 0 || batchSizePolicy.L1OnlyMax < 0 {
+		fmt.Println("ERROR: value size limits must be >= 0")
+		os.Exit(-1)
+	}
+	if backfillPolicy.MaxSize < 0 || backfillPolicy.MinHits < 0 {
+		fmt.Println("ERROR: arguments --backfill-max-size and --backfill-min-hits must be >= 0")
+		os.Exit(-1)
+	}
+
+	var err error
+	if mode, err = orcas.ParseMode(tempMode); err != nil {
+		fmt.Println("ERROR: argument --mode:", err.Error())
+		os.Exit(-1)
+	}
+	if orcas.FlushTiers, err = orcas.ParseFlushScope(tempFlushScope); err != nil {
+		fmt.Println("ERROR: argument --flush-scope:", err.Error())
+		os.Exit(-1)
+	}
+
+	if strictness, err = protocol.ParseStrictness(tempStrictness); err != nil {
+		fmt.Println("ERROR: argument --strictness:", err.Error())
+		os.Exit(-1)
+	}
+	if batchStrictness, err = protocol.ParseStrictness(tempBatchStrictness); err != nil {
+		fmt.Println("ERROR: argument --batch-strictness:", err.Error())
+		os.Exit(-1)
+	}
+	if quietGets, err = orcas.ParseQuietGetErrors(tempQuietGets); err != nil {
+		fmt.Println("ERROR: argument --quiet-get-errors:", err.Error())
+		os.Exit(-1)
+	}
+	if batchQuietGets, err = orcas.ParseQuietGetErrors(tempBatchQuietGets); err != nil {
+		fmt.Println("ERROR: argument --batch-quiet-get-errors:", err.Error())
+		os.Exit(-1)
+	}
+	if quirks, err = protocol.ParseProfile(tempProfile); err != nil {
+		fmt.Println("ERROR: argument --client-profile:", err.Error())
+		os.Exit(-1)
+	}
+	if batchQuirks, err = protocol.ParseProfile(tempBatchProfile); err != nil {
+		fmt.Println("ERROR: argument --batch-client-profile:", err.Error())
+		os.Exit(-1)
+	}
+	protos := []protocol.Components{binprot.Components, textprot.Components}
+	if listenProtos, err = protocol.ParseNames(tempListenProtos, protos); err != nil {
+		fmt.Println("ERROR: argument --protocols:", err.Error())
+		os.Exit(-1)
+	}
+	if batchProtos, err = protocol.ParseNames(tempBatchProtos, protos); err != nil {
+		fmt.Println("ERROR: argument --batch-protocols:", err.Error())
+		os.Exit(-1)
+	}
+	if vbuckets, err = protocol.ParseVBuckets(tempVBuckets); err != nil {
+		fmt.Println("ERROR: argument --vbuckets:", err.Error())
+		os.Exit(-1)
+	}
+	if quotas, err = quota.Parse(tempQuotas); err != nil {
+		fmt.Println("ERROR: argument --quotas:", err.Error())
+		os.Exit(-1)
+	}
+	if replicaConfig.QueueDrop, err = replicas.ParseDropPolicy(tempReplicaQueueDrop); err != nil {
+		fmt.Println("ERROR: argument --replica-queue-drop:", err.Error())
+		os.Exit(-1)
+	}
+	if err = pool.SetDefaultDialConfig(dialConf); err != nil {
+		fmt.Println("ERROR: backend dial settings:", err.Error())
+		os.Exit(-1)
+	}
+	if err = pool.ParseDialRules(dialConf, tempDialRules); err != nil {
+		fmt.Println("ERROR: argument --backend-dial-pools:", err.Error())
+		os.Exit(-1)
+	}
+	if logConf.Level, err = logging.ParseLevel(tempLogLevel); err != nil {
+		fmt.Println("ERROR: argument --log-level:", err.Error())
+		os.Exit(-1)
+	}
+	if err = logging.Configure(logConf); err != nil {
+		fmt.Println("ERROR: argument --access-log-sample-rate:", err.Error())
+		os.Exit(-1)
+	}
+	if logging.DefaultRevert < 0 {
+		fmt.Println("ERROR: argument --log-revert-after must be >= 0")
+		os.Exit(-1)
+	}
+
+	if priorityConcurrency < 0 {
+		fmt.Println("ERROR: argument --priority-concurrency must be >= 0")
+		os.Exit(-1)
+	}
+
+	if readBufSize < 0 || writeBufSize < 0 || backendReadBuf < 0 || backendWriteBuf < 0 {
+		fmt.Println("ERROR: buffer sizes must be >= 0")
+		os.Exit(-1)
+	}
+
+	if consistencySampleRate <= 0 || consistencySampleRate > 1 || consistencySampleSize <= 0 {
+		fmt.Println("ERROR: consistency sample rate must be in (0, 1] and sample size must be > 0")
+		os.Exit(-1)
+	}
+
+	if prefixDelimiter != "" {
+		if len(prefixDelimiter) != 1 || prefixConf.Depth < 1 || prefixConf.SampleRate <= 0 || prefixConf.SampleRate > 1 || prefixConf.MaxPrefixes < 1 {
+			fmt.Println("ERROR: prefix stats delimiter must be a single character, depth and max must be >= 1 and sample rate must be in (0, 1]")
+			os.Exit(-1)
+		}
+		prefixConf.Delimiter = prefixDelimiter[0]
+	}
+
+	if refreshProbability < 0 || refreshProbability > 1 || refreshWorkers < 1 {
+		fmt.Println("ERROR: refresh-ahead probability must be in [0, 1] and workers must be >= 1")
+		os.Exit(-1)
+	}
+
+	if count(l1discovery, l1replicas, l1shards) > 1 || count(l2discovery, l2replicas, l2shards) > 1 {
+		fmt.Println("ERROR: only one of discovery, replicas, and shards can be given for the same tier")
+		os.Exit(-1)
+	}
+
+	if discoveryTimeout <= 0 {
+		fmt.Println("ERROR: argument --discovery-timeout must be > 0")
+		os.Exit(-1)
+	}
+
+	if replicaConfig.CrossZonePenalty < 0 || replicaConfig.Backoff < 0 {
+		fmt.Println("ERROR: argument --replica-cross-zone-penalty and --replica-backoff must be >= 0")
+		os.Exit(-1)
+	}
+
+	if replicaConfig.ReadQuorum < 1 {
+		fmt.Println("ERROR: argument --replica-read-quorum must be >= 1")
+		os.Exit(-1)
+	}
+
+	if replicaConfig.AntiEntropy < 0 || replicaConfig.AntiEntropyRanges < 1 || replicaConfig.AntiEntropyBandwidth < 0 {
+		fmt.Println("ERROR: argument --replica-anti-entropy-interval and --replica-anti-entropy-bandwidth must be >= 0 and --replica-anti-entropy-ranges must be >= 1")
+		os.Exit(-1)
+	}
+	if replicaConfig.Queue < 0 || replicaConfig.QueueMaxAge < 0 {
+		fmt.Println("ERROR: argument --replica-queue and --replica-queue-max-age must be >= 0")
+		os.Exit(-1)
+	}
+
+	if limits.MaxBytes < 0 || limits.MaxItems < 0 || limits.ReclaimRate < 0 {
+		fmt.Println("ERROR: argument --inmem-max-bytes, --inmem-max-items, and --inmem-reclaim-rate must be >= 0")
+		os.Exit(-1)
+	}
+
+	if limits.OffHeapBytes < 0 || limits.OffHeapMinSize < 1 {
+		fmt.Println("ERROR: argument --inmem-offheap-bytes must be >= 0 and --inmem-offheap-min-size must be >= 1")
+		os.Exit(-1)
+	}
+
+	if limits.Shards < 1 || limits.Shards > inmem.MaxShards {
+		fmt.Printf("ERROR: argument --inmem-shards must be between 1 and %d\n", inmem.MaxShards)
+		os.Exit(-1)
+	}
+
+	if wal.SegmentSize <= 0 || wal.MaxSegments < 1 || wal.SyncInterval < 0 {
+		fmt.Println("ERROR: argument --inmem-wal-segment-size must be > 0, --inmem-wal-max-segments must be >= 1, and --inmem-wal-sync must be >= 0")
+		os.Exit(-1)
+	}
+
+	if tombstoneTTL < 0 || tombstoneMax < 1 {
+		fmt.Println("ERROR: argument --tombstone-ttl must be >= 0 and --tombstone-max must be >= 1")
+		os.Exit(-1)
+	}
+
+	if failoverConfig.Threshold < 1 || failoverConfig.Probe <= 0 || failoverConfig.FailBackDelay < 0 || failoverConfig.Repair < 0 {
+		fmt.Println("ERROR: argument --failover-threshold and --failover-probe must be > 0, and --failback-delay and --failover-repair-keys must be >= 0")
+		os.Exit(-1)
+	}
+	switch failBack {
+	case "auto":
+	case "manual":
+		failoverConfig.ManualFailBack = true
+	default:
+		fmt.Println("ERROR: argument --failback must be auto or manual")
+		os.Exit(-1)
+	}
+
+	if clockSkewMax < 0 || clockSkewInterval <= 0 {
+		fmt.Println("ERROR: argument --clock-skew-max must be >= 0 and --clock-skew-interval must be > 0")
+		os.Exit(-1)
+	}
+
+	if batchGetSplit.MaxKeys < 0 || batchGetSplit.Parallel < 1 {
+		fmt.Println("ERROR: argument --bp-get-max-keys must be >= 0 and --bp-get-parallel must be >= 1")
+		os.Exit(-1)
+	}
+
+	if healthInterval <= 0 {
+		fmt.Println("ERROR: argument --health-check-interval must be > 0")
+		os.Exit(-1)
+	}
+
+	if warmConns < 0 || warmTimeout <= 0 {
+		fmt.Println("ERROR: argument --backend-warm-conns must be >= 0 and --backend-warm-timeout must be > 0")
+		os.Exit(-1)
+	}
+
+	if shedInterval <= 0 || shedPolicy.LargeSet < 0 || shedPolicy.MultigetKeys < 0 {
+		fmt.Println("ERROR: shed interval must be > 0 and the shed large set size and multiget keys must be >= 0")
+		os.Exit(-1)
+	}
+
+	if staleFlagBit < -1 || staleFlagBit > 31 {
+		fmt.Println("ERROR: argument --stale-flag-bit must be between -1 and 31")
+		os.Exit(-1)
+	}
+	if staleFlagBit >= 0 {
+		var err error
+		if stalePolicy.FlagMask, err = common.ReserveFlagBit(common.FlagStale, staleFlagBit); err != nil {
+			fmt.Println("ERROR: argument --stale-flag-bit:", err.Error())
+			os.Exit(-1)
+		}
+	}
+
+	// The chunked handler looks up the no-chunk bit itself, so its mask isn't kept
+	for _, c := range []struct {
+		name string
+		bit  int
+		mask *uint32
+	}{
+		{common.FlagL1Only, l1OnlyFlagBit, &classPolicy.L1Only},
+		{common.FlagL2Only, l2OnlyFlagBit, &classPolicy.L2Only},
+		{common.FlagReplicate, replicateFlagBit, &classPolicy.Replicate},
+		{common.FlagNoChunk, noChunkFlagBit, new(uint32)},
+	} {
+		if c.bit < -1 || c.bit > 31 {
+			fmt.Printf("ERROR: argument --%s-flag-bit must be between -1 and 31\n", c.name)
+			os.Exit(-1)
+		}
+		if c.bit >= 0 {
+			var err error
+			if *c.mask, err = common.ReserveFlagBit(c.name, c.bit); err != nil {
+				fmt.Printf("ERROR: argument --%s-flag-bit: %s\n", c.name, err.Error())
+				os.Exit(-1)
+			}
+		}
+	}
+	sizePolicy.Exempt = classPolicy.Replicate
+	batchSizePolicy.Exempt = classPolicy.Replicate
+
+	if echoRequestIDs {
+		common.RegisterExtension(common.Extension{Name: "request_ids", Version: 1})
+	}
+
+	if acceptors < 1 {
+		fmt.Println("ERROR: argument --acceptors must be >= 1")
+		os.Exit(-1)
+	}
+
 	if concurrency >= 64 {
 		fmt.Println("ERROR: Concurrency cannot be more than 2^64")
 		os.Exit(-1)
@@ -165,17 +873,100 @@ func init() {
 
 // And away we go
 func main() {
+	var secretsProvider secrets.Provider
+	if secretsConf != "" {
+		var err error
+		if secretsProvider, err = secrets.FromConfig(secretsConf); err != nil {
+			fmt.Println("ERROR: argument --secrets-provider:", err.Error())
+			os.Exit(-1)
+		}
+	}
+	secret := func(arg, val string, refresh time.Duration) *secrets.Value {
+		v, err := secrets.Resolve(secretsProvider, val, refresh)
+		if err != nil {
+			fmt.Printf("ERROR: argument --%s: %s\n", arg, err.Error())
+			os.Exit(-1)
+		}
+		return v
+	}
+
+	var rec *capture.Recorder
+	if captureFile != "" {
+		// Changing the secret partway through would break correlating keys, so it isn't refreshed
+		var err error
+		if rec, err = capture.NewRecorder(captureFile, captureRate, secret("capture-secret", captureSecret, 0).Get()); err != nil {
+			fmt.Println("ERROR: traffic capture:", err.Error())
+			os.Exit(-1)
+		}
+	}
+
+	if logKeySecret != "" {
+		logging.SetKeySecret(secret("log-key-secret", logKeySecret, secretsRefresh).Get)
+	}
+
 	var l server.ListenArgs
 
 	if useDomainSocket {
 		l = server.ListenArgs{
-			Type: server.ListenUnix,
-			Path: sockPath,
+			Type:                 server.ListenUnix,
+			Path:                 sockPath,
+			ReadBufSize:          readBufSize,
+			WriteBufSize:         writeBufSize,
+			AdaptiveBuffers:      adaptiveBufs,
+			Capture:              rec,
+			SlowRequestThreshold: slowRequests,
+			TimingSampleInterval: timingInterval,
+			EchoRequestIDs:       echoRequestIDs,
+			Strictness:           strictness,
+			VBuckets:             vbuckets,
+			Protocols:            listenProtos,
+			Quirks:               quirks,
+			ZeroCopyMin:          zeroCopyMin,
 		}
 	} else {
 		l = server.ListenArgs{
-			Type: server.ListenTCP,
-			Port: port,
+			Type:                 server.ListenTCP,
+			Port:                 port,
+			Acceptors:            acceptors,
+			ReadBufSize:          readBufSize,
+			WriteBufSize:         writeBufSize,
+			AdaptiveBuffers:      adaptiveBufs,
+			Capture:              rec,
+			SlowRequestThreshold: slowRequests,
+			TimingSampleInterval: timingInterval,
+			EchoRequestIDs:       echoRequestIDs,
+			ProxyProtocol:        proxyProtocol,
+			AllowedClients:       allowedClients,
+			Strictness:           strictness,
+			VBuckets:             vbuckets,
+			Protocols:            listenProtos,
+			Quirks:               quirks,
+			ZeroCopyMin:          zeroCopyMin,
+		}
+	}
+
+	gc := gctune.NewTuner()
+	if err := gc.Apply(gcConf); err != nil {
+		fmt.Println("ERROR: GC settings:", err.Error())
+		os.Exit(-1)
+	}
+	admin.Handle("gc", gc)
+	admin.Handle("conns", server.ConnsHandler)
+	admin.Handle("logging", logging.Handler)
+	admin.Handle("logging/keys", logging.KeyHandler)
+	admin.Handle("logging/traces", logging.TraceHandler)
+	admin.Handle("flags", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(common.DefaultFlagBits.Reservations())
+	}))
+
+	if profileConf.Endpoint != "" {
+		host, _ := os.Hostname()
+		profileConf.Labels = map[string]string{"host": host}
+
+		if err := profiling.Start(profileConf); err != nil {
+			fmt.Println("ERROR: continuous profiling:", err.Error())
+			os.Exit(-1)
 		}
 	}
 
@@ -185,25 +976,311 @@ func main() {
 	var h2 handlers.HandlerConst
 	var h1 handlers.HandlerConst
 
+	ready := admin.NewReadiness("starting")
+	admin.Handle("ready", ready)
+	health = admin.NewHealth(ready)
+
+	var hub *notify.Hub
+	if notifyPort > 0 {
+		hub = notify.NewHub(notifyBuffer)
+		limits.OnExpire = hub.Expired("inmem")
+	}
+
+	// The in-memory cache is shared by everything that uses it, so it's set up once up front
+	if err := inmem.Configure(limits); err != nil {
+		fmt.Println("ERROR: could not configure the in-memory cache:", err.Error())
+		os.Exit(-1)
+	}
+	if wal.Dir != "" {
+		if err := inmem.OpenWAL(wal); err != nil {
+			fmt.Println("ERROR: could not open the in-memory WAL:", err.Error())
+			os.Exit(-1)
+		}
+	}
+	if restore != "" {
+		n, err := inmem.RestoreFile(restore)
+		if os.IsNotExist(err) {
+			log.Printf("No in-memory snapshot at %s, starting empty\n", restore)
+		} else if err != nil {
+			fmt.Println("ERROR: could not restore the in-memory snapshot:", err.Error())
+			os.Exit(-1)
+		} else {
+			log.Printf("Restored %d entries from the in-memory snapshot %s\n", n, restore)
+		}
+	}
+	admin.Handle("inmem/snapshot", inmem.SnapshotHandler)
+	admin.Handle("inmem/restore", inmem.RestoreHandler)
+
 	// Choose the proper L1 handler
-	if l1inmem {
+	if l1handler != "" {
+		h1 = handlerFromConfig("--l1-handler", l1handler)
+	} else if l1inmem {
 		h1 = inmem.New
 	} else if chunked {
-		h1 = memcached.Chunked(l1sock)
+		h1 = memcached.ChunkedTiers(l1sock, backendReadBuf, backendWriteBuf, chunkSizes)
 	} else if l1batched {
 		h1 = memcached.Batched(l1sock, batchOpts)
 	} else {
-		h1 = memcached.Regular(l1sock)
+		h1 = memcached.RegularBufSize(l1sock, backendReadBuf, backendWriteBuf)
 	}
 
 	if l2enabled {
 		o = orcas.L1L2
-		h2 = memcached.Regular(l2sock)
+		if l2handler != "" {
+			h2 = handlerFromConfig("--l2-handler", l2handler)
+		} else {
+			h2 = memcached.RegularBufSize(l2sock, backendReadBuf, backendWriteBuf)
+		}
 	} else {
 		o = orcas.L1Only
 		h2 = handlers.NilHandler
 	}
 
+	var tombstones *tombstone.Set
+	if tombstoneTTL > 0 {
+		tombstones = tombstone.New(tombstoneTTL, tombstoneMax)
+		replicaConfig.Tombstones = tombstones
+	}
+
+	if l1replicas != "" {
+		h1 = replicaGroup("--l1-replicas", l1replicas)
+	}
+	if l2enabled && l2replicas != "" {
+		h2 = replicaGroup("--l2-replicas", l2replicas)
+	}
+
+	if l1shards != "" {
+		h1 = shardGroup("--l1-shards", l1shards)
+	}
+	if l2enabled && l2shards != "" {
+		h2 = shardGroup("--l2-shards", l2shards)
+	}
+
+	if l1discovery != "" {
+		h1 = discover("l1", "--l1-discovery", l1discovery)
+	}
+	if l2enabled && l2discovery != "" {
+		h2 = discover("l2", "--l2-discovery", l2discovery)
+	}
+
+	if chaosEnabled {
+		h1 = injectChaos("l1", h1)
+		if l2enabled {
+			h2 = injectChaos("l2", h2)
+		}
+	}
+
+	if l1standby != "" {
+		h1 = failOver("l1", h1, handlerFromConfig("--l1-standby", l1standby))
+	}
+	if l2enabled && l2standby != "" {
+		h2 = failOver("l2", h2, handlerFromConfig("--l2-standby", l2standby))
+	}
+
+	if l1hedgeTo != "" {
+		h1 = hedged.New(h1, handlerFromConfig("--l1-hedge-to", l1hedgeTo), hedgeDelay)
+	}
+	if l2enabled && l2hedgeTo != "" {
+		h2 = hedged.New(h2, handlerFromConfig("--l2-hedge-to", l2hedgeTo), hedgeDelay)
+	}
+
+	if l1migrateTo != "" {
+		h1 = migrate("l1", h1, handlerFromConfig("--l1-migrate-to", l1migrateTo))
+	}
+	if l2enabled && l2migrateTo != "" {
+		h2 = migrate("l2", h2, handlerFromConfig("--l2-migrate-to", l2migrateTo))
+	}
+
+	if l2enabled && deleteRetries.Attempts > 0 {
+		q, err := deleteq.New(deleteRetries, h2, h1)
+		if err != nil {
+			fmt.Println("ERROR: argument --l2-delete-queue-file:", err.Error())
+			os.Exit(-1)
+		}
+		h2 = q.Handler(h2)
+		admin.Handle("deletes", q)
+	}
+
+	purger := admin.NewPurger()
+	purger.Add("l1", h1)
+	if l2enabled {
+		purger.Add("l2", h2)
+	}
+	admin.Handle("purge", purger)
+
+	if clockSkewMax > 0 {
+		guard := clock.NewSkewGuard(clockSkewMax)
+		guard.Add("l1", serverTime(h1))
+		if l2enabled {
+			guard.Add("l2", serverTime(h2))
+		}
+		go guard.Watch(clockSkewInterval)
+	}
+
+	health.AddDependency("l1", true, ping(h1))
+	if l2enabled {
+		health.AddDependency("l2", true, ping(h2))
+	}
+
+	var warmers []*handlers.Warmer
+	if warmConns > 0 {
+		w1 := handlers.NewWarmer("L1", h1, warmConns)
+		h1 = w1.Handler
+		warmers = append(warmers, w1)
+		if l2enabled {
+			w2 := handlers.NewWarmer("L2", h2, warmConns)
+			h2 = w2.Handler
+			warmers = append(warmers, w2)
+		}
+	}
+
+	if orca != "" {
+		var err error
+		if o, err = orcas.FromConfig(orca); err != nil {
+			fmt.Println("ERROR: argument --orca:", err.Error())
+			os.Exit(-1)
+		}
+	}
+
+	if canaryOrca != "" {
+		co, err := orcas.FromConfig(canaryOrca)
+		if err != nil {
+			fmt.Println("ERROR: argument --canary-orca:", err.Error())
+			os.Exit(-1)
+		}
+		split, err := orcas.NewCanarySplit(canaryPercent, canaryByKey)
+		if err != nil {
+			fmt.Println("ERROR: argument --canary-percent:", err.Error())
+			os.Exit(-1)
+		}
+		admin.Handle("canary", split)
+		o = orcas.Canary(o, co, split)
+	}
+
+	if l2enabled && sizePolicy != (orcas.SizePolicy{}) {
+		o = orcas.SizeRouted(o, sizePolicy)
+	}
+	if l2enabled && classPolicy != (orcas.ClassPolicy{}) {
+		o = orcas.ClassRouted(o, classPolicy)
+	}
+
+	// Only the main listener's orchestrator is given the policy; the batch one never backfills
+	if l2enabled && backfillPolicy.Enabled() {
+		o = orcas.Admission(o, orcas.NewAdmitter(backfillPolicy))
+	}
+
+	// Soft TTLs and refresh-ahead both wrap the orchestrator. Soft TTLs have to be the outer
+	// wrapper so refresh-ahead sees the soft TTL of each entry.
+	// Anything writing to L1 in the background uses l1bg so its entries get the same stale window.
+	var refresher *orcas.Refresher
+	soft := l2enabled && stalePolicy.Window > 0
+	l1bg := h1
+	if soft {
+		l1bg = orcas.StaleL1(h1, stalePolicy)
+	}
+	if tombstones != nil {
+		l1bg = orcas.TombstoneL1(l1bg, tombstones)
+	}
+	if l2enabled && (refreshThreshold > 0 || (soft && stalePolicy.Revalidate)) {
+		refresher = orcas.NewRefresher(l1bg, h2, refreshThreshold, refreshProbability, refreshWorkers)
+		if tombstones != nil {
+			refresher.UseTombstones(tombstones)
+		}
+	}
+	wrap := func(o orcas.OrcaConst) orcas.OrcaConst {
+		if refreshThreshold > 0 && refresher != nil {
+			o = orcas.RefreshAhead(o, refresher)
+		}
+		if soft {
+			o = orcas.StaleWhileRevalidate(o, refresher, stalePolicy)
+		}
+		// Outside the others so their writes to L1 are guarded too
+		if l2enabled && tombstones != nil {
+			o = orcas.Tombstones(o, tombstones)
+		}
+		return o
+	}
+	o = wrap(o)
+
+	var group *peer.Group
+	if peerListen != "" {
+		if _, ok := secrets.Ref(peerTLS.KeyFile); ok {
+			peerTLS.Key = secret("peer-tls-key", peerTLS.KeyFile, secretsRefresh).Get
+			peerTLS.KeyFile = ""
+		}
+
+		var err error
+		if peerTLS.CertFile != "" {
+			group, err = peer.NewTLSGroup(peerListen, peerAddrs, l1bg, peerTLS)
+		} else {
+			group, err = peer.NewGroup(peerListen, peerAddrs, l1bg)
+		}
+		if err != nil {
+			fmt.Println("ERROR: argument --peer-listen:", err.Error())
+			os.Exit(-1)
+		}
+		o = group.Orca(o)
+	}
+
+	// the tier events are published from
+	tier := "l1only"
+	if orca != "" {
+		tier, _ = handlers.SplitSpec(orca)
+	} else if l2enabled {
+		tier = "l1l2"
+	}
+
+	var publisher *cdc.Publisher
+	if cdcSink != "" {
+		sink, err := cdc.SinkFromConfig(cdcSink)
+		if err != nil {
+			fmt.Println("ERROR: argument --cdc-sink:", err.Error())
+			os.Exit(-1)
+		}
+		publisher = cdc.NewPublisher(sink, cdcOpts)
+		o = publisher.Orca(o, tier)
+	}
+
+	// Notifications are published the same way as CDC, just with a much shorter wait for batches
+	// since near caches are waiting on them
+	var notifier *cdc.Publisher
+	if hub != nil {
+		notifier = cdc.NewPublisher(hub, cdc.Opts{FlushInterval: time.Millisecond})
+		o = notifier.Orca(o, tier)
+	}
+
+	var observers []server.RequestObserver
+	if l2enabled {
+		sampler := consistency.NewSampler(consistencySampleRate, consistencySampleSize)
+		observers = append(observers, sampler)
+
+		checker := consistency.NewChecker(h1, h2, sampler, consistencyRepair)
+		http.Handle("/consistency", checker)
+		if consistencyInterval > 0 {
+			checker.Start(consistencyInterval)
+		}
+	}
+	if prefixDelimiter != "" {
+		tracker := prefixstats.New(prefixConf)
+		observers = append(observers, tracker)
+		admin.Handle("prefixes", tracker)
+	}
+	l.Observers = observers
+
+	// Quotas are shared by both listeners, and checked inside the locks so a key's writes are
+	// counted in the order they're done. Writes to different keys are held to the quota by the
+	// bytes they reserve until they're done.
+	var quotaTracker *quota.Tracker
+	if len(quotas) > 0 {
+		var err error
+		if quotaTracker, err = quota.New(quotas); err != nil {
+			fmt.Println("ERROR: argument --quotas:", err.Error())
+			os.Exit(-1)
+		}
+		admin.Handle("quotas", quotaTracker)
+		o = orcas.Quotas(o, quotaTracker)
+	}
+
 	// Add the locking wrapper if requested. The locking wrapper can either allow mutltiple readers
 	// or not, with the same difference in semantics between a sync.Mutex and a sync.RWMutex. If
 	// chunking is enabled, we want to ensure that stricter locking is enabled, since concurrent
@@ -217,22 +1294,192 @@ func main() {
 		}
 	}
 
+	if quietGets == orcas.QuietGetMiss {
+		o = orcas.QuietGetMisses(o)
+	}
+
+	// The mode switch is shared by both listeners so they change modes together
+	modes := orcas.NewModeSwitch(mode, maintenanceMessage)
+	admin.Handle("mode", modes)
+	health.AddDependency("mode", true, func() error {
+		if modes.Mode() == orcas.ModeMaintenance {
+			return errors.New("in maintenance mode")
+		}
+		return nil
+	})
+	o = orcas.Moded(o, modes)
+
+	// Shedding goes outside the mode so the heap is protected no matter what mode the proxy is in
+	var shedder *orcas.Shedder
+	if shedPolicy.Enabled() {
+		shedder = orcas.NewShedder(shedPolicy)
+		go shedder.Monitor(shedInterval)
+		o = orcas.Shedding(o, shedder)
+	}
+
+	var scheduler *priority.Scheduler
+	if priorityConcurrency > 0 {
+		scheduler = priority.NewScheduler(priorityConcurrency)
+		o = orcas.Prioritized(o, scheduler, priority.Classifier{Default: priority.Interactive, Rules: priorityRules})
+	}
+
+	// Budgets go on last since they need to see the handlers exactly as the server creates them
+	if budgetPolicy.Total > 0 {
+		h1 = orcas.BudgetL1(h1)
+		h2 = orcas.BudgetL2(h2)
+		o = orcas.Budgeted(o, budgetPolicy)
+	}
+
+	// The watchdog starts once everything in the background is running, so the goroutines it
+	// counts from are the ones that don't come and go with connections
+	if watchdogConf.Interval > 0 {
+		watchdogConf.Conns = server.NumConns
+		w, err := watchdog.Start(watchdogConf)
+		if err != nil {
+			fmt.Println("ERROR: could not start the watchdog:", err.Error())
+			os.Exit(-1)
+		}
+		admin.Handle("watchdog", w)
+	}
+
+	admin.Handle("health", health)
+	admin.Handle("health/live", http.HandlerFunc(health.Live))
+	admin.Handle("health/ready", http.HandlerFunc(health.Ready))
+	go health.Run(healthInterval)
+
+	// Backends are warmed up last so nothing else takes the spares before the listeners start
+	warmed := true
+	if len(warmers) > 0 {
+		ready.NotReady("warming up backend connections")
+		if err := warmUp(warmers, warmTimeout); err != nil {
+			log.Printf("%v. Starting anyway while warm-up continues in the background.\n", err)
+			warmed = false
+			go func() {
+				for warmUp(warmers, warmTimeout) != nil {
+					time.Sleep(time.Second)
+				}
+				log.Println("Backend warm-up done")
+				ready.Ready()
+			}()
+		}
+	}
+
 	go server.ListenAndServe(l, protocols, server.Default, o, h1, h2)
 
+	if wsPort > 0 {
+		mux := http.NewServeMux()
+		wsArgs := server.WebSocketArgs{AllowedOrigins: wsOrigins, AllowedClients: allowedClients}
+		mux.Handle("/ws", server.WebSocketHandler(wsArgs, server.Default, o, h1, h2))
+		go func() {
+			if err := http.ListenAndServe(fmt.Sprintf(":%d", wsPort), mux); err != nil {
+				log.Panicf("Error serving WebSocket connections on port %d: %v\n", wsPort, err.Error())
+			}
+		}()
+	}
+
+	if hub != nil {
+		mux := http.NewServeMux()
+		mux.Handle("/notify", hub)
+		go func() {
+			if err := http.ListenAndServe(fmt.Sprintf(":%d", notifyPort), mux); err != nil {
+				log.Panicf("Error serving keyspace notifications on port %d: %v\n", notifyPort, err.Error())
+			}
+		}()
+	}
+
 	if l2enabled {
 		// If L2 is enabled, start the batch L1 / L2 orchestrator
 		l = server.ListenArgs{
-			Type: server.ListenTCP,
-			Port: batchPort,
+			Type:                 server.ListenTCP,
+			Port:                 batchPort,
+			Acceptors:            acceptors,
+			ReadBufSize:          readBufSize,
+			WriteBufSize:         writeBufSize,
+			AdaptiveBuffers:      adaptiveBufs,
+			Capture:              rec,
+			SlowRequestThreshold: slowRequests,
+			TimingSampleInterval: timingInterval,
+			EchoRequestIDs:       echoRequestIDs,
+			Observers:            observers,
+			ProxyProtocol:        proxyProtocol,
+			AllowedClients:       allowedClients,
+			Strictness:           batchStrictness,
+			VBuckets:             vbuckets,
+			Protocols:            batchProtos,
+			Quirks:               batchQuirks,
+			ZeroCopyMin:          zeroCopyMin,
 		}
 
 		o := orcas.L1L2Batch
+		if batchSizePolicy != (orcas.SizePolicy{}) {
+			o = orcas.SizeRouted(o, batchSizePolicy)
+		}
+		if classPolicy != (orcas.ClassPolicy{}) {
+			o = orcas.ClassRouted(o, classPolicy)
+		}
+		o = wrap(o)
+		if group != nil {
+			o = group.Orca(o)
+		}
+		if publisher != nil {
+			o = publisher.Orca(o, "l1l2batch")
+		}
+		if notifier != nil {
+			o = notifier.Orca(o, "l1l2batch")
+		}
+
+		if quotaTracker != nil {
+			o = orcas.Quotas(o, quotaTracker)
+		}
 
 		if locked {
 			o = orcas.LockedWithExisting(o, lockset)
 		}
 
-		go server.ListenAndServe(l, protocols, server.Default, o, h1, h2)
+		if batchQuietGets == orcas.QuietGetMiss {
+			o = orcas.QuietGetMisses(o)
+		}
+
+		o = orcas.Moded(o, modes)
+
+		if shedder != nil {
+			o = orcas.Shedding(o, shedder)
+		}
+
+		if scheduler != nil {
+			o = orcas.Prioritized(o, scheduler, priority.Classifier{Default: priority.Batch, Rules: priorityRules})
+		}
+
+		if budgetPolicy.Total > 0 {
+			o = orcas.Budgeted(o, budgetPolicy)
+		}
+
+		go server.ListenAndServe(l, protocols, server.Default, o, handlers.Split(h1, batchGetSplit), handlers.Split(h2, batchGetSplit))
+	}
+
+	if warmed {
+		ready.Ready()
+	}
+
+	admin.Handle("selftest", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reports, passed := runSelfTest()
+		if !passed {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		for _, report := range reports {
+			fmt.Fprint(w, report)
+		}
+	}))
+
+	if selfTest {
+		reports, passed := runSelfTest()
+		for _, report := range reports {
+			fmt.Print(report)
+		}
+		if !passed {
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}
 
 	// Block forever
@@ -240,3 +1487,166 @@ func main() {
 	wg.Add(1)
 	wg.Wait()
 }
+
+// runSelfTest runs the self test suite against every listener
+func runSelfTest() ([]selftest.Report, bool) {
+	var reports []selftest.Report
+	if useDomainSocket {
+		reports = append(reports, selftest.Run("unix", sockPath, selfTestTimeout))
+	} else {
+		reports = append(reports, selftest.Run("tcp", fmt.Sprintf("localhost:%d", port), selfTestTimeout))
+	}
+	if l2enabled {
+		reports = append(reports, selftest.Run("tcp", fmt.Sprintf("localhost:%d", batchPort), selfTestTimeout))
+	}
+
+	passed := true
+	for _, r := range reports {
+		passed = passed && r.Passed()
+	}
+	return reports, passed
+}
+
+// warmUp warms up every backend within the timeout
+func warmUp(warmers []*handlers.Warmer, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, w := range warmers {
+		if err := w.Warm(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func handlerFromConfig(arg, spec string) handlers.HandlerConst {
+	hc, err := handlers.FromConfig(spec)
+	if err != nil {
+		fmt.Printf("ERROR: argument %s: %s\n", arg, err.Error())
+		os.Exit(-1)
+	}
+	return hc
+}
+
+// replicaGroup makes a handler that spreads requests over the replicas in spec
+func replicaGroup(arg, spec string) handlers.HandlerConst {
+	rs, err := replicas.ParseReplicas(spec)
+	if err != nil {
+		fmt.Printf("ERROR: argument %s: %s\n", arg, err.Error())
+		os.Exit(-1)
+	}
+	return replicas.New(replicaConfig, rs).HandlerConst()
+}
+
+// shardGroup makes a handler that spreads keys over the nodes in spec
+func shardGroup(arg, spec string) handlers.HandlerConst {
+	nodes, err := sharded.ParseNodes(spec, sharded.Backend(discovery.HandlerBackend(shardHandler)))
+	if err != nil {
+		fmt.Printf("ERROR: argument %s: %s\n", arg, err.Error())
+		os.Exit(-1)
+	}
+
+	g, err := sharded.New(shardConfig, nodes)
+	if err != nil {
+		fmt.Printf("ERROR: argument %s: %s\n", arg, err.Error())
+		os.Exit(-1)
+	}
+
+	return g.HandlerConst()
+}
+
+// discover makes a replica group of the backends found by the discovery provider in spec and keeps
+// it up to date
+func discover(name, arg, spec string) handlers.HandlerConst {
+	p, err := discovery.FromConfig(spec)
+	if err != nil {
+		fmt.Printf("ERROR: argument %s: %s\n", arg, err.Error())
+		os.Exit(-1)
+	}
+
+	g := replicas.New(replicaConfig, nil)
+	if err := discovery.Apply(name, p, g, discovery.HandlerBackend(discoveryHandler), discoveryTimeout); err != nil {
+		fmt.Printf("ERROR: argument %s: %s\n", arg, err.Error())
+		os.Exit(-1)
+	}
+
+	return g.HandlerConst()
+}
+
+// migrate starts a migration from one handler to another and returns the handler that follows it
+func migrate(name string, from, to handlers.HandlerConst) handlers.HandlerConst {
+	m := migration.New(name, from, to, uint32(migrateCopyExptime))
+	http.Handle("/migration/"+name, m)
+
+	if migrateKeysFile != "" {
+		f, err := os.Open(migrateKeysFile)
+		if err != nil {
+			fmt.Println("ERROR: argument --migrate-keys-file:", err.Error())
+			os.Exit(-1)
+		}
+		go func() {
+			defer f.Close()
+			if err := m.CopyKeysFrom(f); err != nil {
+				log.Printf("Error reading keys to copy for migration %s: %v\n", name, err.Error())
+			}
+		}()
+	}
+
+	return m.HandlerConst()
+}
+
+// failOver puts a standby behind primary that takes over while it's down
+func failOver(name string, primary, standby handlers.HandlerConst) handlers.HandlerConst {
+	f := failover.New(name, failoverConfig, primary, standby)
+	admin.Handle("failover/"+name, f)
+	health.AddDependency(name+"-primary", false, func() error {
+		if f.Down() {
+			return errors.New("failed over to the standby")
+		}
+		return nil
+	})
+	return f.HandlerConst()
+}
+
+// injectChaos wraps hc in fault injection configured through its admin endpoint
+func injectChaos(name string, hc handlers.HandlerConst) handlers.HandlerConst {
+	c := chaos.New(name, hc)
+	admin.Handle("chaos/"+name, c)
+	return c.HandlerConst()
+}
+
+// ping checks the backend of hc on a connection of its own for each check
+func ping(hc handlers.HandlerConst) func() error {
+	return func() error {
+		h, err := hc()
+		if err != nil {
+			return err
+		}
+		defer h.Close()
+		return handlers.Ping(h)
+	}
+}
+
+// serverTime tells the time of the backend of hc, on a connection of its own for each check
+func serverTime(hc handlers.HandlerConst) clock.Source {
+	return func() (time.Time, error) {
+		h, err := hc()
+		if err != nil {
+			return time.Time{}, err
+		}
+		defer h.Close()
+		return handlers.ServerTime(h)
+	}
+}
+
+// count returns how many of the arguments were given
+func count(args ...string) int {
+	n := 0
+	for _, a := range args {
+		if a != "" {
+			n++
+		}
+	}
+	return n
+}
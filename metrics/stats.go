@@ -0,0 +1,89 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Stat is a single metric in the name and value form of the memcached stats command
+type Stat struct {
+	Name  string
+	Value string
+}
+
+// Stats returns the current counters and gauges, including the callback gauges, flattened into
+// memcached-style stats. Histograms and the runtime memory stats are left out since they're large
+// and better read from the metrics endpoint. Tags other than the metric and data type are added to
+// the name in tag name order, e.g. a counter "foo" with the tag "shard: 3" becomes "foo:shard=3".
+// The stats are sorted by name.
+func Stats() []Stat {
+	// same assumption as printMetrics
+	metricsReadLock.Lock()
+	defer metricsReadLock.Unlock()
+
+	im := getAllCounters()
+	fm := []FloatMetric(nil)
+
+	intg, floatg := getAllGauges()
+	im = append(im, intg...)
+	fm = append(fm, floatg...)
+
+	intg, floatg = getAllCallbackGauges()
+	im = append(im, intg...)
+	fm = append(fm, floatg...)
+
+	intg, floatg = getAllBulkCallbackGauges()
+	im = append(im, intg...)
+	fm = append(fm, floatg...)
+
+	ret := make([]Stat, 0, len(im)+len(fm))
+	for _, m := range im {
+		ret = append(ret, Stat{statName(m.Name, m.Tgs), fmt.Sprintf("%d", m.Val)})
+	}
+	for _, m := range fm {
+		ret = append(ret, Stat{statName(m.Name, m.Tgs), fmt.Sprintf("%f", m.Val)})
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+
+	return ret
+}
+
+func statName(name string, tgs Tags) string {
+	var keys []string
+	for k := range tgs {
+		if k != TagMetricType && k != TagDataType {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return name
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	sb.WriteString(name)
+	for _, k := range keys {
+		sb.WriteByte(':')
+		sb.WriteString(k)
+		sb.WriteByte('=')
+		sb.WriteString(tgs[k])
+	}
+
+	return sb.String()
+}
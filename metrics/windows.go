@@ -0,0 +1,160 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// windows are the lengths of time that rates and ratios are computed over. Each windowed metric
+// is exported once per window, tagged with the window's name.
+var windows = []struct {
+	Name    string
+	Samples int
+}{
+	{"10s", 10},
+	{"1m", 60},
+	{"5m", 300},
+}
+
+const (
+	// TagWindow is the tag holding the name of the window of a rate or ratio
+	TagWindow = "window"
+
+	windowResolution = time.Second
+	// one more sample than the longest window, since a window is the difference of two samples
+	windowSamples = 301
+)
+
+var (
+	windowsLock   = new(sync.Mutex)
+	windowed      []*window
+	windowsSample = new(sync.Once)
+)
+
+// window keeps the last few minutes of once a second samples of the sum of some counters
+type window struct {
+	counters []uint32
+	ring     [windowSamples]uint64
+	pos      int
+	filled   int
+}
+
+func newWindow(counters []uint32) *window {
+	w := &window{counters: counters}
+	w.sample()
+
+	windowsLock.Lock()
+	windowed = append(windowed, w)
+	windowsLock.Unlock()
+
+	windowsSample.Do(func() {
+		go sampleWindows()
+	})
+
+	return w
+}
+
+func sampleWindows() {
+	for range time.Tick(windowResolution) {
+		windowsLock.Lock()
+		for _, w := range windowed {
+			w.sample()
+		}
+		windowsLock.Unlock()
+	}
+}
+
+func (w *window) sample() {
+	var sum uint64
+	for _, id := range w.counters {
+		sum += atomic.LoadUint64(&counters[id])
+	}
+
+	w.ring[w.pos] = sum
+	w.pos = (w.pos + 1) % windowSamples
+	if w.filled < windowSamples {
+		w.filled++
+	}
+}
+
+// delta returns how much the counters went up over the last n samples, or over as many as there
+// are if the window hasn't filled up yet, along with the number of samples that covers.
+func (w *window) delta(n int) (uint64, int) {
+	if n > w.filled-1 {
+		n = w.filled - 1
+	}
+	if n <= 0 {
+		return 0, 0
+	}
+
+	last := w.ring[(w.pos-1+windowSamples)%windowSamples]
+	first := w.ring[(w.pos-1-n+2*windowSamples)%windowSamples]
+	return last - first, n
+}
+
+// AddRate exports the per second rate of the sum of the given counters over the last 10 seconds,
+// minute, and 5 minutes, e.g. for requests per second. The rates are float gauges with the given
+// name and tags plus the window tag, which is 10s, 1m, or 5m. Until a window has filled up, its
+// rate covers as much time as there is.
+func AddRate(name string, tgs Tags, counters ...uint32) {
+	w := newWindow(counters)
+
+	for _, win := range windows {
+		samples := win.Samples
+		RegisterFloatGaugeCallback(name, windowTags(tgs, win.Name), func() float64 {
+			windowsLock.Lock()
+			d, n := w.delta(samples)
+			windowsLock.Unlock()
+
+			if n == 0 {
+				return 0
+			}
+			return float64(d) / (float64(n) * windowResolution.Seconds())
+		})
+	}
+}
+
+// AddHitRatio exports the fraction of hits over the same windows as AddRate, which is how much the
+// sum of the hits counters went up over how much the sum of the hits and misses counters went up.
+// The ratios are float gauges with the given name and tags plus the window tag. A window that saw
+// no hits or misses at all has a ratio of 0.
+func AddHitRatio(name string, tgs Tags, hits, misses []uint32) {
+	wh := newWindow(hits)
+	wm := newWindow(misses)
+
+	for _, win := range windows {
+		samples := win.Samples
+		RegisterFloatGaugeCallback(name, windowTags(tgs, win.Name), func() float64 {
+			windowsLock.Lock()
+			h, _ := wh.delta(samples)
+			m, _ := wm.delta(samples)
+			windowsLock.Unlock()
+
+			if h+m == 0 {
+				return 0
+			}
+			return float64(h) / float64(h+m)
+		})
+	}
+}
+
+func windowTags(tgs Tags, window string) Tags {
+	tgs = copyTags(tgs)
+	tgs[TagWindow] = window
+	return tgs
+}
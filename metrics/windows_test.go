@@ -0,0 +1,57 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import "testing"
+
+func TestWindowDelta(t *testing.T) {
+	c := AddCounter("test_window_delta", nil)
+	w := &window{counters: []uint32{c}}
+
+	if d, n := w.delta(10); d != 0 || n != 0 {
+		t.Fatalf("Expected an empty window to cover nothing, got %d over %d", d, n)
+	}
+
+	// One more per second, for longer than the ring holds
+	for i := 0; i < windowSamples+50; i++ {
+		IncCounter(c)
+		w.sample()
+	}
+
+	for _, n := range []int{1, 10, 60, 300} {
+		if d, covered := w.delta(n); d != uint64(n) || covered != n {
+			t.Fatalf("Expected %d over %d samples, got %d over %d", n, n, d, covered)
+		}
+	}
+	if _, covered := w.delta(1000); covered != windowSamples-1 {
+		t.Fatalf("Expected the window to be limited to the ring, got %d", covered)
+	}
+}
+
+func TestWindowPartial(t *testing.T) {
+	c1 := AddCounter("test_window_partial_1", nil)
+	c2 := AddCounter("test_window_partial_2", nil)
+	w := &window{counters: []uint32{c1, c2}}
+	w.sample()
+
+	IncCounterBy(c1, 3)
+	IncCounterBy(c2, 4)
+	w.sample()
+
+	// Only one second has been seen so far, so the 10 second window covers just that
+	if d, n := w.delta(10); d != 7 || n != 1 {
+		t.Fatalf("Expected 7 over 1 sample, got %d over %d", d, n)
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package notify streams keyspace notifications to the clients that keep near caches of rend's
+// data, so they can drop their copies as soon as a key changes instead of polling. A Hub is a
+// cdc.Sink, so it's fed by a cdc.Publisher wrapping the orchestrator like any other sink, and it
+// hands every event to the subscribers interested in the key's prefix. Entries reclaimed by the
+// in-memory store as they expire can be fed to it as well (see Hub.Expired).
+//
+// Like the rest of CDC, delivery is best effort. A subscriber that falls behind has notifications
+// dropped rather than slowing down the others, and the next one it gets is an OpOverflow saying how
+// many were lost, after which it should assume anything under its prefixes may have changed.
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/cdc"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricSubscriptions = metrics.AddCounter("notify_subscriptions", nil)
+	MetricSent          = metrics.AddCounter("notify_sent", nil)
+	MetricDropped       = metrics.AddCounter("notify_dropped", nil)
+	MetricOverflows     = metrics.AddCounter("notify_overflows", nil)
+)
+
+const (
+	// OpExpire is an entry reclaimed as it expired. Entries that expire without being reclaimed
+	// are only noticed the next time they're used, and aren't notified.
+	OpExpire cdc.Op = "expire"
+	// OpOverflow says notifications were dropped because the subscriber fell behind
+	OpOverflow cdc.Op = "overflow"
+	// OpSubscribed is the first notification of every stream, sent once the subscription is in
+	// place, so a client knows it won't miss anything written after it starts caching
+	OpSubscribed cdc.Op = "subscribed"
+)
+
+// DefaultBuffer is the number of notifications a subscriber can fall behind by if the hub isn't
+// given one
+const DefaultBuffer = 1000
+
+// Notification is a single event delivered to a subscriber
+type Notification struct {
+	cdc.Event
+	// Dropped is how many notifications were lost before an OpOverflow
+	Dropped uint64 `json:"dropped,omitempty"`
+}
+
+// Hub fans events out to subscriptions by key prefix
+type Hub struct {
+	buffer int
+
+	// guards subs and the subscriptions' channels and drop counts
+	lock sync.Mutex
+	subs map[*Subscription]struct{}
+	done bool
+}
+
+// NewHub makes a hub whose subscribers can have up to buffer notifications waiting before more are
+// dropped. 0 uses DefaultBuffer.
+func NewHub(buffer int) *Hub {
+	if buffer <= 0 {
+		buffer = DefaultBuffer
+	}
+
+	h := &Hub{
+		buffer: buffer,
+		subs:   make(map[*Subscription]struct{}),
+	}
+
+	metrics.RegisterIntGaugeCallback("notify_subscribers", nil, func() uint64 {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		return uint64(len(h.subs))
+	})
+
+	return h
+}
+
+// Subscription is one subscriber's interest in a set of key prefixes
+type Subscription struct {
+	hub      *Hub
+	prefixes [][]byte
+	c        chan Notification
+	dropped  uint64
+}
+
+// Subscribe starts delivering notifications for keys starting with any of the prefixes, or for
+// every key if there are none. Flushes remove every key, so they're delivered to everyone.
+func (h *Hub) Subscribe(prefixes []string) *Subscription {
+	s := &Subscription{
+		hub: h,
+		c:   make(chan Notification, h.buffer),
+	}
+	for _, p := range prefixes {
+		s.prefixes = append(s.prefixes, []byte(p))
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.done {
+		close(s.c)
+		return s
+	}
+	h.subs[s] = struct{}{}
+	metrics.IncCounter(MetricSubscriptions)
+
+	return s
+}
+
+// C returns the notifications. It's closed once the subscription or the hub is.
+func (s *Subscription) C() <-chan Notification {
+	return s.c
+}
+
+// Close stops the subscription
+func (s *Subscription) Close() {
+	s.hub.lock.Lock()
+	defer s.hub.lock.Unlock()
+
+	if _, ok := s.hub.subs[s]; ok {
+		delete(s.hub.subs, s)
+		close(s.c)
+	}
+}
+
+func (s *Subscription) wants(key []byte) bool {
+	if len(s.prefixes) == 0 || len(key) == 0 {
+		return true
+	}
+	for _, p := range s.prefixes {
+		if bytes.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// send delivers n without blocking, first telling the subscriber about anything it missed. It must
+// be called with the hub locked.
+func (s *Subscription) send(n Notification) {
+	if s.dropped > 0 {
+		select {
+		case s.c <- Notification{Event: cdc.Event{Time: n.Time, Op: OpOverflow}, Dropped: s.dropped}:
+			metrics.IncCounter(MetricOverflows)
+			s.dropped = 0
+		default:
+			s.dropped++
+			metrics.IncCounter(MetricDropped)
+			return
+		}
+	}
+
+	select {
+	case s.c <- n:
+		metrics.IncCounter(MetricSent)
+	default:
+		s.dropped++
+		metrics.IncCounter(MetricDropped)
+	}
+}
+
+// Publish hands each event to the subscribers interested in its key. It never blocks and never
+// fails, so the publisher never retries.
+func (h *Hub) Publish(events []cdc.Event) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for _, ev := range events {
+		for s := range h.subs {
+			if s.wants(ev.Key) {
+				s.send(Notification{Event: ev})
+			}
+		}
+	}
+	return nil
+}
+
+// Expired notifies subscribers that an entry in the named tier was reclaimed as it expired. It
+// can be used directly as the store's expiry callback, e.g. for inmem.Config.OnExpire.
+func (h *Hub) Expired(tier string) func(key []byte) {
+	return func(key []byte) {
+		h.Publish([]cdc.Event{{
+			Time: time.Now().UnixNano(),
+			Op:   OpExpire,
+			Key:  append([]byte(nil), key...),
+			Tier: tier,
+		}})
+	}
+}
+
+// Close ends every subscription
+func (h *Hub) Close() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for s := range h.subs {
+		close(s.c)
+	}
+	h.subs = nil
+	h.done = true
+	return nil
+}
+
+// ServeHTTP streams notifications as newline delimited JSON for as long as the client stays
+// connected. The prefix query parameter, which can be repeated, picks the keys; without it every
+// key is streamed.
+func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	s := h.Subscribe(r.URL.Query()["prefix"])
+	defer s.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	enc := json.NewEncoder(w)
+
+	if err := enc.Encode(Notification{Event: cdc.Event{Time: time.Now().UnixNano(), Op: OpSubscribed}}); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case n, ok := <-s.C():
+			if !ok {
+				return
+			}
+			if err := enc.Encode(n); err != nil {
+				return
+			}
+			// flush once caught up, so a burst goes out in as few writes as possible
+			if len(s.C()) == 0 {
+				flusher.Flush()
+			}
+
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notify_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/cdc"
+	"github.com/netflix/rend/notify"
+)
+
+func event(op cdc.Op, key string) cdc.Event {
+	return cdc.Event{Op: op, Key: []byte(key), Tier: "l1only"}
+}
+
+func next(t *testing.T, s *notify.Subscription) notify.Notification {
+	t.Helper()
+	select {
+	case n := <-s.C():
+		return n
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for a notification")
+		return notify.Notification{}
+	}
+}
+
+func TestPrefixes(t *testing.T) {
+	h := notify.NewHub(10)
+	users := h.Subscribe([]string{"user:", "session:"})
+	all := h.Subscribe(nil)
+
+	h.Publish([]cdc.Event{
+		event(cdc.OpSet, "user:1"),
+		event(cdc.OpDelete, "item:1"),
+		event(cdc.OpTouch, "session:2"),
+		event(cdc.OpFlush, ""),
+	})
+	h.Expired("inmem")([]byte("user:3"))
+
+	for _, want := range []string{"user:1", "session:2", "", "user:3"} {
+		if n := next(t, users); string(n.Key) != want {
+			t.Fatalf("Expected a notification for %q, got %+v", want, n)
+		}
+	}
+	if len(users.C()) != 0 {
+		t.Fatalf("Expected no notifications outside the prefixes, got %+v", <-users.C())
+	}
+	if len(all.C()) != 5 {
+		t.Fatalf("Expected every notification without prefixes, got %d", len(all.C()))
+	}
+
+	users.Close()
+	if _, ok := <-users.C(); ok {
+		t.Fatal("Expected a closed subscription's channel to be closed")
+	}
+	h.Publish([]cdc.Event{event(cdc.OpSet, "user:1")})
+
+	h.Close()
+	for range all.C() {
+	}
+	if _, ok := <-h.Subscribe(nil).C(); ok {
+		t.Fatal("Expected subscribing to a closed hub to return a closed subscription")
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	h := notify.NewHub(2)
+	s := h.Subscribe(nil)
+
+	for _, k := range []string{"a", "b", "c", "d"} {
+		h.Publish([]cdc.Event{event(cdc.OpSet, k)})
+	}
+	next(t, s)
+	next(t, s)
+
+	// the next event after catching up is preceded by how many were lost
+	h.Publish([]cdc.Event{event(cdc.OpSet, "e")})
+	if n := next(t, s); n.Op != notify.OpOverflow || n.Dropped != 2 {
+		t.Fatalf("Expected an overflow of 2, got %+v", n)
+	}
+	if n := next(t, s); string(n.Key) != "e" {
+		t.Fatalf("Expected delivery to resume after the overflow, got %+v", n)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	h := notify.NewHub(10)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/notify?prefix=a&prefix=b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	lines := bufio.NewScanner(res.Body)
+	read := func() notify.Notification {
+		t.Helper()
+		if !lines.Scan() {
+			t.Fatalf("Expected another notification: %v", lines.Err())
+		}
+		var n notify.Notification
+		if err := json.Unmarshal(lines.Bytes(), &n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	if n := read(); n.Op != notify.OpSubscribed {
+		t.Fatalf("Expected the stream to start with a subscribed notification, got %+v", n)
+	}
+
+	h.Publish([]cdc.Event{event(cdc.OpSet, "c1"), event(cdc.OpSet, "b1")})
+	if n := read(); n.Op != cdc.OpSet || string(n.Key) != "b1" || n.Tier != "l1only" {
+		t.Fatalf("Expected the set of b1, got %+v", n)
+	}
+}
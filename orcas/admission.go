@@ -0,0 +1,208 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"sync/atomic"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/protocol"
+)
+
+var (
+	MetricBackfillAdmitted         = metrics.AddCounter("backfill_admitted", nil)
+	MetricBackfillSkippedSize      = metrics.AddCounter("backfill_skipped_size", nil)
+	MetricBackfillSkippedFrequency = metrics.AddCounter("backfill_skipped_frequency", nil)
+)
+
+// BackfillPolicy decides which values read from L2 on an L1 miss are copied into L1. Copying every
+// one lets large values and keys that are only read once push hot keys out of L1.
+type BackfillPolicy struct {
+	// MaxSize is the largest value backfilled, in bytes. 0 means no limit.
+	MaxSize int
+	// MinHits is how many times a key has to have been read recently, counting the read being
+	// served, for it to be backfilled. 0 or 1 backfills on the first miss.
+	MinHits int
+}
+
+// Enabled returns whether the policy skips any backfills
+func (p BackfillPolicy) Enabled() bool {
+	return p.MaxSize > 0 || p.MinHits > 1
+}
+
+// Admitter applies a backfill policy, keeping track of how often keys are read. One is shared by
+// every connection so the read frequencies cover all of the traffic.
+type Admitter struct {
+	p BackfillPolicy
+	s *freqSketch
+}
+
+// NewAdmitter makes an Admitter for the given policy
+func NewAdmitter(p BackfillPolicy) *Admitter {
+	a := &Admitter{p: p}
+	if p.MinHits > 1 {
+		a.s = newFreqSketch()
+	}
+	return a
+}
+
+// read records a read of key
+func (a *Admitter) read(key []byte) {
+	if a.s != nil {
+		a.s.add(key)
+	}
+}
+
+// admit returns whether a value of the given size read from L2 for key should be put in L1
+func (a *Admitter) admit(key []byte, size int) bool {
+	if a.p.MaxSize > 0 && size > a.p.MaxSize {
+		metrics.IncCounter(MetricBackfillSkippedSize)
+		return false
+	}
+	if a.s != nil && a.s.estimate(key) < uint32(a.p.MinHits) {
+		metrics.IncCounter(MetricBackfillSkippedFrequency)
+		return false
+	}
+	metrics.IncCounter(MetricBackfillAdmitted)
+	return true
+}
+
+// Admission wraps an orchestrator so the writes to L1 it makes while serving a read, which are
+// backfills, go through the admitter. Skipped backfills still answer the read with the value from
+// L2; it's just not kept in L1.
+func Admission(oc OrcaConst, a *Admitter) OrcaConst {
+	return func(l1, l2 handlers.Handler, res protocol.Responder) Orca {
+		h := &admissionHandler{Handler: l1, a: a}
+		return &admissionOrca{Orca: oc(h, l2, res), h: h}
+	}
+}
+
+type admissionOrca struct {
+	Orca
+	h *admissionHandler
+}
+
+// read serves a read of keys, during which writes to L1 are backfills
+func (o *admissionOrca) read(keys [][]byte, f func() error) error {
+	for _, k := range keys {
+		o.h.a.read(k)
+	}
+	o.h.reading = true
+	defer func() { o.h.reading = false }()
+	return f()
+}
+
+func (o *admissionOrca) Get(req common.GetRequest) error {
+	return o.read(req.Keys, func() error { return o.Orca.Get(req) })
+}
+
+func (o *admissionOrca) GetE(req common.GetRequest) error {
+	return o.read(req.Keys, func() error { return o.Orca.GetE(req) })
+}
+
+func (o *admissionOrca) Gat(req common.GATRequest) error {
+	return o.read([][]byte{req.Key}, func() error { return o.Orca.Gat(req) })
+}
+
+type admissionHandler struct {
+	handlers.Handler
+	a *Admitter
+
+	// set while a read is being served
+	reading bool
+}
+
+func (h *admissionHandler) Set(cmd common.SetRequest) error {
+	if h.reading && !h.a.admit(cmd.Key, len(cmd.Data)) {
+		return nil
+	}
+	return h.Handler.Set(cmd)
+}
+
+func (h *admissionHandler) Add(cmd common.SetRequest) error {
+	if h.reading && !h.a.admit(cmd.Key, len(cmd.Data)) {
+		return nil
+	}
+	return h.Handler.Add(cmd)
+}
+
+const (
+	sketchDepth = 4
+	// counters per row, a power of 2
+	sketchWidth = 1 << 16
+	// reads counted before every counter is halved, so old reads count for less and less
+	sketchSample = 10 * sketchWidth
+)
+
+// freqSketch estimates how many times each key was read recently in a fixed amount of memory. It's
+// a count-min sketch: every read increments one counter per row, and the estimate is the smallest
+// of them, so collisions can only make keys look hotter than they are.
+type freqSketch struct {
+	adds     uint64
+	counters [sketchDepth][sketchWidth]uint32
+}
+
+func newFreqSketch() *freqSketch {
+	return new(freqSketch)
+}
+
+// index returns the counter of key in each row, by double hashing the 64-bit FNV-1a of key
+func (s *freqSketch) index(key []byte) [sketchDepth]uint32 {
+	h := uint64(14695981039346656037)
+	for _, b := range key {
+		h ^= uint64(b)
+		h *= 1099511628211
+	}
+	h1, h2 := uint32(h), uint32(h>>32)|1
+
+	var res [sketchDepth]uint32
+	for i := range res {
+		res[i] = (h1 + uint32(i)*h2) & (sketchWidth - 1)
+	}
+	return res
+}
+
+func (s *freqSketch) add(key []byte) {
+	for row, i := range s.index(key) {
+		atomic.AddUint32(&s.counters[row][i], 1)
+	}
+
+	if atomic.AddUint64(&s.adds, 1)%sketchSample == 0 {
+		s.halve()
+	}
+}
+
+func (s *freqSketch) estimate(key []byte) uint32 {
+	min := ^uint32(0)
+	for row, i := range s.index(key) {
+		if c := atomic.LoadUint32(&s.counters[row][i]); c < min {
+			min = c
+		}
+	}
+	return min
+}
+
+// halve ages every counter. Increments racing with it may be lost, which only makes those keys
+// look a little colder.
+func (s *freqSketch) halve() {
+	for row := range s.counters {
+		for i := range s.counters[row] {
+			c := &s.counters[row][i]
+			atomic.StoreUint32(c, atomic.LoadUint32(c)/2)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol/binprot"
+)
+
+func TestAdmission(t *testing.T) {
+	a := orcas.NewAdmitter(orcas.BackfillPolicy{MaxSize: 5, MinHits: 2})
+	l1 := mapL1{data: make(map[string]string)}
+
+	get := func(key, value string) {
+		w := bufio.NewWriter(new(bytes.Buffer))
+		o := orcas.Admission(orcas.L1L2, a)(l1, staticL2{data: value}, binprot.NewBinaryResponder(w))
+		err := o.Get(common.GetRequest{
+			Keys:    [][]byte{[]byte(key)},
+			Opaques: []uint32{0},
+			Quiet:   []bool{false},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	get("small", "abc")
+	if _, ok := l1.data["small"]; ok {
+		t.Fatalf("Expected a key read once not to be backfilled")
+	}
+	get("small", "abc")
+	if l1.data["small"] != "abc" {
+		t.Fatalf("Expected a key read twice to be backfilled, got %v", l1.data)
+	}
+
+	get("large", "abcdef")
+	get("large", "abcdef")
+	if _, ok := l1.data["large"]; ok {
+		t.Fatalf("Expected a value over the size limit not to be backfilled")
+	}
+}
@@ -0,0 +1,397 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"context"
+	"errors"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/timer"
+)
+
+var (
+	MetricCmdIncrL1     = metrics.AddCounter("cmd_incr_l1", nil)
+	MetricCmdIncrL2     = metrics.AddCounter("cmd_incr_l2", nil)
+	MetricCmdIncrHits   = metrics.AddCounter("cmd_incr_hits", nil)
+	MetricCmdIncrMisses = metrics.AddCounter("cmd_incr_misses", nil)
+	MetricCmdIncrErrors = metrics.AddCounter("cmd_incr_errors", nil)
+
+	MetricCmdDecrL1     = metrics.AddCounter("cmd_decr_l1", nil)
+	MetricCmdDecrL2     = metrics.AddCounter("cmd_decr_l2", nil)
+	MetricCmdDecrHits   = metrics.AddCounter("cmd_decr_hits", nil)
+	MetricCmdDecrMisses = metrics.AddCounter("cmd_decr_misses", nil)
+	MetricCmdDecrErrors = metrics.AddCounter("cmd_decr_errors", nil)
+
+	HistIncrL1 = metrics.AddHistogram("incr_l1", false, nil)
+	HistIncrL2 = metrics.AddHistogram("incr_l2", false, nil)
+	HistDecrL1 = metrics.AddHistogram("decr_l1", false, nil)
+	HistDecrL2 = metrics.AddHistogram("decr_l2", false, nil)
+)
+
+// Incrementer is implemented by orchestrators that support memcached's increment and decrement.
+// Both answer with the new value, which for a missing key is the initial value in the request if
+// it asks for the key to be created.
+type Incrementer interface {
+	Incr(req common.ArithRequest) error
+	Decr(req common.ArithRequest) error
+}
+
+// IncrementerV2 is the context-aware form of Incrementer for OrcaV2 implementations.
+type IncrementerV2 interface {
+	Incr(ctx context.Context, req common.ArithRequest) error
+	Decr(ctx context.Context, req common.ArithRequest) error
+}
+
+// Incr does the increment in req with o, or returns common.ErrNotSupported if o doesn't implement
+// Incrementer.
+func Incr(o Orca, req common.ArithRequest) error {
+	if i, ok := o.(Incrementer); ok {
+		return i.Incr(req)
+	}
+	return common.ErrNotSupported
+}
+
+// Decr does the decrement in req with o, or returns common.ErrNotSupported if o doesn't implement
+// Incrementer.
+func Decr(o Orca, req common.ArithRequest) error {
+	if i, ok := o.(Incrementer); ok {
+		return i.Decr(req)
+	}
+	return common.ErrNotSupported
+}
+
+// IncrV2 is the OrcaV2 counterpart of Incr.
+func IncrV2(ctx context.Context, o OrcaV2, req common.ArithRequest) error {
+	if i, ok := o.(IncrementerV2); ok {
+		return i.Incr(ctx, req)
+	}
+	return common.ErrNotSupported
+}
+
+// DecrV2 is the OrcaV2 counterpart of Decr.
+func DecrV2(ctx context.Context, o OrcaV2, req common.ArithRequest) error {
+	if i, ok := o.(IncrementerV2); ok {
+		return i.Decr(ctx, req)
+	}
+	return common.ErrNotSupported
+}
+
+// arithMetrics are the metrics of one of incr or decr against one tier
+type arithMetrics struct {
+	counter, hits, misses, errors, hist uint32
+}
+
+var (
+	incrL1 = arithMetrics{MetricCmdIncrL1, MetricCmdIncrHits, MetricCmdIncrMisses, MetricCmdIncrErrors, HistIncrL1}
+	incrL2 = arithMetrics{MetricCmdIncrL2, MetricCmdIncrHits, MetricCmdIncrMisses, MetricCmdIncrErrors, HistIncrL2}
+	decrL1 = arithMetrics{MetricCmdDecrL1, MetricCmdDecrHits, MetricCmdDecrMisses, MetricCmdDecrErrors, HistDecrL1}
+	decrL2 = arithMetrics{MetricCmdDecrL2, MetricCmdDecrHits, MetricCmdDecrMisses, MetricCmdDecrErrors, HistDecrL2}
+)
+
+// arith does the increment or decrement against a single handler and counts the outcome. Creating
+// a missing key counts as a hit since the request succeeded.
+func arith(h handlers.Handler, req common.ArithRequest, decr bool, m arithMetrics) (uint64, error) {
+	metrics.IncCounter(m.counter)
+	start := timer.Now()
+
+	var value uint64
+	var err error
+	if decr {
+		value, err = handlers.Decr(h, req)
+	} else {
+		value, err = handlers.Incr(h, req)
+	}
+
+	metrics.ObserveHist(m.hist, timer.Since(start))
+
+	switch {
+	case err == nil:
+		metrics.IncCounter(m.hits)
+	case errors.Is(err, common.ErrKeyNotFound):
+		metrics.IncCounter(m.misses)
+	default:
+		metrics.IncCounter(m.errors)
+	}
+
+	return value, err
+}
+
+func (l *L1OnlyOrca) Incr(req common.ArithRequest) error {
+	value, err := arith(l.l1, req, false, incrL1)
+	if err != nil {
+		return err
+	}
+	return l.res.Incr(req.Opaque, req.Quiet, value)
+}
+
+func (l *L1OnlyOrca) Decr(req common.ArithRequest) error {
+	value, err := arith(l.l1, req, true, decrL1)
+	if err != nil {
+		return err
+	}
+	return l.res.Decr(req.Opaque, req.Quiet, value)
+}
+
+// Numbers are kept in L2 so every instance counts together. The new value isn't written to L1,
+// since the flags it would need aren't known here, so the old one is deleted instead and the next
+// read fills L1 from L2.
+func (l *L1L2Orca) Incr(req common.ArithRequest) error {
+	value, err := arith(l.l2, req, false, incrL2)
+	if err != nil {
+		return err
+	}
+	if err := deleteL1(l.l1, req.Key); err != nil {
+		return err
+	}
+	return l.res.Incr(req.Opaque, req.Quiet, value)
+}
+
+func (l *L1L2Orca) Decr(req common.ArithRequest) error {
+	value, err := arith(l.l2, req, true, decrL2)
+	if err != nil {
+		return err
+	}
+	if err := deleteL1(l.l1, req.Key); err != nil {
+		return err
+	}
+	return l.res.Decr(req.Opaque, req.Quiet, value)
+}
+
+func (l *L1L2BatchOrca) Incr(req common.ArithRequest) error {
+	value, err := arith(l.l2, req, false, incrL2)
+	if err != nil {
+		return err
+	}
+	if err := deleteL1(l.l1, req.Key); err != nil {
+		return err
+	}
+	return l.res.Incr(req.Opaque, req.Quiet, value)
+}
+
+func (l *L1L2BatchOrca) Decr(req common.ArithRequest) error {
+	value, err := arith(l.l2, req, true, decrL2)
+	if err != nil {
+		return err
+	}
+	if err := deleteL1(l.l1, req.Key); err != nil {
+		return err
+	}
+	return l.res.Decr(req.Opaque, req.Quiet, value)
+}
+
+// deleteL1 removes the L1 copy of a key written in L2. A miss is fine since there was nothing to
+// make stale.
+func deleteL1(l1 handlers.Handler, key []byte) error {
+	metrics.IncCounter(MetricCmdDeleteL1)
+	start := timer.Now()
+
+	err := l1.Delete(common.DeleteRequest{Key: key})
+
+	metrics.ObserveHist(HistDeleteL1, timer.Since(start))
+
+	switch {
+	case err == nil:
+		metrics.IncCounter(MetricCmdDeleteHitsL1)
+	case errors.Is(err, common.ErrKeyNotFound):
+		metrics.IncCounter(MetricCmdDeleteMissesL1)
+	default:
+		metrics.IncCounter(MetricCmdDeleteErrorsL1)
+		return err
+	}
+	return nil
+}
+
+func (l *LockedOrca) Incr(req common.ArithRequest) error {
+	lock := l.getlock(req.Key, false)
+	lock.Lock()
+	defer lock.Unlock()
+	return Incr(l.wrapped, req)
+}
+
+func (l *LockedOrca) Decr(req common.ArithRequest) error {
+	lock := l.getlock(req.Key, false)
+	lock.Lock()
+	defer lock.Unlock()
+	return Decr(l.wrapped, req)
+}
+
+func (o *modedOrca) Incr(req common.ArithRequest) error {
+	if err := o.write(); err != nil {
+		return err
+	}
+	return Incr(o.Orca, req)
+}
+
+func (o *modedOrca) Decr(req common.ArithRequest) error {
+	if err := o.write(); err != nil {
+		return err
+	}
+	return Decr(o.Orca, req)
+}
+
+func (o *budgetOrca) Incr(req common.ArithRequest) error {
+	o.b.start()
+	return Incr(o.Orca, req)
+}
+
+func (o *budgetOrca) Decr(req common.ArithRequest) error {
+	o.b.start()
+	return Decr(o.Orca, req)
+}
+
+func (o *canaryOrca) Incr(req common.ArithRequest) error {
+	arm, start := o.pick(req.Key)
+	return o.done(arm, start, Incr(o.arms[arm], req))
+}
+
+func (o *canaryOrca) Decr(req common.ArithRequest) error {
+	arm, start := o.pick(req.Key)
+	return o.done(arm, start, Decr(o.arms[arm], req))
+}
+
+func (p *prioritizedOrca) Incr(req common.ArithRequest) error {
+	p.acquire(req.Key)
+	defer p.s.Release()
+	return Incr(p.Orca, req)
+}
+
+func (p *prioritizedOrca) Decr(req common.ArithRequest) error {
+	p.acquire(req.Key)
+	defer p.s.Release()
+	return Decr(p.Orca, req)
+}
+
+// Numbers are small, so only shedding all writes holds them back
+func (o *shedOrca) Incr(req common.ArithRequest) error {
+	if err := o.write(0); err != nil {
+		return err
+	}
+	return Incr(o.Orca, req)
+}
+
+func (o *shedOrca) Decr(req common.ArithRequest) error {
+	if err := o.write(0); err != nil {
+		return err
+	}
+	return Decr(o.Orca, req)
+}
+
+func (c *v2Orca) Incr(ctx context.Context, req common.ArithRequest) error {
+	defer c.ctx.enter(ctx)()
+	return Incr(c.o, req)
+}
+
+func (c *v2Orca) Decr(ctx context.Context, req common.ArithRequest) error {
+	defer c.ctx.enter(ctx)()
+	return Decr(c.o, req)
+}
+
+func (v v1Orca) Incr(req common.ArithRequest) error {
+	return IncrV2(v.ctx, v.o, req)
+}
+
+func (v v1Orca) Decr(req common.ArithRequest) error {
+	return DecrV2(v.ctx, v.o, req)
+}
+
+func (b boundHandler) Incr(cmd common.ArithRequest) (uint64, error) {
+	defer b.enter()()
+	return handlers.IncrV2(b.ctx.get(), b.h, cmd)
+}
+
+func (b boundHandler) Decr(cmd common.ArithRequest) (uint64, error) {
+	defer b.enter()()
+	return handlers.DecrV2(b.ctx.get(), b.h, cmd)
+}
+
+func (o *tombstoneOrca) Incr(req common.ArithRequest) error {
+	return Incr(o.Orca, req)
+}
+
+func (o *tombstoneOrca) Decr(req common.ArithRequest) error {
+	return Decr(o.Orca, req)
+}
+
+func (h *tombstoneHandler) Incr(cmd common.ArithRequest) (uint64, error) {
+	return handlers.Incr(h.Handler, cmd)
+}
+
+func (h *tombstoneHandler) Decr(cmd common.ArithRequest) (uint64, error) {
+	return handlers.Decr(h.Handler, cmd)
+}
+
+func (o *admissionOrca) Incr(req common.ArithRequest) error {
+	return Incr(o.Orca, req)
+}
+
+func (o *admissionOrca) Decr(req common.ArithRequest) error {
+	return Decr(o.Orca, req)
+}
+
+func (h *admissionHandler) Incr(cmd common.ArithRequest) (uint64, error) {
+	return handlers.Incr(h.Handler, cmd)
+}
+
+func (h *admissionHandler) Decr(cmd common.ArithRequest) (uint64, error) {
+	return handlers.Decr(h.Handler, cmd)
+}
+
+// The exptime is only used if the key is created, and is extended like any other L1 write
+func (h staleHandler) Incr(cmd common.ArithRequest) (uint64, error) {
+	cmd.Exptime = h.p.extend(cmd.Exptime)
+	return handlers.Incr(h.Handler, cmd)
+}
+
+func (h staleHandler) Decr(cmd common.ArithRequest) (uint64, error) {
+	cmd.Exptime = h.p.extend(cmd.Exptime)
+	return handlers.Decr(h.Handler, cmd)
+}
+
+func (h refreshingHandler) Incr(cmd common.ArithRequest) (uint64, error) {
+	return handlers.Incr(h.Handler, cmd)
+}
+
+func (h refreshingHandler) Decr(cmd common.ArithRequest) (uint64, error) {
+	return handlers.Decr(h.Handler, cmd)
+}
+
+// Numbers are small enough for any tier, so they aren't routed by size
+func (h routedHandler) Incr(cmd common.ArithRequest) (uint64, error) {
+	return handlers.Incr(h.Handler, cmd)
+}
+
+func (h routedHandler) Decr(cmd common.ArithRequest) (uint64, error) {
+	return handlers.Decr(h.Handler, cmd)
+}
+
+// Numbers are small, so they aren't counted against quotas
+func (o *quotaOrca) Incr(req common.ArithRequest) error {
+	return Incr(o.Orca, req)
+}
+
+func (o *quotaOrca) Decr(req common.ArithRequest) error {
+	return Decr(o.Orca, req)
+}
+
+func (h *quietHandler) Incr(cmd common.ArithRequest) (uint64, error) {
+	return handlers.Incr(h.Handler, cmd)
+}
+
+func (h *quietHandler) Decr(cmd common.ArithRequest) (uint64, error) {
+	return handlers.Decr(h.Handler, cmd)
+}
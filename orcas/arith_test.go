@@ -0,0 +1,167 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers/inmem"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol/textprot"
+)
+
+func TestArith(t *testing.T) {
+	// L2 holds the number, L1 only has its copy deleted
+	var l1ops []string
+	l2, _ := inmem.New()
+	buf := new(bytes.Buffer)
+	w := bufio.NewWriter(buf)
+	o := orcas.L1L2(opHandler{ops: &l1ops}, l2, textprot.NewTextResponder(w))
+
+	key := []byte("TestArith")
+	l2.Delete(common.DeleteRequest{Key: key})
+
+	if err := orcas.Incr(o, common.ArithRequest{Key: key, Delta: 1}); !errors.Is(err, common.ErrKeyNotFound) {
+		t.Fatalf("Expected a miss when the key isn't created, got %v", err)
+	}
+	if len(l1ops) != 0 {
+		t.Fatalf("Expected L1 to be left alone by a miss, got %v", l1ops)
+	}
+
+	reqs := []struct {
+		decr bool
+		req  common.ArithRequest
+	}{
+		{false, common.ArithRequest{Key: key, Delta: 1, Initial: 10, Create: true}},
+		{false, common.ArithRequest{Key: key, Delta: 5}},
+		// decrements stop at 0, and quiet ones aren't answered
+		{true, common.ArithRequest{Key: key, Delta: 100, Quiet: true}},
+		{false, common.ArithRequest{Key: key, Delta: 2}},
+	}
+	for _, r := range reqs {
+		var err error
+		if r.decr {
+			err = orcas.Decr(o, r.req)
+		} else {
+			err = orcas.Incr(o, r.req)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w.Flush()
+	if expected := "10\r\n15\r\n2\r\n"; buf.String() != expected {
+		t.Fatalf("Expected %q, got %q", expected, buf.String())
+	}
+	if len(l1ops) != len(reqs) || l1ops[0] != "delete" {
+		t.Fatalf("Expected L1 deleted after every write, got %v", l1ops)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	var l1ops, l2ops []string
+	buf := new(bytes.Buffer)
+	w := bufio.NewWriter(buf)
+	o := orcas.L1L2(opHandler{ops: &l1ops}, opHandler{ops: &l2ops}, textprot.NewTextResponder(w))
+
+	if err := orcas.Flush(o, common.FlushRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(l1ops) != 1 || len(l2ops) != 1 {
+		t.Fatalf("Expected both tiers flushed, got %v and %v", l1ops, l2ops)
+	}
+
+	// the delay is left to the handlers
+	if err := orcas.Flush(o, common.FlushRequest{Delay: 10, Quiet: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() { orcas.FlushTiers = orcas.FlushBoth }()
+	for _, tiers := range []string{"l1", "l2"} {
+		l1ops, l2ops = nil, nil
+		orcas.FlushTiers, _ = orcas.ParseFlushScope(tiers)
+		if err := orcas.Flush(o, common.FlushRequest{Quiet: true}); err != nil {
+			t.Fatal(err)
+		}
+		if (len(l1ops) == 1) != (tiers == "l1") || (len(l2ops) == 1) != (tiers == "l2") {
+			t.Fatalf("Expected only %s flushed, got %v and %v", tiers, l1ops, l2ops)
+		}
+	}
+	if _, err := orcas.ParseFlushScope("l3"); err == nil {
+		t.Error("Expected an unknown flush scope to fail")
+	}
+
+	w.Flush()
+	if buf.String() != "OK\r\n" {
+		t.Fatalf("Expected one OK, got %q", buf.String())
+	}
+}
+
+func TestWrappedL1(t *testing.T) {
+	r := orcas.NewRefresher(inmem.New, inmem.New, time.Second, 0, 1)
+	sp := orcas.StalePolicy{Window: time.Hour}
+	wrappers := map[string]orcas.OrcaConst{
+		"Stale":        orcas.StaleWhileRevalidate(orcas.L1Only, nil, sp),
+		"SizeRouted":   orcas.SizeRouted(orcas.L1Only, orcas.SizePolicy{L1Max: 10}),
+		"RefreshAhead": orcas.RefreshAhead(orcas.L1Only, r),
+	}
+
+	for name, oc := range wrappers {
+		t.Run(name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			w := bufio.NewWriter(buf)
+			h, _ := inmem.New()
+			o := oc(h, nil, textprot.NewTextResponder(w))
+
+			key := []byte("TestWrappedL1" + name)
+			h.Delete(common.DeleteRequest{Key: key})
+
+			req := common.ArithRequest{Key: key, Delta: 1, Initial: 10, Create: true, Exptime: 60}
+			if err := orcas.Incr(o, req); err != nil {
+				t.Fatal(err)
+			}
+			if err := orcas.Decr(o, common.ArithRequest{Key: key, Delta: 3}); err != nil {
+				t.Fatal(err)
+			}
+
+			res := getOneE(t, h, string(key))
+			if string(res.Data) != "7" {
+				t.Fatalf("Expected the number in L1, got %+v", res)
+			}
+			ttl := int64(res.Exptime) - time.Now().Unix()
+			if (name == "Stale") != (ttl > 60) {
+				t.Fatalf("Expected only the stale window to extend the TTL, got %d", ttl)
+			}
+
+			if err := orcas.Flush(o, common.FlushRequest{}); err != nil {
+				t.Fatal(err)
+			}
+			if res := getOneE(t, h, string(key)); !res.Miss {
+				t.Fatalf("Expected L1 flushed, got %+v", res)
+			}
+
+			w.Flush()
+			if expected := "10\r\n7\r\nOK\r\n"; buf.String() != expected {
+				t.Fatalf("Expected %q, got %q", expected, buf.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,475 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/protocol"
+)
+
+var (
+	MetricBudgetTimeoutsL1 = metrics.AddCounter("budget_timeouts_l1", nil)
+	MetricBudgetTimeoutsL2 = metrics.AddCounter("budget_timeouts_l2", nil)
+	MetricBudgetExhausted  = metrics.AddCounter("budget_exhausted", nil)
+)
+
+// BudgetPolicy splits a latency budget for each request between L1 and L2. An L1 operation that
+// runs out of time is abandoned and its keys are treated as misses, so L2 can still answer within
+// what remains. Anything else that runs out of time fails with a temporary failure.
+type BudgetPolicy struct {
+	// Total is the budget for a whole request, across both tiers
+	Total time.Duration
+	// L1 caps the time any single L1 operation may take. 0 means L1 may use the whole budget.
+	L1 time.Duration
+}
+
+// budget is the state of the current request on a connection
+type budget struct {
+	p        BudgetPolicy
+	deadline time.Time
+}
+
+func (b *budget) start() {
+	b.deadline = time.Now().Add(b.p.Total)
+}
+
+// BudgetL1 wraps an L1 handler constructor so its operations can be bounded by Budgeted
+func BudgetL1(hc handlers.HandlerConst) handlers.HandlerConst {
+	return budgetConst(hc, true)
+}
+
+// BudgetL2 wraps an L2 handler constructor so its operations can be bounded by Budgeted
+func BudgetL2(hc handlers.HandlerConst) handlers.HandlerConst {
+	return budgetConst(hc, false)
+}
+
+func budgetConst(hc handlers.HandlerConst, l1 bool) handlers.HandlerConst {
+	return func() (handlers.Handler, error) {
+		h, err := hc()
+		if err != nil {
+			return nil, err
+		}
+		return &budgetHandler{hc: hc, h: h, l1: l1}, nil
+	}
+}
+
+// Budgeted wraps an orchestrator to start a new budget for every request. It only has an effect on
+// handlers from BudgetL1 and BudgetL2, and has to be outside any wrapper that replaces the
+// handlers given to the orchestrator.
+func Budgeted(oc OrcaConst, p BudgetPolicy) OrcaConst {
+	return func(l1, l2 handlers.Handler, res protocol.Responder) Orca {
+		b := &budget{p: p}
+		if bh, ok := handlers.Underlying(l1).(*budgetHandler); ok {
+			bh.b = b
+		}
+		if bh, ok := handlers.Underlying(l2).(*budgetHandler); ok {
+			bh.b = b
+		}
+
+		return &budgetOrca{
+			Orca: oc(l1, l2, res),
+			b:    b,
+		}
+	}
+}
+
+type budgetOrca struct {
+	Orca
+	b *budget
+}
+
+func (o *budgetOrca) Set(req common.SetRequest) error {
+	o.b.start()
+	return o.Orca.Set(req)
+}
+
+func (o *budgetOrca) Add(req common.SetRequest) error {
+	o.b.start()
+	return o.Orca.Add(req)
+}
+
+func (o *budgetOrca) Replace(req common.SetRequest) error {
+	o.b.start()
+	return o.Orca.Replace(req)
+}
+
+func (o *budgetOrca) Append(req common.SetRequest) error {
+	o.b.start()
+	return o.Orca.Append(req)
+}
+
+func (o *budgetOrca) Prepend(req common.SetRequest) error {
+	o.b.start()
+	return o.Orca.Prepend(req)
+}
+
+func (o *budgetOrca) Delete(req common.DeleteRequest) error {
+	o.b.start()
+	return o.Orca.Delete(req)
+}
+
+func (o *budgetOrca) Touch(req common.TouchRequest) error {
+	o.b.start()
+	return o.Orca.Touch(req)
+}
+
+func (o *budgetOrca) Get(req common.GetRequest) error {
+	o.b.start()
+	return o.Orca.Get(req)
+}
+
+func (o *budgetOrca) GetE(req common.GetRequest) error {
+	o.b.start()
+	return o.Orca.GetE(req)
+}
+
+func (o *budgetOrca) Gat(req common.GATRequest) error {
+	o.b.start()
+	return o.Orca.Gat(req)
+}
+
+// budgetHandler bounds each operation by what's left of the request budget. A connection that is
+// still busy with an abandoned operation can't be used again, so it is closed and replaced.
+type budgetHandler struct {
+	hc handlers.HandlerConst
+	h  handlers.Handler
+	l1 bool
+	b  *budget
+}
+
+func (h *budgetHandler) conn() (handlers.Handler, error) {
+	if h.h == nil {
+		hd, err := h.hc()
+		if err != nil {
+			return nil, err
+		}
+		h.h = hd
+	}
+	return h.h, nil
+}
+
+func (h *budgetHandler) abandon() {
+	if h.l1 {
+		metrics.IncCounter(MetricBudgetTimeoutsL1)
+	} else {
+		metrics.IncCounter(MetricBudgetTimeoutsL2)
+	}
+	h.h.Close()
+	h.h = nil
+}
+
+// limit returns the time this operation may take, or false if it isn't bounded at all. Handlers
+// used outside of a Budgeted orchestrator never are.
+func (h *budgetHandler) limit() (time.Duration, bool) {
+	if h.b == nil || h.b.deadline.IsZero() {
+		return 0, false
+	}
+
+	d := time.Until(h.b.deadline)
+	if h.l1 && h.b.p.L1 > 0 && h.b.p.L1 < d {
+		d = h.b.p.L1
+	}
+
+	return d, true
+}
+
+func (h *budgetHandler) run(op func(handlers.Handler) error) error {
+	hd, err := h.conn()
+	if err != nil {
+		return err
+	}
+
+	d, limited := h.limit()
+	if !limited {
+		return op(hd)
+	}
+	if d <= 0 {
+		metrics.IncCounter(MetricBudgetExhausted)
+		return common.ErrTempFailure
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- op(hd)
+	}()
+
+	t := time.NewTimer(d)
+	select {
+	case err := <-done:
+		t.Stop()
+		return err
+	case <-t.C:
+		h.abandon()
+		return common.ErrTempFailure
+	}
+}
+
+func (h *budgetHandler) Set(cmd common.SetRequest) error {
+	return h.run(func(hd handlers.Handler) error { return hd.Set(cmd) })
+}
+
+func (h *budgetHandler) Add(cmd common.SetRequest) error {
+	return h.run(func(hd handlers.Handler) error { return hd.Add(cmd) })
+}
+
+func (h *budgetHandler) Replace(cmd common.SetRequest) error {
+	return h.run(func(hd handlers.Handler) error { return hd.Replace(cmd) })
+}
+
+func (h *budgetHandler) Append(cmd common.SetRequest) error {
+	return h.run(func(hd handlers.Handler) error { return hd.Append(cmd) })
+}
+
+func (h *budgetHandler) Prepend(cmd common.SetRequest) error {
+	return h.run(func(hd handlers.Handler) error { return hd.Prepend(cmd) })
+}
+
+func (h *budgetHandler) Delete(cmd common.DeleteRequest) error {
+	return h.run(func(hd handlers.Handler) error { return hd.Delete(cmd) })
+}
+
+func (h *budgetHandler) Touch(cmd common.TouchRequest) error {
+	return h.run(func(hd handlers.Handler) error { return hd.Touch(cmd) })
+}
+
+func (h *budgetHandler) Incr(cmd common.ArithRequest) (uint64, error) {
+	var v uint64
+	err := h.run(func(hd handlers.Handler) error {
+		var err error
+		v, err = handlers.Incr(hd, cmd)
+		return err
+	})
+	return v, err
+}
+
+func (h *budgetHandler) Decr(cmd common.ArithRequest) (uint64, error) {
+	var v uint64
+	err := h.run(func(hd handlers.Handler) error {
+		var err error
+		v, err = handlers.Decr(hd, cmd)
+		return err
+	})
+	return v, err
+}
+
+func (h *budgetHandler) Flush(cmd common.FlushRequest) error {
+	return h.run(func(hd handlers.Handler) error { return handlers.Flush(hd, cmd) })
+}
+
+func (h *budgetHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	var res common.GetResponse
+	err := h.run(func(hd handlers.Handler) error {
+		var err error
+		res, err = hd.GAT(cmd)
+		return err
+	})
+	return res, err
+}
+
+func (h *budgetHandler) Close() error {
+	if h.h == nil {
+		return nil
+	}
+	return h.h.Close()
+}
+
+// unanswered counts the keys of a get that haven't had a response yet
+func unanswered(keys [][]byte) map[string]int {
+	left := make(map[string]int, len(keys))
+	for _, k := range keys {
+		left[string(k)]++
+	}
+	return left
+}
+
+func (h *budgetHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	hd, err := h.conn()
+	d, limited := h.limit()
+	if err == nil && !limited {
+		return hd.Get(cmd)
+	}
+
+	dataOut := make(chan common.GetResponse, len(cmd.Keys))
+	errorOut := make(chan error, 1)
+
+	// What's left over when the budget runs out. L1 gives up with misses so L2 can answer.
+	timedOut := func(left map[string]int) {
+		if !h.l1 {
+			errorOut <- common.ErrTempFailure
+			return
+		}
+		for i, k := range cmd.Keys {
+			if left[string(k)] > 0 {
+				left[string(k)]--
+				dataOut <- common.GetResponse{Key: k, Opaque: cmd.Opaques[i], Quiet: cmd.Quiet[i], Miss: true}
+			}
+		}
+	}
+
+	if err != nil || d <= 0 {
+		if err != nil {
+			errorOut <- err
+		} else {
+			metrics.IncCounter(MetricBudgetExhausted)
+			timedOut(unanswered(cmd.Keys))
+		}
+		close(dataOut)
+		close(errorOut)
+		return dataOut, errorOut
+	}
+
+	resChan, errChan := hd.Get(cmd)
+
+	go func() {
+		defer close(dataOut)
+		defer close(errorOut)
+
+		left := unanswered(cmd.Keys)
+		t := time.NewTimer(d)
+		defer t.Stop()
+
+		for resChan != nil || errChan != nil {
+			select {
+			case res, ok := <-resChan:
+				if !ok {
+					resChan = nil
+				} else {
+					left[string(res.Key)]--
+					dataOut <- res
+				}
+			case err, ok := <-errChan:
+				if !ok {
+					errChan = nil
+				} else {
+					errorOut <- err
+				}
+			case <-t.C:
+				h.abandon()
+				go drainGetChans(resChan, errChan)
+				timedOut(left)
+				return
+			}
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+func (h *budgetHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	hd, err := h.conn()
+	d, limited := h.limit()
+	if err == nil && !limited {
+		return hd.GetE(cmd)
+	}
+
+	dataOut := make(chan common.GetEResponse, len(cmd.Keys))
+	errorOut := make(chan error, 1)
+
+	timedOut := func(left map[string]int) {
+		if !h.l1 {
+			errorOut <- common.ErrTempFailure
+			return
+		}
+		for i, k := range cmd.Keys {
+			if left[string(k)] > 0 {
+				left[string(k)]--
+				dataOut <- common.GetEResponse{Key: k, Opaque: cmd.Opaques[i], Quiet: cmd.Quiet[i], Miss: true}
+			}
+		}
+	}
+
+	if err != nil || d <= 0 {
+		if err != nil {
+			errorOut <- err
+		} else {
+			metrics.IncCounter(MetricBudgetExhausted)
+			timedOut(unanswered(cmd.Keys))
+		}
+		close(dataOut)
+		close(errorOut)
+		return dataOut, errorOut
+	}
+
+	resChan, errChan := hd.GetE(cmd)
+
+	go func() {
+		defer close(dataOut)
+		defer close(errorOut)
+
+		left := unanswered(cmd.Keys)
+		t := time.NewTimer(d)
+		defer t.Stop()
+
+		for resChan != nil || errChan != nil {
+			select {
+			case res, ok := <-resChan:
+				if !ok {
+					resChan = nil
+				} else {
+					left[string(res.Key)]--
+					dataOut <- res
+				}
+			case err, ok := <-errChan:
+				if !ok {
+					errChan = nil
+				} else {
+					errorOut <- err
+				}
+			case <-t.C:
+				h.abandon()
+				go drainGetEChans(resChan, errChan)
+				timedOut(left)
+				return
+			}
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+// drainGetChans reads an abandoned get to completion so the goroutine behind it can exit
+func drainGetChans(resChan <-chan common.GetResponse, errChan <-chan error) {
+	for resChan != nil || errChan != nil {
+		select {
+		case _, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			}
+		case _, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			}
+		}
+	}
+}
+
+func drainGetEChans(resChan <-chan common.GetEResponse, errChan <-chan error) {
+	for resChan != nil || errChan != nil {
+		select {
+		case _, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			}
+		case _, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			}
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol"
+)
+
+// sleepyHandler hits on every get after a delay
+type sleepyHandler struct {
+	handlers.Handler
+	delay  time.Duration
+	closes *int
+}
+
+func (s sleepyHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	resChan := make(chan common.GetResponse)
+	errChan := make(chan error)
+	go func() {
+		time.Sleep(s.delay)
+		for i, k := range cmd.Keys {
+			resChan <- common.GetResponse{Key: k, Opaque: cmd.Opaques[i]}
+		}
+		close(resChan)
+		close(errChan)
+	}()
+	return resChan, errChan
+}
+
+func (s sleepyHandler) Flush(cmd common.FlushRequest) error {
+	time.Sleep(s.delay)
+	return nil
+}
+
+func (s sleepyHandler) Incr(cmd common.ArithRequest) (uint64, error) {
+	time.Sleep(s.delay)
+	return cmd.Delta, nil
+}
+
+func (s sleepyHandler) Decr(cmd common.ArithRequest) (uint64, error) {
+	time.Sleep(s.delay)
+	return 0, nil
+}
+
+func (s sleepyHandler) Close() error {
+	*s.closes++
+	return nil
+}
+
+// tierOrca gets from one tier and records what came back
+type tierOrca struct {
+	testPanicOrca
+	h      handlers.Handler
+	misses int
+	err    error
+}
+
+func (o *tierOrca) Get(req common.GetRequest) error {
+	resChan, errChan := o.h.Get(req)
+	for resChan != nil || errChan != nil {
+		select {
+		case res, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			} else if res.Miss {
+				o.misses++
+			}
+		case err, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			} else {
+				o.err = err
+			}
+		}
+	}
+	return o.err
+}
+
+func (o *tierOrca) Flush(req common.FlushRequest) error {
+	o.err = handlers.Flush(o.h, req)
+	return o.err
+}
+
+func budgetedGet(l1 bool, delay time.Duration) (*tierOrca, int) {
+	var closes int
+	hc := func() (handlers.Handler, error) { return sleepyHandler{delay: delay, closes: &closes}, nil }
+
+	var h handlers.Handler
+	if l1 {
+		h, _ = orcas.BudgetL1(hc)()
+	} else {
+		h, _ = orcas.BudgetL2(hc)()
+	}
+
+	to := &tierOrca{h: h}
+	o := orcas.Budgeted(func(l1, l2 handlers.Handler, res protocol.Responder) orcas.Orca {
+		return to
+	}, orcas.BudgetPolicy{Total: 50 * time.Millisecond, L1: 5 * time.Millisecond})(h, h, nil)
+
+	o.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte("a"), []byte("b")},
+		Opaques: []uint32{0, 1},
+		Quiet:   []bool{false, false},
+	})
+
+	return to, closes
+}
+
+func TestBudget(t *testing.T) {
+	t.Run("WithinBudget", func(t *testing.T) {
+		to, closes := budgetedGet(true, 0)
+		if to.misses != 0 || to.err != nil || closes != 0 {
+			t.Fatalf("Expected hits within budget, got %d misses, %v, %d closes", to.misses, to.err, closes)
+		}
+	})
+
+	t.Run("L1TimesOutAsMisses", func(t *testing.T) {
+		start := time.Now()
+		to, closes := budgetedGet(true, time.Second)
+		if to.misses != 2 || to.err != nil {
+			t.Fatalf("Expected a slow L1 to give misses, got %d misses and %v", to.misses, to.err)
+		}
+		if closes != 1 {
+			t.Fatalf("Expected the abandoned L1 connection to be closed, got %d closes", closes)
+		}
+		if time.Since(start) > 40*time.Millisecond {
+			t.Fatal("Expected L1 to give up after its share of the budget")
+		}
+	})
+
+	t.Run("L2TimesOutAsError", func(t *testing.T) {
+		to, _ := budgetedGet(false, time.Second)
+		if to.err != common.ErrTempFailure {
+			t.Fatalf("Expected a slow L2 to fail temporarily, got %v", to.err)
+		}
+	})
+
+	t.Run("Unbudgeted", func(t *testing.T) {
+		var closes int
+		h, _ := orcas.BudgetL2(func() (handlers.Handler, error) {
+			return sleepyHandler{delay: 10 * time.Millisecond, closes: &closes}, nil
+		})()
+		to := &tierOrca{h: h}
+		to.Get(common.GetRequest{Keys: [][]byte{[]byte("a")}, Opaques: []uint32{0}, Quiet: []bool{false}})
+		if to.err != nil || to.misses != 0 {
+			t.Fatal("Expected handlers outside a budgeted orchestrator to be unbounded")
+		}
+		if v, err := handlers.Incr(h, common.ArithRequest{Delta: 2}); err != nil || v != 2 {
+			t.Fatalf("Expected increments to be passed on, got %d and %v", v, err)
+		}
+		if _, err := handlers.Decr(h, common.ArithRequest{Delta: 2}); err != nil {
+			t.Fatalf("Expected decrements to be passed on, got %v", err)
+		}
+	})
+
+	t.Run("FlushTimesOut", func(t *testing.T) {
+		var closes int
+		h, _ := orcas.BudgetL2(func() (handlers.Handler, error) {
+			return sleepyHandler{delay: time.Second, closes: &closes}, nil
+		})()
+
+		to := &tierOrca{h: h}
+		o := orcas.Budgeted(func(l1, l2 handlers.Handler, res protocol.Responder) orcas.Orca {
+			return to
+		}, orcas.BudgetPolicy{Total: 20 * time.Millisecond})(h, h, nil)
+
+		start := time.Now()
+		if err := orcas.Flush(o, common.FlushRequest{}); err != common.ErrTempFailure {
+			t.Fatalf("Expected a slow flush to run out of budget, got %v", err)
+		}
+		if closes != 1 || time.Since(start) > 500*time.Millisecond {
+			t.Fatalf("Expected the flush to be abandoned, got %d closes", closes)
+		}
+	})
+}
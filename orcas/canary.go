@@ -0,0 +1,346 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/protocol"
+	"github.com/netflix/rend/timer"
+)
+
+const (
+	armBaseline = iota
+	armCanary
+	numArms
+)
+
+var armNames = [numArms]string{"baseline", "canary"}
+
+var (
+	MetricCanaryRequests = [numArms]uint32{
+		metrics.AddCounter("canary_requests", metrics.Tags{"arm": "baseline"}),
+		metrics.AddCounter("canary_requests", metrics.Tags{"arm": "canary"}),
+	}
+	MetricCanaryErrors = [numArms]uint32{
+		metrics.AddCounter("canary_errors", metrics.Tags{"arm": "baseline"}),
+		metrics.AddCounter("canary_errors", metrics.Tags{"arm": "canary"}),
+	}
+	HistCanary = [numArms]uint32{
+		metrics.AddHistogram("canary", false, metrics.Tags{"arm": "baseline"}),
+		metrics.AddHistogram("canary", false, metrics.Tags{"arm": "canary"}),
+	}
+)
+
+// canaryScale is the resolution of the split; a percentage is turned into a share of this many
+// buckets, so it can be as fine as a hundredth of a percent
+const canaryScale = 10000
+
+// CanarySplit decides how much traffic goes to the canary orchestrator of everything wrapped with
+// it, and keeps the numbers to compare the two by. It's shared by every connection so the split
+// and the kill switch apply to all of them at once.
+type CanarySplit struct {
+	lock    sync.RWMutex
+	enabled bool
+	share   int
+	byKey   bool
+
+	requests [numArms]uint64
+	errors   [numArms]uint64
+	latency  [numArms]uint64
+}
+
+// NewCanarySplit creates a CanarySplit sending the given percentage of traffic to the canary. With
+// byKey the split is made by a hash of each request's key, so any given key is always served by
+// the same side; otherwise each connection is assigned to a side as a whole.
+func NewCanarySplit(percent float64, byKey bool) (*CanarySplit, error) {
+	share, err := canaryShare(percent)
+	if err != nil {
+		return nil, err
+	}
+	return &CanarySplit{
+		enabled: true,
+		share:   share,
+		byKey:   byKey,
+	}, nil
+}
+
+func canaryShare(percent float64) (int, error) {
+	if percent < 0 || percent > 100 {
+		return 0, fmt.Errorf("Canary percentage %v must be between 0 and 100", percent)
+	}
+	return int(percent * canaryScale / 100), nil
+}
+
+// Percent returns the percentage of traffic going to the canary, which is 0 while it's disabled
+func (s *CanarySplit) Percent() float64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if !s.enabled {
+		return 0
+	}
+	return float64(s.share) * 100 / canaryScale
+}
+
+// SetPercent changes the percentage of traffic going to the canary. Connections and keys keep
+// their place in the split, so raising it only adds to what the canary already serves.
+func (s *CanarySplit) SetPercent(percent float64) error {
+	share, err := canaryShare(percent)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	old := s.share
+	s.share = share
+	s.lock.Unlock()
+
+	if old != share {
+		log.Printf("Canary share changed from %v%% to %v%%\n", float64(old)*100/canaryScale, percent)
+	}
+	return nil
+}
+
+// SetEnabled is the kill switch. While the canary is disabled every request goes to the baseline,
+// starting with the next request on every connection.
+func (s *CanarySplit) SetEnabled(enabled bool) {
+	s.lock.Lock()
+	old := s.enabled
+	s.enabled = enabled
+	s.lock.Unlock()
+
+	if old != enabled {
+		log.Printf("Canary enabled changed from %v to %v\n", old, enabled)
+	}
+}
+
+// arm returns which side a request falls on given its place in the split, from 0 to canaryScale
+func (s *CanarySplit) arm(bucket uint32) int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.enabled && int(bucket) < s.share {
+		return armCanary
+	}
+	return armBaseline
+}
+
+func (s *CanarySplit) observe(arm int, start uint64, err error) {
+	elapsed := timer.Since(start)
+
+	metrics.IncCounter(MetricCanaryRequests[arm])
+	metrics.ObserveHist(HistCanary[arm], elapsed)
+	atomic.AddUint64(&s.requests[arm], 1)
+	atomic.AddUint64(&s.latency[arm], elapsed)
+
+	// Misses and failed conditions are answers, not failures of the orchestrator
+	switch common.ClassOf(err) {
+	case common.ClassFatal, common.ClassServer:
+		metrics.IncCounter(MetricCanaryErrors[arm])
+		atomic.AddUint64(&s.errors[arm], 1)
+	}
+}
+
+type canaryArmStatus struct {
+	Requests    uint64  `json:"requests"`
+	Errors      uint64  `json:"errors"`
+	ErrorRate   float64 `json:"error_rate"`
+	MeanLatency string  `json:"mean_latency"`
+}
+
+type canaryStatus struct {
+	Enabled bool                       `json:"enabled"`
+	Percent float64                    `json:"percent"`
+	ByKey   bool                       `json:"by_key"`
+	Arms    map[string]canaryArmStatus `json:"arms"`
+}
+
+// ServeHTTP reports the split and how each side has done since startup as JSON. A POST with an
+// enabled parameter turns the canary on or off, and one with a percent parameter changes the
+// split.
+func (s *CanarySplit) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if v := r.FormValue("percent"); v != "" {
+			p, err := strconv.ParseFloat(v, 64)
+			if err == nil {
+				err = s.SetPercent(p)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if v := r.FormValue("enabled"); v != "" {
+			enabled, err := strconv.ParseBool(v)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			s.SetEnabled(enabled)
+		}
+	}
+
+	s.lock.RLock()
+	status := canaryStatus{
+		Enabled: s.enabled,
+		Percent: float64(s.share) * 100 / canaryScale,
+		ByKey:   s.byKey,
+		Arms:    make(map[string]canaryArmStatus, numArms),
+	}
+	s.lock.RUnlock()
+
+	for arm, name := range armNames {
+		a := canaryArmStatus{
+			Requests: atomic.LoadUint64(&s.requests[arm]),
+			Errors:   atomic.LoadUint64(&s.errors[arm]),
+		}
+		if a.Requests > 0 {
+			a.ErrorRate = float64(a.Errors) / float64(a.Requests)
+			a.MeanLatency = time.Duration(atomic.LoadUint64(&s.latency[arm]) / a.Requests).String()
+		}
+		status.Arms[name] = a
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// Canary sends the share of traffic set by s to the canary orchestrator and the rest to the
+// baseline, e.g. to roll out a new L1L2 policy to a small part of the traffic first. Both are
+// built for every connection on the same handlers and responder, so either can serve any request
+// at any time; the split, the kill switch, and the per-side metrics all take effect per request.
+// Requests without a key, like noop and version, always go to the baseline and aren't counted.
+func Canary(baseline, canary OrcaConst, s *CanarySplit) OrcaConst {
+	return func(l1, l2 handlers.Handler, res protocol.Responder) Orca {
+		return &canaryOrca{
+			arms: [numArms]Orca{baseline(l1, l2, res), canary(l1, l2, res)},
+			s:    s,
+			conn: uint32(rand.Intn(canaryScale)),
+		}
+	}
+}
+
+type canaryOrca struct {
+	arms [numArms]Orca
+	s    *CanarySplit
+	// conn is the place of this connection in the split when it isn't made by key
+	conn uint32
+}
+
+// pick returns the side the request for key goes to, along with the time it started
+func (o *canaryOrca) pick(key []byte) (int, uint64) {
+	bucket := o.conn
+	if o.s.byKey {
+		h := fnv.New32a()
+		h.Write(key)
+		bucket = h.Sum32() % canaryScale
+	}
+	return o.s.arm(bucket), timer.Now()
+}
+
+// done records the outcome of a request picked earlier and passes its error on
+func (o *canaryOrca) done(arm int, start uint64, err error) error {
+	o.s.observe(arm, start, err)
+	return err
+}
+
+func (o *canaryOrca) Set(req common.SetRequest) error {
+	arm, start := o.pick(req.Key)
+	return o.done(arm, start, o.arms[arm].Set(req))
+}
+
+func (o *canaryOrca) Add(req common.SetRequest) error {
+	arm, start := o.pick(req.Key)
+	return o.done(arm, start, o.arms[arm].Add(req))
+}
+
+func (o *canaryOrca) Replace(req common.SetRequest) error {
+	arm, start := o.pick(req.Key)
+	return o.done(arm, start, o.arms[arm].Replace(req))
+}
+
+func (o *canaryOrca) Append(req common.SetRequest) error {
+	arm, start := o.pick(req.Key)
+	return o.done(arm, start, o.arms[arm].Append(req))
+}
+
+func (o *canaryOrca) Prepend(req common.SetRequest) error {
+	arm, start := o.pick(req.Key)
+	return o.done(arm, start, o.arms[arm].Prepend(req))
+}
+
+func (o *canaryOrca) Delete(req common.DeleteRequest) error {
+	arm, start := o.pick(req.Key)
+	return o.done(arm, start, o.arms[arm].Delete(req))
+}
+
+func (o *canaryOrca) Touch(req common.TouchRequest) error {
+	arm, start := o.pick(req.Key)
+	return o.done(arm, start, o.arms[arm].Touch(req))
+}
+
+// A multiget is served by one side as a whole, picked by its first key
+func (o *canaryOrca) Get(req common.GetRequest) error {
+	arm, start := o.pick(firstKey(req.Keys))
+	return o.done(arm, start, o.arms[arm].Get(req))
+}
+
+func (o *canaryOrca) GetE(req common.GetRequest) error {
+	arm, start := o.pick(firstKey(req.Keys))
+	return o.done(arm, start, o.arms[arm].GetE(req))
+}
+
+func (o *canaryOrca) Gat(req common.GATRequest) error {
+	arm, start := o.pick(req.Key)
+	return o.done(arm, start, o.arms[arm].Gat(req))
+}
+
+func (o *canaryOrca) Noop(req common.NoopRequest) error {
+	return o.arms[armBaseline].Noop(req)
+}
+
+func (o *canaryOrca) Quit(req common.QuitRequest) error {
+	return o.arms[armBaseline].Quit(req)
+}
+
+func (o *canaryOrca) Version(req common.VersionRequest) error {
+	return o.arms[armBaseline].Version(req)
+}
+
+func (o *canaryOrca) Unknown(req common.Request) error {
+	return o.arms[armBaseline].Unknown(req)
+}
+
+func (o *canaryOrca) Error(req common.Request, reqType common.RequestType, err error) {
+	o.arms[armBaseline].Error(req, reqType, err)
+}
+
+func firstKey(keys [][]byte) []byte {
+	if len(keys) > 0 {
+		return keys[0]
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol"
+)
+
+// failingSetOrca answers every set with err and panics on anything else
+type failingSetOrca struct {
+	testPanicOrca
+	err error
+}
+
+func (s failingSetOrca) Set(req common.SetRequest) error { return s.err }
+
+func failingSetOrcaConst(err error) orcas.OrcaConst {
+	return func(l1, l2 handlers.Handler, res protocol.Responder) orcas.Orca {
+		return failingSetOrca{err: err}
+	}
+}
+
+type canaryArm struct {
+	Requests uint64 `json:"requests"`
+	Errors   uint64 `json:"errors"`
+}
+
+func canaryStatus(t *testing.T, s *orcas.CanarySplit, query string) map[string]canaryArm {
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/canary?"+query, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Canary admin request %q failed: %d %s", query, rec.Code, rec.Body.String())
+	}
+
+	var status struct {
+		Arms map[string]canaryArm `json:"arms"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	return status.Arms
+}
+
+func TestCanaryByKey(t *testing.T) {
+	s, err := orcas.NewCanarySplit(50, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := orcas.Canary(failingSetOrcaConst(nil), failingSetOrcaConst(common.ErrTempFailure), s)(nil, nil, nil)
+
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = []byte("key" + strconv.Itoa(i))
+	}
+
+	// A key always gets the same answer
+	failed := make(map[string]bool)
+	for _, k := range keys {
+		failed[string(k)] = o.Set(common.SetRequest{Key: k}) != nil
+	}
+	for _, k := range keys {
+		if (o.Set(common.SetRequest{Key: k}) != nil) != failed[string(k)] {
+			t.Fatalf("Key %s moved between the baseline and the canary", k)
+		}
+	}
+
+	arms := canaryStatus(t, s, "")
+	b, c := arms["baseline"], arms["canary"]
+	if b.Requests+c.Requests != 2000 || c.Requests < 800 || c.Requests > 1200 {
+		t.Fatalf("Expected about half of 2000 requests in the canary, got %+v", arms)
+	}
+	if b.Errors != 0 || c.Errors != c.Requests {
+		t.Fatalf("Expected the errors to be counted against the canary, got %+v", arms)
+	}
+
+	// The kill switch sends everything to the baseline from the very next request
+	canaryStatus(t, s, "enabled=false")
+	for _, k := range keys {
+		if err := o.Set(common.SetRequest{Key: k}); err != nil {
+			t.Fatalf("Expected the baseline with the canary disabled, got %v", err)
+		}
+	}
+	if arms := canaryStatus(t, s, ""); arms["canary"].Requests != c.Requests {
+		t.Fatalf("Expected no more canary requests once disabled, got %+v", arms)
+	}
+}
+
+func TestCanaryByConnection(t *testing.T) {
+	s, err := orcas.NewCanarySplit(100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oc := orcas.Canary(failingSetOrcaConst(nil), failingSetOrcaConst(common.ErrTempFailure), s)
+
+	// Every connection is in the canary at 100%, and stays there whatever the key
+	for i := 0; i < 10; i++ {
+		o := oc(nil, nil, nil)
+		for j := 0; j < 10; j++ {
+			if o.Set(common.SetRequest{Key: []byte(strconv.Itoa(j))}) == nil {
+				t.Fatal("Expected every request in the canary")
+			}
+		}
+	}
+
+	canaryStatus(t, s, "percent=0")
+	if s.Percent() != 0 {
+		t.Fatalf("Expected the canary share to be 0, got %v", s.Percent())
+	}
+	if err := oc(nil, nil, nil).Set(common.SetRequest{Key: []byte("a")}); err != nil {
+		t.Fatalf("Expected the baseline at 0%%, got %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/canary?percent=101", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a share over 100%% to be rejected, got %d", rec.Code)
+	}
+}
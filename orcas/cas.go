@@ -0,0 +1,444 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/protocol"
+	"github.com/netflix/rend/timer"
+)
+
+var (
+	MetricCmdGetsL1     = metrics.AddCounter("cmd_gets_l1", nil)
+	MetricCmdGetsL2     = metrics.AddCounter("cmd_gets_l2", nil)
+	MetricCmdGetsHits   = metrics.AddCounter("cmd_gets_hits", nil)
+	MetricCmdGetsMisses = metrics.AddCounter("cmd_gets_misses", nil)
+	MetricCmdGetsErrors = metrics.AddCounter("cmd_gets_errors", nil)
+
+	MetricCmdCASL1     = metrics.AddCounter("cmd_cas_l1", nil)
+	MetricCmdCASL2     = metrics.AddCounter("cmd_cas_l2", nil)
+	MetricCmdCASStored = metrics.AddCounter("cmd_cas_stored", nil)
+	MetricCmdCASExists = metrics.AddCounter("cmd_cas_exists", nil)
+	MetricCmdCASMisses = metrics.AddCounter("cmd_cas_misses", nil)
+	MetricCmdCASErrors = metrics.AddCounter("cmd_cas_errors", nil)
+
+	HistGetsL1 = metrics.AddHistogram("gets_l1", false, nil)
+	HistGetsL2 = metrics.AddHistogram("gets_l2", false, nil)
+	HistCASL1  = metrics.AddHistogram("cas_l1", false, nil)
+	HistCASL2  = metrics.AddHistogram("cas_l2", false, nil)
+)
+
+// CASer is implemented by orchestrators that support memcached's gets and cas. Gets answers like a
+// get with the CAS value of each hit, and CompareAndSwap only does the set if the CAS value of the
+// key is still the one in the request.
+type CASer interface {
+	Gets(req common.GetRequest) error
+	CompareAndSwap(req common.CASRequest) error
+}
+
+// CASerV2 is the context-aware form of CASer for OrcaV2 implementations.
+type CASerV2 interface {
+	Gets(ctx context.Context, req common.GetRequest) error
+	CompareAndSwap(ctx context.Context, req common.CASRequest) error
+}
+
+// Gets does the gets in req with o, or returns common.ErrNotSupported if o doesn't implement CASer.
+func Gets(o Orca, req common.GetRequest) error {
+	if c, ok := o.(CASer); ok {
+		return c.Gets(req)
+	}
+	return common.ErrNotSupported
+}
+
+// CompareAndSwap does the cas in req with o, or returns common.ErrNotSupported if o doesn't
+// implement CASer.
+func CompareAndSwap(o Orca, req common.CASRequest) error {
+	if c, ok := o.(CASer); ok {
+		return c.CompareAndSwap(req)
+	}
+	return common.ErrNotSupported
+}
+
+// GetsV2 is the OrcaV2 counterpart of Gets.
+func GetsV2(ctx context.Context, o OrcaV2, req common.GetRequest) error {
+	if c, ok := o.(CASerV2); ok {
+		return c.Gets(ctx, req)
+	}
+	return common.ErrNotSupported
+}
+
+// CompareAndSwapV2 is the OrcaV2 counterpart of CompareAndSwap.
+func CompareAndSwapV2(ctx context.Context, o OrcaV2, req common.CASRequest) error {
+	if c, ok := o.(CASerV2); ok {
+		return c.CompareAndSwap(ctx, req)
+	}
+	return common.ErrNotSupported
+}
+
+// gets answers the gets in req from a single handler and counts the outcome
+func gets(h handlers.Handler, res protocol.Responder, req common.GetRequest, counter uint32, hist uint32) error {
+	metrics.IncCounter(counter)
+	start := timer.Now()
+
+	resChan, errChan := handlers.Gets(h, req)
+
+	// Same contract as for a get: once an error arrives there are no more responses
+	var err error
+	for resChan != nil || errChan != nil {
+		select {
+		case r, ok := <-resChan:
+			if !ok {
+				resChan = nil
+				continue
+			}
+			if r.Miss {
+				metrics.IncCounter(MetricCmdGetsMisses)
+			} else {
+				metrics.IncCounter(MetricCmdGetsHits)
+			}
+			res.Gets(r)
+
+		case getErr, ok := <-errChan:
+			if !ok {
+				errChan = nil
+				continue
+			}
+			metrics.IncCounter(MetricCmdGetsErrors)
+			err = getErr
+		}
+	}
+
+	metrics.ObserveHist(hist, timer.Since(start))
+
+	if err != nil {
+		return err
+	}
+	return res.GetEnd(req.NoopOpaque, req.NoopEnd)
+}
+
+// compareAndSwap does the cas against a single handler and counts the outcome
+func compareAndSwap(h handlers.Handler, req common.CASRequest, counter uint32, hist uint32) error {
+	metrics.IncCounter(counter)
+	start := timer.Now()
+
+	err := handlers.CompareAndSwap(h, req)
+
+	metrics.ObserveHist(hist, timer.Since(start))
+
+	switch {
+	case err == nil:
+	case errors.Is(err, common.ErrKeyExists):
+		metrics.IncCounter(MetricCmdCASExists)
+	case errors.Is(err, common.ErrKeyNotFound):
+		metrics.IncCounter(MetricCmdCASMisses)
+	default:
+		metrics.IncCounter(MetricCmdCASErrors)
+	}
+
+	return err
+}
+
+func (l *L1OnlyOrca) Gets(req common.GetRequest) error {
+	return gets(l.l1, l.res, req, MetricCmdGetsL1, HistGetsL1)
+}
+
+func (l *L1OnlyOrca) CompareAndSwap(req common.CASRequest) error {
+	if err := compareAndSwap(l.l1, req, MetricCmdCASL1, HistCASL1); err != nil {
+		return err
+	}
+
+	metrics.IncCounter(MetricCmdCASStored)
+	return l.res.CompareAndSwap(req.Opaque, req.Quiet)
+}
+
+// The CAS values of L1 aren't related to the ones in L2, and only L2 is shared by every instance, so
+// gets is always answered from L2 and cas checked there. A successful cas sets L1 the same way as a
+// conditional set does.
+func (l *L1L2Orca) Gets(req common.GetRequest) error {
+	return gets(l.l2, l.res, req, MetricCmdGetsL2, HistGetsL2)
+}
+
+func (l *L1L2Orca) CompareAndSwap(req common.CASRequest) error {
+	if err := compareAndSwap(l.l2, req, MetricCmdCASL2, HistCASL2); err != nil {
+		return err
+	}
+
+	metrics.IncCounter(MetricCmdSetL1)
+	start := timer.Now()
+
+	err := l.l1.Set(req.SetRequest)
+
+	metrics.ObserveHist(HistSetL1, timer.Since(start))
+
+	if err != nil {
+		metrics.IncCounter(MetricCmdSetErrorsL1)
+		metrics.IncCounter(MetricCmdCASErrors)
+		return err
+	}
+	metrics.IncCounter(MetricCmdSetSuccessL1)
+
+	metrics.IncCounter(MetricCmdCASStored)
+	return l.res.CompareAndSwap(req.Opaque, req.Quiet)
+}
+
+func (l *L1L2BatchOrca) Gets(req common.GetRequest) error {
+	return gets(l.l2, l.res, req, MetricCmdGetsL2, HistGetsL2)
+}
+
+func (l *L1L2BatchOrca) CompareAndSwap(req common.CASRequest) error {
+	if err := compareAndSwap(l.l2, req, MetricCmdCASL2, HistCASL2); err != nil {
+		return err
+	}
+
+	metrics.IncCounter(MetricCmdSetReplaceL1)
+	start := timer.Now()
+
+	err := l.l1.Replace(req.SetRequest)
+
+	metrics.ObserveHist(HistReplaceL1, timer.Since(start))
+
+	if err != nil {
+		if errors.Is(err, common.ErrKeyNotFound) {
+			metrics.IncCounter(MetricCmdSetReplaceNotStoredL1)
+		} else {
+			metrics.IncCounter(MetricCmdSetReplaceErrorsL1)
+			metrics.IncCounter(MetricCmdCASErrors)
+			return err
+		}
+	} else {
+		metrics.IncCounter(MetricCmdSetReplaceStoredL1)
+	}
+
+	metrics.IncCounter(MetricCmdCASStored)
+	return l.res.CompareAndSwap(req.Opaque, req.Quiet)
+}
+
+// Gets takes the read lock of each key in turn, like Get
+func (l *LockedOrca) Gets(req common.GetRequest) error {
+	var ret error
+	var lock sync.Locker
+
+	// guarantee that an operation that failed with a panic will unlock its lock
+	defer func() {
+		if r := recover(); r != nil {
+			if lock != nil {
+				lock.Unlock()
+			}
+
+			panic(r)
+		}
+	}()
+
+	for idx, key := range req.Keys {
+		lock = l.getlock(key, true)
+		lock.Lock()
+
+		noopOpaque := uint32(0)
+		noopEnd := false
+		if idx == len(req.Keys)-1 {
+			noopOpaque = req.NoopOpaque
+			noopEnd = req.NoopEnd
+		}
+
+		ret = Gets(l.wrapped, common.GetRequest{
+			Keys:       [][]byte{key},
+			Opaques:    []uint32{req.Opaques[idx]},
+			Quiet:      []bool{req.Quiet[idx]},
+			NoopOpaque: noopOpaque,
+			NoopEnd:    noopEnd,
+		})
+
+		lock.Unlock()
+		lock = nil
+
+		if ret != nil {
+			break
+		}
+	}
+
+	return ret
+}
+
+func (l *LockedOrca) CompareAndSwap(req common.CASRequest) error {
+	lock := l.getlock(req.Key, false)
+	lock.Lock()
+	defer lock.Unlock()
+	return CompareAndSwap(l.wrapped, req)
+}
+
+func (o *modedOrca) Gets(req common.GetRequest) error {
+	miss, err := o.read()
+	if err != nil {
+		return err
+	}
+	if !miss {
+		return Gets(o.Orca, req)
+	}
+
+	for i, key := range req.Keys {
+		o.res.Gets(common.GetResponse{
+			Key:    key,
+			Opaque: req.Opaques[i],
+			Quiet:  req.Quiet[i],
+			Miss:   true,
+		})
+	}
+	return o.res.GetEnd(req.NoopOpaque, req.NoopEnd)
+}
+
+func (o *modedOrca) CompareAndSwap(req common.CASRequest) error {
+	if err := o.write(); err != nil {
+		return err
+	}
+	return CompareAndSwap(o.Orca, req)
+}
+
+func (o *budgetOrca) Gets(req common.GetRequest) error {
+	o.b.start()
+	return Gets(o.Orca, req)
+}
+
+func (o *budgetOrca) CompareAndSwap(req common.CASRequest) error {
+	o.b.start()
+	return CompareAndSwap(o.Orca, req)
+}
+
+func (o *canaryOrca) Gets(req common.GetRequest) error {
+	arm, start := o.pick(firstKey(req.Keys))
+	return o.done(arm, start, Gets(o.arms[arm], req))
+}
+
+func (o *canaryOrca) CompareAndSwap(req common.CASRequest) error {
+	arm, start := o.pick(req.Key)
+	return o.done(arm, start, CompareAndSwap(o.arms[arm], req))
+}
+
+func (p *prioritizedOrca) Gets(req common.GetRequest) error {
+	var key []byte
+	if len(req.Keys) > 0 {
+		key = req.Keys[0]
+	}
+	p.acquire(key)
+	defer p.s.Release()
+	return Gets(p.Orca, req)
+}
+
+func (p *prioritizedOrca) CompareAndSwap(req common.CASRequest) error {
+	p.acquire(req.Key)
+	defer p.s.Release()
+	return CompareAndSwap(p.Orca, req)
+}
+
+func (o *shedOrca) Gets(req common.GetRequest) error {
+	if err := o.read(len(req.Keys)); err != nil {
+		return err
+	}
+	return Gets(o.Orca, req)
+}
+
+func (o *shedOrca) CompareAndSwap(req common.CASRequest) error {
+	if err := o.write(len(req.Data)); err != nil {
+		return err
+	}
+	return CompareAndSwap(o.Orca, req)
+}
+
+func (c *v2Orca) Gets(ctx context.Context, req common.GetRequest) error {
+	defer c.ctx.enter(ctx)()
+	return Gets(c.o, req)
+}
+
+func (c *v2Orca) CompareAndSwap(ctx context.Context, req common.CASRequest) error {
+	defer c.ctx.enter(ctx)()
+	return CompareAndSwap(c.o, req)
+}
+
+func (v v1Orca) Gets(req common.GetRequest) error {
+	return GetsV2(v.ctx, v.o, req)
+}
+
+func (v v1Orca) CompareAndSwap(req common.CASRequest) error {
+	return CompareAndSwapV2(v.ctx, v.o, req)
+}
+
+func (b boundHandler) Gets(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	b.enter()
+	return handlers.GetsV2(b.ctx.get(), b.h, cmd)
+}
+
+func (b boundHandler) CompareAndSwap(cmd common.CASRequest) error {
+	defer b.enter()()
+	return handlers.CompareAndSwapV2(b.ctx.get(), b.h, cmd)
+}
+
+// The other handler wrappers don't implement handlers.CASer, so their CAS values are emulated from
+// the value like for any other handler without them. Size routing has no cas for the same reason it
+// has no SetIfMatch.
+
+func (o *tombstoneOrca) Gets(req common.GetRequest) error {
+	return o.read(func() error { return Gets(o.Orca, req) })
+}
+
+func (o *tombstoneOrca) CompareAndSwap(req common.CASRequest) error {
+	return CompareAndSwap(o.Orca, req)
+}
+
+func (h *tombstoneHandler) Gets(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	return handlers.Gets(h.Handler, cmd)
+}
+
+func (h *tombstoneHandler) CompareAndSwap(cmd common.CASRequest) error {
+	return handlers.CompareAndSwap(h.Handler, cmd)
+}
+
+func (o *admissionOrca) Gets(req common.GetRequest) error {
+	return Gets(o.Orca, req)
+}
+
+func (o *admissionOrca) CompareAndSwap(req common.CASRequest) error {
+	return CompareAndSwap(o.Orca, req)
+}
+
+func (h *admissionHandler) Gets(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	return handlers.Gets(h.Handler, cmd)
+}
+
+func (h *admissionHandler) CompareAndSwap(cmd common.CASRequest) error {
+	return handlers.CompareAndSwap(h.Handler, cmd)
+}
+
+func (o *quotaOrca) Gets(req common.GetRequest) error {
+	return Gets(o.Orca, req)
+}
+
+func (o *quotaOrca) CompareAndSwap(req common.CASRequest) error {
+	return o.write(req.SetRequest, false, func() error { return CompareAndSwap(o.Orca, req) })
+}
+
+// A gets is for updating the keys it reads, which is no time to mistake a failure for a miss, so
+// its errors are left alone
+func (h *quietHandler) Gets(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	return handlers.Gets(h.Handler, cmd)
+}
+
+func (h *quietHandler) CompareAndSwap(cmd common.CASRequest) error {
+	return handlers.CompareAndSwap(h.Handler, cmd)
+}
@@ -0,0 +1,100 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers/inmem"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol/textprot"
+)
+
+func TestCompareAndSwap(t *testing.T) {
+	// L2 holds the CAS values, L1 only sees the sets that went through
+	var l1ops []string
+	l2, _ := inmem.New()
+	buf := new(bytes.Buffer)
+	w := bufio.NewWriter(buf)
+	o := orcas.L1L2(opHandler{ops: &l1ops}, l2, textprot.NewTextResponder(w))
+
+	key := []byte("TestCompareAndSwap")
+	cas := func(unique uint64, data string) error {
+		return orcas.CompareAndSwap(o, common.CASRequest{
+			SetRequest: common.SetRequest{Key: key, Data: []byte(data)},
+			Cas:        unique,
+		})
+	}
+
+	if err := cas(1, "v1"); !errors.Is(err, common.ErrKeyNotFound) {
+		t.Fatalf("Expected a miss before the key exists, got %v", err)
+	}
+
+	if err := l2.Set(common.SetRequest{Key: key, Data: []byte("v1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the CAS value comes back the way a text client sees it
+	req := common.GetRequest{Keys: [][]byte{key}, Opaques: []uint32{0}, Quiet: []bool{false}}
+	if err := orcas.Gets(o, req); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+	var unique uint64
+	if _, err := fmt.Sscanf(buf.String(), "VALUE TestCompareAndSwap 0 2 %d\r\nv1\r\nEND\r\n", &unique); err != nil {
+		t.Fatalf("Unexpected gets response %q: %v", buf.String(), err)
+	}
+	buf.Reset()
+
+	if err := cas(unique+1, "v2"); !errors.Is(err, common.ErrKeyExists) {
+		t.Fatalf("Expected a stale CAS value to fail, got %v", err)
+	}
+	if len(l1ops) != 0 {
+		t.Fatalf("Expected L1 to be left alone by a failed cas, got %v", l1ops)
+	}
+
+	if err := cas(unique, "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if len(l1ops) != 1 || l1ops[0] != "set" {
+		t.Fatalf("Expected L1 to be set after the cas, got %v", l1ops)
+	}
+
+	// the value has a new CAS value now
+	if err := cas(unique, "v3"); !errors.Is(err, common.ErrKeyExists) {
+		t.Fatalf("Expected the old CAS value to fail after a write, got %v", err)
+	}
+
+	w.Flush()
+	if buf.String() != "STORED\r\n" {
+		t.Fatalf("Expected only the matching cas to be answered, got %q", buf.String())
+	}
+}
+
+func TestCompareAndSwapNotSupported(t *testing.T) {
+	var o orcas.Orca = struct{ orcas.Orca }{orcas.L1Only(opHandler{ops: new([]string)}, nil, nil)}
+
+	if err := orcas.Gets(o, common.GetRequest{}); !errors.Is(err, common.ErrNotSupported) {
+		t.Fatalf("Expected an orchestrator without gets to be unsupported, got %v", err)
+	}
+	if err := orcas.CompareAndSwap(o, common.CASRequest{}); !errors.Is(err, common.ErrNotSupported) {
+		t.Fatalf("Expected an orchestrator without cas to be unsupported, got %v", err)
+	}
+}
@@ -0,0 +1,386 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/protocol"
+)
+
+// OrcaV2 is the context-aware form of Orca. The context of each call is the one of the frontend
+// request being served and should be passed down to every backend operation it causes.
+type OrcaV2 interface {
+	Set(ctx context.Context, req common.SetRequest) error
+	Add(ctx context.Context, req common.SetRequest) error
+	Replace(ctx context.Context, req common.SetRequest) error
+	Append(ctx context.Context, req common.SetRequest) error
+	Prepend(ctx context.Context, req common.SetRequest) error
+	Delete(ctx context.Context, req common.DeleteRequest) error
+	Touch(ctx context.Context, req common.TouchRequest) error
+	Get(ctx context.Context, req common.GetRequest) error
+	GetE(ctx context.Context, req common.GetRequest) error
+	Gat(ctx context.Context, req common.GATRequest) error
+	Noop(ctx context.Context, req common.NoopRequest) error
+	Quit(ctx context.Context, req common.QuitRequest) error
+	Version(ctx context.Context, req common.VersionRequest) error
+	Unknown(ctx context.Context, req common.Request) error
+	Error(ctx context.Context, req common.Request, reqType common.RequestType, err error)
+}
+
+type OrcaConstV2 func(l1, l2 handlers.HandlerV2, res protocol.Responder) OrcaV2
+
+// ConstV2 adapts an OrcaConst to OrcaConstV2. The orchestrator is built with handlers that do
+// every operation with the context of the request being served at the time, so any existing
+// orchestrator passes contexts down to its backends without changes. The orchestrator must only
+// use its handlers while serving a request, which is already the case for every orchestrator in
+// this package. If oc is itself the result of ConstV1, the original is used.
+func ConstV2(oc OrcaConst) OrcaConstV2 {
+	return func(l1, l2 handlers.HandlerV2, res protocol.Responder) OrcaV2 {
+		c := &v2Orca{ctx: newScope()}
+		o := oc(bind(l1, c.ctx, common.PhaseL1), bind(l2, c.ctx, common.PhaseL2), res)
+		if u, ok := o.(interface {
+			V2() OrcaV2
+		}); ok {
+			return u.V2()
+		}
+
+		c.o = o
+		return c
+	}
+}
+
+// ConstV1 adapts an OrcaConstV2 so it can be given anywhere an OrcaConst is expected, including
+// server.ListenAndServe. The server unwraps it again and serves it with the contexts of its
+// connections.
+func ConstV1(oc OrcaConstV2) OrcaConst {
+	return func(l1, l2 handlers.Handler, res protocol.Responder) Orca {
+		return V1(context.Background(), oc(handlers.V2(l1), handlers.V2(l2), res))
+	}
+}
+
+// V1 adapts an OrcaV2 to Orca by doing every operation with ctx, which is normally the context of
+// the connection the orchestrator serves.
+func V1(ctx context.Context, o OrcaV2) Orca {
+	return v1Orca{ctx: ctx, o: o}
+}
+
+// RequestID returns the ID of the request o is serving, if o was made by V1 with a context that
+// carries one, or 0 otherwise
+func RequestID(o Orca) common.RequestID {
+	if v, ok := o.(v1Orca); ok {
+		return common.RequestIDFrom(v.ctx)
+	}
+	return 0
+}
+
+// Context returns the context o does every operation with, if o was made by V1, or a background
+// context otherwise
+func Context(o Orca) context.Context {
+	if v, ok := o.(v1Orca); ok {
+		return v.ctx
+	}
+	return context.Background()
+}
+
+// WithContext returns o doing every operation with ctx instead, e.g. to give a single request a
+// deadline. Only an orchestrator made by V1 can be given a new context, anything else is returned
+// as is.
+func WithContext(o Orca, ctx context.Context) Orca {
+	if v, ok := o.(v1Orca); ok {
+		return v1Orca{ctx: ctx, o: v.o}
+	}
+	return o
+}
+
+// scope holds the context of the request an orchestrator made by ConstV2 is serving. Orchestrators
+// only have Handlers, which take no context, so the context given to each call of the OrcaV2 is
+// published here for as long as the call runs, and each handler call passes on the one current
+// when it's made. Once the call returns, the context from before it is back, so work left behind
+// by an orchestrator never uses the context of a request that's over.
+type scope struct {
+	cur atomic.Value
+}
+
+// scoped wraps a context since an atomic.Value can't hold values of different types
+type scoped struct {
+	ctx context.Context
+}
+
+func newScope() *scope {
+	s := new(scope)
+	s.cur.Store(scoped{context.Background()})
+	return s
+}
+
+func (s *scope) get() context.Context {
+	return s.cur.Load().(scoped).ctx
+}
+
+// enter makes ctx the current context and returns a func that puts back the one from before
+func (s *scope) enter(ctx context.Context) func() {
+	prev := s.cur.Swap(scoped{ctx})
+	return func() { s.cur.Store(prev) }
+}
+
+func bind(h handlers.HandlerV2, ctx *scope, phase common.Phase) handlers.Handler {
+	if h == nil {
+		return nil
+	}
+	return boundHandler{h: h, ctx: ctx, phase: phase}
+}
+
+// boundHandler does every operation with the current context of the orchestrator it was made for.
+// For sampled requests, the time spent in it is accounted to its tier in the request's Timing.
+type boundHandler struct {
+	h     handlers.HandlerV2
+	ctx   *scope
+	phase common.Phase
+}
+
+// enter accounts time to the handler's tier in the Timing of the request being served, if it's
+// timed, and returns a func that goes back to the phase from before. An L1 call made while L2 is
+// being read is a backfill. Calls that return channels don't go back, since the orchestrator waits
+// on the results afterwards.
+func (b boundHandler) enter() func() {
+	t := common.TimingFrom(b.ctx.get())
+	if !t.Active() {
+		return func() {}
+	}
+
+	p := b.phase
+	if p == common.PhaseL1 && t.Phase() == common.PhaseL2 {
+		p = common.PhaseBackfill
+	}
+
+	prev := t.Enter(p)
+	return func() { t.Enter(prev) }
+}
+
+func (b boundHandler) V2() handlers.HandlerV2 {
+	return b.h
+}
+
+// Context returns the context of the request being served, see handlers.Context
+func (b boundHandler) Context() context.Context {
+	return b.ctx.get()
+}
+
+func (b boundHandler) Set(cmd common.SetRequest) error {
+	defer b.enter()()
+	return b.h.Set(b.ctx.get(), cmd)
+}
+
+func (b boundHandler) Add(cmd common.SetRequest) error {
+	defer b.enter()()
+	return b.h.Add(b.ctx.get(), cmd)
+}
+
+func (b boundHandler) Replace(cmd common.SetRequest) error {
+	defer b.enter()()
+	return b.h.Replace(b.ctx.get(), cmd)
+}
+
+func (b boundHandler) Append(cmd common.SetRequest) error {
+	defer b.enter()()
+	return b.h.Append(b.ctx.get(), cmd)
+}
+
+func (b boundHandler) Prepend(cmd common.SetRequest) error {
+	defer b.enter()()
+	return b.h.Prepend(b.ctx.get(), cmd)
+}
+
+func (b boundHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	b.enter()
+	return b.h.Get(b.ctx.get(), cmd)
+}
+
+func (b boundHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	b.enter()
+	return b.h.GetE(b.ctx.get(), cmd)
+}
+
+func (b boundHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	defer b.enter()()
+	return b.h.GAT(b.ctx.get(), cmd)
+}
+
+func (b boundHandler) Delete(cmd common.DeleteRequest) error {
+	defer b.enter()()
+	return b.h.Delete(b.ctx.get(), cmd)
+}
+
+func (b boundHandler) Touch(cmd common.TouchRequest) error {
+	defer b.enter()()
+	return b.h.Touch(b.ctx.get(), cmd)
+}
+
+func (b boundHandler) Close() error {
+	return b.h.Close()
+}
+
+// v2Orca sets the context its handlers use for the duration of every operation
+type v2Orca struct {
+	o   Orca
+	ctx *scope
+}
+
+func (c *v2Orca) Set(ctx context.Context, req common.SetRequest) error {
+	defer c.ctx.enter(ctx)()
+	return c.o.Set(req)
+}
+
+func (c *v2Orca) Add(ctx context.Context, req common.SetRequest) error {
+	defer c.ctx.enter(ctx)()
+	return c.o.Add(req)
+}
+
+func (c *v2Orca) Replace(ctx context.Context, req common.SetRequest) error {
+	defer c.ctx.enter(ctx)()
+	return c.o.Replace(req)
+}
+
+func (c *v2Orca) Append(ctx context.Context, req common.SetRequest) error {
+	defer c.ctx.enter(ctx)()
+	return c.o.Append(req)
+}
+
+func (c *v2Orca) Prepend(ctx context.Context, req common.SetRequest) error {
+	defer c.ctx.enter(ctx)()
+	return c.o.Prepend(req)
+}
+
+func (c *v2Orca) Delete(ctx context.Context, req common.DeleteRequest) error {
+	defer c.ctx.enter(ctx)()
+	return c.o.Delete(req)
+}
+
+func (c *v2Orca) Touch(ctx context.Context, req common.TouchRequest) error {
+	defer c.ctx.enter(ctx)()
+	return c.o.Touch(req)
+}
+
+func (c *v2Orca) Get(ctx context.Context, req common.GetRequest) error {
+	defer c.ctx.enter(ctx)()
+	return c.o.Get(req)
+}
+
+func (c *v2Orca) GetE(ctx context.Context, req common.GetRequest) error {
+	defer c.ctx.enter(ctx)()
+	return c.o.GetE(req)
+}
+
+func (c *v2Orca) Gat(ctx context.Context, req common.GATRequest) error {
+	defer c.ctx.enter(ctx)()
+	return c.o.Gat(req)
+}
+
+func (c *v2Orca) Noop(ctx context.Context, req common.NoopRequest) error {
+	defer c.ctx.enter(ctx)()
+	return c.o.Noop(req)
+}
+
+func (c *v2Orca) Quit(ctx context.Context, req common.QuitRequest) error {
+	defer c.ctx.enter(ctx)()
+	return c.o.Quit(req)
+}
+
+func (c *v2Orca) Version(ctx context.Context, req common.VersionRequest) error {
+	defer c.ctx.enter(ctx)()
+	return c.o.Version(req)
+}
+
+func (c *v2Orca) Unknown(ctx context.Context, req common.Request) error {
+	defer c.ctx.enter(ctx)()
+	return c.o.Unknown(req)
+}
+
+func (c *v2Orca) Error(ctx context.Context, req common.Request, reqType common.RequestType, err error) {
+	defer c.ctx.enter(ctx)()
+	c.o.Error(req, reqType, err)
+}
+
+type v1Orca struct {
+	ctx context.Context
+	o   OrcaV2
+}
+
+func (v v1Orca) V2() OrcaV2 {
+	return v.o
+}
+
+func (v v1Orca) Set(req common.SetRequest) error {
+	return v.o.Set(v.ctx, req)
+}
+
+func (v v1Orca) Add(req common.SetRequest) error {
+	return v.o.Add(v.ctx, req)
+}
+
+func (v v1Orca) Replace(req common.SetRequest) error {
+	return v.o.Replace(v.ctx, req)
+}
+
+func (v v1Orca) Append(req common.SetRequest) error {
+	return v.o.Append(v.ctx, req)
+}
+
+func (v v1Orca) Prepend(req common.SetRequest) error {
+	return v.o.Prepend(v.ctx, req)
+}
+
+func (v v1Orca) Delete(req common.DeleteRequest) error {
+	return v.o.Delete(v.ctx, req)
+}
+
+func (v v1Orca) Touch(req common.TouchRequest) error {
+	return v.o.Touch(v.ctx, req)
+}
+
+func (v v1Orca) Get(req common.GetRequest) error {
+	return v.o.Get(v.ctx, req)
+}
+
+func (v v1Orca) GetE(req common.GetRequest) error {
+	return v.o.GetE(v.ctx, req)
+}
+
+func (v v1Orca) Gat(req common.GATRequest) error {
+	return v.o.Gat(v.ctx, req)
+}
+
+func (v v1Orca) Noop(req common.NoopRequest) error {
+	return v.o.Noop(v.ctx, req)
+}
+
+func (v v1Orca) Quit(req common.QuitRequest) error {
+	return v.o.Quit(v.ctx, req)
+}
+
+func (v v1Orca) Version(req common.VersionRequest) error {
+	return v.o.Version(v.ctx, req)
+}
+
+func (v v1Orca) Unknown(req common.Request) error {
+	return v.o.Unknown(v.ctx, req)
+}
+
+func (v v1Orca) Error(req common.Request, reqType common.RequestType, err error) {
+	v.o.Error(v.ctx, req, reqType, err)
+}
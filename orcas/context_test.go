@@ -0,0 +1,187 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/inmem"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol"
+	"github.com/netflix/rend/protocol/textprot"
+	"github.com/netflix/rend/timer"
+)
+
+// setOrca only sets into L1
+type setOrca struct {
+	testPanicOrca
+	l1 handlers.Handler
+}
+
+func (o setOrca) Set(req common.SetRequest) error {
+	return o.l1.Set(req)
+}
+
+func TestConstV2(t *testing.T) {
+	h, _ := inmem.New()
+	res := textprot.NewTextResponder(bufio.NewWriter(ioutil.Discard))
+
+	var l1 handlers.Handler
+	o := orcas.ConstV2(func(h1, h2 handlers.Handler, res protocol.Responder) orcas.Orca {
+		l1 = h1
+		return setOrca{l1: h1}
+	})(handlers.V2(h), nil, res)
+
+	if handlers.Underlying(l1) != h {
+		t.Fatal("Expected the underlying handler to be the one given")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	set := common.SetRequest{Key: []byte("foo"), Data: []byte("bar")}
+	if err := o.Set(ctx, set); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected a cancelled set, got %v", err)
+	}
+	if getInmem(t, "foo") != "" {
+		t.Fatal("Expected a cancelled set not to reach the handler")
+	}
+
+	if err := o.Set(context.Background(), set); err != nil {
+		t.Fatal(err)
+	}
+	if getInmem(t, "foo") != "bar" {
+		t.Fatal("Expected the set to reach the handler")
+	}
+}
+
+// idOrca records the request ID its L1 handler sees on every set
+type idOrca struct {
+	testPanicOrca
+	l1  handlers.Handler
+	ids *[]common.RequestID
+}
+
+func (o idOrca) Set(req common.SetRequest) error {
+	*o.ids = append(*o.ids, common.RequestIDFrom(handlers.Context(o.l1)))
+	return nil
+}
+
+func TestRequestID(t *testing.T) {
+	h, _ := inmem.New()
+	res := textprot.NewTextResponder(bufio.NewWriter(ioutil.Discard))
+
+	var ids []common.RequestID
+	oc := func(h1, h2 handlers.Handler, res protocol.Responder) orcas.Orca {
+		return idOrca{l1: h1, ids: &ids}
+	}
+
+	id := new(common.RequestID)
+	o := orcas.V1(common.WithRequestID(context.Background(), id), orcas.ConstV2(oc)(handlers.V2(h), nil, res))
+
+	set := common.SetRequest{Key: []byte("foo"), Data: []byte("bar")}
+	for _, want := range []common.RequestID{1, 2} {
+		*id = want
+		if orcas.RequestID(o) != want {
+			t.Fatalf("Expected orca to be serving request %v, got %v", want, orcas.RequestID(o))
+		}
+		if err := o.Set(set); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(ids) != 2 || ids[0] != 1 || ids[1] != 2 {
+		t.Fatalf("Expected the handler to see each request ID in turn, got %v", ids)
+	}
+
+	if orcas.RequestID(setOrca{}) != 0 {
+		t.Fatal("Expected no request ID for an orca without a context")
+	}
+}
+
+// delayHandler misses every get, hits every gete, and takes d for sets and getes
+type delayHandler struct {
+	handlers.Handler
+	d time.Duration
+}
+
+func (h delayHandler) Set(cmd common.SetRequest) error {
+	time.Sleep(h.d)
+	return nil
+}
+
+func (h delayHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	res, errs := make(chan common.GetResponse, len(cmd.Keys)), make(chan error)
+	for _, k := range cmd.Keys {
+		res <- common.GetResponse{Key: k, Miss: true}
+	}
+	close(res)
+	close(errs)
+	return res, errs
+}
+
+func (h delayHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	res, errs := make(chan common.GetEResponse, len(cmd.Keys)), make(chan error)
+	go func() {
+		time.Sleep(h.d)
+		for _, k := range cmd.Keys {
+			res <- common.GetEResponse{Key: k, Data: []byte("bar")}
+		}
+		close(res)
+		close(errs)
+	}()
+	return res, errs
+}
+
+func TestTiming(t *testing.T) {
+	const l1Delay, l2Delay = 5 * time.Millisecond, 10 * time.Millisecond
+	res := textprot.NewTextResponder(bufio.NewWriter(ioutil.Discard))
+
+	timing := new(common.Timing)
+	ctx := common.WithTiming(context.Background(), timing)
+	l1, l2 := handlers.V2(delayHandler{d: l1Delay}), handlers.V2(delayHandler{d: l2Delay})
+	o := orcas.V1(ctx, orcas.ConstV2(orcas.L1L2)(l1, l2, res))
+
+	timing.Start(timer.Now())
+	if err := o.Get(common.GetRequest{Keys: [][]byte{[]byte("foo")}}); err != nil {
+		t.Fatal(err)
+	}
+	times := timing.Finish()
+
+	if times.L2 < l2Delay {
+		t.Fatalf("Expected at least %v in L2, got %v", l2Delay, times)
+	}
+	if times.Backfill < l1Delay {
+		t.Fatalf("Expected the L1 set of an L2 hit to be a backfill of at least %v, got %v", l1Delay, times)
+	}
+	if times.L1 >= l1Delay {
+		t.Fatalf("Expected the L1 get alone to count as L1, got %v", times)
+	}
+
+	// requests outside of Start and Finish aren't timed
+	if err := o.Get(common.GetRequest{Keys: [][]byte{[]byte("foo")}}); err != nil {
+		t.Fatal(err)
+	}
+	if timing.Active() {
+		t.Fatal("Expected no timing after Finish")
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/timer"
+)
+
+var (
+	MetricCmdFlushL1     = metrics.AddCounter("cmd_flush_l1", nil)
+	MetricCmdFlushL2     = metrics.AddCounter("cmd_flush_l2", nil)
+	MetricCmdFlushErrors = metrics.AddCounter("cmd_flush_errors", nil)
+
+	HistFlushL1 = metrics.AddHistogram("flush_l1", false, nil)
+	HistFlushL2 = metrics.AddHistogram("flush_l2", false, nil)
+)
+
+// FlushScope is which tiers a flush applies to
+type FlushScope uint8
+
+const (
+	// FlushBoth flushes L2 and then L1
+	FlushBoth FlushScope = iota
+	// FlushL1 only flushes L1, e.g. to drop a local copy that went stale without touching the
+	// shared L2
+	FlushL1
+	// FlushL2 only flushes L2, leaving L1 copies to expire
+	FlushL2
+)
+
+func (s FlushScope) String() string {
+	switch s {
+	case FlushL1:
+		return "l1"
+	case FlushL2:
+		return "l2"
+	}
+	return "both"
+}
+
+// ParseFlushScope parses "both", "l1", or "l2"
+func ParseFlushScope(s string) (FlushScope, error) {
+	switch s {
+	case "both":
+		return FlushBoth, nil
+	case "l1":
+		return FlushL1, nil
+	case "l2":
+		return FlushL2, nil
+	}
+	return FlushBoth, fmt.Errorf("Unknown flush scope %q, expected both, l1, or l2", s)
+}
+
+// FlushTiers is which tiers the orchestrators' flushes apply to. Tiers outside it are left alone,
+// so an L1 only orchestrator flushes nothing when it's FlushL2. It's meant to be set once, before
+// serving.
+var FlushTiers = FlushBoth
+
+// Flusher is implemented by orchestrators that support memcached's flush, which removes every key
+// from every tier in FlushTiers.
+type Flusher interface {
+	Flush(req common.FlushRequest) error
+}
+
+// FlusherV2 is the context-aware form of Flusher for OrcaV2 implementations.
+type FlusherV2 interface {
+	Flush(ctx context.Context, req common.FlushRequest) error
+}
+
+// Flush does the flush in req with o, or returns common.ErrNotSupported if o doesn't implement
+// Flusher.
+func Flush(o Orca, req common.FlushRequest) error {
+	if f, ok := o.(Flusher); ok {
+		return f.Flush(req)
+	}
+	return common.ErrNotSupported
+}
+
+// FlushV2 is the OrcaV2 counterpart of Flush.
+func FlushV2(ctx context.Context, o OrcaV2, req common.FlushRequest) error {
+	if f, ok := o.(FlusherV2); ok {
+		return f.Flush(ctx, req)
+	}
+	return common.ErrNotSupported
+}
+
+// flush flushes a single handler and counts the outcome. Delays are left to the handler, since
+// only it knows when its keys were set. skip is set for tiers outside FlushTiers.
+func flush(h handlers.Handler, req common.FlushRequest, skip bool, counter uint32, hist uint32) error {
+	if skip {
+		return nil
+	}
+
+	metrics.IncCounter(counter)
+	start := timer.Now()
+
+	err := handlers.Flush(h, req)
+
+	metrics.ObserveHist(hist, timer.Since(start))
+
+	if err != nil {
+		metrics.IncCounter(MetricCmdFlushErrors)
+	}
+	return err
+}
+
+func (l *L1OnlyOrca) Flush(req common.FlushRequest) error {
+	if err := flush(l.l1, req, FlushTiers == FlushL2, MetricCmdFlushL1, HistFlushL1); err != nil {
+		return err
+	}
+	return l.res.Flush(req.Opaque, req.Quiet)
+}
+
+// L2 is flushed first so L1 can't be filled again from it afterwards
+func (l *L1L2Orca) Flush(req common.FlushRequest) error {
+	if err := flush(l.l2, req, FlushTiers == FlushL1, MetricCmdFlushL2, HistFlushL2); err != nil {
+		return err
+	}
+	if err := flush(l.l1, req, FlushTiers == FlushL2, MetricCmdFlushL1, HistFlushL1); err != nil {
+		return err
+	}
+	return l.res.Flush(req.Opaque, req.Quiet)
+}
+
+func (l *L1L2BatchOrca) Flush(req common.FlushRequest) error {
+	if err := flush(l.l2, req, FlushTiers == FlushL1, MetricCmdFlushL2, HistFlushL2); err != nil {
+		return err
+	}
+	if err := flush(l.l1, req, FlushTiers == FlushL2, MetricCmdFlushL1, HistFlushL1); err != nil {
+		return err
+	}
+	return l.res.Flush(req.Opaque, req.Quiet)
+}
+
+// A flush isn't about any one key, so there is no key lock to take
+func (l *LockedOrca) Flush(req common.FlushRequest) error {
+	return Flush(l.wrapped, req)
+}
+
+func (o *modedOrca) Flush(req common.FlushRequest) error {
+	if err := o.write(); err != nil {
+		return err
+	}
+	return Flush(o.Orca, req)
+}
+
+func (o *budgetOrca) Flush(req common.FlushRequest) error {
+	o.b.start()
+	return Flush(o.Orca, req)
+}
+
+func (o *canaryOrca) Flush(req common.FlushRequest) error {
+	return Flush(o.arms[armBaseline], req)
+}
+
+func (p *prioritizedOrca) Flush(req common.FlushRequest) error {
+	p.acquire(nil)
+	defer p.s.Release()
+	return Flush(p.Orca, req)
+}
+
+// Flushing frees memory, so it's never shed
+func (o *shedOrca) Flush(req common.FlushRequest) error {
+	return Flush(o.Orca, req)
+}
+
+func (c *v2Orca) Flush(ctx context.Context, req common.FlushRequest) error {
+	defer c.ctx.enter(ctx)()
+	return Flush(c.o, req)
+}
+
+func (v v1Orca) Flush(req common.FlushRequest) error {
+	return FlushV2(v.ctx, v.o, req)
+}
+
+func (b boundHandler) Flush(cmd common.FlushRequest) error {
+	defer b.enter()()
+	return handlers.FlushV2(b.ctx.get(), b.h, cmd)
+}
+
+func (o *tombstoneOrca) Flush(req common.FlushRequest) error {
+	return Flush(o.Orca, req)
+}
+
+func (h *tombstoneHandler) Flush(cmd common.FlushRequest) error {
+	return handlers.Flush(h.Handler, cmd)
+}
+
+func (o *admissionOrca) Flush(req common.FlushRequest) error {
+	return Flush(o.Orca, req)
+}
+
+func (h *admissionHandler) Flush(cmd common.FlushRequest) error {
+	return handlers.Flush(h.Handler, cmd)
+}
+
+func (h staleHandler) Flush(cmd common.FlushRequest) error {
+	return handlers.Flush(h.Handler, cmd)
+}
+
+func (h refreshingHandler) Flush(cmd common.FlushRequest) error {
+	return handlers.Flush(h.Handler, cmd)
+}
+
+func (h routedHandler) Flush(cmd common.FlushRequest) error {
+	return handlers.Flush(h.Handler, cmd)
+}
+
+func (o *quotaOrca) Flush(req common.FlushRequest) error {
+	err := Flush(o.Orca, req)
+	if err == nil {
+		o.t.Flushed(req.Delay)
+	}
+	return err
+}
+
+func (h *quietHandler) Flush(cmd common.FlushRequest) error {
+	return handlers.Flush(h.Handler, cmd)
+}
@@ -15,6 +15,7 @@
 package orcas
 
 import (
+	"errors"
 	"log"
 
 	"github.com/netflix/rend/common"
@@ -105,8 +106,8 @@ func (l *L1L2Orca) Add(req common.SetRequest) error {
 	if err != nil {
 		// A key already existing is not an error per se, it's a part of the
 		// functionality of the add command to respond with a "not stored" in
-		// the form of a ErrKeyExists. Hence no error metrics.
-		if err == common.ErrKeyExists {
+		// the form of an ErrNotAdded. Hence no error metrics.
+		if errors.Is(err, common.ErrNotAdded) {
 			metrics.IncCounter(MetricCmdAddNotStoredL2)
 			metrics.IncCounter(MetricCmdAddNotStored)
 			return err
@@ -139,14 +140,14 @@ func (l *L1L2Orca) Add(req common.SetRequest) error {
 	if err != nil {
 		// This is kind of a problem. What has happened here is that the L2
 		// cache has successfully added the key but L1 did not. In this case
-		// we have to fail with a ErrKeyExists/Not Stored because the overall
+		// we have to fail with an ErrNotAdded/Not Stored because the overall
 		// operation failed. If we assume a retry on the client, then it will
 		// likely fail again at the L2 step.
 		//
 		// One possible scenario here is that an add started and completed L2,
 		// then a set ran to full completion, overwriting the data in L2 then
 		// writing into L1, then the second step here ran and got an error.
-		if err == common.ErrKeyExists {
+		if errors.Is(err, common.ErrNotAdded) {
 			metrics.IncCounter(MetricCmdAddNotStoredL1)
 			metrics.IncCounter(MetricCmdAddNotStored)
 			return err
@@ -179,7 +180,7 @@ func (l *L1L2Orca) Replace(req common.SetRequest) error {
 		// A key not existing is not an error per se, it's a part of the
 		// functionality of the replace command to respond with a "not stored"
 		// in the form of an ErrKeyNotFound. Hence no error metrics.
-		if err == common.ErrKeyNotFound {
+		if errors.Is(err, common.ErrKeyNotFound) {
 			metrics.IncCounter(MetricCmdReplaceNotStoredL2)
 			metrics.IncCounter(MetricCmdReplaceNotStored)
 			return err
@@ -222,7 +223,7 @@ func (l *L1L2Orca) Replace(req common.SetRequest) error {
 		// being replaced in L1 because it did not exist. In this case, L2 has
 		// the data and L1 is empty. This is still correct, and the next get
 		// would place the data back into L1. Hence, we do not return the error.
-		if err == common.ErrKeyNotFound {
+		if errors.Is(err, common.ErrKeyNotFound) {
 			metrics.IncCounter(MetricCmdReplaceNotStoredL1)
 			metrics.IncCounter(MetricCmdReplaceNotStored)
 			return l.res.Replace(req.Opaque, req.Quiet)
@@ -264,7 +265,7 @@ func (l *L1L2Orca) Append(req common.SetRequest) error {
 	if err != nil {
 		// Appending in L2 did not succeed. Don't try in L1 since this means L2
 		// may not have succeeded.
-		if err == common.ErrItemNotStored {
+		if errors.Is(err, common.ErrItemNotStored) {
 			metrics.IncCounter(MetricCmdAppendNotStoredL2)
 			metrics.IncCounter(MetricCmdAppendNotStored)
 			return err
@@ -292,7 +293,7 @@ func (l *L1L2Orca) Append(req common.SetRequest) error {
 		// concurrent delete happened or that the data has just been pushed out
 		// of L1. Append will not bring data back into L1 as it's not necessarily
 		// going to be immediately read.
-		if err == common.ErrItemNotStored || err == common.ErrKeyNotFound {
+		if errors.Is(err, common.ErrItemNotStored) || errors.Is(err, common.ErrKeyNotFound) {
 			metrics.IncCounter(MetricCmdAppendNotStoredL1)
 			metrics.IncCounter(MetricCmdAppendStored)
 			return l.res.Append(req.Opaque, req.Quiet)
@@ -321,7 +322,7 @@ func (l *L1L2Orca) Prepend(req common.SetRequest) error {
 	if err != nil {
 		// Prepending in L2 did not succeed. Don't try in L1 since this means L2
 		// may not have succeeded.
-		if err == common.ErrItemNotStored {
+		if errors.Is(err, common.ErrItemNotStored) {
 			metrics.IncCounter(MetricCmdPrependNotStoredL2)
 			metrics.IncCounter(MetricCmdPrependNotStored)
 			return err
@@ -349,7 +350,7 @@ func (l *L1L2Orca) Prepend(req common.SetRequest) error {
 		// concurrent delete happened or that the data has just been pushed out
 		// of L1. Prepend will not bring data back into L1 as it's not necessarily
 		// going to be immediately read.
-		if err == common.ErrItemNotStored || err == common.ErrKeyNotFound {
+		if errors.Is(err, common.ErrItemNotStored) || errors.Is(err, common.ErrKeyNotFound) {
 			metrics.IncCounter(MetricCmdPrependNotStoredL1)
 			metrics.IncCounter(MetricCmdPrependStored)
 			return l.res.Prepend(req.Opaque, req.Quiet)
@@ -381,7 +382,7 @@ func (l *L1L2Orca) Delete(req common.DeleteRequest) error {
 		// key at all, or another request may be deleting the same key. In that
 		// case the other will finish up. Returning a key not found will trigger
 		// error handling to send back an error response.
-		if err == common.ErrKeyNotFound {
+		if errors.Is(err, common.ErrKeyNotFound) {
 			metrics.IncCounter(MetricCmdDeleteMissesL2)
 			metrics.IncCounter(MetricCmdDeleteMisses)
 			return err
@@ -415,11 +416,11 @@ func (l *L1L2Orca) Delete(req common.DeleteRequest) error {
 		// in L2 hit. This isn't a miss per se since the overall effect is a
 		// delete. Concurrent deletes might interleave to produce this, or the
 		// data might have TTL'd out. Both cases are still fine.
-		if err == common.ErrKeyNotFound {
+		if errors.Is(err, common.ErrKeyNotFound) {
 			metrics.IncCounter(MetricCmdDeleteMissesL1)
 			metrics.IncCounter(MetricCmdDeleteHits)
 			// disregard the miss, don't return the error
-			return l.res.Delete(req.Opaque)
+			return l.res.Delete(req.Opaque, req.Quiet)
 		}
 		metrics.IncCounter(MetricCmdDeleteErrorsL1)
 		metrics.IncCounter(MetricCmdDeleteErrors)
@@ -429,7 +430,7 @@ func (l *L1L2Orca) Delete(req common.DeleteRequest) error {
 	metrics.IncCounter(MetricCmdDeleteHitsL1)
 	metrics.IncCounter(MetricCmdDeleteHits)
 
-	return l.res.Delete(req.Opaque)
+	return l.res.Delete(req.Opaque, req.Quiet)
 }
 
 func (l *L1L2Orca) Touch(req common.TouchRequest) error {
@@ -449,7 +450,7 @@ func (l *L1L2Orca) Touch(req common.TouchRequest) error {
 		// possible to be inconsistent, but only for a short time. Any
 		// concurrent requests will see the same behavior as this one. If the
 		// touch misses here, any other request will see the same view.
-		if err == common.ErrKeyNotFound {
+		if errors.Is(err, common.ErrKeyNotFound) {
 			metrics.IncCounter(MetricCmdTouchMissesL2)
 			metrics.IncCounter(MetricCmdTouchMisses)
 			return err
@@ -481,12 +482,12 @@ func (l *L1L2Orca) Touch(req common.TouchRequest) error {
 		// Touch misses in L1 after a hit in L2 are nto a big deal. The
 		// touch operation here explicitly does *not* act as a pre-warm putting
 		// data into L1. A miss here after a hit is the same as a hit.
-		if err == common.ErrKeyNotFound {
+		if errors.Is(err, common.ErrKeyNotFound) {
 			metrics.IncCounter(MetricCmdTouchMissesL1)
 			// Note that we increment the overall hits here (not misses) on
 			// purpose because L2 hit.
 			metrics.IncCounter(MetricCmdTouchHits)
-			return l.res.Touch(req.Opaque)
+			return l.res.Touch(req.Opaque, req.Quiet)
 		}
 
 		metrics.IncCounter(MetricCmdTouchErrorsL1)
@@ -497,7 +498,7 @@ func (l *L1L2Orca) Touch(req common.TouchRequest) error {
 	metrics.IncCounter(MetricCmdTouchHitsL1)
 	metrics.IncCounter(MetricCmdTouchHits)
 
-	return l.res.Touch(req.Opaque)
+	return l.res.Touch(req.Opaque, req.Quiet)
 }
 
 func (l *L1L2Orca) Get(req common.GetRequest) error {
@@ -513,50 +514,28 @@ func (l *L1L2Orca) Get(req common.GetRequest) error {
 	metrics.IncCounterBy(MetricCmdGetKeysL1, uint64(len(req.Keys)))
 	start := timer.Now()
 
-	resChan, errChan := l.l1.Get(req)
-
-	var err error
-	//var lastres common.GetResponse
 	var l2keys [][]byte
 	var l2opaques []uint32
 	var l2quiets []bool
 
-	// Read all the responses back from L1.
-	// The contract is that the resChan will have GetResponse's for get hits and misses,
-	// and the errChan will have any other errors, such as an out of memory error from
-	// memcached. If any receive happens from errChan, there will be no more responses
-	// from resChan.
-	for {
-		select {
-		case res, ok := <-resChan:
-			if !ok {
-				resChan = nil
-			} else {
-				if res.Miss {
-					metrics.IncCounter(MetricCmdGetMissesL1)
-					l2keys = append(l2keys, res.Key)
-					l2opaques = append(l2opaques, res.Opaque)
-					l2quiets = append(l2quiets, res.Quiet)
-				} else {
-					metrics.IncCounter(MetricCmdGetHits)
-					metrics.IncCounter(MetricCmdGetHitsL1)
-					l.res.Get(res)
-				}
-			}
-
-		case getErr, ok := <-errChan:
-			if !ok {
-				errChan = nil
-			} else {
-				metrics.IncCounter(MetricCmdGetErrors)
-				metrics.IncCounter(MetricCmdGetErrorsL1)
-				err = getErr
-			}
-		}
-
-		if resChan == nil && errChan == nil {
-			break
+	// Read all the responses back from L1. Hits and misses are passed to the callback, and any
+	// other error, such as an out of memory error from memcached, ends the get.
+	err := handlers.GetEach(l.l1, req, func(res common.GetResponse) error {
+		if res.Miss {
+			metrics.IncCounter(MetricCmdGetMissesL1)
+			l2keys = append(l2keys, res.Key)
+			l2opaques = append(l2opaques, res.Opaque)
+			l2quiets = append(l2quiets, res.Quiet)
+		} else {
+			metrics.IncCounter(MetricCmdGetHits)
+			metrics.IncCounter(MetricCmdGetHitsL1)
+			l.res.Get(res)
 		}
+		return nil
+	})
+	if err != nil {
+		metrics.IncCounter(MetricCmdGetErrors)
+		metrics.IncCounter(MetricCmdGetErrorsL1)
 	}
 
 	// finish up metrics for overall L1 (batch) get operation
@@ -583,72 +562,61 @@ func (l *L1L2Orca) Get(req common.GetRequest) error {
 	metrics.IncCounterBy(MetricCmdGetEKeysL2, uint64(len(l2keys)))
 	start = timer.Now()
 
-	resChanE, errChan := l.l2.GetE(req)
-
-	for {
-		select {
-		case res, ok := <-resChanE:
-			if !ok {
-				resChanE = nil
-			} else {
-				if res.Miss {
-					metrics.IncCounter(MetricCmdGetEMissesL2)
-					// Missing L2 means a true miss
-					metrics.IncCounter(MetricCmdGetMisses)
-				} else {
-					metrics.IncCounter(MetricCmdGetEHitsL2)
-
-					//set in l1
-					setreq := common.SetRequest{
-						Key:     res.Key,
-						Flags:   res.Flags,
-						Exptime: res.Exptime,
-						Data:    res.Data,
-					}
-
-					metrics.IncCounter(MetricCmdGetSetL1)
-					start2 := timer.Now()
-
-					err = l.l1.Set(setreq)
-
-					metrics.ObserveHist(HistSetL1, timer.Since(start2))
-
-					if err != nil {
-						metrics.IncCounter(MetricCmdGetSetErrorsL1)
-						return err
-					}
-
-					metrics.IncCounter(MetricCmdGetSetSucessL1)
-
-					// overall operation is considered a hit
-					metrics.IncCounter(MetricCmdGetHits)
-				}
-
-				getres := common.GetResponse{
-					Key:    res.Key,
-					Flags:  res.Flags,
-					Data:   res.Data,
-					Miss:   res.Miss,
-					Opaque: res.Opaque,
-					Quiet:  res.Quiet,
-				}
-
-				l.res.Get(getres)
+	// A failed backfill of L1 ends the get without counting as an L2 error
+	var setErr error
+	l2err := handlers.GetEEach(l.l2, req, func(res common.GetEResponse) error {
+		if res.Miss {
+			metrics.IncCounter(MetricCmdGetEMissesL2)
+			// Missing L2 means a true miss
+			metrics.IncCounter(MetricCmdGetMisses)
+		} else {
+			metrics.IncCounter(MetricCmdGetEHitsL2)
+
+			//set in l1
+			setreq := common.SetRequest{
+				Key:     res.Key,
+				Flags:   res.Flags,
+				Exptime: res.Exptime,
+				Data:    res.Data,
 			}
 
-		case getErr, ok := <-errChan:
-			if !ok {
-				errChan = nil
-			} else {
-				metrics.IncCounter(MetricCmdGetErrors)
-				metrics.IncCounter(MetricCmdGetEErrorsL2)
-				err = getErr
+			metrics.IncCounter(MetricCmdGetSetL1)
+			start2 := timer.Now()
+
+			setErr = l.l1.Set(setreq)
+
+			metrics.ObserveHist(HistSetL1, timer.Since(start2))
+
+			if setErr != nil {
+				metrics.IncCounter(MetricCmdGetSetErrorsL1)
+				return setErr
 			}
+
+			metrics.IncCounter(MetricCmdGetSetSucessL1)
+
+			// overall operation is considered a hit
+			metrics.IncCounter(MetricCmdGetHits)
 		}
 
-		if resChanE == nil && errChan == nil {
-			break
+		getres := common.GetResponse{
+			Key:    res.Key,
+			Flags:  res.Flags,
+			Data:   res.Data,
+			Miss:   res.Miss,
+			Opaque: res.Opaque,
+			Quiet:  res.Quiet,
 		}
+
+		l.res.Get(getres)
+		return nil
+	})
+	if setErr != nil {
+		return setErr
+	}
+	if l2err != nil {
+		metrics.IncCounter(MetricCmdGetErrors)
+		metrics.IncCounter(MetricCmdGetEErrorsL2)
+		err = l2err
 	}
 
 	// finish up metrics for overall L2 (batch) get operation
@@ -748,7 +716,7 @@ func (l *L1L2Orca) Gat(req common.GATRequest) error {
 			// we were trampled in the middle of performing the GAT operation
 			// In this case, it's fine; no error for the overall op. We still
 			// want to track this with a metric, though, and return success.
-			if err == common.ErrKeyExists {
+			if errors.Is(err, common.ErrNotAdded) {
 				metrics.IncCounter(MetricCmdGatAddNotStoredL1)
 			} else {
 				metrics.IncCounter(MetricCmdGatAddErrorsL1)
@@ -806,7 +774,7 @@ func (l *L1L2Orca) Gat(req common.GATRequest) error {
 		metrics.ObserveHist(HistTouchL2, timer.Since(start2))
 
 		if err != nil {
-			if err == common.ErrKeyNotFound {
+			if errors.Is(err, common.ErrKeyNotFound) {
 				// this is a problem. L1 had the item but L2 doesn't. To avoid an
 				// inconsistent view, return the same ErrNotFound and fail the op.
 				metrics.IncCounter(MetricInconsistencyDetected)
@@ -15,6 +15,7 @@
 package orcas
 
 import (
+	"errors"
 	"log"
 
 	"github.com/netflix/rend/common"
@@ -66,7 +67,7 @@ func (l *L1L2BatchOrca) Set(req common.SetRequest) error {
 	metrics.ObserveHist(HistReplaceL1, timer.Since(start))
 
 	if err != nil {
-		if err == common.ErrKeyNotFound {
+		if errors.Is(err, common.ErrKeyNotFound) {
 			// For a replace not stored in L1, there's no problem.
 			// There is no hot data to replace
 			metrics.IncCounter(MetricCmdSetReplaceNotStoredL1)
@@ -98,8 +99,8 @@ func (l *L1L2BatchOrca) Add(req common.SetRequest) error {
 	if err != nil {
 		// A key already existing is not an error per se, it's a part of the
 		// functionality of the add command to respond with a "not stored" in
-		// the form of a ErrKeyExists. Hence no error metrics.
-		if err == common.ErrKeyExists {
+		// the form of an ErrNotAdded. Hence no error metrics.
+		if errors.Is(err, common.ErrNotAdded) {
 			metrics.IncCounter(MetricCmdAddNotStoredL2)
 			metrics.IncCounter(MetricCmdAddNotStored)
 			return err
@@ -122,7 +123,7 @@ func (l *L1L2BatchOrca) Add(req common.SetRequest) error {
 	metrics.ObserveHist(HistReplaceL1, timer.Since(start))
 
 	if err != nil {
-		if err == common.ErrKeyNotFound {
+		if errors.Is(err, common.ErrKeyNotFound) {
 			// For a replace not stored in L1, there's no problem.
 			// There is no hot data to replace
 			metrics.IncCounter(MetricCmdAddReplaceNotStoredL1)
@@ -155,7 +156,7 @@ func (l *L1L2BatchOrca) Replace(req common.SetRequest) error {
 		// A key already existing is not an error per se, it's a part of the
 		// functionality of the replace command to respond with a "not stored"
 		// in the form of an ErrKeyNotFound. Hence no error metrics.
-		if err == common.ErrKeyNotFound {
+		if errors.Is(err, common.ErrKeyNotFound) {
 			metrics.IncCounter(MetricCmdReplaceNotStoredL2)
 			metrics.IncCounter(MetricCmdReplaceNotStored)
 			return err
@@ -178,7 +179,7 @@ func (l *L1L2BatchOrca) Replace(req common.SetRequest) error {
 	metrics.ObserveHist(HistReplaceL1, timer.Since(start))
 
 	if err != nil {
-		if err == common.ErrKeyNotFound {
+		if errors.Is(err, common.ErrKeyNotFound) {
 			// For a replace not stored in L1, there's no problem.
 			// There is no hot data to replace
 			metrics.IncCounter(MetricCmdReplaceReplaceNotStoredL1)
@@ -219,7 +220,7 @@ func (l *L1L2BatchOrca) Append(req common.SetRequest) error {
 	if err != nil {
 		// Appending in L2 did not succeed. Don't try in L1 since this means L2
 		// may not have succeeded.
-		if err == common.ErrItemNotStored {
+		if errors.Is(err, common.ErrItemNotStored) {
 			metrics.IncCounter(MetricCmdAppendNotStoredL2)
 			metrics.IncCounter(MetricCmdAppendNotStored)
 			return err
@@ -247,7 +248,7 @@ func (l *L1L2BatchOrca) Append(req common.SetRequest) error {
 		// concurrent delete happened or that the data has just been pushed out
 		// of L1. Append will not bring data back into L1 as it's not necessarily
 		// going to be immediately read.
-		if err == common.ErrItemNotStored || err == common.ErrKeyNotFound {
+		if errors.Is(err, common.ErrItemNotStored) || errors.Is(err, common.ErrKeyNotFound) {
 			metrics.IncCounter(MetricCmdAppendNotStoredL1)
 			metrics.IncCounter(MetricCmdAppendStored)
 			return l.res.Append(req.Opaque, req.Quiet)
@@ -276,7 +277,7 @@ func (l *L1L2BatchOrca) Prepend(req common.SetRequest) error {
 	if err != nil {
 		// Prepending in L2 did not succeed. Don't try in L1 since this means L2
 		// may not have succeeded.
-		if err == common.ErrItemNotStored {
+		if errors.Is(err, common.ErrItemNotStored) {
 			metrics.IncCounter(MetricCmdPrependNotStoredL2)
 			metrics.IncCounter(MetricCmdPrependNotStored)
 			return err
@@ -304,7 +305,7 @@ func (l *L1L2BatchOrca) Prepend(req common.SetRequest) error {
 		// concurrent delete happened or that the data has just been pushed out
 		// of L1. Prepend will not bring data back into L1 as it's not necessarily
 		// going to be immediately read.
-		if err == common.ErrItemNotStored || err == common.ErrKeyNotFound {
+		if errors.Is(err, common.ErrItemNotStored) || errors.Is(err, common.ErrKeyNotFound) {
 			metrics.IncCounter(MetricCmdPrependNotStoredL1)
 			metrics.IncCounter(MetricCmdPrependStored)
 			return l.res.Prepend(req.Opaque, req.Quiet)
@@ -336,7 +337,7 @@ func (l *L1L2BatchOrca) Delete(req common.DeleteRequest) error {
 		// key at all, or another request may be deleting the same key. In that
 		// case the other will finish up. Returning a key not found will trigger
 		// error handling to send back an error response.
-		if err == common.ErrKeyNotFound {
+		if errors.Is(err, common.ErrKeyNotFound) {
 			metrics.IncCounter(MetricCmdDeleteMissesL2)
 			metrics.IncCounter(MetricCmdDeleteMisses)
 			return err
@@ -370,11 +371,11 @@ func (l *L1L2BatchOrca) Delete(req common.DeleteRequest) error {
 		// in L2 hit. This isn't a miss per se since the overall effect is a
 		// delete. Concurrent deletes might interleave to produce this, or the
 		// data might have TTL'd out. Both cases are still fine.
-		if err == common.ErrKeyNotFound {
+		if errors.Is(err, common.ErrKeyNotFound) {
 			metrics.IncCounter(MetricCmdDeleteMissesL1)
 			metrics.IncCounter(MetricCmdDeleteHits)
 			// disregard the miss, don't return the error
-			return l.res.Delete(req.Opaque)
+			return l.res.Delete(req.Opaque, req.Quiet)
 		}
 		metrics.IncCounter(MetricCmdDeleteErrorsL1)
 		metrics.IncCounter(MetricCmdDeleteErrors)
@@ -384,7 +385,7 @@ func (l *L1L2BatchOrca) Delete(req common.DeleteRequest) error {
 	metrics.IncCounter(MetricCmdDeleteHitsL1)
 	metrics.IncCounter(MetricCmdDeleteHits)
 
-	return l.res.Delete(req.Opaque)
+	return l.res.Delete(req.Opaque, req.Quiet)
 }
 
 func (l *L1L2BatchOrca) Touch(req common.TouchRequest) error {
@@ -404,7 +405,7 @@ func (l *L1L2BatchOrca) Touch(req common.TouchRequest) error {
 		// possible to be inconsistent, but only for a short time. Any
 		// concurrent requests will see the same behavior as this one. If the
 		// touch misses here, any other request will see the same view.
-		if err == common.ErrKeyNotFound {
+		if errors.Is(err, common.ErrKeyNotFound) {
 			metrics.IncCounter(MetricCmdTouchMissesL2)
 			metrics.IncCounter(MetricCmdTouchMisses)
 			return err
@@ -433,7 +434,7 @@ func (l *L1L2BatchOrca) Touch(req common.TouchRequest) error {
 	metrics.ObserveHist(HistTouchL1, timer.Since(start))
 
 	if err != nil {
-		if err == common.ErrKeyNotFound {
+		if errors.Is(err, common.ErrKeyNotFound) {
 			// For a touch miss in L1, there's no problem.
 			metrics.IncCounter(MetricCmdTouchTouchMissesL1)
 		} else {
@@ -447,7 +448,7 @@ func (l *L1L2BatchOrca) Touch(req common.TouchRequest) error {
 
 	metrics.IncCounter(MetricCmdTouchHits)
 
-	return l.res.Touch(req.Opaque)
+	return l.res.Touch(req.Opaque, req.Quiet)
 }
 
 func (l *L1L2BatchOrca) Get(req common.GetRequest) error {
@@ -463,50 +464,28 @@ func (l *L1L2BatchOrca) Get(req common.GetRequest) error {
 	metrics.IncCounterBy(MetricCmdGetKeysL1, uint64(len(req.Keys)))
 	start := timer.Now()
 
-	resChan, errChan := l.l1.Get(req)
-
-	var err error
-	//var lastres common.GetResponse
 	var l2keys [][]byte
 	var l2opaques []uint32
 	var l2quiets []bool
 
-	// Read all the responses back from L1.
-	// The contract is that the resChan will have GetResponse's for get hits and misses,
-	// and the errChan will have any other errors, such as an out of memory error from
-	// memcached. If any receive happens from errChan, there will be no more responses
-	// from resChan.
-	for {
-		select {
-		case res, ok := <-resChan:
-			if !ok {
-				resChan = nil
-			} else {
-				if res.Miss {
-					metrics.IncCounter(MetricCmdGetMissesL1)
-					l2keys = append(l2keys, res.Key)
-					l2opaques = append(l2opaques, res.Opaque)
-					l2quiets = append(l2quiets, res.Quiet)
-				} else {
-					metrics.IncCounter(MetricCmdGetHits)
-					metrics.IncCounter(MetricCmdGetHitsL1)
-					l.res.Get(res)
-				}
-			}
-
-		case getErr, ok := <-errChan:
-			if !ok {
-				errChan = nil
-			} else {
-				metrics.IncCounter(MetricCmdGetErrors)
-				metrics.IncCounter(MetricCmdGetErrorsL1)
-				err = getErr
-			}
-		}
-
-		if resChan == nil && errChan == nil {
-			break
+	// Read all the responses back from L1. Hits and misses are passed to the callback, and any
+	// other error, such as an out of memory error from memcached, ends the get.
+	err := handlers.GetEach(l.l1, req, func(res common.GetResponse) error {
+		if res.Miss {
+			metrics.IncCounter(MetricCmdGetMissesL1)
+			l2keys = append(l2keys, res.Key)
+			l2opaques = append(l2opaques, res.Opaque)
+			l2quiets = append(l2quiets, res.Quiet)
+		} else {
+			metrics.IncCounter(MetricCmdGetHits)
+			metrics.IncCounter(MetricCmdGetHitsL1)
+			l.res.Get(res)
 		}
+		return nil
+	})
+	if err != nil {
+		metrics.IncCounter(MetricCmdGetErrors)
+		metrics.IncCounter(MetricCmdGetErrorsL1)
 	}
 
 	// record metrics before going to L2
@@ -533,55 +512,39 @@ func (l *L1L2BatchOrca) Get(req common.GetRequest) error {
 	metrics.IncCounterBy(MetricCmdGetKeysL2, uint64(len(l2keys)))
 	start = timer.Now()
 
-	resChan, errChan = l.l2.Get(req)
+	l2err := handlers.GetEach(l.l2, req, func(res common.GetResponse) error {
+		if res.Miss {
+			metrics.IncCounter(MetricCmdGetMissesL2)
+			// Missing L2 means a true miss
+			metrics.IncCounter(MetricCmdGetMisses)
+		} else {
+			metrics.IncCounter(MetricCmdGetHitsL2)
 
-	for {
-		select {
-		case res, ok := <-resChan:
-			if !ok {
-				resChan = nil
-			} else {
-				if res.Miss {
-					metrics.IncCounter(MetricCmdGetMissesL2)
-					// Missing L2 means a true miss
-					metrics.IncCounter(MetricCmdGetMisses)
-				} else {
-					metrics.IncCounter(MetricCmdGetHitsL2)
-
-					// For batch, don't set in l1. Typically batch users will read
-					// data once and not again, so setting in L1 will not be valuable.
-					// As well the data is typically just about to be replaced, making
-					// it doubly useless.
-
-					// overall operation is considered a hit
-					metrics.IncCounter(MetricCmdGetHits)
-				}
-
-				getres := common.GetResponse{
-					Key:    res.Key,
-					Flags:  res.Flags,
-					Data:   res.Data,
-					Miss:   res.Miss,
-					Opaque: res.Opaque,
-					Quiet:  res.Quiet,
-				}
-
-				l.res.Get(getres)
-			}
+			// For batch, don't set in l1. Typically batch users will read
+			// data once and not again, so setting in L1 will not be valuable.
+			// As well the data is typically just about to be replaced, making
+			// it doubly useless.
 
-		case getErr, ok := <-errChan:
-			if !ok {
-				errChan = nil
-			} else {
-				metrics.IncCounter(MetricCmdGetErrors)
-				metrics.IncCounter(MetricCmdGetEErrorsL2)
-				err = getErr
-			}
+			// overall operation is considered a hit
+			metrics.IncCounter(MetricCmdGetHits)
 		}
 
-		if resChan == nil && errChan == nil {
-			break
+		getres := common.GetResponse{
+			Key:    res.Key,
+			Flags:  res.Flags,
+			Data:   res.Data,
+			Miss:   res.Miss,
+			Opaque: res.Opaque,
+			Quiet:  res.Quiet,
 		}
+
+		l.res.Get(getres)
+		return nil
+	})
+	if l2err != nil {
+		metrics.IncCounter(MetricCmdGetErrors)
+		metrics.IncCounter(MetricCmdGetEErrorsL2)
+		err = l2err
 	}
 
 	metrics.ObserveHist(HistGetL2, timer.Since(start))
@@ -649,7 +612,7 @@ func (l *L1L2BatchOrca) Gat(req common.GATRequest) error {
 		metrics.ObserveHist(HistTouchL1, timer.Since(start))
 
 		if err != nil {
-			if err == common.ErrKeyNotFound {
+			if errors.Is(err, common.ErrKeyNotFound) {
 				// For a touch miss in L1, there's no problem.
 				metrics.IncCounter(MetricCmdGatTouchMissesL1)
 			} else {
@@ -15,6 +15,8 @@
 package orcas
 
 import (
+	"errors"
+
 	"github.com/netflix/rend/common"
 	"github.com/netflix/rend/handlers"
 	"github.com/netflix/rend/metrics"
@@ -74,7 +76,7 @@ func (l *L1OnlyOrca) Add(req common.SetRequest) error {
 
 		err = l.res.Add(req.Opaque, req.Quiet)
 
-	} else if err == common.ErrKeyExists {
+	} else if errors.Is(err, common.ErrNotAdded) {
 		metrics.IncCounter(MetricCmdAddNotStoredL1)
 		metrics.IncCounter(MetricCmdAddNotStored)
 	} else {
@@ -101,7 +103,7 @@ func (l *L1OnlyOrca) Replace(req common.SetRequest) error {
 
 		err = l.res.Replace(req.Opaque, req.Quiet)
 
-	} else if err == common.ErrKeyNotFound {
+	} else if errors.Is(err, common.ErrKeyNotFound) {
 		metrics.IncCounter(MetricCmdReplaceNotStoredL1)
 		metrics.IncCounter(MetricCmdReplaceNotStored)
 	} else {
@@ -128,7 +130,7 @@ func (l *L1OnlyOrca) Append(req common.SetRequest) error {
 
 		err = l.res.Append(req.Opaque, req.Quiet)
 
-	} else if err == common.ErrKeyNotFound {
+	} else if errors.Is(err, common.ErrKeyNotFound) {
 		metrics.IncCounter(MetricCmdAppendNotStoredL1)
 		metrics.IncCounter(MetricCmdAppendNotStored)
 	} else {
@@ -155,7 +157,7 @@ func (l *L1OnlyOrca) Prepend(req common.SetRequest) error {
 
 		err = l.res.Prepend(req.Opaque, req.Quiet)
 
-	} else if err == common.ErrKeyNotFound {
+	} else if errors.Is(err, common.ErrKeyNotFound) {
 		metrics.IncCounter(MetricCmdPrependNotStoredL1)
 		metrics.IncCounter(MetricCmdPrependNotStored)
 	} else {
@@ -180,9 +182,9 @@ func (l *L1OnlyOrca) Delete(req common.DeleteRequest) error {
 		metrics.IncCounter(MetricCmdDeleteHits)
 		metrics.IncCounter(MetricCmdDeleteHitsL1)
 
-		l.res.Delete(req.Opaque)
+		l.res.Delete(req.Opaque, req.Quiet)
 
-	} else if err == common.ErrKeyNotFound {
+	} else if errors.Is(err, common.ErrKeyNotFound) {
 		metrics.IncCounter(MetricCmdDeleteMissesL1)
 		metrics.IncCounter(MetricCmdDeleteMisses)
 	} else {
@@ -207,9 +209,9 @@ func (l *L1OnlyOrca) Touch(req common.TouchRequest) error {
 		metrics.IncCounter(MetricCmdTouchHitsL1)
 		metrics.IncCounter(MetricCmdTouchHits)
 
-		l.res.Touch(req.Opaque)
+		l.res.Touch(req.Opaque, req.Quiet)
 
-	} else if err == common.ErrKeyNotFound {
+	} else if errors.Is(err, common.ErrKeyNotFound) {
 		metrics.IncCounter(MetricCmdTouchMissesL1)
 		metrics.IncCounter(MetricCmdTouchMisses)
 	} else {
@@ -233,44 +235,22 @@ func (l *L1OnlyOrca) Get(req common.GetRequest) error {
 	metrics.IncCounterBy(MetricCmdGetKeysL1, uint64(len(req.Keys)))
 	start := timer.Now()
 
-	resChan, errChan := l.l1.Get(req)
-
-	var err error
-
-	// Read all the responses back from l.l1.
-	// The contract is that the resChan will have GetResponse's for get hits and misses,
-	// and the errChan will have any other errors, such as an out of memory error from
-	// memcached. If any receive happens from errChan, there will be no more responses
-	// from resChan.
-	for {
-		select {
-		case res, ok := <-resChan:
-			if !ok {
-				resChan = nil
-			} else {
-				if res.Miss {
-					metrics.IncCounter(MetricCmdGetMissesL1)
-					metrics.IncCounter(MetricCmdGetMisses)
-				} else {
-					metrics.IncCounter(MetricCmdGetHits)
-					metrics.IncCounter(MetricCmdGetHitsL1)
-				}
-				l.res.Get(res)
-			}
-
-		case getErr, ok := <-errChan:
-			if !ok {
-				errChan = nil
-			} else {
-				metrics.IncCounter(MetricCmdGetErrors)
-				metrics.IncCounter(MetricCmdGetErrorsL1)
-				err = getErr
-			}
-		}
-
-		if resChan == nil && errChan == nil {
-			break
+	// Read all the responses back from l.l1. Hits and misses are passed to the callback, and any
+	// other error, such as an out of memory error from memcached, ends the get.
+	err := handlers.GetEach(l.l1, req, func(res common.GetResponse) error {
+		if res.Miss {
+			metrics.IncCounter(MetricCmdGetMissesL1)
+			metrics.IncCounter(MetricCmdGetMisses)
+		} else {
+			metrics.IncCounter(MetricCmdGetHits)
+			metrics.IncCounter(MetricCmdGetHitsL1)
 		}
+		l.res.Get(res)
+		return nil
+	})
+	if err != nil {
+		metrics.IncCounter(MetricCmdGetErrors)
+		metrics.IncCounter(MetricCmdGetErrorsL1)
 	}
 
 	metrics.ObserveHist(HistGetL1, timer.Since(start))
@@ -298,44 +278,21 @@ func (l *L1OnlyOrca) GetE(req common.GetRequest) error {
 	metrics.IncCounterBy(MetricCmdGetEKeysL1, uint64(len(req.Keys)))
 	start := timer.Now()
 
-	resChan, errChan := l.l1.GetE(req)
-
-	var err error
-
-	// Read all the responses back from l.l1.
-	// The contract is that the resChan will have GetEResponse's for get hits and misses,
-	// and the errChan will have any other errors, such as an out of memory error from
-	// memcached. If any receive happens from errChan, there will be no more responses
-	// from resChan.
-	for {
-		select {
-		case res, ok := <-resChan:
-			if !ok {
-				resChan = nil
-			} else {
-				if res.Miss {
-					metrics.IncCounter(MetricCmdGetEMissesL1)
-					metrics.IncCounter(MetricCmdGetEMisses)
-				} else {
-					metrics.IncCounter(MetricCmdGetEHits)
-					metrics.IncCounter(MetricCmdGetEHitsL1)
-				}
-				l.res.GetE(res)
-			}
-
-		case getErr, ok := <-errChan:
-			if !ok {
-				errChan = nil
-			} else {
-				metrics.IncCounter(MetricCmdGetEErrors)
-				metrics.IncCounter(MetricCmdGetEErrorsL1)
-				err = getErr
-			}
-		}
-
-		if resChan == nil && errChan == nil {
-			break
+	// Read all the responses back from l.l1, the same way as for Get
+	err := handlers.GetEEach(l.l1, req, func(res common.GetEResponse) error {
+		if res.Miss {
+			metrics.IncCounter(MetricCmdGetEMissesL1)
+			metrics.IncCounter(MetricCmdGetEMisses)
+		} else {
+			metrics.IncCounter(MetricCmdGetEHits)
+			metrics.IncCounter(MetricCmdGetEHitsL1)
 		}
+		l.res.GetE(res)
+		return nil
+	})
+	if err != nil {
+		metrics.IncCounter(MetricCmdGetEErrors)
+		metrics.IncCounter(MetricCmdGetEErrorsL1)
 	}
 
 	metrics.ObserveHist(HistGetEL1, timer.Since(start))
@@ -0,0 +1,347 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"context"
+	"errors"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/timer"
+)
+
+var (
+	MetricCmdGetLockL1     = metrics.AddCounter("cmd_getl_l1", nil)
+	MetricCmdGetLockL2     = metrics.AddCounter("cmd_getl_l2", nil)
+	MetricCmdGetLockLocked = metrics.AddCounter("cmd_getl_locked", nil)
+	MetricCmdGetLockMisses = metrics.AddCounter("cmd_getl_misses", nil)
+	MetricCmdGetLockErrors = metrics.AddCounter("cmd_getl_errors", nil)
+	MetricCmdUnlockL1      = metrics.AddCounter("cmd_unlock_l1", nil)
+	MetricCmdUnlockL2      = metrics.AddCounter("cmd_unlock_l2", nil)
+	MetricCmdUnlockErrors  = metrics.AddCounter("cmd_unlock_errors", nil)
+
+	HistGetLockL1 = metrics.AddHistogram("getl_l1", false, nil)
+	HistGetLockL2 = metrics.AddHistogram("getl_l2", false, nil)
+	HistUnlockL1  = metrics.AddHistogram("unlock_l1", false, nil)
+	HistUnlockL2  = metrics.AddHistogram("unlock_l2", false, nil)
+)
+
+// Locker is implemented by orchestrators that support get-with-lock and unlock. Like every other
+// operation, the orchestrator responds on success and returns any error for the server to handle.
+type Locker interface {
+	GetLock(req common.GetLockRequest) error
+	Unlock(req common.UnlockRequest) error
+}
+
+// LockerV2 is the context-aware form of Locker for OrcaV2 implementations.
+type LockerV2 interface {
+	GetLock(ctx context.Context, req common.GetLockRequest) error
+	Unlock(ctx context.Context, req common.UnlockRequest) error
+}
+
+// GetLock does the get-with-lock in req with o, or returns common.ErrNotSupported if o doesn't
+// implement Locker.
+func GetLock(o Orca, req common.GetLockRequest) error {
+	if l, ok := o.(Locker); ok {
+		return l.GetLock(req)
+	}
+	return common.ErrNotSupported
+}
+
+// Unlock does the unlock in req with o, or returns common.ErrNotSupported if o doesn't implement
+// Locker.
+func Unlock(o Orca, req common.UnlockRequest) error {
+	if l, ok := o.(Locker); ok {
+		return l.Unlock(req)
+	}
+	return common.ErrNotSupported
+}
+
+// GetLockV2 is the OrcaV2 counterpart of GetLock.
+func GetLockV2(ctx context.Context, o OrcaV2, req common.GetLockRequest) error {
+	if l, ok := o.(LockerV2); ok {
+		return l.GetLock(ctx, req)
+	}
+	return common.ErrNotSupported
+}
+
+// UnlockV2 is the OrcaV2 counterpart of Unlock.
+func UnlockV2(ctx context.Context, o OrcaV2, req common.UnlockRequest) error {
+	if l, ok := o.(LockerV2); ok {
+		return l.Unlock(ctx, req)
+	}
+	return common.ErrNotSupported
+}
+
+// getLock locks and gets a key in a single handler and counts the outcome
+func getLock(h handlers.Handler, req common.GetLockRequest, counter uint32, hist uint32) (common.GetLockResponse, error) {
+	metrics.IncCounter(counter)
+	start := timer.Now()
+
+	res, err := handlers.GetLock(h, req)
+
+	metrics.ObserveHist(hist, timer.Since(start))
+
+	switch {
+	case err == nil:
+	case errors.Is(err, common.ErrLocked):
+		metrics.IncCounter(MetricCmdGetLockLocked)
+	case errors.Is(err, common.ErrKeyNotFound):
+		metrics.IncCounter(MetricCmdGetLockMisses)
+	default:
+		metrics.IncCounter(MetricCmdGetLockErrors)
+	}
+
+	return res, err
+}
+
+// unlock releases a lock in a single handler and counts the outcome
+func unlock(h handlers.Handler, req common.UnlockRequest, counter uint32, hist uint32) error {
+	metrics.IncCounter(counter)
+	start := timer.Now()
+
+	err := handlers.Unlock(h, req)
+
+	metrics.ObserveHist(hist, timer.Since(start))
+
+	if err != nil {
+		metrics.IncCounter(MetricCmdUnlockErrors)
+	}
+	return err
+}
+
+func (l *L1OnlyOrca) GetLock(req common.GetLockRequest) error {
+	res, err := getLock(l.l1, req, MetricCmdGetLockL1, HistGetLockL1)
+	if err != nil {
+		return err
+	}
+	return l.res.GetLock(res)
+}
+
+func (l *L1OnlyOrca) Unlock(req common.UnlockRequest) error {
+	if err := unlock(l.l1, req, MetricCmdUnlockL1, HistUnlockL1); err != nil {
+		return err
+	}
+	return l.res.Unlock(req.Opaque)
+}
+
+// Locks are taken in L2, which every rend instance in front of it shares, so a lock keeps out
+// clients of other instances too. L1 is left alone: a lock doesn't change the value.
+func (l *L1L2Orca) GetLock(req common.GetLockRequest) error {
+	res, err := getLock(l.l2, req, MetricCmdGetLockL2, HistGetLockL2)
+	if err != nil {
+		return err
+	}
+	return l.res.GetLock(res)
+}
+
+func (l *L1L2Orca) Unlock(req common.UnlockRequest) error {
+	if err := unlock(l.l2, req, MetricCmdUnlockL2, HistUnlockL2); err != nil {
+		return err
+	}
+	return l.res.Unlock(req.Opaque)
+}
+
+func (l *L1L2BatchOrca) GetLock(req common.GetLockRequest) error {
+	res, err := getLock(l.l2, req, MetricCmdGetLockL2, HistGetLockL2)
+	if err != nil {
+		return err
+	}
+	return l.res.GetLock(res)
+}
+
+func (l *L1L2BatchOrca) Unlock(req common.UnlockRequest) error {
+	if err := unlock(l.l2, req, MetricCmdUnlockL2, HistUnlockL2); err != nil {
+		return err
+	}
+	return l.res.Unlock(req.Opaque)
+}
+
+func (l *LockedOrca) GetLock(req common.GetLockRequest) error {
+	lock := l.getlock(req.Key, false)
+	lock.Lock()
+	defer lock.Unlock()
+	return GetLock(l.wrapped, req)
+}
+
+func (l *LockedOrca) Unlock(req common.UnlockRequest) error {
+	lock := l.getlock(req.Key, false)
+	lock.Lock()
+	defer lock.Unlock()
+	return Unlock(l.wrapped, req)
+}
+
+// Taking and releasing locks are writes as far as the mode is concerned, since the emulated locks
+// are stored in the backend.
+func (o *modedOrca) GetLock(req common.GetLockRequest) error {
+	if err := o.write(); err != nil {
+		return err
+	}
+	return GetLock(o.Orca, req)
+}
+
+func (o *modedOrca) Unlock(req common.UnlockRequest) error {
+	if err := o.write(); err != nil {
+		return err
+	}
+	return Unlock(o.Orca, req)
+}
+
+func (o *budgetOrca) GetLock(req common.GetLockRequest) error {
+	o.b.start()
+	return GetLock(o.Orca, req)
+}
+
+func (o *budgetOrca) Unlock(req common.UnlockRequest) error {
+	o.b.start()
+	return Unlock(o.Orca, req)
+}
+
+func (o *canaryOrca) GetLock(req common.GetLockRequest) error {
+	arm, start := o.pick(req.Key)
+	return o.done(arm, start, GetLock(o.arms[arm], req))
+}
+
+func (o *canaryOrca) Unlock(req common.UnlockRequest) error {
+	arm, start := o.pick(req.Key)
+	return o.done(arm, start, Unlock(o.arms[arm], req))
+}
+
+func (p *prioritizedOrca) GetLock(req common.GetLockRequest) error {
+	p.acquire(req.Key)
+	defer p.s.Release()
+	return GetLock(p.Orca, req)
+}
+
+func (p *prioritizedOrca) Unlock(req common.UnlockRequest) error {
+	p.acquire(req.Key)
+	defer p.s.Release()
+	return Unlock(p.Orca, req)
+}
+
+func (c *v2Orca) GetLock(ctx context.Context, req common.GetLockRequest) error {
+	defer c.ctx.enter(ctx)()
+	return GetLock(c.o, req)
+}
+
+func (c *v2Orca) Unlock(ctx context.Context, req common.UnlockRequest) error {
+	defer c.ctx.enter(ctx)()
+	return Unlock(c.o, req)
+}
+
+func (v v1Orca) GetLock(req common.GetLockRequest) error {
+	return GetLockV2(v.ctx, v.o, req)
+}
+
+func (v v1Orca) Unlock(req common.UnlockRequest) error {
+	return UnlockV2(v.ctx, v.o, req)
+}
+
+func (b boundHandler) GetLock(cmd common.GetLockRequest) (common.GetLockResponse, error) {
+	defer b.enter()()
+	return handlers.GetLockV2(b.ctx.get(), b.h, cmd)
+}
+
+func (b boundHandler) Unlock(cmd common.UnlockRequest) error {
+	defer b.enter()()
+	return handlers.UnlockV2(b.ctx.get(), b.h, cmd)
+}
+
+// Like conditional sets, locks aren't supported with size routing. The lock would be taken in one
+// tier without knowing which tier the value is in.
+
+func (h *budgetHandler) GetLock(cmd common.GetLockRequest) (common.GetLockResponse, error) {
+	var res common.GetLockResponse
+	err := h.run(func(hd handlers.Handler) error {
+		var err error
+		res, err = handlers.GetLock(hd, cmd)
+		return err
+	})
+	if err != nil {
+		// res could still be written by an abandoned op
+		return common.GetLockResponse{}, err
+	}
+	return res, nil
+}
+
+func (h *budgetHandler) Unlock(cmd common.UnlockRequest) error {
+	return h.run(func(hd handlers.Handler) error { return handlers.Unlock(hd, cmd) })
+}
+
+func (h staleHandler) GetLock(cmd common.GetLockRequest) (common.GetLockResponse, error) {
+	return handlers.GetLock(h.Handler, cmd)
+}
+
+func (h staleHandler) Unlock(cmd common.UnlockRequest) error {
+	return handlers.Unlock(h.Handler, cmd)
+}
+
+func (h refreshingHandler) GetLock(cmd common.GetLockRequest) (common.GetLockResponse, error) {
+	return handlers.GetLock(h.Handler, cmd)
+}
+
+func (h refreshingHandler) Unlock(cmd common.UnlockRequest) error {
+	return handlers.Unlock(h.Handler, cmd)
+}
+
+func (o *tombstoneOrca) GetLock(req common.GetLockRequest) error {
+	return GetLock(o.Orca, req)
+}
+
+func (o *tombstoneOrca) Unlock(req common.UnlockRequest) error {
+	return Unlock(o.Orca, req)
+}
+
+func (h *tombstoneHandler) GetLock(cmd common.GetLockRequest) (common.GetLockResponse, error) {
+	return handlers.GetLock(h.Handler, cmd)
+}
+
+func (h *tombstoneHandler) Unlock(cmd common.UnlockRequest) error {
+	return handlers.Unlock(h.Handler, cmd)
+}
+
+func (o *admissionOrca) GetLock(req common.GetLockRequest) error {
+	return GetLock(o.Orca, req)
+}
+
+func (o *admissionOrca) Unlock(req common.UnlockRequest) error {
+	return Unlock(o.Orca, req)
+}
+
+func (h *admissionHandler) GetLock(cmd common.GetLockRequest) (common.GetLockResponse, error) {
+	return handlers.GetLock(h.Handler, cmd)
+}
+
+func (h *admissionHandler) Unlock(cmd common.UnlockRequest) error {
+	return handlers.Unlock(h.Handler, cmd)
+}
+
+func (o *quotaOrca) GetLock(req common.GetLockRequest) error {
+	return GetLock(o.Orca, req)
+}
+
+func (o *quotaOrca) Unlock(req common.UnlockRequest) error {
+	return Unlock(o.Orca, req)
+}
+
+func (h *quietHandler) GetLock(cmd common.GetLockRequest) (common.GetLockResponse, error) {
+	return handlers.GetLock(h.Handler, cmd)
+}
+
+func (h *quietHandler) Unlock(cmd common.UnlockRequest) error {
+	return handlers.Unlock(h.Handler, cmd)
+}
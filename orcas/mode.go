@@ -0,0 +1,309 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/protocol"
+)
+
+var (
+	MetricModeRejected = metrics.AddCounter("mode_rejected", nil)
+	MetricModeMissed   = metrics.AddCounter("mode_forced_misses", nil)
+)
+
+// Mode restricts what an orchestrator will do, for controlled failovers and migrations
+type Mode int
+
+const (
+	// ModeNormal serves everything
+	ModeNormal Mode = iota
+	// ModeReadOnly rejects anything that changes data
+	ModeReadOnly
+	// ModeWriteOnly answers every read with a miss while accepting writes. This fills a cold cache
+	// from clients writing back what they read from the origin, without serving anything from it.
+	ModeWriteOnly
+	// ModeMaintenance rejects everything with a message
+	ModeMaintenance
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeNormal:
+		return "normal"
+	case ModeReadOnly:
+		return "read-only"
+	case ModeWriteOnly:
+		return "write-only"
+	case ModeMaintenance:
+		return "maintenance"
+	}
+	return "unknown"
+}
+
+// ParseMode is the inverse of Mode.String
+func ParseMode(s string) (Mode, error) {
+	switch s {
+	case "normal":
+		return ModeNormal, nil
+	case "read-only":
+		return ModeReadOnly, nil
+	case "write-only":
+		return ModeWriteOnly, nil
+	case "maintenance":
+		return ModeMaintenance, nil
+	}
+	return ModeNormal, fmt.Errorf("Unknown mode %q", s)
+}
+
+// errReadOnly is returned for writes in read-only mode
+var errReadOnly = common.ServerError("read-only")
+
+// ModeSwitch holds the current mode of every orchestrator wrapped with it
+type ModeSwitch struct {
+	lock    sync.RWMutex
+	mode    Mode
+	message string
+	err     error
+}
+
+// NewModeSwitch creates a ModeSwitch in the given mode. The message is what clients are told in
+// maintenance mode.
+func NewModeSwitch(m Mode, message string) *ModeSwitch {
+	return &ModeSwitch{
+		mode:    m,
+		message: message,
+		err:     common.ServerError(message),
+	}
+}
+
+func (s *ModeSwitch) get() (Mode, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.mode, s.err
+}
+
+// Mode returns the current mode
+func (s *ModeSwitch) Mode() Mode {
+	m, _ := s.get()
+	return m
+}
+
+// Set switches every connection to the given mode for their next request. An empty message keeps
+// the current one.
+func (s *ModeSwitch) Set(m Mode, message string) {
+	s.lock.Lock()
+	old := s.mode
+	s.mode = m
+	if message != "" {
+		s.message = message
+		s.err = common.ServerError(message)
+	}
+	s.lock.Unlock()
+
+	if old != m {
+		log.Printf("Mode changed from %v to %v\n", old, m)
+	}
+}
+
+type modeStatus struct {
+	Mode    string `json:"mode"`
+	Message string `json:"message"`
+}
+
+// ServeHTTP reports the current mode as JSON. A POST with a mode parameter, and optionally a
+// message parameter, switches modes first.
+func (s *ModeSwitch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		m, err := ParseMode(r.FormValue("mode"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.Set(m, r.FormValue("message"))
+	}
+
+	s.lock.RLock()
+	status := modeStatus{
+		Mode:    s.mode.String(),
+		Message: s.message,
+	}
+	s.lock.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// Moded wraps an orchestrator so it follows the mode of s
+func Moded(oc OrcaConst, s *ModeSwitch) OrcaConst {
+	return func(l1, l2 handlers.Handler, res protocol.Responder) Orca {
+		return &modedOrca{
+			Orca: oc(l1, l2, res),
+			s:    s,
+			res:  res,
+		}
+	}
+}
+
+type modedOrca struct {
+	Orca
+	s   *ModeSwitch
+	res protocol.Responder
+}
+
+// write returns the error a write gets in the current mode, if any
+func (o *modedOrca) write() error {
+	switch m, msg := o.s.get(); m {
+	case ModeReadOnly:
+		metrics.IncCounter(MetricModeRejected)
+		return errReadOnly
+	case ModeMaintenance:
+		metrics.IncCounter(MetricModeRejected)
+		return msg
+	}
+	return nil
+}
+
+// read returns whether a read should be answered with misses, or the error it gets instead
+func (o *modedOrca) read() (bool, error) {
+	switch m, msg := o.s.get(); m {
+	case ModeWriteOnly:
+		metrics.IncCounter(MetricModeMissed)
+		return true, nil
+	case ModeMaintenance:
+		metrics.IncCounter(MetricModeRejected)
+		return false, msg
+	}
+	return false, nil
+}
+
+func (o *modedOrca) Set(req common.SetRequest) error {
+	if err := o.write(); err != nil {
+		return err
+	}
+	return o.Orca.Set(req)
+}
+
+func (o *modedOrca) Add(req common.SetRequest) error {
+	if err := o.write(); err != nil {
+		return err
+	}
+	return o.Orca.Add(req)
+}
+
+func (o *modedOrca) Replace(req common.SetRequest) error {
+	if err := o.write(); err != nil {
+		return err
+	}
+	return o.Orca.Replace(req)
+}
+
+func (o *modedOrca) Append(req common.SetRequest) error {
+	if err := o.write(); err != nil {
+		return err
+	}
+	return o.Orca.Append(req)
+}
+
+func (o *modedOrca) Prepend(req common.SetRequest) error {
+	if err := o.write(); err != nil {
+		return err
+	}
+	return o.Orca.Prepend(req)
+}
+
+func (o *modedOrca) Delete(req common.DeleteRequest) error {
+	if err := o.write(); err != nil {
+		return err
+	}
+	return o.Orca.Delete(req)
+}
+
+func (o *modedOrca) Touch(req common.TouchRequest) error {
+	if err := o.write(); err != nil {
+		return err
+	}
+	return o.Orca.Touch(req)
+}
+
+func (o *modedOrca) Get(req common.GetRequest) error {
+	miss, err := o.read()
+	if err != nil {
+		return err
+	}
+	if !miss {
+		return o.Orca.Get(req)
+	}
+
+	for i, key := range req.Keys {
+		o.res.Get(common.GetResponse{
+			Key:    key,
+			Opaque: req.Opaques[i],
+			Quiet:  req.Quiet[i],
+			Miss:   true,
+		})
+	}
+	return o.res.GetEnd(req.NoopOpaque, req.NoopEnd)
+}
+
+func (o *modedOrca) GetE(req common.GetRequest) error {
+	miss, err := o.read()
+	if err != nil {
+		return err
+	}
+	if !miss {
+		return o.Orca.GetE(req)
+	}
+
+	for i, key := range req.Keys {
+		o.res.GetE(common.GetEResponse{
+			Key:    key,
+			Opaque: req.Opaques[i],
+			Quiet:  req.Quiet[i],
+			Miss:   true,
+		})
+	}
+	return o.res.GetEnd(req.NoopOpaque, req.NoopEnd)
+}
+
+// Gat both reads and writes, so it's rejected in read-only mode and misses in write-only mode
+func (o *modedOrca) Gat(req common.GATRequest) error {
+	if o.s.Mode() == ModeReadOnly {
+		return o.write()
+	}
+
+	miss, err := o.read()
+	if err != nil {
+		return err
+	}
+	if !miss {
+		return o.Orca.Gat(req)
+	}
+
+	return o.res.GAT(common.GetResponse{
+		Key:    req.Key,
+		Opaque: req.Opaque,
+		Quiet:  req.Quiet,
+		Miss:   true,
+	})
+}
@@ -0,0 +1,70 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol/textprot"
+)
+
+func TestModes(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := bufio.NewWriter(buf)
+	s := orcas.NewModeSwitch(orcas.ModeReadOnly, "down for maintenance")
+
+	// The inner orca panics on anything that gets through
+	o := orcas.Moded(testPanicOrcaConst, s)(nil, nil, textprot.NewTextResponder(w))
+
+	set := common.SetRequest{Key: []byte("foo")}
+	get := common.GetRequest{Keys: [][]byte{[]byte("foo")}, Opaques: []uint32{0}, Quiet: []bool{false}}
+
+	if err := o.Set(set); !common.IsAppError(err) || err.Error() != "SERVER_ERROR read-only" {
+		t.Fatalf("Expected a read-only error, got %v", err)
+	}
+
+	s.Set(orcas.ModeWriteOnly, "")
+	if err := o.Get(get); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+	if buf.String() != "END\r\n" {
+		t.Fatalf("Expected a miss in write-only mode, got %q", buf.String())
+	}
+
+	s.Set(orcas.ModeMaintenance, "")
+	if err := o.Get(get); err == nil || err.Error() != "SERVER_ERROR down for maintenance" {
+		t.Fatalf("Expected the maintenance message, got %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/mode?mode=normal", nil))
+	if s.Mode() != orcas.ModeNormal || !strings.Contains(rec.Body.String(), `"mode":"normal"`) {
+		t.Fatalf("Expected a switch to normal mode, got %s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/mode?mode=bogus", nil))
+	if rec.Code != http.StatusBadRequest || s.Mode() != orcas.ModeNormal {
+		t.Fatalf("Expected an unknown mode to be rejected, got %d", rec.Code)
+	}
+}
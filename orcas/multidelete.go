@@ -0,0 +1,262 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"context"
+	"errors"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/protocol"
+	"github.com/netflix/rend/timer"
+)
+
+// MultiDeleter is implemented by orchestrators that can process a batch of deletes together. The
+// contract is the same as for MultiSetter: every delete is answered individually and in order,
+// including misses, and only an error that should end the connection is returned.
+type MultiDeleter interface {
+	MultiDelete(req common.MultiDeleteRequest) error
+}
+
+// MultiDeleterV2 is the context-aware form of MultiDeleter for OrcaV2 implementations.
+type MultiDeleterV2 interface {
+	MultiDelete(ctx context.Context, req common.MultiDeleteRequest) error
+}
+
+// MultiDelete processes all of the deletes in req with o. Orchestrators that don't implement
+// MultiDeleter get the deletes one at a time.
+func MultiDelete(o Orca, req common.MultiDeleteRequest) error {
+	if md, ok := o.(MultiDeleter); ok {
+		return md.MultiDelete(req)
+	}
+
+	for _, del := range req.Deletes {
+		if err := o.Delete(del); err != nil {
+			if !common.IsAppError(err) {
+				return err
+			}
+			o.Error(del, common.RequestDelete, err)
+		}
+	}
+
+	return nil
+}
+
+// MultiDeleteV2 is the OrcaV2 counterpart of MultiDelete.
+func MultiDeleteV2(ctx context.Context, o OrcaV2, req common.MultiDeleteRequest) error {
+	if md, ok := o.(MultiDeleterV2); ok {
+		return md.MultiDelete(ctx, req)
+	}
+
+	for _, del := range req.Deletes {
+		if err := o.Delete(ctx, del); err != nil {
+			if !common.IsAppError(err) {
+				return err
+			}
+			o.Error(ctx, del, common.RequestDelete, err)
+		}
+	}
+
+	return nil
+}
+
+// respondMultiDelete answers every delete in req in order, given the outcome of each. It stops at
+// the first error that isn't an application error and returns it.
+func respondMultiDelete(res protocol.Responder, req common.MultiDeleteRequest, errs []error) error {
+	for i, del := range req.Deletes {
+		if errs[i] == nil {
+			metrics.IncCounter(MetricCmdDeleteHits)
+			if err := res.Delete(del.Opaque, del.Quiet); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if errors.Is(errs[i], common.ErrKeyNotFound) {
+			metrics.IncCounter(MetricCmdDeleteMisses)
+		} else {
+			metrics.IncCounter(MetricCmdDeleteErrors)
+			if !common.IsAppError(errs[i]) {
+				return errs[i]
+			}
+		}
+		res.Error(del.Opaque, common.RequestDelete, errs[i], del.Quiet)
+	}
+
+	return nil
+}
+
+func (l *L1OnlyOrca) MultiDelete(req common.MultiDeleteRequest) error {
+	metrics.IncCounterBy(MetricCmdDeleteL1, uint64(len(req.Deletes)))
+	start := timer.Now()
+
+	errs := handlers.MultiDelete(l.l1, req)
+
+	metrics.ObserveHist(HistDeleteL1, timer.Since(start))
+
+	for _, err := range errs {
+		if err == nil {
+			metrics.IncCounter(MetricCmdDeleteHitsL1)
+		} else if errors.Is(err, common.ErrKeyNotFound) {
+			metrics.IncCounter(MetricCmdDeleteMissesL1)
+		} else {
+			metrics.IncCounter(MetricCmdDeleteErrorsL1)
+		}
+	}
+
+	return respondMultiDelete(l.res, req, errs)
+}
+
+func (l *L1L2Orca) MultiDelete(req common.MultiDeleteRequest) error {
+	return respondMultiDelete(l.res, req, multiDeleteL1L2(l.l1, l.l2, req))
+}
+
+func (l *L1L2BatchOrca) MultiDelete(req common.MultiDeleteRequest) error {
+	return respondMultiDelete(l.res, req, multiDeleteL1L2(l.l1, l.l2, req))
+}
+
+// multiDeleteL1L2 deletes from L2 first and then from L1 for only the keys L2 had, the same as a
+// single delete. Misses in L1 after a hit in L2 are still a successful delete overall.
+func multiDeleteL1L2(l1, l2 handlers.Handler, req common.MultiDeleteRequest) []error {
+	metrics.IncCounterBy(MetricCmdDeleteL2, uint64(len(req.Deletes)))
+	start := timer.Now()
+
+	errs := handlers.MultiDelete(l2, req)
+
+	metrics.ObserveHist(HistDeleteL2, timer.Since(start))
+
+	var pending common.MultiDeleteRequest
+	var idx []int
+
+	for i, err := range errs {
+		if err == nil {
+			metrics.IncCounter(MetricCmdDeleteHitsL2)
+			pending.Deletes = append(pending.Deletes, req.Deletes[i])
+			idx = append(idx, i)
+		} else if errors.Is(err, common.ErrKeyNotFound) {
+			metrics.IncCounter(MetricCmdDeleteMissesL2)
+		} else {
+			metrics.IncCounter(MetricCmdDeleteErrorsL2)
+		}
+	}
+
+	if len(pending.Deletes) == 0 {
+		return errs
+	}
+
+	metrics.IncCounterBy(MetricCmdDeleteL1, uint64(len(pending.Deletes)))
+	start = timer.Now()
+
+	l1errs := handlers.MultiDelete(l1, pending)
+
+	metrics.ObserveHist(HistDeleteL1, timer.Since(start))
+
+	for j, err := range l1errs {
+		if err == nil {
+			metrics.IncCounter(MetricCmdDeleteHitsL1)
+		} else if errors.Is(err, common.ErrKeyNotFound) {
+			metrics.IncCounter(MetricCmdDeleteMissesL1)
+		} else {
+			metrics.IncCounter(MetricCmdDeleteErrorsL1)
+			errs[idx[j]] = err
+		}
+	}
+
+	return errs
+}
+
+func (o *budgetOrca) MultiDelete(req common.MultiDeleteRequest) error {
+	o.b.start()
+	return MultiDelete(o.Orca, req)
+}
+
+func (o *modedOrca) MultiDelete(req common.MultiDeleteRequest) error {
+	if err := o.write(); err != nil {
+		for _, del := range req.Deletes {
+			o.Orca.Error(del, common.RequestDelete, err)
+		}
+		return nil
+	}
+	return MultiDelete(o.Orca, req)
+}
+
+func (o *canaryOrca) MultiDelete(req common.MultiDeleteRequest) error {
+	var key []byte
+	if len(req.Deletes) > 0 {
+		key = req.Deletes[0].Key
+	}
+	arm, start := o.pick(key)
+	return o.done(arm, start, MultiDelete(o.arms[arm], req))
+}
+
+func (p *prioritizedOrca) MultiDelete(req common.MultiDeleteRequest) error {
+	var key []byte
+	if len(req.Deletes) > 0 {
+		key = req.Deletes[0].Key
+	}
+	p.acquire(key)
+	defer p.s.Release()
+	return MultiDelete(p.Orca, req)
+}
+
+func (b boundHandler) MultiDelete(cmd common.MultiDeleteRequest) []error {
+	defer b.enter()()
+	return handlers.MultiDeleteV2(b.ctx.get(), b.h, cmd)
+}
+
+func (c *v2Orca) MultiDelete(ctx context.Context, req common.MultiDeleteRequest) error {
+	defer c.ctx.enter(ctx)()
+	return MultiDelete(c.o, req)
+}
+
+func (v v1Orca) MultiDelete(req common.MultiDeleteRequest) error {
+	return MultiDeleteV2(v.ctx, v.o, req)
+}
+
+func (o *tombstoneOrca) MultiDelete(req common.MultiDeleteRequest) error {
+	return MultiDelete(o.Orca, req)
+}
+
+func (h *tombstoneHandler) MultiDelete(cmd common.MultiDeleteRequest) []error {
+	for _, del := range cmd.Deletes {
+		h.t.Add(del.Key)
+	}
+	return handlers.MultiDelete(h.Handler, cmd)
+}
+
+func (o *admissionOrca) MultiDelete(req common.MultiDeleteRequest) error {
+	return MultiDelete(o.Orca, req)
+}
+
+func (h *admissionHandler) MultiDelete(cmd common.MultiDeleteRequest) []error {
+	return handlers.MultiDelete(h.Handler, cmd)
+}
+
+// Batches with keys of a tenant are done one delete at a time, since the usage of each key depends
+// on whether its own delete went through
+func (o *quotaOrca) MultiDelete(req common.MultiDeleteRequest) error {
+	for _, del := range req.Deletes {
+		if o.t.Tracks(del.Key) {
+			return MultiDelete(quotaSingle{o}, req)
+		}
+	}
+	return MultiDelete(o.Orca, req)
+}
+
+func (h *quietHandler) MultiDelete(cmd common.MultiDeleteRequest) []error {
+	return handlers.MultiDelete(h.Handler, cmd)
+}
@@ -0,0 +1,97 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol/binprot"
+)
+
+// keysHandler holds a set of keys and deletes them in batches, recording the size of each batch
+type keysHandler struct {
+	handlers.Handler
+	keys    map[string]bool
+	batches *[]int
+}
+
+func (k keysHandler) MultiDelete(cmd common.MultiDeleteRequest) []error {
+	*k.batches = append(*k.batches, len(cmd.Deletes))
+
+	errs := make([]error, len(cmd.Deletes))
+	for i, del := range cmd.Deletes {
+		if !k.keys[string(del.Key)] {
+			errs[i] = common.ErrKeyNotFound
+		}
+		delete(k.keys, string(del.Key))
+	}
+	return errs
+}
+
+func TestMultiDelete(t *testing.T) {
+	var l1batches, l2batches []int
+
+	// foo is only in L2, which still counts as deleted. bar is nowhere.
+	l1 := keysHandler{keys: map[string]bool{"baz": true}, batches: &l1batches}
+	l2 := keysHandler{keys: map[string]bool{"foo": true, "baz": true}, batches: &l2batches}
+
+	buf := new(bytes.Buffer)
+	w := bufio.NewWriter(buf)
+	o := orcas.L1L2(l1, l2, binprot.NewBinaryResponder(w))
+
+	req := common.MultiDeleteRequest{Deletes: []common.DeleteRequest{
+		{Key: []byte("foo"), Opaque: 0, Quiet: true},
+		{Key: []byte("bar"), Opaque: 1, Quiet: true},
+		{Key: []byte("baz"), Opaque: 2},
+	}}
+
+	if err := orcas.MultiDelete(o, req); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+
+	if len(l2batches) != 1 || l2batches[0] != 3 {
+		t.Fatalf("Expected L2 to get one batch of 3, got %v", l2batches)
+	}
+	if len(l1batches) != 1 || l1batches[0] != 2 {
+		t.Fatalf("Expected L1 to get one batch of the 2 keys L2 had, got %v", l1batches)
+	}
+
+	// Only the quiet miss and the final non-quiet delete are answered
+	r := bufio.NewReader(buf)
+	for _, expected := range []struct {
+		opaque uint32
+		err    error
+	}{{1, common.ErrKeyNotFound}, {2, nil}} {
+		res, err := binprot.ReadResponseHeader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Discard(int(res.TotalBodyLength))
+
+		if res.OpaqueToken != expected.opaque || !errors.Is(binprot.DecodeError(res), expected.err) {
+			t.Fatalf("Expected a response for %d with error %v, got %+v", expected.opaque, expected.err, res)
+		}
+	}
+	if r.Buffered() != 0 {
+		t.Fatalf("Expected no more responses, got %d more bytes", r.Buffered())
+	}
+}
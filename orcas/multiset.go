@@ -0,0 +1,278 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"context"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/protocol"
+	"github.com/netflix/rend/timer"
+)
+
+// MultiSetter is implemented by orchestrators that can process a batch of pipelined sets together,
+// typically by handing the whole batch to their handlers so it costs one backend round trip.
+//
+// Each set in the batch is responded to individually and in order, exactly as if it were done by
+// Set. Application errors for single sets are responded to by the orchestrator itself, since their
+// responses need to be in order with the others. Only an error that should end the connection is
+// returned.
+type MultiSetter interface {
+	MultiSet(req common.MultiSetRequest) error
+}
+
+// MultiSetterV2 is the context-aware form of MultiSetter for OrcaV2 implementations.
+type MultiSetterV2 interface {
+	MultiSet(ctx context.Context, req common.MultiSetRequest) error
+}
+
+// MultiSet processes all of the sets in req with o. Orchestrators that don't implement MultiSetter
+// get the sets one at a time.
+func MultiSet(o Orca, req common.MultiSetRequest) error {
+	if ms, ok := o.(MultiSetter); ok {
+		return ms.MultiSet(req)
+	}
+
+	for _, set := range req.Sets {
+		if err := o.Set(set); err != nil {
+			if !common.IsAppError(err) {
+				return err
+			}
+			o.Error(set, common.RequestSet, err)
+		}
+	}
+
+	return nil
+}
+
+// MultiSetV2 is the OrcaV2 counterpart of MultiSet.
+func MultiSetV2(ctx context.Context, o OrcaV2, req common.MultiSetRequest) error {
+	if ms, ok := o.(MultiSetterV2); ok {
+		return ms.MultiSet(ctx, req)
+	}
+
+	for _, set := range req.Sets {
+		if err := o.Set(ctx, set); err != nil {
+			if !common.IsAppError(err) {
+				return err
+			}
+			o.Error(ctx, set, common.RequestSet, err)
+		}
+	}
+
+	return nil
+}
+
+// multiSetL1 does the sets in req against l1 with the usual set metrics. errs holds the errors
+// already known for each set, e.g. from L2, and sets that already failed are not attempted at all.
+func multiSetL1(l1 handlers.Handler, req common.MultiSetRequest, errs []error) []error {
+	var pending common.MultiSetRequest
+	var idx []int
+
+	for i, set := range req.Sets {
+		if errs[i] == nil {
+			pending.Sets = append(pending.Sets, set)
+			idx = append(idx, i)
+		}
+	}
+
+	if len(pending.Sets) == 0 {
+		return errs
+	}
+
+	metrics.IncCounterBy(MetricCmdSetL1, uint64(len(pending.Sets)))
+	start := timer.Now()
+
+	l1errs := handlers.MultiSet(l1, pending)
+
+	metrics.ObserveHist(HistSetL1, timer.Since(start))
+
+	for j, err := range l1errs {
+		if err != nil {
+			metrics.IncCounter(MetricCmdSetErrorsL1)
+		} else {
+			metrics.IncCounter(MetricCmdSetSuccessL1)
+		}
+		errs[idx[j]] = err
+	}
+
+	return errs
+}
+
+// respondMultiSet answers every set in req in order, given the outcome of each. It stops at the
+// first error that isn't an application error and returns it.
+func respondMultiSet(res protocol.Responder, req common.MultiSetRequest, errs []error) error {
+	for i, set := range req.Sets {
+		if errs[i] == nil {
+			metrics.IncCounter(MetricCmdSetSuccess)
+			if err := res.Set(set.Opaque, set.Quiet); err != nil {
+				return err
+			}
+			continue
+		}
+
+		metrics.IncCounter(MetricCmdSetErrors)
+		if !common.IsAppError(errs[i]) {
+			return errs[i]
+		}
+		res.Error(set.Opaque, common.RequestSet, errs[i], set.Quiet)
+	}
+
+	return nil
+}
+
+func (l *L1OnlyOrca) MultiSet(req common.MultiSetRequest) error {
+	errs := multiSetL1(l.l1, req, make([]error, len(req.Sets)))
+	return respondMultiSet(l.res, req, errs)
+}
+
+// As with Set, the items are written to L2 first and only the ones L2 accepted are written to L1.
+func (l *L1L2Orca) MultiSet(req common.MultiSetRequest) error {
+	errs := multiSetL2(l.l2, req)
+	errs = multiSetL1(l.l1, req, errs)
+	return respondMultiSet(l.res, req, errs)
+}
+
+// As with Set, the items are written to L2 first and any of them that L2 accepted are replaced in
+// L1 if they are there.
+func (l *L1L2BatchOrca) MultiSet(req common.MultiSetRequest) error {
+	errs := multiSetL2(l.l2, req)
+
+	for i, set := range req.Sets {
+		if errs[i] != nil {
+			continue
+		}
+
+		metrics.IncCounter(MetricCmdSetReplaceL1)
+		start := timer.Now()
+
+		err := l.l1.Replace(set)
+
+		metrics.ObserveHist(HistReplaceL1, timer.Since(start))
+
+		if err == nil {
+			metrics.IncCounter(MetricCmdSetReplaceStoredL1)
+		} else if common.ClassOf(err) == common.ClassNotFound {
+			metrics.IncCounter(MetricCmdSetReplaceNotStoredL1)
+		} else {
+			metrics.IncCounter(MetricCmdSetReplaceErrorsL1)
+			errs[i] = err
+		}
+	}
+
+	return respondMultiSet(l.res, req, errs)
+}
+
+func multiSetL2(l2 handlers.Handler, req common.MultiSetRequest) []error {
+	metrics.IncCounterBy(MetricCmdSetL2, uint64(len(req.Sets)))
+	start := timer.Now()
+
+	errs := handlers.MultiSet(l2, req)
+
+	metrics.ObserveHist(HistSetL2, timer.Since(start))
+
+	for _, err := range errs {
+		if err != nil {
+			metrics.IncCounter(MetricCmdSetErrorsL2)
+		} else {
+			metrics.IncCounter(MetricCmdSetSuccessL2)
+		}
+	}
+
+	return errs
+}
+
+func (o *budgetOrca) MultiSet(req common.MultiSetRequest) error {
+	o.b.start()
+	return MultiSet(o.Orca, req)
+}
+
+// A batch is allowed or rejected as a whole, but each set in it is still answered on its own
+func (o *modedOrca) MultiSet(req common.MultiSetRequest) error {
+	if err := o.write(); err != nil {
+		for _, set := range req.Sets {
+			o.Orca.Error(set, common.RequestSet, err)
+		}
+		return nil
+	}
+	return MultiSet(o.Orca, req)
+}
+
+func (o *canaryOrca) MultiSet(req common.MultiSetRequest) error {
+	var key []byte
+	if len(req.Sets) > 0 {
+		key = req.Sets[0].Key
+	}
+	arm, start := o.pick(key)
+	return o.done(arm, start, MultiSet(o.arms[arm], req))
+}
+
+// A batch is classified by its first key, the same as a multi-key get
+func (p *prioritizedOrca) MultiSet(req common.MultiSetRequest) error {
+	var key []byte
+	if len(req.Sets) > 0 {
+		key = req.Sets[0].Key
+	}
+	p.acquire(key)
+	defer p.s.Release()
+	return MultiSet(p.Orca, req)
+}
+
+func (b boundHandler) MultiSet(cmd common.MultiSetRequest) []error {
+	defer b.enter()()
+	return handlers.MultiSetV2(b.ctx.get(), b.h, cmd)
+}
+
+func (c *v2Orca) MultiSet(ctx context.Context, req common.MultiSetRequest) error {
+	defer c.ctx.enter(ctx)()
+	return MultiSet(c.o, req)
+}
+
+func (v v1Orca) MultiSet(req common.MultiSetRequest) error {
+	return MultiSetV2(v.ctx, v.o, req)
+}
+
+func (o *tombstoneOrca) MultiSet(req common.MultiSetRequest) error {
+	return MultiSet(o.Orca, req)
+}
+
+func (h *tombstoneHandler) MultiSet(cmd common.MultiSetRequest) []error {
+	return handlers.MultiSet(h.Handler, cmd)
+}
+
+func (o *admissionOrca) MultiSet(req common.MultiSetRequest) error {
+	return MultiSet(o.Orca, req)
+}
+
+func (h *admissionHandler) MultiSet(cmd common.MultiSetRequest) []error {
+	return handlers.MultiSet(h.Handler, cmd)
+}
+
+// Batches with keys of a tenant are done one set at a time so each can be checked against the
+// quota, and answered in order whether or not it fits
+func (o *quotaOrca) MultiSet(req common.MultiSetRequest) error {
+	for _, set := range req.Sets {
+		if o.t.Tracks(set.Key) {
+			return MultiSet(quotaSingle{o}, req)
+		}
+	}
+	return MultiSet(o.Orca, req)
+}
+
+func (h *quietHandler) MultiSet(cmd common.MultiSetRequest) []error {
+	return handlers.MultiSet(h.Handler, cmd)
+}
@@ -0,0 +1,95 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol/textprot"
+)
+
+// batchHandler records the size of every batch it gets and rejects the key "bad"
+type batchHandler struct {
+	handlers.Handler
+	batches *[]int
+}
+
+func (b batchHandler) MultiSet(cmd common.MultiSetRequest) []error {
+	*b.batches = append(*b.batches, len(cmd.Sets))
+
+	errs := make([]error, len(cmd.Sets))
+	for i, set := range cmd.Sets {
+		if string(set.Key) == "bad" {
+			errs[i] = common.ErrKeyExists
+		}
+	}
+	return errs
+}
+
+func TestMultiSet(t *testing.T) {
+	var l1batches, l2batches []int
+
+	buf := new(bytes.Buffer)
+	w := bufio.NewWriter(buf)
+
+	// Built the same way the server builds the orca for a connection
+	l1 := handlers.V2(batchHandler{batches: &l1batches})
+	l2 := handlers.V2(batchHandler{batches: &l2batches})
+	o := orcas.V1(context.Background(), orcas.ConstV2(orcas.L1L2)(l1, l2, textprot.NewTextResponder(w)))
+
+	req := common.MultiSetRequest{Sets: []common.SetRequest{
+		{Key: []byte("foo"), Quiet: true},
+		{Key: []byte("bad"), Quiet: true},
+		{Key: []byte("bar")},
+	}}
+
+	if err := orcas.MultiSet(o, req); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+
+	if len(l2batches) != 1 || l2batches[0] != 3 {
+		t.Fatalf("Expected L2 to get one batch of 3, got %v", l2batches)
+	}
+	if len(l1batches) != 1 || l1batches[0] != 2 {
+		t.Fatalf("Expected L1 to get one batch of the 2 sets L2 accepted, got %v", l1batches)
+	}
+
+	// Quiet sets are noreply in the text protocol, so only the last one is answered, failed or not
+	if buf.String() != "STORED\r\n" {
+		t.Fatalf("Unexpected responses %q", buf.String())
+	}
+}
+
+func TestMultiSetFallback(t *testing.T) {
+	var ops []string
+
+	o := orcas.L1Only(opHandler{ops: &ops}, nil, textprot.NewTextResponder(bufio.NewWriter(new(bytes.Buffer))))
+
+	req := common.MultiSetRequest{Sets: []common.SetRequest{{Key: []byte("foo")}, {Key: []byte("bar")}}}
+	if err := orcas.MultiSet(o, req); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ops) != 2 {
+		t.Fatalf("Expected a handler without MultiSet to get 2 sets, got %v", ops)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/priority"
+	"github.com/netflix/rend/protocol"
+)
+
+// Prioritized wraps an orchestrator so every operation that touches a backend holds a slot from s
+// for its duration. Each listener can use its own classifier, e.g. to make everything arriving on
+// a port used by batch systems low priority.
+func Prioritized(oc OrcaConst, s *priority.Scheduler, c priority.Classifier) OrcaConst {
+	return func(l1, l2 handlers.Handler, res protocol.Responder) Orca {
+		return &prioritizedOrca{
+			Orca: oc(l1, l2, res),
+			s:    s,
+			c:    c,
+		}
+	}
+}
+
+type prioritizedOrca struct {
+	Orca
+	s *priority.Scheduler
+	c priority.Classifier
+}
+
+func (p *prioritizedOrca) acquire(key []byte) {
+	p.s.Acquire(p.c.Classify(key))
+}
+
+func (p *prioritizedOrca) Set(req common.SetRequest) error {
+	p.acquire(req.Key)
+	defer p.s.Release()
+	return p.Orca.Set(req)
+}
+
+func (p *prioritizedOrca) Add(req common.SetRequest) error {
+	p.acquire(req.Key)
+	defer p.s.Release()
+	return p.Orca.Add(req)
+}
+
+func (p *prioritizedOrca) Replace(req common.SetRequest) error {
+	p.acquire(req.Key)
+	defer p.s.Release()
+	return p.Orca.Replace(req)
+}
+
+func (p *prioritizedOrca) Append(req common.SetRequest) error {
+	p.acquire(req.Key)
+	defer p.s.Release()
+	return p.Orca.Append(req)
+}
+
+func (p *prioritizedOrca) Prepend(req common.SetRequest) error {
+	p.acquire(req.Key)
+	defer p.s.Release()
+	return p.Orca.Prepend(req)
+}
+
+func (p *prioritizedOrca) Delete(req common.DeleteRequest) error {
+	p.acquire(req.Key)
+	defer p.s.Release()
+	return p.Orca.Delete(req)
+}
+
+func (p *prioritizedOrca) Touch(req common.TouchRequest) error {
+	p.acquire(req.Key)
+	defer p.s.Release()
+	return p.Orca.Touch(req)
+}
+
+// A multi-key get is classified by its first key
+func (p *prioritizedOrca) Get(req common.GetRequest) error {
+	var key []byte
+	if len(req.Keys) > 0 {
+		key = req.Keys[0]
+	}
+	p.acquire(key)
+	defer p.s.Release()
+	return p.Orca.Get(req)
+}
+
+func (p *prioritizedOrca) GetE(req common.GetRequest) error {
+	var key []byte
+	if len(req.Keys) > 0 {
+		key = req.Keys[0]
+	}
+	p.acquire(key)
+	defer p.s.Release()
+	return p.Orca.GetE(req)
+}
+
+func (p *prioritizedOrca) Gat(req common.GATRequest) error {
+	p.acquire(req.Key)
+	defer p.s.Release()
+	return p.Orca.Gat(req)
+}
@@ -0,0 +1,196 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"fmt"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/protocol"
+)
+
+var (
+	MetricCmdGetErrorMissesL1 = metrics.AddCounter("cmd_get_error_misses_l1", nil)
+	MetricCmdGetErrorMissesL2 = metrics.AddCounter("cmd_get_error_misses_l2", nil)
+)
+
+// QuietGetErrors is how the quiet keys of a get are answered when a backend fails before getting
+// to them. Quiet keys are only answered on a hit, so to a client a miss is the absence of an
+// answer, and an error in their place is often unexpected.
+type QuietGetErrors int
+
+const (
+	// QuietGetError ends the get with the error, like for any other get. Clients never mistake a
+	// failure for a miss, at the cost of failing the whole get.
+	QuietGetError QuietGetErrors = iota
+	// QuietGetMiss answers the quiet keys as misses, so the get succeeds as long as the keys the
+	// backend didn't get to are all quiet. An L1 that fails this way is read through to L2 like
+	// for any miss.
+	QuietGetMiss
+)
+
+func (q QuietGetErrors) String() string {
+	switch q {
+	case QuietGetError:
+		return "error"
+	case QuietGetMiss:
+		return "miss"
+	}
+	return "unknown"
+}
+
+// ParseQuietGetErrors is the inverse of QuietGetErrors.String
+func ParseQuietGetErrors(s string) (QuietGetErrors, error) {
+	switch s {
+	case "error":
+		return QuietGetError, nil
+	case "miss":
+		return QuietGetMiss, nil
+	}
+	return QuietGetError, fmt.Errorf("Unknown quiet get error behavior %q", s)
+}
+
+// QuietGetMisses wraps an orchestrator so a backend error during a get answers the quiet keys it
+// hadn't answered yet as misses, up to the first key that isn't quiet, which still gets the error.
+// Keys answered this way are counted in cmd_get_error_misses_l1 and cmd_get_error_misses_l2,
+// and in the usual miss metrics as well. Only application errors are turned into misses. A fatal
+// error, like a broken backend connection or a timeout, still fails the get and ends the client's
+// connection too, since every request after it would fail the same way.
+func QuietGetMisses(oc OrcaConst) OrcaConst {
+	return func(l1, l2 handlers.Handler, res protocol.Responder) Orca {
+		if l1 != nil {
+			l1 = &quietHandler{Handler: l1, misses: MetricCmdGetErrorMissesL1}
+		}
+		if l2 != nil {
+			l2 = &quietHandler{Handler: l2, misses: MetricCmdGetErrorMissesL2}
+		}
+		return oc(l1, l2, res)
+	}
+}
+
+type quietHandler struct {
+	handlers.Handler
+	misses uint32
+}
+
+// answerMisses answers the keys of cmd from the from-th on as misses with f, if err is an application
+// error and they are quiet. Fatal errors, like a broken connection or a timeout, are returned as
+// they are, since the backend connection can't be used for the rest of the get or anything after
+// it. It returns the error the get ends with, if any.
+func (h *quietHandler) answerMisses(cmd common.GetRequest, from int, err error, f func(i int) error) error {
+	if !common.IsAppError(err) {
+		return err
+	}
+
+	for i := from; i < len(cmd.Keys); i++ {
+		if i >= len(cmd.Quiet) || !cmd.Quiet[i] {
+			return err
+		}
+		metrics.IncCounter(h.misses)
+		if ferr := f(i); ferr != nil {
+			return ferr
+		}
+	}
+	return nil
+}
+
+func (h *quietHandler) opaque(cmd common.GetRequest, i int) uint32 {
+	if i < len(cmd.Opaques) {
+		return cmd.Opaques[i]
+	}
+	return 0
+}
+
+func (h *quietHandler) miss(cmd common.GetRequest, i int) common.GetResponse {
+	return common.GetResponse{Key: cmd.Keys[i], Opaque: h.opaque(cmd, i), Quiet: true, Miss: true}
+}
+
+func (h *quietHandler) GetEach(cmd common.GetRequest, f func(common.GetResponse) error) error {
+	n := 0
+	var ferr error
+	err := handlers.GetEach(h.Handler, cmd, func(res common.GetResponse) error {
+		n++
+		ferr = f(res)
+		return ferr
+	})
+	if err == nil || ferr != nil {
+		return err
+	}
+	return h.answerMisses(cmd, n, err, func(i int) error { return f(h.miss(cmd, i)) })
+}
+
+func (h *quietHandler) GetEEach(cmd common.GetRequest, f func(common.GetEResponse) error) error {
+	n := 0
+	var ferr error
+	err := handlers.GetEEach(h.Handler, cmd, func(res common.GetEResponse) error {
+		n++
+		ferr = f(res)
+		return ferr
+	})
+	if err == nil || ferr != nil {
+		return err
+	}
+	return h.answerMisses(cmd, n, err, func(i int) error {
+		return f(common.GetEResponse{Key: cmd.Keys[i], Opaque: h.opaque(cmd, i), Quiet: true, Miss: true})
+	})
+}
+
+// The channels are filled from GetEach rather than the handler's own channels, since an error on
+// those can arrive before the responses still buffered ahead of it, and which keys were answered
+// wouldn't be known. The data is copied since GetEach only lends it until its callback returns.
+
+func (h *quietHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	dataOut := make(chan common.GetResponse, len(cmd.Keys))
+	errorOut := make(chan error, 1)
+
+	go func() {
+		defer close(dataOut)
+		defer close(errorOut)
+
+		err := h.GetEach(cmd, func(res common.GetResponse) error {
+			res.Data = append([]byte(nil), res.Data...)
+			dataOut <- res
+			return nil
+		})
+		if err != nil {
+			errorOut <- err
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+func (h *quietHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	dataOut := make(chan common.GetEResponse, len(cmd.Keys))
+	errorOut := make(chan error, 1)
+
+	go func() {
+		defer close(dataOut)
+		defer close(errorOut)
+
+		err := h.GetEEach(cmd, func(res common.GetEResponse) error {
+			res.Data = append([]byte(nil), res.Data...)
+			dataOut <- res
+			return nil
+		})
+		if err != nil {
+			errorOut <- err
+		}
+	}()
+
+	return dataOut, errorOut
+}
@@ -0,0 +1,152 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/inmem"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol"
+	"github.com/netflix/rend/protocol/binprot"
+)
+
+// brokenGets answers gets from its handler up to the first key named fail, and fails there with err
+type brokenGets struct {
+	*inmem.Handler
+	err error
+}
+
+func (h brokenGets) until(cmd common.GetRequest) (common.GetRequest, bool) {
+	for i, k := range cmd.Keys {
+		if string(k) == "fail" {
+			return common.GetRequest{Keys: cmd.Keys[:i], Opaques: cmd.Opaques[:i], Quiet: cmd.Quiet[:i]}, true
+		}
+	}
+	return cmd, false
+}
+
+func (h brokenGets) GetEach(cmd common.GetRequest, f func(common.GetResponse) error) error {
+	cmd, broken := h.until(cmd)
+	if err := h.Handler.GetEach(cmd, f); err != nil || !broken {
+		return err
+	}
+	return h.err
+}
+
+func (h brokenGets) GetEEach(cmd common.GetRequest, f func(common.GetEResponse) error) error {
+	cmd, broken := h.until(cmd)
+	if err := h.Handler.GetEEach(cmd, f); err != nil || !broken {
+		return err
+	}
+	return h.err
+}
+
+func quietGet(keys []string, quiet []bool) common.GetRequest {
+	cmd := common.GetRequest{Quiet: quiet}
+	for i, k := range keys {
+		cmd.Keys = append(cmd.Keys, []byte(k))
+		cmd.Opaques = append(cmd.Opaques, uint32(i))
+	}
+	return cmd
+}
+
+func TestQuietGetMisses(t *testing.T) {
+	errBackend := common.ServerError("backend failed")
+	inner, _ := inmem.New()
+	inner.Set(common.SetRequest{Key: []byte("a"), Data: []byte("a")})
+
+	var l1 handlers.Handler
+	orcas.QuietGetMisses(func(h1, h2 handlers.Handler, res protocol.Responder) orcas.Orca {
+		l1 = h1
+		return nil
+	})(brokenGets{Handler: inner.(*inmem.Handler), err: errBackend}, nil, nil)
+
+	get := func(cmd common.GetRequest) ([]common.GetResponse, error) {
+		var got []common.GetResponse
+		err := handlers.GetEach(l1, cmd, func(res common.GetResponse) error {
+			got = append(got, res)
+			return nil
+		})
+		return got, err
+	}
+
+	t.Run("quiet", func(t *testing.T) {
+		got, err := get(quietGet([]string{"a", "fail", "b"}, []bool{true, true, true}))
+		if err != nil {
+			t.Fatalf("Expected the failure to be answered as misses, got %v", err)
+		}
+		if len(got) != 3 || got[0].Miss || !got[1].Miss || !got[2].Miss || got[2].Opaque != 2 {
+			t.Fatalf("Unexpected responses %+v", got)
+		}
+	})
+
+	t.Run("not quiet", func(t *testing.T) {
+		got, err := get(quietGet([]string{"a", "fail", "b"}, []bool{true, true, false}))
+		if err != errBackend {
+			t.Fatalf("Expected the key that isn't quiet to get the error, got %v", err)
+		}
+		if len(got) != 2 {
+			t.Fatalf("Expected the quiet keys before it to be answered, got %+v", got)
+		}
+	})
+
+	t.Run("channels", func(t *testing.T) {
+		resChan, errChan := l1.Get(quietGet([]string{"fail", "a"}, []bool{true, true}))
+		var got []common.GetResponse
+		err := handlers.DrainGet(resChan, errChan, func(res common.GetResponse) error {
+			got = append(got, res)
+			return nil
+		})
+		// keys after the failure aren't read at all, even if they're there
+		if err != nil || len(got) != 2 || !got[0].Miss || !got[1].Miss {
+			t.Fatalf("Expected two misses and no error, got %+v and %v", got, err)
+		}
+	})
+
+	t.Run("fatal", func(t *testing.T) {
+		fatal := errors.New("connection reset")
+		orcas.QuietGetMisses(func(h1, h2 handlers.Handler, res protocol.Responder) orcas.Orca {
+			l1 = h1
+			return nil
+		})(brokenGets{Handler: inner.(*inmem.Handler), err: fatal}, nil, nil)
+
+		if _, err := get(quietGet([]string{"fail"}, []bool{true})); err != fatal {
+			t.Fatalf("Expected an error that breaks the connection to be returned, got %v", err)
+		}
+	})
+
+	t.Run("read through", func(t *testing.T) {
+		l2, _ := inmem.New()
+		l2.Set(common.SetRequest{Key: []byte("fail"), Data: []byte("from l2")})
+
+		buf := new(bytes.Buffer)
+		w := bufio.NewWriter(buf)
+		o := orcas.QuietGetMisses(orcas.L1L2)(brokenGets{Handler: inner.(*inmem.Handler), err: errBackend}, l2, binprot.NewBinaryResponder(w))
+
+		if err := o.Get(quietGet([]string{"fail"}, []bool{true})); err != nil {
+			t.Fatalf("Expected L1's failure to be read through to L2, got %v", err)
+		}
+		w.Flush()
+		if !bytes.Contains(buf.Bytes(), []byte("from l2")) {
+			t.Fatalf("Expected the value from L2, got %q", buf.Bytes())
+		}
+	})
+}
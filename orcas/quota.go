@@ -0,0 +1,128 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"errors"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/protocol"
+	"github.com/netflix/rend/quota"
+)
+
+var MetricQuotaEvictErrors = metrics.AddCounter("quota_evict_errors", nil)
+
+// Quotas wraps an orchestrator so writes to the prefixes of a tenant in t are checked against its
+// quota first, and usage is updated once they're done. The bytes of an admitted write are held
+// against the quota while it's in flight, so concurrent writes can't overshoot it. Keys evicted to
+// make room are deleted from both tiers before the write. The deletes go straight to the handlers,
+// so they aren't seen by anything wrapped inside, like peer invalidation.
+func Quotas(oc OrcaConst, t *quota.Tracker) OrcaConst {
+	return func(l1, l2 handlers.Handler, res protocol.Responder) Orca {
+		return &quotaOrca{
+			Orca: oc(l1, l2, res),
+			t:    t,
+			l1:   l1,
+			l2:   l2,
+		}
+	}
+}
+
+type quotaOrca struct {
+	Orca
+	t      *quota.Tracker
+	l1, l2 handlers.Handler
+}
+
+// write does a write of req with f if the tenant of its key has room for it
+func (o *quotaOrca) write(req common.SetRequest, appending bool, f func() error) error {
+	evict, err := o.t.Admit(req.Key, len(req.Data), appending)
+	if err != nil {
+		return err
+	}
+	for _, key := range evict {
+		o.evict(key)
+	}
+
+	if err := f(); err != nil {
+		o.t.Released(req.Key, len(req.Data), appending)
+		return err
+	}
+	o.t.Stored(req.Key, len(req.Data), appending, req.Exptime)
+	return nil
+}
+
+func (o *quotaOrca) evict(key []byte) {
+	for _, h := range []handlers.Handler{o.l1, o.l2} {
+		if h == nil {
+			continue
+		}
+		if err := h.Delete(common.DeleteRequest{Key: key}); err != nil && !errors.Is(err, common.ErrKeyNotFound) {
+			metrics.IncCounter(MetricQuotaEvictErrors)
+		}
+	}
+}
+
+func (o *quotaOrca) Set(req common.SetRequest) error {
+	return o.write(req, false, func() error { return o.Orca.Set(req) })
+}
+
+func (o *quotaOrca) Add(req common.SetRequest) error {
+	return o.write(req, false, func() error { return o.Orca.Add(req) })
+}
+
+func (o *quotaOrca) Replace(req common.SetRequest) error {
+	return o.write(req, false, func() error { return o.Orca.Replace(req) })
+}
+
+func (o *quotaOrca) Append(req common.SetRequest) error {
+	return o.write(req, true, func() error { return o.Orca.Append(req) })
+}
+
+func (o *quotaOrca) Prepend(req common.SetRequest) error {
+	return o.write(req, true, func() error { return o.Orca.Prepend(req) })
+}
+
+func (o *quotaOrca) Delete(req common.DeleteRequest) error {
+	err := o.Orca.Delete(req)
+	if err == nil || errors.Is(err, common.ErrKeyNotFound) {
+		o.t.Deleted(req.Key)
+	}
+	return err
+}
+
+func (o *quotaOrca) Touch(req common.TouchRequest) error {
+	err := o.Orca.Touch(req)
+	if err == nil {
+		o.t.Touched(req.Key, req.Exptime)
+	}
+	return err
+}
+
+func (o *quotaOrca) Gat(req common.GATRequest) error {
+	err := o.Orca.Gat(req)
+	if err == nil {
+		o.t.Touched(req.Key, req.Exptime)
+	}
+	return err
+}
+
+// quotaSingle only has the methods of Orca, so MultiSet and MultiDelete fall back to doing each
+// operation in a batch on its own through the quotaOrca it has
+type quotaSingle struct {
+	Orca
+}
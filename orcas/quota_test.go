@@ -0,0 +1,127 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/inmem"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol"
+	"github.com/netflix/rend/protocol/textprot"
+	"github.com/netflix/rend/quota"
+)
+
+func TestQuotas(t *testing.T) {
+	l1, _ := inmem.New()
+	tracker, err := quota.New([]quota.Quota{
+		{Tenant: "a", Prefixes: []string{"quota:a:"}, Bytes: 100},
+		{Tenant: "b", Prefixes: []string{"quota:b:"}, Bytes: 100, Mode: quota.ModeEvict},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	w := bufio.NewWriter(buf)
+	o := orcas.Quotas(func(l1, l2 handlers.Handler, res protocol.Responder) orcas.Orca {
+		return orcas.L1Only(l1, l2, res)
+	}, tracker)(l1, nil, textprot.NewTextResponder(w))
+
+	// every key is 9 bytes, so each of these counts for 40
+	set := func(key string) error {
+		return o.Set(common.SetRequest{Key: []byte(key), Data: make([]byte, 31)})
+	}
+	exists := func(key string) bool {
+		hit := false
+		handlers.GetEach(l1, common.GetRequest{Keys: [][]byte{[]byte(key)}, Opaques: []uint32{0}, Quiet: []bool{false}}, func(res common.GetResponse) error {
+			hit = !res.Miss
+			return nil
+		})
+		return hit
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		for _, k := range []string{"quota:a:1", "quota:a:2"} {
+			if err := set(k); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := set("quota:a:3"); !errors.Is(err, quota.ErrExceeded) {
+			t.Fatalf("Expected the write over the quota to be rejected, got %v", err)
+		}
+		if exists("quota:a:3") {
+			t.Fatal("Rejected write was stored")
+		}
+
+		// overwriting a key only counts the difference
+		if err := set("quota:a:2"); err != nil {
+			t.Fatalf("Expected an overwrite to fit, got %v", err)
+		}
+
+		if err := o.Delete(common.DeleteRequest{Key: []byte("quota:a:1")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := set("quota:a:3"); err != nil {
+			t.Fatalf("Expected the write to fit after a delete, got %v", err)
+		}
+	})
+
+	t.Run("evict", func(t *testing.T) {
+		for _, k := range []string{"quota:b:1", "quota:b:2", "quota:b:3"} {
+			if err := set(k); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if exists("quota:b:1") || !exists("quota:b:2") || !exists("quota:b:3") {
+			t.Fatal("Expected only the oldest key to be evicted")
+		}
+
+		u := tracker.Usage()[1]
+		if u.Used != 80 || u.Keys != 2 || u.Evicted != 1 {
+			t.Fatalf("Unexpected usage after evicting: %+v", u)
+		}
+	})
+
+	t.Run("untracked", func(t *testing.T) {
+		if err := o.Set(common.SetRequest{Key: []byte("quota:c"), Data: make([]byte, 1000)}); err != nil {
+			t.Fatalf("Expected keys outside every quota to be written, got %v", err)
+		}
+	})
+
+	t.Run("multiset", func(t *testing.T) {
+		buf.Reset()
+		err := orcas.MultiSet(o, common.MultiSetRequest{Sets: []common.SetRequest{
+			{Key: []byte("quota:c"), Data: []byte("c")},
+			{Key: []byte("quota:a:4"), Data: make([]byte, 31)},
+			{Key: []byte("quota:a:2"), Data: []byte("a")},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Flush()
+
+		expected := "STORED\r\nSERVER_ERROR storage quota exceeded\r\nSTORED\r\n"
+		if got := buf.String(); got != expected {
+			t.Fatalf("Expected each set to be answered in order, got %q", got)
+		}
+	})
+}
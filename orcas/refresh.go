@@ -0,0 +1,290 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/clock"
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/protocol"
+	"github.com/netflix/rend/timer"
+	"github.com/netflix/rend/tombstone"
+)
+
+var (
+	MetricRefreshTriggered = metrics.AddCounter("refresh_ahead_triggered", nil)
+	MetricRefreshInflight  = metrics.AddCounter("refresh_ahead_inflight", nil)
+	MetricRefreshDropped   = metrics.AddCounter("refresh_ahead_dropped", nil)
+	MetricRefreshSuccess   = metrics.AddCounter("refresh_ahead_success", nil)
+	MetricRefreshMissesL2  = metrics.AddCounter("refresh_ahead_misses_l2", nil)
+	MetricRefreshErrors    = metrics.AddCounter("refresh_ahead_errors", nil)
+)
+
+// the number of keys waiting to be refreshed before more are dropped
+const refreshQueueSize = 10000
+
+// Refresher refreshes L1 entries from L2 in the background. It is shared by all connections.
+type Refresher struct {
+	l1, l2    handlers.HandlerConst
+	threshold int64
+	maxProb   float64
+	queue     chan []byte
+
+	lock    sync.Mutex
+	pending map[string]struct{}
+
+	tombstones *tombstone.Set
+}
+
+// NewRefresher creates a Refresher with the given number of workers, each with its own L1 and L2
+// handlers. Hits with less than threshold left before they expire may be refreshed, with a chance
+// that rises linearly from 0 at the threshold to maxProbability at expiry. Spreading refreshes out
+// this way means a popular key is usually refreshed once, a bit early, instead of every client
+// missing on it at the same moment.
+func NewRefresher(l1, l2 handlers.HandlerConst, threshold time.Duration, maxProbability float64, workers int) *Refresher {
+	r := &Refresher{
+		l1:        l1,
+		l2:        l2,
+		threshold: int64(threshold / time.Second),
+		maxProb:   maxProbability,
+		queue:     make(chan []byte, refreshQueueSize),
+		pending:   make(map[string]struct{}),
+	}
+
+	for i := 0; i < workers; i++ {
+		go r.worker()
+	}
+
+	return r
+}
+
+// UseTombstones makes refreshes leave keys alone that are deleted while they're being refreshed.
+// It must be called before any refreshes are triggered.
+func (r *Refresher) UseTombstones(t *tombstone.Set) {
+	r.tombstones = t
+}
+
+// RefreshAhead wraps an orchestrator so that L1 hits close to expiring are refreshed by r. The L1
+// handler must support GetE, since that is how expiration times are found.
+func RefreshAhead(oc OrcaConst, r *Refresher) OrcaConst {
+	return func(l1, l2 handlers.Handler, res protocol.Responder) Orca {
+		return oc(refreshingHandler{Handler: l1, r: r}, l2, res)
+	}
+}
+
+// Consider decides if the entry for key, which expires at the given unix time, should be
+// refreshed, and schedules it if so. An exptime of 0 never expires.
+func (r *Refresher) Consider(key []byte, exptime uint32) {
+	if exptime == 0 {
+		return
+	}
+
+	remaining := int64(exptime) - int64(clock.Unix())
+	if remaining >= r.threshold {
+		return
+	}
+
+	p := r.maxProb
+	if remaining > 0 {
+		p *= 1 - float64(remaining)/float64(r.threshold)
+	}
+
+	if rand.Float64() < p {
+		r.Trigger(key)
+	}
+}
+
+// Trigger schedules key to be refreshed unless a refresh for it is already pending. It never
+// blocks; if the queue is full the refresh is dropped.
+func (r *Refresher) Trigger(key []byte) {
+	r.lock.Lock()
+	if _, ok := r.pending[string(key)]; ok {
+		r.lock.Unlock()
+		metrics.IncCounter(MetricRefreshInflight)
+		return
+	}
+	r.pending[string(key)] = struct{}{}
+	r.lock.Unlock()
+
+	select {
+	case r.queue <- append([]byte(nil), key...):
+		metrics.IncCounter(MetricRefreshTriggered)
+	default:
+		r.done(key)
+		metrics.IncCounter(MetricRefreshDropped)
+	}
+}
+
+func (r *Refresher) done(key []byte) {
+	r.lock.Lock()
+	delete(r.pending, string(key))
+	r.lock.Unlock()
+}
+
+func (r *Refresher) worker() {
+	var l1, l2 handlers.Handler
+
+	for key := range r.queue {
+		var err error
+		if l1 == nil {
+			l1, err = r.l1()
+		}
+		if err == nil && l2 == nil {
+			l2, err = r.l2()
+		}
+		if err == nil {
+			err = r.refresh(l1, l2, key)
+		}
+
+		r.done(key)
+
+		if err != nil {
+			log.Println("Error refreshing key ahead of expiry:", err.Error())
+			metrics.IncCounter(MetricRefreshErrors)
+
+			// start from fresh connections in case these are broken
+			if l1 != nil {
+				l1.Close()
+			}
+			if l2 != nil {
+				l2.Close()
+			}
+			l1, l2 = nil, nil
+		}
+	}
+}
+
+func (r *Refresher) refresh(l1, l2 handlers.Handler, key []byte) error {
+	start := timer.Now()
+	res, err := getEOne(l2, key)
+	if err != nil {
+		return err
+	}
+
+	if res.Miss {
+		// Nothing to refresh from. The L1 entry is left alone to expire on its own.
+		metrics.IncCounter(MetricRefreshMissesL2)
+		return nil
+	}
+
+	set := func() error {
+		return l1.Set(common.SetRequest{
+			Key:     key,
+			Flags:   res.Flags,
+			Exptime: res.Exptime,
+			Data:    res.Data,
+		})
+	}
+	if r.tombstones != nil {
+		err = r.tombstones.Guard(key, start, set, func() error {
+			return l1.Delete(common.DeleteRequest{Key: key})
+		})
+	} else {
+		err = set()
+	}
+	if err != nil {
+		return err
+	}
+
+	metrics.IncCounter(MetricRefreshSuccess)
+	return nil
+}
+
+func getEOne(h handlers.Handler, key []byte) (common.GetEResponse, error) {
+	resChan, errChan := h.GetE(common.GetRequest{
+		Keys:    [][]byte{key},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+
+	var res common.GetEResponse
+	var err error
+
+	for resChan != nil || errChan != nil {
+		select {
+		case r, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			} else {
+				res = r
+			}
+		case e, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			} else {
+				err = e
+			}
+		}
+	}
+
+	return res, err
+}
+
+// refreshingHandler serves Gets from GetE on the wrapped handler to learn when each hit expires
+type refreshingHandler struct {
+	handlers.Handler
+	r *Refresher
+}
+
+func (h refreshingHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	resChanE, errChanE := h.Handler.GetE(cmd)
+
+	dataOut := make(chan common.GetResponse)
+	errorOut := make(chan error)
+
+	go func() {
+		defer close(dataOut)
+		defer close(errorOut)
+
+		for resChanE != nil || errChanE != nil {
+			select {
+			case res, ok := <-resChanE:
+				if !ok {
+					resChanE = nil
+					continue
+				}
+
+				if !res.Miss {
+					h.r.Consider(res.Key, res.Exptime)
+				}
+
+				dataOut <- common.GetResponse{
+					Key:    res.Key,
+					Data:   res.Data,
+					Opaque: res.Opaque,
+					Flags:  res.Flags,
+					Miss:   res.Miss,
+					Quiet:  res.Quiet,
+				}
+
+			case err, ok := <-errChanE:
+				if !ok {
+					errChanE = nil
+					continue
+				}
+
+				errorOut <- err
+			}
+		}
+	}()
+
+	return dataOut, errorOut
+}
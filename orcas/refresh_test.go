@@ -0,0 +1,128 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/inmem"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol"
+)
+
+// staticL2 hits on every GetE with the same value, or fails them all if err is set
+type staticL2 struct {
+	handlers.Handler
+	data string
+	err  error
+}
+
+func (s staticL2) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	resChan := make(chan common.GetEResponse, len(cmd.Keys))
+	errChan := make(chan error, 1)
+	if s.err != nil {
+		errChan <- s.err
+		close(resChan)
+		close(errChan)
+		return resChan, errChan
+	}
+	for i, k := range cmd.Keys {
+		resChan <- common.GetEResponse{Key: k, Data: []byte(s.data), Opaque: cmd.Opaques[i]}
+	}
+	close(resChan)
+	close(errChan)
+	return resChan, errChan
+}
+
+func (s staticL2) Close() error { return nil }
+
+func getInmem(t *testing.T, key string) string {
+	h, _ := inmem.New()
+	resChan, errChan := h.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte(key)},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+	var data string
+	for res := range resChan {
+		data = string(res.Data)
+	}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestRefreshAhead(t *testing.T) {
+	l2 := func() (handlers.Handler, error) { return staticL2{data: "new"}, nil }
+
+	// A threshold this large makes any expiring hit all but certain to be refreshed
+	r := orcas.NewRefresher(inmem.New, l2, 100*365*24*time.Hour, 1, 1)
+
+	var l1 handlers.Handler
+	oc := orcas.RefreshAhead(func(h1, h2 handlers.Handler, res protocol.Responder) orcas.Orca {
+		l1 = h1
+		return nil
+	}, r)
+	h, _ := inmem.New()
+	oc(h, nil, nil)
+
+	l1.Set(common.SetRequest{Key: []byte("refresh"), Data: []byte("old"), Exptime: 60})
+	l1.Set(common.SetRequest{Key: []byte("forever"), Data: []byte("old")})
+
+	resChan, errChan := l1.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte("refresh"), []byte("forever"), []byte("missing")},
+		Opaques: []uint32{0, 1, 2},
+		Quiet:   []bool{false, false, false},
+	})
+
+	var hits, misses int
+	for resChan != nil || errChan != nil {
+		select {
+		case res, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			} else if res.Miss {
+				misses++
+			} else if string(res.Data) != "old" {
+				t.Fatalf("Expected the cached value to be served, got %q", res.Data)
+			} else {
+				hits++
+			}
+		case err, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			} else {
+				t.Fatal(err)
+			}
+		}
+	}
+	if hits != 2 || misses != 1 {
+		t.Fatalf("Expected 2 hits and 1 miss, got %d and %d", hits, misses)
+	}
+
+	for i := 0; i < 200 && getInmem(t, "refresh") != "new"; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if getInmem(t, "refresh") != "new" {
+		t.Fatal("Expected the expiring key to be refreshed from L2")
+	}
+	if getInmem(t, "forever") != "old" {
+		t.Fatal("Expected the key without an expiration to be left alone")
+	}
+}
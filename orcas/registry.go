@@ -0,0 +1,92 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/netflix/rend/handlers"
+)
+
+// OrcaFactory creates an OrcaConst from a configuration string. The meaning of the string is up to
+// the implementation. An empty string means no configuration was given.
+type OrcaFactory func(conf string) (OrcaConst, error)
+
+var (
+	registry     = make(map[string]OrcaFactory)
+	registryLock = new(sync.RWMutex)
+)
+
+func init() {
+	Register("l1only", staticFactory(L1Only))
+	Register("l1l2", staticFactory(L1L2))
+	Register("l1l2batch", staticFactory(L1L2Batch))
+}
+
+func staticFactory(oc OrcaConst) OrcaFactory {
+	return func(conf string) (OrcaConst, error) {
+		return oc, nil
+	}
+}
+
+// Register makes an orchestrator available by name so it can be selected by a configuration
+// string. Implementations outside this package should call it from an init() function so that
+// importing the package is enough to make them available. Registering the same name twice panics.
+func Register(name string, f OrcaFactory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if f == nil {
+		panic("orcas: Register factory is nil for " + name)
+	}
+	if _, dup := registry[name]; dup {
+		panic("orcas: Register called twice for " + name)
+	}
+
+	registry[name] = f
+}
+
+// Registered returns the sorted names of all registered orchestrators.
+func Registered() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// FromConfig resolves a configuration string of the form "name" or "name:conf" to an OrcaConst
+// using the registered factory for that name.
+func FromConfig(spec string) (OrcaConst, error) {
+	name, conf := handlers.SplitSpec(spec)
+
+	registryLock.RLock()
+	f, ok := registry[name]
+	registryLock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("Unknown orca %q. Registered orcas: %s", name, strings.Join(Registered(), ", "))
+	}
+
+	return f(conf)
+}
@@ -0,0 +1,65 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"testing"
+
+	"github.com/netflix/rend/orcas"
+)
+
+func TestRegistry(t *testing.T) {
+	var gotConf string
+	orcas.Register("test-registry", func(conf string) (orcas.OrcaConst, error) {
+		gotConf = conf
+		return testPanicOrcaConst, nil
+	})
+
+	t.Run("ConfigPassedThrough", func(t *testing.T) {
+		oc, err := orcas.FromConfig("test-registry:a:b")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if oc == nil {
+			t.Fatalf("Expected an OrcaConst")
+		}
+		if gotConf != "a:b" {
+			t.Fatalf("Expected conf %q, got %q", "a:b", gotConf)
+		}
+	})
+
+	t.Run("Builtins", func(t *testing.T) {
+		for _, name := range []string{"l1only", "l1l2", "l1l2batch"} {
+			if _, err := orcas.FromConfig(name); err != nil {
+				t.Fatalf("Expected builtin orca %s to be registered: %v", name, err)
+			}
+		}
+	})
+
+	t.Run("Unknown", func(t *testing.T) {
+		if _, err := orcas.FromConfig("does-not-exist"); err == nil {
+			t.Fatalf("Expected an error for an unknown orca")
+		}
+	})
+
+	t.Run("DuplicatePanics", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("Expected duplicate registration to panic")
+			}
+		}()
+		orcas.Register("l1only", func(conf string) (orcas.OrcaConst, error) { return nil, nil })
+	})
+}
@@ -0,0 +1,235 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"context"
+	"errors"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/timer"
+)
+
+var (
+	MetricCmdSetIfMatchL1       = metrics.AddCounter("cmd_setif_l1", nil)
+	MetricCmdSetIfMatchL2       = metrics.AddCounter("cmd_setif_l2", nil)
+	MetricCmdSetIfMatchStored   = metrics.AddCounter("cmd_setif_stored", nil)
+	MetricCmdSetIfMatchMismatch = metrics.AddCounter("cmd_setif_mismatch", nil)
+	MetricCmdSetIfMatchMisses   = metrics.AddCounter("cmd_setif_misses", nil)
+	MetricCmdSetIfMatchErrors   = metrics.AddCounter("cmd_setif_errors", nil)
+
+	HistSetIfMatchL1 = metrics.AddHistogram("setif_l1", false, nil)
+	HistSetIfMatchL2 = metrics.AddHistogram("setif_l2", false, nil)
+)
+
+// SetIfMatcher is implemented by orchestrators that support conditional sets. Like every other
+// operation, the orchestrator responds on success and returns any error for the server to handle.
+type SetIfMatcher interface {
+	SetIfMatch(req common.SetIfMatchRequest) error
+}
+
+// SetIfMatcherV2 is the context-aware form of SetIfMatcher for OrcaV2 implementations.
+type SetIfMatcherV2 interface {
+	SetIfMatch(ctx context.Context, req common.SetIfMatchRequest) error
+}
+
+// SetIfMatch does the conditional set in req with o, or returns common.ErrNotSupported if o doesn't
+// implement SetIfMatcher.
+func SetIfMatch(o Orca, req common.SetIfMatchRequest) error {
+	if sm, ok := o.(SetIfMatcher); ok {
+		return sm.SetIfMatch(req)
+	}
+	return common.ErrNotSupported
+}
+
+// SetIfMatchV2 is the OrcaV2 counterpart of SetIfMatch.
+func SetIfMatchV2(ctx context.Context, o OrcaV2, req common.SetIfMatchRequest) error {
+	if sm, ok := o.(SetIfMatcherV2); ok {
+		return sm.SetIfMatch(ctx, req)
+	}
+	return common.ErrNotSupported
+}
+
+// setIfMatch does the conditional set against a single handler and counts the outcome
+func setIfMatch(h handlers.Handler, req common.SetIfMatchRequest, counter uint32, hist uint32) error {
+	metrics.IncCounter(counter)
+	start := timer.Now()
+
+	err := handlers.SetIfMatch(h, req)
+
+	metrics.ObserveHist(hist, timer.Since(start))
+
+	switch {
+	case err == nil:
+	case errors.Is(err, common.ErrKeyExists):
+		metrics.IncCounter(MetricCmdSetIfMatchMismatch)
+	case errors.Is(err, common.ErrKeyNotFound):
+		metrics.IncCounter(MetricCmdSetIfMatchMisses)
+	default:
+		metrics.IncCounter(MetricCmdSetIfMatchErrors)
+	}
+
+	return err
+}
+
+func (l *L1OnlyOrca) SetIfMatch(req common.SetIfMatchRequest) error {
+	if err := setIfMatch(l.l1, req, MetricCmdSetIfMatchL1, HistSetIfMatchL1); err != nil {
+		return err
+	}
+
+	metrics.IncCounter(MetricCmdSetIfMatchStored)
+	return l.res.SetIfMatch(req.Opaque, req.Quiet)
+}
+
+// L2 holds the authoritative copy, so the condition is checked there. If it matched, L1 gets the new
+// value the same way as for a plain set.
+func (l *L1L2Orca) SetIfMatch(req common.SetIfMatchRequest) error {
+	if err := setIfMatch(l.l2, req, MetricCmdSetIfMatchL2, HistSetIfMatchL2); err != nil {
+		return err
+	}
+
+	metrics.IncCounter(MetricCmdSetL1)
+	start := timer.Now()
+
+	err := l.l1.Set(req.SetRequest)
+
+	metrics.ObserveHist(HistSetL1, timer.Since(start))
+
+	if err != nil {
+		metrics.IncCounter(MetricCmdSetErrorsL1)
+		metrics.IncCounter(MetricCmdSetIfMatchErrors)
+		return err
+	}
+	metrics.IncCounter(MetricCmdSetSuccessL1)
+
+	metrics.IncCounter(MetricCmdSetIfMatchStored)
+	return l.res.SetIfMatch(req.Opaque, req.Quiet)
+}
+
+// As with a plain set in batch mode, a successful conditional set in L2 only replaces the value in
+// L1 if it is already there.
+func (l *L1L2BatchOrca) SetIfMatch(req common.SetIfMatchRequest) error {
+	if err := setIfMatch(l.l2, req, MetricCmdSetIfMatchL2, HistSetIfMatchL2); err != nil {
+		return err
+	}
+
+	metrics.IncCounter(MetricCmdSetReplaceL1)
+	start := timer.Now()
+
+	err := l.l1.Replace(req.SetRequest)
+
+	metrics.ObserveHist(HistReplaceL1, timer.Since(start))
+
+	if err != nil {
+		if errors.Is(err, common.ErrKeyNotFound) {
+			metrics.IncCounter(MetricCmdSetReplaceNotStoredL1)
+		} else {
+			metrics.IncCounter(MetricCmdSetReplaceErrorsL1)
+			metrics.IncCounter(MetricCmdSetIfMatchErrors)
+			return err
+		}
+	} else {
+		metrics.IncCounter(MetricCmdSetReplaceStoredL1)
+	}
+
+	metrics.IncCounter(MetricCmdSetIfMatchStored)
+	return l.res.SetIfMatch(req.Opaque, req.Quiet)
+}
+
+func (l *LockedOrca) SetIfMatch(req common.SetIfMatchRequest) error {
+	lock := l.getlock(req.Key, false)
+	lock.Lock()
+	defer lock.Unlock()
+	return SetIfMatch(l.wrapped, req)
+}
+
+func (o *modedOrca) SetIfMatch(req common.SetIfMatchRequest) error {
+	if err := o.write(); err != nil {
+		return err
+	}
+	return SetIfMatch(o.Orca, req)
+}
+
+func (o *budgetOrca) SetIfMatch(req common.SetIfMatchRequest) error {
+	o.b.start()
+	return SetIfMatch(o.Orca, req)
+}
+
+func (o *canaryOrca) SetIfMatch(req common.SetIfMatchRequest) error {
+	arm, start := o.pick(req.Key)
+	return o.done(arm, start, SetIfMatch(o.arms[arm], req))
+}
+
+func (p *prioritizedOrca) SetIfMatch(req common.SetIfMatchRequest) error {
+	p.acquire(req.Key)
+	defer p.s.Release()
+	return SetIfMatch(p.Orca, req)
+}
+
+func (c *v2Orca) SetIfMatch(ctx context.Context, req common.SetIfMatchRequest) error {
+	defer c.ctx.enter(ctx)()
+	return SetIfMatch(c.o, req)
+}
+
+func (v v1Orca) SetIfMatch(req common.SetIfMatchRequest) error {
+	return SetIfMatchV2(v.ctx, v.o, req)
+}
+
+func (b boundHandler) SetIfMatch(cmd common.SetIfMatchRequest) error {
+	defer b.enter()()
+	return handlers.SetIfMatchV2(b.ctx.get(), b.h, cmd)
+}
+
+// Size routing has no SetIfMatch on purpose. A value routed away from a tier would skip that tier's
+// check, so conditional sets are not supported with it.
+
+func (h *budgetHandler) SetIfMatch(cmd common.SetIfMatchRequest) error {
+	return h.run(func(hd handlers.Handler) error { return handlers.SetIfMatch(hd, cmd) })
+}
+
+func (h staleHandler) SetIfMatch(cmd common.SetIfMatchRequest) error {
+	cmd.Exptime = h.p.extend(cmd.Exptime)
+	return handlers.SetIfMatch(h.Handler, cmd)
+}
+
+func (h refreshingHandler) SetIfMatch(cmd common.SetIfMatchRequest) error {
+	return handlers.SetIfMatch(h.Handler, cmd)
+}
+
+func (o *tombstoneOrca) SetIfMatch(req common.SetIfMatchRequest) error {
+	return SetIfMatch(o.Orca, req)
+}
+
+func (h *tombstoneHandler) SetIfMatch(cmd common.SetIfMatchRequest) error {
+	return handlers.SetIfMatch(h.Handler, cmd)
+}
+
+func (o *admissionOrca) SetIfMatch(req common.SetIfMatchRequest) error {
+	return SetIfMatch(o.Orca, req)
+}
+
+func (h *admissionHandler) SetIfMatch(cmd common.SetIfMatchRequest) error {
+	return handlers.SetIfMatch(h.Handler, cmd)
+}
+
+func (o *quotaOrca) SetIfMatch(req common.SetIfMatchRequest) error {
+	return o.write(req.SetRequest, false, func() error { return SetIfMatch(o.Orca, req) })
+}
+
+func (h *quietHandler) SetIfMatch(cmd common.SetIfMatchRequest) error {
+	return handlers.SetIfMatch(h.Handler, cmd)
+}
@@ -0,0 +1,88 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers/inmem"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol/textprot"
+)
+
+func TestSetIfMatch(t *testing.T) {
+	l1, _ := inmem.New()
+	buf := new(bytes.Buffer)
+	w := bufio.NewWriter(buf)
+	o := orcas.L1Only(l1, nil, textprot.NewTextResponder(w))
+
+	key := []byte("TestSetIfMatch")
+	setif := func(match []byte, hash bool, data string) error {
+		return orcas.SetIfMatch(o, common.SetIfMatchRequest{
+			SetRequest: common.SetRequest{Key: key, Data: []byte(data)},
+			Match:      match,
+			MatchHash:  hash,
+		})
+	}
+
+	if err := setif([]byte("v1"), false, "v2"); !errors.Is(err, common.ErrKeyNotFound) {
+		t.Fatalf("Expected a miss before the key exists, got %v", err)
+	}
+
+	if err := l1.Set(common.SetRequest{Key: key, Data: []byte("v1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := setif([]byte("v0"), false, "v2"); !errors.Is(err, common.ErrKeyExists) {
+		t.Fatalf("Expected a mismatch, got %v", err)
+	}
+	if err := setif([]byte("v1"), false, "v2"); err != nil {
+		t.Fatal(err)
+	}
+
+	hash := make([]byte, 8)
+	binary.BigEndian.PutUint64(hash, common.ValueHash([]byte("v1")))
+	if err := setif(hash, true, "v3"); !errors.Is(err, common.ErrKeyExists) {
+		t.Fatalf("Expected the hash of the old value to mismatch, got %v", err)
+	}
+	binary.BigEndian.PutUint64(hash, common.ValueHash([]byte("v2")))
+	if err := setif(hash, true, "v3"); err != nil {
+		t.Fatal(err)
+	}
+
+	w.Flush()
+	if buf.String() != "STORED\r\nSTORED\r\n" {
+		t.Fatalf("Expected only the matching sets to be answered, got %q", buf.String())
+	}
+
+	res, err := l1.GAT(common.GATRequest{Key: key})
+	if err != nil || string(res.Data) != "v3" {
+		t.Fatalf("Expected the value to be v3, got %q %v", res.Data, err)
+	}
+}
+
+func TestSetIfMatchNotSupported(t *testing.T) {
+	o := orcas.L1Only(opHandler{ops: new([]string)}, nil, nil)
+
+	err := orcas.SetIfMatch(o, common.SetIfMatchRequest{SetRequest: common.SetRequest{Key: []byte("foo")}})
+	if !errors.Is(err, common.ErrNotSupported) {
+		t.Fatalf("Expected a handler without SetIfMatch to be unsupported, got %v", err)
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"log"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/protocol"
+)
+
+var (
+	MetricShedLargeSets = metrics.AddCounter("shed_large_sets", nil)
+	MetricShedMultigets = metrics.AddCounter("shed_multigets", nil)
+	MetricShedWrites    = metrics.AddCounter("shed_writes", nil)
+
+	MetricShedStage     = metrics.AddIntGauge("shed_stage", nil)
+	MetricShedHeapBytes = metrics.AddIntGauge("shed_heap_bytes", nil)
+)
+
+// ShedStage is how much load is being shed because of memory pressure. Each stage also sheds
+// everything the stages before it do.
+type ShedStage int32
+
+const (
+	// ShedNone serves everything
+	ShedNone ShedStage = iota
+	// ShedLargeSets rejects writes of values larger than ShedPolicy.LargeSet
+	ShedLargeSets
+	// ShedMultigets rejects gets for more than ShedPolicy.MultigetKeys keys
+	ShedMultigets
+	// ShedWrites rejects every write that stores data. Deletes and touches are still served since
+	// they don't need more memory, and deletes give some back.
+	ShedWrites
+)
+
+func (s ShedStage) String() string {
+	switch s {
+	case ShedNone:
+		return "none"
+	case ShedLargeSets:
+		return "large-sets"
+	case ShedMultigets:
+		return "multigets"
+	case ShedWrites:
+		return "writes"
+	}
+	return "unknown"
+}
+
+// ShedPolicy sets the heap sizes at which each stage of load shedding starts. A threshold of 0
+// disables that stage. The thresholds are expected to go up with each stage, but a stage whose
+// threshold is passed is entered even if an earlier one is disabled.
+type ShedPolicy struct {
+	// LargeSetHeap is the heap size in bytes that starts the large set stage
+	LargeSetHeap uint64
+	// LargeSet is the largest value accepted in the large set stage and after. 0 only accepts
+	// empty values.
+	LargeSet int
+
+	// MultigetHeap is the heap size in bytes that starts the multiget stage
+	MultigetHeap uint64
+	// MultigetKeys is the most keys a get may ask for in the multiget stage and after. 0 rejects
+	// every get.
+	MultigetKeys int
+
+	// WritesHeap is the heap size in bytes that starts rejecting all writes
+	WritesHeap uint64
+}
+
+// Enabled returns whether any stage of the policy has a threshold
+func (p ShedPolicy) Enabled() bool {
+	return p.LargeSetHeap > 0 || p.MultigetHeap > 0 || p.WritesHeap > 0
+}
+
+func (p ShedPolicy) stage(heap uint64) ShedStage {
+	switch {
+	case p.WritesHeap > 0 && heap >= p.WritesHeap:
+		return ShedWrites
+	case p.MultigetHeap > 0 && heap >= p.MultigetHeap:
+		return ShedMultigets
+	case p.LargeSetHeap > 0 && heap >= p.LargeSetHeap:
+		return ShedLargeSets
+	}
+	return ShedNone
+}
+
+// Shedder tracks the heap of the process and the stage of load shedding it calls for. One Shedder
+// is shared by every connection.
+type Shedder struct {
+	p     ShedPolicy
+	stage int32
+}
+
+// NewShedder creates a Shedder that isn't shedding anything until it sees the heap through
+// Monitor or Observe.
+func NewShedder(p ShedPolicy) *Shedder {
+	return &Shedder{p: p}
+}
+
+// Monitor samples the heap at every interval, forever. It's meant to be run in its own goroutine.
+// Reading the memory stats stops the world briefly, so the interval shouldn't be too short.
+func (s *Shedder) Monitor(interval time.Duration) {
+	var ms runtime.MemStats
+	for {
+		runtime.ReadMemStats(&ms)
+		s.Observe(ms.HeapAlloc)
+		time.Sleep(interval)
+	}
+}
+
+// Observe moves the Shedder to the stage for a heap of the given size in bytes
+func (s *Shedder) Observe(heap uint64) {
+	metrics.SetIntGauge(MetricShedHeapBytes, heap)
+
+	stage := s.p.stage(heap)
+	old := ShedStage(atomic.SwapInt32(&s.stage, int32(stage)))
+	if old != stage {
+		metrics.SetIntGauge(MetricShedStage, uint64(stage))
+		log.Printf("Load shedding changed from %v to %v at %d bytes of heap\n", old, stage, heap)
+	}
+}
+
+// Stage returns the current stage
+func (s *Shedder) Stage() ShedStage {
+	return ShedStage(atomic.LoadInt32(&s.stage))
+}
+
+// Shedding wraps an orchestrator to reject the requests the current stage of s calls for. Rejected
+// requests fail with an out of memory error, which clients should treat as temporary.
+func Shedding(oc OrcaConst, s *Shedder) OrcaConst {
+	return func(l1, l2 handlers.Handler, res protocol.Responder) Orca {
+		return &shedOrca{
+			Orca: oc(l1, l2, res),
+			s:    s,
+		}
+	}
+}
+
+type shedOrca struct {
+	Orca
+	s *Shedder
+}
+
+// write returns the error a write of the given size gets in the current stage, if any
+func (o *shedOrca) write(size int) error {
+	switch stage := o.s.Stage(); {
+	case stage >= ShedWrites:
+		metrics.IncCounter(MetricShedWrites)
+		return common.ErrNoMem
+	case stage >= ShedLargeSets && size > o.s.p.LargeSet:
+		metrics.IncCounter(MetricShedLargeSets)
+		return common.ErrNoMem
+	}
+	return nil
+}
+
+// read returns the error a get for the given number of keys gets in the current stage, if any
+func (o *shedOrca) read(keys int) error {
+	if o.s.Stage() >= ShedMultigets && keys > o.s.p.MultigetKeys {
+		metrics.IncCounter(MetricShedMultigets)
+		return common.ErrNoMem
+	}
+	return nil
+}
+
+func (o *shedOrca) Set(req common.SetRequest) error {
+	if err := o.write(len(req.Data)); err != nil {
+		return err
+	}
+	return o.Orca.Set(req)
+}
+
+func (o *shedOrca) Add(req common.SetRequest) error {
+	if err := o.write(len(req.Data)); err != nil {
+		return err
+	}
+	return o.Orca.Add(req)
+}
+
+func (o *shedOrca) Replace(req common.SetRequest) error {
+	if err := o.write(len(req.Data)); err != nil {
+		return err
+	}
+	return o.Orca.Replace(req)
+}
+
+func (o *shedOrca) Append(req common.SetRequest) error {
+	if err := o.write(len(req.Data)); err != nil {
+		return err
+	}
+	return o.Orca.Append(req)
+}
+
+func (o *shedOrca) Prepend(req common.SetRequest) error {
+	if err := o.write(len(req.Data)); err != nil {
+		return err
+	}
+	return o.Orca.Prepend(req)
+}
+
+func (o *shedOrca) Get(req common.GetRequest) error {
+	if err := o.read(len(req.Keys)); err != nil {
+		return err
+	}
+	return o.Orca.Get(req)
+}
+
+func (o *shedOrca) GetE(req common.GetRequest) error {
+	if err := o.read(len(req.Keys)); err != nil {
+		return err
+	}
+	return o.Orca.GetE(req)
+}
@@ -0,0 +1,103 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol"
+)
+
+// passOrca counts the requests that make it through to it
+type passOrca struct {
+	testPanicOrca
+	n *int
+}
+
+func (o passOrca) Set(req common.SetRequest) error       { *o.n++; return nil }
+func (o passOrca) Delete(req common.DeleteRequest) error { *o.n++; return nil }
+func (o passOrca) Get(req common.GetRequest) error       { *o.n++; return nil }
+
+func TestShedding(t *testing.T) {
+	s := orcas.NewShedder(orcas.ShedPolicy{
+		LargeSetHeap: 100,
+		LargeSet:     10,
+		MultigetHeap: 200,
+		MultigetKeys: 2,
+		WritesHeap:   300,
+	})
+
+	passed := 0
+	o := orcas.Shedding(func(l1, l2 handlers.Handler, res protocol.Responder) orcas.Orca {
+		return passOrca{n: &passed}
+	}, s)(nil, nil, nil)
+
+	small := common.SetRequest{Key: []byte("foo"), Data: make([]byte, 10)}
+	large := common.SetRequest{Key: []byte("foo"), Data: make([]byte, 11)}
+	single := common.GetRequest{Keys: [][]byte{[]byte("foo")}}
+	multi := common.GetRequest{Keys: [][]byte{[]byte("foo"), []byte("bar"), []byte("baz")}}
+	del := common.DeleteRequest{Key: []byte("foo")}
+
+	tests := []struct {
+		heap  uint64
+		stage orcas.ShedStage
+		// whether small, large, single, multi and del get through, in that order
+		pass [5]bool
+	}{
+		{99, orcas.ShedNone, [5]bool{true, true, true, true, true}},
+		{100, orcas.ShedLargeSets, [5]bool{true, false, true, true, true}},
+		{250, orcas.ShedMultigets, [5]bool{true, false, true, false, true}},
+		{1000, orcas.ShedWrites, [5]bool{false, false, true, false, true}},
+		{0, orcas.ShedNone, [5]bool{true, true, true, true, true}},
+	}
+
+	for _, test := range tests {
+		s.Observe(test.heap)
+		if s.Stage() != test.stage {
+			t.Fatalf("Expected stage %v at %d bytes, got %v", test.stage, test.heap, s.Stage())
+		}
+
+		errs := [5]error{o.Set(small), o.Set(large), o.Get(single), o.Get(multi), o.Delete(del)}
+		for i, err := range errs {
+			if test.pass[i] && err != nil {
+				t.Fatalf("Expected request %d to get through in stage %v, got %v", i, test.stage, err)
+			}
+			if !test.pass[i] && err != common.ErrNoMem {
+				t.Fatalf("Expected request %d to be shed in stage %v, got %v", i, test.stage, err)
+			}
+		}
+	}
+
+	if passed != 19 {
+		t.Fatalf("Expected 19 requests to get through, got %d", passed)
+	}
+}
+
+func TestShedPolicySkippedStage(t *testing.T) {
+	// Only the last stage is enabled, so the heap goes straight there
+	s := orcas.NewShedder(orcas.ShedPolicy{WritesHeap: 300})
+
+	s.Observe(299)
+	if s.Stage() != orcas.ShedNone {
+		t.Fatalf("Expected no shedding, got %v", s.Stage())
+	}
+	s.Observe(300)
+	if s.Stage() != orcas.ShedWrites {
+		t.Fatalf("Expected writes to be shed, got %v", s.Stage())
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"errors"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/protocol"
+)
+
+var (
+	MetricSizeRoutedL2Only = metrics.AddCounter("size_routed_l2_only", nil)
+	MetricSizeRoutedL1Only = metrics.AddCounter("size_routed_l1_only", nil)
+)
+
+// SizePolicy decides which tiers a value is stored in by its size. Large values can take the space
+// of thousands of small hot ones in L1 for little benefit, and small hot values may not be worth
+// the round trip to L2 at all.
+type SizePolicy struct {
+	// L1Max is the largest value stored in L1. Larger values only go to L2. 0 means no limit.
+	L1Max int
+	// L1OnlyMax is the largest value that is only stored in L1. 0 means every value goes to L2.
+	L1OnlyMax int
+	// Exempt is a mask of flag bits; values with any of them set go to both tiers whatever their
+	// size, see ClassPolicy.Replicate
+	Exempt uint32
+}
+
+// SizeRouted wraps an orchestrator to apply a size policy to its writes, including filling L1 from
+// L2 on a miss. When a tier is skipped the key is deleted from it instead, so it can't keep
+// serving an older value.
+func SizeRouted(oc OrcaConst, p SizePolicy) OrcaConst {
+	return func(l1, l2 handlers.Handler, res protocol.Responder) Orca {
+		return oc(
+			routedHandler{Handler: l1, skip: p.skipL1},
+			routedHandler{Handler: l2, skip: p.skipL2},
+			res,
+		)
+	}
+}
+
+func (p SizePolicy) skipL1(cmd common.SetRequest) bool {
+	if p.L1Max > 0 && len(cmd.Data) > p.L1Max && cmd.Flags&p.Exempt == 0 {
+		metrics.IncCounter(MetricSizeRoutedL2Only)
+		return true
+	}
+	return false
+}
+
+func (p SizePolicy) skipL2(cmd common.SetRequest) bool {
+	if p.L1OnlyMax > 0 && len(cmd.Data) <= p.L1OnlyMax && cmd.Flags&p.Exempt == 0 {
+		metrics.IncCounter(MetricSizeRoutedL1Only)
+		return true
+	}
+	return false
+}
+
+// routedHandler keeps the writes that skip returns true for out of a tier
+type routedHandler struct {
+	handlers.Handler
+	skip func(cmd common.SetRequest) bool
+}
+
+func (h routedHandler) skipped(cmd common.SetRequest) (bool, error) {
+	if !h.skip(cmd) {
+		return false, nil
+	}
+
+	err := h.Handler.Delete(common.DeleteRequest{Key: cmd.Key})
+	if errors.Is(err, common.ErrKeyNotFound) {
+		err = nil
+	}
+
+	return true, err
+}
+
+func (h routedHandler) Set(cmd common.SetRequest) error {
+	if skip, err := h.skipped(cmd); skip {
+		return err
+	}
+	return h.Handler.Set(cmd)
+}
+
+func (h routedHandler) Add(cmd common.SetRequest) error {
+	if skip, err := h.skipped(cmd); skip {
+		return err
+	}
+	return h.Handler.Add(cmd)
+}
+
+func (h routedHandler) Replace(cmd common.SetRequest) error {
+	if skip, err := h.skipped(cmd); skip {
+		return err
+	}
+	return h.Handler.Replace(cmd)
+}
@@ -0,0 +1,79 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol"
+)
+
+// opHandler records which operations it was asked to do
+type opHandler struct {
+	handlers.Handler
+	ops *[]string
+}
+
+func (o opHandler) Set(cmd common.SetRequest) error {
+	*o.ops = append(*o.ops, "set")
+	return nil
+}
+
+func (o opHandler) Delete(cmd common.DeleteRequest) error {
+	*o.ops = append(*o.ops, "delete")
+	return common.ErrKeyNotFound
+}
+
+func (o opHandler) Flush(cmd common.FlushRequest) error {
+	*o.ops = append(*o.ops, "flush")
+	return nil
+}
+
+func TestSizeRouted(t *testing.T) {
+	var l1ops, l2ops []string
+
+	var l1, l2 handlers.Handler
+	orcas.SizeRouted(func(h1, h2 handlers.Handler, res protocol.Responder) orcas.Orca {
+		l1, l2 = h1, h2
+		return nil
+	}, orcas.SizePolicy{L1Max: 10, L1OnlyMax: 2})(opHandler{ops: &l1ops}, opHandler{ops: &l2ops}, nil)
+
+	set := func(size int) {
+		l1ops, l2ops = nil, nil
+		for _, h := range []handlers.Handler{l2, l1} {
+			if err := h.Set(common.SetRequest{Key: []byte("foo"), Data: make([]byte, size)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	set(5)
+	if len(l1ops) != 1 || l1ops[0] != "set" || len(l2ops) != 1 || l2ops[0] != "set" {
+		t.Fatalf("Expected a medium value in both tiers, got %v and %v", l1ops, l2ops)
+	}
+
+	set(11)
+	if l1ops[0] != "delete" || l2ops[0] != "set" {
+		t.Fatalf("Expected a large value to skip L1, got %v and %v", l1ops, l2ops)
+	}
+
+	set(2)
+	if l1ops[0] != "set" || l2ops[0] != "delete" {
+		t.Fatalf("Expected a small value to skip L2, got %v and %v", l1ops, l2ops)
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"log"
+	"time"
+
+	"github.com/netflix/rend/clock"
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/protocol"
+)
+
+var (
+	MetricStaleServed        = metrics.AddCounter("stale_served", nil)
+	MetricStaleServedOnError = metrics.AddCounter("stale_served_on_error", nil)
+	MetricStaleRevalidated   = metrics.AddCounter("stale_revalidated", nil)
+	MetricStaleExpired       = metrics.AddCounter("stale_expired", nil)
+)
+
+// StalePolicy configures soft TTLs in L1. The TTL a client sets becomes the soft TTL, and the entry
+// is kept in L1 for Window longer. An entry past its soft TTL is stale but can still be served.
+type StalePolicy struct {
+	// Window is how long entries are kept in L1 past the TTL they were set with
+	Window time.Duration
+
+	// Revalidate serves stale entries immediately and refreshes them in the background. Otherwise
+	// stale entries are read from L2 first and only served if L2 fails.
+	Revalidate bool
+
+	// FlagMask is OR'd into the flags of stale entries when they are served, so clients can tell.
+	// 0 leaves the flags alone. The bit should be reserved as common.FlagStale so no other feature
+	// uses it.
+	FlagMask uint32
+}
+
+func (p StalePolicy) window() uint32 {
+	return uint32(p.Window / time.Second)
+}
+
+// extend moves an expiration time, relative or absolute, out by the stale window
+func (p StalePolicy) extend(exptime uint32) uint32 {
+	if exptime == 0 {
+		return 0
+	}
+	if exptime <= clock.RealTimeMaxDelta && exptime+p.window() > clock.RealTimeMaxDelta {
+		return clock.Unix() + exptime + p.window()
+	}
+	return exptime + p.window()
+}
+
+// stale reports whether an entry with the given (extended) unix expiration time is past its soft TTL
+func (p StalePolicy) stale(exptime uint32) bool {
+	return exptime != 0 && int64(exptime)-int64(clock.Unix()) < int64(p.window())
+}
+
+// StaleL1 wraps an L1 handler constructor so writes are extended by the stale window. Anything
+// writing to L1 outside an orchestrator wrapped by StaleWhileRevalidate, like a Refresher, should
+// use this so its entries also get a stale window.
+func StaleL1(l1 handlers.HandlerConst, p StalePolicy) handlers.HandlerConst {
+	return func() (handlers.Handler, error) {
+		h, err := l1()
+		if err != nil {
+			return nil, err
+		}
+		return staleHandler{Handler: h, p: p}, nil
+	}
+}
+
+// StaleWhileRevalidate wraps an orchestrator to apply soft TTLs to L1. The Refresher is used to
+// revalidate stale entries in the background, and may be nil if p.Revalidate is false. To combine
+// this with RefreshAhead, this should be the outer wrapper so refresh-ahead sees soft TTLs.
+func StaleWhileRevalidate(oc OrcaConst, r *Refresher, p StalePolicy) OrcaConst {
+	return func(l1, l2 handlers.Handler, res protocol.Responder) Orca {
+		return oc(staleHandler{Handler: l1, l2: l2, r: r, p: p}, l2, res)
+	}
+}
+
+// staleHandler wraps an L1 handler. Writes are extended by the stale window, and reads report the
+// soft TTL while deciding what to do with stale entries.
+type staleHandler struct {
+	handlers.Handler
+	l2 handlers.Handler
+	r  *Refresher
+	p  StalePolicy
+}
+
+func (h staleHandler) Set(cmd common.SetRequest) error {
+	cmd.Exptime = h.p.extend(cmd.Exptime)
+	return h.Handler.Set(cmd)
+}
+
+func (h staleHandler) Add(cmd common.SetRequest) error {
+	cmd.Exptime = h.p.extend(cmd.Exptime)
+	return h.Handler.Add(cmd)
+}
+
+func (h staleHandler) Replace(cmd common.SetRequest) error {
+	cmd.Exptime = h.p.extend(cmd.Exptime)
+	return h.Handler.Replace(cmd)
+}
+
+func (h staleHandler) Touch(cmd common.TouchRequest) error {
+	cmd.Exptime = h.p.extend(cmd.Exptime)
+	return h.Handler.Touch(cmd)
+}
+
+func (h staleHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	cmd.Exptime = h.p.extend(cmd.Exptime)
+	return h.Handler.GAT(cmd)
+}
+
+func (h staleHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	resChanE, errChanE := h.GetE(cmd)
+
+	dataOut := make(chan common.GetResponse)
+	errorOut := make(chan error)
+
+	go func() {
+		defer close(dataOut)
+		defer close(errorOut)
+
+		for resChanE != nil || errChanE != nil {
+			select {
+			case res, ok := <-resChanE:
+				if !ok {
+					resChanE = nil
+					continue
+				}
+
+				dataOut <- common.GetResponse{
+					Key:    res.Key,
+					Data:   res.Data,
+					Opaque: res.Opaque,
+					Flags:  res.Flags,
+					Miss:   res.Miss,
+					Quiet:  res.Quiet,
+				}
+
+			case err, ok := <-errChanE:
+				if !ok {
+					errChanE = nil
+					continue
+				}
+
+				errorOut <- err
+			}
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+func (h staleHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	resChanE, errChanE := h.Handler.GetE(cmd)
+	id := common.RequestIDFrom(handlers.Context(h.Handler))
+
+	dataOut := make(chan common.GetEResponse)
+	errorOut := make(chan error)
+
+	go func() {
+		defer close(dataOut)
+		defer close(errorOut)
+
+		// Stale entries that need to go to L2 first have to wait until L1 is done, since the
+		// connection can't be used for anything else in the meantime.
+		var stale []common.GetEResponse
+		var l1err error
+
+		for resChanE != nil || errChanE != nil {
+			select {
+			case res, ok := <-resChanE:
+				if !ok {
+					resChanE = nil
+					continue
+				}
+
+				if !res.Miss && h.p.stale(res.Exptime) {
+					if !h.p.Revalidate && h.l2 != nil {
+						stale = append(stale, res)
+						continue
+					}
+
+					if h.r != nil {
+						h.r.Trigger(res.Key)
+					}
+					res = h.serveStale(res)
+					metrics.IncCounter(MetricStaleServed)
+				}
+
+				dataOut <- h.soft(res)
+
+			case err, ok := <-errChanE:
+				if !ok {
+					errChanE = nil
+					continue
+				}
+
+				l1err = err
+				errorOut <- err
+			}
+		}
+
+		if l1err != nil {
+			return
+		}
+
+		for _, res := range stale {
+			dataOut <- h.soft(h.revalidate(id, res))
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+// revalidate reads a stale entry from L2, falling back to serving it stale if L2 fails
+func (h staleHandler) revalidate(id common.RequestID, res common.GetEResponse) common.GetEResponse {
+	fresh, err := getEOne(h.l2, res.Key)
+	if err != nil {
+		log.Printf("Error revalidating stale entry for request %v, serving it stale: %v\n", id, err)
+		metrics.IncCounter(MetricStaleServedOnError)
+		return h.serveStale(res)
+	}
+
+	if fresh.Miss {
+		// Gone from L2, so it's gone for good
+		metrics.IncCounter(MetricStaleExpired)
+		h.Handler.Delete(common.DeleteRequest{Key: res.Key})
+		res.Miss = true
+		res.Data = nil
+		res.Flags = 0
+		res.Exptime = 0
+		return res
+	}
+
+	metrics.IncCounter(MetricStaleRevalidated)
+	h.Set(common.SetRequest{
+		Key:     res.Key,
+		Flags:   fresh.Flags,
+		Exptime: fresh.Exptime,
+		Data:    fresh.Data,
+	})
+
+	res.Data = fresh.Data
+	res.Flags = fresh.Flags
+	res.Exptime = h.p.extend(fresh.Exptime)
+	return res
+}
+
+func (h staleHandler) serveStale(res common.GetEResponse) common.GetEResponse {
+	res.Flags = common.SetFlag(res.Flags, h.p.FlagMask)
+	return res
+}
+
+// soft reports the soft TTL instead of the one the entry is stored with
+func (h staleHandler) soft(res common.GetEResponse) common.GetEResponse {
+	if res.Exptime > h.p.window() {
+		res.Exptime -= h.p.window()
+	}
+	return res
+}
@@ -0,0 +1,129 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/inmem"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol"
+)
+
+func staleL1(l2 handlers.Handler, p orcas.StalePolicy) handlers.Handler {
+	var l1 handlers.Handler
+	oc := orcas.StaleWhileRevalidate(func(h1, h2 handlers.Handler, res protocol.Responder) orcas.Orca {
+		l1 = h1
+		return nil
+	}, nil, p)
+	h, _ := inmem.New()
+	oc(h, l2, nil)
+	return l1
+}
+
+func getOneE(t *testing.T, h handlers.Handler, key string) common.GetEResponse {
+	resChan, errChan := h.GetE(common.GetRequest{
+		Keys:    [][]byte{[]byte(key)},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+
+	var res common.GetEResponse
+	for resChan != nil || errChan != nil {
+		select {
+		case r, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			} else {
+				res = r
+			}
+		case err, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			} else {
+				t.Fatal(err)
+			}
+		}
+	}
+	return res
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	p := orcas.StalePolicy{
+		Window:   time.Hour,
+		FlagMask: 1 << 31,
+	}
+	raw, _ := inmem.New()
+
+	t.Run("Fresh", func(t *testing.T) {
+		l1 := staleL1(staticL2{data: "l2"}, p)
+		l1.Set(common.SetRequest{Key: []byte("swr_fresh"), Data: []byte("l1"), Exptime: 60})
+
+		res := getOneE(t, l1, "swr_fresh")
+		if string(res.Data) != "l1" || res.Flags != 0 {
+			t.Fatalf("Expected the fresh entry as is, got %+v", res)
+		}
+		if soft := int64(res.Exptime) - time.Now().Unix(); soft > 61 {
+			t.Fatalf("Expected the soft TTL to be reported, got %d", soft)
+		}
+	})
+
+	t.Run("Revalidated", func(t *testing.T) {
+		l1 := staleL1(staticL2{data: "l2"}, p)
+
+		// written without the window, so it's already stale
+		raw.Set(common.SetRequest{Key: []byte("swr_stale"), Data: []byte("l1"), Exptime: 60})
+
+		res := getOneE(t, l1, "swr_stale")
+		if string(res.Data) != "l2" || res.Flags != 0 {
+			t.Fatalf("Expected the stale entry to be revalidated from L2, got %+v", res)
+		}
+		if res = getOneE(t, raw, "swr_stale"); string(res.Data) != "l2" {
+			t.Fatalf("Expected L1 to be updated, got %+v", res)
+		}
+	})
+
+	t.Run("ServedOnError", func(t *testing.T) {
+		l1 := staleL1(staticL2{err: errors.New("down")}, p)
+		raw.Set(common.SetRequest{Key: []byte("swr_error"), Data: []byte("l1"), Exptime: 60})
+
+		res := getOneE(t, l1, "swr_error")
+		if string(res.Data) != "l1" || res.Flags != p.FlagMask {
+			t.Fatalf("Expected the stale entry to be served and flagged, got %+v", res)
+		}
+	})
+
+	t.Run("ServedWhileRevalidating", func(t *testing.T) {
+		rp := p
+		rp.Revalidate = true
+		l1 := staleL1(staticL2{data: "l2"}, rp)
+		raw.Set(common.SetRequest{Key: []byte("swr_async"), Data: []byte("l1"), Exptime: 60})
+
+		resChan, errChan := l1.Get(common.GetRequest{
+			Keys:    [][]byte{[]byte("swr_async")},
+			Opaques: []uint32{0},
+			Quiet:   []bool{false},
+		})
+		res := <-resChan
+		<-errChan
+		if string(res.Data) != "l1" || res.Flags != p.FlagMask {
+			t.Fatalf("Expected the stale entry to be served and flagged, got %+v", res)
+		}
+	})
+}
@@ -0,0 +1,184 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/protocol"
+)
+
+var started = time.Now()
+
+// Statser is implemented by orchestrators that answer memcached's stats command. The stats are the
+// same for every orchestrator since they come from the process and its metrics rather than from
+// the handlers.
+type Statser interface {
+	Stats(req common.StatsRequest) error
+}
+
+// StatserV2 is the context-aware form of Statser for OrcaV2 implementations.
+type StatserV2 interface {
+	Stats(ctx context.Context, req common.StatsRequest) error
+}
+
+// Stats answers the stats request in req with o, or returns common.ErrNotSupported if o doesn't
+// implement Statser.
+func Stats(o Orca, req common.StatsRequest) error {
+	if s, ok := o.(Statser); ok {
+		return s.Stats(req)
+	}
+	return common.ErrNotSupported
+}
+
+// StatsV2 is the OrcaV2 counterpart of Stats.
+func StatsV2(ctx context.Context, o OrcaV2, req common.StatsRequest) error {
+	if s, ok := o.(StatserV2); ok {
+		return s.Stats(ctx, req)
+	}
+	return common.ErrNotSupported
+}
+
+// GeneralStats returns the answer to a stats command without a group: the general memcached stats
+// that apply to rend followed by every counter and gauge from metrics.Stats.
+func GeneralStats() []metrics.Stat {
+	now := time.Now()
+	general := []metrics.Stat{
+		{Name: "pid", Value: strconv.Itoa(os.Getpid())},
+		{Name: "uptime", Value: strconv.FormatInt(int64(now.Sub(started)/time.Second), 10)},
+		{Name: "time", Value: strconv.FormatInt(now.Unix(), 10)},
+		{Name: "version", Value: common.VersionString},
+	}
+
+	return append(general, metrics.Stats()...)
+}
+
+var (
+	statsGroups     = make(map[string]func() []metrics.Stat)
+	statsGroupsLock = new(sync.RWMutex)
+)
+
+func init() {
+	RegisterStatsGroup(common.ExtensionsStatsGroup, ExtensionStats)
+}
+
+// ExtensionStats returns the answer to a stats command for common.ExtensionsStatsGroup: the version
+// of the list and then every extension rend advertises.
+func ExtensionStats() []metrics.Stat {
+	exts := common.Extensions()
+
+	res := make([]metrics.Stat, 0, len(exts)+1)
+	res = append(res, metrics.Stat{Name: "extensions", Value: strconv.Itoa(common.ExtensionsVersion)})
+	for _, e := range exts {
+		res = append(res, metrics.Stat{Name: e.Name, Value: e.Value()})
+	}
+	return res
+}
+
+// RegisterStatsGroup makes the stats command for the named group answer with what f returns. It's
+// for stats that come from outside the orchestrators, like the server's list of connections.
+// Registering the same name twice panics.
+func RegisterStatsGroup(name string, f func() []metrics.Stat) {
+	statsGroupsLock.Lock()
+	defer statsGroupsLock.Unlock()
+
+	if _, dup := statsGroups[name]; dup {
+		panic("orcas: RegisterStatsGroup called twice for " + name)
+	}
+	statsGroups[name] = f
+}
+
+// stats answers req with the general stats or a registered group
+func stats(res protocol.Responder, req common.StatsRequest) error {
+	if req.Group == "" {
+		return res.Stats(req.Opaque, GeneralStats())
+	}
+
+	statsGroupsLock.RLock()
+	f, ok := statsGroups[req.Group]
+	statsGroupsLock.RUnlock()
+
+	if !ok {
+		return common.ErrInvalidArgs
+	}
+	return res.Stats(req.Opaque, f())
+}
+
+func (l *L1OnlyOrca) Stats(req common.StatsRequest) error {
+	return stats(l.res, req)
+}
+
+func (l *L1L2Orca) Stats(req common.StatsRequest) error {
+	return stats(l.res, req)
+}
+
+func (l *L1L2BatchOrca) Stats(req common.StatsRequest) error {
+	return stats(l.res, req)
+}
+
+// The wrappers below pass stats through untouched: they don't read or write any keys, so there is
+// nothing to lock, budget, shed or
+// prioritize.
+
+func (l *LockedOrca) Stats(req common.StatsRequest) error {
+	return Stats(l.wrapped, req)
+}
+
+func (o *modedOrca) Stats(req common.StatsRequest) error {
+	return Stats(o.Orca, req)
+}
+
+func (o *budgetOrca) Stats(req common.StatsRequest) error {
+	return Stats(o.Orca, req)
+}
+
+func (o *canaryOrca) Stats(req common.StatsRequest) error {
+	return Stats(o.arms[armBaseline], req)
+}
+
+func (p *prioritizedOrca) Stats(req common.StatsRequest) error {
+	return Stats(p.Orca, req)
+}
+
+func (o *shedOrca) Stats(req common.StatsRequest) error {
+	return Stats(o.Orca, req)
+}
+
+func (c *v2Orca) Stats(ctx context.Context, req common.StatsRequest) error {
+	defer c.ctx.enter(ctx)()
+	return Stats(c.o, req)
+}
+
+func (v v1Orca) Stats(req common.StatsRequest) error {
+	return StatsV2(v.ctx, v.o, req)
+}
+
+func (o *tombstoneOrca) Stats(req common.StatsRequest) error {
+	return Stats(o.Orca, req)
+}
+
+func (o *admissionOrca) Stats(req common.StatsRequest) error {
+	return Stats(o.Orca, req)
+}
+
+func (o *quotaOrca) Stats(req common.StatsRequest) error {
+	return Stats(o.Orca, req)
+}
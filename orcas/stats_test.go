@@ -0,0 +1,60 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers/inmem"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol/textprot"
+)
+
+func TestStats(t *testing.T) {
+	l1, _ := inmem.New()
+	buf := new(bytes.Buffer)
+	w := bufio.NewWriter(buf)
+
+	// the wrappers pass stats through to the orchestrator that answers them
+	loc, _ := orcas.Locked(orcas.L1Only, false, 0)
+	o := loc(l1, nil, textprot.NewTextResponder(w))
+
+	if err := orcas.Stats(o, common.StatsRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	if prefix := fmt.Sprintf("STAT pid %d\r\nSTAT uptime ", os.Getpid()); !strings.HasPrefix(out, prefix) {
+		t.Fatalf("Expected the general stats first, got %q", out)
+	}
+	for _, line := range []string{"\r\nSTAT version " + common.VersionString + "\r\n", "\r\nSTAT cmd_gets_l1 "} {
+		if !strings.Contains(out, line) {
+			t.Fatalf("Expected %q in %q", line, out)
+		}
+	}
+	if !strings.HasSuffix(out, "\r\nEND\r\n") {
+		t.Fatalf("Expected the stats to end with END, got %q", out)
+	}
+
+	if err := orcas.Stats(o, common.StatsRequest{Group: "slabs"}); err != common.ErrInvalidArgs {
+		t.Fatalf("Expected a stats group to be invalid, got %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/protocol"
+)
+
+var (
+	MetricClassL1Only    = metrics.AddCounter("storage_class_l1_only", nil)
+	MetricClassL2Only    = metrics.AddCounter("storage_class_l2_only", nil)
+	MetricClassReplicate = metrics.AddCounter("storage_class_replicate", nil)
+	MetricClassConflicts = metrics.AddCounter("storage_class_conflicts", nil)
+)
+
+// ClassPolicy is the flag bits clients set on a value to say which tiers it belongs in.
+// Applications know which of their data is disposable and which has to persist far better than
+// any policy applied to all of it. Each field is a mask, usually the one reserved in
+// common.DefaultFlagBits under the matching common.Flag name, and 0 if the hint isn't used.
+type ClassPolicy struct {
+	// L1Only values skip L2, e.g. data that's cheap to recompute and only worth keeping close
+	L1Only uint32
+	// L2Only values skip L1, e.g. large or rarely read data that would push hot values out
+	L2Only uint32
+	// Replicate values go to both tiers, overriding the other hints and any SizePolicy, whose
+	// Exempt mask should include this one
+	Replicate uint32
+}
+
+// ClassRouted wraps an orchestrator to store values in the tiers their flags ask for, including
+// when filling L1 from L2 on a miss. Like SizeRouted, a skipped tier has the key deleted instead,
+// so it can't keep serving an older value. A value with both L1Only and L2Only set is stored in
+// both, and counted in storage_class_conflicts.
+func ClassRouted(oc OrcaConst, p ClassPolicy) OrcaConst {
+	return func(l1, l2 handlers.Handler, res protocol.Responder) Orca {
+		return oc(
+			routedHandler{Handler: l1, skip: p.skipL1},
+			routedHandler{Handler: l2, skip: p.skipL2},
+			res,
+		)
+	}
+}
+
+// class returns whether the value only belongs in L1 or only in L2. Anything else goes in both.
+func (p ClassPolicy) class(flags uint32) (l1Only, l2Only bool) {
+	l1Only, l2Only = flags&p.L1Only != 0, flags&p.L2Only != 0
+	if flags&p.Replicate != 0 || (l1Only && l2Only) {
+		return false, false
+	}
+	return l1Only, l2Only
+}
+
+func (p ClassPolicy) skipL1(cmd common.SetRequest) bool {
+	_, l2Only := p.class(cmd.Flags)
+	return l2Only
+}
+
+// skipL2 also counts the writes of each class. Every write from a client reaches it, while L1 is
+// also written when filling it from L2, which isn't a write of the class.
+func (p ClassPolicy) skipL2(cmd common.SetRequest) bool {
+	l1Only, l2Only := p.class(cmd.Flags)
+
+	switch {
+	case cmd.Flags&p.Replicate != 0:
+		metrics.IncCounter(MetricClassReplicate)
+	case l1Only:
+		metrics.IncCounter(MetricClassL1Only)
+	case l2Only:
+		metrics.IncCounter(MetricClassL2Only)
+	case cmd.Flags&p.L1Only != 0:
+		metrics.IncCounter(MetricClassConflicts)
+	}
+
+	return l1Only
+}
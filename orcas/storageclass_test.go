@@ -0,0 +1,71 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol"
+)
+
+func TestClassRouted(t *testing.T) {
+	const (
+		l1Only    = 1 << 28
+		l2Only    = 1 << 29
+		replicate = 1 << 30
+	)
+
+	var l1ops, l2ops []string
+
+	var l1, l2 handlers.Handler
+	oc := orcas.SizeRouted(func(h1, h2 handlers.Handler, res protocol.Responder) orcas.Orca {
+		l1, l2 = h1, h2
+		return nil
+	}, orcas.SizePolicy{L1Max: 10, Exempt: replicate})
+	oc = orcas.ClassRouted(oc, orcas.ClassPolicy{L1Only: l1Only, L2Only: l2Only, Replicate: replicate})
+	oc(opHandler{ops: &l1ops}, opHandler{ops: &l2ops}, nil)
+
+	set := func(flags uint32, size int) {
+		l1ops, l2ops = nil, nil
+		for _, h := range []handlers.Handler{l2, l1} {
+			if err := h.Set(common.SetRequest{Key: []byte("foo"), Flags: flags | 1, Data: make([]byte, size)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, c := range []struct {
+		name   string
+		flags  uint32
+		size   int
+		l1, l2 string
+	}{
+		{"no hint", 0, 5, "set", "set"},
+		{"l1-only", l1Only, 5, "set", "delete"},
+		{"l2-only", l2Only, 5, "delete", "set"},
+		{"both hints", l1Only | l2Only, 5, "set", "set"},
+		{"replicate over a hint", replicate | l2Only, 5, "set", "set"},
+		{"large", 0, 11, "delete", "set"},
+		{"large replicated", replicate, 11, "set", "set"},
+	} {
+		set(c.flags, c.size)
+		if len(l1ops) != 1 || l1ops[0] != c.l1 || len(l2ops) != 1 || l2ops[0] != c.l2 {
+			t.Errorf("Expected %s to %s in L1 and %s in L2, got %v and %v", c.name, c.l1, c.l2, l1ops, l2ops)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+// The handler wrappers below answer synchronous gets without adding a goroutine of their own, so
+// the orchestrators' gets on them stay synchronous all the way down when the handler beneath
+// supports it.
+
+func (b boundHandler) GetEach(cmd common.GetRequest, f func(common.GetResponse) error) error {
+	defer b.enter()()
+	return handlers.GetEachV2(b.ctx.get(), b.h, cmd, f)
+}
+
+func (b boundHandler) GetEEach(cmd common.GetRequest, f func(common.GetEResponse) error) error {
+	defer b.enter()()
+	return handlers.GetEEachV2(b.ctx.get(), b.h, cmd, f)
+}
+
+// Without a budget to enforce a get can run on the caller's goroutine. With one, the timer needs
+// the channels.
+func (h *budgetHandler) GetEach(cmd common.GetRequest, f func(common.GetResponse) error) error {
+	hd, err := h.conn()
+	if _, limited := h.limit(); err == nil && !limited {
+		return handlers.GetEach(hd, cmd, f)
+	}
+	resChan, errChan := h.Get(cmd)
+	return handlers.DrainGet(resChan, errChan, f)
+}
+
+func (h *budgetHandler) GetEEach(cmd common.GetRequest, f func(common.GetEResponse) error) error {
+	hd, err := h.conn()
+	if _, limited := h.limit(); err == nil && !limited {
+		return handlers.GetEEach(hd, cmd, f)
+	}
+	resChan, errChan := h.GetE(cmd)
+	return handlers.DrainGetE(resChan, errChan, f)
+}
+
+func (h *tombstoneHandler) GetEach(cmd common.GetRequest, f func(common.GetResponse) error) error {
+	return handlers.GetEach(h.Handler, cmd, f)
+}
+
+func (h *tombstoneHandler) GetEEach(cmd common.GetRequest, f func(common.GetEResponse) error) error {
+	return handlers.GetEEach(h.Handler, cmd, f)
+}
+
+func (h *admissionHandler) GetEach(cmd common.GetRequest, f func(common.GetResponse) error) error {
+	return handlers.GetEach(h.Handler, cmd, f)
+}
+
+func (h *admissionHandler) GetEEach(cmd common.GetRequest, f func(common.GetEResponse) error) error {
+	return handlers.GetEEach(h.Handler, cmd, f)
+}
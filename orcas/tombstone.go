@@ -0,0 +1,101 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/protocol"
+	"github.com/netflix/rend/timer"
+	"github.com/netflix/rend/tombstone"
+)
+
+// Tombstones wraps an orchestrator so a key deleted while a get is reading it from L2 isn't put
+// back into L1 by the get's backfill. Every delete from L1 records a tombstone first, and sets and
+// adds to L1 while serving a get, which are backfills, are dropped for keys deleted since the get
+// started.
+func Tombstones(oc OrcaConst, t *tombstone.Set) OrcaConst {
+	return func(l1, l2 handlers.Handler, res protocol.Responder) Orca {
+		h := &tombstoneHandler{Handler: l1, t: t}
+		return &tombstoneOrca{Orca: oc(h, l2, res), h: h}
+	}
+}
+
+// TombstoneL1 wraps an L1 handler constructor so deletes record tombstones. Anything deleting from
+// L1 outside an orchestrator wrapped by Tombstones, like peer invalidations, should use this.
+func TombstoneL1(l1 handlers.HandlerConst, t *tombstone.Set) handlers.HandlerConst {
+	return func() (handlers.Handler, error) {
+		h, err := l1()
+		if err != nil {
+			return nil, err
+		}
+		return &tombstoneHandler{Handler: h, t: t}, nil
+	}
+}
+
+type tombstoneOrca struct {
+	Orca
+	h *tombstoneHandler
+}
+
+// read serves a read, during which writes to L1 are backfills
+func (o *tombstoneOrca) read(f func() error) error {
+	o.h.reading = timer.Now()
+	defer func() { o.h.reading = 0 }()
+	return f()
+}
+
+func (o *tombstoneOrca) Get(req common.GetRequest) error {
+	return o.read(func() error { return o.Orca.Get(req) })
+}
+
+func (o *tombstoneOrca) GetE(req common.GetRequest) error {
+	return o.read(func() error { return o.Orca.GetE(req) })
+}
+
+func (o *tombstoneOrca) Gat(req common.GATRequest) error {
+	return o.read(func() error { return o.Orca.Gat(req) })
+}
+
+type tombstoneHandler struct {
+	handlers.Handler
+	t *tombstone.Set
+
+	// when the read being served started, or 0 outside of reads
+	reading uint64
+}
+
+// backfill does a write of key with f, guarded by the tombstones when it's a backfill
+func (h *tombstoneHandler) backfill(key []byte, f func() error) error {
+	if h.reading == 0 {
+		return f()
+	}
+	return h.t.Guard(key, h.reading, f, func() error {
+		return h.Handler.Delete(common.DeleteRequest{Key: key})
+	})
+}
+
+func (h *tombstoneHandler) Set(cmd common.SetRequest) error {
+	return h.backfill(cmd.Key, func() error { return h.Handler.Set(cmd) })
+}
+
+func (h *tombstoneHandler) Add(cmd common.SetRequest) error {
+	return h.backfill(cmd.Key, func() error { return h.Handler.Add(cmd) })
+}
+
+func (h *tombstoneHandler) Delete(cmd common.DeleteRequest) error {
+	h.t.Add(cmd.Key)
+	return h.Handler.Delete(cmd)
+}
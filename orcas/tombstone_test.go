@@ -0,0 +1,121 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol/binprot"
+	"github.com/netflix/rend/tombstone"
+)
+
+// mapL1 misses on every Get and records what is set in it
+type mapL1 struct {
+	handlers.Handler
+	data map[string]string
+}
+
+func (m mapL1) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	resChan := make(chan common.GetResponse, len(cmd.Keys))
+	errChan := make(chan error)
+	for i, k := range cmd.Keys {
+		resChan <- common.GetResponse{Key: k, Miss: true, Opaque: cmd.Opaques[i], Quiet: cmd.Quiet[i]}
+	}
+	close(resChan)
+	close(errChan)
+	return resChan, errChan
+}
+
+func (m mapL1) Set(cmd common.SetRequest) error {
+	m.data[string(cmd.Key)] = string(cmd.Data)
+	return nil
+}
+
+func (m mapL1) Delete(cmd common.DeleteRequest) error {
+	if _, ok := m.data[string(cmd.Key)]; !ok {
+		return common.ErrKeyNotFound
+	}
+	delete(m.data, string(cmd.Key))
+	return nil
+}
+
+// deletingL2 has the key deleted by another client while it is being read
+type deletingL2 struct {
+	staticL2
+	t *tombstone.Set
+}
+
+func (d deletingL2) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	for _, k := range cmd.Keys {
+		d.t.Add(k)
+	}
+	return d.staticL2.GetE(cmd)
+}
+
+func (d deletingL2) Set(cmd common.SetRequest) error       { return nil }
+func (d deletingL2) Delete(cmd common.DeleteRequest) error { return nil }
+
+func TestTombstones(t *testing.T) {
+	ts := tombstone.New(time.Minute, 100)
+	l1 := mapL1{data: make(map[string]string)}
+
+	get := func(l2 handlers.Handler, key string) {
+		w := bufio.NewWriter(new(bytes.Buffer))
+		o := orcas.Tombstones(orcas.L1L2, ts)(l1, l2, binprot.NewBinaryResponder(w))
+		err := o.Get(common.GetRequest{
+			Keys:    [][]byte{[]byte(key)},
+			Opaques: []uint32{0},
+			Quiet:   []bool{false},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	get(staticL2{data: "value"}, "kept")
+	if l1.data["kept"] != "value" {
+		t.Fatalf("Expected a normal get to backfill L1, got %v", l1.data)
+	}
+
+	get(deletingL2{staticL2: staticL2{data: "value"}, t: ts}, "deleted")
+	if _, ok := l1.data["deleted"]; ok {
+		t.Fatal("Expected a key deleted during the get not to be backfilled")
+	}
+
+	// Writes outside of gets aren't backfills and always go through
+	w := bufio.NewWriter(new(bytes.Buffer))
+	o := orcas.Tombstones(orcas.L1L2, ts)(l1, deletingL2{t: ts}, binprot.NewBinaryResponder(w))
+	if err := o.Set(common.SetRequest{Key: []byte("deleted"), Data: []byte("new")}); err != nil {
+		t.Fatal(err)
+	}
+	if l1.data["deleted"] != "new" {
+		t.Fatalf("Expected a set to write L1, got %v", l1.data)
+	}
+
+	if ts.Contains([]byte("kept")) {
+		t.Fatal("Expected no tombstone for a key that wasn't deleted")
+	}
+	l1.data["kept"] = "value"
+	o.Delete(common.DeleteRequest{Key: []byte("kept")})
+	if !ts.Contains([]byte("kept")) {
+		t.Fatal("Expected a delete through the orchestrator to record a tombstone")
+	}
+}
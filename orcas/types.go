@@ -245,3 +245,17 @@ var (
 	//HistGatSingleL1 = metrics.AddHistogram("gat_single_l1", false, nil) // not sampled until configurable
 	//HistGatSingleL2 = metrics.AddHistogram("gat_single_l2", false, nil) // not sampled until configurable
 )
+
+// Rolling hit ratios of every read (get, gete, and gat) overall and for each tier, so there's one
+// authoritative number instead of one derived from the counters by every dashboard
+func init() {
+	metrics.AddHitRatio("hit_ratio", metrics.Tags{"tier": "all"},
+		[]uint32{MetricCmdGetHits, MetricCmdGetEHits, MetricCmdGatHits},
+		[]uint32{MetricCmdGetMisses, MetricCmdGetEMisses, MetricCmdGatMisses})
+	metrics.AddHitRatio("hit_ratio", metrics.Tags{"tier": "l1"},
+		[]uint32{MetricCmdGetHitsL1, MetricCmdGetEHitsL1, MetricCmdGatHitsL1},
+		[]uint32{MetricCmdGetMissesL1, MetricCmdGetEMissesL1, MetricCmdGatMissesL1})
+	metrics.AddHitRatio("hit_ratio", metrics.Tags{"tier": "l2"},
+		[]uint32{MetricCmdGetHitsL2, MetricCmdGetEHitsL2, MetricCmdGatHitsL2},
+		[]uint32{MetricCmdGetMissesL2, MetricCmdGetEMissesL2, MetricCmdGatMissesL2})
+}
@@ -0,0 +1,125 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peer
+
+import (
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol"
+)
+
+// Orca wraps an orchestrator so every write, delete, or touch it completes successfully is
+// broadcast to the peer group. Wrapping the orchestrator rather than the L1 handler means internal
+// writes, like filling L1 from L2 on a miss, don't invalidate the peers.
+func (g *Group) Orca(oc orcas.OrcaConst) orcas.OrcaConst {
+	return func(l1, l2 handlers.Handler, res protocol.Responder) orcas.Orca {
+		return &broadcastOrca{
+			Orca: oc(l1, l2, res),
+			g:    g,
+		}
+	}
+}
+
+type broadcastOrca struct {
+	orcas.Orca
+	g *Group
+}
+
+func (b *broadcastOrca) written(key []byte, err error) error {
+	if err == nil {
+		b.g.Broadcast(OpDelete, key, 0)
+	}
+	return err
+}
+
+func (b *broadcastOrca) Set(req common.SetRequest) error {
+	return b.written(req.Key, b.Orca.Set(req))
+}
+
+func (b *broadcastOrca) Add(req common.SetRequest) error {
+	return b.written(req.Key, b.Orca.Add(req))
+}
+
+func (b *broadcastOrca) Replace(req common.SetRequest) error {
+	return b.written(req.Key, b.Orca.Replace(req))
+}
+
+func (b *broadcastOrca) Append(req common.SetRequest) error {
+	return b.written(req.Key, b.Orca.Append(req))
+}
+
+func (b *broadcastOrca) Prepend(req common.SetRequest) error {
+	return b.written(req.Key, b.Orca.Prepend(req))
+}
+
+func (b *broadcastOrca) Delete(req common.DeleteRequest) error {
+	return b.written(req.Key, b.Orca.Delete(req))
+}
+
+func (b *broadcastOrca) Touch(req common.TouchRequest) error {
+	err := b.Orca.Touch(req)
+	if err == nil {
+		b.g.Broadcast(OpTouch, req.Key, req.Exptime)
+	}
+	return err
+}
+
+func (b *broadcastOrca) Gat(req common.GATRequest) error {
+	err := b.Orca.Gat(req)
+	if err == nil {
+		b.g.Broadcast(OpTouch, req.Key, req.Exptime)
+	}
+	return err
+}
+
+func (b *broadcastOrca) SetIfMatch(req common.SetIfMatchRequest) error {
+	return b.written(req.Key, orcas.SetIfMatch(b.Orca, req))
+}
+
+func (b *broadcastOrca) CompareAndSwap(req common.CASRequest) error {
+	return b.written(req.Key, orcas.CompareAndSwap(b.Orca, req))
+}
+
+func (b *broadcastOrca) Gets(req common.GetRequest) error {
+	return orcas.Gets(b.Orca, req)
+}
+
+func (b *broadcastOrca) Incr(req common.ArithRequest) error {
+	return b.written(req.Key, orcas.Incr(b.Orca, req))
+}
+
+func (b *broadcastOrca) Decr(req common.ArithRequest) error {
+	return b.written(req.Key, orcas.Decr(b.Orca, req))
+}
+
+// Invalidations are for a single key, so flushes aren't broadcast and peers keep serving their L1
+// until it expires
+func (b *broadcastOrca) Flush(req common.FlushRequest) error {
+	return orcas.Flush(b.Orca, req)
+}
+
+func (b *broadcastOrca) Stats(req common.StatsRequest) error {
+	return orcas.Stats(b.Orca, req)
+}
+
+// Locks don't change values, so there's nothing to invalidate
+func (b *broadcastOrca) GetLock(req common.GetLockRequest) error {
+	return orcas.GetLock(b.Orca, req)
+}
+
+func (b *broadcastOrca) Unlock(req common.UnlockRequest) error {
+	return orcas.Unlock(b.Orca, req)
+}
@@ -0,0 +1,325 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package peer keeps the L1 tiers of a group of rend instances from serving stale data. When an
+// instance completes a write, delete, or touch for a client, it broadcasts an invalidation to its
+// peers over UDP (or over TCP with mutual TLS, see NewTLSGroup), and each peer applies it to its
+// own L1. Delivery is best effort: invalidations are dropped rather than slowing down requests, so
+// L1 TTLs should still bound staleness.
+package peer
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"sync/atomic"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricSent          = metrics.AddCounter("peer_invalidations_sent", nil)
+	MetricSendErrors    = metrics.AddCounter("peer_invalidations_send_errors", nil)
+	MetricDropped       = metrics.AddCounter("peer_invalidations_dropped", nil)
+	MetricReceived      = metrics.AddCounter("peer_invalidations_received", nil)
+	MetricApplied       = metrics.AddCounter("peer_invalidations_applied", nil)
+	MetricApplyErrors   = metrics.AddCounter("peer_invalidations_apply_errors", nil)
+	MetricLoops         = metrics.AddCounter("peer_invalidations_loops", nil)
+	MetricDuplicates    = metrics.AddCounter("peer_invalidations_duplicates", nil)
+	MetricInvalidPacket = metrics.AddCounter("peer_invalidations_invalid", nil)
+)
+
+// Op is the kind of invalidation
+type Op uint8
+
+const (
+	// OpDelete removes the key from L1. Writes are broadcast as deletes since the peer's copy is
+	// stale and the new value will be read through from L2.
+	OpDelete Op = iota + 1
+	// OpTouch updates the expiration time of the key in L1
+	OpTouch
+)
+
+const (
+	magic   = 0x52
+	version = 1
+
+	// magic, version, op, origin, sequence, exptime, key length
+	headerLen = 1 + 1 + 1 + 8 + 8 + 4 + 2
+
+	// number of recent invalidations remembered to drop duplicates
+	dedupSize = 4096
+
+	// invalidations waiting to be sent or applied before more are dropped
+	queueSize = 10000
+)
+
+var errInvalidPacket = errors.New("Invalid peer invalidation packet")
+
+type invalidation struct {
+	op      Op
+	origin  uint64
+	seq     uint64
+	exptime uint32
+	key     []byte
+}
+
+func (inv invalidation) encode() []byte {
+	buf := make([]byte, headerLen+len(inv.key))
+	buf[0] = magic
+	buf[1] = version
+	buf[2] = byte(inv.op)
+	binary.BigEndian.PutUint64(buf[3:], inv.origin)
+	binary.BigEndian.PutUint64(buf[11:], inv.seq)
+	binary.BigEndian.PutUint32(buf[19:], inv.exptime)
+	binary.BigEndian.PutUint16(buf[23:], uint16(len(inv.key)))
+	copy(buf[headerLen:], inv.key)
+	return buf
+}
+
+func decode(buf []byte) (invalidation, error) {
+	if len(buf) < headerLen || buf[0] != magic || buf[1] != version {
+		return invalidation{}, errInvalidPacket
+	}
+
+	inv := invalidation{
+		op:      Op(buf[2]),
+		origin:  binary.BigEndian.Uint64(buf[3:]),
+		seq:     binary.BigEndian.Uint64(buf[11:]),
+		exptime: binary.BigEndian.Uint32(buf[19:]),
+	}
+
+	keylen := int(binary.BigEndian.Uint16(buf[23:]))
+	if len(buf) != headerLen+keylen || keylen == 0 || (inv.op != OpDelete && inv.op != OpTouch) {
+		return invalidation{}, errInvalidPacket
+	}
+	inv.key = append([]byte(nil), buf[headerLen:]...)
+
+	return inv, nil
+}
+
+type dedupKey struct {
+	origin, seq uint64
+}
+
+// Group is this instance's membership in a peer group
+type Group struct {
+	// first to keep it 64-bit aligned for atomic access
+	seq uint64
+
+	id   uint64
+	addr net.Addr
+	l1   handlers.HandlerConst
+
+	// UDP transport
+	conn  net.PacketConn
+	peers []net.Addr
+
+	// TLS transport, see NewTLSGroup
+	tlsPeers []*tlsPeer
+	frames   chan []byte
+
+	outgoing chan []byte
+	incoming chan invalidation
+
+	// only used by the receive loop
+	seen     map[dedupKey]struct{}
+	seenRing []dedupKey
+	seenPos  int
+}
+
+// NewGroup listens for invalidations on the given UDP address and applies them to handlers made by
+// l1. Invalidations are sent to every peer address, which may include this instance's own address
+// (e.g. when every instance shares the same peer list); those are recognized and ignored.
+func NewGroup(listen string, peers []string, l1 handlers.HandlerConst) (*Group, error) {
+	addrs := make([]net.Addr, 0, len(peers))
+	for _, p := range peers {
+		addr, err := net.ResolveUDPAddr("udp", p)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+
+	conn, err := net.ListenPacket("udp", listen)
+	if err != nil {
+		return nil, err
+	}
+
+	g, err := newGroup(l1)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	g.addr = conn.LocalAddr()
+	g.conn = conn
+	g.peers = addrs
+
+	go g.send()
+	go g.receive()
+	go g.apply()
+
+	return g, nil
+}
+
+func newGroup(l1 handlers.HandlerConst) (*Group, error) {
+	var idbuf [8]byte
+	if _, err := rand.Read(idbuf[:]); err != nil {
+		return nil, err
+	}
+
+	return &Group{
+		id:       binary.BigEndian.Uint64(idbuf[:]),
+		l1:       l1,
+		outgoing: make(chan []byte, queueSize),
+		incoming: make(chan invalidation, queueSize),
+		seen:     make(map[dedupKey]struct{}, dedupSize),
+		seenRing: make([]dedupKey, dedupSize),
+	}, nil
+}
+
+// Addr returns the address the group is listening on
+func (g *Group) Addr() net.Addr {
+	return g.addr
+}
+
+// Broadcast queues an invalidation to be sent to every peer. It never blocks; if the queue is full
+// the invalidation is dropped.
+func (g *Group) Broadcast(op Op, key []byte, exptime uint32) {
+	if len(g.peers) == 0 && len(g.tlsPeers) == 0 {
+		return
+	}
+
+	inv := invalidation{
+		op:      op,
+		origin:  g.id,
+		seq:     atomic.AddUint64(&g.seq, 1),
+		exptime: exptime,
+		key:     key,
+	}
+
+	select {
+	case g.outgoing <- inv.encode():
+	default:
+		metrics.IncCounter(MetricDropped)
+	}
+}
+
+func (g *Group) send() {
+	for buf := range g.outgoing {
+		for _, p := range g.peers {
+			if _, err := g.conn.WriteTo(buf, p); err != nil {
+				metrics.IncCounter(MetricSendErrors)
+				continue
+			}
+			metrics.IncCounter(MetricSent)
+		}
+	}
+}
+
+func (g *Group) receive() {
+	buf := make([]byte, 64*1024)
+
+	for {
+		n, _, err := g.conn.ReadFrom(buf)
+		if err != nil {
+			log.Println("Error reading peer invalidations, stopping:", err.Error())
+			return
+		}
+
+		g.handle(buf[:n])
+	}
+}
+
+// handle decodes a received invalidation and queues it to be applied. It must only be called from
+// a single goroutine since it records what was seen.
+func (g *Group) handle(buf []byte) {
+	metrics.IncCounter(MetricReceived)
+
+	inv, err := decode(buf)
+	if err != nil {
+		metrics.IncCounter(MetricInvalidPacket)
+		return
+	}
+
+	// Our own broadcast coming back around
+	if inv.origin == g.id {
+		metrics.IncCounter(MetricLoops)
+		return
+	}
+
+	if g.duplicate(dedupKey{inv.origin, inv.seq}) {
+		metrics.IncCounter(MetricDuplicates)
+		return
+	}
+
+	select {
+	case g.incoming <- inv:
+	default:
+		metrics.IncCounter(MetricDropped)
+	}
+}
+
+// duplicate records k as seen and reports whether it already was
+func (g *Group) duplicate(k dedupKey) bool {
+	if _, ok := g.seen[k]; ok {
+		return true
+	}
+
+	delete(g.seen, g.seenRing[g.seenPos])
+	g.seenRing[g.seenPos] = k
+	g.seenPos = (g.seenPos + 1) % len(g.seenRing)
+	g.seen[k] = struct{}{}
+
+	return false
+}
+
+// apply runs received invalidations against the local L1. This uses the L1 handler directly instead
+// of going through an orchestrator, so applied invalidations are never broadcast again.
+func (g *Group) apply() {
+	var h handlers.Handler
+
+	for inv := range g.incoming {
+		if h == nil {
+			var err error
+			if h, err = g.l1(); err != nil {
+				log.Println("Error connecting to L1 to apply peer invalidations:", err.Error())
+				metrics.IncCounter(MetricApplyErrors)
+				continue
+			}
+		}
+
+		var err error
+		switch inv.op {
+		case OpDelete:
+			err = h.Delete(common.DeleteRequest{Key: inv.key})
+		case OpTouch:
+			err = h.Touch(common.TouchRequest{Key: inv.key, Exptime: inv.exptime})
+		}
+
+		switch err {
+		case nil, common.ErrKeyNotFound:
+			metrics.IncCounter(MetricApplied)
+		default:
+			log.Println("Error applying peer invalidation:", err.Error())
+			metrics.IncCounter(MetricApplyErrors)
+			h.Close()
+			h = nil
+		}
+	}
+}
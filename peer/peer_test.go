@@ -0,0 +1,131 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peer
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+// recordingHandler records the deletes and touches applied to it
+type recordingHandler struct {
+	handlers.Handler
+	sync.Mutex
+	deleted [][]byte
+	touched []common.TouchRequest
+}
+
+func (r *recordingHandler) Delete(cmd common.DeleteRequest) error {
+	r.Lock()
+	defer r.Unlock()
+	r.deleted = append(r.deleted, cmd.Key)
+	return nil
+}
+
+func (r *recordingHandler) Touch(cmd common.TouchRequest) error {
+	r.Lock()
+	defer r.Unlock()
+	r.touched = append(r.touched, cmd)
+	return common.ErrKeyNotFound
+}
+
+func (r *recordingHandler) counts() (int, int) {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.deleted), len(r.touched)
+}
+
+func TestEncodeDecode(t *testing.T) {
+	inv := invalidation{op: OpTouch, origin: 1, seq: 2, exptime: 3, key: []byte("foo")}
+	got, err := decode(inv.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.op != inv.op || got.origin != 1 || got.seq != 2 || got.exptime != 3 || !bytes.Equal(got.key, inv.key) {
+		t.Fatalf("Round trip mismatch: %+v", got)
+	}
+
+	buf := inv.encode()
+	if _, err := decode(buf[:len(buf)-1]); err != errInvalidPacket {
+		t.Fatal("Expected truncated packet to be invalid")
+	}
+	buf[2] = 0
+	if _, err := decode(buf); err != errInvalidPacket {
+		t.Fatal("Expected unknown op to be invalid")
+	}
+}
+
+func TestGroup(t *testing.T) {
+	ha, hb := &recordingHandler{}, &recordingHandler{}
+
+	a, err := NewGroup("127.0.0.1:0", nil, func() (handlers.Handler, error) { return ha, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewGroup("127.0.0.1:0", nil, func() (handlers.Handler, error) { return hb, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both use the same peer list including themselves
+	a.peers = []net.Addr{a.Addr(), b.Addr()}
+	b.peers = a.peers
+
+	a.Broadcast(OpDelete, []byte("foo"), 0)
+	a.Broadcast(OpTouch, []byte("bar"), 10)
+
+	for i := 0; i < 200; i++ {
+		if d, tc := hb.counts(); d == 1 && tc == 1 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if d, tc := hb.counts(); d != 1 || tc != 1 {
+		t.Fatalf("Expected one delete and one touch at peer, got %d and %d", d, tc)
+	}
+	if !bytes.Equal(hb.deleted[0], []byte("foo")) || hb.touched[0].Exptime != 10 {
+		t.Fatalf("Unexpected invalidations applied: %q %+v", hb.deleted, hb.touched)
+	}
+	if d, tc := ha.counts(); d != 0 || tc != 0 {
+		t.Fatal("Expected the sender to ignore its own invalidations")
+	}
+}
+
+func TestDuplicate(t *testing.T) {
+	g := &Group{
+		seen:     make(map[dedupKey]struct{}),
+		seenRing: make([]dedupKey, 2),
+	}
+
+	if g.duplicate(dedupKey{1, 1}) || g.duplicate(dedupKey{1, 2}) {
+		t.Fatal("Expected new invalidations not to be duplicates")
+	}
+	if !g.duplicate(dedupKey{1, 1}) {
+		t.Fatal("Expected a repeated invalidation to be a duplicate")
+	}
+
+	// the oldest is forgotten once the ring wraps
+	g.duplicate(dedupKey{1, 3})
+	if g.duplicate(dedupKey{1, 1}) {
+		t.Fatal("Expected the oldest invalidation to be forgotten")
+	}
+}
@@ -0,0 +1,438 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricTLSRejected     = metrics.AddCounter("peer_tls_rejected", nil)
+	MetricTLSReloads      = metrics.AddCounter("peer_tls_reloads", nil)
+	MetricTLSReloadErrors = metrics.AddCounter("peer_tls_reload_errors", nil)
+)
+
+const (
+	dialTimeout      = time.Second
+	redialInterval   = time.Second
+	writeTimeout     = time.Second
+	handshakeTimeout = 5 * time.Second
+
+	// invalidations waiting to be sent to a single peer before more are dropped
+	peerQueueSize = 1000
+)
+
+var errPeerNotAllowed = errors.New("Peer certificate has no allowed subject alternative name")
+
+// TLSConfig configures mutual TLS for peer traffic. Every peer presents a certificate signed by the
+// CA, and both sides of a connection check the other's certificate against AllowedSANs.
+type TLSConfig struct {
+	// PEM files for this instance's certificate and key, and the CA(s) peers must be signed by
+	CertFile string
+	KeyFile  string
+	CAFile   string
+
+	// Key, if set, returns the PEM private key instead of reading KeyFile, e.g. so the key can come
+	// from a secrets provider. It's called again on every reload check.
+	Key func() []byte
+
+	// Patterns (as in path.Match, e.g. "*.cache.example.com" or "spiffe://example.com/rend/*")
+	// matched against the DNS, IP, and URI subject alternative names of a peer's certificate. A
+	// peer is authorized if any of them match any pattern. Empty allows any certificate the CA
+	// signed.
+	AllowedSANs []string
+
+	// How often to check the files for changes so rotated certificates are picked up without a
+	// restart. Zero disables reloading.
+	Reload time.Duration
+}
+
+// credentials holds the current certificate and CA pool, reloading them when the files change.
+// Connections that are already established keep the credentials they were made with.
+type credentials struct {
+	conf TLSConfig
+
+	lock sync.RWMutex
+	cert *tls.Certificate
+	pool *x509.CertPool
+	mods [3]time.Time
+	key  []byte
+}
+
+func newCredentials(conf TLSConfig) (*credentials, error) {
+	if conf.CertFile == "" || (conf.KeyFile == "" && conf.Key == nil) || conf.CAFile == "" {
+		return nil, errors.New("Peer TLS needs a certificate, key, and CA file")
+	}
+	for _, p := range conf.AllowedSANs {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("Invalid allowed SAN pattern %q: %v", p, err)
+		}
+	}
+
+	c := &credentials{conf: conf}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	if conf.Reload > 0 {
+		go c.watch()
+	}
+
+	return c, nil
+}
+
+func (c *credentials) modTimes() ([3]time.Time, error) {
+	var mods [3]time.Time
+	for i, f := range []string{c.conf.CertFile, c.conf.KeyFile, c.conf.CAFile} {
+		if f == "" {
+			continue
+		}
+		fi, err := os.Stat(f)
+		if err != nil {
+			return mods, err
+		}
+		mods[i] = fi.ModTime()
+	}
+	return mods, nil
+}
+
+func (c *credentials) load() error {
+	mods, err := c.modTimes()
+	if err != nil {
+		return err
+	}
+
+	certPEM, err := ioutil.ReadFile(c.conf.CertFile)
+	if err != nil {
+		return err
+	}
+	var key []byte
+	if c.conf.Key != nil {
+		key = c.conf.Key()
+	} else if key, err = ioutil.ReadFile(c.conf.KeyFile); err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair(certPEM, key)
+	if err != nil {
+		return err
+	}
+
+	ca, err := ioutil.ReadFile(c.conf.CAFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return fmt.Errorf("No certificates found in CA file %s", c.conf.CAFile)
+	}
+
+	c.lock.Lock()
+	c.cert = &cert
+	c.pool = pool
+	c.mods = mods
+	c.key = key
+	c.lock.Unlock()
+
+	return nil
+}
+
+// watch reloads the credentials whenever one of the files changes. A failed reload, e.g. when the
+// files are caught halfway through being replaced, keeps the previous credentials and is retried
+// on the next check.
+func (c *credentials) watch() {
+	failing := false
+
+	for range time.Tick(c.conf.Reload) {
+		mods, err := c.modTimes()
+
+		c.lock.RLock()
+		changed := mods != c.mods || (c.conf.Key != nil && !bytes.Equal(c.conf.Key(), c.key))
+		c.lock.RUnlock()
+
+		if err == nil && !changed {
+			continue
+		}
+		if err == nil {
+			err = c.load()
+		}
+		if err != nil {
+			if !failing {
+				log.Println("Error reloading peer TLS credentials, keeping the current ones:", err.Error())
+				failing = true
+			}
+			metrics.IncCounter(MetricTLSReloadErrors)
+			continue
+		}
+
+		failing = false
+		log.Println("Reloaded peer TLS credentials")
+		metrics.IncCounter(MetricTLSReloads)
+	}
+}
+
+func (c *credentials) get() (*tls.Certificate, *x509.CertPool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.cert, c.pool
+}
+
+// authorize checks the peer's verified certificate against the allowed SANs
+func (c *credentials) authorize(cs tls.ConnectionState) error {
+	if len(c.conf.AllowedSANs) == 0 {
+		return nil
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return errPeerNotAllowed
+	}
+
+	leaf := cs.PeerCertificates[0]
+	sans := append([]string(nil), leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, u := range leaf.URIs {
+		sans = append(sans, u.String())
+	}
+
+	for _, san := range sans {
+		for _, p := range c.conf.AllowedSANs {
+			if ok, _ := path.Match(p, san); ok {
+				return nil
+			}
+		}
+	}
+
+	return errPeerNotAllowed
+}
+
+func (c *credentials) serverConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := c.get()
+			return &tls.Config{
+				Certificates:     []tls.Certificate{*cert},
+				ClientCAs:        pool,
+				ClientAuth:       tls.RequireAndVerifyClientCert,
+				MinVersion:       tls.VersionTLS12,
+				VerifyConnection: c.authorize,
+			}, nil
+		},
+	}
+}
+
+func (c *credentials) clientConfig(serverName string) *tls.Config {
+	cert, pool := c.get()
+	return &tls.Config{
+		Certificates:     []tls.Certificate{*cert},
+		RootCAs:          pool,
+		ServerName:       serverName,
+		MinVersion:       tls.VersionTLS12,
+		VerifyConnection: c.authorize,
+	}
+}
+
+// NewTLSGroup is like NewGroup, but invalidations travel over TCP connections secured with mutual
+// TLS instead of UDP. Each peer's certificate must be signed by the configured CA and have an
+// allowed SAN, and peers connecting to this instance are held to the same rules. The peer
+// addresses are host:port, and the host is also the name the peer's certificate is verified for.
+func NewTLSGroup(listen string, peers []string, l1 handlers.HandlerConst, conf TLSConfig) (*Group, error) {
+	creds, err := newCredentials(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	tpeers := make([]*tlsPeer, 0, len(peers))
+	for _, p := range peers {
+		host, _, err := net.SplitHostPort(p)
+		if err != nil {
+			return nil, err
+		}
+		tpeers = append(tpeers, &tlsPeer{
+			addr:       p,
+			serverName: host,
+			creds:      creds,
+			queue:      make(chan []byte, peerQueueSize),
+		})
+	}
+
+	ln, err := tls.Listen("tcp", listen, creds.serverConfig())
+	if err != nil {
+		return nil, err
+	}
+
+	g, err := newGroup(l1)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	g.addr = ln.Addr()
+	g.tlsPeers = tpeers
+	g.frames = make(chan []byte, queueSize)
+
+	for _, p := range tpeers {
+		go p.run()
+	}
+	go g.sendTLS()
+	go g.accept(ln)
+	go g.receiveTLS()
+	go g.apply()
+
+	return g, nil
+}
+
+// sendTLS fans invalidations out to the per-peer queues so one slow or unreachable peer doesn't
+// hold up the others
+func (g *Group) sendTLS() {
+	for buf := range g.outgoing {
+		for _, p := range g.tlsPeers {
+			select {
+			case p.queue <- buf:
+			default:
+				metrics.IncCounter(MetricDropped)
+			}
+		}
+	}
+}
+
+func (g *Group) accept(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Println("Error accepting peer connections, stopping:", err.Error())
+			return
+		}
+		go g.readTLS(conn.(*tls.Conn))
+	}
+}
+
+// readTLS reads invalidation frames from a peer connection. Invalidations are self delimiting, so
+// frames are just encoded invalidations back to back.
+func (g *Group) readTLS(conn *tls.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		log.Printf("Rejected peer connection from %s: %s", conn.RemoteAddr(), err.Error())
+		metrics.IncCounter(MetricTLSRejected)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	r := bufio.NewReader(conn)
+	for {
+		hdr := make([]byte, headerLen)
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return
+		}
+		// a stream that's out of step can't be recovered, so drop the connection
+		if hdr[0] != magic || hdr[1] != version {
+			metrics.IncCounter(MetricInvalidPacket)
+			return
+		}
+
+		buf := make([]byte, headerLen+int(binary.BigEndian.Uint16(hdr[23:])))
+		copy(buf, hdr)
+		if _, err := io.ReadFull(r, buf[headerLen:]); err != nil {
+			return
+		}
+
+		select {
+		case g.frames <- buf:
+		default:
+			metrics.IncCounter(MetricDropped)
+		}
+	}
+}
+
+// receiveTLS handles the frames read from all peer connections in one place so they share the
+// duplicate tracking
+func (g *Group) receiveTLS() {
+	for buf := range g.frames {
+		g.handle(buf)
+	}
+}
+
+type tlsPeer struct {
+	addr       string
+	serverName string
+	creds      *credentials
+	queue      chan []byte
+}
+
+// run keeps a connection to the peer and writes queued invalidations to it, reconnecting after
+// errors. While the peer can't be reached, invalidations are dropped.
+func (p *tlsPeer) run() {
+	var (
+		conn     *tls.Conn
+		w        *bufio.Writer
+		lastDial time.Time
+		failing  bool
+	)
+
+	for buf := range p.queue {
+		if conn == nil {
+			if time.Since(lastDial) < redialInterval {
+				metrics.IncCounter(MetricSendErrors)
+				continue
+			}
+			lastDial = time.Now()
+
+			var err error
+			conn, err = tls.DialWithDialer(&net.Dialer{Timeout: dialTimeout}, "tcp", p.addr, p.creds.clientConfig(p.serverName))
+			if err != nil {
+				if !failing {
+					log.Printf("Error connecting to peer %s: %s", p.addr, err.Error())
+					failing = true
+				}
+				metrics.IncCounter(MetricSendErrors)
+				conn = nil
+				continue
+			}
+			failing = false
+			w = bufio.NewWriter(conn)
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		_, err := w.Write(buf)
+		// batch up writes while there are more waiting
+		if err == nil && len(p.queue) == 0 {
+			err = w.Flush()
+		}
+		if err != nil {
+			metrics.IncCounter(MetricSendErrors)
+			conn.Close()
+			conn = nil
+			continue
+		}
+
+		metrics.IncCounter(MetricSent)
+	}
+}
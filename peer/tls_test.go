@@ -0,0 +1,245 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package peer
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/handlers"
+)
+
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+	dir    string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	ca := &testCA{cert: cert, key: key, serial: 1, dir: t.TempDir()}
+	writePEM(t, filepath.Join(ca.dir, "ca.pem"), "CERTIFICATE", der)
+	return ca
+}
+
+func writePEM(t *testing.T, file, typ string, der []byte) {
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// issue writes a certificate for 127.0.0.1 with the given URI SAN and returns its config
+func (ca *testCA) issue(t *testing.T, name, uri string) TLSConfig {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(uri)
+
+	ca.serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		URIs:         []*url.URL{u},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := TLSConfig{
+		CertFile:    filepath.Join(ca.dir, name+".pem"),
+		KeyFile:     filepath.Join(ca.dir, name+"-key.pem"),
+		CAFile:      filepath.Join(ca.dir, "ca.pem"),
+		AllowedSANs: []string{"spiffe://rend/peer/*"},
+	}
+	writePEM(t, conf.CertFile, "CERTIFICATE", der)
+	writePEM(t, conf.KeyFile, "EC PRIVATE KEY", keyDer)
+	return conf
+}
+
+func waitCounts(h *recordingHandler, deletes int) int {
+	for i := 0; i < 200; i++ {
+		if d, _ := h.counts(); d >= deletes {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	d, _ := h.counts()
+	return d
+}
+
+func TestTLSGroup(t *testing.T) {
+	ca := newTestCA(t)
+	ha, hb := &recordingHandler{}, &recordingHandler{}
+
+	b, err := NewTLSGroup("127.0.0.1:0", nil, func() (handlers.Handler, error) { return hb, nil },
+		ca.issue(t, "b", "spiffe://rend/peer/b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewTLSGroup("127.0.0.1:0", []string{b.Addr().String()}, func() (handlers.Handler, error) { return ha, nil },
+		ca.issue(t, "a", "spiffe://rend/peer/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.Broadcast(OpDelete, []byte("foo"), 0)
+	a.Broadcast(OpDelete, []byte("bar"), 0)
+
+	if d := waitCounts(hb, 2); d != 2 {
+		t.Fatalf("Expected two deletes at peer, got %d", d)
+	}
+	if !bytes.Equal(hb.deleted[0], []byte("foo")) || !bytes.Equal(hb.deleted[1], []byte("bar")) {
+		t.Fatalf("Unexpected invalidations applied: %q", hb.deleted)
+	}
+
+	// a peer signed by the CA but without an allowed SAN can't send invalidations
+	c, err := NewTLSGroup("127.0.0.1:0", []string{b.Addr().String()}, func() (handlers.Handler, error) { return ha, nil },
+		ca.issue(t, "c", "spiffe://rend/other/c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Broadcast(OpDelete, []byte("baz"), 0)
+	time.Sleep(100 * time.Millisecond)
+
+	if d, _ := hb.counts(); d != 2 {
+		t.Fatalf("Expected invalidations from an unauthorized peer to be rejected, got %d deletes", d)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	c := &credentials{conf: TLSConfig{AllowedSANs: []string{"*.cache.example.com", "10.0.0.1"}}}
+
+	cases := []struct {
+		cert *x509.Certificate
+		ok   bool
+	}{
+		{&x509.Certificate{DNSNames: []string{"a.cache.example.com"}}, true},
+		{&x509.Certificate{DNSNames: []string{"a.web.example.com"}}, false},
+		{&x509.Certificate{IPAddresses: []net.IP{net.ParseIP("10.0.0.1")}}, true},
+		{&x509.Certificate{IPAddresses: []net.IP{net.ParseIP("10.0.0.2")}}, false},
+		{&x509.Certificate{}, false},
+	}
+	for i, tc := range cases {
+		err := c.authorize(tls.ConnectionState{PeerCertificates: []*x509.Certificate{tc.cert}})
+		if (err == nil) != tc.ok {
+			t.Errorf("Case %d: expected authorized %v, got %v", i, tc.ok, err)
+		}
+	}
+
+	if err := (&credentials{}).authorize(tls.ConnectionState{}); err != nil {
+		t.Fatal("Expected no allowed SANs to allow any peer, got", err)
+	}
+}
+
+func TestCredentialsReload(t *testing.T) {
+	ca := newTestCA(t)
+	conf := ca.issue(t, "a", "spiffe://rend/peer/a")
+	conf.Reload = 5 * time.Millisecond
+
+	c, err := newCredentials(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := c.get()
+
+	// a bad certificate keeps the current one
+	if err := ioutil.WriteFile(conf.CertFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(conf.CertFile, future, future)
+	time.Sleep(50 * time.Millisecond)
+	if cert, _ := c.get(); cert != first {
+		t.Fatal("Expected a failed reload to keep the current certificate")
+	}
+
+	ca.issue(t, "a", "spiffe://rend/peer/a")
+	future = future.Add(time.Minute)
+	os.Chtimes(conf.CertFile, future, future)
+	os.Chtimes(conf.KeyFile, future, future)
+
+	for i := 0; i < 200; i++ {
+		if cert, _ := c.get(); cert != first {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("Expected the rotated certificate to be loaded")
+}
+
+func TestCredentialsKeySource(t *testing.T) {
+	ca := newTestCA(t)
+	conf := ca.issue(t, "a", "spiffe://rend/peer/a")
+
+	key, err := ioutil.ReadFile(conf.KeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(conf.KeyFile)
+	conf.KeyFile = ""
+	conf.Key = func() []byte { return key }
+
+	c, err := newCredentials(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, _ := c.get(); cert == nil {
+		t.Fatal("Expected the key from the source to be loaded")
+	}
+}
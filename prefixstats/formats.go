@@ -0,0 +1,248 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prefixstats
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Format is the serialization format of a value, as guessed from its bytes
+type Format int
+
+const (
+	// FormatBinary is anything that isn't recognized as one of the others
+	FormatBinary Format = iota
+	FormatEmpty
+	FormatGzip
+	FormatZstd
+	FormatJavaSerialized
+	FormatJSON
+	FormatMsgpack
+	FormatProtobuf
+	// FormatText is printable UTF-8 that isn't JSON
+	FormatText
+
+	numFormats
+)
+
+var formatNames = [numFormats]string{"binary", "empty", "gzip", "zstd", "java", "json", "msgpack", "protobuf", "text"}
+
+func (f Format) String() string {
+	return formatNames[f]
+}
+
+// Compressed returns whether values in the format are already compressed
+func (f Format) Compressed() bool {
+	return f == FormatGzip || f == FormatZstd
+}
+
+// maxNesting bounds how deep the msgpack check goes into nested values
+const maxNesting = 16
+
+// Detect guesses the format of a value. Compressed and Java serialized values start with magic
+// bytes. JSON, msgpack, and protobuf don't, so a value is only taken to be one of those if it
+// parses as one from start to end. A value can be valid in more than one, so the stricter formats
+// are tried first: short text often happens to be a well formed protobuf message, but a protobuf
+// message is rarely free of control characters.
+func Detect(data []byte) Format {
+	switch {
+	case len(data) == 0:
+		return FormatEmpty
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		return FormatGzip
+	case bytes.HasPrefix(data, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return FormatZstd
+	case bytes.HasPrefix(data, []byte{0xac, 0xed, 0x00, 0x05}):
+		return FormatJavaSerialized
+	case isJSON(data):
+		return FormatJSON
+	case isMsgpack(data):
+		return FormatMsgpack
+	case isText(data):
+		return FormatText
+	case isProtobuf(data):
+		return FormatProtobuf
+	}
+	return FormatBinary
+}
+
+// isJSON only counts objects and arrays, since a bare number or string is more likely to be a
+// counter or plain text than a serialized structure
+func isJSON(data []byte) bool {
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+	if len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') {
+		return false
+	}
+	return json.Valid(data)
+}
+
+// isMsgpack only counts maps and arrays, for the same reason as isJSON
+func isMsgpack(data []byte) bool {
+	b := data[0]
+	if !(b >= 0x80 && b <= 0x9f) && b != 0xdc && b != 0xdd && b != 0xde && b != 0xdf {
+		return false
+	}
+	n, ok := skipMsgpack(data, 0)
+	return ok && n == len(data)
+}
+
+// skipMsgpack returns the length of the msgpack value at the start of data
+func skipMsgpack(data []byte, depth int) (int, bool) {
+	if len(data) == 0 || depth > maxNesting {
+		return 0, false
+	}
+
+	b := data[0]
+	var head, length, items int
+
+	switch {
+	case b <= 0x7f || b >= 0xe0 || b == 0xc0 || b == 0xc2 || b == 0xc3:
+		// fixint and nil, false, true
+		return 1, true
+	case b >= 0x80 && b <= 0x8f:
+		head, items = 1, 2*int(b&0x0f)
+	case b >= 0x90 && b <= 0x9f:
+		head, items = 1, int(b&0x0f)
+	case b >= 0xa0 && b <= 0xbf:
+		head, length = 1, int(b&0x1f)
+	case b == 0xcc || b == 0xd0:
+		head = 2
+	case b == 0xcd || b == 0xd1:
+		head = 3
+	case b == 0xca || b == 0xce || b == 0xd2:
+		head = 5
+	case b == 0xcb || b == 0xcf || b == 0xd3:
+		head = 9
+	case b >= 0xd4 && b <= 0xd8:
+		// fixext, with a type byte and 1 to 16 bytes of data
+		head = 2 + 1<<(b-0xd4)
+	case b == 0xc4 || b == 0xc7 || b == 0xd9:
+		if len(data) < 2 {
+			return 0, false
+		}
+		head, length = 2, int(data[1])
+		if b == 0xc7 {
+			head++
+		}
+	case b == 0xc5 || b == 0xc8 || b == 0xda || b == 0xdc || b == 0xde:
+		if len(data) < 3 {
+			return 0, false
+		}
+		head = 3
+		n := int(binary.BigEndian.Uint16(data[1:]))
+		switch b {
+		case 0xdc:
+			items = n
+		case 0xde:
+			items = 2 * n
+		case 0xc8:
+			head, length = 4, n
+		default:
+			length = n
+		}
+	case b == 0xc6 || b == 0xc9 || b == 0xdb || b == 0xdd || b == 0xdf:
+		if len(data) < 5 {
+			return 0, false
+		}
+		head = 5
+		n := int(binary.BigEndian.Uint32(data[1:]))
+		if n < 0 || n > len(data) {
+			return 0, false
+		}
+		switch b {
+		case 0xdd:
+			items = n
+		case 0xdf:
+			items = 2 * n
+		case 0xc9:
+			head, length = 6, n
+		default:
+			length = n
+		}
+	default:
+		// 0xc1 is never used
+		return 0, false
+	}
+
+	pos := head + length
+	if pos > len(data) {
+		return 0, false
+	}
+	for i := 0; i < items; i++ {
+		n, ok := skipMsgpack(data[pos:], depth+1)
+		if !ok {
+			return 0, false
+		}
+		pos += n
+	}
+	return pos, true
+}
+
+func isText(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	for _, r := range string(data) {
+		if unicode.IsControl(r) && r != '\t' && r != '\r' && r != '\n' {
+			return false
+		}
+	}
+	return true
+}
+
+// isProtobuf returns whether data is a sequence of well formed protobuf fields. The contents of
+// length delimited fields aren't checked, since strings, bytes, and nested messages all look alike.
+func isProtobuf(data []byte) bool {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 || tag>>3 == 0 || tag>>3 > 1<<29-1 {
+			return false
+		}
+		data = data[n:]
+
+		switch tag & 7 {
+		case 0:
+			if _, n = binary.Uvarint(data); n <= 0 {
+				return false
+			}
+			data = data[n:]
+		case 1:
+			if len(data) < 8 {
+				return false
+			}
+			data = data[8:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return false
+			}
+			data = data[n+int(length):]
+		case 5:
+			if len(data) < 4 {
+				return false
+			}
+			data = data[4:]
+		default:
+			// the group wire types are long deprecated
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,71 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prefixstats
+
+import (
+	"math"
+	"math/bits"
+)
+
+// precision is the number of hash bits that pick a register, which gives a standard error of
+// about 1.6% for 4KB per sketch
+const precision = 12
+
+const registers = 1 << precision
+
+// hll is a HyperLogLog sketch of the distinct hashes added to it
+type hll [registers]uint8
+
+func (h *hll) add(hash uint64) {
+	idx := hash >> (64 - precision)
+	// the position of the first set bit after the index bits, with a sentinel bit so it's bounded
+	rank := uint8(bits.LeadingZeros64(hash<<precision|1<<(precision-1))) + 1
+	if rank > h[idx] {
+		h[idx] = rank
+	}
+}
+
+// estimate is the usual HyperLogLog estimate, with linear counting for small cardinalities where
+// the raw estimate is biased
+func (h *hll) estimate() float64 {
+	sum := 0.0
+	zeros := 0
+	for _, r := range h {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	m := float64(registers)
+	alpha := 0.7213 / (1 + 1.079/m)
+	est := alpha * m * m / sum
+
+	if est <= 2.5*m && zeros > 0 {
+		return m * math.Log(m/float64(zeros))
+	}
+	return est
+}
+
+// mix spreads the bits of an FNV hash, whose high bits depend too little on the last bytes of
+// the key for a sketch that indexes on them. It's the splitmix64 finalizer.
+func mix(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
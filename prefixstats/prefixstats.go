@@ -0,0 +1,285 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package prefixstats estimates how many keys and bytes each key prefix takes up, from the writes
+// seen in traffic. Backends only report totals for a whole pool, which doesn't say which of the
+// applications sharing it is using the capacity.
+//
+// Keys are sampled by hash, so a sampled key is always sampled, and each prefix keeps a
+// HyperLogLog sketch of its sampled keys along with the average size of its sampled writes. The
+// key count is the sketch's estimate scaled up by the sample rate, and the byte count is that
+// times the average size. Both are counts of what was written since the tracker started or was
+// last reset: deletes and expirations don't take anything away, so with TTLs much shorter than
+// that time they overestimate what's actually stored.
+//
+// Sampled values are also classified by their serialization format, as guessed by Detect, which
+// shows the prefixes whose values are stored as uncompressed JSON and the like.
+package prefixstats
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/logging"
+	"github.com/netflix/rend/metrics"
+)
+
+// OtherPrefix collects the keys of prefixes seen after MaxPrefixes were already being tracked
+const OtherPrefix = "(other)"
+
+// Config is how keys are grouped into prefixes and how many of them are sampled
+type Config struct {
+	// The prefix of a key is everything up to and including the Depth-th Delimiter. Keys with
+	// fewer delimiters than that are their own prefix, up to the last delimiter they have, or the
+	// empty prefix if they have none.
+	Delimiter byte
+	Depth     int
+	// Fraction of keys (0 to 1] sampled
+	SampleRate float64
+	// At most this many prefixes are tracked
+	MaxPrefixes int
+}
+
+type prefix struct {
+	sketch  hll
+	writes  uint64
+	bytes   uint64
+	formats [numFormats]struct{ writes, bytes uint64 }
+}
+
+// Stat is the estimated footprint of one prefix
+type Stat struct {
+	Prefix string
+	Keys   uint64
+	Bytes  uint64
+	// Formats are the estimated writes and value bytes written in each format seen under the
+	// prefix, most bytes first
+	Formats []FormatStat
+}
+
+// FormatStat is how much was written under a prefix in one format
+type FormatStat struct {
+	Format Format
+	Writes uint64
+	Bytes  uint64
+}
+
+// Tracker keeps the per prefix estimates. It implements server.RequestObserver, and serves its
+// current estimates over HTTP.
+type Tracker struct {
+	conf      Config
+	threshold uint32
+
+	lock     sync.Mutex
+	prefixes map[string]*prefix
+}
+
+// New creates a tracker and reports its estimates in the prefix_keys and prefix_bytes metrics,
+// tagged with the prefix, and the prefix_format_writes and prefix_format_bytes metrics, tagged with
+// the prefix and the format
+func New(c Config) *Tracker {
+	if c.Depth < 1 {
+		c.Depth = 1
+	}
+
+	threshold := ^uint32(0)
+	if c.SampleRate < 1 {
+		threshold = uint32(c.SampleRate * float64(^uint32(0)))
+	}
+	if threshold == 0 {
+		threshold = 1
+	}
+
+	t := &Tracker{
+		conf:      c,
+		threshold: threshold,
+		prefixes:  make(map[string]*prefix),
+	}
+
+	metrics.RegisterBulkCallback(t.metrics)
+
+	return t
+}
+
+func (t *Tracker) Observe(req common.Request, reqType common.RequestType) {
+	switch reqType {
+	case common.RequestSet, common.RequestAdd, common.RequestReplace:
+		set := req.(common.SetRequest)
+		t.offer(set.Key, set.Data)
+	case common.RequestSetIfMatch:
+		set := req.(common.SetIfMatchRequest)
+		t.offer(set.Key, set.Data)
+	case common.RequestCAS:
+		set := req.(common.CASRequest)
+		t.offer(set.Key, set.Data)
+	case common.RequestMultiSet:
+		for _, set := range req.(common.MultiSetRequest).Sets {
+			t.offer(set.Key, set.Data)
+		}
+	}
+}
+
+func (t *Tracker) offer(key, data []byte) {
+	h := fnv.New64a()
+	h.Write(key)
+	hash := mix(h.Sum64())
+
+	// the low bits decide the sample and the high bits go into the sketch
+	if uint32(hash) > t.threshold {
+		return
+	}
+
+	p := t.prefixOf(key)
+	format := Detect(data)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	ps, ok := t.prefixes[string(p)]
+	if !ok {
+		name := string(p)
+		if len(t.prefixes) >= t.conf.MaxPrefixes {
+			name = OtherPrefix
+		}
+		if ps, ok = t.prefixes[name]; !ok {
+			ps = new(prefix)
+			t.prefixes[name] = ps
+		}
+	}
+
+	ps.sketch.add(hash)
+	ps.writes++
+	ps.bytes += uint64(len(key) + len(data))
+	ps.formats[format].writes++
+	ps.formats[format].bytes += uint64(len(data))
+}
+
+func (t *Tracker) prefixOf(key []byte) []byte {
+	end := 0
+	for i := 0; i < t.conf.Depth; i++ {
+		idx := bytes.IndexByte(key[end:], t.conf.Delimiter)
+		if idx < 0 {
+			break
+		}
+		end += idx + 1
+	}
+	return key[:end]
+}
+
+// Stats returns the current estimates, sorted by prefix
+func (t *Tracker) Stats() []Stat {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	scale := float64(^uint32(0)) / float64(t.threshold)
+
+	stats := make([]Stat, 0, len(t.prefixes))
+	for name, ps := range t.prefixes {
+		keys := ps.sketch.estimate() * scale
+		s := Stat{
+			Prefix: name,
+			Keys:   uint64(keys + 0.5),
+			Bytes:  uint64(keys*float64(ps.bytes)/float64(ps.writes) + 0.5),
+		}
+
+		for f, fs := range ps.formats {
+			if fs.writes > 0 {
+				s.Formats = append(s.Formats, FormatStat{
+					Format: Format(f),
+					Writes: uint64(float64(fs.writes)*scale + 0.5),
+					Bytes:  uint64(float64(fs.bytes)*scale + 0.5),
+				})
+			}
+		}
+		sort.SliceStable(s.Formats, func(i, j int) bool { return s.Formats[i].Bytes > s.Formats[j].Bytes })
+
+		stats = append(stats, s)
+	}
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Prefix < stats[j].Prefix })
+
+	return stats
+}
+
+// Reset forgets every prefix
+func (t *Tracker) Reset() {
+	t.lock.Lock()
+	t.prefixes = make(map[string]*prefix)
+	t.lock.Unlock()
+}
+
+func (t *Tracker) metrics() ([]metrics.IntMetric, []metrics.FloatMetric) {
+	stats := t.Stats()
+
+	ret := make([]metrics.IntMetric, 0, 2*len(stats))
+	for _, s := range stats {
+		tags := metrics.Tags{"prefix": reported(s.Prefix)}
+		ret = append(ret,
+			metrics.IntMetric{Name: "prefix_keys", Val: s.Keys, Tgs: tags},
+			metrics.IntMetric{Name: "prefix_bytes", Val: s.Bytes, Tgs: tags},
+		)
+
+		for _, f := range s.Formats {
+			ftags := metrics.Tags{"prefix": tags["prefix"], "format": f.Format.String()}
+			ret = append(ret,
+				metrics.IntMetric{Name: "prefix_format_writes", Val: f.Writes, Tgs: ftags},
+				metrics.IntMetric{Name: "prefix_format_bytes", Val: f.Bytes, Tgs: ftags},
+			)
+		}
+	}
+
+	return ret, nil
+}
+
+// ServeHTTP shows the estimates, one prefix per line with the share of value bytes in each format.
+// A POST resets them.
+func (t *Tracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		t.Reset()
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	for _, s := range t.Stats() {
+		var total uint64
+		for _, f := range s.Formats {
+			total += f.Bytes
+		}
+
+		formats := make([]string, 0, len(s.Formats))
+		for _, f := range s.Formats {
+			share := 0.0
+			if total > 0 {
+				share = 100 * float64(f.Bytes) / float64(total)
+			}
+			formats = append(formats, fmt.Sprintf("%v:%.0f%%", f.Format, share))
+		}
+
+		fmt.Fprintf(w, "%q keys=%d bytes=%d formats=%s\n", reported(s.Prefix), s.Keys, s.Bytes, strings.Join(formats, ","))
+	}
+}
+
+// reported is how a prefix appears outside the process. Prefixes are the start of keys, so they go
+// through logging.Key like keys do, except for the ones that aren't taken from a key.
+func reported(prefix string) string {
+	if prefix == "" || prefix == OtherPrefix {
+		return prefix
+	}
+	return logging.Key([]byte(prefix))
+}
@@ -0,0 +1,143 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prefixstats_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/prefixstats"
+)
+
+func set(t *prefixstats.Tracker, key string, size int) {
+	t.Observe(common.SetRequest{Key: []byte(key), Data: make([]byte, size)}, common.RequestSet)
+}
+
+func within(t *testing.T, what string, got, want uint64, tolerance float64) {
+	if math.Abs(float64(got)-float64(want)) > tolerance*float64(want) {
+		t.Errorf("Expected %s to be about %d, got %d", what, want, got)
+	}
+}
+
+func TestEstimates(t *testing.T) {
+	tr := prefixstats.New(prefixstats.Config{Delimiter: ':', Depth: 2, SampleRate: 1, MaxPrefixes: 10})
+
+	for i := 0; i < 20000; i++ {
+		// every key is written twice, which counts once
+		set(tr, fmt.Sprintf("catalog:v3:%d", i), 90)
+		set(tr, fmt.Sprintf("catalog:v3:%d", i), 90)
+	}
+	for i := 0; i < 300; i++ {
+		set(tr, fmt.Sprintf("user:%d", i), 10)
+	}
+	set(tr, "bare", 0)
+
+	stats := tr.Stats()
+	if len(stats) != 3 || stats[0].Prefix != "" || stats[1].Prefix != "catalog:v3:" || stats[2].Prefix != "user:" {
+		t.Fatalf("Expected the empty, catalog:v3: and user: prefixes, got %+v", stats)
+	}
+
+	within(t, "catalog keys", stats[1].Keys, 20000, 0.05)
+	// keys are about 15 bytes each
+	within(t, "catalog bytes", stats[1].Bytes, 20000*105, 0.05)
+	within(t, "user keys", stats[2].Keys, 300, 0.02)
+
+	tr.Reset()
+	if stats := tr.Stats(); len(stats) != 0 {
+		t.Fatalf("Expected no prefixes after a reset, got %+v", stats)
+	}
+}
+
+func TestSampled(t *testing.T) {
+	tr := prefixstats.New(prefixstats.Config{Delimiter: ':', Depth: 1, SampleRate: 0.1, MaxPrefixes: 10})
+
+	for i := 0; i < 200000; i++ {
+		set(tr, fmt.Sprintf("catalog:%d", i), 100)
+	}
+
+	stats := tr.Stats()
+	if len(stats) != 1 {
+		t.Fatalf("Expected one prefix, got %+v", stats)
+	}
+	within(t, "sampled keys", stats[0].Keys, 200000, 0.1)
+}
+
+func TestMaxPrefixes(t *testing.T) {
+	tr := prefixstats.New(prefixstats.Config{Delimiter: ':', Depth: 1, SampleRate: 1, MaxPrefixes: 2})
+
+	for _, p := range []string{"a", "b", "c", "d"} {
+		set(tr, p+":key", 1)
+	}
+
+	stats := tr.Stats()
+	if len(stats) != 3 || stats[0].Prefix != prefixstats.OtherPrefix || stats[0].Keys != 2 {
+		t.Fatalf("Expected 2 prefixes and 2 other keys, got %+v", stats)
+	}
+}
+
+func TestDetect(t *testing.T) {
+	gz := new(bytes.Buffer)
+	w := gzip.NewWriter(gz)
+	w.Write([]byte(`{"a":1}`))
+	w.Close()
+
+	for _, c := range []struct {
+		data   []byte
+		format prefixstats.Format
+	}{
+		{nil, prefixstats.FormatEmpty},
+		{gz.Bytes(), prefixstats.FormatGzip},
+		{[]byte{0x28, 0xb5, 0x2f, 0xfd, 0x20, 0x01}, prefixstats.FormatZstd},
+		{[]byte{0xac, 0xed, 0x00, 0x05, 0x73, 0x72}, prefixstats.FormatJavaSerialized},
+		{[]byte(` {"user": 1234, "tags": ["a", "b"]}`), prefixstats.FormatJSON},
+		// {"a": 1, "b": [true, "xy"]}
+		{[]byte{0x82, 0xa1, 'a', 0x01, 0xa1, 'b', 0x92, 0xc3, 0xa2, 'x', 'y'}, prefixstats.FormatMsgpack},
+		// field 1 = 150, field 2 = "abc"
+		{[]byte{0x08, 0x96, 0x01, 0x12, 0x03, 'a', 'b', 'c'}, prefixstats.FormatProtobuf},
+		{[]byte("1234"), prefixstats.FormatText},
+		{[]byte("hello world\n"), prefixstats.FormatText},
+		{[]byte(`{"truncated": `), prefixstats.FormatText},
+		{[]byte{0x82, 0xa1, 'a'}, prefixstats.FormatBinary},
+		{[]byte{0xff, 0x00, 0x07}, prefixstats.FormatBinary},
+	} {
+		if f := prefixstats.Detect(c.data); f != c.format {
+			t.Errorf("Expected %q to be detected as %v, got %v", c.data, c.format, f)
+		}
+	}
+}
+
+func TestFormats(t *testing.T) {
+	tr := prefixstats.New(prefixstats.Config{Delimiter: ':', Depth: 1, SampleRate: 1, MaxPrefixes: 10})
+
+	for i := 0; i < 10; i++ {
+		tr.Observe(common.SetRequest{Key: []byte(fmt.Sprintf("user:%d", i)), Data: []byte(`{"name": "someone"}`)}, common.RequestSet)
+	}
+	tr.Observe(common.SetRequest{Key: []byte("user:x"), Data: []byte{0x1f, 0x8b, 0x08}}, common.RequestSet)
+
+	stats := tr.Stats()
+	if len(stats) != 1 || len(stats[0].Formats) != 2 {
+		t.Fatalf("Expected one prefix with two formats, got %+v", stats)
+	}
+	if f := stats[0].Formats[0]; f.Format != prefixstats.FormatJSON || f.Writes != 10 || f.Bytes != 190 {
+		t.Fatalf("Expected the JSON writes first, got %+v", f)
+	}
+	if f := stats[0].Formats[1]; f.Format != prefixstats.FormatGzip || f.Writes != 1 || f.Bytes != 3 {
+		t.Fatalf("Expected the gzip write second, got %+v", f)
+	}
+}
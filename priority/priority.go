@@ -0,0 +1,169 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package priority keeps low priority traffic, like batch jobs and cache warming, from degrading
+// interactive traffic that goes through the same instance. Backend access is limited to a fixed
+// number of concurrent operations, and when all of them are in use the waiting operations are
+// let through in priority order. Below saturation nothing waits and priorities make no difference.
+package priority
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/metrics"
+)
+
+// Class is a traffic class. Lower values have higher priority.
+type Class int
+
+const (
+	// Interactive traffic is served first
+	Interactive Class = iota
+	// Batch traffic is only served when no interactive traffic is waiting
+	Batch
+
+	numClasses
+)
+
+func (c Class) String() string {
+	switch c {
+	case Interactive:
+		return "interactive"
+	case Batch:
+		return "batch"
+	}
+	return "unknown"
+}
+
+// ParseClass is the inverse of Class.String
+func ParseClass(s string) (Class, error) {
+	switch s {
+	case "interactive":
+		return Interactive, nil
+	case "batch":
+		return Batch, nil
+	}
+	return Interactive, fmt.Errorf("Unknown traffic class %q", s)
+}
+
+var (
+	metricWaits [numClasses]uint32
+	histWaits   [numClasses]uint32
+)
+
+func init() {
+	for c := Class(0); c < numClasses; c++ {
+		tags := metrics.Tags{"class": c.String()}
+		metricWaits[c] = metrics.AddCounter("priority_waits", tags)
+		histWaits[c] = metrics.AddHistogram("priority_wait", false, tags)
+	}
+}
+
+// Scheduler hands out a fixed number of slots for backend operations
+type Scheduler struct {
+	lock    sync.Mutex
+	free    int
+	waiting [numClasses][]chan struct{}
+}
+
+// NewScheduler creates a scheduler allowing the given number of concurrent operations
+func NewScheduler(concurrency int) *Scheduler {
+	s := &Scheduler{free: concurrency}
+
+	for c := Class(0); c < numClasses; c++ {
+		c := c
+		metrics.RegisterIntGaugeCallback("priority_queue_depth", metrics.Tags{"class": c.String()}, func() uint64 {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			return uint64(len(s.waiting[c]))
+		})
+	}
+
+	return s
+}
+
+// Acquire waits for a slot. Every Acquire must be followed by a Release.
+func (s *Scheduler) Acquire(c Class) {
+	s.lock.Lock()
+	if s.free > 0 {
+		s.free--
+		s.lock.Unlock()
+		return
+	}
+
+	ready := make(chan struct{})
+	s.waiting[c] = append(s.waiting[c], ready)
+	s.lock.Unlock()
+
+	metrics.IncCounter(metricWaits[c])
+	start := time.Now()
+	<-ready
+	metrics.ObserveHist(histWaits[c], uint64(time.Since(start)))
+}
+
+// Release gives a slot back, directly to the highest priority waiter if there is one
+func (s *Scheduler) Release() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for c := range s.waiting {
+		if len(s.waiting[c]) > 0 {
+			ready := s.waiting[c][0]
+			s.waiting[c][0] = nil
+			s.waiting[c] = s.waiting[c][1:]
+			close(ready)
+			return
+		}
+	}
+
+	s.free++
+}
+
+// Rule assigns a class to keys starting with a prefix
+type Rule struct {
+	Prefix []byte
+	Class  Class
+}
+
+// Classifier decides the class of a request from its key. The first matching rule wins, and keys
+// that don't match any rule get the default class.
+type Classifier struct {
+	Default Class
+	Rules   []Rule
+}
+
+// Classify returns the class of a request for key
+func (c Classifier) Classify(key []byte) Class {
+	for _, r := range c.Rules {
+		if bytes.HasPrefix(key, r.Prefix) {
+			return r.Class
+		}
+	}
+	return c.Default
+}
+
+// ParseRules parses a comma separated list of prefixes into rules for the given class
+func ParseRules(prefixes string, c Class) []Rule {
+	var rules []Rule
+	for _, p := range strings.Split(prefixes, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			rules = append(rules, Rule{Prefix: []byte(p), Class: c})
+		}
+	}
+	return rules
+}
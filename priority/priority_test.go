@@ -0,0 +1,71 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package priority
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedulerPriority(t *testing.T) {
+	s := NewScheduler(1)
+	s.Acquire(Batch)
+
+	order := make(chan Class, 2)
+	wait := func(c Class) {
+		s.Acquire(c)
+		order <- c
+		s.Release()
+	}
+
+	// A batch waiter queues up first, then an interactive one
+	go wait(Batch)
+	for !s.queued(Batch) {
+		time.Sleep(time.Millisecond)
+	}
+	go wait(Interactive)
+	for !s.queued(Interactive) {
+		time.Sleep(time.Millisecond)
+	}
+
+	s.Release()
+
+	if first := <-order; first != Interactive {
+		t.Fatalf("Expected interactive traffic to go first, got %v", first)
+	}
+	if second := <-order; second != Batch {
+		t.Fatalf("Expected batch traffic to go second, got %v", second)
+	}
+}
+
+func (s *Scheduler) queued(c Class) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.waiting[c]) > 0
+}
+
+func TestClassifier(t *testing.T) {
+	c := Classifier{
+		Default: Interactive,
+		Rules:   ParseRules("warm:, precompute:", Batch),
+	}
+
+	if c.Classify([]byte("user:1")) != Interactive {
+		t.Fatal("Expected keys without a matching prefix to get the default class")
+	}
+	if c.Classify([]byte("precompute:1")) != Batch {
+		t.Fatal("Expected keys with a batch prefix to be batch")
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package profiling periodically captures CPU and heap profiles in the background and uploads
+// them to a continuous profiling service. Profiles are uploaded in the standard gzipped pprof
+// format, so any ingestion endpoint that accepts raw pprof data over HTTP POST can be used.
+package profiling
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"time"
+
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricProfilesCaptured     = metrics.AddCounter("profiles_captured", nil)
+	MetricProfilesSkipped      = metrics.AddCounter("profiles_skipped", nil)
+	MetricProfileCaptureErrors = metrics.AddCounter("profile_capture_errors", nil)
+	MetricProfileUploadErrors  = metrics.AddCounter("profile_upload_errors", nil)
+)
+
+// Config controls what is captured, how often, and where it is sent.
+type Config struct {
+	// Endpoint is the URL profiles are POSTed to. Each upload carries the query parameters
+	// "name", "type" (cpu or heap), "from" and "until" (unix seconds), plus any Labels.
+	Endpoint string
+
+	// Name identifies this application to the profiling service
+	Name string
+
+	// Labels are added to every upload as extra query parameters, e.g. the host or cluster
+	Labels map[string]string
+
+	// Interval is the time between capture attempts
+	Interval time.Duration
+
+	// CPUDuration is how long each CPU profile runs. 0 disables CPU profiles.
+	CPUDuration time.Duration
+
+	// Heap enables heap profiles
+	Heap bool
+
+	// SampleRate is the probability (0 to 1] that a given interval is captured. Sampling keeps
+	// the overhead of profiling a large fleet down while still building up history.
+	SampleRate float64
+
+	// MemProfileRate, if non-zero, overrides runtime.MemProfileRate to control heap sampling
+	MemProfileRate int
+}
+
+const (
+	uploadTimeout = 30 * time.Second
+	defaultName   = "rend"
+)
+
+// Start begins capturing profiles in the background according to the given config.
+func Start(c Config) error {
+	if c.Endpoint == "" {
+		return fmt.Errorf("profiling endpoint is required")
+	}
+	if _, err := url.Parse(c.Endpoint); err != nil {
+		return fmt.Errorf("bad profiling endpoint: %v", err)
+	}
+	if c.Interval <= 0 {
+		return fmt.Errorf("profiling interval must be positive")
+	}
+	if c.CPUDuration >= c.Interval {
+		return fmt.Errorf("CPU profile duration must be less than the interval")
+	}
+	if c.SampleRate <= 0 || c.SampleRate > 1 {
+		return fmt.Errorf("profiling sample rate must be in (0, 1]")
+	}
+	if c.CPUDuration <= 0 && !c.Heap {
+		return fmt.Errorf("at least one of CPU or heap profiles must be enabled")
+	}
+	if c.Name == "" {
+		c.Name = defaultName
+	}
+	if c.MemProfileRate != 0 {
+		runtime.MemProfileRate = c.MemProfileRate
+	}
+
+	p := &profiler{
+		conf:   c,
+		client: &http.Client{Timeout: uploadTimeout},
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	go p.run()
+
+	return nil
+}
+
+type profiler struct {
+	conf   Config
+	client *http.Client
+	rand   *rand.Rand
+}
+
+func (p *profiler) run() {
+	for range time.Tick(p.conf.Interval) {
+		if p.rand.Float64() >= p.conf.SampleRate {
+			metrics.IncCounter(MetricProfilesSkipped)
+			continue
+		}
+
+		if p.conf.CPUDuration > 0 {
+			p.captureCPU()
+		}
+		if p.conf.Heap {
+			p.captureHeap()
+		}
+	}
+}
+
+func (p *profiler) captureCPU() {
+	buf := &bytes.Buffer{}
+	from := time.Now()
+
+	// This fails if a profile is already running, e.g. from someone using /debug/pprof/profile
+	if err := pprof.StartCPUProfile(buf); err != nil {
+		log.Println("Error starting CPU profile:", err.Error())
+		metrics.IncCounter(MetricProfileCaptureErrors)
+		return
+	}
+	time.Sleep(p.conf.CPUDuration)
+	pprof.StopCPUProfile()
+
+	metrics.IncCounter(MetricProfilesCaptured)
+	p.upload("cpu", from, time.Now(), buf)
+}
+
+func (p *profiler) captureHeap() {
+	buf := &bytes.Buffer{}
+	now := time.Now()
+
+	if err := pprof.Lookup("heap").WriteTo(buf, 0); err != nil {
+		log.Println("Error capturing heap profile:", err.Error())
+		metrics.IncCounter(MetricProfileCaptureErrors)
+		return
+	}
+
+	metrics.IncCounter(MetricProfilesCaptured)
+	p.upload("heap", now, now, buf)
+}
+
+func (p *profiler) upload(ptype string, from, until time.Time, data *bytes.Buffer) {
+	u, _ := url.Parse(p.conf.Endpoint)
+
+	q := u.Query()
+	for k, v := range p.conf.Labels {
+		q.Set(k, v)
+	}
+	q.Set("name", p.conf.Name)
+	q.Set("type", ptype)
+	q.Set("from", strconv.FormatInt(from.Unix(), 10))
+	q.Set("until", strconv.FormatInt(until.Unix(), 10))
+	u.RawQuery = q.Encode()
+
+	res, err := p.client.Post(u.String(), "application/octet-stream", data)
+	if err != nil {
+		log.Println("Error uploading profile:", err.Error())
+		metrics.IncCounter(MetricProfileUploadErrors)
+		return
+	}
+	res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		log.Printf("Error uploading profile: endpoint returned %s\n", res.Status)
+		metrics.IncCounter(MetricProfileUploadErrors)
+	}
+}
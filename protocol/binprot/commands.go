@@ -24,11 +24,16 @@ import (
 
 // Data commands are those that send a header, key, exptime, and data
 func writeDataCmdCommon(w io.Writer, opcode uint8, key []byte, flags, exptime, dataSize, opaque uint32) error {
+	return writeDataCmdCAS(w, opcode, key, flags, exptime, dataSize, opaque, 0)
+}
+
+func writeDataCmdCAS(w io.Writer, opcode uint8, key []byte, flags, exptime, dataSize, opaque uint32, cas uint64) error {
 	// opcode, keyLength, extraLength, totalBodyLength
 	// key + extras + body
 	extrasLen := 8
 	totalBodyLength := len(key) + extrasLen + int(dataSize)
 	header := makeRequestHeader(opcode, len(key), extrasLen, totalBodyLength, opaque)
+	header.CASToken = cas
 
 	writeRequestHeader(w, header)
 
@@ -52,6 +57,42 @@ func WriteSetCmd(w io.Writer, key []byte, flags, exptime, dataSize, opaque uint3
 	return writeDataCmdCommon(w, OpcodeSet, key, flags, exptime, dataSize, opaque)
 }
 
+// WriteSetCASCmd writes out the binary representation of a set request header that only succeeds if
+// the CAS value of the item is still cas, as returned by an earlier get.
+func WriteSetCASCmd(w io.Writer, key []byte, flags, exptime, dataSize, opaque uint32, cas uint64) error {
+	return writeDataCmdCAS(w, OpcodeSet, key, flags, exptime, dataSize, opaque, cas)
+}
+
+// WriteSetIfMatchCmd writes out the binary representation of a conditional set request header and
+// its match token to the given io.Writer. The value of dataSize bytes must be written after it.
+func WriteSetIfMatchCmd(w io.Writer, key []byte, flags, exptime uint32, matchType uint32, match []byte, dataSize, opaque uint32) error {
+	extrasLen := 16
+	totalBodyLength := extrasLen + len(key) + len(match) + int(dataSize)
+	header := makeRequestHeader(OpcodeSetIfMatch, len(key), extrasLen, totalBodyLength, opaque)
+
+	writeRequestHeader(w, header)
+	reqHeadPool.Put(header)
+
+	buf := make([]byte, extrasLen+len(key)+len(match))
+	binary.BigEndian.PutUint32(buf[0:4], flags)
+	binary.BigEndian.PutUint32(buf[4:8], exptime)
+	binary.BigEndian.PutUint32(buf[8:12], matchType)
+	binary.BigEndian.PutUint32(buf[12:16], uint32(len(match)))
+	copy(buf[16:], key)
+	copy(buf[16+len(key):], match)
+
+	n, err := w.Write(buf)
+	metrics.IncCounterBy(common.MetricBytesWrittenLocal, uint64(n))
+
+	return err
+}
+
+// WriteSetQCmd writes out the binary representation of a quiet set request header to the given
+// io.Writer. The server will only respond if the set fails.
+func WriteSetQCmd(w io.Writer, key []byte, flags, exptime, dataSize, opaque uint32) error {
+	return writeDataCmdCommon(w, OpcodeSetQ, key, flags, exptime, dataSize, opaque)
+}
+
 // WriteAddCmd writes out the binary representation of an add request header to the given io.Writer
 func WriteAddCmd(w io.Writer, key []byte, flags, exptime, dataSize, opaque uint32) error {
 	//fmt.Printf("Add: key: %v | flags: %v | exptime: %v | dataSize: %v | totalBodyLength: %v\n",
@@ -140,6 +181,12 @@ func WriteDeleteCmd(w io.Writer, key []byte, opaque uint32) error {
 	return writeKeyCmd(w, OpcodeDelete, key, opaque)
 }
 
+// WriteDeleteQCmd writes out the binary representation of a quiet delete request to the given
+// io.Writer. The server will only respond if the delete fails, including for a miss.
+func WriteDeleteQCmd(w io.Writer, key []byte, opaque uint32) error {
+	return writeKeyCmd(w, OpcodeDeleteQ, key, opaque)
+}
+
 // Key Exptime commands send the header, key, and an exptime
 func writeKeyExptimeCmd(w io.Writer, opcode uint8, key []byte, exptime, opaque uint32) error {
 	// opcode, keyLength, extraLength, totalBodyLength
@@ -183,6 +230,113 @@ func WriteGATQCmd(w io.Writer, key []byte, exptime, opaque uint32) error {
 	return writeKeyExptimeCmd(w, OpcodeGatQ, key, exptime, opaque)
 }
 
+// WriteGetLockCmd writes out the binary representation of a get-with-lock request header to the
+// given io.Writer. A lock time of 0 means the server's default.
+func WriteGetLockCmd(w io.Writer, key []byte, lockTime, opaque uint32) error {
+	return writeKeyExptimeCmd(w, OpcodeGetLocked, key, lockTime, opaque)
+}
+
+// WriteUnlockCmd writes out the binary representation of an unlock request header to the given
+// io.Writer, with the token from the get-with-lock response as the CAS
+func WriteUnlockCmd(w io.Writer, key []byte, token uint64, opaque uint32) error {
+	// opcode, keyLength, extraLength, totalBodyLength
+	header := makeRequestHeader(OpcodeUnlockKey, len(key), 0, len(key), opaque)
+	header.CASToken = token
+	writeRequestHeader(w, header)
+
+	n, err := w.Write(key)
+
+	metrics.IncCounterBy(common.MetricBytesWrittenLocal, uint64(ReqHeaderLen+n))
+	reqHeadPool.Put(header)
+
+	return err
+}
+
+// Arith commands send the header, the delta, initial value and exptime extras, and the key
+func writeArithCmd(w io.Writer, opcode uint8, key []byte, delta, initial uint64, exptime, opaque uint32) error {
+	// opcode, keyLength, extraLength, totalBodyLength
+	extrasLen := 20
+	header := makeRequestHeader(opcode, len(key), extrasLen, len(key)+extrasLen, opaque)
+	writeRequestHeader(w, header)
+
+	buf := make([]byte, len(key)+extrasLen)
+	binary.BigEndian.PutUint64(buf[0:8], delta)
+	binary.BigEndian.PutUint64(buf[8:16], initial)
+	binary.BigEndian.PutUint32(buf[16:20], exptime)
+	copy(buf[20:], key)
+
+	n, err := w.Write(buf)
+
+	metrics.IncCounterBy(common.MetricBytesWrittenLocal, uint64(ReqHeaderLen+n))
+	reqHeadPool.Put(header)
+
+	return err
+}
+
+// WriteIncrCmd writes out the binary representation of an increment request header to the given
+// io.Writer. A missing key is created with the initial value unless exptime is 0xffffffff.
+func WriteIncrCmd(w io.Writer, key []byte, delta, initial uint64, exptime, opaque uint32) error {
+	return writeArithCmd(w, OpcodeIncrement, key, delta, initial, exptime, opaque)
+}
+
+// WriteIncrQCmd writes out the binary representation of a quiet increment request header to the
+// given io.Writer. The server will only respond if the increment fails.
+func WriteIncrQCmd(w io.Writer, key []byte, delta, initial uint64, exptime, opaque uint32) error {
+	return writeArithCmd(w, OpcodeIncrementQ, key, delta, initial, exptime, opaque)
+}
+
+// WriteDecrCmd writes out the binary representation of a decrement request header to the given
+// io.Writer, with the same extras as WriteIncrCmd.
+func WriteDecrCmd(w io.Writer, key []byte, delta, initial uint64, exptime, opaque uint32) error {
+	return writeArithCmd(w, OpcodeDecrement, key, delta, initial, exptime, opaque)
+}
+
+// WriteDecrQCmd writes out the binary representation of a quiet decrement request header to the
+// given io.Writer. The server will only respond if the decrement fails.
+func WriteDecrQCmd(w io.Writer, key []byte, delta, initial uint64, exptime, opaque uint32) error {
+	return writeArithCmd(w, OpcodeDecrementQ, key, delta, initial, exptime, opaque)
+}
+
+// WriteFlushCmd writes out the binary representation of a flush request header to the given
+// io.Writer. The delay extras are only sent when delay isn't 0.
+func WriteFlushCmd(w io.Writer, delay, opaque uint32) error {
+	return writeFlushCmd(w, OpcodeFlush, delay, opaque)
+}
+
+// WriteFlushQCmd writes out the binary representation of a quiet flush request header to the given
+// io.Writer. The server will only respond if the flush fails.
+func WriteFlushQCmd(w io.Writer, delay, opaque uint32) error {
+	return writeFlushCmd(w, OpcodeFlushQ, delay, opaque)
+}
+
+func writeFlushCmd(w io.Writer, opcode uint8, delay, opaque uint32) error {
+	// opcode, keyLength, extraLength, totalBodyLength
+	extrasLen := 0
+	if delay != 0 {
+		extrasLen = 4
+	}
+	header := makeRequestHeader(opcode, 0, extrasLen, extrasLen, opaque)
+	writeRequestHeader(w, header)
+
+	buf := make([]byte, extrasLen)
+	if delay != 0 {
+		binary.BigEndian.PutUint32(buf, delay)
+	}
+
+	n, err := w.Write(buf)
+
+	metrics.IncCounterBy(common.MetricBytesWrittenLocal, uint64(ReqHeaderLen+n))
+	reqHeadPool.Put(header)
+
+	return err
+}
+
+// WriteStatCmd writes out the binary representation of a stat request header to the given
+// io.Writer. An empty group asks for the general stats.
+func WriteStatCmd(w io.Writer, group []byte, opaque uint32) error {
+	return writeKeyCmd(w, OpcodeStat, group, opaque)
+}
+
 // WriteNoopCmd writes out the binary representation of a noop request header to the given io.Writer
 func WriteNoopCmd(w io.Writer, opaque uint32) error {
 	// opcode, keyLength, extraLength, totalBodyLength
@@ -23,14 +23,53 @@ import (
 // Components is the holder for all the different protocol components in the binprot package
 var Components protocol.Components = comps{}
 
-type comps struct{}
+type comps struct {
+	strict   bool
+	vbuckets *protocol.VBuckets
+	quirks   protocol.Quirks
+}
 
 func (c comps) NewRequestParser(r *bufio.Reader) protocol.RequestParser {
-	return NewBinaryParser(r)
+	p := NewBinaryParser(r)
+	if c.strict {
+		p = NewStrictBinaryParser(r)
+	}
+	p.vbuckets = c.vbuckets
+	p.quirks = c.quirks
+	return p
+}
+
+func (c comps) WithStrictness(s protocol.Strictness) protocol.Components {
+	c.strict = s == protocol.Strict
+	return c
+}
+
+func (c comps) WithVBuckets(v *protocol.VBuckets) protocol.Components {
+	c.vbuckets = v
+	return c
+}
+
+func (c comps) WithQuirks(q protocol.Quirks) protocol.Components {
+	c.quirks = q
+	return c
+}
+
+func (c comps) Name() string {
+	return "binary"
 }
 
 func (c comps) NewResponder(w *bufio.Writer) protocol.Responder {
-	return NewBinaryResponder(w)
+	r := NewBinaryResponder(w)
+	r.quirks = c.quirks
+	return r
+}
+
+// NewResponderTo returns a responder that writes large values directly to the connection
+func (c comps) NewResponderTo(w protocol.ResponseWriter) protocol.Responder {
+	return BinaryResponder{
+		writer: w,
+		quirks: c.quirks,
+	}
 }
 
 func (c comps) NewDisambiguator(p protocol.Peeker) protocol.Disambiguator {
@@ -30,6 +30,11 @@ var (
 	MetricBinaryRequestHeadersBadMagic  = metrics.AddCounter("binary_request_headers_bad_magic", nil)
 	MetricBinaryResponseHeadersParsed   = metrics.AddCounter("binary_response_headers_parsed", nil)
 	MetricBinaryResponseHeadersBadMagic = metrics.AddCounter("binary_response_headers_bad_magic", nil)
+	MetricBinaryMultiSetsParsed         = metrics.AddCounter("binary_multi_sets_parsed", nil)
+	MetricBinaryMultiSetItemsParsed     = metrics.AddCounter("binary_multi_set_items_parsed", nil)
+	MetricBinaryMultiDeletesParsed      = metrics.AddCounter("binary_multi_deletes_parsed", nil)
+	MetricBinaryMultiDeleteItemsParsed  = metrics.AddCounter("binary_multi_delete_items_parsed", nil)
+	MetricBinaryNotMyVBucket            = metrics.AddCounter("binary_not_my_vbucket", nil)
 )
 
 type RequestHeader struct {
@@ -38,10 +43,10 @@ type RequestHeader struct {
 	KeyLength       uint16
 	ExtraLength     uint8
 	DataType        uint8  // Always 0
-	VBucket         uint16 // Not used
+	VBucket         uint16 // Only checked by parsers that know which vbuckets they own
 	TotalBodyLength uint32
 	OpaqueToken     uint32 // Echoed to the client
-	CASToken        uint64 // Unused in current implementation
+	CASToken        uint64 // Only sent to backends, for compare-and-swap
 }
 
 const resHeaderLen = 24
@@ -121,17 +126,13 @@ func readRequestHeader(r io.Reader) (RequestHeader, error) {
 	rh.Opcode = buf[1]
 	rh.KeyLength = binary.BigEndian.Uint16(buf[2:4])
 	rh.ExtraLength = buf[4]
-	// ignore DataType, unused
-	//rh.DataType = buf[5]
-	rh.DataType = 0
-	// ignore VBucket, unused
-	//rh.VBucket = binary.BigEndian.Uint16(buf[6:8])
-	rh.VBucket = 0
+	// only checked by strict parsers
+	rh.DataType = buf[5]
+	rh.VBucket = binary.BigEndian.Uint16(buf[6:8])
 	rh.TotalBodyLength = binary.BigEndian.Uint32(buf[8:12])
 	rh.OpaqueToken = binary.BigEndian.Uint32(buf[12:16])
-	// ignore CAS, unused in rend
-	//rh.CASToken = binary.BigEndian.Uint64(buf[16:24])
-	rh.CASToken = 0
+	// CAS is only used to carry the token of an unlock
+	rh.CASToken = binary.BigEndian.Uint64(buf[16:24])
 
 	bufPool.Put(buf)
 	metrics.IncCounter(MetricBinaryRequestHeadersParsed)
@@ -152,11 +153,7 @@ func writeRequestHeader(w io.Writer, rh RequestHeader) error {
 	buf[7] = 0
 	binary.BigEndian.PutUint32(buf[8:12], rh.TotalBodyLength)
 	binary.BigEndian.PutUint32(buf[12:16], rh.OpaqueToken)
-
-	// zero CAS region
-	for i := 16; i < 24; i++ {
-		buf[i] = 0
-	}
+	binary.BigEndian.PutUint64(buf[16:24], rh.CASToken)
 
 	n, err := w.Write(buf)
 	metrics.IncCounterBy(common.MetricBytesWrittenLocal, uint64(n))
@@ -191,9 +188,8 @@ func ReadResponseHeader(r io.Reader) (ResponseHeader, error) {
 	rh.Status = binary.BigEndian.Uint16(buf[6:8])
 	rh.TotalBodyLength = binary.BigEndian.Uint32(buf[8:12])
 	rh.OpaqueToken = binary.BigEndian.Uint32(buf[12:16])
-	// ignore CAS, unused in rend
-	//rh.CASToken = binary.BigEndian.Uint64(buf[16:24])
-	rh.CASToken = 0
+	// CAS is only used by the handlers for conditional sets
+	rh.CASToken = binary.BigEndian.Uint64(buf[16:24])
 
 	bufPool.Put(buf)
 	metrics.IncCounter(MetricBinaryResponseHeadersParsed)
@@ -213,11 +209,7 @@ func writeResponseHeader(w io.Writer, rh ResponseHeader) error {
 	binary.BigEndian.PutUint16(buf[6:8], rh.Status)
 	binary.BigEndian.PutUint32(buf[8:12], rh.TotalBodyLength)
 	binary.BigEndian.PutUint32(buf[12:16], rh.OpaqueToken)
-
-	// zero CAS region
-	for i := 16; i < 24; i++ {
-		buf[i] = 0
-	}
+	binary.BigEndian.PutUint64(buf[16:24], rh.CASToken)
 
 	n, err := w.Write(buf)
 	metrics.IncCounterBy(common.MetricBytesWrittenLocal, uint64(n))
@@ -19,9 +19,11 @@ import (
 	"encoding/binary"
 	"io"
 	"log"
+	"time"
 
 	"github.com/netflix/rend/common"
 	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/protocol"
 	"github.com/netflix/rend/timer"
 )
 
@@ -103,14 +105,103 @@ import (
 //     Key                 : The textual string "Hello"
 //     Value               : None
 
+// Clients that know about it can add a deadline hint to most commands: 4 more bytes of extras
+// after the standard ones, holding the number of milliseconds from when the request is sent that
+// the client will wait for the response. E.g. a get with a deadline has 4 bytes of extras and a
+// set has 12, with the deadline after the flags and exptime. Commands without the extra bytes are
+// parsed as usual.
+const deadlineExtraLen = 4
+
 type BinaryParser struct {
 	reader *bufio.Reader
+
+	// the deadline hint of the last request parsed, in milliseconds
+	deadline *uint32
+
+	strict bool
+
+	// requests for vbuckets outside this set are turned away, see check
+	vbuckets *protocol.VBuckets
+
+	// the opaque of the last request header read
+	opaque *uint32
+	quirks protocol.Quirks
+
+	// a request turned away in the middle of a batch, answered on the next call to Parse
+	rejected *rejection
+}
+
+type rejection struct {
+	opaque uint32
+	err    error
 }
 
 func NewBinaryParser(reader *bufio.Reader) BinaryParser {
 	return BinaryParser{
-		reader: reader,
+		reader:   reader,
+		deadline: new(uint32),
+		opaque:   new(uint32),
+		rejected: new(rejection),
+	}
+}
+
+// NewStrictBinaryParser returns a parser that rejects requests the binary protocol spec doesn't
+// allow, see checkStrict
+func NewStrictBinaryParser(reader *bufio.Reader) BinaryParser {
+	return BinaryParser{
+		reader:   reader,
+		deadline: new(uint32),
+		opaque:   new(uint32),
+		rejected: new(rejection),
+		strict:   true,
+	}
+}
+
+// Deadline returns how long the client said it would wait for the last request parsed, or 0 if it
+// didn't say. In a batch of commands, the earliest deadline applies to the whole batch.
+func (b BinaryParser) Deadline() time.Duration {
+	return time.Duration(*b.deadline) * time.Millisecond
+}
+
+// checker is run on every request header in a batch after the first, right after it's read. A
+// request it turns away ends the batch, so the requests before it are still served, and is answered
+// with its own opaque on the next call to Parse. An error means the connection can't be read.
+type checker func(r io.Reader, h RequestHeader) (bool, error)
+
+// check holds a request header to the spec if the parser is strict and turns it away with
+// NOT_MY_VBUCKET if it's for a vbucket the parser doesn't own. Either way the rejected request's
+// body is skipped, so the connection stays usable. The vbucket isn't echoed back since the binary
+// protocol puts the status where requests carry it; clients match responses by opaque instead.
+func (b BinaryParser) check(r io.Reader, h RequestHeader) error {
+	if b.strict {
+		if err := checkStrict(r, h); err != nil {
+			return err
+		}
+	}
+
+	if !b.vbuckets.Owns(h.VBucket) {
+		metrics.IncCounter(MetricBinaryNotMyVBucket)
+		if err := skipBody(r, h); err != nil {
+			return err
+		}
+		return common.ErrNotMyVBucket
+	}
+
+	return nil
+}
+
+// checkBatched is the checker for batches, see check
+func (b BinaryParser) checkBatched(r io.Reader, h RequestHeader) (bool, error) {
+	err := b.check(r, h)
+	if err == nil {
+		return true, nil
+	}
+	// anything but a structured error came from reading the body
+	if _, ok := common.AsError(err); !ok {
+		return false, err
 	}
+	*b.rejected = rejection{opaque: h.OpaqueToken, err: err}
+	return false, nil
 }
 
 // Gets can be pipelined by sending many headers at once to the server.
@@ -126,43 +217,76 @@ func NewBinaryParser(reader *bufio.Reader) BinaryParser {
 // spymemcached's implementation ^^^
 
 func (b BinaryParser) Parse() (common.Request, common.RequestType, uint64, error) {
+	if r := *b.rejected; r.err != nil {
+		*b.rejected = rejection{}
+		*b.deadline = 0
+		*b.opaque = r.opaque
+		return common.NoopRequest{Opaque: r.opaque}, common.RequestUnknown, timer.Now(), r.err
+	}
+
+	req, reqType, start, err := b.parse()
+	if err != nil && req == nil && b.quirks.HeaderOpaques {
+		req = common.NoopRequest{Opaque: *b.opaque}
+	}
+	return req, reqType, start, err
+}
+
+func (b BinaryParser) parse() (common.Request, common.RequestType, uint64, error) {
 	// read in the full header before any variable length fields
 	reqHeader, err := readRequestHeader(b.reader)
 	start := timer.Now()
 	defer reqHeadPool.Put(reqHeader)
+	*b.deadline = 0
+	*b.opaque = 0
 
 	if err != nil {
 		return nil, common.RequestUnknown, start, err
 	}
+	*b.opaque = reqHeader.OpaqueToken
+
+	if err := b.check(b.reader, reqHeader); err != nil {
+		// the opaque goes back with the error so the client can tell which request was turned away
+		return common.NoopRequest{Opaque: reqHeader.OpaqueToken}, common.RequestUnknown, start, err
+	}
 
 	switch reqHeader.Opcode {
 	case OpcodeSet:
-		return setRequest(b.reader, reqHeader, common.RequestSet, false, start)
+		return setRequest(b.reader, reqHeader, common.RequestSet, false, start, b.deadline)
 	case OpcodeSetQ:
-		return setRequest(b.reader, reqHeader, common.RequestSet, true, start)
+		req, reqType, start, err := setRequest(b.reader, reqHeader, common.RequestSet, true, start, b.deadline)
+		if err != nil {
+			return req, reqType, start, err
+		}
+		return readBatchSet(b.reader, req, start, b.deadline, b.checkBatched)
+
+	// Expected only from clients that know about this extension
+	case OpcodeSetIfMatch:
+		return setIfMatchRequest(b.reader, reqHeader, false, start)
+	case OpcodeSetIfMatchQ:
+		return setIfMatchRequest(b.reader, reqHeader, true, start)
 
 	case OpcodeAdd:
-		return setRequest(b.reader, reqHeader, common.RequestAdd, false, start)
+		return setRequest(b.reader, reqHeader, common.RequestAdd, false, start, b.deadline)
 	case OpcodeAddQ:
-		return setRequest(b.reader, reqHeader, common.RequestAdd, true, start)
+		return setRequest(b.reader, reqHeader, common.RequestAdd, true, start, b.deadline)
 
 	case OpcodeReplace:
-		return setRequest(b.reader, reqHeader, common.RequestReplace, false, start)
+		return setRequest(b.reader, reqHeader, common.RequestReplace, false, start, b.deadline)
 	case OpcodeReplaceQ:
-		return setRequest(b.reader, reqHeader, common.RequestReplace, true, start)
+		return setRequest(b.reader, reqHeader, common.RequestReplace, true, start, b.deadline)
 
 	case OpcodeAppend:
-		return appendPrependRequest(b.reader, reqHeader, common.RequestAppend, false, start)
+		return appendPrependRequest(b.reader, reqHeader, common.RequestAppend, false, start, b.deadline)
 	case OpcodeAppendQ:
-		return appendPrependRequest(b.reader, reqHeader, common.RequestAppend, true, start)
+		return appendPrependRequest(b.reader, reqHeader, common.RequestAppend, true, start, b.deadline)
 
 	case OpcodePrepend:
-		return appendPrependRequest(b.reader, reqHeader, common.RequestPrepend, false, start)
+		return appendPrependRequest(b.reader, reqHeader, common.RequestPrepend, false, start, b.deadline)
 	case OpcodePrependQ:
-		return appendPrependRequest(b.reader, reqHeader, common.RequestPrepend, true, start)
+		return appendPrependRequest(b.reader, reqHeader, common.RequestPrepend, true, start, b.deadline)
 
 	case OpcodeGetQ:
-		req, err := readBatchGet(b.reader, reqHeader)
+		req, err := readBatchGet(b.reader, reqHeader, b.deadline, b.checkBatched)
 		if err != nil {
 			log.Println("Error reading batch get")
 			return nil, common.RequestGet, start, err
@@ -171,7 +295,12 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, uint64, error
 		return req, common.RequestGet, start, nil
 
 	case OpcodeGet:
-		// key
+		// deadline, key
+		if err := readDeadline(b.reader, reqHeader, 0, b.deadline); err != nil {
+			log.Println("Error reading deadline")
+			return nil, common.RequestGet, start, err
+		}
+
 		key, err := readString(b.reader, reqHeader.KeyLength)
 		if err != nil {
 			log.Println("Error reading key")
@@ -187,7 +316,7 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, uint64, error
 
 	// Expected only in applications behind Rend that reuse this parsing code
 	case OpcodeGetEQ:
-		req, err := readBatchGetE(b.reader, reqHeader)
+		req, err := readBatchGetE(b.reader, reqHeader, b.deadline, b.checkBatched)
 		if err != nil {
 			log.Println("Error reading batch get")
 			return nil, common.RequestGetE, start, err
@@ -197,7 +326,12 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, uint64, error
 
 	// Expected only in applications behind Rend that reuse this parsing code
 	case OpcodeGetE:
-		// key
+		// deadline, key
+		if err := readDeadline(b.reader, reqHeader, 0, b.deadline); err != nil {
+			log.Println("Error reading deadline")
+			return nil, common.RequestGetE, start, err
+		}
+
 		key, err := readString(b.reader, reqHeader.KeyLength)
 		if err != nil {
 			log.Println("Error reading key")
@@ -212,13 +346,18 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, uint64, error
 		}, common.RequestGetE, start, nil
 
 	case OpcodeGat:
-		// exptime, key
+		// exptime, deadline, key
 		exptime, err := readUInt32(b.reader)
 		if err != nil {
 			log.Println("Error reading exptime")
 			return nil, common.RequestGat, start, err
 		}
 
+		if err := readDeadline(b.reader, reqHeader, 4, b.deadline); err != nil {
+			log.Println("Error reading deadline")
+			return nil, common.RequestGat, start, err
+		}
+
 		key, err := readString(b.reader, reqHeader.KeyLength)
 		if err != nil {
 			log.Println("Error reading key")
@@ -232,26 +371,34 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, uint64, error
 		}, common.RequestGat, start, nil
 
 	case OpcodeDelete:
-		// key
-		key, err := readString(b.reader, reqHeader.KeyLength)
+		req, err := deleteRequest(b.reader, reqHeader, b.deadline)
 		if err != nil {
-			log.Println("Error reading key")
 			return nil, common.RequestDelete, start, err
 		}
 
-		return common.DeleteRequest{
-			Key:    key,
-			Opaque: reqHeader.OpaqueToken,
-		}, common.RequestDelete, start, nil
+		return req, common.RequestDelete, start, nil
+
+	case OpcodeDeleteQ:
+		req, err := deleteRequest(b.reader, reqHeader, b.deadline)
+		if err != nil {
+			return nil, common.RequestDelete, start, err
+		}
+
+		return readBatchDelete(b.reader, req, start, b.deadline, b.checkBatched)
 
 	case OpcodeTouch:
-		// exptime, key
+		// exptime, deadline, key
 		exptime, err := readUInt32(b.reader)
 		if err != nil {
 			log.Println("Error reading exptime")
 			return nil, common.RequestTouch, start, err
 		}
 
+		if err := readDeadline(b.reader, reqHeader, 4, b.deadline); err != nil {
+			log.Println("Error reading deadline")
+			return nil, common.RequestTouch, start, err
+		}
+
 		key, err := readString(b.reader, reqHeader.KeyLength)
 		if err != nil {
 			log.Println("Error reading key")
@@ -264,6 +411,53 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, uint64, error
 			Opaque:  reqHeader.OpaqueToken,
 		}, common.RequestTouch, start, nil
 
+	case OpcodeGetLocked:
+		// lock time and deadline if given, key
+		var lockTime uint32
+		if reqHeader.ExtraLength > 0 {
+			var err error
+			if lockTime, err = readUInt32(b.reader); err != nil {
+				log.Println("Error reading lock time")
+				return nil, common.RequestGetLock, start, err
+			}
+
+			if err := readDeadline(b.reader, reqHeader, 4, b.deadline); err != nil {
+				log.Println("Error reading deadline")
+				return nil, common.RequestGetLock, start, err
+			}
+		}
+
+		key, err := readString(b.reader, reqHeader.KeyLength)
+		if err != nil {
+			log.Println("Error reading key")
+			return nil, common.RequestGetLock, start, err
+		}
+
+		return common.GetLockRequest{
+			Key:      key,
+			LockTime: lockTime,
+			Opaque:   reqHeader.OpaqueToken,
+		}, common.RequestGetLock, start, nil
+
+	case OpcodeUnlockKey:
+		// deadline, key, with the token as the CAS
+		if err := readDeadline(b.reader, reqHeader, 0, b.deadline); err != nil {
+			log.Println("Error reading deadline")
+			return nil, common.RequestUnlock, start, err
+		}
+
+		key, err := readString(b.reader, reqHeader.KeyLength)
+		if err != nil {
+			log.Println("Error reading key")
+			return nil, common.RequestUnlock, start, err
+		}
+
+		return common.UnlockRequest{
+			Key:    key,
+			Token:  reqHeader.CASToken,
+			Opaque: reqHeader.OpaqueToken,
+		}, common.RequestUnlock, start, nil
+
 	case OpcodeNoop:
 		return common.NoopRequest{
 			Opaque: reqHeader.OpaqueToken,
@@ -284,6 +478,37 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, uint64, error
 		return common.VersionRequest{
 			Opaque: reqHeader.OpaqueToken,
 		}, common.RequestVersion, start, nil
+
+	case OpcodeIncrement:
+		return arithRequest(b.reader, reqHeader, common.RequestIncr, false, start)
+	case OpcodeIncrementQ:
+		return arithRequest(b.reader, reqHeader, common.RequestIncr, true, start)
+	case OpcodeDecrement:
+		return arithRequest(b.reader, reqHeader, common.RequestDecr, false, start)
+	case OpcodeDecrementQ:
+		return arithRequest(b.reader, reqHeader, common.RequestDecr, true, start)
+
+	case OpcodeFlush:
+		return flushRequest(b.reader, reqHeader, false, start)
+	case OpcodeFlushQ:
+		return flushRequest(b.reader, reqHeader, true, start)
+
+	case OpcodeStat:
+		// key is the optional stats group
+		group, err := readString(b.reader, reqHeader.KeyLength)
+		if err != nil {
+			log.Println("Error reading stats group")
+			return nil, common.RequestStats, start, err
+		}
+		// a strict port serves none of the extensions it would list
+		if b.strict && string(group) == common.ExtensionsStatsGroup {
+			return nil, common.RequestStats, start, common.ErrExtension
+		}
+
+		return common.StatsRequest{
+			Group:  string(group),
+			Opaque: reqHeader.OpaqueToken,
+		}, common.RequestStats, start, nil
 	}
 
 	log.Printf("Error processing request: unknown command. Command: %X\nWhole request:%#v", reqHeader.Opcode, reqHeader)
@@ -291,7 +516,7 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, uint64, error
 	return nil, common.RequestUnknown, start, common.ErrUnknownCmd
 }
 
-func readBatchGet(r io.Reader, header RequestHeader) (common.GetRequest, error) {
+func readBatchGet(r io.Reader, header RequestHeader, deadline *uint32, check checker) (common.GetRequest, error) {
 	var keys [][]byte
 	var opaques []uint32
 	var quiet []bool
@@ -301,7 +526,11 @@ func readBatchGet(r io.Reader, header RequestHeader) (common.GetRequest, error)
 	// while GETQ
 	// read key, read header
 	for header.Opcode == OpcodeGetQ {
-		// key
+		// deadline, key
+		if err := readDeadline(r, header, 0, deadline); err != nil {
+			return common.GetRequest{}, err
+		}
+
 		key, err := readString(r, header.KeyLength)
 		if err != nil {
 			return common.GetRequest{}, err
@@ -317,10 +546,28 @@ func readBatchGet(r io.Reader, header RequestHeader) (common.GetRequest, error)
 		if err != nil {
 			return common.GetRequest{}, err
 		}
+		ok, err := check(r, header)
+		if err != nil {
+			reqHeadPool.Put(header)
+			return common.GetRequest{}, err
+		}
+		if !ok {
+			// the batch ends without a GET or NOOP, which come in the next one
+			reqHeadPool.Put(header)
+			return common.GetRequest{
+				Keys:    keys,
+				Opaques: opaques,
+				Quiet:   quiet,
+			}, nil
+		}
 	}
 
 	if header.Opcode == OpcodeGet {
-		// key
+		// deadline, key
+		if err := readDeadline(r, header, 0, deadline); err != nil {
+			return common.GetRequest{}, err
+		}
+
 		key, err := readString(r, header.KeyLength)
 		if err != nil {
 			return common.GetRequest{}, err
@@ -354,7 +601,7 @@ func readBatchGet(r io.Reader, header RequestHeader) (common.GetRequest, error)
 	}, nil
 }
 
-func readBatchGetE(r io.Reader, header RequestHeader) (common.GetRequest, error) {
+func readBatchGetE(r io.Reader, header RequestHeader, deadline *uint32, check checker) (common.GetRequest, error) {
 	var keys [][]byte
 	var opaques []uint32
 	var quiet []bool
@@ -364,7 +611,11 @@ func readBatchGetE(r io.Reader, header RequestHeader) (common.GetRequest, error)
 	// while GETQ
 	// read key, read header
 	for header.Opcode == OpcodeGetEQ {
-		// key
+		// deadline, key
+		if err := readDeadline(r, header, 0, deadline); err != nil {
+			return common.GetRequest{}, err
+		}
+
 		key, err := readString(r, header.KeyLength)
 		if err != nil {
 			return common.GetRequest{}, err
@@ -380,10 +631,28 @@ func readBatchGetE(r io.Reader, header RequestHeader) (common.GetRequest, error)
 		if err != nil {
 			return common.GetRequest{}, err
 		}
+		ok, err := check(r, header)
+		if err != nil {
+			reqHeadPool.Put(header)
+			return common.GetRequest{}, err
+		}
+		if !ok {
+			// the batch ends without a GET or NOOP, which come in the next one
+			reqHeadPool.Put(header)
+			return common.GetRequest{
+				Keys:    keys,
+				Opaques: opaques,
+				Quiet:   quiet,
+			}, nil
+		}
 	}
 
 	if header.Opcode == OpcodeGetE {
-		// key
+		// deadline, key
+		if err := readDeadline(r, header, 0, deadline); err != nil {
+			return common.GetRequest{}, err
+		}
+
 		key, err := readString(r, header.KeyLength)
 		if err != nil {
 			return common.GetRequest{}, err
@@ -417,8 +686,135 @@ func readBatchGetE(r io.Reader, header RequestHeader) (common.GetRequest, error)
 	}, nil
 }
 
-func setRequest(r io.Reader, reqHeader RequestHeader, reqType common.RequestType, quiet bool, start uint64) (common.SetRequest, common.RequestType, uint64, error) {
-	// flags, exptime, key, value
+// MaxBatchSet and MaxBatchDelete are the most sets or deletes that will be collected into a single
+// batch request. Any further pipelined commands are simply parsed as the start of the next batch.
+const (
+	MaxBatchSet    = 256
+	MaxBatchDelete = 256
+)
+
+// Sets are pipelined the same way as gets: a series of SETQ commands optionally ending in a SET.
+// Unlike a batch get, the client doesn't need to wait for anything between the commands, so there
+// is no guarantee the next header has been sent yet. Only the sets that are already buffered are
+// collected together, which means this never blocks waiting for a command that may never arrive.
+// Anything other than a set (commonly a NOOP) is left in the buffer for the next call to Parse.
+func readBatchSet(r *bufio.Reader, first common.SetRequest, start uint64, deadline *uint32, check checker) (common.Request, common.RequestType, uint64, error) {
+	sets := []common.SetRequest{first}
+
+	for len(sets) < MaxBatchSet && sets[len(sets)-1].Quiet {
+		if op, ok := peekOpcode(r); !ok || (op != OpcodeSetQ && op != OpcodeSet) {
+			break
+		}
+
+		reqHeader, err := readRequestHeader(r)
+		if err != nil {
+			return nil, common.RequestMultiSet, start, err
+		}
+		ok, err := check(r, reqHeader)
+		if err != nil || !ok {
+			reqHeadPool.Put(reqHeader)
+			if err != nil {
+				return nil, common.RequestMultiSet, start, err
+			}
+			break
+		}
+
+		req, _, _, err := setRequest(r, reqHeader, common.RequestSet, reqHeader.Opcode == OpcodeSetQ, start, deadline)
+		reqHeadPool.Put(reqHeader)
+		if err != nil {
+			return nil, common.RequestMultiSet, start, err
+		}
+
+		sets = append(sets, req)
+	}
+
+	if len(sets) == 1 {
+		return first, common.RequestSet, start, nil
+	}
+
+	metrics.IncCounter(MetricBinaryMultiSetsParsed)
+	metrics.IncCounterBy(MetricBinaryMultiSetItemsParsed, uint64(len(sets)))
+
+	return common.MultiSetRequest{Sets: sets}, common.RequestMultiSet, start, nil
+}
+
+// Deletes are batched exactly like sets: a series of DELETEQ commands optionally ending in a DELETE,
+// collected only as far as they are already buffered.
+func readBatchDelete(r *bufio.Reader, first common.DeleteRequest, start uint64, deadline *uint32, check checker) (common.Request, common.RequestType, uint64, error) {
+	deletes := []common.DeleteRequest{first}
+
+	for len(deletes) < MaxBatchDelete && deletes[len(deletes)-1].Quiet {
+		if op, ok := peekOpcode(r); !ok || (op != OpcodeDeleteQ && op != OpcodeDelete) {
+			break
+		}
+
+		reqHeader, err := readRequestHeader(r)
+		if err != nil {
+			return nil, common.RequestMultiDelete, start, err
+		}
+		ok, err := check(r, reqHeader)
+		if err != nil || !ok {
+			reqHeadPool.Put(reqHeader)
+			if err != nil {
+				return nil, common.RequestMultiDelete, start, err
+			}
+			break
+		}
+
+		req, err := deleteRequest(r, reqHeader, deadline)
+		reqHeadPool.Put(reqHeader)
+		if err != nil {
+			return nil, common.RequestMultiDelete, start, err
+		}
+
+		deletes = append(deletes, req)
+	}
+
+	if len(deletes) == 1 {
+		return first, common.RequestDelete, start, nil
+	}
+
+	metrics.IncCounter(MetricBinaryMultiDeletesParsed)
+	metrics.IncCounterBy(MetricBinaryMultiDeleteItemsParsed, uint64(len(deletes)))
+
+	return common.MultiDeleteRequest{Deletes: deletes}, common.RequestMultiDelete, start, nil
+}
+
+// peekOpcode returns the opcode of the next request if its whole header is already buffered
+func peekOpcode(r *bufio.Reader) (uint8, bool) {
+	if r.Buffered() < ReqHeaderLen {
+		return 0, false
+	}
+
+	peek, err := r.Peek(ReqHeaderLen)
+	if err != nil || peek[0] != MagicRequest {
+		return 0, false
+	}
+
+	return peek[1], true
+}
+
+func deleteRequest(r io.Reader, reqHeader RequestHeader, deadline *uint32) (common.DeleteRequest, error) {
+	if err := readDeadline(r, reqHeader, 0, deadline); err != nil {
+		log.Println("Error reading deadline")
+		return common.DeleteRequest{}, err
+	}
+
+	key, err := readString(r, reqHeader.KeyLength)
+	if err != nil {
+		log.Println("Error reading key")
+		return common.DeleteRequest{}, err
+	}
+
+	return common.DeleteRequest{
+		Key:    key,
+		Opaque: reqHeader.OpaqueToken,
+		Quiet:  reqHeader.Opcode == OpcodeDeleteQ,
+	}, nil
+}
+
+func setRequest(r io.Reader, reqHeader RequestHeader, reqType common.RequestType, quiet bool, start uint64, deadline *uint32) (common.SetRequest, common.RequestType, uint64, error) {
+	// flags, exptime, deadline, key, value
 	flags, err := readUInt32(r)
 	if err != nil {
 		log.Println("Error reading flags")
@@ -431,6 +827,11 @@ func setRequest(r io.Reader, reqHeader RequestHeader, reqType common.RequestType
 		return common.SetRequest{}, reqType, start, err
 	}
 
+	if err := readDeadline(r, reqHeader, 8, deadline); err != nil {
+		log.Println("Error reading deadline")
+		return common.SetRequest{}, reqType, start, err
+	}
+
 	key, err := readString(r, reqHeader.KeyLength)
 	if err != nil {
 		log.Println("Error reading key")
@@ -459,15 +860,126 @@ func setRequest(r io.Reader, reqHeader RequestHeader, reqType common.RequestType
 	}, reqType, start, nil
 }
 
-func appendPrependRequest(r io.Reader, reqHeader RequestHeader, reqType common.RequestType, quiet bool, start uint64) (common.SetRequest, common.RequestType, uint64, error) {
-	// key, value
+func setIfMatchRequest(r io.Reader, reqHeader RequestHeader, quiet bool, start uint64) (common.Request, common.RequestType, uint64, error) {
+	// The whole body is read before checking it so a bad request doesn't leave the rest of it to be
+	// parsed as the next command.
+	body := make([]byte, reqHeader.TotalBodyLength)
+	n, err := io.ReadAtLeast(r, body, len(body))
+	metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(n))
+	if err != nil {
+		return nil, common.RequestSetIfMatch, start, err
+	}
+
+	// flags, exptime, match type, match length, key, match, value
+	fixedLength := uint32(reqHeader.ExtraLength) + uint32(reqHeader.KeyLength)
+	if reqHeader.ExtraLength != 16 || fixedLength > reqHeader.TotalBodyLength {
+		return nil, common.RequestSetIfMatch, start, common.ErrBadRequest
+	}
+
+	flags := binary.BigEndian.Uint32(body[0:4])
+	exptime := binary.BigEndian.Uint32(body[4:8])
+	matchType := binary.BigEndian.Uint32(body[8:12])
+	matchLength := binary.BigEndian.Uint32(body[12:16])
+
+	if matchType != MatchValue && matchType != MatchHash {
+		return nil, common.RequestSetIfMatch, start, common.ErrBadRequest
+	}
+	if matchLength > reqHeader.TotalBodyLength-fixedLength {
+		return nil, common.RequestSetIfMatch, start, common.ErrBadRequest
+	}
+
+	key := body[16:fixedLength]
+	match := body[fixedLength : fixedLength+matchLength]
+	data := body[fixedLength+matchLength:]
+
+	return common.SetIfMatchRequest{
+		SetRequest: common.SetRequest{
+			Quiet:   quiet,
+			Key:     key,
+			Flags:   flags,
+			Exptime: exptime,
+			Opaque:  reqHeader.OpaqueToken,
+			Data:    data,
+		},
+		Match:     match,
+		MatchHash: matchType == MatchHash,
+	}, common.RequestSetIfMatch, start, nil
+}
+
+// arithNoCreate is the expiration that asks for an increment or decrement of a missing key to fail
+// instead of storing the initial value
+const arithNoCreate = 0xffffffff
+
+func arithRequest(r io.Reader, reqHeader RequestHeader, reqType common.RequestType, quiet bool, start uint64) (common.Request, common.RequestType, uint64, error) {
+	// Read the whole body first, like setIfMatchRequest, so a bad one isn't parsed as the next command
+	body := make([]byte, reqHeader.TotalBodyLength)
+	n, err := io.ReadAtLeast(r, body, len(body))
+	metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(n))
+	if err != nil {
+		return nil, reqType, start, err
+	}
+
+	// delta, initial value, exptime, key
+	if reqHeader.ExtraLength != 20 || reqHeader.KeyLength == 0 ||
+		uint32(reqHeader.ExtraLength)+uint32(reqHeader.KeyLength) != reqHeader.TotalBodyLength {
+		return nil, reqType, start, common.ErrBadRequest
+	}
+
+	exptime := binary.BigEndian.Uint32(body[16:20])
+
+	return common.ArithRequest{
+		Key:     body[20:],
+		Delta:   binary.BigEndian.Uint64(body[0:8]),
+		Initial: binary.BigEndian.Uint64(body[8:16]),
+		Exptime: exptime,
+		Create:  exptime != arithNoCreate,
+		Opaque:  reqHeader.OpaqueToken,
+		Quiet:   quiet,
+	}, reqType, start, nil
+}
+
+func flushRequest(r io.Reader, reqHeader RequestHeader, quiet bool, start uint64) (common.Request, common.RequestType, uint64, error) {
+	body := make([]byte, reqHeader.TotalBodyLength)
+	n, err := io.ReadAtLeast(r, body, len(body))
+	metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(n))
+	if err != nil {
+		return nil, common.RequestFlush, start, err
+	}
+
+	// the delay is optional
+	if (reqHeader.ExtraLength != 0 && reqHeader.ExtraLength != 4) || reqHeader.KeyLength != 0 ||
+		uint32(reqHeader.ExtraLength) != reqHeader.TotalBodyLength {
+		return nil, common.RequestFlush, start, common.ErrBadRequest
+	}
+
+	var delay uint32
+	if reqHeader.ExtraLength == 4 {
+		delay = binary.BigEndian.Uint32(body)
+	}
+
+	return common.FlushRequest{
+		Delay:  delay,
+		Opaque: reqHeader.OpaqueToken,
+		Quiet:  quiet,
+	}, common.RequestFlush, start, nil
+}
+
+func appendPrependRequest(r io.Reader, reqHeader RequestHeader, reqType common.RequestType, quiet bool, start uint64, deadline *uint32) (common.SetRequest, common.RequestType, uint64, error) {
+	// deadline, key, value
+	if err := readDeadline(r, reqHeader, 0, deadline); err != nil {
+		log.Println("Error reading deadline")
+		return common.SetRequest{}, reqType, start, err
+	}
+
 	key, err := readString(r, reqHeader.KeyLength)
 	if err != nil {
 		log.Println("Error reading key")
 		return common.SetRequest{}, reqType, start, err
 	}
 
-	realLength := reqHeader.TotalBodyLength - uint32(reqHeader.KeyLength)
+	realLength := reqHeader.TotalBodyLength -
+		uint32(reqHeader.ExtraLength) -
+		uint32(reqHeader.KeyLength)
 
 	// Read in the body of the set request
 	dataBuf := make([]byte, realLength)
@@ -487,6 +999,24 @@ func appendPrependRequest(r io.Reader, reqHeader RequestHeader, reqType common.R
 	}, reqType, start, nil
 }
 
+// readDeadline reads the deadline hint of a command if it has one, given the length of the standard
+// extras it comes after. Only the earliest deadline seen for a request is kept.
+func readDeadline(r io.Reader, reqHeader RequestHeader, extraLen uint8, deadline *uint32) error {
+	if reqHeader.ExtraLength != extraLen+deadlineExtraLen {
+		return nil
+	}
+
+	ms, err := readUInt32(r)
+	if err != nil {
+		return err
+	}
+
+	if ms > 0 && (*deadline == 0 || ms < *deadline) {
+		*deadline = ms
+	}
+	return nil
+}
+
 func readString(r io.Reader, l uint16) ([]byte, error) {
 	buf := make([]byte, l)
 	n, err := io.ReadAtLeast(r, buf, int(l))
@@ -17,9 +17,16 @@ package binprot
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/protocol"
 )
 
 func TestUnknownCommand(t *testing.T) {
@@ -48,6 +55,396 @@ func TestUnknownCommand(t *testing.T) {
 	}
 }
 
+func writeSets(t *testing.T, buf *bytes.Buffer, quiet int, loud bool) {
+	write := func(cmd func(w io.Writer, key []byte, flags, exptime, dataSize, opaque uint32) error, i int) {
+		key := []byte(fmt.Sprintf("key%d", i))
+		data := []byte(fmt.Sprintf("data%d", i))
+		if err := cmd(buf, key, uint32(i), 0, uint32(len(data)), uint32(i)); err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(data)
+	}
+
+	for i := 0; i < quiet; i++ {
+		write(WriteSetQCmd, i)
+	}
+	if loud {
+		write(WriteSetCmd, quiet)
+	}
+}
+
+func TestBatchSet(t *testing.T) {
+	t.Run("EndsWithSet", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		writeSets(t, buf, 3, true)
+
+		req, reqType, _, err := NewBinaryParser(bufio.NewReader(buf)).Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reqType != common.RequestMultiSet {
+			t.Fatalf("Expected a multi set, got %v", reqType)
+		}
+
+		sets := req.(common.MultiSetRequest).Sets
+		if len(sets) != 4 {
+			t.Fatalf("Expected 4 sets, got %d", len(sets))
+		}
+		for i, set := range sets {
+			if string(set.Key) != fmt.Sprintf("key%d", i) || string(set.Data) != fmt.Sprintf("data%d", i) {
+				t.Errorf("Set %d has key %q and data %q", i, set.Key, set.Data)
+			}
+			if set.Opaque != uint32(i) || set.Flags != uint32(i) {
+				t.Errorf("Set %d has opaque %d and flags %d", i, set.Opaque, set.Flags)
+			}
+			if set.Quiet != (i < 3) {
+				t.Errorf("Set %d has quiet %v", i, set.Quiet)
+			}
+		}
+	})
+	t.Run("StopsAtNoop", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		writeSets(t, buf, 2, false)
+		WriteNoopCmd(buf, 42)
+
+		p := NewBinaryParser(bufio.NewReader(buf))
+
+		req, reqType, _, err := p.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reqType != common.RequestMultiSet || len(req.(common.MultiSetRequest).Sets) != 2 {
+			t.Fatalf("Expected a multi set of 2, got %v %#v", reqType, req)
+		}
+
+		req, reqType, _, err = p.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reqType != common.RequestNoop || req.GetOpaque() != 42 {
+			t.Fatalf("Expected the noop to be parsed next, got %v %#v", reqType, req)
+		}
+	})
+	t.Run("Single", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		writeSets(t, buf, 1, false)
+
+		req, reqType, _, err := NewBinaryParser(bufio.NewReader(buf)).Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reqType != common.RequestSet || !req.IsQuiet() {
+			t.Fatalf("Expected a single quiet set, got %v %#v", reqType, req)
+		}
+	})
+	t.Run("Max", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		writeSets(t, buf, MaxBatchSet+10, false)
+
+		p := NewBinaryParser(bufio.NewReaderSize(buf, 64*1024))
+
+		req, _, _, err := p.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := len(req.(common.MultiSetRequest).Sets); n != MaxBatchSet {
+			t.Fatalf("Expected the first batch to have %d sets, got %d", MaxBatchSet, n)
+		}
+
+		req, _, _, err = p.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := len(req.(common.MultiSetRequest).Sets); n != 10 {
+			t.Fatalf("Expected the second batch to have 10 sets, got %d", n)
+		}
+	})
+}
+
+func TestBatchDelete(t *testing.T) {
+	buf := new(bytes.Buffer)
+	for i := 0; i < 3; i++ {
+		WriteDeleteQCmd(buf, []byte(fmt.Sprintf("key%d", i)), uint32(i))
+	}
+	WriteNoopCmd(buf, 3)
+
+	p := NewBinaryParser(bufio.NewReader(buf))
+
+	req, reqType, _, err := p.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqType != common.RequestMultiDelete {
+		t.Fatalf("Expected a multi delete, got %v", reqType)
+	}
+
+	deletes := req.(common.MultiDeleteRequest).Deletes
+	if len(deletes) != 3 {
+		t.Fatalf("Expected 3 deletes, got %d", len(deletes))
+	}
+	for i, del := range deletes {
+		if string(del.Key) != fmt.Sprintf("key%d", i) || del.Opaque != uint32(i) || !del.Quiet {
+			t.Errorf("Unexpected delete %d: %+v", i, del)
+		}
+	}
+
+	if _, reqType, _, err = p.Parse(); err != nil || reqType != common.RequestNoop {
+		t.Fatalf("Expected the noop to be parsed next, got %v %v", reqType, err)
+	}
+}
+
+func TestSetIfMatch(t *testing.T) {
+	buf := new(bytes.Buffer)
+	WriteSetIfMatchCmd(buf, []byte("foo"), 1, 2, MatchValue, []byte("old"), 3, 7)
+	buf.WriteString("new")
+	WriteNoopCmd(buf, 8)
+
+	p := NewBinaryParser(bufio.NewReader(buf))
+
+	req, reqType, _, err := p.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqType != common.RequestSetIfMatch {
+		t.Fatalf("Expected a SetIfMatch request, got %v", reqType)
+	}
+
+	r := req.(common.SetIfMatchRequest)
+	if string(r.Key) != "foo" || string(r.Data) != "new" || string(r.Match) != "old" || r.MatchHash {
+		t.Fatalf("Unexpected request %+v", r)
+	}
+	if r.Flags != 1 || r.Exptime != 2 || r.Opaque != 7 {
+		t.Fatalf("Unexpected flags, exptime or opaque %+v", r)
+	}
+
+	if _, reqType, _, err = p.Parse(); err != nil || reqType != common.RequestNoop {
+		t.Fatalf("Expected the noop to be parsed next, got %v %v", reqType, err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	buf := new(bytes.Buffer)
+	WriteGetLockCmd(buf, []byte("foo"), 10, 1)
+	WriteUnlockCmd(buf, []byte("foo"), 0xdeadbeef, 2)
+
+	p := NewBinaryParser(bufio.NewReader(buf))
+
+	req, reqType, _, err := p.Parse()
+	if err != nil || reqType != common.RequestGetLock {
+		t.Fatalf("Expected a GetLock request, got %v %v", reqType, err)
+	}
+	if r := req.(common.GetLockRequest); string(r.Key) != "foo" || r.LockTime != 10 || r.Opaque != 1 {
+		t.Fatalf("Unexpected request %+v", r)
+	}
+
+	req, reqType, _, err = p.Parse()
+	if err != nil || reqType != common.RequestUnlock {
+		t.Fatalf("Expected an Unlock request, got %v %v", reqType, err)
+	}
+	if r := req.(common.UnlockRequest); string(r.Key) != "foo" || r.Token != 0xdeadbeef || r.Opaque != 2 {
+		t.Fatalf("Unexpected request %+v", r)
+	}
+
+	// the token comes back as the CAS
+	w := bufio.NewWriter(buf)
+	NewBinaryResponder(w).GetLock(common.GetLockResponse{Key: []byte("foo"), Data: []byte("bar"), Opaque: 1, Token: 0xdeadbeef})
+
+	res, err := ReadResponseHeader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Opcode != OpcodeGetLocked || res.CASToken != 0xdeadbeef || res.TotalBodyLength != 7 {
+		t.Fatalf("Unexpected response %+v", res)
+	}
+}
+
+func TestStat(t *testing.T) {
+	buf := new(bytes.Buffer)
+	WriteStatCmd(buf, nil, 1)
+	WriteStatCmd(buf, []byte("slabs"), 2)
+
+	p := NewStrictBinaryParser(bufio.NewReader(buf))
+
+	req, reqType, _, err := p.Parse()
+	if err != nil || reqType != common.RequestStats {
+		t.Fatalf("Expected a Stats request, got %v %v", reqType, err)
+	}
+	if r := req.(common.StatsRequest); r.Group != "" || r.Opaque != 1 {
+		t.Fatalf("Unexpected request %+v", r)
+	}
+
+	req, reqType, _, err = p.Parse()
+	if err != nil || reqType != common.RequestStats {
+		t.Fatalf("Expected a Stats request, got %v %v", reqType, err)
+	}
+	if r := req.(common.StatsRequest); r.Group != "slabs" || r.Opaque != 2 {
+		t.Fatalf("Unexpected request %+v", r)
+	}
+
+	// a packet per stat and an empty one at the end
+	w := bufio.NewWriter(buf)
+	NewBinaryResponder(w).Stats(1, []metrics.Stat{{Name: "pid", Value: "42"}, {Name: "uptime", Value: "7"}})
+
+	for _, expected := range []metrics.Stat{{Name: "pid", Value: "42"}, {Name: "uptime", Value: "7"}, {}} {
+		res, err := ReadResponseHeader(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Opcode != OpcodeStat || res.Status != StatusSuccess || res.OpaqueToken != 1 || res.ExtraLength != 0 {
+			t.Fatalf("Unexpected response %+v", res)
+		}
+
+		body := make([]byte, res.TotalBodyLength)
+		if _, err := io.ReadFull(buf, body); err != nil {
+			t.Fatal(err)
+		}
+		if name, value := string(body[:res.KeyLength]), string(body[res.KeyLength:]); name != expected.Name || value != expected.Value {
+			t.Fatalf("Expected %+v, got %q %q", expected, name, value)
+		}
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("Unexpected trailing response bytes %q", buf.Bytes())
+	}
+}
+
+func TestArith(t *testing.T) {
+	buf := new(bytes.Buffer)
+	WriteIncrCmd(buf, []byte("foo"), 2, 10, 60, 1)
+	WriteDecrQCmd(buf, []byte("foo"), 3, 0, 0xffffffff, 2)
+	WriteFlushQCmd(buf, 30, 3)
+	WriteFlushCmd(buf, 0, 4)
+
+	p := NewStrictBinaryParser(bufio.NewReader(buf))
+
+	req, reqType, _, err := p.Parse()
+	if err != nil || reqType != common.RequestIncr {
+		t.Fatalf("Expected an Incr request, got %v %v", reqType, err)
+	}
+	if r := req.(common.ArithRequest); string(r.Key) != "foo" || r.Delta != 2 || r.Initial != 10 || r.Exptime != 60 || !r.Create || r.Quiet || r.Opaque != 1 {
+		t.Fatalf("Unexpected request %+v", r)
+	}
+
+	// an exptime of 0xffffffff means a missing key isn't created
+	req, reqType, _, err = p.Parse()
+	if err != nil || reqType != common.RequestDecr {
+		t.Fatalf("Expected a Decr request, got %v %v", reqType, err)
+	}
+	if r := req.(common.ArithRequest); string(r.Key) != "foo" || r.Delta != 3 || r.Create || !r.Quiet || r.Opaque != 2 {
+		t.Fatalf("Unexpected request %+v", r)
+	}
+
+	for _, expected := range []common.FlushRequest{{Delay: 30, Opaque: 3, Quiet: true}, {Opaque: 4}} {
+		req, reqType, _, err = p.Parse()
+		if err != nil || reqType != common.RequestFlush || req.(common.FlushRequest) != expected {
+			t.Fatalf("Expected flush %+v, got %v %+v %v", expected, reqType, req, err)
+		}
+	}
+
+	// quiet successes aren't answered, loud ones carry the new value
+	w := bufio.NewWriter(buf)
+	r := NewBinaryResponder(w)
+	r.Incr(1, true, 5)
+	r.Flush(3, true)
+	r.Decr(2, false, 7)
+
+	res, err := ReadResponseHeader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Opcode != OpcodeDecrement || res.OpaqueToken != 2 || res.TotalBodyLength != 8 {
+		t.Fatalf("Unexpected response %+v", res)
+	}
+	if value := binary.BigEndian.Uint64(buf.Next(8)); value != 7 || buf.Len() != 0 {
+		t.Fatalf("Expected only the value 7, got %d and %q", value, buf.Bytes())
+	}
+}
+
+func TestErrorRequestID(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := bufio.NewWriter(buf)
+	r := NewBinaryResponder(w)
+
+	err := common.TagRequestID(common.ErrTempFailure, 0x1234)
+	if err := r.Error(9, common.RequestSet, err, false); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ReadResponseHeader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != StatusTempFailure || res.OpaqueToken != 9 || res.CASToken != 0x1234 {
+		t.Fatalf("Expected a temporary failure carrying the request ID, got %+v", res)
+	}
+}
+
+// writeWithDeadline writes a command with a deadline hint after the given standard extras
+func writeWithDeadline(w io.Writer, opcode uint8, extras []uint32, deadline uint32, key, value []byte) {
+	extraLen := 4*len(extras) + deadlineExtraLen
+	header := makeRequestHeader(opcode, len(key), extraLen, extraLen+len(key)+len(value), 0)
+	writeRequestHeader(w, header)
+
+	for _, e := range append(extras, deadline) {
+		binary.Write(w, binary.BigEndian, e)
+	}
+	w.Write(key)
+	w.Write(value)
+}
+
+func TestDeadline(t *testing.T) {
+	buf := new(bytes.Buffer)
+	writeWithDeadline(buf, OpcodeGetQ, nil, 50, []byte("k1"), nil)
+	writeWithDeadline(buf, OpcodeGetQ, nil, 20, []byte("k2"), nil)
+	WriteGetCmd(buf, []byte("k3"), 0)
+	writeWithDeadline(buf, OpcodeSet, []uint32{1, 2}, 30, []byte("k4"), []byte("value"))
+	writeWithDeadline(buf, OpcodeTouch, []uint32{3}, 40, []byte("k5"), nil)
+	WriteDeleteCmd(buf, []byte("k6"), 0)
+
+	p := NewBinaryParser(bufio.NewReader(buf))
+
+	req, _, _, err := p.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := req.(common.GetRequest).Keys; len(keys) != 3 || string(keys[2]) != "k3" {
+		t.Fatalf("Unexpected batch get %v", keys)
+	}
+	if p.Deadline() != 20*time.Millisecond {
+		t.Fatalf("Expected the earliest deadline in the batch, got %v", p.Deadline())
+	}
+
+	req, _, _, err = p.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := req.(common.SetRequest)
+	if string(set.Key) != "k4" || string(set.Data) != "value" || set.Flags != 1 || set.Exptime != 2 {
+		t.Fatalf("Unexpected set %+v", set)
+	}
+	if p.Deadline() != 30*time.Millisecond {
+		t.Fatalf("Expected a 30ms deadline, got %v", p.Deadline())
+	}
+
+	req, _, _, err = p.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if touch := req.(common.TouchRequest); string(touch.Key) != "k5" || touch.Exptime != 3 {
+		t.Fatalf("Unexpected touch %+v", touch)
+	}
+	if p.Deadline() != 40*time.Millisecond {
+		t.Fatalf("Expected a 40ms deadline, got %v", p.Deadline())
+	}
+
+	req, _, _, err = p.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(req.(common.DeleteRequest).Key) != "k6" || p.Deadline() != 0 {
+		t.Fatalf("Expected a delete without a deadline, got %+v %v", req, p.Deadline())
+	}
+}
+
 type dummyIO struct{}
 
 func (d dummyIO) Read(p []byte) (int, error) {
@@ -88,3 +485,262 @@ func BenchmarkHeaders(b *testing.B) {
 		}
 	})
 }
+
+func TestStrict(t *testing.T) {
+	header := func(opcode, extras uint8, keyLen uint16, body uint32) []byte {
+		buf := make([]byte, ReqHeaderLen)
+		buf[0] = MagicRequest
+		buf[1] = opcode
+		binary.BigEndian.PutUint16(buf[2:], keyLen)
+		buf[4] = extras
+		binary.BigEndian.PutUint32(buf[8:], body)
+		return buf
+	}
+	cmd := func(opcode, extras uint8, key string, value string) []byte {
+		buf := header(opcode, extras, uint16(len(key)), uint32(int(extras)+len(key)+len(value)))
+		buf = append(buf, make([]byte, extras)...)
+		buf = append(buf, key...)
+		return append(buf, value...)
+	}
+
+	typed := cmd(OpcodeGet, 0, "foo", "")
+	typed[5] = 1
+
+	cases := []struct {
+		name  string
+		input []byte
+		err   error
+	}{
+		{"Valid", cmd(OpcodeSet, 8, "foo", "bar"), nil},
+		{"Deadline", cmd(OpcodeGet, 4, "foo", ""), common.ErrBadExtras},
+		{"GetE", cmd(OpcodeGetE, 0, "foo", ""), common.ErrExtension},
+		{"Unsupported", cmd(OpcodeGetK, 0, "foo", ""), common.ErrExtension},
+		{"NoKey", cmd(OpcodeDelete, 0, "", ""), common.ErrBadKey},
+		{"KeyTooLong", cmd(OpcodeTouch, 4, string(make([]byte, 251)), ""), common.ErrKeyTooLong},
+		{"KeyOnNoop", cmd(OpcodeNoop, 0, "foo", ""), common.ErrBadBody},
+		{"ValueOnStat", cmd(OpcodeStat, 0, "foo", "bar"), common.ErrBadBody},
+		{"StatExtensions", cmd(OpcodeStat, 0, "extensions", ""), common.ErrExtension},
+		{"FlushDelay", cmd(OpcodeFlushQ, 4, "", ""), nil},
+		{"IncrExtras", cmd(OpcodeIncrement, 8, "foo", ""), common.ErrBadExtras},
+		{"ValueOnGet", cmd(OpcodeGet, 0, "foo", "bar"), common.ErrBadBody},
+		{"DataType", typed, common.ErrBadDataType},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			buf := bytes.NewBuffer(tc.input)
+			WriteNoopCmd(buf, 7)
+			p := NewStrictBinaryParser(bufio.NewReader(buf))
+
+			if _, _, _, err := p.Parse(); err != tc.err {
+				t.Fatalf("Expected %v, got %v", tc.err, err)
+			}
+			if req, reqType, _, err := p.Parse(); err != nil || reqType != common.RequestNoop || req.(common.NoopRequest).Opaque != 7 {
+				t.Fatalf("Expected the next command to be parsed, got %v %v", reqType, err)
+			}
+		})
+	}
+
+	// a bad request in a batch ends it, and the gets before it are still served
+	buf := bytes.NewBuffer(append(cmd(OpcodeGetQ, 0, "foo", ""), cmd(OpcodeGet, 0, "", "")...))
+	p := NewStrictBinaryParser(bufio.NewReader(buf))
+	if req, _, _, err := p.Parse(); err != nil || len(req.(common.GetRequest).Keys) != 1 {
+		t.Fatalf("Expected the first get, got %v %v", req, err)
+	}
+	if _, _, _, err := p.Parse(); err != common.ErrBadKey {
+		t.Fatalf("Expected %v, got %v", common.ErrBadKey, err)
+	}
+}
+
+func TestVBuckets(t *testing.T) {
+	owned, err := protocol.ParseVBuckets("0-511, 1000")
+	if err != nil {
+		t.Fatalf("Error parsing vbuckets: %v", err)
+	}
+	for _, bad := range []string{"5-1", "x", "70000", "1-"} {
+		if _, err := protocol.ParseVBuckets(bad); err == nil {
+			t.Fatalf("Expected an error parsing %q", bad)
+		}
+	}
+
+	get := func(opcode uint8, vb uint16, opaque uint32) []byte {
+		buf := make([]byte, ReqHeaderLen, ReqHeaderLen+3)
+		buf[0] = MagicRequest
+		buf[1] = opcode
+		binary.BigEndian.PutUint16(buf[2:], 3)
+		binary.BigEndian.PutUint16(buf[6:], vb)
+		binary.BigEndian.PutUint32(buf[8:], 3)
+		binary.BigEndian.PutUint32(buf[12:], opaque)
+		return append(buf, "foo"...)
+	}
+
+	cases := []struct {
+		name  string
+		input []byte
+		err   error
+	}{
+		{"Owned", get(OpcodeGet, 511, 1), nil},
+		{"Single", get(OpcodeGet, 1000, 1), nil},
+		{"NotOwned", get(OpcodeGet, 512, 1), common.ErrNotMyVBucket},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			buf := bytes.NewBuffer(tc.input)
+			WriteNoopCmd(buf, 7)
+			p := protocol.WithVBuckets(Components, owned).NewRequestParser(bufio.NewReader(buf))
+
+			req, _, _, err := p.Parse()
+			if err != tc.err {
+				t.Fatalf("Expected %v, got %v", tc.err, err)
+			}
+			if err == nil && req.(common.GetRequest).Opaques[0] != 1 {
+				t.Fatalf("Expected opaque 1, got %v", req)
+			}
+			if req, reqType, _, err := p.Parse(); err != nil || reqType != common.RequestNoop || req.(common.NoopRequest).Opaque != 7 {
+				t.Fatalf("Expected the next command to be parsed, got %v %v", reqType, err)
+			}
+		})
+	}
+
+	// a pipeline over several vbuckets is split around the ones turned away, each answered with its
+	// own opaque in order
+	set := func(opcode uint8, vb uint16, opaque uint32) []byte {
+		buf := get(opcode, vb, opaque)
+		buf[4] = 8
+		binary.BigEndian.PutUint32(buf[8:], 8+3+3)
+		return append(append(buf[:ReqHeaderLen], make([]byte, 8)...), "foobar"...)
+	}
+	var pipeline []byte
+	for _, b := range [][]byte{
+		get(OpcodeGetQ, 3, 1), get(OpcodeGetQ, 999, 2), get(OpcodeGetQ, 4, 3), get(OpcodeGet, 5, 4),
+		set(OpcodeSetQ, 6, 5), set(OpcodeSetQ, 7, 6), set(OpcodeSetQ, 512, 7), set(OpcodeSet, 8, 8),
+	} {
+		pipeline = append(pipeline, b...)
+	}
+	p := protocol.WithVBuckets(Components, owned).NewRequestParser(bufio.NewReader(bytes.NewBuffer(pipeline)))
+
+	expected := []struct {
+		reqType common.RequestType
+		opaques []uint32
+		err     error
+	}{
+		{common.RequestGet, []uint32{1}, nil},
+		{common.RequestUnknown, []uint32{2}, common.ErrNotMyVBucket},
+		{common.RequestGet, []uint32{3, 4}, nil},
+		{common.RequestMultiSet, []uint32{5, 6}, nil},
+		{common.RequestUnknown, []uint32{7}, common.ErrNotMyVBucket},
+		{common.RequestSet, []uint32{8}, nil},
+	}
+	for _, e := range expected {
+		req, reqType, _, err := p.Parse()
+		if err != e.err || reqType != e.reqType {
+			t.Fatalf("Expected %v %v, got %v %v", e.reqType, e.err, reqType, err)
+		}
+
+		var opaques []uint32
+		switch r := req.(type) {
+		case common.GetRequest:
+			opaques = r.Opaques
+		case common.MultiSetRequest:
+			for _, s := range r.Sets {
+				opaques = append(opaques, s.Opaque)
+			}
+		default:
+			opaques = []uint32{r.GetOpaque()}
+		}
+		if !reflect.DeepEqual(opaques, e.opaques) {
+			t.Fatalf("Expected opaques %v, got %v", e.opaques, opaques)
+		}
+	}
+
+	// a rejected request's opaque comes back with the error
+	buf := bytes.NewBuffer(get(OpcodeGet, 4000, 42))
+	req, _, _, err := protocol.WithVBuckets(Components, owned).NewRequestParser(bufio.NewReader(buf)).Parse()
+	if err != common.ErrNotMyVBucket || req == nil || req.GetOpaque() != 42 {
+		t.Fatalf("Expected NOT_MY_VBUCKET for opaque 42, got %v %v", req, err)
+	}
+
+	// everything is served without a set
+	buf = bytes.NewBuffer(get(OpcodeGet, 4000, 42))
+	if _, _, _, err := protocol.WithVBuckets(Components, nil).NewRequestParser(bufio.NewReader(buf)).Parse(); err != nil {
+		t.Fatalf("Expected every vbucket to be served, got %v", err)
+	}
+}
+
+func TestQuirks(t *testing.T) {
+	unknown := []byte{
+		0x80, 0xFF, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, // total body length
+		0x00, 0x00, 0x00, 0xA5, // opaque token
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}
+	spy := protocol.WithQuirks(Components, protocol.Profiles["spymemcached"])
+
+	req, _, _, err := spy.NewRequestParser(bufio.NewReader(bytes.NewReader(unknown))).Parse()
+	if err != common.ErrUnknownCmd || req == nil || req.GetOpaque() != 0xA5 {
+		t.Fatalf("Expected the header's opaque with the error, got %v %v", req, err)
+	}
+
+	respond := func(c protocol.Components, f func(protocol.Responder)) []byte {
+		buf := new(bytes.Buffer)
+		w := bufio.NewWriter(buf)
+		f(c.NewResponder(w))
+		w.Flush()
+		return buf.Bytes()
+	}
+	quietHit := func(r protocol.Responder) {
+		r.Get(common.GetResponse{Key: []byte("a"), Data: []byte("b"), Quiet: true})
+	}
+	notFound := func(r protocol.Responder) {
+		r.Error(1, common.RequestGet, common.ErrKeyNotFound, false)
+	}
+
+	if res := respond(Components, quietHit); res[1] != OpcodeGet {
+		t.Errorf("Expected a quiet hit to be a GET by default, got opcode %#x", res[1])
+	}
+	if res := respond(spy, quietHit); res[1] != OpcodeGetQ {
+		t.Errorf("Expected a quiet hit to be a GETQ, got opcode %#x", res[1])
+	}
+	if res := respond(Components, notFound); len(res) != resHeaderLen {
+		t.Errorf("Expected an error without a body by default, got %q", res)
+	}
+	if res := respond(spy, notFound); string(res[resHeaderLen:]) != "Not found" || binary.BigEndian.Uint32(res[8:12]) != 9 {
+		t.Errorf("Expected memcached's message, got %q", res)
+	}
+
+	lib := protocol.WithQuirks(Components, protocol.Profiles["libmemcached"])
+	if res := respond(lib, func(r protocol.Responder) { r.Version(1) }); string(res[resHeaderLen:]) != "1.6.0" {
+		t.Errorf("Expected a memcached version, got %q", res)
+	}
+
+	if _, err := protocol.ParseProfile("dalli"); err == nil {
+		t.Error("Expected an unknown profile to fail")
+	}
+}
+
+func TestZeroCopy(t *testing.T) {
+	large := bytes.Repeat([]byte("x"), 100)
+
+	respond := func(min int) []byte {
+		buf := new(bytes.Buffer)
+		w := bufio.NewWriter(buf)
+		r := protocol.NewResponderTo(Components, protocol.NewResponseWriter(w, buf, min))
+		r.Get(common.GetResponse{Key: []byte("small"), Data: []byte("v"), Flags: 1, Opaque: 1})
+		r.GetE(common.GetEResponse{Key: []byte("large"), Data: large, Flags: 2, Exptime: 3, Opaque: 2})
+		r.GetEnd(3, true)
+		return buf.Bytes()
+	}
+
+	copied, direct := respond(0), respond(10)
+	if !bytes.Equal(copied, direct) {
+		t.Fatalf("Expected %x, got %x", copied, direct)
+	}
+
+	// header, flags, and exptime in front of the large value
+	gete := copied[resHeaderLen+4+1:]
+	if gete[1] != OpcodeGetE || gete[4] != 8 || binary.BigEndian.Uint32(gete[8:12]) != 108 ||
+		binary.BigEndian.Uint32(gete[resHeaderLen+4:]) != 3 || !bytes.Equal(gete[resHeaderLen+8:resHeaderLen+108], large) {
+		t.Fatalf("Unexpected GetE response %x", gete)
+	}
+}
@@ -20,6 +20,7 @@ import (
 
 	"github.com/netflix/rend/common"
 	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/protocol"
 )
 
 // Sample Get response
@@ -117,50 +118,63 @@ import (
 //     Value               : None
 
 type BinaryResponder struct {
-	writer *bufio.Writer
+	writer protocol.ResponseWriter
+	quirks protocol.Quirks
 }
 
 func NewBinaryResponder(writer *bufio.Writer) BinaryResponder {
 	return BinaryResponder{
-		writer: writer,
+		writer: protocol.NewResponseWriter(writer, nil, 0),
 	}
 }
 
 func (b BinaryResponder) Set(opaque uint32, quiet bool) error {
 	if !quiet {
-		return writeSuccessResponseHeader(b.writer, OpcodeSet, 0, 0, 0, opaque, true)
+		return writeSuccessResponseHeader(b.writer.Writer, OpcodeSet, 0, 0, 0, opaque, true)
 	}
 	return nil
 }
 
 func (b BinaryResponder) Add(opaque uint32, quiet bool) error {
 	if !quiet {
-		return writeSuccessResponseHeader(b.writer, OpcodeAdd, 0, 0, 0, opaque, true)
+		return writeSuccessResponseHeader(b.writer.Writer, OpcodeAdd, 0, 0, 0, opaque, true)
 	}
 	return nil
 }
 
 func (b BinaryResponder) Replace(opaque uint32, quiet bool) error {
 	if !quiet {
-		return writeSuccessResponseHeader(b.writer, OpcodeReplace, 0, 0, 0, opaque, true)
+		return writeSuccessResponseHeader(b.writer.Writer, OpcodeReplace, 0, 0, 0, opaque, true)
 	}
 	return nil
 }
 
 func (b BinaryResponder) Append(opaque uint32, quiet bool) error {
 	if !quiet {
-		return writeSuccessResponseHeader(b.writer, OpcodeAppend, 0, 0, 0, opaque, true)
+		return writeSuccessResponseHeader(b.writer.Writer, OpcodeAppend, 0, 0, 0, opaque, true)
 	}
 	return nil
 }
 
 func (b BinaryResponder) Prepend(opaque uint32, quiet bool) error {
 	if !quiet {
-		return writeSuccessResponseHeader(b.writer, OpcodePrepend, 0, 0, 0, opaque, true)
+		return writeSuccessResponseHeader(b.writer.Writer, OpcodePrepend, 0, 0, 0, opaque, true)
 	}
 	return nil
 }
 
+func (b BinaryResponder) SetIfMatch(opaque uint32, quiet bool) error {
+	if !quiet {
+		return writeSuccessResponseHeader(b.writer.Writer, OpcodeSetIfMatch, 0, 0, 0, opaque, true)
+	}
+	return nil
+}
+
+// CompareAndSwap answers like a set, which is what a set with a CAS value is in the binary protocol
+func (b BinaryResponder) CompareAndSwap(opaque uint32, quiet bool) error {
+	return b.Set(opaque, quiet)
+}
+
 func (b BinaryResponder) Get(response common.GetResponse) error {
 	if response.Miss {
 		if !response.Quiet {
@@ -169,14 +183,23 @@ func (b BinaryResponder) Get(response common.GetResponse) error {
 		return nil
 	}
 
-	return getCommon(b.writer, response, OpcodeGet)
+	return getCommon(b.writer, b.opcode(OpcodeGet, OpcodeGetQ, response.Quiet), response.Opaque, 0, response.Data, response.Flags)
+}
+
+// opcode returns the opcode a hit is answered with, which is the quiet one for a quiet request
+// only with the QuietOpcodes quirk
+func (b BinaryResponder) opcode(loud, quiet uint8, isQuiet bool) uint8 {
+	if isQuiet && b.quirks.QuietOpcodes {
+		return quiet
+	}
+	return loud
 }
 
 func (b BinaryResponder) GetEnd(opaque uint32, noopEnd bool) error {
 	// if Noop was the end of the pipelined batch gets, respond with a Noop header
 	// otherwise, stay quiet as the last get would be a GET and not a GETQ
 	if noopEnd {
-		return writeSuccessResponseHeader(b.writer, OpcodeNoop, 0, 0, 0, opaque, true)
+		return writeSuccessResponseHeader(b.writer.Writer, OpcodeNoop, 0, 0, 0, opaque, true)
 	}
 
 	return nil
@@ -190,7 +213,20 @@ func (b BinaryResponder) GAT(response common.GetResponse) error {
 		return nil
 	}
 
-	return getCommon(b.writer, response, OpcodeGat)
+	return getCommon(b.writer, b.opcode(OpcodeGat, OpcodeGatQ, response.Quiet), response.Opaque, 0, response.Data, response.Flags)
+}
+
+// Gets answers like a get with the CAS value of the data in the header, where the binary protocol
+// always has room for it.
+func (b BinaryResponder) Gets(response common.GetResponse) error {
+	if response.Miss {
+		if !response.Quiet {
+			return b.Error(response.Opaque, common.RequestGets, common.ErrKeyNotFound, false)
+		}
+		return nil
+	}
+
+	return getCommon(b.writer, b.opcode(OpcodeGet, OpcodeGetQ, response.Quiet), response.Opaque, response.Cas, response.Data, response.Flags)
 }
 
 func (b BinaryResponder) GetE(response common.GetEResponse) error {
@@ -201,51 +237,136 @@ func (b BinaryResponder) GetE(response common.GetEResponse) error {
 		return nil
 	}
 
-	// total body length = extras (flags & exptime, 8 bytes) + data length
-	totalBodyLength := len(response.Data) + 8
-	writeSuccessResponseHeader(b.writer, OpcodeGetE, 0, 8, totalBodyLength, response.Opaque, false)
-	binary.Write(b.writer, binary.BigEndian, response.Flags)
-	binary.Write(b.writer, binary.BigEndian, response.Exptime)
-	b.writer.Write(response.Data)
+	// extras are the flags and the expiration time
+	return getCommon(b.writer, b.opcode(OpcodeGetE, OpcodeGetEQ, response.Quiet), response.Opaque, 0, response.Data, response.Flags, response.Exptime)
+}
 
-	if err := b.writer.Flush(); err != nil {
-		return err
+func (b BinaryResponder) GetLock(response common.GetLockResponse) error {
+	return getCommon(b.writer, OpcodeGetLocked, response.Opaque, response.Token, response.Data, response.Flags)
+}
+
+func (b BinaryResponder) Unlock(opaque uint32) error {
+	return writeSuccessResponseHeader(b.writer.Writer, OpcodeUnlockKey, 0, 0, 0, opaque, true)
+}
+
+func (b BinaryResponder) Delete(opaque uint32, quiet bool) error {
+	if !quiet {
+		return writeSuccessResponseHeader(b.writer.Writer, OpcodeDelete, 0, 0, 0, opaque, true)
 	}
-	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(totalBodyLength))
 	return nil
 }
 
-func (b BinaryResponder) Delete(opaque uint32) error {
-	return writeSuccessResponseHeader(b.writer, OpcodeDelete, 0, 0, 0, opaque, true)
+func (b BinaryResponder) Touch(opaque uint32, quiet bool) error {
+	if !quiet {
+		return writeSuccessResponseHeader(b.writer.Writer, OpcodeTouch, 0, 0, 0, opaque, true)
+	}
+	return nil
 }
 
-func (b BinaryResponder) Touch(opaque uint32) error {
-	return writeSuccessResponseHeader(b.writer, OpcodeTouch, 0, 0, 0, opaque, true)
+func (b BinaryResponder) Incr(opaque uint32, quiet bool, value uint64) error {
+	if !quiet {
+		return arithCommon(b.writer.Writer, OpcodeIncrement, opaque, value)
+	}
+	return nil
+}
+
+func (b BinaryResponder) Decr(opaque uint32, quiet bool, value uint64) error {
+	if !quiet {
+		return arithCommon(b.writer.Writer, OpcodeDecrement, opaque, value)
+	}
+	return nil
+}
+
+func (b BinaryResponder) Flush(opaque uint32, quiet bool) error {
+	if !quiet {
+		return writeSuccessResponseHeader(b.writer.Writer, OpcodeFlush, 0, 0, 0, opaque, true)
+	}
+	return nil
 }
 
 func (b BinaryResponder) Noop(opaque uint32) error {
-	return writeSuccessResponseHeader(b.writer, OpcodeNoop, 0, 0, 0, opaque, true)
+	return writeSuccessResponseHeader(b.writer.Writer, OpcodeNoop, 0, 0, 0, opaque, true)
 }
 
 func (b BinaryResponder) Quit(opaque uint32, quiet bool) error {
 	if !quiet {
-		return writeSuccessResponseHeader(b.writer, OpcodeQuit, 0, 0, 0, opaque, true)
+		return writeSuccessResponseHeader(b.writer.Writer, OpcodeQuit, 0, 0, 0, opaque, true)
 	}
 	return nil
 }
 
 func (b BinaryResponder) Version(opaque uint32) error {
-	if err := writeSuccessResponseHeader(b.writer, OpcodeVersion, 0, 0, len(common.VersionString), opaque, false); err != nil {
+	version := common.VersionString
+	if b.quirks.Version != "" {
+		version = b.quirks.Version
+	}
+	if err := writeSuccessResponseHeader(b.writer.Writer, OpcodeVersion, 0, 0, len(version), opaque, false); err != nil {
 		return err
 	}
-	n, _ := b.writer.WriteString(common.VersionString)
+	n, _ := b.writer.WriteString(version)
 	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
 	return b.writer.Flush()
 }
 
+// Stats sends a packet for each stat with the name as the key and the value as the value, ending
+// with a packet with neither.
+func (b BinaryResponder) Stats(opaque uint32, stats []metrics.Stat) error {
+	for _, s := range stats {
+		if err := writeSuccessResponseHeader(b.writer.Writer, OpcodeStat, len(s.Name), 0, len(s.Name)+len(s.Value), opaque, false); err != nil {
+			return err
+		}
+		n, _ := b.writer.WriteString(s.Name)
+		n2, _ := b.writer.WriteString(s.Value)
+		metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n+n2))
+	}
+	if err := writeSuccessResponseHeader(b.writer.Writer, OpcodeStat, 0, 0, 0, opaque, false); err != nil {
+		return err
+	}
+	return b.writer.Flush()
+}
+
 func (b BinaryResponder) Error(opaque uint32, reqType common.RequestType, err error, quiet bool) error {
 	// TODO: proper opcode
-	return writeErrorResponseHeader(b.writer, reqTypeToOpcode(reqType, quiet), errorToCode(err), opaque)
+	// The CAS is meaningless in an error response, so it's free to carry the request ID
+	id, _ := common.RequestIDOf(err)
+	status := errorToCode(err)
+	var msg string
+	if b.quirks.ErrorMessages {
+		msg = errorMessage(status, err)
+	}
+	return writeErrorResponse(b.writer.Writer, reqTypeToOpcode(reqType, quiet), status, opaque, uint64(id), msg)
+}
+
+// errorMessage returns the message memcached sends in the body of an error response with the
+// given status, or the error's own for statuses memcached doesn't have. The cause of an error is
+// never sent, since it can hold details of the backends.
+func errorMessage(status uint16, err error) string {
+	switch status {
+	case StatusKeyEnoent:
+		return "Not found"
+	case StatusKeyExists:
+		return "Data exists for key."
+	case StatusE2big:
+		return "Too large."
+	case StatusEinval:
+		return "Invalid arguments"
+	case StatusNotStored:
+		return "Not stored."
+	case StatusDeltaBadval:
+		return "Non-numeric server-side value for incr or decr"
+	case StatusAuthError:
+		return "Auth failure."
+	case StatusUnknownCommand:
+		return "Unknown command"
+	case StatusEnomem:
+		return "Out of memory"
+	case StatusNotSupported:
+		return "Not supported"
+	}
+	if e, ok := common.AsError(err); ok {
+		return e.Message
+	}
+	return "Internal error"
 }
 
 // Mae sure this includes all possibilities in the github.com/netflix/rend/common.RequestType enum
@@ -255,6 +376,8 @@ func reqTypeToOpcode(rt common.RequestType, quiet bool) uint8 {
 		return OpcodeGet
 	case rt == common.RequestGet && !quiet:
 		return OpcodeGet
+	case rt == common.RequestGets:
+		return OpcodeGet
 	case rt == common.RequestGat:
 		return OpcodeGat
 	case rt == common.RequestGetE:
@@ -263,6 +386,10 @@ func reqTypeToOpcode(rt common.RequestType, quiet bool) uint8 {
 		return OpcodeSetQ
 	case rt == common.RequestSet && !quiet:
 		return OpcodeSet
+	case rt == common.RequestCAS && quiet:
+		return OpcodeSetQ
+	case rt == common.RequestCAS && !quiet:
+		return OpcodeSet
 	case rt == common.RequestAdd && quiet:
 		return OpcodeAddQ
 	case rt == common.RequestAdd && !quiet:
@@ -285,28 +412,76 @@ func reqTypeToOpcode(rt common.RequestType, quiet bool) uint8 {
 		return OpcodeDelete
 	case rt == common.RequestTouch:
 		return OpcodeTouch
+	case rt == common.RequestSetIfMatch && quiet:
+		return OpcodeSetIfMatchQ
+	case rt == common.RequestSetIfMatch && !quiet:
+		return OpcodeSetIfMatch
+	case rt == common.RequestGetLock:
+		return OpcodeGetLocked
+	case rt == common.RequestUnlock:
+		return OpcodeUnlockKey
+	case rt == common.RequestStats:
+		return OpcodeStat
+	case rt == common.RequestIncr && quiet:
+		return OpcodeIncrementQ
+	case rt == common.RequestIncr && !quiet:
+		return OpcodeIncrement
+	case rt == common.RequestDecr && quiet:
+		return OpcodeDecrementQ
+	case rt == common.RequestDecr && !quiet:
+		return OpcodeDecrement
+	case rt == common.RequestFlush && quiet:
+		return OpcodeFlushQ
+	case rt == common.RequestFlush && !quiet:
+		return OpcodeFlush
 	default:
 		return OpcodeInvalid
 	}
 }
 
-func getCommon(w *bufio.Writer, response common.GetResponse, opcode uint8) error {
-	// total body length = extras (flags, 4 bytes) + data length
-	totalBodyLength := len(response.Data) + 4
-	writeSuccessResponseHeader(w, opcode, 0, 4, totalBodyLength, response.Opaque, false)
-	buf := make([]byte, 4)
-	binary.BigEndian.PutUint32(buf, response.Flags)
-	w.Write(buf)
-	w.Write(response.Data)
-	if err := w.Flush(); err != nil {
+// arithCommon answers an increment or decrement with the new value as an 8 byte body
+func arithCommon(w *bufio.Writer, opcode uint8, opaque uint32, value uint64) error {
+	if err := writeSuccessResponseHeader(w, opcode, 0, 0, 8, opaque, false); err != nil {
 		return err
 	}
-	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(totalBodyLength))
-	return nil
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, value)
+	n, _ := w.Write(buf)
+	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
+	return w.Flush()
+}
+
+// getCommon writes a successful response with a value, for every kind of get. The header and
+// extras are put together in one buffer so the value can follow them in the same write, straight
+// from where it is if it's large. Every get has the flags as its first extra; some add more.
+func getCommon(w protocol.ResponseWriter, opcode uint8, opaque uint32, cas uint64, data []byte, extras ...uint32) error {
+	var buf [resHeaderLen + 8]byte
+	extraLength := 4 * len(extras)
+	totalBodyLength := extraLength + len(data)
+
+	buf[0] = MagicResponse
+	buf[1] = opcode
+	buf[4] = uint8(extraLength)
+	binary.BigEndian.PutUint16(buf[6:8], StatusSuccess)
+	binary.BigEndian.PutUint32(buf[8:12], uint32(totalBodyLength))
+	binary.BigEndian.PutUint32(buf[12:16], opaque)
+	binary.BigEndian.PutUint64(buf[16:24], cas)
+	for i, e := range extras {
+		binary.BigEndian.PutUint32(buf[resHeaderLen+4*i:], e)
+	}
+
+	n, err := w.WriteValue(buf[:resHeaderLen+extraLength], data, nil)
+	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
+	return err
 }
 
 func writeSuccessResponseHeader(w *bufio.Writer, opcode uint8, keyLength, extraLength,
 	totalBodyLength int, opaque uint32, flush bool) error {
+	return writeSuccessResponseHeaderCAS(w, opcode, keyLength, extraLength, totalBodyLength, opaque, 0, flush)
+}
+
+func writeSuccessResponseHeaderCAS(w *bufio.Writer, opcode uint8, keyLength, extraLength,
+	totalBodyLength int, opaque uint32, cas uint64, flush bool) error {
 
 	header := resHeadPool.Get().(ResponseHeader)
 
@@ -318,7 +493,7 @@ func writeSuccessResponseHeader(w *bufio.Writer, opcode uint8, keyLength, extraL
 	header.Status = StatusSuccess
 	header.TotalBodyLength = uint32(totalBodyLength)
 	header.OpaqueToken = opaque
-	header.CASToken = uint64(0)
+	header.CASToken = cas
 
 	if err := writeResponseHeader(w, header); err != nil {
 		resHeadPool.Put(header)
@@ -338,7 +513,8 @@ func writeSuccessResponseHeader(w *bufio.Writer, opcode uint8, keyLength, extraL
 	return nil
 }
 
-func writeErrorResponseHeader(w *bufio.Writer, opcode uint8, status uint16, opaque uint32) error {
+// writeErrorResponse writes an error response with msg as its body
+func writeErrorResponse(w *bufio.Writer, opcode uint8, status uint16, opaque uint32, cas uint64, msg string) error {
 	header := resHeadPool.Get().(ResponseHeader)
 
 	header.Magic = MagicResponse
@@ -347,14 +523,16 @@ func writeErrorResponseHeader(w *bufio.Writer, opcode uint8, status uint16, opaq
 	header.ExtraLength = uint8(0)
 	header.DataType = uint8(0)
 	header.Status = status
-	header.TotalBodyLength = uint32(0)
+	header.TotalBodyLength = uint32(len(msg))
 	header.OpaqueToken = opaque
-	header.CASToken = uint64(0)
+	header.CASToken = cas
 
 	if err := writeResponseHeader(w, header); err != nil {
 		resHeadPool.Put(header)
 		return err
 	}
+	n, _ := w.WriteString(msg)
+	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
 
 	if err := w.Flush(); err != nil {
 		resHeadPool.Put(header)
@@ -0,0 +1,120 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package binprot
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+)
+
+const maxKeyLength = 250
+
+// shape is what the spec says a request with an opcode carries
+type shape struct {
+	extras uint8
+	key    bool
+	value  bool
+}
+
+// strictShapes has every opcode a strict parser accepts. Extensions, like GetE and the deadline
+// hint extras, aren't in it, and neither are the opcodes rend doesn't serve.
+var strictShapes = map[uint8]shape{
+	OpcodeGet:      {0, true, false},
+	OpcodeGetQ:     {0, true, false},
+	OpcodeSet:      {8, true, true},
+	OpcodeSetQ:     {8, true, true},
+	OpcodeAdd:      {8, true, true},
+	OpcodeAddQ:     {8, true, true},
+	OpcodeReplace:  {8, true, true},
+	OpcodeReplaceQ: {8, true, true},
+	OpcodeAppend:   {0, true, true},
+	OpcodeAppendQ:  {0, true, true},
+	OpcodePrepend:  {0, true, true},
+	OpcodePrependQ: {0, true, true},
+	OpcodeDelete:   {0, true, false},
+	OpcodeDeleteQ:  {0, true, false},
+	OpcodeTouch:    {4, true, false},
+	OpcodeGat:      {4, true, false},
+	OpcodeNoop:     {0, false, false},
+	OpcodeQuit:     {0, false, false},
+	OpcodeQuitQ:    {0, false, false},
+	OpcodeVersion:  {0, false, false},
+	OpcodeStat:     {0, false, false},
+
+	OpcodeIncrement:  {20, true, false},
+	OpcodeIncrementQ: {20, true, false},
+	OpcodeDecrement:  {20, true, false},
+	OpcodeDecrementQ: {20, true, false},
+	OpcodeFlush:      {0, false, false},
+	OpcodeFlushQ:     {0, false, false},
+}
+
+// checkStrict holds a request header to the spec. A rejected request's body is skipped, so the
+// connection stays usable and the client gets an error saying what was wrong.
+func checkStrict(r io.Reader, h RequestHeader) error {
+	err := strictError(h)
+	if err == nil {
+		return nil
+	}
+
+	if derr := skipBody(r, h); derr != nil {
+		return derr
+	}
+
+	return err
+}
+
+// skipBody reads past the body of a request that won't be parsed
+func skipBody(r io.Reader, h RequestHeader) error {
+	n, err := io.CopyN(ioutil.Discard, r, int64(h.TotalBodyLength))
+	metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(n))
+	return err
+}
+
+func strictError(h RequestHeader) error {
+	s, ok := strictShapes[h.Opcode]
+	if !ok {
+		return common.ErrExtension
+	}
+
+	if h.DataType != 0 {
+		return common.ErrBadDataType
+	}
+	// the delay of a flush is optional
+	flushDelay := (h.Opcode == OpcodeFlush || h.Opcode == OpcodeFlushQ) && h.ExtraLength == 4
+	if h.ExtraLength != s.extras && !flushDelay {
+		return common.ErrBadExtras
+	}
+
+	switch {
+	case s.key && h.KeyLength == 0:
+		return common.ErrBadKey
+	case h.KeyLength > maxKeyLength:
+		return common.ErrKeyTooLong
+	case !s.key && h.KeyLength != 0 && h.Opcode != OpcodeStat:
+		// the key of a stat is the optional group
+		return common.ErrBadBody
+	}
+
+	fixed := uint32(h.ExtraLength) + uint32(h.KeyLength)
+	if h.TotalBodyLength < fixed || (!s.value && h.TotalBodyLength != fixed) {
+		return common.ErrBadBody
+	}
+
+	return nil
+}
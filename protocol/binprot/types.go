@@ -65,6 +65,21 @@ const (
 	OpcodeGetE  = uint8(0x40)
 	OpcodeGetEQ = uint8(0x41)
 
+	// Conditional set, a Rend extension. The extras are the flags, the exptime, the kind of match
+	// (MatchValue or MatchHash) and the length of the match token, 4 bytes each. The body is the
+	// key, the match token, and then the value.
+	OpcodeSetIfMatch  = uint8(0x42)
+	OpcodeSetIfMatchQ = uint8(0x43)
+
+	// Pessimistic locking, with the opcodes Couchbase uses. GetLocked has an optional 4 byte extra,
+	// the lock time in seconds, and answers like a get with the unlock token as the CAS. UnlockKey
+	// takes the token as its CAS.
+	OpcodeGetLocked = uint8(0x94)
+	OpcodeUnlockKey = uint8(0x95)
+
+	MatchValue = uint32(0)
+	MatchHash  = uint32(1)
+
 	StatusSuccess        = uint16(0x00)
 	StatusKeyEnoent      = uint16(0x01)
 	StatusKeyExists      = uint16(0x02)
@@ -72,6 +87,9 @@ const (
 	StatusEinval         = uint16(0x04)
 	StatusNotStored      = uint16(0x05)
 	StatusDeltaBadval    = uint16(0x06)
+	StatusNotMyVbucket   = uint16(0x07)
+	StatusLocked         = uint16(0x09)
+	StatusNotLocked      = uint16(0x0e)
 	StatusAuthError      = uint16(0x20)
 	StatusAuthContinue   = uint16(0x21)
 	StatusUnknownCommand = uint16(0x81)
@@ -88,6 +106,9 @@ func DecodeError(header ResponseHeader) error {
 	case StatusKeyEnoent:
 		return common.ErrKeyNotFound
 	case StatusKeyExists:
+		if header.Opcode == OpcodeAdd || header.Opcode == OpcodeAddQ {
+			return common.ErrNotAdded
+		}
 		return common.ErrKeyExists
 	case StatusE2big:
 		return common.ErrValueTooBig
@@ -97,6 +118,12 @@ func DecodeError(header ResponseHeader) error {
 		return common.ErrItemNotStored
 	case StatusDeltaBadval:
 		return common.ErrBadIncDecValue
+	case StatusNotMyVbucket:
+		return common.ErrNotMyVBucket
+	case StatusLocked:
+		return common.ErrLocked
+	case StatusNotLocked:
+		return common.ErrNotLocked
 	case StatusAuthError:
 		return common.ErrAuth
 	case StatusUnknownCommand:
@@ -116,33 +143,8 @@ func DecodeError(header ResponseHeader) error {
 }
 
 func errorToCode(err error) uint16 {
-	switch err {
-	case common.ErrKeyNotFound:
-		return StatusKeyEnoent
-	case common.ErrKeyExists:
-		return StatusKeyExists
-	case common.ErrValueTooBig:
-		return StatusE2big
-	case common.ErrInvalidArgs:
-		return StatusEinval
-	case common.ErrItemNotStored:
-		return StatusNotStored
-	case common.ErrBadIncDecValue:
-		return StatusDeltaBadval
-	case common.ErrAuth:
-		return StatusAuthError
-	case common.ErrUnknownCmd:
-		return StatusUnknownCommand
-	case common.ErrNoMem:
-		return StatusEnomem
-	case common.ErrNotSupported:
-		return StatusNotSupported
-	case common.ErrInternal:
-		return StatusInternalError
-	case common.ErrBusy:
-		return StatusBusy
-	case common.ErrTempFailure:
-		return StatusTempFailure
+	if e, ok := common.AsError(err); ok {
+		return e.Status
 	}
 	return StatusInvalid
 }
@@ -0,0 +1,94 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Quirks are ways of answering that differ from rend's usual ones but match what memcached itself
+// does, for client libraries that were written against memcached and depend on the difference.
+// The zero value is rend's usual behavior.
+type Quirks struct {
+	// ErrorMessages puts memcached's message for the status, e.g. "Not found", in the body of
+	// binary error responses instead of leaving it empty
+	ErrorMessages bool
+	// QuietOpcodes answers binary quiet gets that hit with the quiet opcode they were sent with,
+	// e.g. GETQ, rather than the opcode of the plain get
+	QuietOpcodes bool
+	// HeaderOpaques answers binary requests that can't be parsed past their header with the
+	// opaque from the header instead of 0, so clients can match the error to the request
+	HeaderOpaques bool
+	// Version is the version sent to clients in place of rend's own, for clients that parse it
+	// as a memcached version number. Empty sends rend's.
+	Version string
+}
+
+// Profiles are the quirks each known client library needs, by name
+var Profiles = map[string]Quirks{
+	"none": {},
+	// spymemcached checks that every binary response has the opcode and opaque of the request it
+	// answers and reports error messages as the status of failed operations
+	"spymemcached": {
+		ErrorMessages: true,
+		QuietOpcodes:  true,
+		HeaderOpaques: true,
+	},
+	// libmemcached fails the version command when the version isn't a memcached version number,
+	// and reads error messages into the result of failed operations
+	"libmemcached": {
+		ErrorMessages: true,
+		Version:       "1.6.0",
+	},
+	// php-memcached is built on libmemcached. It keeps the type of each value in its flags, which
+	// rend already stores and returns as given.
+	"php-memcached": {
+		ErrorMessages: true,
+		Version:       "1.6.0",
+	},
+}
+
+// ParseProfile returns the quirks of the named profile in Profiles. An empty name is "none".
+func ParseProfile(name string) (Quirks, error) {
+	if name == "" {
+		return Quirks{}, nil
+	}
+	if q, ok := Profiles[name]; ok {
+		return q, nil
+	}
+
+	names := make([]string, 0, len(Profiles))
+	for n := range Profiles {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return Quirks{}, fmt.Errorf("Unknown client profile %q, expected one of %s", name, strings.Join(names, ", "))
+}
+
+// QuirkComponents is implemented by Components that can answer with quirks
+type QuirkComponents interface {
+	WithQuirks(q Quirks) Components
+}
+
+// WithQuirks returns components that answer with the given quirks. Components that don't
+// implement QuirkComponents are returned unchanged.
+func WithQuirks(c Components, q Quirks) Components {
+	if qc, ok := c.(QuirkComponents); ok {
+		return qc.WithQuirks(q)
+	}
+	return c
+}
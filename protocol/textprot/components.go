@@ -23,14 +23,44 @@ import (
 // Components is the holder for all the different protocol components in the textprot package
 var Components protocol.Components = comps{}
 
-type comps struct{}
+type comps struct {
+	strict bool
+	quirks protocol.Quirks
+}
 
 func (c comps) NewRequestParser(r *bufio.Reader) protocol.RequestParser {
+	if c.strict {
+		return NewStrictTextParser(r)
+	}
 	return NewTextParser(r)
 }
 
+func (c comps) WithStrictness(s protocol.Strictness) protocol.Components {
+	c.strict = s == protocol.Strict
+	return c
+}
+
+func (c comps) WithQuirks(q protocol.Quirks) protocol.Components {
+	c.quirks = q
+	return c
+}
+
+func (c comps) Name() string {
+	return "text"
+}
+
 func (c comps) NewResponder(w *bufio.Writer) protocol.Responder {
-	return NewTextResponder(w)
+	r := NewTextResponder(w)
+	r.quirks = c.quirks
+	return r
+}
+
+// NewResponderTo returns a responder that writes large values directly to the connection
+func (c comps) NewResponderTo(w protocol.ResponseWriter) protocol.Responder {
+	return TextResponder{
+		writer: w,
+		quirks: c.quirks,
+	}
 }
 
 func (c comps) NewDisambiguator(p protocol.Peeker) protocol.Disambiguator {
@@ -0,0 +1,110 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package textprot
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricBadDataChunks  = metrics.AddCounter("text_bad_data_chunks", nil)
+	MetricValuesTooLarge = metrics.AddCounter("text_values_too_large", nil)
+)
+
+// MaxValueLength is the longest data block a storage command may have. Longer ones are skipped
+// without being buffered and answered like memcached does, with SERVER_ERROR object too large for
+// cache.
+var MaxValueLength uint64 = 128 * 1024 * 1024
+
+// Data blocks up to readChunk bytes are read into a buffer of their full length at once. Longer ones
+// start with a readChunk sized buffer which doubles, up to the length given, as the data arrives,
+// so a client that claims a large value and never sends it can't make rend allocate all of it. The
+// buffers aren't pooled since the data is handed off to the handlers, which may keep it.
+const readChunk = 64 * 1024
+
+// readData reads a data block of length bytes and the \r\n after it. Like memcached, exactly length
+// + 2 bytes are read no matter what they hold, so a block that doesn't end in \r\n is rejected and
+// whatever follows it is parsed as the next command.
+func readData(r *bufio.Reader, length uint64) ([]byte, error) {
+	if length > MaxValueLength {
+		metrics.IncCounter(MetricValuesTooLarge)
+		if err := swallow(r, length+2); err != nil {
+			return nil, err
+		}
+		return nil, common.ErrValueTooBig
+	}
+
+	size := length
+	if size > readChunk {
+		size = readChunk
+	}
+
+	buf := make([]byte, size)
+	var n uint64
+	for {
+		m, err := io.ReadFull(r, buf[n:])
+		n += uint64(m)
+		metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(m))
+		if err != nil {
+			return nil, err
+		}
+
+		if n == length {
+			break
+		}
+
+		grown := 2 * uint64(len(buf))
+		if grown > length {
+			grown = length
+		}
+		next := make([]byte, grown)
+		copy(next, buf)
+		buf = next
+	}
+
+	var end [2]byte
+	m, err := io.ReadFull(r, end[:])
+	metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(m))
+	if err != nil {
+		return nil, err
+	}
+	if end != [2]byte{'\r', '\n'} {
+		metrics.IncCounter(MetricBadDataChunks)
+		return nil, common.ErrBadDataChunk
+	}
+
+	return buf, nil
+}
+
+// swallow skips the next n bytes, e.g. the data block of a rejected storage command
+func swallow(r *bufio.Reader, n uint64) error {
+	for n > 0 {
+		step := n
+		if step > readChunk {
+			step = readChunk
+		}
+		m, err := r.Discard(int(step))
+		n -= uint64(m)
+		metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(m))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
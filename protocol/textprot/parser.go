@@ -16,6 +16,7 @@ package textprot
 
 import (
 	"bufio"
+	"encoding/binary"
 	"io"
 	"log"
 	"strconv"
@@ -26,8 +27,16 @@ import (
 	"github.com/netflix/rend/timer"
 )
 
+var (
+	// MetricNoreply counts the commands sent with noreply, and MetricNoreplyFailures the ones of
+	// those that failed without the client being told, e.g. an add of a key that already exists.
+	MetricNoreply         = metrics.AddCounter("text_noreply", nil)
+	MetricNoreplyFailures = metrics.AddCounter("text_noreply_failures", nil)
+)
+
 type TextParser struct {
 	reader *bufio.Reader
+	strict bool
 }
 
 func NewTextParser(reader *bufio.Reader) TextParser {
@@ -36,7 +45,20 @@ func NewTextParser(reader *bufio.Reader) TextParser {
 	}
 }
 
+// NewStrictTextParser returns a parser that rejects anything protocol.txt doesn't allow, see
+// checkStrict
+func NewStrictTextParser(reader *bufio.Reader) TextParser {
+	return TextParser{
+		reader: reader,
+		strict: true,
+	}
+}
+
 func (t TextParser) Parse() (common.Request, common.RequestType, uint64, error) {
+	if t.strict {
+		return t.parseStrict()
+	}
+
 	data, err := t.reader.ReadString('\n')
 	start := timer.Now()
 	metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(len(data)))
@@ -50,54 +72,123 @@ func (t TextParser) Parse() (common.Request, common.RequestType, uint64, error)
 		return nil, common.RequestUnknown, start, err
 	}
 
-	clParts := strings.Split(strings.TrimSpace(data), " ")
+	return t.parse(strings.Split(strings.TrimSpace(data), " "), start)
+}
+
+func (t TextParser) parse(clParts []string, start uint64) (common.Request, common.RequestType, uint64, error) {
+	clParts, quiet := noreply(clParts)
+	if quiet {
+		metrics.IncCounter(MetricNoreply)
+	}
 
 	switch clParts[0] {
 	case "set":
-		return setRequest(t.reader, clParts, common.RequestSet, start)
+		return setRequest(t.reader, clParts, common.RequestSet, start, quiet)
 
 	case "add":
-		return setRequest(t.reader, clParts, common.RequestAdd, start)
+		return setRequest(t.reader, clParts, common.RequestAdd, start, quiet)
 
 	case "replace":
-		return setRequest(t.reader, clParts, common.RequestReplace, start)
+		return setRequest(t.reader, clParts, common.RequestReplace, start, quiet)
 
 	case "append":
-		return setRequest(t.reader, clParts, common.RequestAppend, start)
+		return setRequest(t.reader, clParts, common.RequestAppend, start, quiet)
 
 	case "prepend":
-		return setRequest(t.reader, clParts, common.RequestPrepend, start)
+		return setRequest(t.reader, clParts, common.RequestPrepend, start, quiet)
+
+	// setif is an extension that only sets the value if the hash of the current value matches
+	case "setif":
+		return setIfMatchRequest(t.reader, clParts, start, quiet)
+
+	case "cas":
+		return casRequest(t.reader, clParts, start, quiet)
 
 	case "get":
-		if len(clParts) < 2 {
-			return nil, common.RequestGet, start, common.ErrBadRequest
+		return getRequest(clParts, common.RequestGet, start)
+
+	case "gets":
+		return getRequest(clParts, common.RequestGets, start)
+
+	// gete is the text form of the GetE binary extension, which returns the expiration time of each
+	// value along with it
+	case "gete":
+		return getRequest(clParts, common.RequestGetE, start)
+
+	// getl locks a key while getting it, "getl <key> [<locktime>]", and answers like a get with the
+	// token to unlock it with after the length. unl releases it, "unl <key> <token>".
+	case "getl":
+		if len(clParts) != 2 && len(clParts) != 3 {
+			return nil, common.RequestGetLock, start, common.ErrBadRequest
 		}
 
-		var keys [][]byte
-		for _, key := range clParts[1:] {
-			keys = append(keys, []byte(key))
+		var lockTime uint64
+		if len(clParts) == 3 {
+			var err error
+			if lockTime, err = strconv.ParseUint(clParts[2], 10, 32); err != nil {
+				return nil, common.RequestGetLock, start, common.ErrBadRequest
+			}
 		}
 
-		opaques := make([]uint32, len(keys))
-		quiet := make([]bool, len(keys))
+		return common.GetLockRequest{
+			Key:      []byte(clParts[1]),
+			LockTime: uint32(lockTime),
+			Opaque:   uint32(0),
+		}, common.RequestGetLock, start, nil
 
-		return common.GetRequest{
-			Keys:    keys,
-			Opaques: opaques,
-			Quiet:   quiet,
-			NoopEnd: false,
-		}, common.RequestGet, start, nil
+	case "unl":
+		if len(clParts) != 3 {
+			return nil, common.RequestUnlock, start, common.ErrBadRequest
+		}
+
+		token, err := strconv.ParseUint(clParts[2], 10, 64)
+		if err != nil {
+			return nil, common.RequestUnlock, start, common.ErrBadRequest
+		}
+
+		return common.UnlockRequest{
+			Key:    []byte(clParts[1]),
+			Token:  token,
+			Opaque: uint32(0),
+		}, common.RequestUnlock, start, nil
 
 	case "delete":
-		if len(clParts) != 2 {
+		if len(clParts) < 2 {
 			return nil, common.RequestDelete, start, common.ErrBadRequest
 		}
 
+		// Old clients may still send the long removed hold time as "delete <key> 0". Any other
+		// hold time, or extra argument, is refused the way memcached refuses it.
+		if len(clParts) > 3 || (len(clParts) == 3 && clParts[2] != "0") {
+			return nil, common.RequestDelete, start, common.ErrBadCommandLine
+		}
+
 		return common.DeleteRequest{
 			Key:    []byte(clParts[1]),
 			Opaque: uint32(0),
+			Quiet:  quiet,
 		}, common.RequestDelete, start, nil
 
+	// Extension: "mdelete <key>*" deletes every key given and answers each one on its own line,
+	// in order, e.g. DELETED then NOT_FOUND.
+	case "mdelete":
+		if len(clParts) < 2 {
+			return nil, common.RequestMultiDelete, start, common.ErrBadRequest
+		}
+
+		deletes := make([]common.DeleteRequest, len(clParts)-1)
+		for i, key := range clParts[1:] {
+			deletes[i] = common.DeleteRequest{
+				Key:    []byte(key),
+				Opaque: uint32(0),
+				Quiet:  quiet,
+			}
+		}
+
+		return common.MultiDeleteRequest{
+			Deletes: deletes,
+		}, common.RequestMultiDelete, start, nil
+
 	// TODO: Error handling for invalid cmd line
 	case "touch":
 		if len(clParts) != 3 {
@@ -116,6 +207,7 @@ func (t TextParser) Parse() (common.Request, common.RequestType, uint64, error)
 			Key:     key,
 			Exptime: uint32(exptime),
 			Opaque:  uint32(0),
+			Quiet:   quiet,
 		}, common.RequestTouch, start, nil
 	case "noop":
 		if len(clParts) != 1 {
@@ -142,12 +234,115 @@ func (t TextParser) Parse() (common.Request, common.RequestType, uint64, error)
 			Opaque: 0,
 		}, common.RequestVersion, start, nil
 
+	case "stats":
+		if len(clParts) > 2 {
+			return nil, common.RequestStats, start, common.ErrBadRequest
+		}
+		var group string
+		if len(clParts) == 2 {
+			group = clParts[1]
+		}
+		return common.StatsRequest{
+			Group:  group,
+			Opaque: 0,
+		}, common.RequestStats, start, nil
+
 	default:
 		return nil, common.RequestUnknown, start, nil
 	}
 }
 
-func setRequest(r *bufio.Reader, clParts []string, reqType common.RequestType, start uint64) (common.SetRequest, common.RequestType, uint64, error) {
+// noreply strips the noreply memcached allows at the end of storage, delete and touch commands,
+// which asks for the command not to be answered, and reports whether it was there.
+func noreply(clParts []string) ([]string, bool) {
+	n := len(clParts)
+	if n < 3 || clParts[n-1] != "noreply" {
+		return clParts, false
+	}
+
+	switch clParts[0] {
+	case "set", "add", "replace", "append", "prepend", "setif", "cas", "delete", "mdelete", "touch":
+		return clParts[:n-1], true
+	}
+	return clParts, false
+}
+
+func getRequest(clParts []string, reqType common.RequestType, start uint64) (common.Request, common.RequestType, uint64, error) {
+	if len(clParts) < 2 {
+		return nil, reqType, start, common.ErrBadRequest
+	}
+
+	var keys [][]byte
+	for _, key := range clParts[1:] {
+		keys = append(keys, []byte(key))
+	}
+
+	opaques := make([]uint32, len(keys))
+	quiet := make([]bool, len(keys))
+
+	return common.GetRequest{
+		Keys:    keys,
+		Opaques: opaques,
+		Quiet:   quiet,
+		NoopEnd: false,
+	}, reqType, start, nil
+}
+
+// setIfMatchRequest parses "setif <key> <flags> <exptime> <bytes> <hash>", where hash is the
+// common.ValueHash of the current value in hex. Like cas, it answers STORED, EXISTS or NOT_FOUND.
+func setIfMatchRequest(r *bufio.Reader, clParts []string, start uint64, quiet bool) (common.Request, common.RequestType, uint64, error) {
+	if len(clParts) != 6 {
+		return nil, common.RequestSetIfMatch, start, common.ErrBadRequest
+	}
+
+	// The value is read in first so a bad hash doesn't leave it to be parsed as a command
+	set, _, _, err := setRequest(r, clParts[:5], common.RequestSetIfMatch, start, quiet)
+	if err != nil {
+		return nil, common.RequestSetIfMatch, start, err
+	}
+
+	hash, err := strconv.ParseUint(strings.TrimSpace(clParts[5]), 16, 64)
+	if err != nil {
+		log.Printf("Error parsing hash for setif command: %s\n", err.Error())
+		return nil, common.RequestSetIfMatch, start, common.ErrBadRequest
+	}
+
+	match := make([]byte, 8)
+	binary.BigEndian.PutUint64(match, hash)
+
+	return common.SetIfMatchRequest{
+		SetRequest: set,
+		Match:      match,
+		MatchHash:  true,
+	}, common.RequestSetIfMatch, start, nil
+}
+
+// casRequest parses "cas <key> <flags> <exptime> <bytes> <cas unique>", where the CAS value is the
+// one a gets returned for the key.
+func casRequest(r *bufio.Reader, clParts []string, start uint64, quiet bool) (common.Request, common.RequestType, uint64, error) {
+	if len(clParts) != 6 {
+		return nil, common.RequestCAS, start, common.ErrBadRequest
+	}
+
+	// As with setif, the value is read first so a bad CAS value doesn't leave it behind
+	set, _, _, err := setRequest(r, clParts[:5], common.RequestCAS, start, quiet)
+	if err != nil {
+		return nil, common.RequestCAS, start, err
+	}
+
+	cas, err := strconv.ParseUint(strings.TrimSpace(clParts[5]), 10, 64)
+	if err != nil {
+		log.Printf("Error parsing cas unique for cas command: %s\n", err.Error())
+		return nil, common.RequestCAS, start, common.ErrBadRequest
+	}
+
+	return common.CASRequest{
+		SetRequest: set,
+		Cas:        cas,
+	}, common.RequestCAS, start, nil
+}
+
+func setRequest(r *bufio.Reader, clParts []string, reqType common.RequestType, start uint64, quiet bool) (common.SetRequest, common.RequestType, uint64, error) {
 	// sanity check
 	if len(clParts) != 5 {
 		return common.SetRequest{}, reqType, start, common.ErrBadRequest
@@ -173,23 +368,17 @@ func setRequest(r *bufio.Reader, clParts []string, reqType common.RequestType, s
 		return common.SetRequest{}, reqType, start, common.ErrBadLength
 	}
 
-	// Read in data
-	dataBuf := make([]byte, length)
-	n, err := io.ReadAtLeast(r, dataBuf, int(length))
-	metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(n))
+	dataBuf, err := readData(r, length)
 	if err != nil {
-		return common.SetRequest{}, reqType, start, common.ErrInternal
+		return common.SetRequest{}, reqType, start, err
 	}
 
-	// Consume the last two bytes "\r\n"
-	r.ReadString(byte('\n'))
-	metrics.IncCounterBy(common.MetricBytesReadRemote, 2)
-
 	return common.SetRequest{
 		Key:     key,
 		Flags:   uint32(flags),
 		Exptime: uint32(exptime),
 		Opaque:  uint32(0),
+		Quiet:   quiet,
 		Data:    dataBuf,
 	}, reqType, start, nil
 }
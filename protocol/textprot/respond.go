@@ -16,40 +16,52 @@ package textprot
 
 import (
 	"bufio"
-	"fmt"
+	"errors"
+	"strconv"
+	"strings"
 
 	"github.com/netflix/rend/common"
 	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/protocol"
 )
 
 type TextResponder struct {
-	writer *bufio.Writer
+	writer protocol.ResponseWriter
+	quirks protocol.Quirks
 }
 
 func NewTextResponder(writer *bufio.Writer) TextResponder {
 	return TextResponder{
-		writer: writer,
+		writer: protocol.NewResponseWriter(writer, nil, 0),
 	}
 }
 
 func (t TextResponder) Set(opaque uint32, quiet bool) error {
-	return t.resp("STORED")
+	return t.reply("STORED", quiet)
 }
 
 func (t TextResponder) Add(opaque uint32, quiet bool) error {
-	return t.resp("STORED")
+	return t.reply("STORED", quiet)
 }
 
 func (t TextResponder) Replace(opaque uint32, quiet bool) error {
-	return t.resp("STORED")
+	return t.reply("STORED", quiet)
 }
 
 func (t TextResponder) Append(opaque uint32, quiet bool) error {
-	return t.resp("STORED")
+	return t.reply("STORED", quiet)
 }
 
 func (t TextResponder) Prepend(opaque uint32, quiet bool) error {
-	return t.resp("STORED")
+	return t.reply("STORED", quiet)
+}
+
+func (t TextResponder) SetIfMatch(opaque uint32, quiet bool) error {
+	return t.reply("STORED", quiet)
+}
+
+func (t TextResponder) CompareAndSwap(opaque uint32, quiet bool) error {
+	return t.reply("STORED", quiet)
 }
 
 func (t TextResponder) Get(response common.GetResponse) error {
@@ -62,34 +74,79 @@ func (t TextResponder) Get(response common.GetResponse) error {
 	// [VALUE <key> <flags> <bytes>\r\n
 	// <data block>\r\n]*
 	// END\r\n
-	n, err := fmt.Fprintf(t.writer, "VALUE %s %d %d\r\n", response.Key, response.Flags, len(response.Data))
+	return t.value(response.Key, response.Flags, response.Data)
+}
+
+var crlf = []byte("\r\n")
+
+// value writes out a value line and the data block after it. Every kind of get writes its values
+// this way, with the numbers that differ between them, like a CAS value, given as extra.
+func (t TextResponder) value(key []byte, flags uint32, data []byte, extra ...uint64) error {
+	var buf [128]byte
+	n, err := t.writer.WriteValue(valueLine(buf[:0], key, flags, len(data), extra...), data, crlf)
 	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
-	if err != nil {
-		return err
+	return err
+}
+
+// valueLine appends VALUE <key> <flags> <bytes>[ <extra>]*\r\n to dst
+func valueLine(dst, key []byte, flags uint32, length int, extra ...uint64) []byte {
+	dst = append(dst, "VALUE "...)
+	dst = append(dst, key...)
+	dst = append(dst, ' ')
+	dst = strconv.AppendUint(dst, uint64(flags), 10)
+	dst = append(dst, ' ')
+	dst = strconv.AppendInt(dst, int64(length), 10)
+	for _, e := range extra {
+		dst = append(dst, ' ')
+		dst = strconv.AppendUint(dst, e, 10)
 	}
+	return append(dst, crlf...)
+}
 
-	n, err = t.writer.Write(response.Data)
-	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
-	if err != nil {
-		return err
+func (t TextResponder) GetEnd(opaque uint32, noopEnd bool) error {
+	return t.resp("END")
+}
+
+// GetE responds to the gete extension. Each value is written like for a get, with the expiration
+// time after the length, in the same form the binary GetE extension returns it.
+func (t TextResponder) GetE(response common.GetEResponse) error {
+	if response.Miss {
+		return nil
 	}
 
-	n, err = t.writer.WriteString("\r\n")
-	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
-	if err != nil {
-		return err
+	// [VALUE <key> <flags> <bytes> <exptime>\r\n
+	// <data block>\r\n]*
+	// END\r\n
+	return t.value(response.Key, response.Flags, response.Data, uint64(response.Exptime))
+}
+
+// Gets writes each value like a get, with its CAS value after the length. The last get of a gets is
+// ended with GetEnd as usual.
+func (t TextResponder) Gets(response common.GetResponse) error {
+	if response.Miss {
+		return nil
 	}
 
-	t.writer.Flush()
-	return nil
+	// [VALUE <key> <flags> <bytes> <cas unique>\r\n
+	// <data block>\r\n]*
+	// END\r\n
+	return t.value(response.Key, response.Flags, response.Data, response.Cas)
 }
 
-func (t TextResponder) GetEnd(opaque uint32, noopEnd bool) error {
+// GetLock responds to the getl extension like a get of the one key, with the token that unlocks it
+// after the length.
+func (t TextResponder) GetLock(response common.GetLockResponse) error {
+	// VALUE <key> <flags> <bytes> <token>\r\n
+	// <data block>\r\n
+	// END\r\n
+	if err := t.value(response.Key, response.Flags, response.Data, response.Token); err != nil {
+		return err
+	}
 	return t.resp("END")
 }
 
-func (t TextResponder) GetE(response common.GetEResponse) error {
-	panic("GetE command in text protocol")
+func (t TextResponder) Unlock(opaque uint32) error {
+	return t.resp("UNLOCKED")
 }
 
 func (t TextResponder) GAT(response common.GetResponse) error {
@@ -103,12 +160,24 @@ func (t TextResponder) GAT(response common.GetResponse) error {
 	panic("GAT command in text protocol")
 }
 
-func (t TextResponder) Delete(opaque uint32) error {
-	return t.resp("DELETED")
+func (t TextResponder) Delete(opaque uint32, quiet bool) error {
+	return t.reply("DELETED", quiet)
 }
 
-func (t TextResponder) Touch(opaque uint32) error {
-	return t.resp("TOUCHED")
+func (t TextResponder) Touch(opaque uint32, quiet bool) error {
+	return t.reply("TOUCHED", quiet)
+}
+
+func (t TextResponder) Incr(opaque uint32, quiet bool, value uint64) error {
+	return t.reply(strconv.FormatUint(value, 10), quiet)
+}
+
+func (t TextResponder) Decr(opaque uint32, quiet bool, value uint64) error {
+	return t.reply(strconv.FormatUint(value, 10), quiet)
+}
+
+func (t TextResponder) Flush(opaque uint32, quiet bool) error {
+	return t.reply("OK", quiet)
 }
 
 func (t TextResponder) Noop(opaque uint32) error {
@@ -123,36 +192,86 @@ func (t TextResponder) Quit(opaque uint32, quiet bool) error {
 }
 
 func (t TextResponder) Version(opaque uint32) error {
+	if t.quirks.Version != "" {
+		return t.resp("VERSION " + t.quirks.Version)
+	}
 	return t.resp("VERSION " + common.VersionString)
 }
 
+func (t TextResponder) Stats(opaque uint32, stats []metrics.Stat) error {
+	for _, s := range stats {
+		n, err := t.writer.WriteString("STAT " + s.Name + " " + s.Value + "\r\n")
+		metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
+		if err != nil {
+			return err
+		}
+	}
+	return t.resp("END")
+}
+
 func (t TextResponder) Error(opaque uint32, reqType common.RequestType, err error, quiet bool) error {
-	switch err {
-	case common.ErrKeyNotFound:
+	// Like memcached, noreply only holds back the answers that are the outcome of the command. Errors
+	// with the command or the server are still sent.
+	if quiet && (errors.Is(err, common.ErrKeyNotFound) || errors.Is(err, common.ErrKeyExists) ||
+		errors.Is(err, common.ErrItemNotStored)) {
+		metrics.IncCounter(MetricNoreplyFailures)
+		return nil
+	}
+
+	switch {
+	case errors.Is(err, common.ErrKeyNotFound):
 		return t.resp("NOT_FOUND")
-	case common.ErrKeyExists:
+	case errors.Is(err, common.ErrNotAdded):
 		return t.resp("NOT_STORED")
-	case common.ErrItemNotStored:
+	case errors.Is(err, common.ErrKeyExists):
+		// The key was written since it was read. setif answers the same way as a failed cas.
+		return t.resp("EXISTS")
+	case errors.Is(err, common.ErrItemNotStored):
 		return t.resp("NOT_STORED")
-	case common.ErrValueTooBig:
-		fallthrough
-	case common.ErrInvalidArgs:
+	case errors.Is(err, common.ErrValueTooBig):
+		return t.resp("SERVER_ERROR object too large for cache")
+	case errors.Is(err, common.ErrInvalidArgs):
 		return t.resp("CLIENT_ERROR bad command line")
-	case common.ErrBadIncDecValue:
+	case errors.Is(err, common.ErrBadIncDecValue):
 		return t.resp("CLIENT_ERROR invalid numeric delta argument")
-	case common.ErrAuth:
+	case errors.Is(err, common.ErrLocked):
+		return t.resp("LOCK_ERROR")
+	case errors.Is(err, common.ErrNotLocked):
+		return t.resp("UNLOCK_ERROR")
+	case errors.Is(err, common.ErrAuth):
 		return t.resp("CLIENT_ERROR")
-	case common.ErrUnknownCmd:
-		fallthrough
-	case common.ErrNoMem:
-		fallthrough
+	case errors.Is(err, common.ErrUnknownCmd):
+		return t.resp("ERROR")
 	default:
-		return t.resp(err.Error())
+		return t.resp(errorLine(err))
+	}
+}
+
+// errorLine is the line an error without an answer of its own goes out as. Only its message is
+// sent, never its cause, which can hold details of the backends. Messages that aren't already a
+// CLIENT_ERROR or SERVER_ERROR go out as a SERVER_ERROR, since a bare ERROR tells the client the
+// command wasn't understood.
+func errorLine(err error) string {
+	e, ok := common.AsError(err)
+	if !ok {
+		return "SERVER_ERROR Internal error"
+	}
+	if strings.HasPrefix(e.Message, "CLIENT_ERROR") || strings.HasPrefix(e.Message, "SERVER_ERROR") {
+		return e.Message
+	}
+	return "SERVER_ERROR " + strings.TrimPrefix(e.Message, "ERROR ")
+}
+
+// reply answers a command unless it was sent with noreply
+func (t TextResponder) reply(s string, quiet bool) error {
+	if quiet {
+		return nil
 	}
+	return t.resp(s)
 }
 
 func (t TextResponder) resp(s string) error {
-	n, err := fmt.Fprintf(t.writer, s+"\r\n")
+	n, err := t.writer.WriteString(s + "\r\n")
 	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
 	if err != nil {
 		return err
@@ -0,0 +1,206 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package textprot
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/timer"
+)
+
+const (
+	// memcached's limits: command lines other than gets, which may have any number of keys, and
+	// keys
+	maxLineLength = 2048
+	maxKeyLength  = 250
+)
+
+func (t TextParser) parseStrict() (common.Request, common.RequestType, uint64, error) {
+	line, err := readLine(t.reader)
+	start := timer.Now()
+
+	if err != nil {
+		if err != io.EOF && common.ClassOf(err) != common.ClassClient {
+			log.Printf("Error while reading text command line: %s\n", err.Error())
+		}
+		return nil, common.RequestUnknown, start, err
+	}
+
+	clParts := strings.Split(line, " ")
+	if err := checkStrict(t.reader, clParts); err != nil {
+		return nil, common.RequestUnknown, start, err
+	}
+
+	return t.parse(clParts, start)
+}
+
+// readLine reads a command line, which must end with \r\n, and returns it without the line ending.
+// Lines longer than memcached allows are read to the end, so the next command is parsed from the
+// right place, and rejected.
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	var n int
+	tooLong := false
+
+	for {
+		frag, err := r.ReadSlice('\n')
+		n += len(frag)
+
+		if !tooLong {
+			line = append(line, frag...)
+			if len(line) > maxLineLength+2 && !bytes.HasPrefix(line, []byte("get ")) && !bytes.HasPrefix(line, []byte("gets ")) {
+				tooLong = true
+				line = nil
+			}
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+
+		metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(n))
+		if err != nil {
+			return "", err
+		}
+		break
+	}
+
+	if tooLong {
+		return "", common.ErrLineTooLong
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", common.ErrBadLineEnding
+	}
+
+	return string(line[:len(line)-2]), nil
+}
+
+// checkStrict holds a command line to protocol.txt: single spaces between the tokens, valid keys,
+// the right number of arguments, and none of rend's extensions. When a storage command is rejected
+// its data block is skipped too, if its length can be read, so the data isn't parsed as commands.
+// Unknown commands are left for the parser to answer as usual.
+func checkStrict(r *bufio.Reader, clParts []string) error {
+	// an empty line is an unknown command
+	if len(clParts) == 1 && clParts[0] == "" {
+		return nil
+	}
+
+	err := checkCommand(clParts)
+	if err == nil {
+		return nil
+	}
+
+	switch clParts[0] {
+	case "set", "add", "replace", "append", "prepend", "setif", "cas":
+		if len(clParts) < 5 {
+			break
+		}
+		if length, perr := strconv.ParseUint(clParts[4], 10, 32); perr == nil {
+			if derr := swallow(r, length+2); derr != nil {
+				return derr
+			}
+		}
+	}
+
+	return err
+}
+
+func checkCommand(clParts []string) error {
+	for _, part := range clParts {
+		if part == "" {
+			return common.ErrBadCommandLine
+		}
+	}
+
+	clParts, _ = noreply(clParts)
+
+	switch clParts[0] {
+	case "set", "add", "replace", "append", "prepend":
+		if len(clParts) != 5 {
+			return common.ErrBadCommandLine
+		}
+		return checkKey(clParts[1])
+
+	case "cas":
+		if len(clParts) != 6 {
+			return common.ErrBadCommandLine
+		}
+		return checkKey(clParts[1])
+
+	case "get", "gets":
+		if len(clParts) < 2 {
+			return common.ErrBadCommandLine
+		}
+		for _, key := range clParts[1:] {
+			if err := checkKey(key); err != nil {
+				return err
+			}
+		}
+
+	// memcached still accepts the old "delete <key> 0", but the spec doesn't
+	case "delete":
+		if len(clParts) != 2 {
+			return common.ErrBadCommandLine
+		}
+		return checkKey(clParts[1])
+
+	case "touch":
+		if len(clParts) != 3 {
+			return common.ErrBadCommandLine
+		}
+		return checkKey(clParts[1])
+
+	case "quit", "version":
+		if len(clParts) != 1 {
+			return common.ErrBadCommandLine
+		}
+
+	case "stats":
+		if len(clParts) > 2 {
+			return common.ErrBadCommandLine
+		}
+		// a strict port serves none of the extensions it would list
+		if len(clParts) == 2 && clParts[1] == common.ExtensionsStatsGroup {
+			return common.ErrExtension
+		}
+
+	case "gete", "setif", "getl", "unl", "noop", "mdelete":
+		return common.ErrExtension
+	}
+
+	return nil
+}
+
+func checkKey(key string) error {
+	if len(key) > maxKeyLength {
+		return common.ErrKeyTooLong
+	}
+	if len(key) == 0 {
+		return common.ErrBadKey
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return common.ErrBadKey
+		}
+	}
+	return nil
+}
@@ -0,0 +1,408 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package textprot_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/protocol"
+	"github.com/netflix/rend/protocol/textprot"
+)
+
+func TestGetE(t *testing.T) {
+	p := textprot.NewTextParser(bufio.NewReader(strings.NewReader("gete foo bar\r\n")))
+
+	req, reqType, _, err := p.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqType != common.RequestGetE {
+		t.Fatalf("Expected a GetE request, got %v", reqType)
+	}
+	if keys := req.(common.GetRequest).Keys; len(keys) != 2 || string(keys[0]) != "foo" || string(keys[1]) != "bar" {
+		t.Fatalf("Unexpected keys %q", keys)
+	}
+
+	buf := new(bytes.Buffer)
+	r := textprot.NewTextResponder(bufio.NewWriter(buf))
+	r.GetE(common.GetEResponse{Key: []byte("foo"), Data: []byte("value"), Flags: 3, Exptime: 1500000000})
+	r.GetE(common.GetEResponse{Key: []byte("bar"), Miss: true})
+	r.GetEnd(0, false)
+
+	if expected := "VALUE foo 3 5 1500000000\r\nvalue\r\nEND\r\n"; buf.String() != expected {
+		t.Fatalf("Expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestMultiDelete(t *testing.T) {
+	p := textprot.NewTextParser(bufio.NewReader(strings.NewReader(
+		"mdelete foo bar baz\r\ndelete foo 0\r\ndelete foo 10\r\ndelete foo bar\r\n")))
+
+	req, reqType, _, err := p.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqType != common.RequestMultiDelete {
+		t.Fatalf("Expected a multi delete request, got %v", reqType)
+	}
+	deletes := req.(common.MultiDeleteRequest).Deletes
+	if len(deletes) != 3 || string(deletes[0].Key) != "foo" || string(deletes[2].Key) != "baz" {
+		t.Fatalf("Unexpected deletes %+v", deletes)
+	}
+
+	// The old hold time argument still means a single delete
+	req, reqType, _, err = p.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqType != common.RequestDelete || string(req.(common.DeleteRequest).Key) != "foo" {
+		t.Fatalf("Expected a single delete of foo, got %v %+v", reqType, req)
+	}
+
+	// Any other hold time or extra key is refused rather than read as something else
+	for i := 0; i < 2; i++ {
+		if _, _, _, err = p.Parse(); err != common.ErrBadCommandLine {
+			t.Fatalf("Expected %v, got %v", common.ErrBadCommandLine, err)
+		}
+	}
+}
+
+func TestSetIfMatch(t *testing.T) {
+	p := textprot.NewTextParser(bufio.NewReader(strings.NewReader("setif foo 1 2 3 00000000000000ff\r\nbar\r\n")))
+
+	req, reqType, _, err := p.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqType != common.RequestSetIfMatch {
+		t.Fatalf("Expected a SetIfMatch request, got %v", reqType)
+	}
+
+	r := req.(common.SetIfMatchRequest)
+	if string(r.Key) != "foo" || r.Flags != 1 || r.Exptime != 2 || string(r.Data) != "bar" {
+		t.Fatalf("Unexpected set %+v", r.SetRequest)
+	}
+	if !r.MatchHash || !bytes.Equal(r.Match, []byte{0, 0, 0, 0, 0, 0, 0, 0xff}) {
+		t.Fatalf("Unexpected match %x", r.Match)
+	}
+
+	buf := new(bytes.Buffer)
+	w := bufio.NewWriter(buf)
+	textprot.NewTextResponder(w).Error(0, common.RequestSetIfMatch, common.ErrKeyExists, false)
+	w.Flush()
+	if buf.String() != "EXISTS\r\n" {
+		t.Fatalf("Expected a mismatch to be EXISTS, got %q", buf.String())
+	}
+}
+
+func TestCAS(t *testing.T) {
+	p := textprot.NewTextParser(bufio.NewReader(strings.NewReader("gets foo bar\r\ncas foo 1 2 3 42\r\nbaz\r\ncas foo 1 2 3 x\r\nbaz\r\nversion\r\n")))
+
+	req, reqType, _, err := p.Parse()
+	if err != nil || reqType != common.RequestGets {
+		t.Fatalf("Expected a Gets request, got %v %v", reqType, err)
+	}
+	if keys := req.(common.GetRequest).Keys; len(keys) != 2 || string(keys[0]) != "foo" || string(keys[1]) != "bar" {
+		t.Fatalf("Unexpected keys %q", keys)
+	}
+
+	req, reqType, _, err = p.Parse()
+	if err != nil || reqType != common.RequestCAS {
+		t.Fatalf("Expected a CAS request, got %v %v", reqType, err)
+	}
+	if r := req.(common.CASRequest); string(r.Key) != "foo" || r.Flags != 1 || r.Exptime != 2 || string(r.Data) != "baz" || r.Cas != 42 {
+		t.Fatalf("Unexpected request %+v", r)
+	}
+
+	// the data of a cas with a bad CAS value is still read
+	if _, _, _, err = p.Parse(); err != common.ErrBadRequest {
+		t.Fatalf("Expected a bad CAS value to be a bad request, got %v", err)
+	}
+	if _, reqType, _, err = p.Parse(); err != nil || reqType != common.RequestVersion {
+		t.Fatalf("Expected the next command to be parsed, got %v %v", reqType, err)
+	}
+
+	buf := new(bytes.Buffer)
+	r := textprot.NewTextResponder(bufio.NewWriter(buf))
+	r.Gets(common.GetResponse{Key: []byte("foo"), Data: []byte("value"), Flags: 3, Cas: 42})
+	r.Gets(common.GetResponse{Key: []byte("bar"), Miss: true})
+	r.GetEnd(0, false)
+	r.CompareAndSwap(0, false)
+	r.Error(0, common.RequestCAS, common.ErrKeyExists, false)
+	r.Error(0, common.RequestCAS, common.ErrKeyNotFound, false)
+
+	if expected := "VALUE foo 3 5 42\r\nvalue\r\nEND\r\nSTORED\r\nEXISTS\r\nNOT_FOUND\r\n"; buf.String() != expected {
+		t.Fatalf("Expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{"NotAdded", common.ErrNotAdded, "NOT_STORED"},
+		{"WrappedNotAdded", common.Wrap(common.ErrNotAdded, io.EOF), "NOT_STORED"},
+		{"Exists", common.ErrKeyExists, "EXISTS"},
+		{"Server", common.ErrTempFailure, "SERVER_ERROR Temporary error"},
+		{"Cause", common.Wrap(common.ErrBusy, errors.New("dial tcp 10.0.0.1:11211: refused")), "SERVER_ERROR Busy"},
+		{"ServerError", common.ServerError("storage quota exceeded"), "SERVER_ERROR storage quota exceeded"},
+		{"Client", common.ErrNotMyVBucket, "CLIENT_ERROR vbucket is not served here"},
+		{"UnknownCmd", common.ErrUnknownCmd, "ERROR"},
+		{"Unstructured", errors.New("backend exploded"), "SERVER_ERROR Internal error"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			w := bufio.NewWriter(buf)
+			textprot.NewTextResponder(w).Error(0, common.RequestAdd, test.err, false)
+			w.Flush()
+			if buf.String() != test.expected+"\r\n" {
+				t.Fatalf("Expected %q, got %q", test.expected, buf.String())
+			}
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	p := textprot.NewTextParser(bufio.NewReader(strings.NewReader("stats\r\nstats slabs\r\nstats a b\r\n")))
+
+	for _, group := range []string{"", "slabs"} {
+		req, reqType, _, err := p.Parse()
+		if err != nil || reqType != common.RequestStats {
+			t.Fatalf("Expected a Stats request, got %v %v", reqType, err)
+		}
+		if r := req.(common.StatsRequest); r.Group != group {
+			t.Fatalf("Expected group %q, got %+v", group, r)
+		}
+	}
+	if _, _, _, err := p.Parse(); err != common.ErrBadRequest {
+		t.Fatalf("Expected two groups to be a bad request, got %v", err)
+	}
+
+	buf := new(bytes.Buffer)
+	r := textprot.NewTextResponder(bufio.NewWriter(buf))
+	r.Stats(0, []metrics.Stat{{Name: "pid", Value: "42"}, {Name: "cmd_get", Value: "7"}})
+	r.Stats(0, nil)
+
+	if expected := "STAT pid 42\r\nSTAT cmd_get 7\r\nEND\r\nEND\r\n"; buf.String() != expected {
+		t.Fatalf("Expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestNoreply(t *testing.T) {
+	input := "set foo 1 2 3 noreply\r\nbar\r\ncas foo 1 2 3 42 noreply\r\nbaz\r\ndelete foo noreply\r\n" +
+		"touch foo 10 noreply\r\ndelete noreply\r\n"
+	p := textprot.NewTextParser(bufio.NewReader(strings.NewReader(input)))
+
+	for _, expected := range []common.RequestType{common.RequestSet, common.RequestCAS, common.RequestDelete, common.RequestTouch} {
+		req, reqType, _, err := p.Parse()
+		if err != nil || reqType != expected {
+			t.Fatalf("Expected a %v request, got %v %v", expected, reqType, err)
+		}
+		if !req.IsQuiet() {
+			t.Fatalf("Expected %+v to be quiet", req)
+		}
+	}
+
+	// a key can still be called noreply
+	req, reqType, _, err := p.Parse()
+	if err != nil || reqType != common.RequestDelete || req.IsQuiet() || string(req.(common.DeleteRequest).Key) != "noreply" {
+		t.Fatalf("Expected a delete of the key noreply, got %v %+v %v", reqType, req, err)
+	}
+
+	// Only errors with the command itself are still answered
+	buf := new(bytes.Buffer)
+	r := textprot.NewTextResponder(bufio.NewWriter(buf))
+	r.Set(0, true)
+	r.Delete(0, true)
+	r.Touch(0, true)
+	r.Error(0, common.RequestAdd, common.ErrNotAdded, true)
+	r.Error(0, common.RequestDelete, common.ErrKeyNotFound, true)
+	r.Error(0, common.RequestSet, common.ErrInvalidArgs, true)
+
+	if expected := "CLIENT_ERROR bad command line\r\n"; buf.String() != expected {
+		t.Fatalf("Expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestData(t *testing.T) {
+	// longer than a single read
+	large := strings.Repeat("0123456789", 20000)
+
+	input := "set large 0 0 200000\r\n" + large + "\r\n" +
+		"set empty 0 0 0\r\n\r\n" +
+		"set bad 0 0 3\r\nbarXYversion\r\n" +
+		"set huge 0 0 200001\r\n" + large + "!\r\nversion\r\n" +
+		"set short 0 0 10\r\nabc"
+
+	defer func(max uint64) { textprot.MaxValueLength = max }(textprot.MaxValueLength)
+	textprot.MaxValueLength = 200000
+
+	p := textprot.NewTextParser(bufio.NewReader(strings.NewReader(input)))
+
+	req, _, _, err := p.Parse()
+	if err != nil || string(req.(common.SetRequest).Data) != large {
+		t.Fatalf("Expected the large value to be read whole, got %v", err)
+	}
+	if cap(req.(common.SetRequest).Data) != len(large) {
+		t.Fatalf("Expected the buffer to be the size of the value, got %d", cap(req.(common.SetRequest).Data))
+	}
+
+	req, _, _, err = p.Parse()
+	if err != nil || len(req.(common.SetRequest).Data) != 0 {
+		t.Fatalf("Expected an empty value, got %+v %v", req, err)
+	}
+
+	// exactly the length and two more bytes are read, like memcached, and whatever comes after
+	// them is the next command
+	for _, expected := range []error{common.ErrBadDataChunk, common.ErrValueTooBig} {
+		if _, _, _, err = p.Parse(); err != expected {
+			t.Fatalf("Expected %v, got %v", expected, err)
+		}
+
+		if _, reqType, _, err := p.Parse(); err != nil || reqType != common.RequestVersion {
+			t.Fatalf("Expected the next command to be parsed, got %v %v", reqType, err)
+		}
+	}
+
+	if _, _, _, err = p.Parse(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected a value cut short to fail the connection, got %v", err)
+	}
+
+	buf := new(bytes.Buffer)
+	textprot.NewTextResponder(bufio.NewWriter(buf)).Error(0, common.RequestSet, common.ErrValueTooBig, false)
+	if expected := "SERVER_ERROR object too large for cache\r\n"; buf.String() != expected {
+		t.Fatalf("Expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestLock(t *testing.T) {
+	p := textprot.NewTextParser(bufio.NewReader(strings.NewReader("getl foo 10\r\nunl foo 1234\r\ngetl foo bar\r\n")))
+
+	req, reqType, _, err := p.Parse()
+	if err != nil || reqType != common.RequestGetLock {
+		t.Fatalf("Expected a GetLock request, got %v %v", reqType, err)
+	}
+	if r := req.(common.GetLockRequest); string(r.Key) != "foo" || r.LockTime != 10 {
+		t.Fatalf("Unexpected request %+v", r)
+	}
+
+	req, reqType, _, err = p.Parse()
+	if err != nil || reqType != common.RequestUnlock {
+		t.Fatalf("Expected an Unlock request, got %v %v", reqType, err)
+	}
+	if r := req.(common.UnlockRequest); string(r.Key) != "foo" || r.Token != 1234 {
+		t.Fatalf("Unexpected request %+v", r)
+	}
+
+	if _, _, _, err = p.Parse(); err != common.ErrBadRequest {
+		t.Fatalf("Expected a bad lock time to be a bad request, got %v", err)
+	}
+
+	buf := new(bytes.Buffer)
+	r := textprot.NewTextResponder(bufio.NewWriter(buf))
+	r.GetLock(common.GetLockResponse{Key: []byte("foo"), Data: []byte("value"), Flags: 3, Token: 1234})
+	r.Error(0, common.RequestGetLock, common.ErrLocked, false)
+
+	if expected := "VALUE foo 3 5 1234\r\nvalue\r\nEND\r\nLOCK_ERROR\r\n"; buf.String() != expected {
+		t.Fatalf("Expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestStrict(t *testing.T) {
+	long := strings.Repeat("k", 251)
+
+	cases := []struct {
+		name, input string
+		err         error
+	}{
+		{"Valid", "set foo 1 2 3\r\nbar\r\n", nil},
+		{"BareNewline", "get foo\n", common.ErrBadLineEnding},
+		{"DoubleSpace", "get  foo\r\n", common.ErrBadCommandLine},
+		{"KeyTooLong", "get " + long + "\r\n", common.ErrKeyTooLong},
+		{"ControlCharacter", "delete fo\x01o\r\n", common.ErrBadKey},
+		{"LineTooLong", "touch " + strings.Repeat("x", 3000) + " 0\r\n", common.ErrLineTooLong},
+		{"LongGetLine", "get" + strings.Repeat(" key", 1000) + "\r\n", nil},
+		{"LongGetsLine", "gets" + strings.Repeat(" key", 1000) + "\r\n", nil},
+		{"CAS", "cas foo 0 0 3 7\r\nbar\r\n", nil},
+		{"Noreply", "set foo 0 0 3 noreply\r\nbar\r\n", nil},
+		{"NoreplyDelete", "delete foo noreply\r\n", nil},
+		{"CASSwallowsData", "cas foo 0 0 3\r\nbar\r\n", common.ErrBadCommandLine},
+		{"HoldTime", "delete foo 0\r\n", common.ErrBadCommandLine},
+		{"BadSetSwallowsData", "set " + long + " 0 0 3\r\nbar\r\n", common.ErrKeyTooLong},
+		{"DataChunk", "set foo 0 0 3\r\nbarXY", common.ErrBadDataChunk},
+		{"GetE", "gete foo\r\n", common.ErrExtension},
+		{"MultiDelete", "mdelete foo bar\r\n", common.ErrExtension},
+		{"SetIfSwallowsData", "setif foo 0 0 3 ff\r\nbar\r\n", common.ErrExtension},
+		{"ExtraArgs", "version now\r\n", common.ErrBadCommandLine},
+		{"StatsGroup", "stats items\r\n", nil},
+		{"StatsGroups", "stats items slabs\r\n", common.ErrBadCommandLine},
+		{"StatsExtensions", "stats extensions\r\n", common.ErrExtension},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// the command after the rejected one has to be parsed from the right place
+			r := bufio.NewReaderSize(strings.NewReader(tc.input+"version\r\n"), 1024)
+			p := textprot.NewStrictTextParser(r)
+
+			if _, _, _, err := p.Parse(); err != tc.err {
+				t.Fatalf("Expected %v, got %v", tc.err, err)
+			}
+			if _, reqType, _, err := p.Parse(); err != nil || reqType != common.RequestVersion {
+				t.Fatalf("Expected the next command to be parsed, got %v %v", reqType, err)
+			}
+		})
+	}
+
+	// the lenient parser takes what memcached takes
+	p := textprot.NewTextParser(bufio.NewReader(strings.NewReader("get foo\ndelete foo 0\r\n")))
+	for i := 0; i < 2; i++ {
+		if _, _, _, err := p.Parse(); err != nil {
+			t.Fatal("Expected the lenient parser to accept memcached's quirks, got", err)
+		}
+	}
+}
+
+func TestZeroCopy(t *testing.T) {
+	large := bytes.Repeat([]byte("x"), 100)
+
+	respond := func(min int) string {
+		buf := new(bytes.Buffer)
+		w := bufio.NewWriter(buf)
+		r := protocol.NewResponderTo(textprot.Components, protocol.NewResponseWriter(w, buf, min))
+		r.Get(common.GetResponse{Key: []byte("small"), Data: []byte("v"), Flags: 1})
+		r.Gets(common.GetResponse{Key: []byte("large"), Data: large, Flags: 2, Cas: 3})
+		r.GetEnd(0, false)
+		return buf.String()
+	}
+
+	want := "VALUE small 1 1\r\nv\r\nVALUE large 2 100 3\r\n" + string(large) + "\r\nEND\r\n"
+	for _, min := range []int{0, 10} {
+		if res := respond(min); res != want {
+			t.Fatalf("Minimum %d: unexpected response %q", min, res)
+		}
+	}
+}
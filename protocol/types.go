@@ -18,8 +18,12 @@ package protocol
 
 import (
 	"bufio"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
 )
 
 // RequestParser represents an interface to parse incoming requests. Each protocol provides its own
@@ -31,6 +35,13 @@ type RequestParser interface {
 	Parse() (common.Request, common.RequestType, uint64, error)
 }
 
+// DeadlineParser is implemented by the RequestParsers of protocols that let clients say how long
+// they will wait for a response. Deadline returns that time for the request returned by the last
+// call to Parse, counted from when the request arrived, or 0 if the client didn't give one.
+type DeadlineParser interface {
+	Deadline() time.Duration
+}
+
 // Responder is the interface for a protocol to respond to different commands. It responds in
 // whatever way is appropriate, including doing nothing or panic()-ing for unsupported interactions.
 // Unsupported interactions are OK to panic() on because they should never be returned from the
@@ -41,15 +52,24 @@ type Responder interface {
 	Replace(opaque uint32, quiet bool) error
 	Append(opaque uint32, quiet bool) error
 	Prepend(opaque uint32, quiet bool) error
+	SetIfMatch(opaque uint32, quiet bool) error
+	CompareAndSwap(opaque uint32, quiet bool) error
 	Get(response common.GetResponse) error
 	GetEnd(opaque uint32, noopEnd bool) error
 	GetE(response common.GetEResponse) error
+	Gets(response common.GetResponse) error
 	GAT(response common.GetResponse) error
-	Delete(opaque uint32) error
-	Touch(opaque uint32) error
+	GetLock(response common.GetLockResponse) error
+	Unlock(opaque uint32) error
+	Delete(opaque uint32, quiet bool) error
+	Touch(opaque uint32, quiet bool) error
+	Incr(opaque uint32, quiet bool, value uint64) error
+	Decr(opaque uint32, quiet bool, value uint64) error
+	Flush(opaque uint32, quiet bool) error
 	Noop(opaque uint32) error
 	Quit(opaque uint32, quiet bool) error
 	Version(opaque uint32) error
+	Stats(opaque uint32, stats []metrics.Stat) error
 	Error(opaque uint32, reqType common.RequestType, err error, quiet bool) error
 }
 
@@ -76,3 +96,88 @@ type Components interface {
 	NewRequestParser(r *bufio.Reader) RequestParser
 	NewResponder(w *bufio.Writer) Responder
 }
+
+// Strictness is how closely a protocol's parser holds clients to the memcached protocol spec
+type Strictness uint8
+
+const (
+	// Lenient accepts what real memcached accepts, quirks included (e.g. bare \n line endings in
+	// the text protocol), along with rend's own extensions. It's the default.
+	Lenient Strictness = iota
+	// Strict rejects any request the spec doesn't allow, including rend's extensions, with an
+	// error that says what was wrong with it
+	Strict
+)
+
+func (s Strictness) String() string {
+	if s == Strict {
+		return "strict"
+	}
+	return "lenient"
+}
+
+// ParseStrictness parses "strict" or "lenient"
+func ParseStrictness(s string) (Strictness, error) {
+	switch s {
+	case "strict":
+		return Strict, nil
+	case "lenient":
+		return Lenient, nil
+	}
+	return Lenient, fmt.Errorf("Unknown protocol strictness %q, expected strict or lenient", s)
+}
+
+// ParseNames parses a comma separated list of the names of protocols among ps, e.g. to restrict a
+// listener to them. An empty string parses to an empty list.
+func ParseNames(s string, ps []Components) ([]string, error) {
+	known := make([]string, len(ps))
+	for i, p := range ps {
+		known[i] = Name(p)
+	}
+
+	var res []string
+	for _, n := range strings.Split(s, ",") {
+		n = strings.TrimSpace(n)
+		if n == "" {
+			continue
+		}
+
+		found := false
+		for _, k := range known {
+			found = found || n == k
+		}
+		if !found {
+			return nil, fmt.Errorf("Unknown protocol %q, expected one of %s", n, strings.Join(known, ", "))
+		}
+		res = append(res, n)
+	}
+	return res, nil
+}
+
+// NamedComponents is implemented by Components that can say which protocol they speak
+type NamedComponents interface {
+	Name() string
+}
+
+// Name returns the name of the protocol c speaks, or "unknown" if it doesn't implement
+// NamedComponents
+func Name(c Components) string {
+	if nc, ok := c.(NamedComponents); ok {
+		return nc.Name()
+	}
+	return "unknown"
+}
+
+// StrictComponents is implemented by Components whose parsers can be strict
+type StrictComponents interface {
+	WithStrictness(s Strictness) Components
+}
+
+// WithStrictness returns components that parse with the given strictness. Components that don't
+// implement StrictComponents are returned unchanged.
+func WithStrictness(c Components, s Strictness) Components {
+	if sc, ok := c.(StrictComponents); ok {
+		return sc.WithStrictness(s)
+	}
+	return c
+}
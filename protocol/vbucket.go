@@ -0,0 +1,96 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// VBuckets is a set of virtual buckets, the 16 bit partition IDs that Couchbase-derived clients put
+// in every binary request header after hashing the key against their cluster map. A nil set owns
+// every vbucket.
+type VBuckets struct {
+	bits [1 << 16 / 64]uint64
+	spec string
+}
+
+// ParseVBuckets parses a comma separated list of vbucket IDs and inclusive ranges, e.g.
+// "0-511,1000". An empty string returns a nil set.
+func ParseVBuckets(s string) (*VBuckets, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+
+	v := &VBuckets{spec: s}
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		lo, hi := part, part
+		if idx := strings.IndexByte(part, '-'); idx >= 0 {
+			lo, hi = part[:idx], part[idx+1:]
+		}
+
+		first, err := strconv.ParseUint(strings.TrimSpace(lo), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid vbucket %q in %q", lo, s)
+		}
+		last, err := strconv.ParseUint(strings.TrimSpace(hi), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid vbucket %q in %q", hi, s)
+		}
+		if last < first {
+			return nil, fmt.Errorf("Invalid vbucket range %q in %q", part, s)
+		}
+
+		for vb := first; vb <= last; vb++ {
+			v.bits[vb/64] |= 1 << (vb % 64)
+		}
+	}
+
+	return v, nil
+}
+
+// Owns reports whether vb is in the set
+func (v *VBuckets) Owns(vb uint16) bool {
+	if v == nil {
+		return true
+	}
+	return v.bits[vb/64]&(1<<(vb%64)) != 0
+}
+
+func (v *VBuckets) String() string {
+	if v == nil {
+		return "all"
+	}
+	return v.spec
+}
+
+// VBucketComponents is implemented by Components whose parsers can turn away requests for vbuckets
+// the listener doesn't own
+type VBucketComponents interface {
+	WithVBuckets(v *VBuckets) Components
+}
+
+// WithVBuckets returns components that only serve requests for the vbuckets in v. Components that
+// don't implement VBucketComponents are returned unchanged.
+func WithVBuckets(c Components, v *VBuckets) Components {
+	if vc, ok := c.(VBucketComponents); ok {
+		return vc.WithVBuckets(v)
+	}
+	return c
+}
@@ -0,0 +1,309 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package websocket implements a small JSON protocol carried over WebSocket connections so that
+// browser-based tools can talk to the cache directly. Only the subset of RFC 6455 needed for a
+// server is implemented: the opening handshake, masked client frames, fragmentation, and the
+// ping / pong / close control frames. Extensions and subprotocols are not negotiated.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+)
+
+const handshakeGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// MaxMessageSize is the largest message that will be accepted from a client. Values are base64
+// encoded in the JSON messages, so this leaves room for a full 1MB memcached item.
+const MaxMessageSize = 4 << 20
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+
+	finBit  = 0x80
+	maskBit = 0x80
+)
+
+var (
+	ErrHandshake       = errors.New("Bad WebSocket handshake")
+	ErrUnmaskedFrame   = errors.New("WebSocket client frame is not masked")
+	ErrMessageTooLarge = errors.New("WebSocket message too large")
+	ErrBadFrame        = errors.New("Bad WebSocket frame")
+)
+
+// Conn is a server-side WebSocket connection.
+type Conn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+
+	// control frames can be written while replying to a ping in the middle of a read, so all
+	// writes are serialized
+	wlock  sync.Mutex
+	closed bool
+}
+
+// Upgrade performs the server side of the WebSocket opening handshake and takes over the
+// underlying connection from the HTTP server. On failure an HTTP error has already been written
+// to the client.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "WebSocket upgrade required", http.StatusBadRequest)
+		return nil, ErrHandshake
+	}
+
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, ErrHandshake
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, ErrHandshake
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return nil, ErrHandshake
+	}
+
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rw.WriteString("Upgrade: websocket\r\n")
+	rw.WriteString("Connection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n")
+
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &Conn{
+		conn: conn,
+		rw:   rw,
+	}, nil
+}
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + handshakeGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReadMessage reads the next complete data message, reassembling fragments and handling any
+// control frames that arrive in between. A close frame from the client is answered and reported
+// as io.EOF.
+func (c *Conn) ReadMessage() ([]byte, error) {
+	var msg []byte
+	started := false
+
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+
+		case opPong:
+			continue
+
+		case opClose:
+			// echo the status code back, if any, as the close reply
+			if len(payload) >= 2 {
+				payload = payload[:2]
+			}
+			c.writeFrame(opClose, payload)
+			c.wlock.Lock()
+			c.closed = true
+			c.wlock.Unlock()
+			return nil, io.EOF
+
+		case opText, opBinary:
+			if started {
+				return nil, ErrBadFrame
+			}
+			started = true
+
+		case opContinuation:
+			if !started {
+				return nil, ErrBadFrame
+			}
+
+		default:
+			return nil, ErrBadFrame
+		}
+
+		if len(msg)+len(payload) > MaxMessageSize {
+			return nil, ErrMessageTooLarge
+		}
+		msg = append(msg, payload...)
+
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+func (c *Conn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var hdr [2]byte
+	if _, err = io.ReadFull(c.rw, hdr[:]); err != nil {
+		return
+	}
+
+	fin = hdr[0]&finBit != 0
+	opcode = hdr[0] & 0x0F
+
+	if hdr[1]&maskBit == 0 {
+		err = ErrUnmaskedFrame
+		return
+	}
+
+	length := uint64(hdr[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.rw, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.rw, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	// control frames can't be fragmented and are limited to 125 bytes
+	if opcode&0x8 != 0 && (!fin || length > 125) {
+		err = ErrBadFrame
+		return
+	}
+
+	if length > MaxMessageSize {
+		err = ErrMessageTooLarge
+		return
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(c.rw, mask[:]); err != nil {
+		return
+	}
+
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.rw, payload); err != nil {
+		return
+	}
+	metrics.IncCounterBy(common.MetricBytesReadRemote, length)
+
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return
+}
+
+// WriteMessage writes a single unfragmented text message.
+func (c *Conn) WriteMessage(msg []byte) error {
+	return c.writeFrame(opText, msg)
+}
+
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	var hdr [10]byte
+	hdr[0] = finBit | opcode
+	n := 2
+
+	switch l := len(payload); {
+	case l < 126:
+		hdr[1] = byte(l)
+	case l <= 0xFFFF:
+		hdr[1] = 126
+		binary.BigEndian.PutUint16(hdr[2:], uint16(l))
+		n += 2
+	default:
+		hdr[1] = 127
+		binary.BigEndian.PutUint64(hdr[2:], uint64(l))
+		n += 8
+	}
+
+	if _, err := c.rw.Write(hdr[:n]); err != nil {
+		return err
+	}
+	if _, err := c.rw.Write(payload); err != nil {
+		return err
+	}
+	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n+len(payload)))
+
+	return c.rw.Flush()
+}
+
+// Close sends a normal closure frame, if one has not been exchanged yet, and closes the
+// underlying connection.
+func (c *Conn) Close() error {
+	c.wlock.Lock()
+	closed := c.closed
+	c.closed = true
+	c.wlock.Unlock()
+
+	if !closed {
+		c.writeFrame(opClose, []byte{0x03, 0xE8}) // 1000, normal closure
+	}
+
+	return c.conn.Close()
+}
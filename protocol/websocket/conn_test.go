@@ -0,0 +1,153 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package websocket_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/protocol/websocket"
+)
+
+func writeClientFrame(t *testing.T, w io.Writer, opcode byte, payload []byte) {
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	hdr := []byte{0x80 | opcode}
+
+	switch l := len(payload); {
+	case l < 126:
+		hdr = append(hdr, 0x80|byte(l))
+	default:
+		hdr = append(hdr, 0x80|126, 0, 0)
+		binary.BigEndian.PutUint16(hdr[2:], uint16(l))
+	}
+	hdr = append(hdr, mask[:]...)
+
+	masked := make([]byte, len(payload))
+	for i := range payload {
+		masked[i] = payload[i] ^ mask[i%4]
+	}
+
+	if _, err := w.Write(append(hdr, masked...)); err != nil {
+		t.Fatalf("Error writing frame: %v", err)
+	}
+}
+
+func readServerFrame(t *testing.T, r *bufio.Reader) (byte, []byte) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		t.Fatalf("Error reading frame: %v", err)
+	}
+	if hdr[1]&0x80 != 0 {
+		t.Fatalf("Server frames must not be masked")
+	}
+
+	length := int(hdr[1] & 0x7F)
+	if length == 126 {
+		var ext [2]byte
+		io.ReadFull(r, ext[:])
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatalf("Error reading frame payload: %v", err)
+	}
+	return hdr[0] & 0x0F, payload
+}
+
+func TestRoundTrip(t *testing.T) {
+	parsed := make(chan common.RequestType, 1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		_, reqType, _, err := websocket.NewJSONParser(conn).Parse()
+		if err != nil {
+			t.Errorf("Unexpected parse error: %v", err)
+			return
+		}
+		parsed <- reqType
+
+		websocket.NewJSONResponder(conn).Set(7, false)
+
+		// the next read sees the client's close
+		if _, _, _, err := websocket.NewJSONParser(conn).Parse(); err != io.EOF {
+			t.Errorf("Expected io.EOF after close, got %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	c, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+
+	c.Write([]byte("GET / HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"))
+
+	r := bufio.NewReader(c)
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("Error reading handshake response: %v", err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101, got %d", res.StatusCode)
+	}
+	// sample accept value from RFC 6455
+	if res.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Bad accept key %q", res.Header.Get("Sec-WebSocket-Accept"))
+	}
+
+	writeClientFrame(t, c, 0x1, []byte(`{"id": 7, "op": "set", "key": "foo", "value": "YmFy"}`))
+
+	if rt := <-parsed; rt != common.RequestSet {
+		t.Fatalf("Expected a set request, got %v", rt)
+	}
+
+	op, payload := readServerFrame(t, r)
+	if op != 0x1 {
+		t.Fatalf("Expected a text frame, got opcode %d", op)
+	}
+
+	var resp websocket.Response
+	if err := json.Unmarshal(payload, &resp); err != nil {
+		t.Fatalf("Bad JSON response %q: %v", payload, err)
+	}
+	if resp.ID != 7 || resp.Op != "set" || resp.Status != "ok" {
+		t.Fatalf("Unexpected response %+v", resp)
+	}
+
+	writeClientFrame(t, c, 0x8, []byte{0x03, 0xE8})
+	if op, _ := readServerFrame(t, r); op != 0x8 {
+		t.Fatalf("Expected a close frame, got opcode %d", op)
+	}
+}
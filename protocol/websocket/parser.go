@@ -0,0 +1,193 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package websocket
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/timer"
+)
+
+// Request is the JSON form of a request from a client. Values are base64 encoded, as is standard
+// for binary data in JSON. The ID is echoed back in every response to the request so clients can
+// match them up. Supported ops are get, gete, gat, set, add, replace, append, prepend, delete,
+// touch, noop, version, and quit.
+//
+//	{"id": 1, "op": "set", "key": "foo", "value": "YmFy", "flags": 0, "exptime": 0}
+//	{"id": 2, "op": "get", "keys": ["foo", "baz"]}
+type Request struct {
+	ID      uint32   `json:"id"`
+	Op      string   `json:"op"`
+	Key     string   `json:"key,omitempty"`
+	Keys    []string `json:"keys,omitempty"`
+	Value   []byte   `json:"value,omitempty"`
+	Flags   uint32   `json:"flags,omitempty"`
+	Exptime uint32   `json:"exptime,omitempty"`
+}
+
+// Response is the JSON form of a response to a client. Status is one of "ok", "miss", "end", or
+// "error". A get produces one response per key followed by a response with Status "end".
+type Response struct {
+	ID      uint32 `json:"id"`
+	Op      string `json:"op"`
+	Status  string `json:"status"`
+	Key     string `json:"key,omitempty"`
+	Value   []byte `json:"value,omitempty"`
+	Flags   uint32 `json:"flags,omitempty"`
+	Exptime uint32 `json:"exptime,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Version string `json:"version,omitempty"`
+	// Token unlocks a key locked by a getl. It's a decimal string since it doesn't fit in the
+	// integers of most JSON parsers.
+	Token string `json:"token,omitempty"`
+	// Cas is the CAS value of a gets hit, a decimal string for the same reason
+	Cas string `json:"cas,omitempty"`
+	// Number is the new value of an incr or decr, a decimal string like Cas
+	Number string `json:"number,omitempty"`
+	// Stats are the stats command's names and values
+	Stats map[string]string `json:"stats,omitempty"`
+}
+
+type JSONParser struct {
+	conn *Conn
+}
+
+func NewJSONParser(conn *Conn) JSONParser {
+	return JSONParser{
+		conn: conn,
+	}
+}
+
+func (j JSONParser) Parse() (common.Request, common.RequestType, uint64, error) {
+	msg, err := j.conn.ReadMessage()
+	start := timer.Now()
+
+	if err != nil {
+		if err != io.EOF {
+			log.Printf("Error while reading WebSocket message: %s\n", err.Error())
+		}
+		return nil, common.RequestUnknown, start, err
+	}
+
+	var req Request
+	if err := json.Unmarshal(msg, &req); err != nil {
+		return nil, common.RequestUnknown, start, common.ErrBadRequest
+	}
+
+	switch req.Op {
+	case "set":
+		return setRequest(req, common.RequestSet, start)
+	case "add":
+		return setRequest(req, common.RequestAdd, start)
+	case "replace":
+		return setRequest(req, common.RequestReplace, start)
+	case "append":
+		return setRequest(req, common.RequestAppend, start)
+	case "prepend":
+		return setRequest(req, common.RequestPrepend, start)
+
+	case "get", "gete":
+		keys := req.Keys
+		if req.Key != "" {
+			keys = append(keys, req.Key)
+		}
+		if len(keys) == 0 {
+			return nil, common.RequestGet, start, common.ErrBadRequest
+		}
+
+		gr := common.GetRequest{
+			Keys:       make([][]byte, len(keys)),
+			Opaques:    make([]uint32, len(keys)),
+			Quiet:      make([]bool, len(keys)),
+			NoopOpaque: req.ID,
+			NoopEnd:    false,
+		}
+		for i, k := range keys {
+			gr.Keys[i] = []byte(k)
+			gr.Opaques[i] = req.ID
+		}
+
+		if req.Op == "gete" {
+			return gr, common.RequestGetE, start, nil
+		}
+		return gr, common.RequestGet, start, nil
+
+	case "gat":
+		if req.Key == "" {
+			return nil, common.RequestGat, start, common.ErrBadRequest
+		}
+		return common.GATRequest{
+			Key:     []byte(req.Key),
+			Exptime: req.Exptime,
+			Opaque:  req.ID,
+		}, common.RequestGat, start, nil
+
+	case "delete":
+		if req.Key == "" {
+			return nil, common.RequestDelete, start, common.ErrBadRequest
+		}
+		return common.DeleteRequest{
+			Key:    []byte(req.Key),
+			Opaque: req.ID,
+		}, common.RequestDelete, start, nil
+
+	case "touch":
+		if req.Key == "" {
+			return nil, common.RequestTouch, start, common.ErrBadRequest
+		}
+		return common.TouchRequest{
+			Key:     []byte(req.Key),
+			Exptime: req.Exptime,
+			Opaque:  req.ID,
+		}, common.RequestTouch, start, nil
+
+	case "noop":
+		return common.NoopRequest{
+			Opaque: req.ID,
+		}, common.RequestNoop, start, nil
+
+	case "quit":
+		return common.QuitRequest{
+			Opaque: req.ID,
+		}, common.RequestQuit, start, nil
+
+	case "version":
+		return common.VersionRequest{
+			Opaque: req.ID,
+		}, common.RequestVersion, start, nil
+
+	default:
+		return common.NoopRequest{
+			Opaque: req.ID,
+		}, common.RequestUnknown, start, nil
+	}
+}
+
+func setRequest(req Request, reqType common.RequestType, start uint64) (common.Request, common.RequestType, uint64, error) {
+	if req.Key == "" {
+		return nil, reqType, start, common.ErrBadRequest
+	}
+
+	return common.SetRequest{
+		Key:     []byte(req.Key),
+		Data:    req.Value,
+		Flags:   req.Flags,
+		Exptime: req.Exptime,
+		Opaque:  req.ID,
+	}, reqType, start, nil
+}
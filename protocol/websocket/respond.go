@@ -0,0 +1,247 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+)
+
+type JSONResponder struct {
+	conn *Conn
+}
+
+func NewJSONResponder(conn *Conn) JSONResponder {
+	return JSONResponder{
+		conn: conn,
+	}
+}
+
+func (j JSONResponder) Set(opaque uint32, quiet bool) error {
+	return j.resp(Response{ID: opaque, Op: "set", Status: "ok"})
+}
+
+func (j JSONResponder) Add(opaque uint32, quiet bool) error {
+	return j.resp(Response{ID: opaque, Op: "add", Status: "ok"})
+}
+
+func (j JSONResponder) Replace(opaque uint32, quiet bool) error {
+	return j.resp(Response{ID: opaque, Op: "replace", Status: "ok"})
+}
+
+func (j JSONResponder) Append(opaque uint32, quiet bool) error {
+	return j.resp(Response{ID: opaque, Op: "append", Status: "ok"})
+}
+
+func (j JSONResponder) Prepend(opaque uint32, quiet bool) error {
+	return j.resp(Response{ID: opaque, Op: "prepend", Status: "ok"})
+}
+
+func (j JSONResponder) SetIfMatch(opaque uint32, quiet bool) error {
+	return j.resp(Response{ID: opaque, Op: "setif", Status: "ok"})
+}
+
+func (j JSONResponder) CompareAndSwap(opaque uint32, quiet bool) error {
+	return j.resp(Response{ID: opaque, Op: "cas", Status: "ok"})
+}
+
+func (j JSONResponder) Get(response common.GetResponse) error {
+	return j.resp(getResponse("get", response))
+}
+
+func (j JSONResponder) GetEnd(opaque uint32, noopEnd bool) error {
+	return j.resp(Response{ID: opaque, Op: "get", Status: "end"})
+}
+
+func (j JSONResponder) GetE(response common.GetEResponse) error {
+	r := Response{
+		ID:  response.Opaque,
+		Op:  "gete",
+		Key: string(response.Key),
+	}
+
+	if response.Miss {
+		r.Status = "miss"
+	} else {
+		r.Status = "ok"
+		r.Value = response.Data
+		r.Flags = response.Flags
+		r.Exptime = response.Exptime
+	}
+
+	return j.resp(r)
+}
+
+func (j JSONResponder) Gets(response common.GetResponse) error {
+	r := getResponse("gets", response)
+	if !response.Miss {
+		r.Cas = strconv.FormatUint(response.Cas, 10)
+	}
+	return j.resp(r)
+}
+
+func (j JSONResponder) GetLock(response common.GetLockResponse) error {
+	return j.resp(Response{
+		ID:     response.Opaque,
+		Op:     "getl",
+		Status: "ok",
+		Key:    string(response.Key),
+		Value:  response.Data,
+		Flags:  response.Flags,
+		Token:  strconv.FormatUint(response.Token, 10),
+	})
+}
+
+func (j JSONResponder) Unlock(opaque uint32) error {
+	return j.resp(Response{ID: opaque, Op: "unlock", Status: "ok"})
+}
+
+func (j JSONResponder) GAT(response common.GetResponse) error {
+	return j.resp(getResponse("gat", response))
+}
+
+func (j JSONResponder) Delete(opaque uint32, quiet bool) error {
+	return j.resp(Response{ID: opaque, Op: "delete", Status: "ok"})
+}
+
+func (j JSONResponder) Touch(opaque uint32, quiet bool) error {
+	return j.resp(Response{ID: opaque, Op: "touch", Status: "ok"})
+}
+
+func (j JSONResponder) Incr(opaque uint32, quiet bool, value uint64) error {
+	return j.resp(Response{ID: opaque, Op: "incr", Status: "ok", Number: strconv.FormatUint(value, 10)})
+}
+
+func (j JSONResponder) Decr(opaque uint32, quiet bool, value uint64) error {
+	return j.resp(Response{ID: opaque, Op: "decr", Status: "ok", Number: strconv.FormatUint(value, 10)})
+}
+
+func (j JSONResponder) Flush(opaque uint32, quiet bool) error {
+	return j.resp(Response{ID: opaque, Op: "flush", Status: "ok"})
+}
+
+func (j JSONResponder) Noop(opaque uint32) error {
+	return j.resp(Response{ID: opaque, Op: "noop", Status: "ok"})
+}
+
+func (j JSONResponder) Quit(opaque uint32, quiet bool) error {
+	return j.resp(Response{ID: opaque, Op: "quit", Status: "ok"})
+}
+
+func (j JSONResponder) Version(opaque uint32) error {
+	return j.resp(Response{ID: opaque, Op: "version", Status: "ok", Version: common.VersionString})
+}
+
+func (j JSONResponder) Stats(opaque uint32, stats []metrics.Stat) error {
+	m := make(map[string]string, len(stats))
+	for _, s := range stats {
+		m[s.Name] = s.Value
+	}
+	return j.resp(Response{ID: opaque, Op: "stats", Status: "ok", Stats: m})
+}
+
+func (j JSONResponder) Error(opaque uint32, reqType common.RequestType, err error, quiet bool) error {
+	// A miss on a gat is reported the same way as a miss on get
+	if errors.Is(err, common.ErrKeyNotFound) && reqType == common.RequestGat {
+		return j.resp(Response{ID: opaque, Op: "gat", Status: "miss"})
+	}
+
+	return j.resp(Response{
+		ID:     opaque,
+		Op:     reqTypeToOp(reqType),
+		Status: "error",
+		Error:  err.Error(),
+	})
+}
+
+func (j JSONResponder) resp(r Response) error {
+	msg, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return j.conn.WriteMessage(msg)
+}
+
+func getResponse(op string, response common.GetResponse) Response {
+	r := Response{
+		ID:  response.Opaque,
+		Op:  op,
+		Key: string(response.Key),
+	}
+
+	if response.Miss {
+		r.Status = "miss"
+	} else {
+		r.Status = "ok"
+		r.Value = response.Data
+		r.Flags = response.Flags
+	}
+
+	return r
+}
+
+func reqTypeToOp(rt common.RequestType) string {
+	switch rt {
+	case common.RequestGet:
+		return "get"
+	case common.RequestGetE:
+		return "gete"
+	case common.RequestGets:
+		return "gets"
+	case common.RequestGat:
+		return "gat"
+	case common.RequestSet:
+		return "set"
+	case common.RequestAdd:
+		return "add"
+	case common.RequestReplace:
+		return "replace"
+	case common.RequestAppend:
+		return "append"
+	case common.RequestPrepend:
+		return "prepend"
+	case common.RequestSetIfMatch:
+		return "setif"
+	case common.RequestCAS:
+		return "cas"
+	case common.RequestGetLock:
+		return "getl"
+	case common.RequestUnlock:
+		return "unlock"
+	case common.RequestDelete:
+		return "delete"
+	case common.RequestTouch:
+		return "touch"
+	case common.RequestNoop:
+		return "noop"
+	case common.RequestQuit:
+		return "quit"
+	case common.RequestVersion:
+		return "version"
+	case common.RequestStats:
+		return "stats"
+	case common.RequestIncr:
+		return "incr"
+	case common.RequestDecr:
+		return "decr"
+	case common.RequestFlush:
+		return "flush"
+	}
+	return "unknown"
+}
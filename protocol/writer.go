@@ -0,0 +1,92 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"bufio"
+	"io"
+	"net"
+
+	"github.com/netflix/rend/metrics"
+)
+
+var MetricZeroCopyWrites = metrics.AddCounter("response_zero_copy_writes", nil)
+
+// ResponseWriter is what responders write to. Most of what they write goes through the buffered
+// writer it embeds, but a value at least as large as the writer's minimum is handed to the
+// connection as is, in a single gathered write along with the bytes before and after it, instead of
+// being copied into the buffer first. The value is written straight out of the buffer the backend
+// read it into.
+type ResponseWriter struct {
+	*bufio.Writer
+
+	// conn is what the buffered writer writes to
+	conn io.Writer
+	min  int
+}
+
+// NewResponseWriter returns a ResponseWriter that writes values of at least min bytes directly to
+// conn, which must be what w writes to. A nil conn or a min of 0 copies every value into w.
+func NewResponseWriter(w *bufio.Writer, conn io.Writer, min int) ResponseWriter {
+	if min <= 0 {
+		conn = nil
+	}
+	return ResponseWriter{
+		Writer: w,
+		conn:   conn,
+		min:    min,
+	}
+}
+
+// WriteValue writes a response made of a header, a value, and a trailer, either of which may be
+// empty, and flushes it to the client. It returns the number of bytes written.
+func (w ResponseWriter) WriteValue(header, value, trailer []byte) (int, error) {
+	if w.conn == nil || len(value) < w.min {
+		var total int
+		for _, b := range [3][]byte{header, value, trailer} {
+			n, err := w.Write(b)
+			total += n
+			if err != nil {
+				return total, err
+			}
+		}
+		return total, w.Flush()
+	}
+
+	// Whatever was buffered before the response has to go out ahead of it
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+
+	bufs := net.Buffers{header, value, trailer}
+	n, err := bufs.WriteTo(w.conn)
+	metrics.IncCounter(MetricZeroCopyWrites)
+	return int(n), err
+}
+
+// WriterComponents is implemented by Components whose responders can write values directly to the
+// connection through a ResponseWriter
+type WriterComponents interface {
+	NewResponderTo(w ResponseWriter) Responder
+}
+
+// NewResponderTo returns a responder of c that writes to w, using only its buffered writer if c
+// doesn't implement WriterComponents.
+func NewResponderTo(c Components, w ResponseWriter) Responder {
+	if wc, ok := c.(WriterComponents); ok {
+		return wc.NewResponderTo(w)
+	}
+	return c.NewResponder(w.Writer)
+}
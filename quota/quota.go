@@ -0,0 +1,632 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package quota keeps any one application from taking up more than its share of a shared pool. A
+// tenant is a set of key prefixes with a limit on the bytes stored under them, and every write to
+// those prefixes is checked against the limit first. A tenant over its limit either has its writes
+// rejected or, in evict mode, has its own oldest keys deleted to make room, so the pool's LRU
+// doesn't push out everyone else's keys instead.
+//
+// Usage is an estimate from the writes, deletes and touches seen in traffic, counting the bytes of
+// each key and its value. It starts from zero when the process starts, writes that fail after they
+// were admitted aren't counted, and keys the backends evict on their own are counted until they
+// expire or are written again. Every key of a tenant is remembered along with its size, so tenants
+// should be limited to the prefixes that need a quota.
+package quota
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/clock"
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricRejected = metrics.AddCounter("quota_rejected_writes", nil)
+	MetricEvicted  = metrics.AddCounter("quota_evicted_keys", nil)
+)
+
+// ErrExceeded is returned for writes that would take a tenant in reject mode over its quota
+var ErrExceeded = common.ServerError("storage quota exceeded")
+
+// Mode is what happens to a write that would take a tenant over its quota
+type Mode int
+
+const (
+	// ModeReject fails the write with ErrExceeded
+	ModeReject Mode = iota
+	// ModeEvict lets the write through after picking the tenant's oldest keys to delete, as many
+	// as it takes to stay within the quota. A value larger than the whole quota is still rejected.
+	ModeEvict
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeReject:
+		return "reject"
+	case ModeEvict:
+		return "evict"
+	}
+	return "unknown"
+}
+
+// ParseMode is the inverse of Mode.String
+func ParseMode(s string) (Mode, error) {
+	switch s {
+	case "reject":
+		return ModeReject, nil
+	case "evict":
+		return ModeEvict, nil
+	}
+	return ModeReject, fmt.Errorf("Unknown quota mode %q", s)
+}
+
+// Quota is the limit of one tenant
+type Quota struct {
+	Tenant   string
+	Prefixes []string
+	Bytes    uint64
+	Mode     Mode
+}
+
+// Parse parses quotas separated by semicolons, each in the form
+//
+//	[tenant=]prefix[,prefix...]:bytes[:mode]
+//
+// e.g. "search=search:,rank::10000000000;ads::1000000000:evict". The fields after the prefixes
+// are split off from the end, so prefixes may contain colons. A quota without a tenant name is
+// named after its prefixes, and one without a mode rejects writes.
+func Parse(s string) ([]Quota, error) {
+	var quotas []Quota
+
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		var q Quota
+		rest := entry
+		if i := strings.Index(rest, "="); i >= 0 {
+			q.Tenant, rest = rest[:i], rest[i+1:]
+		}
+
+		i := strings.LastIndex(rest, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("Quota %q has no size", entry)
+		}
+		if m, err := ParseMode(rest[i+1:]); err == nil {
+			q.Mode, rest = m, rest[:i]
+			if i = strings.LastIndex(rest, ":"); i < 0 {
+				return nil, fmt.Errorf("Quota %q has no size", entry)
+			}
+		}
+
+		n, err := strconv.ParseUint(rest[i+1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Quota %q has an invalid size: %v", entry, err)
+		}
+		q.Bytes = n
+
+		for _, p := range strings.Split(rest[:i], ",") {
+			if p != "" {
+				q.Prefixes = append(q.Prefixes, p)
+			}
+		}
+		if len(q.Prefixes) == 0 {
+			return nil, fmt.Errorf("Quota %q has no prefixes", entry)
+		}
+		if q.Tenant == "" {
+			q.Tenant = strings.Join(q.Prefixes, ",")
+		}
+
+		quotas = append(quotas, q)
+	}
+
+	return quotas, nil
+}
+
+type item struct {
+	size     uint64
+	deadline uint32
+	seq      uint64
+}
+
+type written struct {
+	key string
+	seq uint64
+}
+
+type tenant struct {
+	conf Quota
+
+	lock sync.Mutex
+	// the limit and mode in effect, which differ from conf while overridden
+	limit      uint64
+	mode       Mode
+	overridden bool
+
+	used uint64
+	// bytes admitted for writes that haven't been stored or released yet, so concurrent writes
+	// can't all be admitted against the same room
+	reserved uint64
+	items    map[string]item
+	// keys in the order they were written, so the oldest can be evicted first. A key written again
+	// is in the queue more than once, and only the entry matching the map counts.
+	queue []written
+	seq   uint64
+	// when expired keys were last looked for
+	swept uint32
+
+	rejected uint64
+	evicted  uint64
+}
+
+type route struct {
+	prefix string
+	t      *tenant
+}
+
+// Tracker estimates the usage of each tenant and decides which writes they may make. One Tracker
+// is shared by every connection.
+type Tracker struct {
+	tenants []*tenant
+	// every tenant's prefixes, longest first so the most specific one matches
+	routes []route
+
+	flushLock sync.Mutex
+	// resets usage when a delayed flush happens
+	flushTimer *time.Timer
+}
+
+// New creates a tracker for the given quotas and reports each tenant's usage in the
+// quota_used_bytes, quota_limit_bytes, quota_keys, and quota_utilization metrics, tagged with the
+// tenant. A prefix in more than one quota is an error.
+func New(quotas []Quota) (*Tracker, error) {
+	t := new(Tracker)
+	seen := make(map[string]string)
+
+	for _, q := range quotas {
+		tn := &tenant{
+			conf:  q,
+			limit: q.Bytes,
+			mode:  q.Mode,
+			items: make(map[string]item),
+		}
+		t.tenants = append(t.tenants, tn)
+
+		for _, p := range q.Prefixes {
+			if other, ok := seen[p]; ok {
+				return nil, fmt.Errorf("Prefix %q is in the quotas of both %s and %s", p, other, q.Tenant)
+			}
+			seen[p] = q.Tenant
+			t.routes = append(t.routes, route{p, tn})
+		}
+	}
+
+	sort.SliceStable(t.routes, func(i, j int) bool {
+		return len(t.routes[i].prefix) > len(t.routes[j].prefix)
+	})
+
+	metrics.RegisterBulkCallback(t.metrics)
+
+	return t, nil
+}
+
+func (t *Tracker) tenant(key []byte) *tenant {
+	for _, r := range t.routes {
+		if len(key) >= len(r.prefix) && string(key[:len(r.prefix)]) == r.prefix {
+			return r.t
+		}
+	}
+	return nil
+}
+
+// Admit decides whether a write of size bytes of data to key may go ahead. Appending writes add to
+// the value already there instead of replacing it. Writes that would take the key's tenant over its
+// quota get ErrExceeded in reject mode. In evict mode they get the keys to delete to make room,
+// which are no longer counted against the tenant. An admitted write holds its bytes against the
+// quota until it's passed to Stored or Released with the same arguments.
+func (t *Tracker) Admit(key []byte, size int, appending bool) ([][]byte, error) {
+	tn := t.tenant(key)
+	if tn == nil {
+		return nil, nil
+	}
+
+	tn.lock.Lock()
+	defer tn.lock.Unlock()
+
+	old, after := tn.sizes(key, size, appending)
+	if tn.fits(old, after) {
+		tn.reserved += reservation(key, size, appending)
+		return nil, nil
+	}
+
+	tn.sweep()
+	old, after = tn.sizes(key, size, appending)
+	if tn.fits(old, after) {
+		tn.reserved += reservation(key, size, appending)
+		return nil, nil
+	}
+
+	if tn.mode == ModeReject || after > tn.limit {
+		tn.rejected++
+		metrics.IncCounter(MetricRejected)
+		return nil, ErrExceeded
+	}
+
+	var evict [][]byte
+	var self []written
+	for len(tn.queue) > 0 && !tn.fits(old, after) {
+		w := tn.queue[0]
+		tn.queue = tn.queue[1:]
+
+		it, ok := tn.items[w.key]
+		if !ok || it.seq != w.seq {
+			continue
+		}
+		if w.key == string(key) {
+			// the key being written isn't evicted to make room for itself
+			self = append(self, w)
+			continue
+		}
+		tn.remove(w.key, it)
+		evict = append(evict, []byte(w.key))
+	}
+	tn.queue = append(self, tn.queue...)
+
+	tn.evicted += uint64(len(evict))
+	metrics.IncCounterBy(MetricEvicted, uint64(len(evict)))
+	tn.reserved += reservation(key, size, appending)
+	return evict, nil
+}
+
+// Stored records a write of size bytes of data to key that went through, with the exptime it was
+// given
+func (t *Tracker) Stored(key []byte, size int, appending bool, exptime uint32) {
+	tn := t.tenant(key)
+	if tn == nil {
+		return
+	}
+
+	tn.lock.Lock()
+	defer tn.lock.Unlock()
+
+	tn.reserved -= reservation(key, size, appending)
+
+	old, ok := tn.items[string(key)]
+	it := item{deadline: clock.Deadline(exptime)}
+	_, it.size = tn.sizes(key, size, appending)
+	if appending && ok {
+		// appends keep the expiration the value had
+		it.deadline = old.deadline
+	}
+	tn.used -= old.size
+
+	tn.seq++
+	it.seq = tn.seq
+	tn.items[string(key)] = it
+	tn.used += it.size
+	tn.queue = append(tn.queue, written{string(key), it.seq})
+	tn.compact()
+}
+
+// Released gives back the bytes of an admitted write that failed
+func (t *Tracker) Released(key []byte, size int, appending bool) {
+	tn := t.tenant(key)
+	if tn == nil {
+		return
+	}
+
+	tn.lock.Lock()
+	tn.reserved -= reservation(key, size, appending)
+	tn.lock.Unlock()
+}
+
+// Tracks reports whether key is under the prefixes of a tenant
+func (t *Tracker) Tracks(key []byte) bool {
+	return t.tenant(key) != nil
+}
+
+// Deleted records that key was deleted
+func (t *Tracker) Deleted(key []byte) {
+	tn := t.tenant(key)
+	if tn == nil {
+		return
+	}
+
+	tn.lock.Lock()
+	defer tn.lock.Unlock()
+
+	if it, ok := tn.items[string(key)]; ok {
+		tn.remove(string(key), it)
+	}
+}
+
+// Touched records that key was given a new exptime
+func (t *Tracker) Touched(key []byte, exptime uint32) {
+	tn := t.tenant(key)
+	if tn == nil {
+		return
+	}
+
+	tn.lock.Lock()
+	defer tn.lock.Unlock()
+
+	if it, ok := tn.items[string(key)]; ok {
+		it.deadline = clock.Deadline(exptime)
+		tn.items[string(key)] = it
+	}
+}
+
+// sizes returns how many bytes key counts for now, and how many it would after a write of size
+// bytes of data. The lock must be held.
+func (tn *tenant) sizes(key []byte, size int, appending bool) (uint64, uint64) {
+	old, ok := tn.items[string(key)]
+	if appending && ok {
+		return old.size, old.size + uint64(size)
+	}
+	return old.size, uint64(len(key) + size)
+}
+
+// fits reports whether a key that counts for old bytes can grow to after bytes without taking the
+// tenant over its limit, counting the bytes held by other admitted writes. The lock must be held.
+func (tn *tenant) fits(old, after uint64) bool {
+	return tn.used+tn.reserved-old+after <= tn.limit
+}
+
+// reservation is how many bytes an admitted write holds until it's done. It only depends on the
+// write, so Admit and Stored agree on it however the key changes in between. Appends hold what they
+// add, and other writes the whole new value, even if it replaces one already counted.
+func reservation(key []byte, size int, appending bool) uint64 {
+	if appending {
+		return uint64(size)
+	}
+	return uint64(len(key) + size)
+}
+
+// Flushed records a flush with the given delay, which is a memcached expiration time. Like the
+// backends, usage is only reset once the delay has passed, and any flush replaces a delayed one
+// that hasn't happened yet. Writes still in flight keep their reservations.
+func (t *Tracker) Flushed(delay uint32) {
+	t.flushLock.Lock()
+	defer t.flushLock.Unlock()
+
+	if t.flushTimer != nil {
+		t.flushTimer.Stop()
+		t.flushTimer = nil
+	}
+
+	if at, now := clock.Deadline(delay), clock.Unix(); at > now {
+		t.flushTimer = time.AfterFunc(time.Duration(at-now)*time.Second, t.reset)
+		return
+	}
+
+	t.reset()
+}
+
+// reset forgets every key
+func (t *Tracker) reset() {
+	for _, tn := range t.tenants {
+		tn.lock.Lock()
+		tn.used = 0
+		tn.items = make(map[string]item)
+		tn.queue = nil
+		tn.lock.Unlock()
+	}
+}
+
+// remove stops counting key. The lock must be held.
+func (tn *tenant) remove(key string, it item) {
+	delete(tn.items, key)
+	tn.used -= it.size
+	tn.compact()
+}
+
+// sweep stops counting the keys that have expired, at most once a second since it has to look at
+// all of them. The lock must be held.
+func (tn *tenant) sweep() {
+	now := clock.Unix()
+	if now == tn.swept {
+		return
+	}
+	tn.swept = now
+
+	for k, it := range tn.items {
+		if clock.Expired(it.deadline) {
+			delete(tn.items, k)
+			tn.used -= it.size
+		}
+	}
+	tn.compact()
+}
+
+// compact drops the queue entries of keys that were written again or aren't counted anymore once
+// they make up most of the queue. The lock must be held.
+func (tn *tenant) compact() {
+	if len(tn.queue) < 1024 || len(tn.queue) < 2*len(tn.items) {
+		return
+	}
+
+	q := make([]written, 0, len(tn.items))
+	for _, w := range tn.queue {
+		if it, ok := tn.items[w.key]; ok && it.seq == w.seq {
+			q = append(q, w)
+		}
+	}
+	tn.queue = q
+}
+
+// Usage is where a tenant stands against its quota
+type Usage struct {
+	Tenant   string   `json:"tenant"`
+	Prefixes []string `json:"prefixes"`
+	Limit    uint64   `json:"limit_bytes"`
+	Mode     string   `json:"mode"`
+	// Overridden is set if the limit or mode were changed at runtime
+	Overridden  bool    `json:"overridden"`
+	Used        uint64  `json:"used_bytes"`
+	Keys        int     `json:"keys"`
+	Utilization float64 `json:"utilization"`
+	Rejected    uint64  `json:"rejected_writes"`
+	Evicted     uint64  `json:"evicted_keys"`
+}
+
+// Usage returns the usage of every tenant, in the order their quotas were given
+func (t *Tracker) Usage() []Usage {
+	res := make([]Usage, 0, len(t.tenants))
+
+	for _, tn := range t.tenants {
+		tn.lock.Lock()
+		u := Usage{
+			Tenant:     tn.conf.Tenant,
+			Prefixes:   tn.conf.Prefixes,
+			Limit:      tn.limit,
+			Mode:       tn.mode.String(),
+			Overridden: tn.overridden,
+			Used:       tn.used,
+			Keys:       len(tn.items),
+			Rejected:   tn.rejected,
+			Evicted:    tn.evicted,
+		}
+		tn.lock.Unlock()
+
+		if u.Limit > 0 {
+			u.Utilization = float64(u.Used) / float64(u.Limit)
+		}
+		res = append(res, u)
+	}
+
+	return res
+}
+
+var errUnknownTenant = errors.New("Unknown tenant")
+
+// Override changes the limit and mode of a tenant until it's reverted. The keys counted against
+// it stay, so a lower limit only takes effect as they're deleted, expire, or are evicted by the
+// next writes.
+func (t *Tracker) Override(tenant string, bytes uint64, mode Mode) error {
+	for _, tn := range t.tenants {
+		if tn.conf.Tenant == tenant {
+			tn.lock.Lock()
+			tn.limit, tn.mode, tn.overridden = bytes, mode, true
+			tn.lock.Unlock()
+			return nil
+		}
+	}
+	return errUnknownTenant
+}
+
+// Revert puts a tenant back on the quota it was configured with
+func (t *Tracker) Revert(tenant string) error {
+	for _, tn := range t.tenants {
+		if tn.conf.Tenant == tenant {
+			tn.lock.Lock()
+			tn.limit, tn.mode, tn.overridden = tn.conf.Bytes, tn.conf.Mode, false
+			tn.lock.Unlock()
+			return nil
+		}
+	}
+	return errUnknownTenant
+}
+
+func (t *Tracker) metrics() ([]metrics.IntMetric, []metrics.FloatMetric) {
+	usage := t.Usage()
+
+	ints := make([]metrics.IntMetric, 0, 3*len(usage))
+	floats := make([]metrics.FloatMetric, 0, len(usage))
+	for _, u := range usage {
+		tags := metrics.Tags{"tenant": u.Tenant}
+		ints = append(ints,
+			metrics.IntMetric{Name: "quota_used_bytes", Val: u.Used, Tgs: tags},
+			metrics.IntMetric{Name: "quota_limit_bytes", Val: u.Limit, Tgs: tags},
+			metrics.IntMetric{Name: "quota_keys", Val: uint64(u.Keys), Tgs: tags},
+		)
+		floats = append(floats, metrics.FloatMetric{Name: "quota_utilization", Val: u.Utilization, Tgs: tags})
+	}
+
+	return ints, floats
+}
+
+// ServeHTTP reports the usage of every tenant as JSON. A POST with a tenant parameter changes its
+// quota to the bytes and mode parameters, keeping whichever of them isn't given, or puts it back
+// on its configured quota with revert=true.
+func (t *Tracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if err := t.override(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t.Usage())
+}
+
+func (t *Tracker) override(r *http.Request) error {
+	tenant := r.FormValue("tenant")
+
+	if revert, _ := strconv.ParseBool(r.FormValue("revert")); revert {
+		if err := t.Revert(tenant); err != nil {
+			return err
+		}
+		log.Printf("Quota of %s reverted by %s\n", tenant, r.RemoteAddr)
+		return nil
+	}
+
+	var cur *Usage
+	for _, u := range t.Usage() {
+		if u.Tenant == tenant {
+			cur = &u
+			break
+		}
+	}
+	if cur == nil {
+		return errUnknownTenant
+	}
+
+	bytes := cur.Limit
+	if v := r.FormValue("bytes"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return err
+		}
+		bytes = n
+	}
+
+	mode, _ := ParseMode(cur.Mode)
+	if v := r.FormValue("mode"); v != "" {
+		m, err := ParseMode(v)
+		if err != nil {
+			return err
+		}
+		mode = m
+	}
+
+	if err := t.Override(tenant, bytes, mode); err != nil {
+		return err
+	}
+	log.Printf("Quota of %s overridden to %d bytes in %v mode by %s\n", tenant, bytes, mode, r.RemoteAddr)
+	return nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quota_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/netflix/rend/quota"
+)
+
+func TestParse(t *testing.T) {
+	quotas, err := quota.Parse("search=search:,rank::1000; ads::500:evict ;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []quota.Quota{
+		{Tenant: "search", Prefixes: []string{"search:", "rank:"}, Bytes: 1000, Mode: quota.ModeReject},
+		{Tenant: "ads:", Prefixes: []string{"ads:"}, Bytes: 500, Mode: quota.ModeEvict},
+	}
+	if !reflect.DeepEqual(quotas, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, quotas)
+	}
+
+	for _, bad := range []string{"search:", "search:lots", "=:100", "a::10:sometimes"} {
+		if _, err := quota.Parse(bad); err == nil {
+			t.Errorf("Expected %q to be invalid", bad)
+		}
+	}
+
+	if _, err := quota.New([]quota.Quota{
+		{Tenant: "a", Prefixes: []string{"x:"}},
+		{Tenant: "b", Prefixes: []string{"x:"}},
+	}); err == nil {
+		t.Error("Expected a prefix in two quotas to be rejected")
+	}
+}
+
+func TestTracker(t *testing.T) {
+	tracker, err := quota.New([]quota.Quota{
+		{Tenant: "outer", Prefixes: []string{"t:"}, Bytes: 1000},
+		{Tenant: "inner", Prefixes: []string{"t:inner:"}, Bytes: 20},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	usage := func(tenant string) quota.Usage {
+		for _, u := range tracker.Usage() {
+			if u.Tenant == tenant {
+				return u
+			}
+		}
+		t.Fatalf("No usage for %s", tenant)
+		return quota.Usage{}
+	}
+
+	// the longest prefix decides the tenant
+	key := []byte("t:inner:a")
+	if _, err := tracker.Admit(key, 10, false); err != nil {
+		t.Fatal(err)
+	}
+	tracker.Stored(key, 10, false, 0)
+	if u := usage("inner"); u.Used != 19 || u.Keys != 1 {
+		t.Fatalf("Unexpected usage after a set: %+v", u)
+	}
+	if u := usage("outer"); u.Used != 0 {
+		t.Fatalf("Expected the key to only count for the inner tenant, got %+v", u)
+	}
+
+	// appends add to the value that's there
+	if _, err := tracker.Admit(key, 2, true); err != quota.ErrExceeded {
+		t.Fatalf("Expected an append over the quota to be rejected, got %v", err)
+	}
+	if _, err := tracker.Admit(key, 1, true); err != nil {
+		t.Fatal(err)
+	}
+	tracker.Stored(key, 1, true, 0)
+	if u := usage("inner"); u.Used != 20 || u.Rejected != 1 {
+		t.Fatalf("Unexpected usage after an append: %+v", u)
+	}
+
+	srv := httptest.NewServer(tracker)
+	defer srv.Close()
+
+	res, err := http.PostForm(srv.URL, url.Values{"tenant": {"inner"}, "bytes": {"100"}, "mode": {"evict"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []quota.Usage
+	json.NewDecoder(res.Body).Decode(&got)
+	res.Body.Close()
+	if len(got) != 2 || got[1].Limit != 100 || got[1].Mode != "evict" || !got[1].Overridden {
+		t.Fatalf("Expected the override to be reported, got %+v", got)
+	}
+
+	if _, err := tracker.Admit(key, 50, true); err != nil {
+		t.Fatalf("Expected the overridden quota to allow the append, got %v", err)
+	}
+	tracker.Released(key, 50, true)
+
+	res, err = http.PostForm(srv.URL, url.Values{"tenant": {"inner"}, "revert": {"true"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if u := usage("inner"); u.Limit != 20 || u.Mode != "reject" || u.Overridden {
+		t.Fatalf("Expected the configured quota back, got %+v", u)
+	}
+
+	res, err = http.PostForm(srv.URL, url.Values{"tenant": {"nobody"}, "bytes": {"1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected an unknown tenant to be a bad request, got %d", res.StatusCode)
+	}
+
+	tracker.Deleted(key)
+	if u := usage("inner"); u.Used != 0 || u.Keys != 0 {
+		t.Fatalf("Unexpected usage after a delete: %+v", u)
+	}
+
+	// writes in flight hold their bytes, so concurrent ones can't both take the same room
+	other := []byte("t:inner:b")
+	if _, err := tracker.Admit(key, 5, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tracker.Admit(other, 5, false); err != quota.ErrExceeded {
+		t.Fatalf("Expected a write to be rejected while another holds the room, got %v", err)
+	}
+	tracker.Released(key, 5, false)
+	if _, err := tracker.Admit(other, 5, false); err != nil {
+		t.Fatalf("Expected a released write to give its room back, got %v", err)
+	}
+	tracker.Stored(other, 5, false, 0)
+	if u := usage("inner"); u.Used != 14 || u.Keys != 1 {
+		t.Fatalf("Unexpected usage after a reserved write: %+v", u)
+	}
+
+	// a delayed flush leaves usage alone until it happens
+	tracker.Flushed(60)
+	if u := usage("inner"); u.Used != 14 {
+		t.Fatalf("Expected a delayed flush to wait, got %+v", u)
+	}
+	tracker.Flushed(0)
+	if u := usage("inner"); u.Used != 0 || u.Keys != 0 {
+		t.Fatalf("Unexpected usage after a flush: %+v", u)
+	}
+}
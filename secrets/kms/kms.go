@@ -0,0 +1,305 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package kms is a secrets provider that decrypts secrets with the AWS Key Management Service. The
+// secrets themselves are stored encrypted, as the base64 ciphertext blobs the KMS Encrypt API (or
+// aws kms encrypt) returns, in another secrets provider. This keeps plaintext credentials out of
+// files and environment variables, and access to them is controlled by the KMS key policy.
+//
+// The provider is selected with a configuration string of URL query parameters, where source is
+// the configuration of the provider holding the ciphertexts (URL escaped if it has its own
+// parameters):
+//
+//	kms:region=us-east-1&source=file:/etc/rend/encrypted
+//
+// Requests are signed with the credentials in the standard AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY, and AWS_SESSION_TOKEN environment variables, which are read again for
+// every request so rotated credentials are used. Other ways of getting credentials, like the
+// instance metadata service, are not supported.
+package kms
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/netflix/rend/secrets"
+)
+
+func init() {
+	secrets.Register("kms", func(conf string) (secrets.Provider, error) {
+		c, err := ParseConfig(conf)
+		if err != nil {
+			return nil, err
+		}
+		return New(c)
+	})
+}
+
+// Config configures a KMS provider
+type Config struct {
+	Region string
+	// KMS endpoint. Empty uses the regional endpoint, https://kms.<region>.amazonaws.com.
+	Endpoint string
+	// Configuration of the provider the ciphertexts are read from
+	Source string
+	// Optional key ID or ARN the ciphertexts must have been encrypted with
+	KeyID   string
+	Timeout time.Duration
+}
+
+const defaultTimeout = 5 * time.Second
+
+// ParseConfig parses a configuration string of URL query parameters. region and source are
+// required. The rest are optional: endpoint, key_id, and timeout.
+func ParseConfig(conf string) (Config, error) {
+	c := Config{Timeout: defaultTimeout}
+
+	q, err := url.ParseQuery(conf)
+	if err != nil {
+		return c, err
+	}
+
+	for name := range q {
+		val := q.Get(name)
+
+		switch name {
+		case "region":
+			c.Region = val
+		case "endpoint":
+			c.Endpoint = strings.TrimRight(val, "/")
+		case "source":
+			c.Source = val
+		case "key_id":
+			c.KeyID = val
+		case "timeout":
+			d, err := time.ParseDuration(val)
+			if err != nil || d <= 0 {
+				return c, fmt.Errorf("Invalid KMS timeout %q", val)
+			}
+			c.Timeout = d
+		default:
+			return c, fmt.Errorf("Unknown KMS secrets provider option %q", name)
+		}
+	}
+
+	if c.Region == "" || c.Source == "" {
+		return c, errors.New("The KMS secrets provider needs a region and a source, e.g. kms:region=us-east-1&source=file:/etc/rend/encrypted")
+	}
+	if c.Endpoint == "" {
+		c.Endpoint = "https://kms." + c.Region + ".amazonaws.com"
+	}
+
+	return c, nil
+}
+
+// Provider decrypts secrets read from its source provider
+type Provider struct {
+	c      Config
+	source secrets.Provider
+	client *http.Client
+}
+
+func New(c Config) (*Provider, error) {
+	source, err := secrets.FromConfig(c.Source)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Provider{
+		c:      c,
+		source: source,
+		client: &http.Client{Timeout: c.Timeout},
+	}, nil
+}
+
+type decryptRequest struct {
+	CiphertextBlob string `json:"CiphertextBlob"`
+	KeyID          string `json:"KeyId,omitempty"`
+}
+
+type decryptResponse struct {
+	Plaintext string `json:"Plaintext"`
+}
+
+type errorResponse struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+func (p *Provider) Secret(name string) ([]byte, error) {
+	ciphertext, err := p.source.Secret(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// The ciphertext is already base64, which is what the JSON API wants
+	body, err := json.Marshal(decryptRequest{
+		CiphertextBlob: strings.TrimSpace(string(ciphertext)),
+		KeyID:          p.c.KeyID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	creds, err := envCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", p.c.Endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService.Decrypt")
+	sign(req, body, creds, p.c.Region, "kms", time.Now())
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		var e errorResponse
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		if json.Unmarshal(msg, &e) == nil && e.Type != "" {
+			return nil, fmt.Errorf("KMS could not decrypt %s: %s %s", name, e.Type, e.Message)
+		}
+		return nil, fmt.Errorf("KMS returned %s for %s", res.Status, name)
+	}
+
+	var dec decryptResponse
+	if err := json.NewDecoder(res.Body).Decode(&dec); err != nil {
+		return nil, err
+	}
+
+	return base64.StdEncoding.DecodeString(dec.Plaintext)
+}
+
+type credentials struct {
+	accessKey, secretKey, token string
+}
+
+func envCredentials() (credentials, error) {
+	c := credentials{
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return c, errors.New("No AWS credentials: set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return c, nil
+}
+
+// sign adds AWS Signature Version 4 authentication to the request. Every header already set is
+// signed, along with the host and date.
+func sign(req *http.Request, body []byte, c credentials, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if c.token != "" {
+		req.Header.Set("X-Amz-Security-Token", c.token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	bodyHash := sha256.Sum256(body)
+	canonical := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL.Query()),
+		canonHeaders.String(),
+		signed,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	canonHash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.accessKey+"/"+scope+
+		", SignedHeaders="+signed+", Signature="+sig)
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		vs := append([]string(nil), q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, escape(k)+"="+escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// escape percent encodes like SigV4 needs, which differs from url.QueryEscape for spaces
+func escape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,116 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kms
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The example from the AWS Signature Version 4 documentation
+func TestSign(t *testing.T) {
+	req, _ := http.NewRequest("GET", "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+
+	now, _ := time.Parse("20060102T150405Z", "20150830T123600Z")
+	sign(req, nil, credentials{accessKey: "AKIDEXAMPLE", secretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}, "us-east-1", "iam", now)
+
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, " +
+		"SignedHeaders=content-type;host;x-amz-date, " +
+		"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+	if got := req.Header.Get("Authorization"); got != expected {
+		t.Fatalf("Unexpected signature:\n%s\n%s", got, expected)
+	}
+}
+
+func TestDecrypt(t *testing.T) {
+	ciphertext := base64.StdEncoding.EncodeToString([]byte("encrypted"))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if r.Header.Get("X-Amz-Target") != "TrentService.Decrypt" ||
+			!strings.Contains(auth, "Credential=AKID/") || !strings.Contains(auth, "/us-west-2/kms/aws4_request") ||
+			!strings.Contains(auth, "x-amz-security-token") {
+			t.Errorf("Unexpected request headers: %v", r.Header)
+		}
+
+		var req decryptRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.CiphertextBlob != ciphertext {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"InvalidCiphertextException","message":""}`))
+			return
+		}
+		json.NewEncoder(w).Encode(decryptResponse{Plaintext: base64.StdEncoding.EncodeToString([]byte("hunter2"))})
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "password"), []byte(ciphertext+"\n"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "garbage"), []byte("Z2FyYmFnZQ=="), 0600)
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	os.Setenv("AWS_SESSION_TOKEN", "token")
+	defer func() {
+		os.Unsetenv("AWS_ACCESS_KEY_ID")
+		os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+		os.Unsetenv("AWS_SESSION_TOKEN")
+	}()
+
+	c, err := ParseConfig("region=us-west-2&endpoint=" + srv.URL + "&source=file:" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if val, err := p.Secret("password"); err != nil || string(val) != "hunter2" {
+		t.Fatalf("Expected the decrypted secret, got %q %v", val, err)
+	}
+	if _, err := p.Secret("garbage"); err == nil || !strings.Contains(err.Error(), "InvalidCiphertextException") {
+		t.Fatal("Expected the KMS error to be passed on, got", err)
+	}
+
+	os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	if _, err := p.Secret("password"); err == nil {
+		t.Fatal("Expected missing credentials to fail")
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	c, err := ParseConfig("region=eu-west-1&source=env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Endpoint != "https://kms.eu-west-1.amazonaws.com" {
+		t.Fatal("Unexpected default endpoint", c.Endpoint)
+	}
+	for _, conf := range []string{"", "region=x", "source=env", "region=x&source=env&bogus=1"} {
+		if _, err := ParseConfig(conf); err == nil {
+			t.Errorf("Expected %q to be invalid", conf)
+		}
+	}
+}
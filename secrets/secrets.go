@@ -0,0 +1,154 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package secrets fetches credentials, like TLS private keys and passwords, from a secrets
+// provider instead of flat configuration files. Providers are selected by name with a
+// configuration string, like handlers and CDC sinks. The built-in ones read environment variables
+// and files (e.g. a tmpfs mounted by an agent), and the vault and kms subpackages register
+// providers for HashiCorp Vault and the AWS KMS.
+//
+// Configuration values refer to a secret with a "secret:" prefix followed by the secret's name in
+// the provider, e.g. secret:rend/peer-key. A Value keeps a secret up to date by fetching it again
+// periodically, so rotated credentials are picked up without a restart.
+package secrets
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/netflix/rend/handlers"
+)
+
+// Provider looks up secrets by name. The meaning of the name is up to the provider, e.g. an
+// environment variable or a path in Vault.
+type Provider interface {
+	Secret(name string) ([]byte, error)
+}
+
+// ProviderFunc adapts a function to a Provider
+type ProviderFunc func(name string) ([]byte, error)
+
+func (f ProviderFunc) Secret(name string) ([]byte, error) {
+	return f(name)
+}
+
+// ProviderFactory creates a Provider from a configuration string, in the same way as handler
+// factories
+type ProviderFactory func(conf string) (Provider, error)
+
+// ErrNotFound is returned by providers for secrets that don't exist
+var ErrNotFound = errors.New("Secret not found")
+
+var (
+	providers     = make(map[string]ProviderFactory)
+	providersLock = new(sync.RWMutex)
+)
+
+func init() {
+	Register("env", func(conf string) (Provider, error) {
+		return Env(conf), nil
+	})
+	Register("file", func(conf string) (Provider, error) {
+		if conf == "" {
+			return nil, errors.New("The file secrets provider needs a directory, e.g. file:/run/secrets")
+		}
+		return Dir(conf), nil
+	})
+}
+
+// Register makes a provider implementation available by name. Registering the same name twice
+// panics.
+func Register(name string, f ProviderFactory) {
+	providersLock.Lock()
+	defer providersLock.Unlock()
+
+	if f == nil {
+		panic("secrets: Register factory is nil for " + name)
+	}
+	if _, dup := providers[name]; dup {
+		panic("secrets: Register called twice for " + name)
+	}
+
+	providers[name] = f
+}
+
+// Registered returns the sorted names of all registered provider implementations.
+func Registered() []string {
+	providersLock.RLock()
+	defer providersLock.RUnlock()
+
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// FromConfig resolves a configuration string of the form "name" or "name:conf" to a Provider
+// using the registered factory for that name.
+func FromConfig(spec string) (Provider, error) {
+	name, conf := handlers.SplitSpec(spec)
+
+	providersLock.RLock()
+	f, ok := providers[name]
+	providersLock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("Unknown secrets provider %q. Registered providers: %s", name, strings.Join(Registered(), ", "))
+	}
+
+	return f(conf)
+}
+
+// Env is a provider that reads secrets from environment variables named by the prefix followed
+// by the secret name. Unset and empty variables are not found.
+type Env string
+
+func (e Env) Secret(name string) ([]byte, error) {
+	v := os.Getenv(string(e) + name)
+	if v == "" {
+		return nil, ErrNotFound
+	}
+	return []byte(v), nil
+}
+
+// Dir is a provider that reads each secret from the file with that name under the directory.
+// Trailing newlines are removed, since most tools that write secret files add one.
+type Dir string
+
+func (d Dir) Secret(name string) ([]byte, error) {
+	// names can't escape the directory
+	clean := filepath.Clean("/" + name)
+	if clean == "/" {
+		return nil, ErrNotFound
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(string(d), clean))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(strings.TrimRight(string(buf), "\r\n")), nil
+}
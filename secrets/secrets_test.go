@@ -0,0 +1,134 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package secrets_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/secrets"
+)
+
+func TestEnv(t *testing.T) {
+	os.Setenv("RENDTEST_PASSWORD", "hunter2")
+	defer os.Unsetenv("RENDTEST_PASSWORD")
+
+	p, err := secrets.FromConfig("env:RENDTEST_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, err := p.Secret("PASSWORD"); err != nil || string(val) != "hunter2" {
+		t.Fatalf("Expected the environment variable, got %q %v", val, err)
+	}
+	if _, err := p.Secret("MISSING"); err != secrets.ErrNotFound {
+		t.Fatal("Expected a missing variable not to be found, got", err)
+	}
+}
+
+func TestDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "rend"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "rend", "password"), []byte("hunter2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(filepath.Dir(dir), "outside"), []byte("no"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filepath.Join(filepath.Dir(dir), "outside"))
+
+	p, err := secrets.FromConfig("file:" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, err := p.Secret("rend/password"); err != nil || string(val) != "hunter2" {
+		t.Fatalf("Expected the file contents without the newline, got %q %v", val, err)
+	}
+	if _, err := p.Secret("../outside"); err != secrets.ErrNotFound {
+		t.Fatal("Expected names not to escape the directory, got", err)
+	}
+
+	if _, err := secrets.FromConfig("file"); err == nil {
+		t.Fatal("Expected the file provider to need a directory")
+	}
+	if _, err := secrets.FromConfig("nope"); err == nil {
+		t.Fatal("Expected an unknown provider to fail")
+	}
+}
+
+func TestResolve(t *testing.T) {
+	v, err := secrets.Resolve(nil, "plain", 0)
+	if err != nil || string(v.Get()) != "plain" {
+		t.Fatalf("Expected a plain value to be used as is, got %v", err)
+	}
+	if _, err := secrets.Resolve(nil, "secret:foo", 0); err == nil {
+		t.Fatal("Expected a secret reference without a provider to fail")
+	}
+
+	p := secrets.ProviderFunc(func(name string) ([]byte, error) {
+		return []byte("value of " + name), nil
+	})
+	v, err = secrets.Resolve(p, "secret:foo", 0)
+	if err != nil || string(v.Get()) != "value of foo" {
+		t.Fatalf("Expected the referred secret, got %q %v", v.Get(), err)
+	}
+}
+
+func TestValueRefresh(t *testing.T) {
+	var (
+		lock sync.Mutex
+		val  = "one"
+		err  error
+	)
+	p := secrets.ProviderFunc(func(string) ([]byte, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		return []byte(val), err
+	})
+
+	v, e := secrets.NewValue(p, "foo", time.Millisecond)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	// failing refreshes keep the current value
+	lock.Lock()
+	val, err = "", errors.New("provider down")
+	lock.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	if string(v.Get()) != "one" {
+		t.Fatalf("Expected a failed refresh to keep the value, got %q", v.Get())
+	}
+
+	lock.Lock()
+	val, err = "two", nil
+	lock.Unlock()
+	for i := 0; i < 200 && string(v.Get()) != "two"; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if string(v.Get()) != "two" {
+		t.Fatalf("Expected the rotated value, got %q", v.Get())
+	}
+
+	if _, err := secrets.NewValue(secrets.Env("RENDTEST_"), "MISSING", 0); err != secrets.ErrNotFound {
+		t.Fatal("Expected the first fetch to have to succeed, got", err)
+	}
+}
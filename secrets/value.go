@@ -0,0 +1,131 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package secrets
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricFetches     = metrics.AddCounter("secrets_fetches", nil)
+	MetricFetchErrors = metrics.AddCounter("secrets_fetch_errors", nil)
+	MetricRotations   = metrics.AddCounter("secrets_rotations", nil)
+)
+
+// RefPrefix marks a configuration value that refers to a secret instead of holding it
+const RefPrefix = "secret:"
+
+var errNoProvider = errors.New("A secret is referred to but no secrets provider is configured")
+
+// Ref returns the name of the secret a configuration value refers to, and whether it refers to one
+func Ref(val string) (string, bool) {
+	if !strings.HasPrefix(val, RefPrefix) {
+		return "", false
+	}
+	return val[len(RefPrefix):], true
+}
+
+// Value is a secret that's kept up to date from its provider
+type Value struct {
+	p    Provider
+	name string
+
+	lock sync.RWMutex
+	val  []byte
+}
+
+// Static returns a Value that never changes, for configuration given directly
+func Static(val []byte) *Value {
+	return &Value{val: val}
+}
+
+// NewValue fetches the named secret and, if refresh is positive, fetches it again at that interval
+// for as long as the process runs. A failed refresh keeps the current value, so a provider outage
+// doesn't take credentials away; only the first fetch has to succeed.
+func NewValue(p Provider, name string, refresh time.Duration) (*Value, error) {
+	v := &Value{p: p, name: name}
+
+	val, err := v.fetch()
+	if err != nil {
+		return nil, err
+	}
+	v.val = val
+
+	if refresh > 0 {
+		go v.refresh(refresh)
+	}
+
+	return v, nil
+}
+
+// Resolve returns the Value of a configuration value: the secret it refers to if it has the
+// RefPrefix, refreshed from p at the given interval, or the configuration value itself otherwise.
+func Resolve(p Provider, val string, refresh time.Duration) (*Value, error) {
+	name, ok := Ref(val)
+	if !ok {
+		return Static([]byte(val)), nil
+	}
+	if p == nil {
+		return nil, errNoProvider
+	}
+	return NewValue(p, name, refresh)
+}
+
+// Get returns the current value of the secret. The returned slice must not be modified.
+func (v *Value) Get() []byte {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	return v.val
+}
+
+func (v *Value) fetch() ([]byte, error) {
+	metrics.IncCounter(MetricFetches)
+	val, err := v.p.Secret(v.name)
+	if err != nil {
+		metrics.IncCounter(MetricFetchErrors)
+	}
+	return val, err
+}
+
+func (v *Value) refresh(interval time.Duration) {
+	failing := false
+
+	for range time.Tick(interval) {
+		val, err := v.fetch()
+		if err != nil {
+			if !failing {
+				log.Printf("Error refreshing secret %s, keeping the current value: %s", v.name, err.Error())
+				failing = true
+			}
+			continue
+		}
+		failing = false
+
+		v.lock.Lock()
+		if !bytes.Equal(val, v.val) {
+			v.val = val
+			metrics.IncCounter(MetricRotations)
+			log.Printf("Secret %s was rotated", v.name)
+		}
+		v.lock.Unlock()
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package vault is a secrets provider that reads from a HashiCorp Vault KV version 2 secrets engine
+// through Vault's HTTP API. Secret names are paths in the engine's mount, optionally followed by
+// "#field" to pick a field of the secret; the field defaults to "value".
+//
+// The provider is selected with a configuration string of URL query parameters:
+//
+//	vault:addr=https://vault.example.com:8200&mount=secret&token_file=/run/vault/token
+//
+// The token is read from token_file on every fetch, so an agent renewing it can simply replace the
+// file. Without token_file, the VAULT_TOKEN environment variable is used.
+package vault
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/netflix/rend/secrets"
+)
+
+func init() {
+	secrets.Register("vault", func(conf string) (secrets.Provider, error) {
+		c, err := ParseConfig(conf)
+		if err != nil {
+			return nil, err
+		}
+		return New(c)
+	})
+}
+
+// Config configures a Vault provider
+type Config struct {
+	// Base address of the Vault server, e.g. https://vault.example.com:8200
+	Addr string
+	// Mount path of the KV version 2 secrets engine
+	Mount string
+	// File holding the Vault token. Empty uses the VAULT_TOKEN environment variable.
+	TokenFile string
+	// Enterprise namespace, sent as X-Vault-Namespace. Empty sends none.
+	Namespace string
+	// PEM CA certificates to verify the server with instead of the system roots
+	CAFile  string
+	Timeout time.Duration
+}
+
+const (
+	defaultMount   = "secret"
+	defaultField   = "value"
+	defaultTimeout = 5 * time.Second
+)
+
+// ParseConfig parses a configuration string of URL query parameters. addr is required. The rest
+// are optional: mount (secret by default), token_file, namespace, ca_file, and timeout.
+func ParseConfig(conf string) (Config, error) {
+	c := Config{
+		Mount:   defaultMount,
+		Timeout: defaultTimeout,
+	}
+
+	q, err := url.ParseQuery(conf)
+	if err != nil {
+		return c, err
+	}
+
+	for name := range q {
+		val := q.Get(name)
+
+		switch name {
+		case "addr":
+			c.Addr = strings.TrimRight(val, "/")
+		case "mount":
+			c.Mount = strings.Trim(val, "/")
+		case "token_file":
+			c.TokenFile = val
+		case "namespace":
+			c.Namespace = val
+		case "ca_file":
+			c.CAFile = val
+		case "timeout":
+			d, err := time.ParseDuration(val)
+			if err != nil || d <= 0 {
+				return c, fmt.Errorf("Invalid Vault timeout %q", val)
+			}
+			c.Timeout = d
+		default:
+			return c, fmt.Errorf("Unknown Vault secrets provider option %q", name)
+		}
+	}
+
+	if c.Addr == "" {
+		return c, errors.New("The Vault secrets provider needs an addr, e.g. vault:addr=https://vault:8200")
+	}
+	if c.Mount == "" {
+		return c, errors.New("Vault mount can't be empty")
+	}
+
+	return c, nil
+}
+
+// Provider reads secrets from Vault
+type Provider struct {
+	c      Config
+	client *http.Client
+}
+
+func New(c Config) (*Provider, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if c.CAFile != "" {
+		ca, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("No certificates found in Vault CA file %s", c.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &Provider{
+		c:      c,
+		client: &http.Client{Transport: transport, Timeout: c.Timeout},
+	}, nil
+}
+
+func (p *Provider) token() (string, error) {
+	if p.c.TokenFile == "" {
+		if t := os.Getenv("VAULT_TOKEN"); t != "" {
+			return t, nil
+		}
+		return "", errors.New("No Vault token: set token_file or VAULT_TOKEN")
+	}
+
+	buf, err := ioutil.ReadFile(p.c.TokenFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(buf)), nil
+}
+
+type kvResponse struct {
+	Data struct {
+		Data map[string]interface{} `json:"data"`
+	} `json:"data"`
+}
+
+func (p *Provider) Secret(name string) ([]byte, error) {
+	field := defaultField
+	if idx := strings.LastIndexByte(name, '#'); idx >= 0 {
+		name, field = name[:idx], name[idx+1:]
+	}
+
+	token, err := p.token()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", p.c.Addr+"/v1/"+p.c.Mount+"/data/"+strings.TrimLeft(name, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if p.c.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.c.Namespace)
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, secrets.ErrNotFound
+	default:
+		// Vault's error bodies are short JSON lists of messages, which are worth passing on
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf("Vault returned %s for %s: %s", res.Status, name, strings.TrimSpace(string(msg)))
+	}
+
+	var kv kvResponse
+	if err := json.NewDecoder(res.Body).Decode(&kv); err != nil {
+		return nil, err
+	}
+
+	val, ok := kv.Data.Data[field]
+	if !ok {
+		return nil, secrets.ErrNotFound
+	}
+	s, ok := val.(string)
+	if !ok {
+		return nil, fmt.Errorf("Vault secret %s field %s is not a string", name, field)
+	}
+
+	return []byte(s), nil
+}
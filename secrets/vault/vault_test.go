@@ -0,0 +1,91 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vault_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/netflix/rend/secrets"
+	"github.com/netflix/rend/secrets/vault"
+)
+
+func TestVault(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.token" || r.Header.Get("X-Vault-Namespace") != "team" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		if r.URL.Path != "/v1/kv/data/rend/peer" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"data":{"data":{"value":"default","key":"pem","n":1},"metadata":{"version":3}}}`))
+	}))
+	defer srv.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("s.token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := secrets.FromConfig("vault:addr=" + srv.URL + "&mount=kv&namespace=team&token_file=" + tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if val, err := p.Secret("rend/peer"); err != nil || string(val) != "default" {
+		t.Fatalf("Expected the default field, got %q %v", val, err)
+	}
+	if val, err := p.Secret("rend/peer#key"); err != nil || string(val) != "pem" {
+		t.Fatalf("Expected the named field, got %q %v", val, err)
+	}
+	if _, err := p.Secret("rend/peer#missing"); err != secrets.ErrNotFound {
+		t.Fatal("Expected a missing field not to be found, got", err)
+	}
+	if _, err := p.Secret("rend/peer#n"); err == nil {
+		t.Fatal("Expected a non-string field to fail")
+	}
+	if _, err := p.Secret("rend/other"); err != secrets.ErrNotFound {
+		t.Fatal("Expected a missing secret not to be found, got", err)
+	}
+
+	if err := ioutil.WriteFile(tokenFile, []byte("s.revoked"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Secret("rend/peer"); err == nil {
+		t.Fatal("Expected the rewritten token file to be used and rejected")
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	c, err := vault.ParseConfig("addr=https://vault:8200/&timeout=1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Addr != "https://vault:8200" || c.Mount != "secret" {
+		t.Fatalf("Unexpected config: %+v", c)
+	}
+
+	for _, conf := range []string{"", "mount=kv", "addr=x&timeout=-1s", "addr=x&bogus=1"} {
+		if _, err := vault.ParseConfig(conf); err == nil {
+			t.Errorf("Expected %q to be invalid", conf)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package selftest runs a short end to end suite of operations against a running rend listener, as
+// a quick check that an instance and its backends work before it's put in service. Every check uses
+// its own keys under a random prefix and cleans up after itself, so it's safe to run against an
+// instance that is already serving traffic.
+package selftest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/netflix/rend/client/binprot"
+	"github.com/netflix/rend/client/common"
+)
+
+// LargeValueSize is the size of the value used to check values that span many chunks when L1 is
+// chunked
+const LargeValueSize = 256 * 1024
+
+// Result is the outcome of a single check
+type Result struct {
+	Name     string
+	Duration time.Duration
+	// Skipped is set when the listener's backends don't support the operation at all
+	Skipped bool
+	Err     error
+}
+
+// Report is the outcome of a whole run against one listener
+type Report struct {
+	Network string
+	Addr    string
+	Results []Result
+	Total   time.Duration
+}
+
+// Passed returns whether every check either passed or was skipped
+func (r Report) Passed() bool {
+	for _, res := range r.Results {
+		if res.Err != nil {
+			return false
+		}
+	}
+	return len(r.Results) > 0
+}
+
+func (r Report) String() string {
+	buf := new(bytes.Buffer)
+	status := "PASS"
+	if !r.Passed() {
+		status = "FAIL"
+	}
+	fmt.Fprintf(buf, "%s %s %s (%v)\n", status, r.Network, r.Addr, r.Total)
+
+	for _, res := range r.Results {
+		switch {
+		case res.Err != nil:
+			fmt.Fprintf(buf, "  FAIL %-12s %10v  %v\n", res.Name, res.Duration, res.Err)
+		case res.Skipped:
+			fmt.Fprintf(buf, "  SKIP %-12s %10v  not supported\n", res.Name, res.Duration)
+		default:
+			fmt.Fprintf(buf, "  PASS %-12s %10v\n", res.Name, res.Duration)
+		}
+	}
+
+	return buf.String()
+}
+
+// errSkip marks a check as skipped
+var errSkip = errors.New("skipped")
+
+type check struct {
+	name string
+	f    func(rw *bufio.ReadWriter, key []byte) error
+}
+
+var prot = binprot.BinProt{}
+
+var checks = []check{
+	{"set", func(rw *bufio.ReadWriter, key []byte) error {
+		return prot.SetE(rw, key, []byte("selftest"), 300)
+	}},
+	{"get", func(rw *bufio.ReadWriter, key []byte) error {
+		return expect(rw, key, []byte("selftest"))
+	}},
+	{"gete", func(rw *bufio.ReadWriter, key []byte) error {
+		data, _, exptime, err := prot.GetE(rw, key)
+		if errors.Is(err, common.ErrUnknownCmd) || errors.Is(err, common.ErrNotSupported) {
+			return errSkip
+		}
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(data, []byte("selftest")) {
+			return fmt.Errorf("got %q back", data)
+		}
+		if exptime == 0 {
+			return errors.New("got no expiration time back")
+		}
+		return nil
+	}},
+	{"touch", func(rw *bufio.ReadWriter, key []byte) error {
+		if err := prot.Touch(rw, key); err != nil {
+			return err
+		}
+		return expect(rw, key, []byte("selftest"))
+	}},
+	{"delete", func(rw *bufio.ReadWriter, key []byte) error {
+		if err := prot.Delete(rw, key); err != nil {
+			return err
+		}
+		if _, err := prot.Get(rw, key); !errors.Is(err, common.ErrKeyNotFound) {
+			return fmt.Errorf("expected a miss after delete, got %v", err)
+		}
+		return nil
+	}},
+	{"large value", func(rw *bufio.ReadWriter, key []byte) error {
+		value := make([]byte, LargeValueSize)
+		if _, err := io.ReadFull(rand.Reader, value); err != nil {
+			return err
+		}
+		if err := prot.SetE(rw, key, value, 300); err != nil {
+			return err
+		}
+		return expect(rw, key, value)
+	}},
+	{"cleanup", func(rw *bufio.ReadWriter, prefix []byte) error {
+		for _, c := range []string{"set", "large value"} {
+			err := prot.Delete(rw, checkKey(prefix, c))
+			if err != nil && !errors.Is(err, common.ErrKeyNotFound) {
+				return err
+			}
+		}
+		return nil
+	}},
+}
+
+func expect(rw *bufio.ReadWriter, key, value []byte) error {
+	data, err := prot.Get(rw, key)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(data, value) {
+		if len(value) > 32 {
+			return fmt.Errorf("got %d bytes back that don't match the %d that were set", len(data), len(value))
+		}
+		return fmt.Errorf("got %q back instead of %q", data, value)
+	}
+	return nil
+}
+
+// checkKey returns the key a check works on. The checks after set all work on the key it set, while
+// the large value gets its own. Cleanup is given the prefix.
+func checkKey(prefix []byte, name string) []byte {
+	switch name {
+	case "get", "gete", "touch", "delete":
+		name = "set"
+	case "cleanup":
+		return prefix
+	}
+	return []byte(string(prefix) + strings.Replace(name, " ", "-", -1))
+}
+
+// Run connects to the listener at addr, which is either "tcp" or "unix" for network, and runs
+// the suite against it. The connection is retried until timeout passes, so the suite can be started
+// right alongside the listener. The timeout also bounds the whole run.
+func Run(network, addr string, timeout time.Duration) Report {
+	r := Report{Network: network, Addr: addr}
+	start := time.Now()
+	deadline := start.Add(timeout)
+
+	var conn net.Conn
+	var err error
+	for {
+		conn, err = net.DialTimeout(network, addr, time.Until(deadline))
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		r.Results = append(r.Results, Result{Name: "connect", Duration: time.Since(start), Err: err})
+		r.Total = time.Since(start)
+		return r
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	prefix := []byte("rend-selftest:" + randomID() + ":")
+
+	for _, c := range checks {
+		cstart := time.Now()
+		err := c.f(rw, checkKey(prefix, c.name))
+		res := Result{Name: c.name, Duration: time.Since(cstart)}
+		if errors.Is(err, errSkip) {
+			res.Skipped = true
+		} else {
+			res.Err = err
+		}
+		r.Results = append(r.Results, res)
+	}
+
+	r.Total = time.Since(start)
+	return r
+}
+
+func randomID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,67 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selftest_test
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/inmem"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol"
+	"github.com/netflix/rend/protocol/binprot"
+	"github.com/netflix/rend/selftest"
+	"github.com/netflix/rend/server"
+)
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestRun(t *testing.T) {
+	port := freePort(t)
+	go server.ListenAndServe(
+		server.ListenArgs{Type: server.ListenTCP, Port: port},
+		[]protocol.Components{binprot.Components},
+		server.Default,
+		orcas.L1Only,
+		inmem.New,
+		handlers.NilHandler,
+	)
+
+	r := selftest.Run("tcp", net.JoinHostPort("localhost", strconv.Itoa(port)), 5*time.Second)
+	if !r.Passed() {
+		t.Fatalf("Expected the self test to pass:\n%v", r)
+	}
+	if !strings.HasPrefix(r.String(), "PASS tcp") {
+		t.Fatalf("Unexpected report:\n%v", r)
+	}
+}
+
+func TestRunUnreachable(t *testing.T) {
+	r := selftest.Run("tcp", net.JoinHostPort("localhost", strconv.Itoa(freePort(t))), 200*time.Millisecond)
+	if r.Passed() || len(r.Results) != 1 || r.Results[0].Name != "connect" {
+		t.Fatalf("Expected a failed connection, got:\n%v", r)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"net"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/protocol"
+)
+
+const (
+	// the bufio default, used when no size is given
+	defaultBufSize = 4096
+
+	adaptiveMinBufSize     = 1 << 10 // 1k
+	adaptiveDefaultMaxSize = 1 << 16 // 64k
+
+	// number of requests between evaluations of the buffer sizes
+	adaptiveEvalInterval = 64
+
+	// room for protocol headers and the key around a value
+	adaptiveHeaderSlack = 256
+)
+
+func bufSizeOrDefault(size, def int) int {
+	if size <= 0 {
+		return def
+	}
+	return size
+}
+
+// adaptiveBuffers resizes the buffered reader and writer of a connection based on the sizes of
+// the values that cross it. Connections start out with small buffers, which is all that is needed
+// for metadata-sized values, and grow toward the maximum as larger values are seen. They shrink
+// back down when traffic becomes small again.
+//
+// The resize is done by replacing the contents of the *bufio.Reader and *bufio.Writer that the
+// parser and responder already hold, which is only safe when there is no buffered data. That is
+// true between requests for all but pipelining clients, for which the resize is just deferred.
+type adaptiveBuffers struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+
+	readSize     int
+	writeSize    int
+	maxReadSize  int
+	maxWriteSize int
+
+	// the largest values seen in each direction since the last evaluation
+	maxIn  int
+	maxOut int
+	count  int
+}
+
+func newAdaptiveBuffers(conn net.Conn, maxReadSize, maxWriteSize int) *adaptiveBuffers {
+	return &adaptiveBuffers{
+		conn:         conn,
+		r:            bufio.NewReaderSize(conn, adaptiveMinBufSize),
+		w:            bufio.NewWriterSize(conn, adaptiveMinBufSize),
+		readSize:     adaptiveMinBufSize,
+		writeSize:    adaptiveMinBufSize,
+		maxReadSize:  maxReadSize,
+		maxWriteSize: maxWriteSize,
+	}
+}
+
+// targetSize is the smallest power of two that fits the value and its headers, within bounds
+func targetSize(valueSize, maxSize int) int {
+	size := adaptiveMinBufSize
+	for size < valueSize+adaptiveHeaderSlack && size < maxSize {
+		size <<= 1
+	}
+	if size > maxSize {
+		size = maxSize
+	}
+	return size
+}
+
+func (a *adaptiveBuffers) evaluate() {
+	a.count++
+	if a.count < adaptiveEvalInterval {
+		return
+	}
+
+	if target := targetSize(a.maxIn, a.maxReadSize); target != a.readSize && a.r.Buffered() == 0 {
+		*a.r = *bufio.NewReaderSize(a.conn, target)
+		a.readSize = target
+		metrics.IncCounter(MetricBufferResizes)
+	}
+
+	if target := targetSize(a.maxOut, a.maxWriteSize); target != a.writeSize && a.w.Buffered() == 0 {
+		*a.w = *bufio.NewWriterSize(a.conn, target)
+		a.writeSize = target
+		metrics.IncCounter(MetricBufferResizes)
+	}
+
+	a.count = 0
+	a.maxIn = 0
+	a.maxOut = 0
+}
+
+func (a *adaptiveBuffers) observeIn(n int) {
+	if n > a.maxIn {
+		a.maxIn = n
+	}
+}
+
+func (a *adaptiveBuffers) observeOut(n int) {
+	if n > a.maxOut {
+		a.maxOut = n
+	}
+}
+
+type adaptiveParser struct {
+	protocol.RequestParser
+	a *adaptiveBuffers
+}
+
+func (p adaptiveParser) Parse() (common.Request, common.RequestType, uint64, error) {
+	p.a.evaluate()
+
+	req, reqType, start, err := p.RequestParser.Parse()
+	if sr, ok := req.(common.SetRequest); ok {
+		p.a.observeIn(len(sr.Data))
+	}
+
+	return req, reqType, start, err
+}
+
+type adaptiveResponder struct {
+	protocol.Responder
+	a *adaptiveBuffers
+}
+
+func (r adaptiveResponder) Get(response common.GetResponse) error {
+	r.a.observeOut(len(response.Data))
+	return r.Responder.Get(response)
+}
+
+func (r adaptiveResponder) GetE(response common.GetEResponse) error {
+	r.a.observeOut(len(response.Data))
+	return r.Responder.GetE(response)
+}
+
+func (r adaptiveResponder) GAT(response common.GetResponse) error {
+	r.a.observeOut(len(response.Data))
+	return r.Responder.GAT(response)
+}
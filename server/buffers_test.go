@@ -0,0 +1,70 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTargetSize(t *testing.T) {
+	tests := []struct {
+		value, max, want int
+	}{
+		{0, 1 << 16, adaptiveMinBufSize},
+		{700, 1 << 16, 1 << 10},
+		{800, 1 << 16, 1 << 11},
+		{10000, 1 << 16, 1 << 14},
+		{1 << 20, 1 << 16, 1 << 16},
+		{1 << 20, 3000, 3000},
+	}
+
+	for _, tt := range tests {
+		if got := targetSize(tt.value, tt.max); got != tt.want {
+			t.Errorf("targetSize(%d, %d): expected %d, got %d", tt.value, tt.max, tt.want, got)
+		}
+	}
+}
+
+func TestAdaptiveBuffersResize(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	a := newAdaptiveBuffers(c1, 1<<16, 1<<16)
+	r, w := a.r, a.w
+
+	a.observeIn(20000)
+	a.observeOut(100)
+	for i := 0; i < adaptiveEvalInterval; i++ {
+		a.evaluate()
+	}
+
+	// the same pointers held by the parser and responder see the new sizes
+	if r.Size() != 1<<15 {
+		t.Fatalf("Expected read buffer to grow to %d, got %d", 1<<15, r.Size())
+	}
+	if w.Size() != adaptiveMinBufSize {
+		t.Fatalf("Expected write buffer to stay at %d, got %d", adaptiveMinBufSize, w.Size())
+	}
+
+	// with only small values in the next interval, the read buffer shrinks again
+	for i := 0; i < adaptiveEvalInterval; i++ {
+		a.evaluate()
+	}
+	if r.Size() != adaptiveMinBufSize {
+		t.Fatalf("Expected read buffer to shrink to %d, got %d", adaptiveMinBufSize, r.Size())
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol"
+	"github.com/netflix/rend/watchdog"
+)
+
+func init() {
+	orcas.RegisterStatsGroup("conns", ConnStats)
+	metrics.RegisterBulkCallback(clientMetrics)
+}
+
+// conns holds every client connection being served, from every listener
+var conns = &connTable{m: make(map[uint64]*connInfo)}
+
+// loopLeases are held by the goroutine serving each connection. There should be no more of them
+// than connections in conns; any more are loops that never noticed their connection closed.
+var loopLeases = watchdog.NewKind("server_loops", false)
+
+type connTable struct {
+	lock sync.RWMutex
+	next uint64
+	m    map[uint64]*connInfo
+}
+
+// connInfo is what is known about one client connection. It's removed from the table when it's
+// closed along with the rest of the connection.
+type connInfo struct {
+	id        uint64
+	remote    string
+	local     string
+	protocol  string
+	connected time.Time
+
+	ops uint64
+
+	lock     sync.Mutex
+	last     string
+	lastTime time.Time
+}
+
+// trackConn adds a connection speaking the given protocol to the table. The addresses are in the
+// form addrString gives them.
+func trackConn(remote, local, protocol string) *connInfo {
+	info := &connInfo{
+		remote:    remote,
+		local:     local,
+		protocol:  protocol,
+		connected: time.Now(),
+	}
+
+	conns.lock.Lock()
+	conns.next++
+	info.id = conns.next
+	conns.m[info.id] = info
+	conns.lock.Unlock()
+
+	return info
+}
+
+// record notes a request parsed from the connection
+func (c *connInfo) record(req common.Request, reqType common.RequestType) {
+	atomic.AddUint64(&c.ops, 1)
+
+	c.lock.Lock()
+	c.last = describeRequest(req, reqType)
+	c.lastTime = time.Now()
+	c.lock.Unlock()
+}
+
+// Close removes the connection from the table. It's in the list of things the server closes when
+// the connection ends, so the table never holds connections that are gone.
+func (c *connInfo) Close() error {
+	conns.lock.Lock()
+	delete(conns.m, c.id)
+	conns.lock.Unlock()
+	return nil
+}
+
+// ConnStatus is a snapshot of one client connection
+type ConnStatus struct {
+	ID         uint64    `json:"id"`
+	Addr       string    `json:"addr"`
+	ListenAddr string    `json:"listen_addr"`
+	Protocol   string    `json:"protocol"`
+	Connected  time.Time `json:"connected"`
+	Ops        uint64    `json:"ops"`
+	// LastCommand is the last request's command and first key, empty until the first request
+	LastCommand string    `json:"last_command"`
+	LastActive  time.Time `json:"last_active"`
+}
+
+func (c *connInfo) status() ConnStatus {
+	s := ConnStatus{
+		ID:         c.id,
+		Addr:       c.remote,
+		ListenAddr: c.local,
+		Protocol:   c.protocol,
+		Connected:  c.connected,
+		Ops:        atomic.LoadUint64(&c.ops),
+	}
+
+	c.lock.Lock()
+	s.LastCommand, s.LastActive = c.last, c.lastTime
+	c.lock.Unlock()
+
+	if s.LastActive.IsZero() {
+		s.LastActive = c.connected
+	}
+	return s
+}
+
+// addrString formats an address the way memcached's stats conns does, e.g. tcp:10.0.0.1:54321
+func addrString(a net.Addr) string {
+	if a == nil {
+		return ""
+	}
+	return a.Network() + ":" + a.String()
+}
+
+// Conns returns a snapshot of every client connection being served, oldest first
+func Conns() []ConnStatus {
+	conns.lock.RLock()
+	res := make([]ConnStatus, 0, len(conns.m))
+	for _, c := range conns.m {
+		res = append(res, c.status())
+	}
+	conns.lock.RUnlock()
+
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+// NumConns returns the number of client connections being served
+func NumConns() int {
+	conns.lock.RLock()
+	defer conns.lock.RUnlock()
+	return len(conns.m)
+}
+
+// ConnStats answers `stats conns` like memcached does, with a group of stats named after each
+// connection's ID, along with rend's own protocol, connect time, op count, and last command
+func ConnStats() []metrics.Stat {
+	now := time.Now()
+
+	var res []metrics.Stat
+	for _, c := range Conns() {
+		prefix := strconv.FormatUint(c.ID, 10) + ":"
+		res = append(res,
+			metrics.Stat{Name: prefix + "addr", Value: c.Addr},
+			metrics.Stat{Name: prefix + "listen_addr", Value: c.ListenAddr},
+			metrics.Stat{Name: prefix + "protocol", Value: c.Protocol},
+			metrics.Stat{Name: prefix + "connected", Value: strconv.FormatInt(c.Connected.Unix(), 10)},
+			metrics.Stat{Name: prefix + "ops", Value: strconv.FormatUint(c.Ops, 10)},
+			metrics.Stat{Name: prefix + "secs_since_last_cmd", Value: strconv.FormatInt(int64(now.Sub(c.LastActive)/time.Second), 10)},
+		)
+		if c.LastCommand != "" {
+			res = append(res, metrics.Stat{Name: prefix + "last_cmd", Value: c.LastCommand})
+		}
+	}
+	return res
+}
+
+// clientOf returns the host of an address in the form addrString gives it, which is the IP for
+// TCP connections. Connections over anything else are grouped under their network.
+func clientOf(addr string) string {
+	i := strings.IndexByte(addr, ':')
+	if i < 0 {
+		return addr
+	}
+	if host, _, err := net.SplitHostPort(addr[i+1:]); err == nil && addr[:i] == "tcp" {
+		return host
+	}
+	return addr[:i]
+}
+
+// clientMetrics reports the connections open from each client and the requests they've sent,
+// tagged with the client's address. For connections through a proxy speaking the PROXY protocol
+// that's the real client's address, not the proxy's. Only clients with connections open are
+// reported, so there are never more of them than connections.
+func clientMetrics() ([]metrics.IntMetric, []metrics.FloatMetric) {
+	type client struct {
+		conns, ops uint64
+	}
+	clients := make(map[string]*client)
+
+	for _, c := range Conns() {
+		addr := clientOf(c.Addr)
+		cl, ok := clients[addr]
+		if !ok {
+			cl = new(client)
+			clients[addr] = cl
+		}
+		cl.conns++
+		cl.ops += c.Ops
+	}
+
+	ret := make([]metrics.IntMetric, 0, 2*len(clients))
+	for addr, cl := range clients {
+		tgs := metrics.Tags{"client": addr}
+		ret = append(ret,
+			metrics.IntMetric{Name: "client_conns", Val: cl.conns, Tgs: tgs},
+			metrics.IntMetric{Name: "client_ops", Val: cl.ops, Tgs: tgs},
+		)
+	}
+
+	return ret, nil
+}
+
+// ConnsHandler lists every client connection being served as JSON
+var ConnsHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Conns())
+})
+
+// connParser records every request parsed from a connection in its connInfo
+type connParser struct {
+	protocol.RequestParser
+	info *connInfo
+}
+
+func (p connParser) Parse() (common.Request, common.RequestType, uint64, error) {
+	req, reqType, start, err := p.RequestParser.Parse()
+	if err == nil {
+		p.info.record(req, reqType)
+	}
+	return req, reqType, start, err
+}
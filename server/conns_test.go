@@ -0,0 +1,107 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/netflix/rend/common"
+)
+
+type oneRequestParser struct {
+	req     common.Request
+	reqType common.RequestType
+}
+
+func (p oneRequestParser) Parse() (common.Request, common.RequestType, uint64, error) {
+	return p.req, p.reqType, 0, nil
+}
+
+func TestConnTracking(t *testing.T) {
+	info := trackConn("tcp:10.0.0.1:54321", "tcp:0.0.0.0:11211", "text")
+
+	p := connParser{
+		RequestParser: oneRequestParser{common.GetRequest{Keys: [][]byte{[]byte("foo")}}, common.RequestGet},
+		info:          info,
+	}
+	for i := 0; i < 3; i++ {
+		if _, _, _, err := p.Parse(); err != nil {
+			t.Fatalf("Parse: %v", err)
+		}
+	}
+
+	stats := make(map[string]string)
+	for _, s := range ConnStats() {
+		stats[s.Name] = s.Value
+	}
+
+	prefix := strconv.FormatUint(info.id, 10) + ":"
+	expected := map[string]string{
+		"addr":        "tcp:10.0.0.1:54321",
+		"listen_addr": "tcp:0.0.0.0:11211",
+		"protocol":    "text",
+		"ops":         "3",
+		"last_cmd":    describeRequest(common.GetRequest{Keys: [][]byte{[]byte("foo")}}, common.RequestGet),
+	}
+	for name, want := range expected {
+		if got, ok := stats[prefix+name]; !ok || got != want {
+			t.Errorf("Expected %s%s to be %q, got %q", prefix, name, want, got)
+		}
+	}
+
+	info.Close()
+	for _, s := range ConnStats() {
+		if s.Name == prefix+"addr" {
+			t.Fatalf("Expected connection %d to be gone after closing, got %v", info.id, s)
+		}
+	}
+}
+
+func TestClientMetrics(t *testing.T) {
+	a := trackConn("tcp:10.0.0.2:54321", "tcp:0.0.0.0:11211", "text")
+	b := trackConn("tcp:10.0.0.2:54322", "tcp:0.0.0.0:11211", "binary")
+	c := trackConn("tcp:[fd00::1]:54323", "tcp:0.0.0.0:11211", "binary")
+	defer c.Close()
+	atomic.AddUint64(&a.ops, 2)
+	atomic.AddUint64(&b.ops, 3)
+
+	find := func(name, client string) (uint64, bool) {
+		ints, _ := clientMetrics()
+		for _, m := range ints {
+			if m.Name == name && m.Tgs["client"] == client {
+				return m.Val, true
+			}
+		}
+		return 0, false
+	}
+
+	if v, _ := find("client_conns", "10.0.0.2"); v != 2 {
+		t.Fatalf("Expected 2 connections from 10.0.0.2, got %d", v)
+	}
+	if v, _ := find("client_ops", "10.0.0.2"); v != 5 {
+		t.Fatalf("Expected 5 requests from 10.0.0.2, got %d", v)
+	}
+	if v, _ := find("client_conns", "fd00::1"); v != 1 {
+		t.Fatalf("Expected 1 connection from fd00::1, got %d", v)
+	}
+
+	a.Close()
+	b.Close()
+	if _, ok := find("client_conns", "10.0.0.2"); ok {
+		t.Fatal("Expected no metrics for a client without connections")
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"io"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol"
+)
+
+// connOrca builds the orchestrator for a single connection. Every operation is done with a
+// context that is cancelled once the connection is closed, or as soon as a response can't be
+// written to the client anymore, so the remaining backend work for a client that has gone away can
+// be skipped. The context also carries the ID of the request being served, which id points to. The
+// returned io.Closer cancels the context and belongs with the other closers of the connection. If
+// timing isn't nil, the context carries it too so the orchestrator's handlers can account their
+// time in it.
+func connOrca(o orcas.OrcaConst, l1, l2 handlers.Handler, res protocol.Responder, id *common.RequestID, timing *common.Timing) (orcas.Orca, io.Closer) {
+	ctx := common.WithRequestID(context.Background(), id)
+	if timing != nil {
+		ctx = common.WithTiming(ctx, timing)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	res = cancellingResponder{Responder: res, cancel: cancel}
+
+	o2 := orcas.ConstV2(o)(handlers.V2(l1), handlers.V2(l2), res)
+	return orcas.V1(ctx, o2), cancelCloser(cancel)
+}
+
+type cancelCloser context.CancelFunc
+
+func (c cancelCloser) Close() error {
+	c()
+	return nil
+}
+
+// cancellingResponder cancels the context of the connection when a response fails to be written
+type cancellingResponder struct {
+	protocol.Responder
+	cancel context.CancelFunc
+}
+
+func (c cancellingResponder) check(err error) error {
+	if err != nil {
+		c.cancel()
+	}
+	return err
+}
+
+func (c cancellingResponder) Set(opaque uint32, quiet bool) error {
+	return c.check(c.Responder.Set(opaque, quiet))
+}
+
+func (c cancellingResponder) Add(opaque uint32, quiet bool) error {
+	return c.check(c.Responder.Add(opaque, quiet))
+}
+
+func (c cancellingResponder) Replace(opaque uint32, quiet bool) error {
+	return c.check(c.Responder.Replace(opaque, quiet))
+}
+
+func (c cancellingResponder) Append(opaque uint32, quiet bool) error {
+	return c.check(c.Responder.Append(opaque, quiet))
+}
+
+func (c cancellingResponder) Prepend(opaque uint32, quiet bool) error {
+	return c.check(c.Responder.Prepend(opaque, quiet))
+}
+
+func (c cancellingResponder) SetIfMatch(opaque uint32, quiet bool) error {
+	return c.check(c.Responder.SetIfMatch(opaque, quiet))
+}
+
+func (c cancellingResponder) CompareAndSwap(opaque uint32, quiet bool) error {
+	return c.check(c.Responder.CompareAndSwap(opaque, quiet))
+}
+
+func (c cancellingResponder) Get(response common.GetResponse) error {
+	return c.check(c.Responder.Get(response))
+}
+
+func (c cancellingResponder) GetEnd(opaque uint32, noopEnd bool) error {
+	return c.check(c.Responder.GetEnd(opaque, noopEnd))
+}
+
+func (c cancellingResponder) GetE(response common.GetEResponse) error {
+	return c.check(c.Responder.GetE(response))
+}
+
+func (c cancellingResponder) Gets(response common.GetResponse) error {
+	return c.check(c.Responder.Gets(response))
+}
+
+func (c cancellingResponder) GetLock(response common.GetLockResponse) error {
+	return c.check(c.Responder.GetLock(response))
+}
+
+func (c cancellingResponder) Unlock(opaque uint32) error {
+	return c.check(c.Responder.Unlock(opaque))
+}
+
+func (c cancellingResponder) GAT(response common.GetResponse) error {
+	return c.check(c.Responder.GAT(response))
+}
+
+func (c cancellingResponder) Delete(opaque uint32, quiet bool) error {
+	return c.check(c.Responder.Delete(opaque, quiet))
+}
+
+func (c cancellingResponder) Touch(opaque uint32, quiet bool) error {
+	return c.check(c.Responder.Touch(opaque, quiet))
+}
+
+func (c cancellingResponder) Incr(opaque uint32, quiet bool, value uint64) error {
+	return c.check(c.Responder.Incr(opaque, quiet, value))
+}
+
+func (c cancellingResponder) Decr(opaque uint32, quiet bool, value uint64) error {
+	return c.check(c.Responder.Decr(opaque, quiet, value))
+}
+
+func (c cancellingResponder) Flush(opaque uint32, quiet bool) error {
+	return c.check(c.Responder.Flush(opaque, quiet))
+}
+
+func (c cancellingResponder) Noop(opaque uint32) error {
+	return c.check(c.Responder.Noop(opaque))
+}
+
+func (c cancellingResponder) Quit(opaque uint32, quiet bool) error {
+	return c.check(c.Responder.Quit(opaque, quiet))
+}
+
+func (c cancellingResponder) Version(opaque uint32) error {
+	return c.check(c.Responder.Version(opaque))
+}
+
+func (c cancellingResponder) Stats(opaque uint32, stats []metrics.Stat) error {
+	return c.check(c.Responder.Stats(opaque, stats))
+}
+
+func (c cancellingResponder) Error(opaque uint32, reqType common.RequestType, err error, quiet bool) error {
+	return c.check(c.Responder.Error(opaque, reqType, err, quiet))
+}
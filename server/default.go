@@ -15,9 +15,12 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"time"
 
 	"github.com/netflix/rend/common"
 	"github.com/netflix/rend/metrics"
@@ -55,18 +58,17 @@ func (s *DefaultServer) Loop() {
 				log.Println("Panic location: ", identifyPanic())
 			}
 
-			abort(s.conns, fmt.Errorf("Runtime panic: %v", r))
+			abortRequest(s.conns, orcas.RequestID(s.orca), fmt.Errorf("Runtime panic: %v", r))
 		}
 	}()
 
+	deadlines, _ := s.rp.(protocol.DeadlineParser)
+
 	for {
 		request, reqType, start, err := s.rp.Parse()
 		if err != nil {
-			if err == common.ErrBadRequest ||
-				err == common.ErrBadLength ||
-				err == common.ErrBadFlags ||
-				err == common.ErrBadExptime {
-				s.orca.Error(nil, common.RequestUnknown, err)
+			if common.ClassOf(err) == common.ClassClient {
+				s.orca.Error(request, reqType, err)
 				continue
 			} else {
 				// Otherwise IO error. Abort!
@@ -77,63 +79,127 @@ func (s *DefaultServer) Loop() {
 
 		metrics.IncCounter(MetricCmdTotal)
 
+		// A request with a deadline is served with its own context, so backend work for it stops
+		// once the client has given up on it
+		orca := s.orca
+		var ctx context.Context
+		var cancel context.CancelFunc
+		if deadlines != nil {
+			if d := deadlines.Deadline(); d > 0 {
+				metrics.IncCounter(MetricCmdDeadlines)
+				d -= time.Duration(timer.Since(start))
+				ctx, cancel = context.WithTimeout(orcas.Context(s.orca), d)
+				orca = orcas.WithContext(s.orca, ctx)
+			}
+		}
+
 		// TODO: handle nil
 		switch reqType {
 		case common.RequestSet:
 			metrics.IncCounter(MetricCmdSet)
-			err = s.orca.Set(request.(common.SetRequest))
+			err = orca.Set(request.(common.SetRequest))
+		case common.RequestSetIfMatch:
+			metrics.IncCounter(MetricCmdSetIfMatch)
+			err = orcas.SetIfMatch(orca, request.(common.SetIfMatchRequest))
+		case common.RequestCAS:
+			metrics.IncCounter(MetricCmdCAS)
+			err = orcas.CompareAndSwap(orca, request.(common.CASRequest))
+		case common.RequestMultiSet:
+			req := request.(common.MultiSetRequest)
+			metrics.IncCounter(MetricCmdMultiSet)
+			metrics.IncCounterBy(MetricCmdMultiSetKeys, uint64(len(req.Sets)))
+			err = orcas.MultiSet(orca, req)
 		case common.RequestAdd:
 			metrics.IncCounter(MetricCmdAdd)
-			err = s.orca.Add(request.(common.SetRequest))
+			err = orca.Add(request.(common.SetRequest))
 		case common.RequestReplace:
 			metrics.IncCounter(MetricCmdReplace)
-			err = s.orca.Replace(request.(common.SetRequest))
+			err = orca.Replace(request.(common.SetRequest))
 		case common.RequestAppend:
 			metrics.IncCounter(MetricCmdAppend)
-			err = s.orca.Append(request.(common.SetRequest))
+			err = orca.Append(request.(common.SetRequest))
 		case common.RequestPrepend:
 			metrics.IncCounter(MetricCmdPrepend)
-			err = s.orca.Prepend(request.(common.SetRequest))
+			err = orca.Prepend(request.(common.SetRequest))
 		case common.RequestDelete:
 			metrics.IncCounter(MetricCmdDelete)
-			err = s.orca.Delete(request.(common.DeleteRequest))
+			err = orca.Delete(request.(common.DeleteRequest))
+		case common.RequestMultiDelete:
+			req := request.(common.MultiDeleteRequest)
+			metrics.IncCounter(MetricCmdMultiDelete)
+			metrics.IncCounterBy(MetricCmdMultiDeleteKeys, uint64(len(req.Deletes)))
+			err = orcas.MultiDelete(orca, req)
 		case common.RequestTouch:
 			metrics.IncCounter(MetricCmdTouch)
-			err = s.orca.Touch(request.(common.TouchRequest))
+			err = orca.Touch(request.(common.TouchRequest))
 		case common.RequestGet:
 			metrics.IncCounter(MetricCmdGet)
-			err = s.orca.Get(request.(common.GetRequest))
+			err = orca.Get(request.(common.GetRequest))
 		case common.RequestGetE:
 			metrics.IncCounter(MetricCmdGetE)
-			err = s.orca.GetE(request.(common.GetRequest))
+			err = orca.GetE(request.(common.GetRequest))
+		case common.RequestGets:
+			metrics.IncCounter(MetricCmdGets)
+			err = orcas.Gets(orca, request.(common.GetRequest))
 		case common.RequestGat:
 			metrics.IncCounter(MetricCmdGat)
-			err = s.orca.Gat(request.(common.GATRequest))
+			err = orca.Gat(request.(common.GATRequest))
+		case common.RequestGetLock:
+			metrics.IncCounter(MetricCmdGetLock)
+			err = orcas.GetLock(orca, request.(common.GetLockRequest))
+		case common.RequestUnlock:
+			metrics.IncCounter(MetricCmdUnlock)
+			err = orcas.Unlock(orca, request.(common.UnlockRequest))
 		case common.RequestNoop:
 			metrics.IncCounter(MetricCmdNoop)
-			err = s.orca.Noop(request.(common.NoopRequest))
+			err = orca.Noop(request.(common.NoopRequest))
 		case common.RequestQuit:
 			metrics.IncCounter(MetricCmdQuit)
-			s.orca.Quit(request.(common.QuitRequest))
+			orca.Quit(request.(common.QuitRequest))
+			if cancel != nil {
+				cancel()
+			}
 			abort(s.conns, err)
 			return
 		case common.RequestVersion:
 			metrics.IncCounter(MetricCmdVersion)
-			err = s.orca.Version(request.(common.VersionRequest))
+			err = orca.Version(request.(common.VersionRequest))
+		case common.RequestStats:
+			metrics.IncCounter(MetricCmdStats)
+			err = orcas.Stats(orca, request.(common.StatsRequest))
+		case common.RequestIncr:
+			metrics.IncCounter(MetricCmdIncr)
+			err = orcas.Incr(orca, request.(common.ArithRequest))
+		case common.RequestDecr:
+			metrics.IncCounter(MetricCmdDecr)
+			err = orcas.Decr(orca, request.(common.ArithRequest))
+		case common.RequestFlush:
+			metrics.IncCounter(MetricCmdFlush)
+			err = orcas.Flush(orca, request.(common.FlushRequest))
 		case common.RequestUnknown:
 			metrics.IncCounter(MetricCmdUnknown)
-			err = s.orca.Unknown(request)
+			err = orca.Unknown(request)
+		}
+
+		if cancel != nil {
+			if err != nil && ctx.Err() == context.DeadlineExceeded {
+				// Reported like any other request that couldn't be served in time, so the client
+				// isn't disconnected for it
+				metrics.IncCounter(MetricCmdDeadlinesExceeded)
+				err = common.Wrap(common.ErrTempFailure, err)
+			}
+			cancel()
 		}
 
 		if err != nil {
 			if common.IsAppError(err) {
-				if err != common.ErrKeyNotFound {
+				if !errors.Is(err, common.ErrKeyNotFound) {
 					metrics.IncCounter(MetricErrAppError)
 				}
 				s.orca.Error(request, reqType, err)
 			} else {
 				metrics.IncCounter(MetricErrUnrecoverable)
-				abort(s.conns, err)
+				abortRequest(s.conns, orcas.RequestID(orca), err)
 				return
 			}
 		}
@@ -142,20 +208,40 @@ func (s *DefaultServer) Loop() {
 		switch reqType {
 		case common.RequestSet:
 			metrics.ObserveHist(HistSet, dur)
+		case common.RequestSetIfMatch:
+			metrics.ObserveHist(HistSetIfMatch, dur)
+		case common.RequestCAS:
+			metrics.ObserveHist(HistCAS, dur)
+		case common.RequestMultiSet:
+			metrics.ObserveHist(HistMultiSet, dur)
 		case common.RequestAdd:
 			metrics.ObserveHist(HistAdd, dur)
 		case common.RequestReplace:
 			metrics.ObserveHist(HistReplace, dur)
 		case common.RequestDelete:
 			metrics.ObserveHist(HistDelete, dur)
+		case common.RequestMultiDelete:
+			metrics.ObserveHist(HistMultiDelete, dur)
 		case common.RequestTouch:
 			metrics.ObserveHist(HistTouch, dur)
 		case common.RequestGet:
 			metrics.ObserveHist(HistGet, dur)
 		case common.RequestGetE:
 			metrics.ObserveHist(HistGetE, dur)
+		case common.RequestGets:
+			metrics.ObserveHist(HistGets, dur)
 		case common.RequestGat:
 			metrics.ObserveHist(HistGat, dur)
+		case common.RequestIncr:
+			metrics.ObserveHist(HistIncr, dur)
+		case common.RequestDecr:
+			metrics.ObserveHist(HistDecr, dur)
+		case common.RequestFlush:
+			metrics.ObserveHist(HistFlush, dur)
+		case common.RequestGetLock:
+			metrics.ObserveHist(HistGetLock, dur)
+		case common.RequestUnlock:
+			metrics.ObserveHist(HistUnlock, dur)
 		}
 	}
 }
@@ -15,12 +15,22 @@
 package server_test
 
 import (
+	"context"
+	"errors"
 	"io"
+	"net"
 	"runtime"
 	"testing"
+	"time"
 
 	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/inmem"
+	"github.com/netflix/rend/handlers/memcached/std"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol"
 	"github.com/netflix/rend/server"
+	"github.com/netflix/rend/timer"
 )
 
 type ioCloserSpy struct {
@@ -323,3 +333,101 @@ func TestDefaultServer(t *testing.T) {
 		t.Run("Unknown", func(t *testing.T) { testPanic(t, common.RequestUnknown, nil) })
 	})
 }
+
+type deadlineParser struct {
+	testRequestParser
+	deadline time.Duration
+}
+
+func (d *deadlineParser) Deadline() time.Duration {
+	return d.deadline
+}
+
+// l1Orca sets into L1 and records the errors it is asked to respond with
+type l1Orca struct {
+	*testOrca
+	l1   handlers.Handler
+	errs *[]error
+}
+
+func (o l1Orca) Set(req common.SetRequest) error {
+	return o.l1.Set(req)
+}
+
+func (o l1Orca) Error(req common.Request, reqType common.RequestType, err error) {
+	*o.errs = append(*o.errs, err)
+}
+
+func TestDeadline(t *testing.T) {
+	serve := func(key string, deadline time.Duration) ([]error, bool) {
+		h, _ := inmem.New()
+		var errs []error
+
+		oc := func(l1, l2 handlers.Handler, res protocol.Responder) orcas.Orca {
+			return l1Orca{testOrca: &testOrca{called: make(map[string]interface{})}, l1: l1, errs: &errs}
+		}
+		orca := orcas.V1(context.Background(), orcas.ConstV2(oc)(handlers.V2(h), nil, nil))
+
+		rp := &deadlineParser{deadline: deadline}
+		rp.reqType = common.RequestSet
+		rp.req = common.SetRequest{Key: []byte(key), Data: []byte("data")}
+		rp.startTime = timer.Now()
+
+		closer := &ioCloserSpy{}
+		server.Default([]io.Closer{closer}, rp, orca).Loop()
+
+		if !closer.closed {
+			t.Fatal("Expected the connection to be closed at the end")
+		}
+
+		res, err := h.GAT(common.GATRequest{Key: []byte(key)})
+		return errs, err == nil && !res.Miss
+	}
+
+	if errs, stored := serve("deadline-ok", time.Minute); len(errs) != 0 || !stored {
+		t.Fatalf("Expected a request within its deadline to be served, got %v", errs)
+	}
+
+	errs, stored := serve("deadline-exceeded", time.Nanosecond)
+	if stored {
+		t.Fatal("Expected a request past its deadline not to reach the backend")
+	}
+	if len(errs) != 1 || !errors.Is(errs[0], common.ErrTempFailure) || !errors.Is(errs[0], context.DeadlineExceeded) {
+		t.Fatalf("Expected a temporary failure for a request past its deadline, got %v", errs)
+	}
+}
+
+func TestDeadlineStalledBackend(t *testing.T) {
+	// The backend reads the request and never answers
+	dial := func() (io.ReadWriteCloser, error) {
+		client, server := net.Pipe()
+		go io.Copy(io.Discard, server)
+		return client, nil
+	}
+	h, err := std.NewHandlerDialer(dial, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	var errs []error
+	oc := func(l1, l2 handlers.Handler, res protocol.Responder) orcas.Orca {
+		return l1Orca{testOrca: &testOrca{called: make(map[string]interface{})}, l1: l1, errs: &errs}
+	}
+	orca := orcas.V1(context.Background(), orcas.ConstV2(oc)(handlers.V2(h), nil, nil))
+
+	rp := &deadlineParser{deadline: 50 * time.Millisecond}
+	rp.reqType = common.RequestSet
+	rp.req = common.SetRequest{Key: []byte("stalled"), Data: []byte("data")}
+	rp.startTime = timer.Now()
+
+	start := time.Now()
+	server.Default([]io.Closer{&ioCloserSpy{}}, rp, orca).Loop()
+
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Expected the deadline to cut the backend operation short, took %v", d)
+	}
+	if len(errs) != 1 || !errors.Is(errs[0], common.ErrTempFailure) {
+		t.Fatalf("Expected a temporary failure for a request past its deadline, got %v", errs)
+	}
+}
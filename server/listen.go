@@ -16,6 +16,7 @@ package server
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"log"
@@ -23,7 +24,9 @@ import (
 	"os"
 	"time"
 
+	"github.com/netflix/rend/common"
 	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/logging"
 	"github.com/netflix/rend/metrics"
 	"github.com/netflix/rend/orcas"
 	"github.com/netflix/rend/protocol"
@@ -50,35 +53,72 @@ import (
 // h1, h2 handlers.HandlerConst
 //   - Used to create the handlers.Handler instances as needed when the connection is established.
 func ListenAndServe(l ListenArgs, ps []protocol.Components, s ServerConst, o orcas.OrcaConst, h1, h2 handlers.HandlerConst) {
-	var listener net.Listener
-	var err error
+	var listeners []net.Listener
+
+	configured := make([]protocol.Components, len(ps))
+	for i, p := range ps {
+		configured[i] = protocol.WithQuirks(protocol.WithVBuckets(protocol.WithStrictness(p, l.Strictness), l.VBuckets), l.Quirks)
+	}
+	ps = configured
 
 	switch l.Type {
 	case ListenTCP:
-		listener, err = net.Listen("tcp", fmt.Sprintf(":%d", l.Port))
-		if err != nil {
-			log.Panicf("Error binding to port %d: %v\n", l.Port, err.Error())
+		addr := fmt.Sprintf(":%d", l.Port)
+
+		if l.Acceptors > 1 {
+			if !reusePortSupported {
+				log.Panicf("Error binding to port %d: multiple acceptors require SO_REUSEPORT, which is not supported on this platform\n", l.Port)
+			}
+
+			// Each listener gets its own socket bound to the same port. The kernel spreads
+			// incoming connections across them, so each acceptor has its own accept queue.
+			lc := net.ListenConfig{Control: setReusePort}
+			for i := 0; i < l.Acceptors; i++ {
+				listener, err := lc.Listen(context.Background(), "tcp", addr)
+				if err != nil {
+					log.Panicf("Error binding to port %d with SO_REUSEPORT: %v\n", l.Port, err.Error())
+				}
+				listeners = append(listeners, listener)
+			}
+		} else {
+			listener, err := net.Listen("tcp", addr)
+			if err != nil {
+				log.Panicf("Error binding to port %d: %v\n", l.Port, err.Error())
+			}
+			listeners = append(listeners, listener)
 		}
 
 	case ListenUnix:
-		err = os.Remove(l.Path)
+		err := os.Remove(l.Path)
 		if err != nil && !os.IsNotExist(err) {
 			log.Panicf("Error removing previous unix socket file at %s\n", l.Path)
 		}
-		listener, err = net.Listen("unix", l.Path)
+		listener, err := net.Listen("unix", l.Path)
 		if err != nil {
 			log.Panicf("Error binding to unix socket at %s: %v\n", l.Path, err.Error())
 		}
+		listeners = append(listeners, listener)
 
 	default:
 		log.Panicf("Unsupported server listen type: %v", l.Type)
 	}
 
+	for _, listener := range listeners[1:] {
+		go accept(l, listener, ps, s, o, h1, h2)
+	}
+
+	accept(l, listeners[0], ps, s, o, h1, h2)
+}
+
+// accept runs the accept() loop for a single listener
+func accept(l ListenArgs, listener net.Listener, ps []protocol.Components, s ServerConst, o orcas.OrcaConst, h1, h2 handlers.HandlerConst) {
 	for {
 		remote, err := listener.Accept()
 		if err != nil {
 			log.Println("Error accepting connection from remote:", err.Error())
-			remote.Close()
+			if remote != nil {
+				remote.Close()
+			}
 			continue
 		}
 		metrics.IncCounter(MetricConnectionsEstablishedExt)
@@ -89,39 +129,109 @@ func ListenAndServe(l ListenArgs, ps []protocol.Components, s ServerConst, o orc
 			tcpRemote.SetKeepAlivePeriod(30 * time.Second)
 		}
 
-		// construct L1 handler using given constructor
-		l1, err := h1()
-		if err != nil {
-			log.Println("Error opening connection to L1:", err.Error())
-			remote.Close()
-			continue
-		}
-		metrics.IncCounter(MetricConnectionsEstablishedL1)
-
-		// construct l2
-		l2, err := h2()
-		if err != nil {
-			log.Println("Error opening connection to L2:", err.Error())
-			l1.Close()
-			remote.Close()
-			continue
-		}
-		metrics.IncCounter(MetricConnectionsEstablishedL2)
-
 		// spin off a goroutine here to handle determining the protocol used for the connection.
 		// The server loop can't be started until the protocol is known. Another goroutine is
 		// necessary here because we don't want to block accepting new connections if the current
-		// new connection doesn't send data immediately.
+		// new connection doesn't send data immediately. The backends are only connected to once
+		// the client is known to be allowed.
 		go func(remoteConn net.Conn) {
-			remoteReader := bufio.NewReader(remoteConn)
-			remoteWriter := bufio.NewWriter(remoteConn)
+			var remoteReader *bufio.Reader
+			var remoteWriter *bufio.Writer
+			var adaptive *adaptiveBuffers
+
+			// Any connection's requests can be sampled or traced, see requestIDParser
+			timing := new(common.Timing)
+			remoteConn = timedConn{Conn: remoteConn, t: timing}
+
+			if l.AdaptiveBuffers {
+				adaptive = newAdaptiveBuffers(remoteConn,
+					bufSizeOrDefault(l.ReadBufSize, adaptiveDefaultMaxSize),
+					bufSizeOrDefault(l.WriteBufSize, adaptiveDefaultMaxSize))
+				remoteReader = adaptive.r
+				remoteWriter = adaptive.w
+			} else {
+				remoteReader = bufio.NewReaderSize(remoteConn, bufSizeOrDefault(l.ReadBufSize, defaultBufSize))
+				remoteWriter = bufio.NewWriterSize(remoteConn, bufSizeOrDefault(l.WriteBufSize, defaultBufSize))
+			}
+			writer := protocol.NewResponseWriter(remoteWriter, remoteConn, l.ZeroCopyMin)
+
+			if l.ProxyProtocol {
+				// The header comes first, so a client that doesn't send one is cut off quickly
+				remoteConn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+				addr, err := readProxyHeader(remoteReader)
+				if err != nil {
+					log.Printf("Error reading PROXY header from %v: %v\n", remoteConn.RemoteAddr(), err.Error())
+					metrics.IncCounter(MetricProxyHeaderErrors)
+					abort([]io.Closer{remoteConn}, nil)
+					return
+				}
+				remoteConn.SetReadDeadline(time.Time{})
+				metrics.IncCounter(MetricProxyHeaders)
+				if addr != nil {
+					remoteConn = proxiedConn{Conn: remoteConn, remote: addr}
+				}
+			}
+
+			if !clientAllowed(l.AllowedClients, remoteConn.RemoteAddr()) {
+				log.Println("Rejecting connection from disallowed client", remoteConn.RemoteAddr())
+				metrics.IncCounter(MetricConnectionsRejectedACL)
+				abort([]io.Closer{remoteConn}, nil)
+				return
+			}
+
+			// construct L1 handler using given constructor
+			l1, err := h1()
+			if err != nil {
+				log.Println("Error opening connection to L1:", err.Error())
+				remoteConn.Close()
+				return
+			}
+			metrics.IncCounter(MetricConnectionsEstablishedL1)
+
+			// construct l2
+			l2, err := h2()
+			if err != nil {
+				log.Println("Error opening connection to L2:", err.Error())
+				l1.Close()
+				remoteConn.Close()
+				return
+			}
+			metrics.IncCounter(MetricConnectionsEstablishedL2)
 
 			var reqParser protocol.RequestParser
 			var responder protocol.Responder
 			var matched bool
+			var protoName string
 
 			peeker := protocol.Peeker(remoteReader)
 
+			// Reject clients speaking something that is clearly not memcached before any of the
+			// protocols get a chance to misinterpret the bytes.
+			foreign, err := sniffForeign(peeker)
+			if err != nil {
+				abort([]io.Closer{remoteConn, l1, l2}, err)
+				if err == io.EOF {
+					metrics.IncCounter(MetricProtocolsAssignedErrorEOF)
+				} else {
+					metrics.IncCounter(MetricProtocolsAssignedError)
+				}
+				return
+			}
+			if foreign != foreignNone {
+				log.Printf("Rejecting %v connection from %v\n", foreign, remoteConn.RemoteAddr())
+				switch foreign {
+				case foreignRESP:
+					metrics.IncCounter(MetricProtocolsRejectedRESP)
+				case foreignHTTP:
+					metrics.IncCounter(MetricProtocolsRejectedHTTP)
+				case foreignTLS:
+					metrics.IncCounter(MetricProtocolsRejectedTLS)
+				}
+				rejectForeign(remoteWriter, foreign)
+				abort([]io.Closer{remoteConn, l1, l2}, nil)
+				return
+			}
+
 			for _, p := range ps {
 				match, err := p.NewDisambiguator(peeker).CanParse()
 
@@ -137,7 +247,8 @@ func ListenAndServe(l ListenArgs, ps []protocol.Components, s ServerConst, o orc
 
 				if match {
 					reqParser = p.NewRequestParser(remoteReader)
-					responder = p.NewResponder(remoteWriter)
+					responder = protocol.NewResponderTo(p, writer)
+					protoName = protocol.Name(p)
 					matched = true
 				}
 			}
@@ -146,15 +257,66 @@ func ListenAndServe(l ListenArgs, ps []protocol.Components, s ServerConst, o orc
 			if !matched {
 				p := ps[len(ps)-1]
 				reqParser = p.NewRequestParser(remoteReader)
-				responder = p.NewResponder(remoteWriter)
+				responder = protocol.NewResponderTo(p, writer)
+				protoName = protocol.Name(p)
 				metrics.IncCounter(MetricProtocolsAssignedFallback)
 			}
 
+			if !protocolAllowed(l.Protocols, protoName) {
+				log.Printf("Rejecting %s connection from %v on a listener restricted to %v\n", protoName, remoteConn.RemoteAddr(), l.Protocols)
+				metrics.IncCounter(MetricProtocolsRejectedRestricted)
+				responder.Error(0, common.RequestUnknown, restrictedError(l.Protocols), false)
+				abort([]io.Closer{remoteConn, l1, l2}, nil)
+				return
+			}
+
 			metrics.IncCounter(MetricProtocolsAssigned)
+			deadlines, _ := reqParser.(protocol.DeadlineParser)
+
+			if len(l.Observers) > 0 {
+				reqParser = observingParser{RequestParser: reqParser, observers: l.Observers}
+			}
+
+			if l.Capture != nil {
+				reqParser = l.Capture.Wrap(reqParser)
+			}
+
+			if adaptive != nil {
+				reqParser = adaptiveParser{RequestParser: reqParser, a: adaptive}
+				responder = adaptiveResponder{Responder: responder, a: adaptive}
+			}
+
+			info := trackConn(addrString(remoteConn.RemoteAddr()), addrString(remoteConn.LocalAddr()), protoName)
+			reqParser = connParser{RequestParser: reqParser, info: info}
+
+			id := new(common.RequestID)
+			trace := new(requestTrace)
+			reqParser = &requestIDParser{
+				RequestParser: reqParser,
+				id:            id,
+				deadlines:     deadlines,
+				slow:          l.SlowRequestThreshold,
+				timing:        timing,
+				sampleEvery:   l.TimingSampleInterval,
+				conn:          info,
+				trace:         trace,
+			}
+			if l.EchoRequestIDs {
+				responder = requestIDResponder{Responder: responder, id: id}
+			}
+			responder = traceResponder{Responder: responder, t: trace}
+
+			orca, cancel := connOrca(o, l1, l2, responder, id, timing)
+			server := s([]io.Closer{remoteConn, l1, l2, cancel, info}, reqParser, orca)
 
-			server := s([]io.Closer{remoteConn, l1, l2}, reqParser, o(l1, l2, responder))
+			logging.Debugf("Opened %s connection from %v\n", protoName, remoteConn.RemoteAddr())
 
-			go server.Loop()
+			lease := loopLeases.Start()
+			go func() {
+				defer lease.Done()
+				server.Loop()
+				logging.Debugf("Closed %s connection from %v\n", protoName, remoteConn.RemoteAddr())
+			}()
 		}(remote)
 	}
 }
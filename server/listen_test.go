@@ -0,0 +1,75 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/handlers"
+)
+
+func TestAcceptProxied(t *testing.T) {
+	prev := proxyHeaderTimeout
+	proxyHeaderTimeout = 50 * time.Millisecond
+	defer func() { proxyHeaderTimeout = prev }()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dials int32
+	hc := func() (handlers.Handler, error) {
+		atomic.AddInt32(&dials, 1)
+		return nil, io.EOF
+	}
+
+	_, n, _ := net.ParseCIDR("10.0.0.0/8")
+	l := ListenArgs{Type: ListenTCP, ProxyProtocol: true, AllowedClients: []*net.IPNet{n}}
+	go accept(l, listener, nil, nil, nil, hc, hc)
+
+	// closed waits for the server to close a connection after sending it a header
+	closed := func(t *testing.T, header string) {
+		t.Helper()
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		if _, err := io.WriteString(conn, header); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("Expected the connection to be closed, got %v", err)
+		}
+	}
+
+	t.Run("Disallowed", func(t *testing.T) {
+		closed(t, "PROXY TCP4 192.168.0.1 10.0.0.1 54321 11211\r\n")
+	})
+	t.Run("NoHeader", func(t *testing.T) {
+		closed(t, "")
+	})
+
+	if d := atomic.LoadInt32(&dials); d != 0 {
+		t.Fatalf("Expected no backend connections for rejected clients, got %d", d)
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Support for the HAProxy PROXY protocol, versions 1 and 2, as described in
+// http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+//
+// When enabled on a listener, every connection must start with a PROXY header. The address in the
+// header replaces the remote address of the connection, so logging and client ACLs see the real
+// client instead of the load balancer in front of rend.
+
+var (
+	ErrProxyHeaderMissing = errors.New("PROXY protocol header missing")
+	ErrProxyHeaderInvalid = errors.New("PROXY protocol header invalid")
+)
+
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyV1Prefix = "PROXY "
+	// The longest possible v1 header, including the CRLF
+	proxyV1MaxLen = 107
+
+	proxyV2CmdLocal = 0x0
+	proxyV2CmdProxy = 0x1
+
+	proxyV2FamTCP4 = 0x11
+	proxyV2FamUDP4 = 0x12
+	proxyV2FamTCP6 = 0x21
+	proxyV2FamUDP6 = 0x22
+)
+
+// proxyHeaderTimeout is how long a client has to send its PROXY header after connecting
+var proxyHeaderTimeout = 5 * time.Second
+
+// proxiedConn is a net.Conn whose remote address came from a PROXY header
+type proxiedConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (p proxiedConn) RemoteAddr() net.Addr {
+	return p.remote
+}
+
+// readProxyHeader consumes a PROXY header from the start of the connection. The returned address
+// is nil if the header is valid but carries no address, e.g. for health checks from the proxy
+// itself, in which case the connection's own remote address should be used.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	buf, err := r.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, err
+	}
+
+	if string(buf) == proxyV1Prefix {
+		return readProxyV1(r)
+	}
+
+	buf, err = r.Peek(len(proxyV2Sig))
+	if err != nil {
+		if err == io.EOF {
+			return nil, ErrProxyHeaderMissing
+		}
+		return nil, err
+	}
+
+	if bytes.Equal(buf, proxyV2Sig) {
+		return readProxyV2(r)
+	}
+
+	return nil, ErrProxyHeaderMissing
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	// ReadSlice would be cleaner but the limit has to be enforced to avoid reading arbitrary
+	// amounts of data from a client that never sends a newline.
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrProxyHeaderInvalid
+	}
+
+	parts := strings.Split(string(line[:len(line)-2]), " ")
+
+	if len(parts) >= 2 && parts[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(parts) != 6 || (parts[1] != "TCP4" && parts[1] != "TCP6") {
+		return nil, ErrProxyHeaderInvalid
+	}
+
+	ip := net.ParseIP(parts[2])
+	if ip == nil {
+		return nil, ErrProxyHeaderInvalid
+	}
+	if (parts[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, ErrProxyHeaderInvalid
+	}
+
+	port, err := strconv.ParseUint(parts[4], 10, 16)
+	if err != nil {
+		return nil, ErrProxyHeaderInvalid
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	if hdr[12]>>4 != 2 {
+		return nil, ErrProxyHeaderInvalid
+	}
+
+	cmd := hdr[12] & 0x0F
+	fam := hdr[13]
+	length := int(binary.BigEndian.Uint16(hdr[14:]))
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch cmd {
+	case proxyV2CmdLocal:
+		return nil, nil
+	case proxyV2CmdProxy:
+	default:
+		return nil, ErrProxyHeaderInvalid
+	}
+
+	// Anything after the addresses is TLVs, which are ignored
+	switch fam {
+	case proxyV2FamTCP4, proxyV2FamUDP4:
+		if length < 12 {
+			return nil, ErrProxyHeaderInvalid
+		}
+		ip := net.IP(append([]byte(nil), body[0:4]...))
+		port := int(binary.BigEndian.Uint16(body[8:10]))
+		if fam == proxyV2FamUDP4 {
+			return &net.UDPAddr{IP: ip, Port: port}, nil
+		}
+		return &net.TCPAddr{IP: ip, Port: port}, nil
+
+	case proxyV2FamTCP6, proxyV2FamUDP6:
+		if length < 36 {
+			return nil, ErrProxyHeaderInvalid
+		}
+		ip := net.IP(append([]byte(nil), body[0:16]...))
+		port := int(binary.BigEndian.Uint16(body[32:34]))
+		if fam == proxyV2FamUDP6 {
+			return &net.UDPAddr{IP: ip, Port: port}, nil
+		}
+		return &net.TCPAddr{IP: ip, Port: port}, nil
+	}
+
+	// Unix sockets and unspecified families carry no usable client address
+	return nil, nil
+}
+
+// clientAllowed reports whether the given remote address is inside one of the allowed networks.
+// An empty list allows everything.
+func clientAllowed(allowed []*net.IPNet, addr net.Addr) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	case nil:
+		// nothing is known about the client
+		return false
+	default:
+		// unix domain sockets and the like are local by definition
+		return true
+	}
+
+	for _, n := range allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
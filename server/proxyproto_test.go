@@ -0,0 +1,87 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := "\r\n\r\n\x00\r\nQUIT\n" +
+		"\x21\x11\x00\x0c" + // PROXY, TCP4, 12 bytes
+		"\x0a\x00\x00\x01" + "\x0a\x00\x00\x02" + // 10.0.0.1 -> 10.0.0.2
+		"\x30\x39" + "\x2b\xcb" // 12345 -> 11211
+
+	tests := []struct {
+		name    string
+		input   string
+		addr    string
+		wantErr error
+	}{
+		{"V1TCP4", "PROXY TCP4 192.168.0.1 192.168.0.11 56324 11211\r\nget foo\r\n", "192.168.0.1:56324", nil},
+		{"V1TCP6", "PROXY TCP6 ::1 ::1 56324 11211\r\nget foo\r\n", "[::1]:56324", nil},
+		{"V1Unknown", "PROXY UNKNOWN\r\nget foo\r\n", "", nil},
+		{"V1FamilyMismatch", "PROXY TCP6 192.168.0.1 192.168.0.11 56324 11211\r\nget foo\r\n", "", ErrProxyHeaderInvalid},
+		{"V1NoCRLF", "PROXY TCP4 192.168.0.1 192.168.0.11 56324 11211\nget foo\r\n", "", ErrProxyHeaderInvalid},
+		{"V2TCP4", v2 + "get foo\r\n", "10.0.0.1:12345", nil},
+		{"V2Local", "\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00get foo\r\n", "", nil},
+		{"Missing", "get foo bar baz\r\n", "", ErrProxyHeaderMissing},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.input))
+			addr, err := readProxyHeader(r)
+			if err != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if err != nil {
+				return
+			}
+
+			if tt.addr == "" {
+				if addr != nil {
+					t.Fatalf("Expected no address, got %v", addr)
+				}
+			} else if addr == nil || addr.String() != tt.addr {
+				t.Fatalf("Expected address %s, got %v", tt.addr, addr)
+			}
+
+			// the request after the header must be untouched
+			rest, _ := r.ReadString('\n')
+			if rest != "get foo\r\n" {
+				t.Fatalf("Expected the request to follow the header, got %q", rest)
+			}
+		})
+	}
+}
+
+func TestClientAllowed(t *testing.T) {
+	_, n, _ := net.ParseCIDR("10.0.0.0/8")
+	allowed := []*net.IPNet{n}
+
+	if !clientAllowed(nil, &net.TCPAddr{IP: net.ParseIP("192.168.0.1")}) {
+		t.Fatalf("An empty list should allow everything")
+	}
+	if !clientAllowed(allowed, &net.TCPAddr{IP: net.ParseIP("10.1.2.3")}) {
+		t.Fatalf("Expected 10.1.2.3 to be allowed")
+	}
+	if clientAllowed(allowed, &net.TCPAddr{IP: net.ParseIP("192.168.0.1")}) {
+		t.Fatalf("Expected 192.168.0.1 to be rejected")
+	}
+}
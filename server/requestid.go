@@ -0,0 +1,216 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/logging"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/protocol"
+	"github.com/netflix/rend/timer"
+)
+
+var (
+	MetricSlowRequests    = metrics.AddCounter("slow_requests", nil)
+	MetricTimedRequests   = metrics.AddCounter("timed_requests", nil)
+	MetricSampledRequests = metrics.AddCounter("access_log_requests", nil)
+)
+
+// requestIDParser gives every request parsed from a connection a new ID. The ID is shared with the
+// context of the connection's orchestrator, so everything serving the request can see it.
+//
+// It also passes on the deadline hints of the protocol's parser, since the server only sees the
+// outermost of the parsers wrapping it.
+//
+// If slow is set, requests that take at least that long are logged along with their ID. The server
+// only parses the next request once the previous one has been answered, so the time from the
+// start of one request to the next call to Parse is how long it took. A threshold set at runtime
+// with the logging package replaces it.
+//
+// If timing is set, one in sampleEvery requests is timed with it and logged the same way, with
+// the time it spent in each phase. Requests sampled for the access log, see
+// logging.SampleAccess, are logged the same way too. All of these are logged at logging.LevelInfo.
+//
+// Requests matching a running logging.Trace are always timed, and logged whatever the level along
+// with the connection they came from, all of their keys, and what the responses to them were.
+type requestIDParser struct {
+	protocol.RequestParser
+	id          *common.RequestID
+	deadlines   protocol.DeadlineParser
+	slow        time.Duration
+	timing      *common.Timing
+	sampleEvery int
+	conn        *connInfo
+	trace       *requestTrace
+
+	last        common.Request
+	lastType    common.RequestType
+	lastStart   uint64
+	lastSampled bool
+}
+
+func (p *requestIDParser) Parse() (common.Request, common.RequestType, uint64, error) {
+	if p.last != nil {
+		if trace, events := p.trace.end(); trace != 0 {
+			logging.Tracef(trace, "Request %v on conn %d from %s: %s took %v answered with [%s] %v\n", *p.id, p.conn.id, p.conn.remote,
+				describeTrace(p.last, p.lastType), time.Duration(timer.Since(p.lastStart)), strings.Join(events, ", "), p.timing.Finish())
+		} else if p.timing.Active() {
+			metrics.IncCounter(MetricTimedRequests)
+			logging.Infof("Request timing %v: %s %v\n", *p.id, describeRequest(p.last, p.lastType), p.timing.Finish())
+		}
+
+		slow := p.slow
+		if s := logging.SlowRequests(); s > 0 {
+			slow = s
+		}
+		if dur := time.Duration(timer.Since(p.lastStart)); slow > 0 && dur >= slow {
+			metrics.IncCounter(MetricSlowRequests)
+			logging.Infof("Slow request %v: %s took %v\n", *p.id, describeRequest(p.last, p.lastType), dur)
+		} else if p.lastSampled {
+			metrics.IncCounter(MetricSampledRequests)
+			logging.Infof("Request %v: %s took %v\n", *p.id, describeRequest(p.last, p.lastType), dur)
+		}
+		p.last = nil
+	}
+
+	req, reqType, start, err := p.RequestParser.Parse()
+	*p.id = common.NewRequestID()
+
+	// every request is kept since the logging settings can change before it's answered
+	if err == nil {
+		p.last, p.lastType, p.lastStart = req, reqType, start
+		p.lastSampled = logging.SampleAccess()
+	}
+	var trace uint64
+	if err == nil && logging.Tracing() {
+		_, keys := requestOp(req, reqType)
+		trace = logging.MatchTrace(p.conn.id, p.conn.remote, keys)
+	}
+	if trace != 0 {
+		p.trace.begin(trace)
+	}
+	if err == nil && (trace != 0 || p.sampleEvery > 0 && sampleTiming(p.sampleEvery)) {
+		p.timing.Start(start)
+		p.timing.Enter(common.PhaseOther)
+	}
+	return req, reqType, start, err
+}
+
+func (p *requestIDParser) Deadline() time.Duration {
+	if p.deadlines == nil {
+		return 0
+	}
+	return p.deadlines.Deadline()
+}
+
+// describeRequest summarizes a request for a log line as its command and first key
+func describeRequest(req common.Request, reqType common.RequestType) string {
+	op, keys := requestOp(req, reqType)
+
+	switch len(keys) {
+	case 0:
+		return op
+	case 1:
+		return op + " " + strconv.Quote(logging.Key(keys[0]))
+	}
+	return op + " " + strconv.Quote(logging.Key(keys[0])) + " and " + strconv.Itoa(len(keys)-1) + " more keys"
+}
+
+// requestOp returns the command of a request and every key in it
+func requestOp(req common.Request, reqType common.RequestType) (op string, keys [][]byte) {
+	switch reqType {
+	case common.RequestGet, common.RequestGetE, common.RequestGets:
+		op, keys = "get", req.(common.GetRequest).Keys
+		switch reqType {
+		case common.RequestGetE:
+			op = "gete"
+		case common.RequestGets:
+			op = "gets"
+		}
+	case common.RequestGat:
+		op, keys = "gat", [][]byte{req.(common.GATRequest).Key}
+	case common.RequestSet, common.RequestAdd, common.RequestReplace, common.RequestAppend, common.RequestPrepend:
+		op, keys = setOpName(reqType), [][]byte{req.(common.SetRequest).Key}
+	case common.RequestSetIfMatch:
+		op, keys = "setif", [][]byte{req.(common.SetIfMatchRequest).Key}
+	case common.RequestCAS:
+		op, keys = "cas", [][]byte{req.(common.CASRequest).Key}
+	case common.RequestMultiSet:
+		op = "multiset"
+		for _, set := range req.(common.MultiSetRequest).Sets {
+			keys = append(keys, set.Key)
+		}
+	case common.RequestDelete:
+		op, keys = "delete", [][]byte{req.(common.DeleteRequest).Key}
+	case common.RequestMultiDelete:
+		op = "multidelete"
+		for _, del := range req.(common.MultiDeleteRequest).Deletes {
+			keys = append(keys, del.Key)
+		}
+	case common.RequestTouch:
+		op, keys = "touch", [][]byte{req.(common.TouchRequest).Key}
+	case common.RequestIncr:
+		op, keys = "incr", [][]byte{req.(common.ArithRequest).Key}
+	case common.RequestDecr:
+		op, keys = "decr", [][]byte{req.(common.ArithRequest).Key}
+	case common.RequestFlush:
+		op = "flush"
+	case common.RequestGetLock:
+		op, keys = "getl", [][]byte{req.(common.GetLockRequest).Key}
+	case common.RequestUnlock:
+		op, keys = "unl", [][]byte{req.(common.UnlockRequest).Key}
+	case common.RequestNoop:
+		op = "noop"
+	case common.RequestQuit:
+		op = "quit"
+	case common.RequestVersion:
+		op = "version"
+	case common.RequestStats:
+		op = "stats"
+	default:
+		op = "unknown"
+	}
+
+	return op, keys
+}
+
+func setOpName(reqType common.RequestType) string {
+	switch reqType {
+	case common.RequestAdd:
+		return "add"
+	case common.RequestReplace:
+		return "replace"
+	case common.RequestAppend:
+		return "append"
+	case common.RequestPrepend:
+		return "prepend"
+	}
+	return "set"
+}
+
+// requestIDResponder attaches the ID of the current request to every error sent to the client, so
+// the protocol can echo it back
+type requestIDResponder struct {
+	protocol.Responder
+	id *common.RequestID
+}
+
+func (r requestIDResponder) Error(opaque uint32, reqType common.RequestType, err error, quiet bool) error {
+	return r.Responder.Error(opaque, reqType, common.TagRequestID(err, *r.id), quiet)
+}
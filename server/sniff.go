@@ -0,0 +1,164 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/protocol"
+)
+
+// foreignProtocol identifies a protocol that a misdirected client is speaking. None of them can be
+// served, but recognizing them lets the connection be rejected with an error the client can
+// understand instead of a confusing parse error from one of the memcached protocols.
+type foreignProtocol int
+
+const (
+	foreignNone foreignProtocol = iota
+	foreignRESP
+	foreignHTTP
+	foreignTLS
+)
+
+func (f foreignProtocol) String() string {
+	switch f {
+	case foreignRESP:
+		return "RESP"
+	case foreignHTTP:
+		return "HTTP"
+	case foreignTLS:
+		return "TLS"
+	}
+	return "none"
+}
+
+var httpMethods = [][]byte{
+	[]byte("GET "),
+	[]byte("HEAD "),
+	[]byte("POST "),
+	[]byte("PUT "),
+	[]byte("DELETE "),
+	[]byte("OPTIONS "),
+	[]byte("CONNECT "),
+	[]byte("TRACE "),
+	[]byte("PATCH "),
+}
+
+const (
+	tlsRecordHandshake = 0x16
+	tlsMajorVersion    = 0x03
+)
+
+// sniffForeign peeks at the start of the connection to see if the client is speaking one of the
+// protocols that might reasonably be pointed at the wrong port. The memcached text protocol only
+// uses lower case commands and the binary protocol always starts with the request magic, so none
+// of the patterns here can collide with a valid memcached request.
+func sniffForeign(p protocol.Peeker) (foreignProtocol, error) {
+	first, err := p.Peek(1)
+	if err != nil {
+		return foreignNone, err
+	}
+
+	switch {
+	case first[0] == '*':
+		// RESP arrays are the only way redis clients send commands, e.g. *1\r\n$4\r\nPING\r\n
+		buf, err := p.Peek(2)
+		if err != nil && err != io.EOF {
+			return foreignNone, err
+		}
+		if len(buf) == 2 && buf[1] >= '0' && buf[1] <= '9' {
+			return foreignRESP, nil
+		}
+
+	case first[0] == tlsRecordHandshake:
+		buf, err := p.Peek(3)
+		if err != nil && err != io.EOF {
+			return foreignNone, err
+		}
+		if len(buf) == 3 && buf[1] == tlsMajorVersion {
+			return foreignTLS, nil
+		}
+
+	case first[0] >= 'A' && first[0] <= 'Z':
+		for _, m := range httpMethods {
+			if m[0] != first[0] {
+				continue
+			}
+			// Peek returns whatever it could along with an error if the full length isn't
+			// available, so a short read here is just a mismatch.
+			buf, _ := p.Peek(len(m))
+			if bytes.Equal(buf, m) {
+				return foreignHTTP, nil
+			}
+		}
+	}
+
+	return foreignNone, nil
+}
+
+// rejectForeign writes a protocol-appropriate error to the client explaining that this is a
+// memcached endpoint. The connection is expected to be closed afterward.
+func rejectForeign(w *bufio.Writer, f foreignProtocol) error {
+	switch f {
+	case foreignRESP:
+		w.WriteString("-ERR this is a memcached endpoint, the redis protocol is not supported\r\n")
+
+	case foreignHTTP:
+		body := "This is a memcached endpoint. HTTP is not supported on this port.\n"
+		w.WriteString("HTTP/1.1 400 Bad Request\r\n")
+		w.WriteString("Content-Type: text/plain\r\n")
+		w.WriteString("Connection: close\r\n")
+		w.WriteString("Content-Length: ")
+		w.WriteString(strconv.Itoa(len(body)))
+		w.WriteString("\r\n\r\n")
+		w.WriteString(body)
+
+	case foreignTLS:
+		// A fatal handshake_failure alert. The record version is TLS 1.0, which every TLS client
+		// will accept in an alert sent before the version is negotiated.
+		w.Write([]byte{0x15, 0x03, 0x01, 0x00, 0x02, 0x02, 0x28})
+	}
+
+	return w.Flush()
+}
+
+// protocolAllowed returns whether a listener restricted to the given protocols, by name, serves
+// the named protocol. An empty list serves every protocol.
+func protocolAllowed(allowed []string, name string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, a := range allowed {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+// restrictedError is what a client speaking a protocol the listener doesn't serve is told before
+// the connection is closed. The binary protocol only sees the status, which is not supported.
+func restrictedError(allowed []string) error {
+	return &common.Error{
+		Class:   common.ClassClient,
+		Status:  0x83,
+		Message: "CLIENT_ERROR this port only serves the " + strings.Join(allowed, " and ") + " protocol",
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/protocol/textprot"
+)
+
+func TestSniffForeign(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  foreignProtocol
+	}{
+		{"TextGet", "get foo\r\n", foreignNone},
+		{"TextShort", "g", foreignNone},
+		{"Binary", "\x80\x00\x00\x03foo", foreignNone},
+		{"RESP", "*1\r\n$4\r\nPING\r\n", foreignRESP},
+		{"RESPStarOnly", "*", foreignNone},
+		{"HTTPGet", "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", foreignHTTP},
+		{"HTTPOptions", "OPTIONS * HTTP/1.1\r\n\r\n", foreignHTTP},
+		{"UpperNotHTTP", "GETS foo\r\n", foreignNone},
+		{"TLS", "\x16\x03\x01\x02\x00\x01", foreignTLS},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.input))
+			got, err := sniffForeign(r)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("Expected %v, got %v", tt.want, got)
+			}
+
+			// sniffing must not consume any input
+			if r.Buffered() != len(tt.input) {
+				t.Fatalf("Expected %d bytes to remain buffered, got %d", len(tt.input), r.Buffered())
+			}
+		})
+	}
+}
+
+func TestRejectForeignHTTP(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := rejectForeign(bufio.NewWriter(buf), foreignHTTP); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(buf.String(), "HTTP/1.1 400 Bad Request\r\n") {
+		t.Fatalf("Expected an HTTP 400 response, got %q", buf.String())
+	}
+}
+
+func TestRejectRestricted(t *testing.T) {
+	if !protocolAllowed(nil, "text") {
+		t.Fatalf("Expected an unrestricted listener to serve text")
+	}
+	if protocolAllowed([]string{"binary"}, "text") {
+		t.Fatalf("Expected a binary only listener to reject text")
+	}
+
+	buf := &bytes.Buffer{}
+	w := bufio.NewWriter(buf)
+	if err := textprot.NewTextResponder(w).Error(0, common.RequestUnknown, restrictedError([]string{"binary"}), false); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if buf.String() != "CLIENT_ERROR this port only serves the binary protocol\r\n" {
+		t.Fatalf("Unexpected rejection %q", buf.String())
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/netflix/rend/common"
+)
+
+// requests seen by sampleTiming across every connection
+var timingSampleCount uint64
+
+// sampleTiming reports whether the next request should be timed, for one in every n requests
+func sampleTiming(n int) bool {
+	return atomic.AddUint64(&timingSampleCount, 1)%uint64(n) == 0
+}
+
+// timedConn accounts the time spent writing to the client to the respond phase of a timed request.
+// The responders flush after every response, so this is where their time goes.
+type timedConn struct {
+	net.Conn
+	t *common.Timing
+}
+
+func (c timedConn) Write(b []byte) (int, error) {
+	prev := c.t.Enter(common.PhaseRespond)
+	defer c.t.Enter(prev)
+	return c.Conn.Write(b)
+}
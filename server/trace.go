@@ -0,0 +1,180 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/logging"
+	"github.com/netflix/rend/protocol"
+)
+
+// requestTrace collects what happens to the request a connection is serving while it's traced,
+// see logging.Trace. The responses can be written from more than one goroutine, e.g. for the keys
+// of a batch get, so the events are locked.
+type requestTrace struct {
+	// id is the ID of the trace the current request matched, or 0 if it isn't traced
+	id uint64
+
+	lock   sync.Mutex
+	events []string
+}
+
+func (t *requestTrace) begin(id uint64) {
+	t.lock.Lock()
+	t.events = t.events[:0]
+	t.lock.Unlock()
+	atomic.StoreUint64(&t.id, id)
+}
+
+// add records an event if the request is traced
+func (t *requestTrace) add(format string, args ...interface{}) {
+	if atomic.LoadUint64(&t.id) == 0 {
+		return
+	}
+
+	e := fmt.Sprintf(format, args...)
+	t.lock.Lock()
+	t.events = append(t.events, e)
+	t.lock.Unlock()
+}
+
+// end stops tracing the request and returns the trace it matched along with what happened to it
+func (t *requestTrace) end() (uint64, []string) {
+	id := atomic.SwapUint64(&t.id, 0)
+	if id == 0 {
+		return 0, nil
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return id, append([]string(nil), t.events...)
+}
+
+// describeTrace describes a traced request with all of its keys
+func describeTrace(req common.Request, reqType common.RequestType) string {
+	op, keys := requestOp(req, reqType)
+
+	quoted := make([]string, 0, len(keys)+1)
+	quoted = append(quoted, op)
+	for _, k := range keys {
+		quoted = append(quoted, strconv.Quote(logging.Key(k)))
+	}
+	return strings.Join(quoted, " ")
+}
+
+// traceResponder records the responses to traced requests
+type traceResponder struct {
+	protocol.Responder
+	t *requestTrace
+}
+
+func (r traceResponder) hit(key []byte, flags uint32, data []byte, miss bool) {
+	if miss {
+		r.t.add("miss %q", logging.Key(key))
+		return
+	}
+	r.t.add("hit %q flags=%d bytes=%d", logging.Key(key), flags, len(data))
+}
+
+func (r traceResponder) Set(opaque uint32, quiet bool) error {
+	r.t.add("stored")
+	return r.Responder.Set(opaque, quiet)
+}
+
+func (r traceResponder) Add(opaque uint32, quiet bool) error {
+	r.t.add("stored")
+	return r.Responder.Add(opaque, quiet)
+}
+
+func (r traceResponder) Replace(opaque uint32, quiet bool) error {
+	r.t.add("stored")
+	return r.Responder.Replace(opaque, quiet)
+}
+
+func (r traceResponder) Append(opaque uint32, quiet bool) error {
+	r.t.add("stored")
+	return r.Responder.Append(opaque, quiet)
+}
+
+func (r traceResponder) Prepend(opaque uint32, quiet bool) error {
+	r.t.add("stored")
+	return r.Responder.Prepend(opaque, quiet)
+}
+
+func (r traceResponder) SetIfMatch(opaque uint32, quiet bool) error {
+	r.t.add("stored")
+	return r.Responder.SetIfMatch(opaque, quiet)
+}
+
+func (r traceResponder) CompareAndSwap(opaque uint32, quiet bool) error {
+	r.t.add("stored")
+	return r.Responder.CompareAndSwap(opaque, quiet)
+}
+
+func (r traceResponder) Get(response common.GetResponse) error {
+	r.hit(response.Key, response.Flags, response.Data, response.Miss)
+	return r.Responder.Get(response)
+}
+
+func (r traceResponder) GetE(response common.GetEResponse) error {
+	r.hit(response.Key, response.Flags, response.Data, response.Miss)
+	return r.Responder.GetE(response)
+}
+
+func (r traceResponder) Gets(response common.GetResponse) error {
+	r.hit(response.Key, response.Flags, response.Data, response.Miss)
+	return r.Responder.Gets(response)
+}
+
+func (r traceResponder) GAT(response common.GetResponse) error {
+	r.hit(response.Key, response.Flags, response.Data, response.Miss)
+	return r.Responder.GAT(response)
+}
+
+func (r traceResponder) GetLock(response common.GetLockResponse) error {
+	r.hit(response.Key, response.Flags, response.Data, false)
+	return r.Responder.GetLock(response)
+}
+
+func (r traceResponder) Delete(opaque uint32, quiet bool) error {
+	r.t.add("deleted")
+	return r.Responder.Delete(opaque, quiet)
+}
+
+func (r traceResponder) Touch(opaque uint32, quiet bool) error {
+	r.t.add("touched")
+	return r.Responder.Touch(opaque, quiet)
+}
+
+func (r traceResponder) Incr(opaque uint32, quiet bool, value uint64) error {
+	r.t.add("value %d", value)
+	return r.Responder.Incr(opaque, quiet, value)
+}
+
+func (r traceResponder) Decr(opaque uint32, quiet bool, value uint64) error {
+	r.t.add("value %d", value)
+	return r.Responder.Decr(opaque, quiet, value)
+}
+
+func (r traceResponder) Error(opaque uint32, reqType common.RequestType, err error, quiet bool) error {
+	r.t.add("error %q", err.Error())
+	return r.Responder.Error(opaque, reqType, err, quiet)
+}
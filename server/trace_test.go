@@ -0,0 +1,67 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/logging"
+	"github.com/netflix/rend/protocol/textprot"
+)
+
+func TestTraceRequests(t *testing.T) {
+	buf := new(bytes.Buffer)
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+
+	info := trackConn("tcp:10.0.0.1:54321", "tcp:0.0.0.0:11211", "text")
+	defer info.Close()
+
+	tr, err := logging.StartTrace("", strconv.FormatUint(info.id, 10), time.Minute, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logging.StopTrace(tr.ID, "test")
+
+	trace := new(requestTrace)
+	p := &requestIDParser{
+		RequestParser: oneRequestParser{common.GetRequest{Keys: [][]byte{[]byte("foo"), []byte("bar")}}, common.RequestGet},
+		id:            new(common.RequestID),
+		timing:        new(common.Timing),
+		conn:          info,
+		trace:         trace,
+	}
+	r := traceResponder{Responder: textprot.NewTextResponder(bufio.NewWriter(new(bytes.Buffer))), t: trace}
+
+	p.Parse()
+	r.Get(common.GetResponse{Key: []byte("foo"), Data: []byte("abc"), Flags: 3})
+	r.Get(common.GetResponse{Key: []byte("bar"), Miss: true})
+	p.Parse()
+
+	line := buf.String()
+	for _, want := range []string{"Trace " + strconv.FormatUint(tr.ID, 10) + ": ", "from tcp:10.0.0.1:54321", `get "foo" "bar"`, `[hit "foo" flags=3 bytes=3, miss "bar"]`, "l1="} {
+		if !strings.Contains(line, want) {
+			t.Fatalf("Expected %q in the trace, got %q", want, line)
+		}
+	}
+}
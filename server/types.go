@@ -16,7 +16,11 @@ package server
 
 import (
 	"io"
+	"net"
+	"time"
 
+	"github.com/netflix/rend/capture"
+	"github.com/netflix/rend/common"
 	"github.com/netflix/rend/metrics"
 	"github.com/netflix/rend/orcas"
 	"github.com/netflix/rend/protocol"
@@ -28,6 +32,13 @@ type Server interface {
 	Loop()
 }
 
+// RequestObserver is given every successfully parsed request before it is performed, e.g. to sample
+// keys for background processing. Observe is called on the connection's goroutine, so it must be
+// fast and must not modify the request.
+type RequestObserver interface {
+	Observe(req common.Request, reqType common.RequestType)
+}
+
 type ListenType int
 
 const (
@@ -42,45 +53,141 @@ type ListenArgs struct {
 	Port int
 	// Unix domain socket path to listen on, if applicable
 	Path string
+	// Sizes of the buffered reader and writer for each connection, in bytes. 0 means the default
+	// of 4k. When AdaptiveBuffers is set, these are the maximum sizes the buffers can grow to,
+	// with a default of 64k.
+	ReadBufSize  int
+	WriteBufSize int
+	// Start each connection with small buffers and resize them based on the sizes of the values
+	// being transferred
+	AdaptiveBuffers bool
+	// If set, parsed requests from every connection are sampled into this capture
+	Capture *capture.Recorder
+	// Observers are shown every request parsed from every connection
+	Observers []RequestObserver
+	// Number of TCP listening sockets to open on the same port using SO_REUSEPORT, each with its
+	// own accept loop. 0 or 1 means a single listener without SO_REUSEPORT.
+	Acceptors int
+	// Require a PROXY protocol (v1 or v2) header at the start of every connection and use the
+	// client address it carries as the connection's remote address
+	ProxyProtocol bool
+	// If not empty, only clients with addresses inside these networks are served. When
+	// ProxyProtocol is enabled this applies to the address from the PROXY header.
+	AllowedClients []*net.IPNet
+	// Requests that take at least this long are logged along with their request IDs. 0 means no
+	// requests are logged. A threshold set at runtime with the logging package replaces it.
+	SlowRequestThreshold time.Duration
+	// One in this many requests is timed phase by phase (parse, L1, L2, backfill, respond) and
+	// logged with its request ID. 0 means no requests are timed.
+	TimingSampleInterval int
+	// Send the request ID back to the client with every error response: at the end of the error
+	// line in the text protocol and in the CAS field of the response in the binary protocol
+	EchoRequestIDs bool
+	// How closely requests are held to the memcached protocol spec. Protocols that can't be strict
+	// are always lenient.
+	Strictness protocol.Strictness
+	// If set, binary requests for vbuckets outside this set get NOT_MY_VBUCKET instead of being
+	// served. Protocols without vbuckets serve everything.
+	VBuckets *protocol.VBuckets
+	// If not empty, only connections speaking these protocols, by the names protocol.Name gives
+	// them, are served. Others are sent an error in their own protocol and closed.
+	Protocols []string
+	// Quirks of memcached's that clients of this listener depend on, usually those of one of the
+	// protocol.Profiles. The zero value answers the way rend usually does.
+	Quirks protocol.Quirks
+	// Values of at least this many bytes are written to the client straight from the buffers they
+	// were read into, in one gathered write with the rest of their response, instead of being
+	// copied into the connection's write buffer. 0 copies every value.
+	ZeroCopyMin int
+}
+
+// WebSocketArgs restricts who may open connections to a WebSocketHandler
+type WebSocketArgs struct {
+	// Origins besides the server's own that browsers may connect from, as they send them in the
+	// Origin header, e.g. https://tools.example.com. "*" allows any origin. Requests without an
+	// Origin header don't come from a browser and are always allowed.
+	AllowedOrigins []string
+	// If not empty, only clients with addresses inside these networks are served, like
+	// ListenArgs.AllowedClients
+	AllowedClients []*net.IPNet
 }
 
 var (
-	MetricConnectionsEstablishedExt = metrics.AddCounter("conn_established_ext", nil)
-	MetricConnectionsEstablishedL1  = metrics.AddCounter("conn_established_l1", nil)
-	MetricConnectionsEstablishedL2  = metrics.AddCounter("conn_established_l2", nil)
-	MetricProtocolsAssigned         = metrics.AddCounter("protocols_assigned", nil)
-	MetricProtocolsAssignedError    = metrics.AddCounter("protocols_assigned_error", nil)
-	MetricProtocolsAssignedErrorEOF = metrics.AddCounter("protocols_assigned_error_eof", nil)
-	MetricProtocolsAssignedFallback = metrics.AddCounter("protocols_assigned_fallback", nil)
-	MetricCmdTotal                  = metrics.AddCounter("cmd_total", nil)
-	MetricErrAppError               = metrics.AddCounter("err_app_err", nil)
-	MetricErrUnrecoverable          = metrics.AddCounter("err_unrecoverable", nil)
+	MetricConnectionsEstablishedExt       = metrics.AddCounter("conn_established_ext", nil)
+	MetricConnectionsEstablishedL1        = metrics.AddCounter("conn_established_l1", nil)
+	MetricConnectionsEstablishedL2        = metrics.AddCounter("conn_established_l2", nil)
+	MetricConnectionsEstablishedWebSocket = metrics.AddCounter("conn_established_websocket", nil)
+	MetricProtocolsAssigned               = metrics.AddCounter("protocols_assigned", nil)
+	MetricProtocolsAssignedError          = metrics.AddCounter("protocols_assigned_error", nil)
+	MetricProtocolsAssignedErrorEOF       = metrics.AddCounter("protocols_assigned_error_eof", nil)
+	MetricProtocolsAssignedFallback       = metrics.AddCounter("protocols_assigned_fallback", nil)
+	MetricProtocolsRejectedRESP           = metrics.AddCounter("protocols_rejected_resp", nil)
+	MetricProtocolsRejectedHTTP           = metrics.AddCounter("protocols_rejected_http", nil)
+	MetricProtocolsRejectedTLS            = metrics.AddCounter("protocols_rejected_tls", nil)
+	MetricProtocolsRejectedRestricted     = metrics.AddCounter("protocols_rejected_restricted", nil)
+	MetricProxyHeaders                    = metrics.AddCounter("proxy_headers", nil)
+	MetricProxyHeaderErrors               = metrics.AddCounter("proxy_header_errors", nil)
+	MetricConnectionsRejectedACL          = metrics.AddCounter("conn_rejected_acl", nil)
+	MetricConnectionsRejectedOrigin       = metrics.AddCounter("conn_rejected_origin", nil)
+	MetricBufferResizes                   = metrics.AddCounter("conn_buffer_resizes", nil)
+	MetricCmdTotal                        = metrics.AddCounter("cmd_total", nil)
+	MetricErrAppError                     = metrics.AddCounter("err_app_err", nil)
+	MetricErrUnrecoverable                = metrics.AddCounter("err_unrecoverable", nil)
+	MetricCmdDeadlines                    = metrics.AddCounter("cmd_deadlines", nil)
+	MetricCmdDeadlinesExceeded            = metrics.AddCounter("cmd_deadlines_exceeded", nil)
 
-	MetricCmdGet     = metrics.AddCounter("cmd_get", nil)
-	MetricCmdGetE    = metrics.AddCounter("cmd_gete", nil)
-	MetricCmdSet     = metrics.AddCounter("cmd_set", nil)
-	MetricCmdAdd     = metrics.AddCounter("cmd_add", nil)
-	MetricCmdReplace = metrics.AddCounter("cmd_replace", nil)
-	MetricCmdAppend  = metrics.AddCounter("cmd_append", nil)
-	MetricCmdPrepend = metrics.AddCounter("cmd_prepend", nil)
-	MetricCmdDelete  = metrics.AddCounter("cmd_delete", nil)
-	MetricCmdTouch   = metrics.AddCounter("cmd_touch", nil)
-	MetricCmdGat     = metrics.AddCounter("cmd_gat", nil)
-	MetricCmdUnknown = metrics.AddCounter("cmd_unknown", nil)
-	MetricCmdNoop    = metrics.AddCounter("cmd_noop", nil)
-	MetricCmdQuit    = metrics.AddCounter("cmd_quit", nil)
-	MetricCmdVersion = metrics.AddCounter("cmd_version", nil)
+	MetricCmdGet             = metrics.AddCounter("cmd_get", nil)
+	MetricCmdGetE            = metrics.AddCounter("cmd_gete", nil)
+	MetricCmdGets            = metrics.AddCounter("cmd_gets", nil)
+	MetricCmdSet             = metrics.AddCounter("cmd_set", nil)
+	MetricCmdSetIfMatch      = metrics.AddCounter("cmd_setif", nil)
+	MetricCmdCAS             = metrics.AddCounter("cmd_cas", nil)
+	MetricCmdMultiSet        = metrics.AddCounter("cmd_multiset", nil)
+	MetricCmdMultiSetKeys    = metrics.AddCounter("cmd_multiset_keys", nil)
+	MetricCmdAdd             = metrics.AddCounter("cmd_add", nil)
+	MetricCmdReplace         = metrics.AddCounter("cmd_replace", nil)
+	MetricCmdAppend          = metrics.AddCounter("cmd_append", nil)
+	MetricCmdPrepend         = metrics.AddCounter("cmd_prepend", nil)
+	MetricCmdDelete          = metrics.AddCounter("cmd_delete", nil)
+	MetricCmdMultiDelete     = metrics.AddCounter("cmd_multidelete", nil)
+	MetricCmdMultiDeleteKeys = metrics.AddCounter("cmd_multidelete_keys", nil)
+	MetricCmdTouch           = metrics.AddCounter("cmd_touch", nil)
+	MetricCmdGat             = metrics.AddCounter("cmd_gat", nil)
+	MetricCmdGetLock         = metrics.AddCounter("cmd_getl", nil)
+	MetricCmdUnlock          = metrics.AddCounter("cmd_unlock", nil)
+	MetricCmdUnknown         = metrics.AddCounter("cmd_unknown", nil)
+	MetricCmdNoop            = metrics.AddCounter("cmd_noop", nil)
+	MetricCmdQuit            = metrics.AddCounter("cmd_quit", nil)
+	MetricCmdVersion         = metrics.AddCounter("cmd_version", nil)
+	MetricCmdStats           = metrics.AddCounter("cmd_stats", nil)
+	MetricCmdIncr            = metrics.AddCounter("cmd_incr", nil)
+	MetricCmdDecr            = metrics.AddCounter("cmd_decr", nil)
+	MetricCmdFlush           = metrics.AddCounter("cmd_flush", nil)
 
-	HistSet     = metrics.AddHistogram("set", false, nil)
-	HistAdd     = metrics.AddHistogram("add", false, nil)
-	HistReplace = metrics.AddHistogram("replace", false, nil)
-	HistAppend  = metrics.AddHistogram("append", false, nil)
-	HistPrepend = metrics.AddHistogram("prepend", false, nil)
-	HistDelete  = metrics.AddHistogram("delete", false, nil)
-	HistTouch   = metrics.AddHistogram("touch", false, nil)
-	HistGet     = metrics.AddHistogram("get", false, nil)  // not sampled until configurable
-	HistGetE    = metrics.AddHistogram("gete", false, nil) // not sampled until configurable
-	HistGat     = metrics.AddHistogram("gat", false, nil)  // not sampled until configurable
+	HistSet         = metrics.AddHistogram("set", false, nil)
+	HistSetIfMatch  = metrics.AddHistogram("setif", false, nil)
+	HistCAS         = metrics.AddHistogram("cas", false, nil)
+	HistMultiSet    = metrics.AddHistogram("multiset", false, nil)
+	HistAdd         = metrics.AddHistogram("add", false, nil)
+	HistReplace     = metrics.AddHistogram("replace", false, nil)
+	HistAppend      = metrics.AddHistogram("append", false, nil)
+	HistPrepend     = metrics.AddHistogram("prepend", false, nil)
+	HistDelete      = metrics.AddHistogram("delete", false, nil)
+	HistMultiDelete = metrics.AddHistogram("multidelete", false, nil)
+	HistTouch       = metrics.AddHistogram("touch", false, nil)
+	HistIncr        = metrics.AddHistogram("incr", false, nil)
+	HistDecr        = metrics.AddHistogram("decr", false, nil)
+	HistFlush       = metrics.AddHistogram("flush", false, nil)
+	HistGetLock     = metrics.AddHistogram("getl", false, nil)
+	HistUnlock      = metrics.AddHistogram("unlock", false, nil)
+	HistGet         = metrics.AddHistogram("get", false, nil)  // not sampled until configurable
+	HistGetE        = metrics.AddHistogram("gete", false, nil) // not sampled until configurable
+	HistGets        = metrics.AddHistogram("gets", false, nil) // not sampled until configurable
+	HistGat         = metrics.AddHistogram("gat", false, nil)  // not sampled until configurable
 
 	// TODO: inconsistency metrics for when L1 is not a subset of L2
 )
+
+func init() {
+	metrics.AddRate("cmd_rate", nil, MetricCmdTotal)
+}
@@ -20,6 +20,9 @@ import (
 	"log"
 	"runtime"
 	"strings"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/protocol"
 )
 
 func abort(toClose []io.Closer, err error) {
@@ -33,6 +36,14 @@ func abort(toClose []io.Closer, err error) {
 	}
 }
 
+// abortRequest is abort for an error that happened while serving the request with the given ID
+func abortRequest(toClose []io.Closer, id common.RequestID, err error) {
+	if err != nil && err != io.EOF {
+		log.Printf("Error while processing request %v. Closing connection. Error: %v\n", id, err)
+	}
+	abort(toClose, nil)
+}
+
 func identifyPanic() string {
 	var name, file string
 	var line int
@@ -53,3 +64,18 @@ func identifyPanic() string {
 
 	return fmt.Sprintf("Panic occured at: %v:%v (line %v)", file, name, line)
 }
+
+type observingParser struct {
+	protocol.RequestParser
+	observers []RequestObserver
+}
+
+func (o observingParser) Parse() (common.Request, common.RequestType, uint64, error) {
+	req, reqType, start, err := o.RequestParser.Parse()
+	if err == nil {
+		for _, obs := range o.observers {
+			obs.Observe(req, reqType)
+		}
+	}
+	return req, reqType, start, err
+}
@@ -0,0 +1,130 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol/websocket"
+)
+
+// WebSocketHandler returns an http.Handler that upgrades each request to a WebSocket connection
+// and serves the JSON protocol in the websocket package on it. Each connection gets its own set of
+// handlers and orchestrator, exactly like a connection accepted by ListenAndServe, so browser
+// based tools see the same view of the cache as regular clients.
+//
+// Browsers let any page open a WebSocket to any server, so connections from pages of other origins
+// than the server's own are refused unless they are in args.AllowedOrigins. Otherwise any site a
+// user visits could use the cache through their browser.
+func WebSocketHandler(args WebSocketArgs, s ServerConst, o orcas.OrcaConst, h1, h2 handlers.HandlerConst) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !clientAllowed(args.AllowedClients, remoteAddr(r)) {
+			log.Println("Rejecting WebSocket connection from disallowed client", r.RemoteAddr)
+			metrics.IncCounter(MetricConnectionsRejectedACL)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if !originAllowed(args.AllowedOrigins, r) {
+			log.Printf("Rejecting WebSocket connection from %v with disallowed origin %q\n", r.RemoteAddr, r.Header.Get("Origin"))
+			metrics.IncCounter(MetricConnectionsRejectedOrigin)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		conn, err := websocket.Upgrade(w, r)
+		if err != nil {
+			log.Println("Error upgrading WebSocket connection:", err.Error())
+			return
+		}
+		metrics.IncCounter(MetricConnectionsEstablishedExt)
+		metrics.IncCounter(MetricConnectionsEstablishedWebSocket)
+
+		l1, err := h1()
+		if err != nil {
+			log.Println("Error opening connection to L1:", err.Error())
+			conn.Close()
+			return
+		}
+		metrics.IncCounter(MetricConnectionsEstablishedL1)
+
+		l2, err := h2()
+		if err != nil {
+			log.Println("Error opening connection to L2:", err.Error())
+			l1.Close()
+			conn.Close()
+			return
+		}
+		metrics.IncCounter(MetricConnectionsEstablishedL2)
+
+		// The connection has been hijacked from the HTTP server, so the loop can run right here
+		// in the goroutine the HTTP server gave this request.
+		id := new(common.RequestID)
+		local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		info := trackConn("tcp:"+r.RemoteAddr, addrString(local), "websocket")
+		rp := &requestIDParser{
+			RequestParser: connParser{RequestParser: websocket.NewJSONParser(conn), info: info},
+			id:            id,
+		}
+		res := websocket.NewJSONResponder(conn)
+
+		orca, cancel := connOrca(o, l1, l2, res, id, nil)
+		lease := loopLeases.Start()
+		defer lease.Done()
+		s([]io.Closer{conn, l1, l2, cancel, info}, rp, orca).Loop()
+	})
+}
+
+// remoteAddr returns the client address of an HTTP request, or nil if it can't be parsed
+func remoteAddr(r *http.Request) net.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip}
+}
+
+// originAllowed reports whether a WebSocket request comes from the server's own origin, one of the
+// allowed ones, or not from a browser at all
+func originAllowed(allowed []string, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	for _, a := range allowed {
+		if a == "*" || strings.EqualFold(a, origin) {
+			return true
+		}
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
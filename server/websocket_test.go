@@ -0,0 +1,78 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	tests := []struct {
+		origin  string
+		allowed []string
+		ok      bool
+	}{
+		{"", nil, true},
+		{"http://rend.example.com:8080", nil, true},
+		{"http://RENDEXAMPLE.com", nil, false},
+		{"https://evil.example.com", nil, false},
+		{"https://tools.example.com", []string{"https://tools.example.com"}, true},
+		{"https://evil.example.com", []string{"https://tools.example.com"}, false},
+		{"https://evil.example.com", []string{"*"}, true},
+		{"null", nil, false},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "http://rend.example.com:8080/ws", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if ok := originAllowed(test.allowed, r); ok != test.ok {
+			t.Errorf("Expected origin %q with %v allowed to give %v, got %v", test.origin, test.allowed, test.ok, ok)
+		}
+	}
+}
+
+func TestWebSocketRejected(t *testing.T) {
+	_, n, _ := net.ParseCIDR("10.0.0.0/8")
+	// Nothing is dialed or upgraded for a rejected request
+	h := WebSocketHandler(WebSocketArgs{AllowedClients: []*net.IPNet{n}}, nil, nil, nil, nil)
+
+	tests := []struct {
+		name, remote, origin string
+	}{
+		{"Client", "192.168.0.1:1234", ""},
+		{"Unknown client", "pipe", ""},
+		{"Origin", "10.1.2.3:1234", "https://evil.example.com"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://rend.example.com/ws", nil)
+			r.RemoteAddr = test.remote
+			if test.origin != "" {
+				r.Header.Set("Origin", test.origin)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != http.StatusForbidden {
+				t.Fatalf("Expected the connection to be refused, got status %d", w.Code)
+			}
+		})
+	}
+}
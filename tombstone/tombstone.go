@@ -0,0 +1,171 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tombstone remembers recently deleted keys for a short while. Writes that carry data read
+// before a delete, like an L1 backfill from L2 or a repair of a lagging replica, can race with the
+// delete and bring the key back long after it was deleted. With a tombstone for the key they can
+// tell, and are dropped instead.
+package tombstone
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/timer"
+)
+
+var (
+	MetricAdded   = metrics.AddCounter("tombstones_added", nil)
+	MetricEvicted = metrics.AddCounter("tombstones_evicted", nil)
+	MetricBlocked = metrics.AddCounter("tombstones_blocked_writes", nil)
+	MetricUndone  = metrics.AddCounter("tombstones_undone_writes", nil)
+)
+
+const numShards = 16
+
+type entry struct {
+	key     string
+	deleted uint64
+}
+
+type shard struct {
+	lock sync.Mutex
+	// when each key was last deleted, and the same in the order they were added so the oldest
+	// can be dropped first. A key deleted again is in the queue more than once, and only the entry
+	// matching the map counts.
+	keys  map[string]uint64
+	queue []entry
+}
+
+// Set is a set of tombstones, shared by everything that deletes or backfills keys
+type Set struct {
+	ttl    uint64
+	max    int
+	shards [numShards]shard
+}
+
+// New makes a set that keeps each tombstone for ttl, and at most max of them, dropping the oldest
+// first when there are more
+func New(ttl time.Duration, max int) *Set {
+	s := &Set{
+		ttl: uint64(ttl),
+		max: max/numShards + 1,
+	}
+	for i := range s.shards {
+		s.shards[i].keys = make(map[string]uint64)
+	}
+
+	metrics.RegisterIntGaugeCallback("tombstones", nil, s.Len)
+
+	return s
+}
+
+func (s *Set) shard(key []byte) *shard {
+	h := fnv.New32a()
+	h.Write(key)
+	return &s.shards[h.Sum32()%numShards]
+}
+
+// expire drops tombstones that are too old or too many. The lock must be held.
+func (s *Set) expire(sh *shard, now uint64) {
+	for len(sh.queue) > 0 {
+		e := sh.queue[0]
+		if now-e.deleted < s.ttl && len(sh.keys) <= s.max {
+			return
+		}
+
+		if d, ok := sh.keys[e.key]; ok && d == e.deleted {
+			delete(sh.keys, e.key)
+			if now-e.deleted < s.ttl {
+				metrics.IncCounter(MetricEvicted)
+			}
+		}
+		sh.queue = sh.queue[1:]
+	}
+}
+
+// Add records that key is being deleted now. It should be called before the delete is done, so a
+// write that checks for the tombstone after doing its write can't miss it.
+func (s *Set) Add(key []byte) {
+	sh := s.shard(key)
+	now := timer.Now()
+
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+
+	sh.keys[string(key)] = now
+	sh.queue = append(sh.queue, entry{string(key), now})
+	s.expire(sh, now)
+
+	metrics.IncCounter(MetricAdded)
+}
+
+// DeletedSince reports whether key was deleted at or after since, a time from timer.Now
+func (s *Set) DeletedSince(key []byte, since uint64) bool {
+	sh := s.shard(key)
+	now := timer.Now()
+
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+
+	d, ok := sh.keys[string(key)]
+	return ok && d >= since && now-d < s.ttl
+}
+
+// Contains reports whether key has been deleted within the TTL
+func (s *Set) Contains(key []byte) bool {
+	return s.DeletedSince(key, 0)
+}
+
+// Len returns the number of tombstones
+func (s *Set) Len() uint64 {
+	var n uint64
+	now := timer.Now()
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.lock.Lock()
+		s.expire(sh, now)
+		n += uint64(len(sh.keys))
+		sh.lock.Unlock()
+	}
+	return n
+}
+
+// Guard does write, a write of key with data that was read at since, a time from timer.Now, unless
+// the key has been deleted since then. A delete that lands while the write is being done is
+// caught after it and the write is undone with undo, so the key stays deleted either way. A write
+// that's dropped doesn't fail.
+func (s *Set) Guard(key []byte, since uint64, write, undo func() error) error {
+	if s.DeletedSince(key, since) {
+		metrics.IncCounter(MetricBlocked)
+		return nil
+	}
+
+	if err := write(); err != nil {
+		return err
+	}
+
+	if s.DeletedSince(key, since) {
+		metrics.IncCounter(MetricUndone)
+		if err := undo(); err != nil && !errors.Is(err, common.ErrKeyNotFound) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tombstone_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/timer"
+	"github.com/netflix/rend/tombstone"
+)
+
+func TestSet(t *testing.T) {
+	s := tombstone.New(50*time.Millisecond, 1000)
+
+	before := timer.Now()
+	s.Add([]byte("foo"))
+	after := timer.Now()
+
+	if !s.Contains([]byte("foo")) || s.Contains([]byte("bar")) {
+		t.Fatal("Expected only foo to have a tombstone")
+	}
+	if !s.DeletedSince([]byte("foo"), before) || s.DeletedSince([]byte("foo"), after+1) {
+		t.Fatal("Expected foo to be deleted after before and not after after")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if s.Contains([]byte("foo")) || s.Len() != 0 {
+		t.Fatal("Expected the tombstone to expire")
+	}
+}
+
+func TestSetMax(t *testing.T) {
+	s := tombstone.New(time.Minute, 160)
+	for i := 0; i < 10000; i++ {
+		s.Add([]byte(fmt.Sprint(i)))
+	}
+	if n := s.Len(); n > 200 {
+		t.Fatalf("Expected about 160 tombstones, got %d", n)
+	}
+	if !s.Contains([]byte("9999")) {
+		t.Fatal("Expected the newest tombstone to be kept")
+	}
+}
+
+func TestGuard(t *testing.T) {
+	s := tombstone.New(time.Minute, 1000)
+	key := []byte("foo")
+
+	written, undone := false, false
+	write := func() error { written = true; return nil }
+	undo := func() error { undone = true; return common.ErrKeyNotFound }
+
+	// Deleted after the read, so the write is dropped
+	since := timer.Now()
+	s.Add(key)
+	if err := s.Guard(key, since, write, undo); err != nil || written {
+		t.Fatalf("Expected the write to be dropped, got %v %v", err, written)
+	}
+
+	// Read after the delete, so the write goes through
+	since = timer.Now()
+	if err := s.Guard(key, since, write, undo); err != nil || !written || undone {
+		t.Fatalf("Expected the write to be done, got %v %v %v", err, written, undone)
+	}
+
+	// Deleted while writing, so the write is undone
+	written = false
+	since = timer.Now()
+	write = func() error { written = true; s.Add(key); return nil }
+	if err := s.Guard(key, since, write, undo); err != nil || !written || !undone {
+		t.Fatalf("Expected the write to be undone, got %v %v %v", err, written, undone)
+	}
+
+	failed := errors.New("failed")
+	if err := s.Guard([]byte("bar"), timer.Now(), func() error { return failed }, undo); err != failed {
+		t.Fatalf("Expected the write's error, got %v", err)
+	}
+}
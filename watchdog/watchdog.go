@@ -0,0 +1,386 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package watchdog looks for goroutines and other resources that are never given back. Code that
+// hands out something that should be returned, like a goroutine feeding the responses of a get or a
+// pooled backend connection, takes a Lease of its Kind and ends it when the thing is returned.
+// While a Watchdog is running it checks every kind for leases held longer than they should ever
+// be, and the number of goroutines against the number of client connections. Everything it finds
+// is counted and logged, and a dump of every goroutine's stack can be written for each finding, so
+// the next leak comes with the stacks of the goroutines it left behind.
+package watchdog
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/timer"
+)
+
+var (
+	MetricGoroutines        = metrics.AddIntGauge("watchdog_goroutines", nil)
+	MetricGoroutinesPerConn = metrics.AddFloatGauge("watchdog_goroutines_per_conn", nil)
+	MetricGoroutineAlarms   = metrics.AddCounter("watchdog_goroutine_alarms", nil)
+	MetricDumps             = metrics.AddCounter("watchdog_dumps", nil)
+	MetricDumpErrors        = metrics.AddCounter("watchdog_dump_errors", nil)
+)
+
+// Leases are only kept while a watchdog is running, so there's no cost to them otherwise
+var enabled int32
+
+const numShards = 16
+
+// Kind is a kind of resource that's tracked with leases
+type Kind struct {
+	name string
+	// whether leases of this kind are leaked once they're older than the max age. Leases of
+	// long lived resources, like connections, are only counted.
+	aged bool
+
+	next   uint64
+	shards [numShards]struct {
+		lock sync.Mutex
+		m    map[uint64]*lease
+	}
+
+	metricOutstanding uint32
+	metricLeaked      uint32
+}
+
+type lease struct {
+	start uint64
+	// set once the lease has been counted as leaked, so it's only counted once
+	leaked bool
+}
+
+var (
+	kinds     []*Kind
+	kindsLock = new(sync.Mutex)
+)
+
+// NewKind registers a kind of resource. If aged is set, a lease held longer than the watchdog's
+// max age is reported as a leak. Kinds are meant to be package level variables.
+func NewKind(name string, aged bool) *Kind {
+	tags := metrics.Tags{"kind": name}
+	k := &Kind{
+		name:              name,
+		aged:              aged,
+		metricOutstanding: metrics.AddIntGauge("watchdog_outstanding", tags),
+		metricLeaked:      metrics.AddCounter("watchdog_leaks", tags),
+	}
+	for i := range k.shards {
+		k.shards[i].m = make(map[uint64]*lease)
+	}
+
+	kindsLock.Lock()
+	kinds = append(kinds, k)
+	kindsLock.Unlock()
+
+	return k
+}
+
+// Name returns the name of the kind
+func (k *Kind) Name() string {
+	return k.name
+}
+
+// Lease is one resource that's been handed out. The zero Lease is valid and does nothing.
+type Lease struct {
+	k  *Kind
+	id uint64
+}
+
+// Start takes a lease, which must be ended with Done
+func (k *Kind) Start() Lease {
+	if atomic.LoadInt32(&enabled) == 0 {
+		return Lease{}
+	}
+
+	id := atomic.AddUint64(&k.next, 1)
+	s := &k.shards[id%numShards]
+	s.lock.Lock()
+	s.m[id] = &lease{start: timer.Now()}
+	s.lock.Unlock()
+
+	return Lease{k: k, id: id}
+}
+
+// Done ends the lease. Calling it more than once is harmless.
+func (l Lease) Done() {
+	if l.k == nil {
+		return
+	}
+
+	s := &l.k.shards[l.id%numShards]
+	s.lock.Lock()
+	delete(s.m, l.id)
+	s.lock.Unlock()
+}
+
+// scan counts the outstanding leases and marks the ones older than maxAge as leaked, returning how
+// many there are of each along with the age of the oldest
+func (k *Kind) scan(maxAge time.Duration) (outstanding, leaked int, oldest time.Duration) {
+	now := timer.Now()
+
+	for i := range k.shards {
+		s := &k.shards[i]
+		s.lock.Lock()
+		outstanding += len(s.m)
+		for _, l := range s.m {
+			age := time.Duration(now - l.start)
+			if age > oldest {
+				oldest = age
+			}
+			if k.aged && !l.leaked && age > maxAge {
+				l.leaked = true
+				leaked++
+			}
+		}
+		s.lock.Unlock()
+	}
+
+	return outstanding, leaked, oldest
+}
+
+// Config is how the watchdog checks for leaks
+type Config struct {
+	// Interval is how often the watchdog checks
+	Interval time.Duration
+	// MaxAge is how long a lease of an aged kind can be held before it's a leak
+	MaxAge time.Duration
+	// GoroutinesPerConn is how many goroutines each client connection is expected to need at most,
+	// beyond the ones the process had when the watchdog started. More than that is reported as a
+	// possible leak. 0 turns the check off.
+	GoroutinesPerConn int
+	// Conns returns the number of client connections being served
+	Conns func() int
+	// DumpDir is where the stacks of every goroutine are written when a leak is found. Empty
+	// disables dumps.
+	DumpDir string
+	// DumpInterval is the least time between two dumps, so a leak that keeps growing doesn't fill
+	// the disk
+	DumpInterval time.Duration
+}
+
+// Watchdog checks for leaks in the background
+type Watchdog struct {
+	conf     Config
+	baseline int
+	stop     chan struct{}
+	wg       sync.WaitGroup
+
+	lock     sync.Mutex
+	status   Status
+	lastDump time.Time
+	alarmed  bool
+}
+
+// KindStatus is what the last check found for one kind
+type KindStatus struct {
+	Name        string        `json:"name"`
+	Outstanding int           `json:"outstanding"`
+	Leaked      int           `json:"leaked"`
+	OldestAge   time.Duration `json:"oldest_age_ns"`
+}
+
+// Status is what the last check found
+type Status struct {
+	Checked    time.Time    `json:"checked"`
+	Goroutines int          `json:"goroutines"`
+	Baseline   int          `json:"baseline"`
+	Conns      int          `json:"conns"`
+	Kinds      []KindStatus `json:"kinds"`
+	LastDump   string       `json:"last_dump,omitempty"`
+}
+
+// Start starts checking for leaks. Only leases taken after this are tracked. There should only be
+// one watchdog running at a time.
+func Start(c Config) (*Watchdog, error) {
+	if c.Interval <= 0 || c.MaxAge <= 0 {
+		return nil, fmt.Errorf("watchdog interval and max age must be > 0")
+	}
+	if c.GoroutinesPerConn < 0 {
+		return nil, fmt.Errorf("watchdog goroutines per connection must be >= 0")
+	}
+	if c.Conns == nil {
+		c.Conns = func() int { return 0 }
+	}
+	if c.DumpDir != "" {
+		if err := os.MkdirAll(c.DumpDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	w := &Watchdog{
+		conf:     c,
+		baseline: runtime.NumGoroutine(),
+		stop:     make(chan struct{}),
+	}
+	atomic.StoreInt32(&enabled, 1)
+
+	w.wg.Add(1)
+	go w.run()
+
+	return w, nil
+}
+
+// Stop stops the checks. Leases aren't tracked anymore after this.
+func (w *Watchdog) Stop() {
+	atomic.StoreInt32(&enabled, 0)
+	close(w.stop)
+	w.wg.Wait()
+}
+
+func (w *Watchdog) run() {
+	defer w.wg.Done()
+
+	t := time.NewTicker(w.conf.Interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-t.C:
+			w.Check()
+		}
+	}
+}
+
+// Check checks for leaks right away, and returns what it found
+func (w *Watchdog) Check() Status {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	st := Status{
+		Checked:    time.Now(),
+		Goroutines: runtime.NumGoroutine(),
+		Baseline:   w.baseline,
+		Conns:      w.conf.Conns(),
+		LastDump:   w.status.LastDump,
+	}
+
+	var found []string
+
+	kindsLock.Lock()
+	ks := append([]*Kind(nil), kinds...)
+	kindsLock.Unlock()
+
+	for _, k := range ks {
+		outstanding, leaked, oldest := k.scan(w.conf.MaxAge)
+		metrics.SetIntGauge(k.metricOutstanding, uint64(outstanding))
+
+		if leaked > 0 {
+			metrics.IncCounterBy(k.metricLeaked, uint64(leaked))
+			found = append(found, fmt.Sprintf("%d %s held for over %v", leaked, k.name, w.conf.MaxAge))
+		}
+
+		st.Kinds = append(st.Kinds, KindStatus{
+			Name:        k.name,
+			Outstanding: outstanding,
+			Leaked:      leaked,
+			OldestAge:   oldest,
+		})
+	}
+	sort.Slice(st.Kinds, func(i, j int) bool { return st.Kinds[i].Name < st.Kinds[j].Name })
+
+	extra := st.Goroutines - w.baseline
+	if extra < 0 {
+		extra = 0
+	}
+	metrics.SetIntGauge(MetricGoroutines, uint64(st.Goroutines))
+	if st.Conns > 0 {
+		metrics.SetFloatGauge(MetricGoroutinesPerConn, float64(extra)/float64(st.Conns))
+	} else {
+		metrics.SetFloatGauge(MetricGoroutinesPerConn, 0)
+	}
+
+	// With no connections the goroutines of one are still allowed for, since requests on the admin
+	// port and background work come and go
+	if w.conf.GoroutinesPerConn > 0 {
+		conns := st.Conns
+		if conns == 0 {
+			conns = 1
+		}
+		over := extra > w.conf.GoroutinesPerConn*conns
+
+		// Only the start of an alarm is reported, not every check it lasts through
+		if over && !w.alarmed {
+			metrics.IncCounter(MetricGoroutineAlarms)
+			found = append(found, fmt.Sprintf("%d goroutines for %d connections, %d when the watchdog started", st.Goroutines, st.Conns, w.baseline))
+		}
+		w.alarmed = over
+	}
+
+	for _, f := range found {
+		log.Println("Possible leak:", f)
+	}
+	if len(found) > 0 {
+		if path := w.dump(st.Checked); path != "" {
+			st.LastDump = path
+		}
+	}
+
+	w.status = st
+	return st
+}
+
+// dump writes the stacks of every goroutine to a new file in the dump directory, unless a dump was
+// written too recently, and returns its path
+func (w *Watchdog) dump(now time.Time) string {
+	if w.conf.DumpDir == "" || now.Sub(w.lastDump) < w.conf.DumpInterval {
+		return ""
+	}
+	w.lastDump = now
+
+	path := filepath.Join(w.conf.DumpDir, "goroutines-"+now.Format("20060102T150405.000")+".txt")
+	f, err := os.Create(path)
+	if err != nil {
+		log.Println("Error writing goroutine dump:", err.Error())
+		metrics.IncCounter(MetricDumpErrors)
+		return ""
+	}
+	defer f.Close()
+
+	if err := pprof.Lookup("goroutine").WriteTo(f, 2); err != nil {
+		log.Println("Error writing goroutine dump:", err.Error())
+		metrics.IncCounter(MetricDumpErrors)
+		return ""
+	}
+
+	metrics.IncCounter(MetricDumps)
+	log.Println("Wrote the stacks of every goroutine to", path)
+	return path
+}
+
+// ServeHTTP reports what the last check found as JSON
+func (w *Watchdog) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	w.lock.Lock()
+	st := w.status
+	w.lock.Unlock()
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(st)
+}
@@ -0,0 +1,122 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watchdog_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/watchdog"
+)
+
+var (
+	aged      = watchdog.NewKind("test_aged", true)
+	longLived = watchdog.NewKind("test_long_lived", false)
+)
+
+func kind(st watchdog.Status, name string) watchdog.KindStatus {
+	for _, k := range st.Kinds {
+		if k.Name == name {
+			return k
+		}
+	}
+	return watchdog.KindStatus{}
+}
+
+func TestWatchdog(t *testing.T) {
+	// A lease taken while no watchdog is running does nothing
+	aged.Start().Done()
+
+	dir := t.TempDir()
+	w, err := watchdog.Start(watchdog.Config{
+		Interval:          time.Hour,
+		MaxAge:            10 * time.Millisecond,
+		GoroutinesPerConn: 2,
+		Conns:             func() int { return 1 },
+		DumpDir:           dir,
+		DumpInterval:      time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+
+	leaked := aged.Start()
+	conn := longLived.Start()
+	aged.Start().Done()
+	time.Sleep(20 * time.Millisecond)
+
+	st := w.Check()
+	if k := kind(st, "test_aged"); k.Outstanding != 1 || k.Leaked != 1 || k.OldestAge < 10*time.Millisecond {
+		t.Fatalf("Expected the held lease to be leaked, got %+v", k)
+	}
+	if k := kind(st, "test_long_lived"); k.Outstanding != 1 || k.Leaked != 0 {
+		t.Fatalf("Expected long lived leases to only be counted, got %+v", k)
+	}
+	if st.LastDump == "" || !strings.HasPrefix(st.LastDump, dir) {
+		t.Fatalf("Expected a goroutine dump in %s, got %q", dir, st.LastDump)
+	}
+	dump, err := ioutil.ReadFile(st.LastDump)
+	if err != nil || !strings.Contains(string(dump), "goroutine") {
+		t.Fatalf("Unexpected dump %v", err)
+	}
+
+	// A leak is only counted once, however many checks see it
+	if k := kind(w.Check(), "test_aged"); k.Outstanding != 1 || k.Leaked != 0 {
+		t.Fatalf("Expected the leak to only be counted once, got %+v", k)
+	}
+
+	leaked.Done()
+	conn.Done()
+	conn.Done()
+	st = w.Check()
+	if k := kind(st, "test_aged"); k.Outstanding != 0 {
+		t.Fatalf("Expected no leases left, got %+v", k)
+	}
+	if k := kind(st, "test_long_lived"); k.Outstanding != 0 {
+		t.Fatalf("Expected no leases left, got %+v", k)
+	}
+
+	// Goroutines beyond what one connection needs
+	stop := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		go func() { <-stop }()
+	}
+	defer close(stop)
+
+	st = w.Check()
+	if st.Goroutines < st.Baseline+10 {
+		t.Fatalf("Expected the extra goroutines to be counted, got %+v", st)
+	}
+	dumps, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(dumps) != 1 {
+		t.Fatalf("Expected no second dump within the dump interval, got %v", dumps)
+	}
+}
+
+func TestBadConfig(t *testing.T) {
+	for _, c := range []watchdog.Config{
+		{MaxAge: time.Minute},
+		{Interval: time.Second},
+		{Interval: time.Second, MaxAge: time.Minute, GoroutinesPerConn: -1},
+	} {
+		if _, err := watchdog.Start(c); err == nil {
+			t.Fatalf("Expected %+v to be rejected", c)
+		}
+	}
+}